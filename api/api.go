@@ -0,0 +1,193 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package api defines the JSON responses of the HTTP API. The server
+// encodes the responses with these types and the client package decodes
+// them with the same types. The package does not depend on the database
+// package so that clients do not import the server's storage.
+package api
+
+import (
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+// Package is the response of the /-/api/json/<path> endpoint: the
+// stored documentation of a package and the security advisories for the
+// package.
+type Package struct {
+	*doc.Package
+	Advisories []Advisory `json:"advisories"`
+}
+
+// Advisory is a security advisory for a package or the packages below an
+// import path.
+type Advisory struct {
+	ID string `json:"id"`
+
+	// Path is the import path of the affected package. If Prefix is true,
+	// the packages below Path are also affected.
+	Path   string `json:"path"`
+	Prefix bool   `json:"prefix,omitempty"`
+
+	// Versions are the affected version ranges. Commits lists affected
+	// commits that are not covered by a range. All versions are affected
+	// if both are empty.
+	Versions []VersionRange `json:"versions,omitempty"`
+	Commits  []string       `json:"commits,omitempty"`
+
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	URL      string `json:"url"`
+}
+
+// VersionRange is a range of tagged versions. Introduced is the first
+// affected tag and Fixed is the first tag that is not affected. An empty
+// bound leaves the range open on that side.
+type VersionRange struct {
+	Introduced string `json:"introduced,omitempty"`
+	Fixed      string `json:"fixed,omitempty"`
+}
+
+// SearchResult is a package in the results of a search.
+type SearchResult struct {
+	Path     string `json:"path"`
+	Synopsis string `json:"synopsis,omitempty"`
+
+	// True if the package does not have a package comment and the synopsis
+	// is derived from an ancestor package.
+	SynopsisDerived bool `json:"synopsisDerived,omitempty"`
+
+	// Summary of the package contents for packages without a synopsis.
+	Summary string `json:"summary,omitempty"`
+
+	// Import path of the newest major version of the package if the
+	// project keeps newer major versions in subdirectories.
+	NewestMajor string `json:"newestMajor,omitempty"`
+
+	// Severity of the most severe advisory for the package.
+	Advisory string `json:"advisory,omitempty"`
+
+	// Detected language of the package comment or "" if the language is
+	// unknown.
+	Language string `json:"language,omitempty"`
+
+	// Names of the exported types in the package that implement the
+	// interface of an implements: query.
+	Implementations []string `json:"implementations,omitempty"`
+
+	// Ranges of the synopsis that match the query terms.
+	SynopsisMatches []Match `json:"synopsisMatches,omitempty"`
+
+	// Part of the package comment around the first match of a query term
+	// and the ranges of the excerpt that match the terms. Set where no term
+	// matches the synopsis.
+	Excerpt        string  `json:"excerpt,omitempty"`
+	ExcerptMatches []Match `json:"excerptMatches,omitempty"`
+}
+
+// Match is a range of bytes in a text that matches a query term.
+type Match struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SearchResponse is the response of the /search endpoint on the API host.
+type SearchResponse struct {
+	Results []SearchResult `json:"results"`
+
+	// Session is the token to pass with the next incremental query.
+	Session string `json:"session,omitempty"`
+}
+
+// Card is the response of the /-/api/card/<path> endpoint: a compact
+// description of a package.
+type Card struct {
+	Path     string        `json:"path"`
+	Name     string        `json:"name"`
+	IsCmd    bool          `json:"command,omitempty"`
+	Synopsis string        `json:"synopsis,omitempty"`
+	Notable  []doc.Notable `json:"notable,omitempty"`
+	Updated  time.Time     `json:"updated"`
+
+	// Importers is the number of packages that import the package.
+	Importers int `json:"importers"`
+}
+
+// ExistsResponse is the response of the /-/api/exists/<path> endpoint.
+type ExistsResponse struct {
+	Exists bool `json:"exists"`
+}
+
+// Identifier is an exported identifier of a package.
+type Identifier struct {
+	Name string `json:"name"`
+
+	// Type is the receiver type of a method.
+	Type string `json:"type,omitempty"`
+
+	// Anchor is the fragment of the declaration on the package page.
+	Anchor string `json:"anchor"`
+}
+
+// IdentifiersResponse is the response of the
+// /-/api/identifiers/<path> endpoint.
+type IdentifiersResponse struct {
+	Identifiers []Identifier `json:"identifiers"`
+}
+
+// ServiceStatus is the state of a project host.
+type ServiceStatus struct {
+	Host      string    `json:"host"`
+	State     string    `json:"state"`
+	LastFetch time.Time `json:"lastFetch"`
+}
+
+// CacheUsage is the memory usage of a cache.
+type CacheUsage struct {
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Evictions int    `json:"evictions"`
+	Evicted   int    `json:"evicted"`
+}
+
+// StorageUsage is the usage of a persistent store.
+type StorageUsage struct {
+	Name  string `json:"name"`
+	Items int    `json:"items"`
+	Bytes int64  `json:"bytes"`
+}
+
+// MemoryStatus is the memory usage of the server.
+type MemoryStatus struct {
+	Limit   int64          `json:"limit"`
+	Heap    int64          `json:"heap"`
+	Caches  []CacheUsage   `json:"caches"`
+	Storage []StorageUsage `json:"storage"`
+}
+
+// Status is the response of the /-/api/status endpoint.
+type Status struct {
+	Services []ServiceStatus `json:"services"`
+	Memory   MemoryStatus    `json:"memory"`
+}
+
+// ErrorResponse is the body of an API response with an error status.
+type ErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
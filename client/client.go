@@ -0,0 +1,331 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package client is a client for the GoDoc.org HTTP API.
+//
+// The methods of a Client are safe for concurrent use. The responses are
+// decoded with the types in the api package, the same types that the server
+// encodes.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/api"
+)
+
+// maxETags is the maximum number of ETags cached by a client.
+const maxETags = 1000
+
+// ErrNotModified is returned by GetPackage when the package is not modified
+// since the previous call to GetPackage for the package.
+var ErrNotModified = errors.New("client: not modified")
+
+// NotFoundError is returned when the package is not found.
+type NotFoundError struct {
+	Path string
+}
+
+func (e *NotFoundError) Error() string {
+	return "client: package " + e.Path + " not found"
+}
+
+// RateLimitedError is returned when the request is rejected by the rate
+// limit of the server.
+type RateLimitedError struct {
+	// Limit and Remaining are the number of requests per window and the
+	// number of requests remaining in the window.
+	Limit, Remaining int
+
+	// Reset is the end of the window.
+	Reset time.Time
+
+	// RetryAfter is the time to wait before the next request.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("client: rate limited, retry after %v", e.RetryAfter)
+}
+
+// ServerError is returned for responses with a 5xx status.
+type ServerError struct {
+	Status  int
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("client: server error %d: %s", e.Status, e.Message)
+}
+
+// StatusError is returned for responses with an unexpected status that is
+// not reported with one of the other error types.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: status %d: %s", e.Status, e.Message)
+}
+
+// Client is a client for the API.
+type Client struct {
+	// SiteURL is the URL of the site, for example "https://godoc.org".
+	SiteURL string
+
+	// APIURL is the URL of the API host. Search requests are sent to this
+	// host.
+	APIURL string
+
+	// HTTPClient is the client used to send requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// MaxRetryWait is the longest Retry-After delay that the client waits
+	// for before retrying a rate limited request. If zero, the client does
+	// not retry and returns a *RateLimitedError.
+	MaxRetryWait time.Duration
+
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+// New returns a client for the site at siteURL. The URL of the API host is
+// derived from siteURL by adding the "api." prefix to the host name.
+func New(siteURL string) *Client {
+	siteURL = strings.TrimRight(siteURL, "/")
+	apiURL := siteURL
+	if u, err := url.Parse(siteURL); err == nil && u.Host != "" {
+		u.Host = "api." + u.Host
+		apiURL = u.String()
+	}
+	return &Client{SiteURL: siteURL, APIURL: apiURL}
+}
+
+// GetOptions are the options for GetPackage.
+type GetOptions struct {
+	// Unconditional disables the conditional request. GetPackage does not
+	// return ErrNotModified when set.
+	Unconditional bool
+}
+
+// GetPackage returns the stored documentation of the package at path.
+// GetPackage returns ErrNotModified if the documentation did not change
+// since the previous call for the path.
+func (c *Client) GetPackage(ctx context.Context, path string, opts *GetOptions) (*api.Package, error) {
+	header := http.Header{}
+	if opts == nil || !opts.Unconditional {
+		if etag := c.etag(path); etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+	}
+	resp, err := c.do(ctx, c.SiteURL+"/-/api/json/"+escapePath(path), header, path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
+	var data api.Package
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	c.setETag(path, resp.Header.Get("Etag"))
+	return &data, nil
+}
+
+// SearchOptions are the options for Search.
+type SearchOptions struct {
+	// Scope restricts the search to the packages in a project root.
+	Scope string
+
+	// Incremental enables search as you type queries. Session is the
+	// session token from the previous incremental response.
+	Incremental bool
+	Session     string
+}
+
+// Search searches for packages.
+func (c *Client) Search(ctx context.Context, q string, opts *SearchOptions) (*api.SearchResponse, error) {
+	v := url.Values{"q": {q}}
+	if opts != nil {
+		if opts.Scope != "" {
+			v.Set("scope", opts.Scope)
+		}
+		if opts.Incremental {
+			v.Set("session", opts.Session)
+		}
+	}
+	var data api.SearchResponse
+	if err := c.getJSON(ctx, c.APIURL+"/search?"+v.Encode(), "", &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Exists returns whether the package at path is in the index.
+func (c *Client) Exists(ctx context.Context, path string) (bool, error) {
+	var data api.ExistsResponse
+	if err := c.getJSON(ctx, c.SiteURL+"/-/api/exists/"+escapePath(path), path, &data); err != nil {
+		return false, err
+	}
+	return data.Exists, nil
+}
+
+// Identifiers returns the exported identifiers of the package at path.
+func (c *Client) Identifiers(ctx context.Context, path string) ([]api.Identifier, error) {
+	var data api.IdentifiersResponse
+	if err := c.getJSON(ctx, c.SiteURL+"/-/api/identifiers/"+escapePath(path), path, &data); err != nil {
+		return nil, err
+	}
+	return data.Identifiers, nil
+}
+
+// Card returns the summary card of the package at path.
+func (c *Client) Card(ctx context.Context, path string) (*api.Card, error) {
+	var data api.Card
+	if err := c.getJSON(ctx, c.SiteURL+"/-/api/card/"+escapePath(path), path, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Status returns the state of the project hosts and the memory usage of the
+// server.
+func (c *Client) Status(ctx context.Context) (*api.Status, error) {
+	var data api.Status
+	if err := c.getJSON(ctx, c.SiteURL+"/-/api/status", "", &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, u string, path string, v interface{}) error {
+	resp, err := c.do(ctx, u, nil, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends a GET request and returns the response for 2xx and 304 status
+// codes. Other status codes are returned as errors. Path is the import path
+// reported in a *NotFoundError.
+func (c *Client) do(ctx context.Context, u string, header http.Header, path string) (*http.Response, error) {
+	for {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Accept", "application/json")
+		httpClient := c.HTTPClient
+		if httpClient == nil {
+			httpClient = http.DefaultClient
+		}
+		resp, err := httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotModified {
+			return resp, nil
+		}
+		err = responseError(resp, path)
+		resp.Body.Close()
+		if e, ok := err.(*RateLimitedError); ok && c.MaxRetryWait > 0 && e.RetryAfter <= c.MaxRetryWait {
+			t := time.NewTimer(e.RetryAfter)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+			continue
+		}
+		return nil, err
+	}
+}
+
+// responseError returns the error for a response with an error status.
+func responseError(resp *http.Response, path string) error {
+	var data api.ErrorResponse
+	p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(p, &data) != nil || data.Error.Message == "" {
+		data.Error.Message = http.StatusText(resp.StatusCode)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && path != "":
+		return &NotFoundError{Path: path}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return rateLimitedError(resp.Header)
+	case resp.StatusCode/100 == 5:
+		return &ServerError{Status: resp.StatusCode, Message: data.Error.Message}
+	default:
+		return &StatusError{Status: resp.StatusCode, Message: data.Error.Message}
+	}
+}
+
+// rateLimitedError returns the error for the rate limit headers in h.
+func rateLimitedError(h http.Header) *RateLimitedError {
+	e := &RateLimitedError{}
+	e.Limit, _ = strconv.Atoi(h.Get("X-Ratelimit-Limit"))
+	e.Remaining, _ = strconv.Atoi(h.Get("X-Ratelimit-Remaining"))
+	if n, err := strconv.ParseInt(h.Get("X-Ratelimit-Reset"), 10, 64); err == nil {
+		e.Reset = time.Unix(n, 0)
+	}
+	if n, err := strconv.Atoi(h.Get("Retry-After")); err == nil && n >= 0 {
+		e.RetryAfter = time.Duration(n) * time.Second
+	}
+	return e
+}
+
+func (c *Client) etag(path string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.etags[path]
+}
+
+func (c *Client) setETag(path, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if etag == "" {
+		delete(c.etags, path)
+		return
+	}
+	if c.etags == nil || len(c.etags) >= maxETags {
+		c.etags = make(map[string]string)
+	}
+	c.etags[path] = etag
+}
+
+// escapePath escapes an import path for use in a URL path.
+func escapePath(path string) string {
+	return (&url.URL{Path: path}).String()
+}
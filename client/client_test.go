@@ -0,0 +1,277 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/api"
+)
+
+// replayServer is a test server that replays the recorded responses in
+// testdata. The fixture function returns the name of the response file for
+// a request.
+type replayServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newReplayServer(t *testing.T, fixture func(r *http.Request) string) *replayServer {
+	s := &replayServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.mu.Unlock()
+		f, err := os.Open(filepath.Join("testdata", fixture(r)+".http"))
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		resp, err := http.ReadResponse(bufio.NewReader(f), r)
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	return s
+}
+
+func (s *replayServer) client() *Client {
+	return &Client{SiteURL: s.URL, APIURL: s.URL}
+}
+
+func (s *replayServer) request(i int) *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i >= len(s.requests) {
+		return nil
+	}
+	return s.requests[i]
+}
+
+func TestNew(t *testing.T) {
+	c := New("https://godoc.org/")
+	if c.SiteURL != "https://godoc.org" || c.APIURL != "https://api.godoc.org" {
+		t.Errorf("New() = %q, %q, want https://godoc.org, https://api.godoc.org", c.SiteURL, c.APIURL)
+	}
+}
+
+func TestGetPackage(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string {
+		if r.URL.Path != "/-/api/json/github.com/user/repo" {
+			return "not-found"
+		}
+		if r.Header.Get("If-None-Match") == `"abc123"` {
+			return "not-modified"
+		}
+		return "package"
+	})
+	defer s.Close()
+	c := s.client()
+	ctx := context.Background()
+
+	pdoc, err := c.GetPackage(ctx, "github.com/user/repo", nil)
+	if err != nil {
+		t.Fatalf("GetPackage() returned error %v", err)
+	}
+	if pdoc.ImportPath != "github.com/user/repo" || pdoc.Synopsis != "Package repo does things." || pdoc.Advisories == nil {
+		t.Errorf("GetPackage() = %+v", pdoc)
+	}
+	if h := s.request(0).Header.Get("If-None-Match"); h != "" {
+		t.Errorf("first request If-None-Match = %q, want none", h)
+	}
+
+	if _, err := c.GetPackage(ctx, "github.com/user/repo", nil); err != ErrNotModified {
+		t.Errorf("second GetPackage() returned error %v, want ErrNotModified", err)
+	}
+
+	if _, err := c.GetPackage(ctx, "github.com/user/repo", &GetOptions{Unconditional: true}); err != nil {
+		t.Errorf("unconditional GetPackage() returned error %v", err)
+	}
+	if h := s.request(2).Header.Get("If-None-Match"); h != "" {
+		t.Errorf("unconditional request If-None-Match = %q, want none", h)
+	}
+
+	_, err = c.GetPackage(ctx, "github.com/user/missing", nil)
+	if e, ok := err.(*NotFoundError); !ok || e.Path != "github.com/user/missing" {
+		t.Errorf("GetPackage(missing) returned error %v, want *NotFoundError", err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "rate-limited" })
+	defer s.Close()
+	c := s.client()
+	c.MaxRetryWait = time.Second
+
+	_, err := c.Exists(context.Background(), "github.com/user/repo")
+	e, ok := err.(*RateLimitedError)
+	if !ok {
+		t.Fatalf("Exists() returned error %v, want *RateLimitedError", err)
+	}
+	want := &RateLimitedError{Limit: 60, Remaining: 0, Reset: time.Unix(1381017630, 0), RetryAfter: 30 * time.Second}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("Exists() returned error %+v, want %+v", e, want)
+	}
+}
+
+func TestRateLimitedRetry(t *testing.T) {
+	var mu sync.Mutex
+	n := 0
+	s := newReplayServer(t, func(r *http.Request) string {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		if n == 1 {
+			return "rate-limited-retry"
+		}
+		return "exists"
+	})
+	defer s.Close()
+	c := s.client()
+
+	if _, err := c.Exists(context.Background(), "github.com/user/repo"); err == nil {
+		t.Fatal("Exists() without MaxRetryWait returned nil error")
+	}
+
+	c.MaxRetryWait = time.Second
+	n = 0
+	exists, err := c.Exists(context.Background(), "github.com/user/repo")
+	if err != nil || !exists {
+		t.Errorf("Exists() = %v, %v, want true, nil", exists, err)
+	}
+	if n != 2 {
+		t.Errorf("server handled %d requests, want 2", n)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "rate-limited" })
+	defer s.Close()
+	c := s.client()
+	c.MaxRetryWait = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Status(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Status() returned error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "server-error" })
+	defer s.Close()
+
+	_, err := s.client().Card(context.Background(), "github.com/user/repo")
+	if e, ok := err.(*ServerError); !ok || e.Status != 500 || e.Message != "Internal Server Error" {
+		t.Errorf("Card() returned error %v, want *ServerError", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "search" })
+	defer s.Close()
+
+	data, err := s.client().Search(context.Background(), "repo", &SearchOptions{Incremental: true, Session: "s1"})
+	if err != nil {
+		t.Fatalf("Search() returned error %v", err)
+	}
+	if len(data.Results) != 2 || data.Results[0].Path != "github.com/user/repo" || data.Session != "s2" {
+		t.Errorf("Search() = %+v", data)
+	}
+	r := s.request(0)
+	if r.URL.Path != "/search" || r.FormValue("q") != "repo" || r.FormValue("session") != "s1" {
+		t.Errorf("Search() requested %s", r.URL)
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "identifiers" })
+	defer s.Close()
+
+	ids, err := s.client().Identifiers(context.Background(), "github.com/user/repo")
+	want := []api.Identifier{{Name: "Client", Anchor: "Client"}, {Name: "Do", Type: "Client", Anchor: "Client.Do"}}
+	if err != nil || !reflect.DeepEqual(ids, want) {
+		t.Errorf("Identifiers() = %+v, %v, want %+v", ids, err, want)
+	}
+	if p := s.request(0).URL.Path; p != "/-/api/identifiers/github.com/user/repo" {
+		t.Errorf("Identifiers() requested %s", p)
+	}
+}
+
+func TestCard(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "card" })
+	defer s.Close()
+
+	card, err := s.client().Card(context.Background(), "github.com/user/repo")
+	if err != nil {
+		t.Fatalf("Card() returned error %v", err)
+	}
+	if card.Path != "github.com/user/repo" || card.Importers != 3 || !card.Updated.Equal(time.Date(2013, 10, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Card() = %+v", card)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "status" })
+	defer s.Close()
+
+	status, err := s.client().Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status() returned error %v", err)
+	}
+	if len(status.Services) != 1 || status.Services[0].Host != "github.com" || len(status.Memory.Caches) != 1 {
+		t.Errorf("Status() = %+v", status)
+	}
+}
+
+func TestConcurrentGetPackage(t *testing.T) {
+	s := newReplayServer(t, func(r *http.Request) string { return "package" })
+	defer s.Close()
+	c := s.client()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.GetPackage(context.Background(), "github.com/user/repo", &GetOptions{Unconditional: true})
+		}()
+	}
+	wg.Wait()
+	if etag := c.etag("github.com/user/repo"); etag != `"abc123"` {
+		t.Errorf("cached etag = %q, want %q", etag, `"abc123"`)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Severities of advisories from least to most severe.
+const (
+	SeverityLow      = "low"
+	SeverityModerate = "moderate"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+var severityRank = map[string]int{
+	SeverityLow:      1,
+	SeverityModerate: 2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// SeverityRank returns the rank of an advisory severity. More severe
+// advisories have a higher rank. Unknown severities have rank 0.
+func SeverityRank(severity string) int {
+	return severityRank[severity]
+}
+
+// advisoryTerm is the search term for packages with an advisory.
+const advisoryTerm = "has:advisory"
+
+// Advisory is a security advisory for a package or the packages below an
+// import path.
+type Advisory struct {
+	ID string `json:"id"`
+
+	// Path is the import path of the affected package. If Prefix is true,
+	// the packages below Path are also affected.
+	Path   string `json:"path"`
+	Prefix bool   `json:"prefix,omitempty"`
+
+	// Versions are the affected version ranges. Commits lists affected
+	// commits that are not covered by a range. All versions are affected
+	// if both are empty.
+	Versions []VersionRange `json:"versions,omitempty"`
+	Commits  []string       `json:"commits,omitempty"`
+
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	URL      string `json:"url"`
+}
+
+// VersionRange is a range of tagged versions. Introduced is the first
+// affected tag and Fixed is the first tag that is not affected. An empty
+// bound leaves the range open on that side.
+type VersionRange struct {
+	Introduced string `json:"introduced,omitempty"`
+	Fixed      string `json:"fixed,omitempty"`
+}
+
+// pattern returns the member of the advisoryPaths set for the advisory.
+func (a *Advisory) pattern() string {
+	if a.Prefix {
+		return a.Path + "/..."
+	}
+	return a.Path
+}
+
+// MatchesPath returns true if the advisory applies to the package with the
+// given import path. A prefix matches whole path elements only, so the
+// prefix example.com/foo does not match example.com/foobar.
+func (a *Advisory) MatchesPath(path string) bool {
+	return matchAdvisoryPattern(a.pattern(), path)
+}
+
+func matchAdvisoryPattern(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "/...") {
+		prefix := pattern[:len(pattern)-len("/...")]
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+	return path == pattern
+}
+
+// AffectsVersion returns true if the advisory applies to the given version
+// of a package. The version is a tag or a commit. The empty version is the
+// current documentation, which is reported as affected. A version that is
+// not a listed commit and not a comparable tag is also reported as
+// affected because the advisory cannot rule it out.
+func (a *Advisory) AffectsVersion(version string) bool {
+	if version == "" || (len(a.Versions) == 0 && len(a.Commits) == 0) {
+		return true
+	}
+	for _, c := range a.Commits {
+		if c == version || (len(version) >= 7 && strings.HasPrefix(c, version)) {
+			return true
+		}
+	}
+	v, ok := parseVersion(version)
+	if !ok {
+		return true
+	}
+	for _, r := range a.Versions {
+		if r.Introduced != "" {
+			introduced, _ := parseVersion(r.Introduced)
+			if compareVersions(v, introduced) < 0 {
+				continue
+			}
+		}
+		if r.Fixed != "" {
+			fixed, _ := parseVersion(r.Fixed)
+			if compareVersions(v, fixed) >= 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// parseVersion parses a tag of the form v1.2.3 or 1.2.3 with one or more
+// numeric components. Pre-release and build suffixes are not supported.
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(s, "v")
+	if s == "" {
+		return nil, false
+	}
+	var v []int
+	for _, f := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || f[0] == '+' {
+			return nil, false
+		}
+		v = append(v, n)
+	}
+	return v, true
+}
+
+// compareVersions returns -1, 0 or 1 as a is less than, equal to or
+// greater than b. Missing components compare as zero.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// ValidateAdvisory returns an error if the advisory is incomplete or has an
+// invalid path, severity, reference URL or version range.
+func ValidateAdvisory(a *Advisory) error {
+	if strings.TrimSpace(a.ID) == "" {
+		return fmt.Errorf("missing id")
+	}
+	if err := ValidateBlockRule(BlockPath, a.Path); err != nil {
+		return err
+	}
+	if severityRank[a.Severity] == 0 {
+		return fmt.Errorf("unknown severity %q", a.Severity)
+	}
+	if strings.TrimSpace(a.Summary) == "" {
+		return fmt.Errorf("missing summary")
+	}
+	u, err := url.Parse(a.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("reference URL %q is not an absolute http or https URL", a.URL)
+	}
+	for _, r := range a.Versions {
+		if r.Introduced == "" && r.Fixed == "" {
+			return fmt.Errorf("version range has no bounds")
+		}
+		for _, s := range []string{r.Introduced, r.Fixed} {
+			if _, ok := parseVersion(s); s != "" && !ok {
+				return fmt.Errorf("version %q is not a tag of the form v1.2.3", s)
+			}
+		}
+		if r.Introduced != "" && r.Fixed != "" {
+			introduced, _ := parseVersion(r.Introduced)
+			fixed, _ := parseVersion(r.Fixed)
+			if compareVersions(introduced, fixed) >= 0 {
+				return fmt.Errorf("version range %s to %s is empty", r.Introduced, r.Fixed)
+			}
+		}
+	}
+	for _, c := range a.Commits {
+		if len(c) < 7 || strings.Trim(strings.ToLower(c), "0123456789abcdef") != "" {
+			return fmt.Errorf("commit %q is not a hexadecimal commit hash", c)
+		}
+	}
+	return nil
+}
+
+var putAdvisoriesScript = newScript(0, indexLua+`
+    local gen = ARGV[1]
+    local term = ARGV[2]
+    local feed = ARGV[3]
+    local hasPaths = ARGV[4] == '1'
+
+    if redis.call('GET', 'advisories') == feed then
+        return redis.call('SCARD', indexKey(gen, term))
+    end
+    redis.call('SET', 'advisories', feed)
+
+    -- The changed patterns are the patterns that were added or removed.
+    local old = {}
+    for _, pattern in ipairs(redis.call('SMEMBERS', 'advisoryPaths')) do
+        old[pattern] = true
+    end
+    redis.call('DEL', 'advisoryPaths')
+    local changed = {}
+    local exact = {}
+    local prefixes = {}
+    for i = 5, #ARGV do
+        local pattern = ARGV[i]
+        redis.call('SADD', 'advisoryPaths', pattern)
+        if old[pattern] then
+            old[pattern] = nil
+        else
+            table.insert(changed, pattern)
+        end
+        if string.sub(pattern, -4) == '/...' then
+            table.insert(prefixes, string.sub(pattern, 1, -5))
+        else
+            exact[pattern] = true
+        end
+    end
+    for pattern in pairs(old) do
+        table.insert(changed, pattern)
+    end
+
+    local function matches(path)
+        if exact[path] then
+            return true
+        end
+        for _, prefix in ipairs(prefixes) do
+            if path == prefix or string.sub(path, 1, #prefix + 1) == prefix .. '/' then
+                return true
+            end
+        end
+        return false
+    end
+
+    -- Find the ids of the indexed packages that match a changed pattern.
+    -- The packages below a prefix are read from the sorted set of import
+    -- paths. All indexed packages are checked if the index does not have
+    -- the set.
+    local ids = {}
+    local all = false
+    for _, pattern in ipairs(changed) do
+        if string.sub(pattern, -4) ~= '/...' then
+            local id = redis.call('GET', 'id:' .. pattern)
+            if id then
+                ids[id] = true
+            end
+        elseif hasPaths then
+            -- Members are "<path> <id>". The range includes some paths that
+            -- are not below the prefix. These paths are rechecked below.
+            local prefix = string.sub(pattern, 1, -5)
+            for _, m in ipairs(redis.call('ZRANGEBYLEX', indexKey(gen, 'path:'), '[' .. prefix .. ' ', '(' .. prefix .. '0')) do
+                ids[string.match(m, ' (%d+)$')] = true
+            end
+        else
+            all = true
+        end
+    end
+    if all then
+        for _, id in ipairs(redis.call('SUNION', indexKey(gen, 'all:'), indexKey(gen, term))) do
+            ids[id] = true
+        end
+    end
+
+    local reindex = redis.call('EXISTS', 'reindex') == 1
+    for id in pairs(ids) do
+        local path = redis.call('HGET', 'pkg:' .. id, 'path')
+        local indexed = redis.call('SISMEMBER', indexKey(gen, 'all:'), id) == 1 or redis.call('SISMEMBER', indexKey(gen, term), id) == 1
+        if path and indexed then
+            local affected = matches(path)
+            local terms = {}
+            local found = false
+            for t in string.gmatch(redis.call('HGET', 'pkg:' .. id, termsField(gen)) or '', '([^ ]+)') do
+                if t == term then
+                    found = true
+                else
+                    table.insert(terms, t)
+                end
+            end
+            if affected then
+                table.insert(terms, term)
+                redis.call('SADD', indexKey(gen, term), id)
+            else
+                redis.call('SREM', indexKey(gen, term), id)
+            end
+            if found ~= affected then
+                if reindex then
+                    redis.call('SADD', 'reindex:updated', id)
+                end
+                redis.call('HSET', 'pkg:' .. id, termsField(gen), table.concat(terms, ' '))
+            end
+        end
+    end
+    return redis.call('SCARD', indexKey(gen, term))
+`)
+
+// PutAdvisories replaces the stored advisories and updates the has:advisory
+// search term of the indexed packages. Nothing is updated if the advisories
+// did not change. Otherwise only the packages matching an added or removed
+// advisory path are updated. The function returns the number of indexed
+// packages with an advisory. The advisories are not validated.
+func (db *Database) PutAdvisories(advisories []Advisory) (int, error) {
+	p, err := json.Marshal(advisories)
+	if err != nil {
+		return 0, err
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return 0, err
+	}
+	hasPaths := 0
+	if si.tok.version >= pathTermVersion {
+		hasPaths = 1
+	}
+	args := []interface{}{si.generation, advisoryTerm, p, hasPaths}
+	for i := range advisories {
+		args = append(args, advisories[i].pattern())
+	}
+	return redis.Int(putAdvisoriesScript.Do(c, args...))
+}
+
+// Advisories returns the stored advisories.
+func (db *Database) Advisories() ([]Advisory, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	p, err := redis.Bytes(c.Do("GET", "advisories"))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var advisories []Advisory
+	if err := json.Unmarshal(p, &advisories); err != nil {
+		return nil, err
+	}
+	return advisories, nil
+}
+
+// hasAdvisory returns true if a stored advisory applies to the package with
+// the given import path.
+func hasAdvisory(c redis.Conn, path string) (bool, error) {
+	patterns, err := redis.Strings(c.Do("SMEMBERS", "advisoryPaths"))
+	if err != nil {
+		return false, err
+	}
+	for _, pattern := range patterns {
+		if matchAdvisoryPattern(pattern, path) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
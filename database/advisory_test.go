@@ -0,0 +1,202 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestAdvisoryMatchesPath(t *testing.T) {
+	prefix := &Advisory{Path: "github.com/user/repo", Prefix: true}
+	exact := &Advisory{Path: "github.com/user/repo/pkg"}
+	for _, tt := range []struct {
+		a    *Advisory
+		path string
+		want bool
+	}{
+		{prefix, "github.com/user/repo", true},
+		{prefix, "github.com/user/repo/pkg", true},
+		{prefix, "github.com/user/repo/pkg/sub", true},
+		{prefix, "github.com/user/repository", false},
+		{prefix, "github.com/user/repo-fork", false},
+		{prefix, "github.com/user", false},
+		{exact, "github.com/user/repo/pkg", true},
+		{exact, "github.com/user/repo/pkg/sub", false},
+		{exact, "github.com/user/repo/pkgs", false},
+		{exact, "github.com/user/repo", false},
+	} {
+		if got := tt.a.MatchesPath(tt.path); got != tt.want {
+			t.Errorf("%s matches %q = %v, want %v", tt.a.pattern(), tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAdvisoryAffectsVersion(t *testing.T) {
+	a := &Advisory{
+		Versions: []VersionRange{
+			{Introduced: "v1.2.0", Fixed: "v1.4.1"},
+			{Introduced: "v2.0.0", Fixed: "v2.0.3"},
+		},
+		Commits: []string{"0123456789abcdef0123456789abcdef01234567"},
+	}
+	for _, tt := range []struct {
+		version string
+		want    bool
+	}{
+		{"", true},
+		{"v1.1.9", false},
+		{"v1.2.0", true},
+		{"v1.2", true},
+		{"v1.4.0", true},
+		{"v1.4.1", false},
+		{"v1.10.0", false},
+		{"v2.0.2", true},
+		{"v2.0.3", false},
+		{"0123456789abcdef0123456789abcdef01234567", true},
+		{"0123456", true},
+		{"fedcba9876543210fedcba9876543210fedcba98", true},
+		{"release", true},
+	} {
+		if got := a.AffectsVersion(tt.version); got != tt.want {
+			t.Errorf("AffectsVersion(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+
+	open := &Advisory{Versions: []VersionRange{{Fixed: "v0.3.0"}}}
+	if !open.AffectsVersion("v0.0.1") || open.AffectsVersion("v1.0.0") {
+		t.Errorf("range without introduced version does not match earlier versions only")
+	}
+	all := &Advisory{}
+	if !all.AffectsVersion("v9.9.9") {
+		t.Errorf("advisory without versions does not affect all versions")
+	}
+}
+
+func TestValidateAdvisory(t *testing.T) {
+	valid := func() *Advisory {
+		return &Advisory{
+			ID:       "GDDO-2024-0001",
+			Path:     "github.com/user/repo",
+			Prefix:   true,
+			Versions: []VersionRange{{Introduced: "v1.0.0", Fixed: "v1.0.5"}},
+			Commits:  []string{"0123456789abcdef"},
+			Severity: SeverityHigh,
+			Summary:  "Decoder panics on crafted input.",
+			URL:      "https://example.com/advisories/1",
+		}
+	}
+	if err := ValidateAdvisory(valid()); err != nil {
+		t.Fatalf("valid advisory returned %v", err)
+	}
+	for _, tt := range []struct {
+		name   string
+		modify func(*Advisory)
+	}{
+		{"id", func(a *Advisory) { a.ID = " " }},
+		{"path", func(a *Advisory) { a.Path = "github.com/user/repo/" }},
+		{"relative path", func(a *Advisory) { a.Path = "github.com/../repo" }},
+		{"severity", func(a *Advisory) { a.Severity = "severe" }},
+		{"summary", func(a *Advisory) { a.Summary = "" }},
+		{"url scheme", func(a *Advisory) { a.URL = "javascript:alert(1)" }},
+		{"relative url", func(a *Advisory) { a.URL = "/advisories/1" }},
+		{"empty range", func(a *Advisory) { a.Versions = []VersionRange{{}} }},
+		{"bad tag", func(a *Advisory) { a.Versions = []VersionRange{{Fixed: "v1.x"}} }},
+		{"inverted range", func(a *Advisory) { a.Versions = []VersionRange{{Introduced: "v1.2.0", Fixed: "v1.1.0"}} }},
+		{"commit", func(a *Advisory) { a.Commits = []string{"master"} }},
+	} {
+		a := valid()
+		tt.modify(a)
+		if err := ValidateAdvisory(a); err == nil {
+			t.Errorf("%s: invalid advisory accepted", tt.name)
+		}
+	}
+}
+
+func TestAdvisories(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	put := func(path string) {
+		pdoc := &doc.Package{
+			ImportPath:  path,
+			ProjectRoot: "github.com/user/repo",
+			Name:        "pkg",
+			Synopsis:    "Package pkg decodes frobs.",
+			Updated:     time.Now(),
+			Funcs:       []*doc.Func{{}},
+		}
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("github.com/user/repo/pkg")
+	put("github.com/user/repository")
+
+	advisories := []Advisory{{ID: "1", Path: "github.com/user/repo", Prefix: true, Severity: SeverityHigh, Summary: "s", URL: "https://example.com/1"}}
+	n, err := db.PutAdvisories(advisories)
+	if n != 1 || err != nil {
+		t.Fatalf("PutAdvisories() = %d, %v, want 1", n, err)
+	}
+	assertQuery := func(q string, want ...string) {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Path)
+		}
+		if len(got) != len(want) || (len(got) > 0 && got[0] != want[0]) {
+			t.Errorf("Query(%q) = %v, want %v", q, got, want)
+		}
+	}
+	assertQuery("has:advisory", "github.com/user/repo/pkg")
+	assertQuery("frobs has:advisory", "github.com/user/repo/pkg")
+
+	// Packages stored after the advisories are loaded get the term.
+	put("github.com/user/repo/other")
+	pkgs, err := db.Query("has:advisory")
+	if len(pkgs) != 2 || err != nil {
+		t.Errorf("Query(has:advisory) = %v, %v, want 2 packages", pkgs, err)
+	}
+
+	// Storing the same advisories again does not change the packages.
+	if n, err := db.PutAdvisories(advisories); n != 2 || err != nil {
+		t.Errorf("PutAdvisories(same) = %d, %v, want 2", n, err)
+	}
+
+	// An added advisory updates the packages matching its path.
+	exact := Advisory{ID: "2", Path: "github.com/user/repository", Severity: SeverityLow, Summary: "s", URL: "https://example.com/2"}
+	if n, err := db.PutAdvisories(append(advisories, exact)); n != 3 || err != nil {
+		t.Errorf("PutAdvisories(added) = %d, %v, want 3", n, err)
+	}
+	if n, err := db.PutAdvisories(advisories); n != 2 || err != nil {
+		t.Errorf("PutAdvisories(removed) = %d, %v, want 2", n, err)
+	}
+
+	got, err := db.Advisories()
+	if err != nil || len(got) != 1 || got[0].ID != "1" {
+		t.Errorf("Advisories() = %v, %v, want the stored advisory", got, err)
+	}
+
+	// Replacing the advisories removes the term.
+	if n, err := db.PutAdvisories(nil); n != 0 || err != nil {
+		t.Fatalf("PutAdvisories(nil) = %d, %v", n, err)
+	}
+	assertQuery("has:advisory")
+}
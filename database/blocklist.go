@@ -0,0 +1,280 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Kinds of block rules.
+const (
+	// BlockPath blocks fetching the packages at or below an import path.
+	BlockPath = "path"
+
+	// BlockCIDR blocks requests from a range of client IP addresses.
+	BlockCIDR = "cidr"
+)
+
+// BlockRule is a rule in the blocklist.
+type BlockRule struct {
+	Kind string `json:"kind"`
+	Rule string `json:"rule"`
+
+	// Added is the time the rule was added or the zero time for rules
+	// added before the time was recorded.
+	Added time.Time `json:"added,omitempty"`
+
+	// Hits is the number of fetches or requests blocked by the rule.
+	Hits int64 `json:"hits"`
+}
+
+// blockSets maps rule kinds to the sets of rules.
+var blockSets = map[string]string{
+	BlockPath: "block",
+	BlockCIDR: "blockCIDR",
+}
+
+// ValidateBlockRule returns an error if rule is not a valid rule of the
+// given kind. Path rules are import path prefixes of whole path elements.
+// CIDR rules are IP ranges written with the network address, for example
+// 192.0.2.0/24.
+func ValidateBlockRule(kind, rule string) error {
+	switch kind {
+	case BlockPath:
+		if rule == "" || strings.HasPrefix(rule, "/") || strings.HasSuffix(rule, "/") {
+			return fmt.Errorf("path %q must not be empty or start or end with a slash", rule)
+		}
+		for _, elem := range strings.Split(rule, "/") {
+			if elem == "" || elem == "." || elem == ".." {
+				return fmt.Errorf("path %q has an empty or relative element", rule)
+			}
+			if strings.IndexAny(elem, " \t\r\n") >= 0 {
+				return fmt.Errorf("path %q contains white space", rule)
+			}
+		}
+	case BlockCIDR:
+		ip, n, err := net.ParseCIDR(rule)
+		if err != nil {
+			return err
+		}
+		if !ip.Equal(n.IP) {
+			return fmt.Errorf("CIDR %q is not written with the network address %s", rule, n.IP)
+		}
+	default:
+		return fmt.Errorf("unknown rule kind %q", kind)
+	}
+	return nil
+}
+
+// isBlockedBy returns true if path is at or below the path rule root.
+func isBlockedBy(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root) && path[len(root)] == '/'
+}
+
+var addBlockRulesScript = newScript(0, `
+    local now = ARGV[1]
+    for i = 2,#ARGV,2 do
+        local kind = ARGV[i]
+        local rule = ARGV[i+1]
+        local set = 'block'
+        if kind == 'cidr' then
+            set = 'blockCIDR'
+        end
+        redis.call('SADD', set, rule)
+        redis.call('HSETNX', 'blockAdded', kind .. ' ' .. rule, now)
+    end
+`)
+
+// ImportBlockRules adds rules to the blocklist and deletes the packages
+// blocked by the path rules. The rules are added in one script, so either
+// all rules are added or none are. The caller should check the rules with
+// ValidateBlockRule first; ImportBlockRules returns an error without adding
+// any rule if a rule is not valid. The added time and hits of the rules
+// are ignored.
+func (db *Database) ImportBlockRules(rules []BlockRule) error {
+	args := []interface{}{time.Now().Unix()}
+	for _, r := range rules {
+		if err := ValidateBlockRule(r.Kind, r.Rule); err != nil {
+			return err
+		}
+		args = append(args, r.Kind, r.Rule)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	if _, err := addBlockRulesScript.Do(c, args...); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.Kind == BlockPath {
+			if err := deleteBlocked(c, r.Rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type byBlockRule []BlockRule
+
+func (p byBlockRule) Len() int      { return len(p) }
+func (p byBlockRule) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byBlockRule) Less(i, j int) bool {
+	if p[i].Kind != p[j].Kind {
+		return p[i].Kind < p[j].Kind
+	}
+	return p[i].Rule < p[j].Rule
+}
+
+// BlockRules returns the rules in the blocklist sorted by kind and rule.
+func (db *Database) BlockRules() ([]BlockRule, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	c.Send("SMEMBERS", blockSets[BlockPath])
+	c.Send("SMEMBERS", blockSets[BlockCIDR])
+	c.Send("HGETALL", "blockAdded")
+	c.Send("HGETALL", "blockHits")
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	paths, err := redis.Strings(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	cidrs, err := redis.Strings(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	added, err := int64Map(values[2])
+	if err != nil {
+		return nil, err
+	}
+	hits, err := int64Map(values[3])
+	if err != nil {
+		return nil, err
+	}
+	var rules []BlockRule
+	add := func(kind string, rule string) {
+		r := BlockRule{Kind: kind, Rule: rule, Hits: hits[kind+" "+rule]}
+		if t, ok := added[kind+" "+rule]; ok {
+			r.Added = time.Unix(t, 0).UTC()
+		}
+		rules = append(rules, r)
+	}
+	for _, rule := range paths {
+		add(BlockPath, rule)
+	}
+	for _, rule := range cidrs {
+		add(BlockCIDR, rule)
+	}
+	sort.Sort(byBlockRule(rules))
+	return rules, nil
+}
+
+// int64Map converts an HGETALL reply with integer values to a map.
+func int64Map(reply interface{}) (map[string]int64, error) {
+	values, err := redis.Strings(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]int64)
+	for i := 0; i+1 < len(values); i += 2 {
+		n, err := strconv.ParseInt(values[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		m[values[i]] = n
+	}
+	return m, nil
+}
+
+// BlockedCIDRs returns the CIDR rules in the blocklist.
+func (db *Database) BlockedCIDRs() ([]string, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	return redis.Strings(c.Do("SMEMBERS", blockSets[BlockCIDR]))
+}
+
+// CountBlockHit increments the hit count of a rule.
+func (db *Database) CountBlockHit(kind, rule string) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := c.Do("HINCRBY", "blockHits", kind+" "+rule, 1)
+	return err
+}
+
+// BlockedPackages returns the import paths of the stored packages that the
+// path rule root would block, sorted by path, and the number of such
+// packages. At most limit paths are returned. The keys are read with SCAN.
+func (db *Database) BlockedPackages(root string, limit int) ([]string, int, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	var paths []string
+	n := 0
+	err := scanKeys(c, "id:"+escapePattern(root)+"*", func(keys []string) error {
+		for _, key := range keys {
+			path := key[len("id:"):]
+			if !isBlockedBy(path, root) {
+				continue
+			}
+			n++
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(paths)
+	if len(paths) > limit {
+		paths = paths[:limit]
+	}
+	return paths, n, nil
+}
+
+// BlockingRule returns the path rule that blocks the package with the given
+// import path or "" if the package is not blocked. The hit count of the rule
+// is not incremented.
+func (db *Database) BlockingRule(path string) (string, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	var roots []string
+	for i := 0; i <= len(path); i++ {
+		if i == len(path) || path[i] == '/' {
+			roots = append(roots, path[:i])
+			c.Send("SISMEMBER", blockSets[BlockPath], path[:i])
+		}
+	}
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return "", err
+	}
+	for i, v := range values {
+		if blocked, _ := redis.Bool(v, nil); blocked {
+			return roots[i], nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var validateBlockRuleTests = []struct {
+	kind, rule string
+	ok         bool
+}{
+	{BlockPath, "github.com/spammer", true},
+	{BlockPath, "spam.example.com", true},
+	{BlockPath, "", false},
+	{BlockPath, "github.com/spammer/", false},
+	{BlockPath, "/github.com", false},
+	{BlockPath, "github.com//spammer", false},
+	{BlockPath, "github.com/../x", false},
+	{BlockPath, "github.com/a b", false},
+	{BlockCIDR, "192.0.2.0/24", true},
+	{BlockCIDR, "2001:db8::/32", true},
+	{BlockCIDR, "192.0.2.1/24", false},
+	{BlockCIDR, "192.0.2.0", false},
+	{"host", "example.com", false},
+}
+
+func TestValidateBlockRule(t *testing.T) {
+	for _, tt := range validateBlockRuleTests {
+		if err := ValidateBlockRule(tt.kind, tt.rule); (err == nil) != tt.ok {
+			t.Errorf("ValidateBlockRule(%q, %q) = %v, want ok = %v", tt.kind, tt.rule, err, tt.ok)
+		}
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, path := range []string{"github.com/spammer/a", "github.com/spammer/a/b", "github.com/spammerx/c", "github.com/user/repo"} {
+		if err := db.Put(&doc.Package{ImportPath: path, ProjectRoot: path, Name: "p"}, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, n, err := db.BlockedPackages("github.com/spammer", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"github.com/spammer/a"}; n != 2 || !reflect.DeepEqual(paths, want) {
+		t.Errorf("BlockedPackages() = %v, %d, want %v, 2", paths, n, want)
+	}
+
+	// An invalid rule prevents the import of all rules.
+	err = db.ImportBlockRules([]BlockRule{{Kind: BlockPath, Rule: "github.com/spammer"}, {Kind: BlockCIDR, Rule: "192.0.2.1/24"}})
+	if err == nil {
+		t.Error("ImportBlockRules() with invalid rule did not return error")
+	}
+	if rules, err := db.BlockRules(); err != nil || len(rules) != 0 {
+		t.Errorf("BlockRules() = %v, %v, want no rules", rules, err)
+	}
+
+	if err := db.ImportBlockRules([]BlockRule{{Kind: BlockPath, Rule: "github.com/spammer"}, {Kind: BlockCIDR, Rule: "192.0.2.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := db.IsBlocked("github.com/spammer/d"); !blocked || err != nil {
+		t.Errorf("IsBlocked() = %v, %v, want true", blocked, err)
+	}
+	for path, want := range map[string]string{
+		"github.com/spammer":    "github.com/spammer",
+		"github.com/spammer/d":  "github.com/spammer",
+		"github.com/spammerx/c": "",
+	} {
+		if rule, err := db.BlockingRule(path); rule != want || err != nil {
+			t.Errorf("BlockingRule(%q) = %q, %v, want %q", path, rule, err, want)
+		}
+	}
+	if err := db.CountBlockHit(BlockCIDR, "192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CountBlockHit(BlockPath, "github.com/spammer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, n, err := db.BlockedPackages("github.com/spammer", 10); n != 0 || err != nil {
+		t.Errorf("BlockedPackages() after import = %d, %v, want 0", n, err)
+	}
+	if exists, err := db.Exists("github.com/spammerx/c"); !exists || err != nil {
+		t.Errorf("Exists(github.com/spammerx/c) = %v, %v, want true", exists, err)
+	}
+
+	rules, err := db.BlockRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("BlockRules() returned %d rules, want 2", len(rules))
+	}
+	for i, want := range []BlockRule{{Kind: BlockCIDR, Rule: "192.0.2.0/24", Hits: 1}, {Kind: BlockPath, Rule: "github.com/spammer", Hits: 1}} {
+		if rules[i].Added.IsZero() {
+			t.Errorf("rule %s has no added time", rules[i].Rule)
+		}
+		rules[i].Added = time.Time{}
+		if rules[i] != want {
+			t.Errorf("rule %d = %+v, want %+v", i, rules[i], want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Card is a compact description of a package shown in search results and
+// embedded in other sites. The card is computed when the package is stored
+// so that it can be shown without loading the package documentation.
+type Card struct {
+	Path     string        `json:"path"`
+	Name     string        `json:"name"`
+	IsCmd    bool          `json:"command,omitempty"`
+	Synopsis string        `json:"synopsis,omitempty"`
+	Notable  []doc.Notable `json:"notable,omitempty"`
+	Updated  time.Time     `json:"updated"`
+
+	// Importers is the number of packages that import the package. The
+	// count is read when the card is loaded.
+	Importers int `json:"importers"`
+}
+
+// encodeCard returns the stored card for a package or "" for directories.
+func encodeCard(pdoc *doc.Package) (string, error) {
+	if pdoc.Name == "" {
+		return "", nil
+	}
+	p, err := json.Marshal(&Card{
+		Path:     pdoc.ImportPath,
+		Name:     pdoc.Name,
+		IsCmd:    pdoc.IsCmd,
+		Synopsis: pdoc.Synopsis,
+		Notable:  doc.NotableIdentifiers(pdoc),
+		Updated:  pdoc.Updated,
+	})
+	return string(p), err
+}
+
+var cardsScript = newScript(0, indexLua+`
+    local gen = ARGV[1]
+    local result = {}
+    for i = 2, #ARGV do
+        local path = ARGV[i]
+        local card = ''
+        local importers = 0
+        local id = redis.call('GET', 'id:' .. path)
+        if id then
+            card = redis.call('HGET', 'pkg:' .. id, 'card') or ''
+            importers = redis.call('SCARD', indexKey(gen, 'import:' .. path))
+        end
+        result[#result+1] = card
+        result[#result+1] = importers
+    end
+    return result
+`)
+
+// Cards returns the cards of the packages with the given import paths. The
+// card is nil for directories, for packages that are not stored and for
+// packages stored before cards were added.
+func (db *Database) Cards(paths []string) ([]*Card, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{si.generation}
+	for _, path := range paths {
+		args = append(args, path)
+	}
+	values, err := redis.Values(cardsScript.Do(c, args...))
+	if err != nil {
+		return nil, err
+	}
+	cards := make([]*Card, len(paths))
+	for i := range cards {
+		var (
+			p         []byte
+			importers int
+		)
+		if values, err = redis.Scan(values, &p, &importers); err != nil {
+			return nil, err
+		}
+		if len(p) == 0 {
+			continue
+		}
+		var card Card
+		if err := json.Unmarshal(p, &card); err != nil {
+			return nil, err
+		}
+		card.Importers = importers
+		cards[i] = &card
+	}
+	return cards, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+// cardTestPackage is the fixture package for the card tests.
+func cardTestPackage() *doc.Package {
+	return &doc.Package{
+		ImportPath:  "github.com/user/repo/wire",
+		ProjectRoot: "github.com/user/repo",
+		Name:        "wire",
+		Synopsis:    "Package wire implements the wire protocol.",
+		Updated:     time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC),
+		Types: []*doc.Type{{
+			Name:    "Conn",
+			Doc:     "Conn is a connection to a server. Conns are not safe for concurrent use.\n",
+			Methods: []*doc.Func{{Name: "Close"}, {Name: "Send"}},
+			Funcs:   []*doc.Func{{Name: "Dial", Doc: "Dial connects to\nthe server at addr.\n", ExampleUses: 3}},
+		}},
+		Funcs: []*doc.Func{{Name: "Ping", ExampleUses: 1}},
+	}
+}
+
+func TestEncodeCard(t *testing.T) {
+	s, err := encodeCard(cardTestPackage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"path":"github.com/user/repo/wire","name":"wire","synopsis":"Package wire implements the wire protocol.","notable":[{"name":"Conn","synopsis":"Conn is a connection to a server."},{"name":"Dial","synopsis":"Dial connects to the server at addr."},{"name":"Ping"}],"updated":"2014-05-01T12:00:00Z","importers":0}`
+	if s != want {
+		t.Errorf("encodeCard() =\n%s\nwant\n%s", s, want)
+	}
+	if s, err := encodeCard(&doc.Package{ImportPath: "github.com/user/repo"}); s != "" || err != nil {
+		t.Errorf("encodeCard(directory) = %q, %v, want empty", s, err)
+	}
+}
+
+func TestCards(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := cardTestPackage()
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	importer := &doc.Package{ImportPath: "github.com/other/app", ProjectRoot: "github.com/other/app", Name: "app", Imports: []string{pdoc.ImportPath}}
+	if err := db.Put(importer, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cards, err := db.Cards([]string{pdoc.ImportPath, "github.com/user/missing", "github.com/other/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 3 || cards[0] == nil || cards[1] != nil || cards[2] == nil {
+		t.Fatalf("Cards() = %v, want cards for the stored packages", cards)
+	}
+	if c := cards[0]; c.Name != "wire" || len(c.Notable) != 3 || c.Importers != 1 || !c.Updated.Equal(pdoc.Updated) {
+		t.Errorf("card = %+v, want the fixture card imported by one package", c)
+	}
+
+	// The card follows the stored package.
+	pdoc.Synopsis = "Package wire implements version 2 of the wire protocol."
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	cards, err = db.Cards([]string{pdoc.ImportPath})
+	if err != nil || cards[0].Synopsis != pdoc.Synopsis {
+		t.Errorf("Cards() after refresh = %v, %v, want the new synopsis", cards, err)
+	}
+	if err := db.Delete(pdoc.ImportPath); err != nil {
+		t.Fatal(err)
+	}
+	if cards, err := db.Cards([]string{pdoc.ImportPath}); err != nil || cards[0] != nil {
+		t.Errorf("Cards() after delete = %v, %v, want nil card", cards, err)
+	}
+}
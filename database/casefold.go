@@ -0,0 +1,93 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// CanonicalPath returns the import path of the stored package that differs
+// from path only in case. CanonicalPath returns "" if there is no such
+// package or if import paths on the host of path are case-sensitive. The
+// returned path is equal to path if the package is stored with the same
+// case.
+func (db *Database) CanonicalPath(path string) (string, error) {
+	fold := doc.FoldImportPath(path)
+	if fold == "" {
+		return "", nil
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	canonical, err := redis.String(c.Do("GET", "fold:"+fold))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return canonical, err
+}
+
+// getCanonicalImports returns the imports of pdoc that differ only in case
+// from the import path of a stored package, mapped to the stored path.
+func getCanonicalImports(c redis.Conn, pdoc *doc.Package) (map[string]string, error) {
+	var result map[string]string
+	for _, path := range pdoc.Imports {
+		fold := doc.FoldImportPath(path)
+		if fold == "" {
+			continue
+		}
+		canonical, err := redis.String(c.Do("GET", "fold:"+fold))
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if canonical != path {
+			if result == nil {
+				result = make(map[string]string)
+			}
+			result[path] = canonical
+		}
+	}
+	return result, nil
+}
+
+// importCaseDiagnostics returns diags with an import case diagnostic for
+// each import in canonicalImports. Import case diagnostics from a previous
+// put are replaced.
+func importCaseDiagnostics(diags []*doc.Diagnostic, canonicalImports map[string]string) []*doc.Diagnostic {
+	var result []*doc.Diagnostic
+	for _, d := range diags {
+		if d.Code != doc.DiagnosticImportCase {
+			result = append(result, d)
+		}
+	}
+	var paths []string
+	for path := range canonicalImports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var caseDiags []*doc.Diagnostic
+	for _, path := range paths {
+		caseDiags = append(caseDiags, &doc.Diagnostic{
+			Code:     doc.DiagnosticImportCase,
+			Severity: doc.SeverityWarning,
+			Message:  "Import path " + strconv.Quote(path) + " differs only in case from the indexed package " + strconv.Quote(canonicalImports[path]) + ".",
+		})
+	}
+	return append(caseDiags, result...)
+}
@@ -14,25 +14,81 @@
 
 // Redis keys and types:
 //
-// maxPackageId string: next id to assign
+// maxPackageId string: last assigned id. Ids are not reused after a package
+//      is deleted; a deleted package is assigned a new id when stored again.
 // id:<path> string: id for given import path
 // pkg:<id> hash
-//      terms: space separated search terms
+//      terms<g>: space separated search terms in index generation <g>
 //      path: import path
 //      synopsis: synopsis
+//      derived: 1 if the synopsis is derived from an ancestor package, 0 otherwise
 //      gob: snappy compressed gob encoded doc.Package
-//      score: document search score
+//      score<g>: document search score in index generation <g>
 //      etag:
-//      kind: p=package, c=command, d=directory with no go files
-// index:<term> set: package ids for given search term
-// index:import:<path> set: packages with import path
-// index:project:<root> set: packages in project with root
+//      kind: p=package, c=command, d=directory with no go files and no errors
+//      files: space separated hashes of source files
+//      updated: Unix time the documentation was fetched
+//      summary: summary of the package contents if the synopsis is empty
+//      majorRoot: project root if the package is the root or a major version subdirectory
+//      newestMajor: import path of the newest stored major version of the project root
+//      textVersion: version of the renderer of the stored text documentation
+//      textUpdated: Unix time the package was fetched for the stored text documentation
+//      textSummary, textAll: snappy compressed text documentation
+//      card: JSON encoded Card without the importer count, empty for directories
+//      lang: detected language of the package comment, empty if unknown
+//      methods: JSON encoded method sets of the exported types, empty if no type has methods
+//      rank: popularity hint for ranking search results, set with SetRank
+//      doc: package comment with collapsed white space, truncated for search result excerpts
+// index<g>:<term> set: package ids for given search term
+// index<g>:import:<path> set: packages with import path
+// index<g>:project:<root> set: packages in project with root
+// index<g>:fingerprint:<hash> set: packages with the same exported API
+// index<g>:stale:yes set: packages in projects with no commits in the last year
+// index<g>:has:advisory set: packages with a security advisory
+// index<g>:lang:<code> set: packages with a package comment in the language
+// index<g>:method:<name> set: packages with an exported concrete type with a method with the name
+// index<g>:methods:<hash> set: packages with an exported concrete type with the method set hash
+// searchIndex hash: generation and tokenizer version of the live search index
+// reindex hash: generation and tokenizer version of the search index rebuild
+// reindex:updated set: packages updated during the search index rebuild
+// activity:<root> string: gob encoded doc.ProjectActivity for project
 // nextCrawl zset: package id, Unix time for next crawl
-// block set: packages to block
+// viewed zset: package id, Unix time of last view of monorepo package
 // popular zset: package id, score
 // popular:0 string: scaled base time for popular scores
 // newCrawl set: new paths to crawl
 // badCrawl set: paths that returned error when crawling.
+// tmp:session-<n> set: intersection of query terms saved for a query session
+// lease:<name> string: holder of lease, expires with the lease
+// apiToken hash: API token, JSON encoded APIToken
+// file:<hash> string: snappy compressed source file content
+// fileRefs hash: file hash, number of references from stored packages
+// indexChanges string: number of package puts and deletes
+// fold:<path> string: import path of the first stored package with the case folded path
+// textVersion zset: package id, version of the renderer of the stored text documentation
+// majorVersions:<root> zset: import path, major version of stored packages in the root and v2, v3 subdirectories
+// reports zset: import path, Unix time of the last open report for the package
+// report:<path> hash: report reason, number of open reports with the reason
+// reportText:<path> list: JSON encoded Report, the most recent open reports with text
+// fetch:<path> hash: Unix time and result of the last fetch of the package, expires
+// cadence:<root> hash: refresh interval in seconds and Unix expiry time requested for project, expires
+// refreshToken:<root> hash: token to verify a refresh cadence request for project and author key of the requester, expires
+// views:<path>:<day> hash: declaration anchor, number of views of the declaration on the day since the Unix epoch, expires
+// block set: import path prefixes to block
+// blockCIDR set: client IP ranges to block
+// blockAdded hash: "<kind> <rule>", Unix time the block rule was added
+// blockHits hash: "<kind> <rule>", number of fetches or requests blocked by the rule
+// snapshot:<path> hash: Unix time the documentation was fetched, snappy compressed gob encoded doc.Package of a past build
+// snapshots:<path> zset: Unix time, Unix time of the snapshots of the package
+// snapshotStats hash: count and total bytes of the stored snapshots
+// ref:<path>@<ref> hash: documentation of an explicitly requested tag or branch, expires
+//      gob: snappy compressed gob encoded doc.Package
+//      updated: Unix time the documentation was fetched
+// advisories string: JSON encoded []Advisory
+// methodSetStats hash: number of packages with stored method sets and total bytes of the method sets
+// advisoryPaths set: import paths of advisories, with a "/..." suffix for path prefixes
+//
+// The index generation <g> is omitted from keys and fields for generation 0.
 
 // Package database manages storage for GoPkgDoc.
 package database
@@ -46,6 +102,7 @@ import (
 	"math"
 	"net/url"
 	"os"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -60,11 +117,51 @@ type Database struct {
 	Pool interface {
 		Get() redis.Conn
 	}
+	sessions   querySessions
+	index      indexCache
+	migration  *migration
+	implements implementsCounters
 }
 
 type Package struct {
 	Path     string `json:"path"`
 	Synopsis string `json:"synopsis,omitempty"`
+
+	// True if the package does not have a package comment and the synopsis
+	// is derived from an ancestor package.
+	SynopsisDerived bool `json:"synopsisDerived,omitempty"`
+
+	// Summary of the package contents for packages without a synopsis or
+	// the number of packages below a directory. Set for directory listings
+	// only.
+	Summary string `json:"summary,omitempty"`
+
+	// Import path of the newest major version of the package if the
+	// project keeps newer major versions in subdirectories. Set for search
+	// results only.
+	NewestMajor string `json:"newestMajor,omitempty"`
+
+	// Severity of the most severe advisory for the package. Set by the
+	// server for search results only.
+	Advisory string `json:"advisory,omitempty"`
+
+	// Detected language of the package comment or "" if the language is
+	// unknown. Set for search results only.
+	Language string `json:"language,omitempty"`
+
+	// Names of the exported types in the package that implement the
+	// interface of an implements: query. Set for search results only.
+	Implementations []string `json:"implementations,omitempty"`
+
+	// Ranges of the synopsis that match the query terms. Set for search
+	// results only.
+	SynopsisMatches []Match `json:"synopsisMatches,omitempty"`
+
+	// Part of the package comment around the first match of a query term
+	// and the ranges of the excerpt that match the terms. Set for search
+	// results where no term matches the synopsis.
+	Excerpt        string  `json:"excerpt,omitempty"`
+	ExcerptMatches []Match `json:"excerptMatches,omitempty"`
 }
 
 type byPath []Package
@@ -79,8 +176,8 @@ var (
 	redisLog         = flag.Bool("db-log", false, "Log database commands")
 )
 
-func dialDb() (c redis.Conn, err error) {
-	u, err := url.Parse(*redisServer)
+func dialDb(server string) (c redis.Conn, err error) {
+	u, err := url.Parse(server)
 	if err != nil {
 		return nil, err
 	}
@@ -111,10 +208,9 @@ func dialDb() (c redis.Conn, err error) {
 	return
 }
 
-// New creates a database configured from command line flags.
-func New() (*Database, error) {
+func newPool(server string) (*redis.Pool, error) {
 	pool := &redis.Pool{
-		Dial:        dialDb,
+		Dial:        func() (redis.Conn, error) { return dialDb(server) },
 		MaxIdle:     10,
 		IdleTimeout: *redisIdleTimeout,
 	}
@@ -124,8 +220,45 @@ func New() (*Database, error) {
 	} else {
 		c.Close()
 	}
+	return pool, nil
+}
+
+// New creates a database configured from command line flags.
+func New() (*Database, error) {
+	pool, err := newPool(*redisServer)
+	if err != nil {
+		return nil, err
+	}
+	if *migrateServer == "" {
+		return &Database{Pool: pool}, nil
+	}
 
-	return &Database{Pool: pool}, nil
+	newServer, err := newPool(*migrateServer)
+	if err != nil {
+		return nil, err
+	}
+	c := newServer.Get()
+	for _, s := range scripts {
+		if err := s.Load(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	c.Close()
+
+	m := newMigration(pool, newServer, *migrateCutover, *migrateShadow)
+	go m.runComparator()
+	return &Database{Pool: m, migration: m}, nil
+}
+
+// MigrationStatus returns the progress of the migration to the server set
+// by the db-migrate-server flag. Ok is false if the database is not
+// migrating.
+func (db *Database) MigrationStatus() (status MigrationStatus, ok bool) {
+	if db.migration == nil {
+		return MigrationStatus{}, false
+	}
+	return db.migration.Status(), true
 }
 
 // Exists returns true if package with import path exists in the database.
@@ -135,7 +268,7 @@ func (db *Database) Exists(path string) (bool, error) {
 	return redis.Bool(c.Do("EXISTS", "id:"+path))
 }
 
-var putScript = redis.NewScript(0, `
+var putScript = newScript(0, indexLua+fileLua+majorVersionLua+`
     local path = ARGV[1]
     local synopsis = ARGV[2]
     local score = ARGV[3]
@@ -144,6 +277,22 @@ var putScript = redis.NewScript(0, `
     local etag = ARGV[6]
     local kind = ARGV[7]
     local nextCrawl = ARGV[8]
+    local gen = ARGV[9]
+    local files = ARGV[10]
+    local updated = ARGV[11]
+    local fold = ARGV[12]
+    local summary = ARGV[13]
+    local majorRoot = ARGV[14]
+    local major = ARGV[15]
+    local derived = ARGV[16]
+    local card = ARGV[17]
+    local lang = ARGV[18]
+    local methods = ARGV[19]
+    local doc = ARGV[20]
+
+    if (redis.call('HGET', 'searchIndex', 'generation') or '0') ~= gen then
+        return redis.error_reply('search index changed')
+    end
 
     local id = redis.call('GET', 'id:' .. path)
     if not id then
@@ -151,8 +300,12 @@ var putScript = redis.NewScript(0, `
         redis.call('SET', 'id:' .. path, id)
     end
 
+    if redis.call('EXISTS', 'reindex') == 1 then
+        redis.call('SADD', 'reindex:updated', id)
+    end
+
     local update = {}
-    for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
+    for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, termsField(gen)) or '', '([^ ]+)') do
         update[term] = 1
     end
 
@@ -162,9 +315,9 @@ var putScript = redis.NewScript(0, `
 
     for term, x in pairs(update) do
         if x == 1 then
-            redis.call('SREM', 'index:' .. term, id)
+            removeTerm(gen, term, id)
         elseif x == 2 then 
-            redis.call('SADD', 'index:' .. term, id)
+            addTerm(gen, term, id)
             if string.sub(term, 1, 7) == 'import:' then
                 local import = string.sub(term, 8)
                 if redis.call('EXISTS', 'id:' .. import) == 0  and redis.call('SISMEMBER', 'badCrawl', import) == 0 then
@@ -177,20 +330,185 @@ var putScript = redis.NewScript(0, `
     redis.call('SREM', 'badCrawl', path)
     redis.call('SREM', 'newCrawl', path)
 
+    updateFileRefs(files, 1)
+    updateFileRefs(redis.call('HGET', 'pkg:' .. id, 'files') or '', -1)
+
     if nextCrawl ~= '0' then
         redis.call('ZADD', 'nextCrawl', nextCrawl, id)
     end
 
-    return redis.call('HMSET', 'pkg:' .. id, 'path', path, 'synopsis', synopsis, 'score', score, 'gob', gob, 'terms', terms, 'etag', etag, 'kind', kind)
+    -- The first stored casing of a path is kept until the package with the
+    -- casing is deleted.
+    if fold ~= '' then
+        local other = redis.call('GET', 'fold:' .. fold)
+        if not other or redis.call('EXISTS', 'id:' .. other) == 0 then
+            redis.call('SET', 'fold:' .. fold, path)
+        end
+    end
+
+    -- Major versions are stored in a sorted set per project root. The
+    -- project root is not a member if it does not contain a package.
+    local oldMajorRoot = redis.call('HGET', 'pkg:' .. id, 'majorRoot') or ''
+    if oldMajorRoot ~= '' and oldMajorRoot ~= majorRoot then
+        redis.call('ZREM', 'majorVersions:' .. oldMajorRoot, path)
+        updateMajorVersions(oldMajorRoot)
+    end
+
+    local oldMethods = redis.call('HGET', 'pkg:' .. id, 'methods') or ''
+    if oldMethods ~= '' then
+        redis.call('HINCRBY', 'methodSetStats', 'packages', -1)
+        redis.call('HINCRBY', 'methodSetStats', 'bytes', -string.len(oldMethods))
+    end
+    if methods ~= '' then
+        redis.call('HINCRBY', 'methodSetStats', 'packages', 1)
+        redis.call('HINCRBY', 'methodSetStats', 'bytes', string.len(methods))
+    end
+
+    redis.call('INCR', 'indexChanges')
+    redis.call('HMSET', 'pkg:' .. id, 'path', path, 'synopsis', synopsis, scoreField(gen), score, 'gob', gob, termsField(gen), terms, 'etag', etag, 'kind', kind, 'files', files, 'updated', updated, 'summary', summary, 'majorRoot', majorRoot, 'derived', derived, 'card', card, 'lang', lang, 'methods', methods, 'doc', doc)
+
+    if majorRoot ~= '' then
+        if kind ~= 'd' then
+            redis.call('ZADD', 'majorVersions:' .. majorRoot, major, path)
+        else
+            redis.call('ZREM', 'majorVersions:' .. majorRoot, path)
+        end
+        updateMajorVersions(majorRoot)
+    end
+    return true
+`)
+
+func init() {
+	// The put script assigns a new package the next id. Copy the id of the
+	// path and the last assigned id to a migration target before the script
+	// runs there so that the target keeps the ids of the source.
+	setCopyKeys(putScript, func(argv []interface{}) []string {
+		path, _ := redis.String(argv[0], nil)
+		return []string{"id:" + path, "maxPackageId"}
+	})
+}
+
+// copyScoreFactor is applied to the search score of packages that appear to
+// be copies of other packages.
+const copyScoreFactor = 0.01
+
+// findOriginalScript returns the path of the package with the most importers
+// among the packages with the given fingerprint. Ties are broken by the
+// package id, the package stored first wins. The package with the given path
+// is included in the comparison even if it's not stored yet. If a package in
+// the same project wins, the package is not a copy and the given path is
+// returned. Other major versions of a package are in the same project.
+var findOriginalScript = newScript(0, indexLua+`
+    local path = ARGV[1]
+    local fingerprint = ARGV[2]
+    local gen = ARGV[3]
+    local root = ARGV[4]
+
+    local bestPath = path
+    local bestCount = redis.call('SCARD', indexKey(gen, 'import:' .. path))
+    local bestId = tonumber(redis.call('GET', 'id:' .. path) or '0')
+    if bestId == 0 then
+        bestId = math.huge
+    end
+
+    for _, id in ipairs(redis.call('SMEMBERS', indexKey(gen, 'fingerprint:' .. fingerprint))) do
+        local p = redis.call('HGET', 'pkg:' .. id, 'path')
+        if p and p ~= path then
+            local n = redis.call('SCARD', indexKey(gen, 'import:' .. p))
+            local i = tonumber(id)
+            if n > bestCount or (n == bestCount and i < bestId) then
+                bestPath = p
+                bestCount = n
+                bestId = i
+            end
+        end
+    end
+
+    if bestPath ~= path then
+        local id = redis.call('GET', 'id:' .. bestPath)
+        if redis.call('SISMEMBER', indexKey(gen, 'project:' .. root), id) == 1 then
+            return path
+        end
+    end
+    return bestPath
 `)
 
-// Put adds the package documentation to the database.
+// Put adds the package documentation to the database. Packages with an
+// import path that is not valid are not stored.
 func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
+	if err := doc.CheckImportPath(pdoc.ImportPath); err != nil && !doc.IsGoRepoPath(pdoc.ImportPath) {
+		return err
+	}
+	err := db.put(pdoc, nextCrawl)
+	if err == errIndexChanged {
+		// The search index was replaced since the live generation was
+		// loaded. Load the new generation and try again.
+		db.index.invalidate()
+		err = db.put(pdoc, nextCrawl)
+	}
+	return err
+}
+
+func (db *Database) put(pdoc *doc.Package, nextCrawl time.Time) error {
 	c := db.Pool.Get()
 	defer c.Close()
 
-	score := documentScore(pdoc)
-	terms := documentTerms(pdoc, score)
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
+
+	copyOf := ""
+	if pdoc.Fingerprint != "" {
+		original, err := redis.String(findOriginalScript.Do(c, pdoc.ImportPath, pdoc.Fingerprint, si.generation, normalizeProjectRoot(pdoc.ProjectRoot)))
+		if err != nil {
+			return err
+		}
+		if original != pdoc.ImportPath {
+			copyOf = original
+		}
+	}
+	if copyOf != pdoc.CopyOf {
+		pdocNew := *pdoc
+		pdoc = &pdocNew
+		pdoc.CopyOf = copyOf
+	}
+
+	canonicalImports, err := getCanonicalImports(c, pdoc)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(canonicalImports, pdoc.CanonicalImports) {
+		pdocNew := *pdoc
+		pdoc = &pdocNew
+		pdoc.CanonicalImports = canonicalImports
+		pdoc.Diagnostics = importCaseDiagnostics(pdoc.Diagnostics, canonicalImports)
+	}
+
+	summary := ""
+	if pdoc.Synopsis == "" || pdoc.SynopsisDerived {
+		summary = doc.Summary(pdoc)
+		synopsis, err := db.derivedSynopsis(c, pdoc)
+		if err != nil {
+			return err
+		}
+		if synopsis != pdoc.Synopsis {
+			pdocNew := *pdoc
+			pdoc = &pdocNew
+			pdoc.Synopsis = synopsis
+			pdoc.SynopsisDerived = synopsis != ""
+		}
+	}
+
+	activity, err := getActivity(c, pdoc.ProjectRoot)
+	if err != nil {
+		return err
+	}
+	advisory, err := hasAdvisory(c, pdoc.ImportPath)
+	if err != nil {
+		return err
+	}
+	terms, score := indexTerms(si.tok, pdoc, activity, advisory)
 
 	var gobBuf bytes.Buffer
 	if err := gob.NewEncoder(&gobBuf).Encode(pdoc); err != nil {
@@ -202,11 +520,18 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
 		pdocNew := *pdoc
 		pdoc = &pdocNew
 		pdoc.Truncated = true
+		pdoc.Diagnostics = append([]*doc.Diagnostic{{
+			Code:     doc.DiagnosticTruncated,
+			Severity: doc.SeverityWarning,
+			Message:  "The documentation is too large to store. Declarations and examples are not shown.",
+		}}, pdoc.Diagnostics...)
 		pdoc.Vars = nil
 		pdoc.Funcs = nil
 		pdoc.Types = nil
 		pdoc.Consts = nil
 		pdoc.Examples = nil
+		pdoc.ReadmeExamples = nil
+		pdoc.Variants = nil
 		gobBuf.Reset()
 		if err := gob.NewEncoder(&gobBuf).Encode(pdoc); err != nil {
 			return err
@@ -220,7 +545,7 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
 
 	kind := "p"
 	switch {
-	case pdoc.Name == "":
+	case pdoc.Name == "" && len(pdoc.Errors) == 0:
 		kind = "d"
 	case pdoc.IsCmd:
 		kind = "c"
@@ -230,16 +555,60 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
 	if !nextCrawl.IsZero() {
 		t = nextCrawl.Unix()
 	}
-	_, err = putScript.Do(c, pdoc.ImportPath, pdoc.Synopsis, score, gobBytes, strings.Join(terms, " "), pdoc.Etag, kind, t)
-	return err
+	updated := int64(0)
+	if !pdoc.Updated.IsZero() {
+		updated = pdoc.Updated.Unix()
+	}
+
+	majorRoot := ""
+	major := doc.MajorVersion(pdoc.ImportPath, pdoc.ProjectRoot)
+	if major != 0 {
+		majorRoot = pdoc.ProjectRoot
+	}
+
+	derived := 0
+	if pdoc.SynopsisDerived {
+		derived = 1
+	}
+
+	card, err := encodeCard(pdoc)
+	if err != nil {
+		return err
+	}
+
+	lang := pdoc.DetectedLanguage
+	if lang == doc.LanguageUnknown {
+		lang = ""
+	}
+
+	methods, err := encodeMethodSets(pdoc)
+	if err != nil {
+		return err
+	}
+
+	// The script stores the documentation, the etag and the search index
+	// entries of the package together. Redis runs a script without
+	// interleaving other commands, so the stored package and the index
+	// agree after a crash at any point. The snapshot written below is a
+	// copy; losing it to a crash does not affect the current package.
+	_, err = putScript.Do(c, pdoc.ImportPath, pdoc.Synopsis, score, gobBytes, strings.Join(terms, " "), pdoc.Etag, kind, t, si.generation, fileHashes(pdoc), updated, doc.FoldImportPath(pdoc.ImportPath), summary, majorRoot, major, derived, card, lang, methods, docField(pdoc))
+	if err != nil {
+		return err
+	}
+	snapshotTime := pdoc.Updated
+	if snapshotTime.IsZero() {
+		snapshotTime = time.Now()
+	}
+	return putSnapshot(c, pdoc.ImportPath, snapshotTime, gobBytes)
 }
 
-var setNextCrawlEtagScript = redis.NewScript(0, `
+var setNextCrawlEtagScript = newScript(0, indexLua+`
     local root = ARGV[1]
     local etag = ARGV[2]
     local nextCrawl = ARGV[3]
+    local gen = ARGV[4]
 
-    local pkgs = redis.call('SORT', 'index:project:' .. root, 'GET', '#',  'GET', 'pkg:*->etag')
+    local pkgs = redis.call('SORT', indexKey(gen, 'project:' .. root), 'GET', '#',  'GET', 'pkg:*->etag')
 
     for i=1,#pkgs,2 do
         if pkgs[i+1] == etag then
@@ -252,15 +621,20 @@ var setNextCrawlEtagScript = redis.NewScript(0, `
 func (db *Database) SetNextCrawlEtag(projectRoot string, etag string, t time.Time) error {
 	c := db.Pool.Get()
 	defer c.Close()
-	_, err := setNextCrawlEtagScript.Do(c, normalizeProjectRoot(projectRoot), etag, t.Unix())
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
+	_, err = setNextCrawlEtagScript.Do(c, normalizeProjectRoot(projectRoot), etag, t.Unix(), si.generation)
 	return err
 }
 
-var setNextCrawlScript = redis.NewScript(0, `
+var setNextCrawlScript = newScript(0, indexLua+`
     local root = ARGV[1]
     local nextCrawl = tonumber(ARGV[2])
+    local gen = ARGV[3]
 
-    local pkgs = redis.call('SORT', 'index:project:' .. root, 'GET', '#')
+    local pkgs = redis.call('SORT', indexKey(gen, 'project:' .. root), 'GET', '#')
 
     for i=1,#pkgs do
         if nextCrawl < tonumber(redis.call('ZSCORE', 'nextCrawl', pkgs[i])) then
@@ -273,13 +647,83 @@ var setNextCrawlScript = redis.NewScript(0, `
 func (db *Database) SetNextCrawl(projectRoot string, t time.Time) error {
 	c := db.Pool.Get()
 	defer c.Close()
-	_, err := setNextCrawlScript.Do(c, normalizeProjectRoot(projectRoot), t.Unix())
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
+	_, err = setNextCrawlScript.Do(c, normalizeProjectRoot(projectRoot), t.Unix(), si.generation)
 	return err
 }
 
+var setPackageNextCrawlScript = newScript(0, `
+    local path = ARGV[1]
+    local nextCrawl = ARGV[2]
+
+    local id = redis.call('GET', 'id:' .. path)
+    if not id then
+        return false
+    end
+    return redis.call('ZADD', 'nextCrawl', nextCrawl, id)
+`)
+
+// SetPackageNextCrawl sets the next crawl time for the package with the
+// given import path only. Use for packages in monorepos where the packages
+// in the project are crawled independently.
+func (db *Database) SetPackageNextCrawl(path string, t time.Time) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := setPackageNextCrawlScript.Do(c, path, t.Unix())
+	return err
+}
+
+var setViewedScript = newScript(0, `
+    local path = ARGV[1]
+    local t = ARGV[2]
+
+    local id = redis.call('GET', 'id:' .. path)
+    if not id then
+        return false
+    end
+    return redis.call('ZADD', 'viewed', t, id)
+`)
+
+// SetViewed records the time that the package with the given import path
+// was viewed. The crawler uses the time to decide which packages in a
+// monorepo to refresh.
+func (db *Database) SetViewed(path string, t time.Time) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := setViewedScript.Do(c, path, t.Unix())
+	return err
+}
+
+var lastViewedScript = newScript(0, `
+    local path = ARGV[1]
+
+    local id = redis.call('GET', 'id:' .. path)
+    if not id then
+        return false
+    end
+    return redis.call('ZSCORE', 'viewed', id)
+`)
+
+// LastViewed returns the time set by SetViewed for the package with the
+// given import path or the zero time if the package was not viewed.
+func (db *Database) LastViewed(path string) (time.Time, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	t, err := redis.Int64(lastViewedScript.Do(c, path))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(t, 0), nil
+}
+
 // getDocScript gets the package documentation and update time for the
 // specified path. If path is "-", then the oldest document is returned.
-var getDocScript = redis.NewScript(0, `
+var getDocScript = newScript(0, `
     local path = ARGV[1]
 
     local id
@@ -324,13 +768,13 @@ func (db *Database) getDoc(c redis.Conn, path string) (*doc.Package, time.Time,
 		return nil, time.Time{}, err
 	}
 
-	p, err = snappy.Decode(nil, p)
+	pdoc, err := decodePackage(p, path)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
 
-	var pdoc doc.Package
-	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pdoc); err != nil {
+	pdoc.MajorVersions, err = getMajorVersions(c, pdoc)
+	if err != nil {
 		return nil, time.Time{}, err
 	}
 
@@ -339,13 +783,27 @@ func (db *Database) getDoc(c redis.Conn, path string) (*doc.Package, time.Time,
 		nextCrawl = time.Unix(t, 0).UTC()
 	}
 
-	return &pdoc, nextCrawl, err
+	return pdoc, nextCrawl, err
+}
+
+// decodePackage decodes the gob field of a package hash.
+func decodePackage(p []byte, path string) (*doc.Package, error) {
+	p, err := snappy.Decode(nil, p)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decoding %s: %v", path, err)
+	}
+	var pdoc doc.Package
+	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pdoc); err != nil {
+		return nil, fmt.Errorf("gob decoding %s: %v", path, err)
+	}
+	return &pdoc, nil
 }
 
-var getSubdirsScript = redis.NewScript(0, `
+var getSubdirsScript = newScript(0, indexLua+`
+    local gen = ARGV[1]
     local reply
-    for i = 1,#ARGV do
-        reply = redis.call('SORT', 'index:project:' .. ARGV[i], 'ALPHA', 'BY', 'pkg:*->path', 'GET', 'pkg:*->path', 'GET', 'pkg:*->synopsis', 'GET', 'pkg:*->kind')
+    for i = 2,#ARGV do
+        reply = redis.call('SORT', indexKey(gen, 'project:' .. ARGV[i]), 'ALPHA', 'BY', 'pkg:*->path', 'GET', 'pkg:*->path', 'GET', 'pkg:*->synopsis', 'GET', 'pkg:*->derived', 'GET', 'pkg:*->summary', 'GET', 'pkg:*->kind')
         if #reply > 0 then
             break
         end
@@ -353,17 +811,37 @@ var getSubdirsScript = redis.NewScript(0, `
     return reply
 `)
 
+var getPathSubdirsScript = newScript(0, indexLua+`
+    local prefix = ARGV[2]
+    local reply = {}
+    for _, m in ipairs(redis.call('ZRANGEBYLEX', indexKey(ARGV[1], 'path:'), '[' .. prefix, '(' .. prefix .. '\255')) do
+        local id = string.match(m, ' (%d+)$')
+        for _, v in ipairs(redis.call('HMGET', 'pkg:' .. id, 'path', 'synopsis', 'derived', 'summary', 'kind')) do
+            table.insert(reply, v)
+        end
+    end
+    return reply
+`)
+
 func (db *Database) getSubdirs(c redis.Conn, path string, pdoc *doc.Package) ([]Package, error) {
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, err
+	}
+
 	var reply interface{}
-	var err error
 
 	switch {
 	case isStandardPackage(path):
-		reply, err = getSubdirsScript.Do(c, "go")
+		reply, err = getSubdirsScript.Do(c, si.generation, "go")
 	case pdoc != nil:
-		reply, err = getSubdirsScript.Do(c, pdoc.ProjectRoot)
+		reply, err = getSubdirsScript.Do(c, si.generation, pdoc.ProjectRoot)
+	case si.tok.version >= pathTermVersion:
+		// The project root is not known. The packages under the path are
+		// read from the sorted set of import paths.
+		reply, err = getPathSubdirsScript.Do(c, si.generation, path+"/")
 	default:
-		var roots []interface{}
+		roots := []interface{}{si.generation}
 		projectRoot := path
 		for i := 0; i < 5; i++ {
 			roots = append(roots, projectRoot)
@@ -387,7 +865,7 @@ func (db *Database) getSubdirs(c redis.Conn, path string, pdoc *doc.Package) ([]
 	for len(values) > 0 {
 		var pkg Package
 		var kind string
-		values, err = redis.Scan(values, &pkg.Path, &pkg.Synopsis, &kind)
+		values, err = redis.Scan(values, &pkg.Path, &pkg.Synopsis, &pkg.SynopsisDerived, &pkg.Summary, &kind)
 		if err != nil {
 			return nil, err
 		}
@@ -413,6 +891,11 @@ func (db *Database) Get(path string) (*doc.Package, []Package, time.Time, error)
 	if pdoc != nil {
 		// fixup for speclal "-" path.
 		path = pdoc.ImportPath
+
+		pdoc.Activity, err = getActivity(c, pdoc.ProjectRoot)
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
 	}
 
 	subdirs, err := db.getSubdirs(c, path, pdoc)
@@ -428,31 +911,138 @@ func (db *Database) GetDoc(path string) (*doc.Package, time.Time, error) {
 	return db.getDoc(c, path)
 }
 
-var deleteScript = redis.NewScript(0, `
+func getActivity(c redis.Conn, projectRoot string) (*doc.ProjectActivity, error) {
+	p, err := redis.Bytes(c.Do("GET", "activity:"+normalizeProjectRoot(projectRoot)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var a doc.ProjectActivity
+	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetActivity returns the stored activity for the project or nil if the
+// activity has not been stored.
+func (db *Database) GetActivity(projectRoot string) (*doc.ProjectActivity, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	return getActivity(c, projectRoot)
+}
+
+var putActivityScript = newScript(0, indexLua+`
+    local root = ARGV[1]
+    local activity = ARGV[2]
+    local stale = ARGV[3] == '1'
+    local staleTerm = ARGV[4]
+
+    local gen = redis.call('HGET', 'searchIndex', 'generation') or '0'
+    local reindex = redis.call('EXISTS', 'reindex') == 1
+
+    redis.call('SET', 'activity:' .. root, activity)
+
+    for _, id in ipairs(redis.call('SMEMBERS', indexKey(gen, 'project:' .. root))) do
+        if reindex then
+            redis.call('SADD', 'reindex:updated', id)
+        end
+        local terms = {}
+        local found = false
+        for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, termsField(gen)) or '', '([^ ]+)') do
+            if term == staleTerm then
+                found = true
+            else
+                table.insert(terms, term)
+            end
+        end
+        if stale then
+            table.insert(terms, staleTerm)
+            redis.call('SADD', indexKey(gen, staleTerm), id)
+        else
+            redis.call('SREM', indexKey(gen, staleTerm), id)
+        end
+        if found ~= stale then
+            redis.call('HSET', 'pkg:' .. id, termsField(gen), table.concat(terms, ' '))
+        end
+    end
+`)
+
+// PutActivity stores the activity for the project and updates the stale
+// project search term for the packages in the project.
+func (db *Database) PutActivity(projectRoot string, a *doc.ProjectActivity) error {
+	c := db.Pool.Get()
+	defer c.Close()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(a); err != nil {
+		return err
+	}
+	stale := 0
+	if a.IsStale(time.Now()) {
+		stale = 1
+	}
+	_, err := putActivityScript.Do(c, normalizeProjectRoot(projectRoot), buf.Bytes(), stale, staleTerm)
+	return err
+}
+
+var deleteScript = newScript(0, indexLua+fileLua+majorVersionLua+`
     local path = ARGV[1]
+    local fold = ARGV[2]
 
     local id = redis.call('GET', 'id:' .. path)
     if not id then
         return false
     end
 
-    for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
-        redis.call('SREM', 'index:' .. term, id)
+    -- Remove the package from the live search index and from the search
+    -- index under construction.
+    local gens = {redis.call('HGET', 'searchIndex', 'generation') or '0'}
+    local next = redis.call('HGET', 'reindex', 'generation')
+    if next then
+        table.insert(gens, next)
+    end
+    for _, gen in ipairs(gens) do
+        for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, termsField(gen)) or '', '([^ ]+)') do
+            removeTerm(gen, term, id)
+        end
     end
 
     redis.call('ZREM', 'nextCrawl', id)
     redis.call('SREM', 'badCrawl', path)
     redis.call('SREM', 'newCrawl', path)
     redis.call('ZREM', 'popular', id)
+    redis.call('ZREM', 'viewed', id)
+    redis.call('ZREM', 'textVersion', id)
+    updateFileRefs(redis.call('HGET', 'pkg:' .. id, 'files') or '', -1)
+    if fold ~= '' and redis.call('GET', 'fold:' .. fold) == path then
+        redis.call('DEL', 'fold:' .. fold)
+    end
+    local majorRoot = redis.call('HGET', 'pkg:' .. id, 'majorRoot') or ''
+    local methods = redis.call('HGET', 'pkg:' .. id, 'methods') or ''
+    if methods ~= '' then
+        redis.call('HINCRBY', 'methodSetStats', 'packages', -1)
+        redis.call('HINCRBY', 'methodSetStats', 'bytes', -string.len(methods))
+    end
+    redis.call('INCR', 'indexChanges')
     redis.call('DEL', 'pkg:' .. id)
-    return redis.call('DEL', 'id:' .. path)
+    local result = redis.call('DEL', 'id:' .. path)
+    if majorRoot ~= '' then
+        redis.call('ZREM', 'majorVersions:' .. majorRoot, path)
+        updateMajorVersions(majorRoot)
+    end
+    return result
 `)
 
 // Delete deletes the documenation for the given import path.
 func (db *Database) Delete(path string) error {
 	c := db.Pool.Get()
 	defer c.Close()
-	_, err := deleteScript.Do(c, path)
+	if _, err := deleteScript.Do(c, path, doc.FoldImportPath(path)); err != nil {
+		return err
+	}
+	_, err := deleteSnapshotsScript.Do(c, path)
 	return err
 }
 
@@ -480,32 +1070,191 @@ func packages(reply interface{}, all bool) ([]Package, error) {
 	return result, nil
 }
 
-func (db *Database) getPackages(key string, all bool) ([]Package, error) {
+// searchResults is like packages for replies with the derived synopsis flag
+// after the synopsis and the newestMajor and lang fields after the kind.
+func searchResults(reply interface{}) ([]Package, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Package, 0, len(values)/6)
+	_, err = scanSearchResults(values, func(pkg Package) bool {
+		result = append(result, pkg)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// scanSearchResults calls fn for each package in a search reply until fn
+// returns false. The reply has the path, synopsis, derived synopsis flag,
+// kind, newest major version and language fields for each package.
+// Directories are skipped. The function returns false if fn returned false.
+func scanSearchResults(values []interface{}, fn func(Package) bool) (bool, error) {
+	for len(values) > 0 {
+		var pkg Package
+		var derived, kind string
+		var err error
+		values, err = redis.Scan(values, &pkg.Path, &pkg.Synopsis, &derived, &kind, &pkg.NewestMajor, &pkg.Language)
+		if err != nil {
+			return false, err
+		}
+		// The derived field is missing from packages stored before the
+		// field was added. SORT with STORE returns "" for the field.
+		pkg.SynopsisDerived = derived == "1"
+		if kind == "d" {
+			continue
+		}
+		if pkg.NewestMajor == pkg.Path {
+			pkg.NewestMajor = ""
+		}
+		if pkg.Path == "C" {
+			pkg.Synopsis = "Package C is a \"pseudo-package\" used to access the C namespace from a cgo source file."
+		}
+		if !fn(pkg) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// listing is like packages for replies with the derived synopsis flag and
+// summary fields after the synopsis. The summary of a directory is set to the number of packages
+// below the directory in the reply.
+func listing(reply interface{}, all bool) ([]Package, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Package, 0, len(values)/5)
+	dirs := make(map[int]bool)
+	for len(values) > 0 {
+		var pkg Package
+		var kind string
+		values, err = redis.Scan(values, &pkg.Path, &pkg.Synopsis, &pkg.SynopsisDerived, &pkg.Summary, &kind)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "d" {
+			if !all {
+				continue
+			}
+			dirs[len(result)] = true
+		}
+		if pkg.Path == "C" {
+			pkg.Synopsis = "Package C is a \"pseudo-package\" used to access the C namespace from a cgo source file."
+		}
+		result = append(result, pkg)
+	}
+	for i := range dirs {
+		prefix := result[i].Path + "/"
+		n := 0
+		for j, pkg := range result {
+			if strings.HasPrefix(pkg.Path, prefix) && !dirs[j] {
+				n++
+			}
+		}
+		switch n {
+		case 0:
+		case 1:
+			result[i].Summary = "1 package"
+		default:
+			result[i].Summary = strconv.Itoa(n) + " packages"
+		}
+	}
+	return result, nil
+}
+
+// getPackages returns the packages in the index set for term.
+func (db *Database) getPackages(term string, all bool) ([]Package, error) {
 	c := db.Pool.Get()
 	defer c.Close()
-	reply, err := c.Do("SORT", key, "ALPHA", "BY", "pkg:*->path", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind")
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.Do("SORT", si.key(term), "ALPHA", "BY", "pkg:*->path", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->derived", "GET", "pkg:*->summary", "GET", "pkg:*->kind")
 	if err != nil {
 		return nil, err
 	}
-	return packages(reply, all)
+	return listing(reply, all)
 }
 
 func (db *Database) GoIndex() ([]Package, error) {
-	return db.getPackages("index:project:go", false)
+	return db.getPackages("project:go", false)
 }
 
 func (db *Database) Index() ([]Package, error) {
-	return db.getPackages("index:all:", false)
+	return db.getPackages("all:", false)
 }
 
 func (db *Database) Project(projectRoot string) ([]Package, error) {
-	return db.getPackages("index:project:"+normalizeProjectRoot(projectRoot), true)
+	return db.getPackages("project:"+normalizeProjectRoot(projectRoot), true)
+}
+
+var projectUpdatedScript = newScript(0, indexLua+`
+    local gen = ARGV[1]
+    local root = ARGV[2]
+
+    local n = 0
+    local updated = 0
+    for _, id in ipairs(redis.call('SMEMBERS', indexKey(gen, 'project:' .. root))) do
+        n = n + 1
+        local t = tonumber(redis.call('HGET', 'pkg:' .. id, 'updated')) or 0
+        if t > updated then
+            updated = t
+        end
+    end
+    return {n, updated}
+`)
+
+// ProjectUpdated returns the number of stored packages in the project with
+// the given root and the latest time that one of the packages was fetched.
+// The values change when a package in the project is stored or deleted.
+func (db *Database) ProjectUpdated(projectRoot string) (int, time.Time, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	values, err := redis.Values(projectUpdatedScript.Do(c, si.generation, normalizeProjectRoot(projectRoot)))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var n int
+	var updated int64
+	if _, err := redis.Scan(values, &n, &updated); err != nil {
+		return 0, time.Time{}, err
+	}
+	if updated == 0 {
+		return n, time.Time{}, nil
+	}
+	return n, time.Unix(updated, 0).UTC(), nil
+}
+
+// IndexChanges returns a counter that is incremented when a package is
+// stored or deleted. Use the counter to detect changes to the index.
+func (db *Database) IndexChanges() (int64, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	n, err := redis.Int64(c.Do("GET", "indexChanges"))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return n, err
 }
 
 func (db *Database) AllPackages() ([]Package, error) {
 	c := db.Pool.Get()
 	defer c.Close()
-	values, err := redis.Values(c.Do("SORT", "nextCrawl", "DESC", "BY", "pkg:*->score", "GET", "pkg:*->path", "GET", "pkg:*->kind"))
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Values(c.Do("SORT", "nextCrawl", "DESC", "BY", "pkg:*->"+si.scoreField(), "GET", "pkg:*->path", "GET", "pkg:*->kind"))
 	if err != nil {
 		return nil, err
 	}
@@ -525,19 +1274,26 @@ func (db *Database) AllPackages() ([]Package, error) {
 	return result, nil
 }
 
-var packagesScript = redis.NewScript(0, `
+var packagesScript = newScript(0, `
     local result = {}
     for i = 1,#ARGV do
         local path = ARGV[i]
         local synopsis = ''
+        local derived = '0'
+        local summary = ''
         local kind = 'u'
         local id = redis.call('GET', 'id:' .. path)
         if id then
-            synopsis = redis.call('HGET', 'pkg:' .. id, 'synopsis')
-            kind = redis.call('HGET', 'pkg:' .. id, 'kind')
+            local values = redis.call('HMGET', 'pkg:' .. id, 'synopsis', 'derived', 'summary', 'kind')
+            synopsis = values[1]
+            derived = values[2] or '0'
+            summary = values[3] or ''
+            kind = values[4]
         end
         result[#result+1] = path
         result[#result+1] = synopsis
+        result[#result+1] = derived
+        result[#result+1] = summary
         result[#result+1] = kind
     end
     return result
@@ -554,7 +1310,7 @@ func (db *Database) Packages(paths []string) ([]Package, error) {
 	if err != nil {
 		return nil, err
 	}
-	pkgs, err := packages(reply, false)
+	pkgs, err := listing(reply, false)
 	sort.Sort(byPath(pkgs))
 	return pkgs, err
 }
@@ -562,27 +1318,53 @@ func (db *Database) Packages(paths []string) ([]Package, error) {
 func (db *Database) ImporterCount(path string) (int, error) {
 	c := db.Pool.Get()
 	defer c.Close()
-	return redis.Int(c.Do("SCARD", "index:import:"+path))
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(c.Do("SCARD", si.key("import:"+path)))
 }
 
 func (db *Database) Importers(path string) ([]Package, error) {
-	return db.getPackages("index:import:"+path, false)
+	return db.getPackages("import:"+path, false)
+}
+
+// TestImporterCount returns the number of packages with tests that import
+// path.
+func (db *Database) TestImporterCount(path string) (int, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(c.Do("SCARD", si.key(testImportTermPrefix+path)))
+}
+
+// TestImporters returns the packages with tests that import path.
+func (db *Database) TestImporters(path string) ([]Package, error) {
+	return db.getPackages(testImportTermPrefix+path, false)
 }
 
 func (db *Database) Block(root string) error {
 	c := db.Pool.Get()
 	defer c.Close()
-	if _, err := c.Do("SADD", "block", root); err != nil {
+	if _, err := addBlockRulesScript.Do(c, time.Now().Unix(), BlockPath, root); err != nil {
 		return err
 	}
+	return deleteBlocked(c, root)
+}
+
+// deleteBlocked deletes the packages with import paths at or below root.
+func deleteBlocked(c redis.Conn, root string) error {
 	keys, err := redis.Values(c.Do("KEYS", "id:"+root+"*"))
 	if err != nil {
 		return err
 	}
 	for _, key := range keys {
 		path := string(key.([]byte)[len("id:"):])
-		if path == root || strings.HasPrefix(path, root) && path[len(root)] == '/' {
-			if _, err := deleteScript.Do(c, path); err != nil {
+		if isBlockedBy(path, root) {
+			if _, err := deleteScript.Do(c, path, doc.FoldImportPath(path)); err != nil {
 				return err
 			}
 		}
@@ -590,7 +1372,7 @@ func (db *Database) Block(root string) error {
 	return nil
 }
 
-var isBlockedScript = redis.NewScript(0, `
+var isBlockedScript = newScript(0, `
     local path = ''
     for s in string.gmatch(ARGV[1], '[^/]+') do
         path = path .. s
@@ -602,6 +1384,9 @@ var isBlockedScript = redis.NewScript(0, `
     return  0
 `)
 
+// IsBlocked returns true if a path rule blocks the package with the given
+// import path. The hit count of the rule is not incremented; callers that
+// reject a request use BlockingRule and CountBlockHit.
 func (db *Database) IsBlocked(path string) (bool, error) {
 	c := db.Pool.Get()
 	defer c.Close()
@@ -609,32 +1394,132 @@ func (db *Database) IsBlocked(path string) (bool, error) {
 }
 
 func (db *Database) Query(q string) ([]Package, error) {
-	terms := parseQuery(q)
-	if len(terms) == 0 {
-		return nil, nil
+	return db.QueryScope(q, "")
+}
+
+// QueryScope executes a query restricted to the packages in the project with
+// the given root. The standard library has the root "go". If scope is "",
+// then all packages are searched. A query with an implements:<interface>
+// field, as in implements:io.Reader, returns the packages with exported
+// types that implement the interface. Packages whose only content is errors
+// are returned for queries with the all: prefix only.
+func (db *Database) QueryScope(q string, scope string) ([]Package, error) {
+	return db.queryScope(q, scope, SortByDocumentScore)
+}
+
+// searchQuery is a parsed search query. Query, QuerySession and QueryFunc
+// use searchQuery to select, exclude and highlight the results in the same
+// way.
+type searchQuery struct {
+	si searchIndex
+
+	// q is the query with the all: prefix removed.
+	q string
+
+	terms []string
+
+	// all is true if the packages whose only content is errors are
+	// included in the results.
+	all bool
+}
+
+func (si searchIndex) parseSearchQuery(q string) (*searchQuery, error) {
+	q, all := trimAllPrefix(q)
+	terms, err := si.queryTerms(q)
+	if err != nil {
+		return nil, err
+	}
+	return &searchQuery{si: si, q: q, terms: terms, all: all}, nil
+}
+
+// sendStore sends the commands to store the intersection of the sets with
+// the given keys in the set with key id. Unless the query has the all:
+// prefix, the packages whose only content is errors are removed from the set.
+func (sq *searchQuery) sendStore(c redis.Conn, id string, keys ...interface{}) {
+	c.Send("SINTERSTORE", append([]interface{}{id}, keys...)...)
+	if !sq.all {
+		c.Send("SDIFFSTORE", id, id, sq.si.key(errorsOnlyTerm))
+	}
+}
+
+// sortOptions returns the SORT options for the results of the query. The
+// reply is read with results.
+func (sq *searchQuery) sortOptions() []interface{} {
+	return []interface{}{"DESC", "BY", "pkg:*->" + sq.si.scoreField(), "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->derived", "GET", "pkg:*->kind", "GET", "pkg:*->newestMajor", "GET", "pkg:*->lang", "GET", "pkg:*->doc"}
+}
+
+// sortFields is the number of fields for each package in a reply to a sort
+// with the searchQuery sortOptions.
+const sortFields = 7
+
+// results returns the packages in a reply to a sort with sortOptions with the
+// matches of the query terms set.
+func (sq *searchQuery) results(reply interface{}) ([]Package, error) {
+	pkgs, docs, err := searchResultsWithDocs(reply)
+	if err != nil {
+		return nil, err
 	}
+	sq.si.setMatches(sq.terms, pkgs, docs)
+	return pkgs, nil
+}
+
+func (db *Database) queryScope(q string, scope string, order SortOrder) ([]Package, error) {
 	c := db.Pool.Get()
 	defer c.Close()
-	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, err
+	}
+	if name, rest, ok := implementsQuery(q); ok {
+		return db.queryImplements(c, si, name, rest, scope)
+	}
+	sq, err := si.parseSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(sq.terms) == 0 {
+		return nil, nil
+	}
+	id, err := tempKey(c)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, temp, err := si.termKeys(c, sq.terms)
+	if len(temp) > 0 {
+		defer c.Do("DEL", temp...)
+	}
 	if err != nil {
 		return nil, err
 	}
-	id := "tmp:query-" + strconv.Itoa(n)
 
-	args := []interface{}{id}
-	for _, term := range terms {
-		args = append(args, "index:"+term)
+	if scope != "" {
+		keys = append([]interface{}{si.key("project:" + normalizeProjectRoot(scope))}, keys...)
+	}
+	sq.sendStore(c, id, keys...)
+	if order == SortByRank {
+		c.Send("SORT", si.rankedSortArgs(id)...)
+	} else {
+		c.Send("SORT", append([]interface{}{id}, sq.sortOptions()...)...)
 	}
-	c.Send("SINTERSTORE", args...)
-	c.Send("SORT", id, "DESC", "BY", "pkg:*->score", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind")
 	c.Send("DEL", id)
 	values, err := redis.Values(c.Do(""))
 	if err != nil {
 		return nil, err
 	}
-	pkgs, err := packages(values[1], false)
+	reply := values[len(values)-2]
+	var pkgs []Package
+	if order == SortByRank {
+		pkgs, err = si.rankResults(c, sq.terms, reply)
+	} else {
+		pkgs, err = sq.results(reply)
+	}
+	return moveStandardMatch(pkgs, sq.q), err
+}
 
-	// Move exact match on standard package to the top of the list.
+// moveStandardMatch moves an exact match on a standard package to the top of
+// the list.
+func moveStandardMatch(pkgs []Package, q string) []Package {
 	for i, pkg := range pkgs {
 		if !isStandardPackage(pkg.Path) {
 			break
@@ -644,7 +1529,7 @@ func (db *Database) Query(q string) ([]Package, error) {
 			break
 		}
 	}
-	return pkgs, err
+	return pkgs
 }
 
 type PackageInfo struct {
@@ -658,12 +1543,16 @@ type PackageInfo struct {
 func (db *Database) Do(f func(*PackageInfo) error) error {
 	c := db.Pool.Get()
 	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
 	keys, err := redis.Values(c.Do("KEYS", "pkg:*"))
 	if err != nil {
 		return err
 	}
 	for _, key := range keys {
-		values, err := redis.Values(c.Do("HMGET", key, "gob", "score", "kind", "path"))
+		values, err := redis.Values(c.Do("HMGET", key, "gob", si.scoreField(), "kind", "path"))
 		if err != nil {
 			return err
 		}
@@ -682,13 +1571,9 @@ func (db *Database) Do(f func(*PackageInfo) error) error {
 			continue
 		}
 
-		p, err = snappy.Decode(nil, p)
+		pi.PDoc, err = decodePackage(p, path)
 		if err != nil {
-			return fmt.Errorf("snappy decoding %s: %v", path, err)
-		}
-
-		if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pi.PDoc); err != nil {
-			return fmt.Errorf("gob decoding %s: %v", path, err)
+			return err
 		}
 		pi.Pkgs, err = db.getSubdirs(c, pi.PDoc.ImportPath, pi.PDoc)
 		if err != nil {
@@ -701,18 +1586,22 @@ func (db *Database) Do(f func(*PackageInfo) error) error {
 	return nil
 }
 
-var importGraphScript = redis.NewScript(0, `
+var importGraphScript = newScript(0, indexLua+`
     local path = ARGV[1]
+    local gen = ARGV[2]
 
     local id = redis.call('GET', 'id:' .. path)
     if not id then
         return false
     end
 
-    return redis.call('HMGET', 'pkg:' .. id, 'synopsis', 'terms')
+    return redis.call('HMGET', 'pkg:' .. id, 'synopsis', termsField(gen))
 `)
 
-func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool) ([]Package, [][2]int, error) {
+// ImportGraph returns the packages in the dependency graph of pdoc, the
+// edges between the packages and the indexes of the packages that are not in
+// the database. The first package is pdoc.
+func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool) ([]Package, [][2]int, []int, error) {
 
 	// This breadth-first traversal of the package's dependencies uses the
 	// Redis pipeline as queue. Links to packages with invalid import paths are
@@ -720,33 +1609,39 @@ func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool) ([]Package,
 
 	c := db.Pool.Get()
 	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	if err := importGraphScript.Load(c); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	nodes := []Package{{Path: pdoc.ImportPath, Synopsis: pdoc.Synopsis}}
 	edges := [][2]int{}
 	index := map[string]int{pdoc.ImportPath: 0}
+	var unindexed []int
 
 	for _, path := range pdoc.Imports {
 		j := len(nodes)
 		index[path] = j
 		edges = append(edges, [2]int{0, j})
 		nodes = append(nodes, Package{Path: path})
-		importGraphScript.Send(c, path)
+		importGraphScript.Send(c, path, si.generation)
 	}
 
 	for i := 1; i < len(nodes); i++ {
 		c.Flush()
 		r, err := redis.Values(c.Receive())
 		if err == redis.ErrNil {
+			unindexed = append(unindexed, i)
 			continue
 		} else if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		var synopsis, terms string
 		if _, err := redis.Scan(r, &synopsis, &terms); err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		nodes[i].Synopsis = synopsis
 		if hideStdDeps && isStandardPackage(nodes[i].Path) {
@@ -760,13 +1655,13 @@ func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool) ([]Package,
 					j = len(nodes)
 					index[path] = j
 					nodes = append(nodes, Package{Path: path})
-					importGraphScript.Send(c, path)
+					importGraphScript.Send(c, path, si.generation)
 				}
 				edges = append(edges, [2]int{i, j})
 			}
 		}
 	}
-	return nodes, edges, nil
+	return nodes, edges, unindexed, nil
 }
 
 func (db *Database) PutGob(key string, value interface{}) error {
@@ -792,7 +1687,7 @@ func (db *Database) GetGob(key string, value interface{}) error {
 	return gob.NewDecoder(bytes.NewReader(p)).Decode(value)
 }
 
-var incrementPopularScore = redis.NewScript(0, `
+var incrementPopularScore = newScript(0, `
     local path = ARGV[1]
     local n = ARGV[2]
     local t = ARGV[3]
@@ -828,7 +1723,7 @@ func (db *Database) IncrementPopularScore(path string) error {
 	return err
 }
 
-var popularScript = redis.NewScript(0, `
+var popularScript = newScript(0, `
     local stop = ARGV[1]
     local ids = redis.call('ZREVRANGE', 'popular', '0', stop)
     local result = {}
@@ -852,7 +1747,7 @@ func (db *Database) Popular(count int) ([]Package, error) {
 	return pkgs, err
 }
 
-var popularWithScoreScript = redis.NewScript(0, `
+var popularWithScoreScript = newScript(0, `
     local ids = redis.call('ZREVRANGE', 'popular', '0', -1, 'WITHSCORES')
     local result = {}
     for i=1,#ids,2 do
@@ -884,7 +1779,33 @@ func (db *Database) GetNewCrawl() (string, error) {
 	return v, err
 }
 
-var setBadCrawlScript = redis.NewScript(0, `
+var queueNewCrawlScript = newScript(0, `
+    for _, path in ipairs(ARGV) do
+        if redis.call('EXISTS', 'id:' .. path) == 0 then
+            redis.call('SREM', 'badCrawl', path)
+            redis.call('SADD', 'newCrawl', path)
+        end
+    end
+`)
+
+// QueueNewCrawl adds the packages that are not in the database to the set
+// of new paths to crawl. Paths that returned an error when crawled before
+// are crawled again.
+func (db *Database) QueueNewCrawl(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	args := make([]interface{}, len(paths))
+	for i, path := range paths {
+		args[i] = path
+	}
+	_, err := queueNewCrawlScript.Do(c, args...)
+	return err
+}
+
+var setBadCrawlScript = newScript(0, `
     local path = ARGV[1]
     if redis.call('SREM', 'newCrawl', path) == 1 then
         redis.call('SADD', 'badCrawl', path)
@@ -897,3 +1818,20 @@ func (db *Database) SetBadCrawl(path string) error {
 	_, err := setBadCrawlScript.Do(c, path)
 	return err
 }
+
+// IsMonorepo returns true if the project with the given root is stored as a
+// monorepo with SetMonorepo.
+func (db *Database) IsMonorepo(projectRoot string) (bool, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	return redis.Bool(c.Do("SISMEMBER", "monorepos", projectRoot))
+}
+
+// SetMonorepo stores the project with the given root as a monorepo. The
+// packages of a monorepo are fetched one directory at a time.
+func (db *Database) SetMonorepo(projectRoot string) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := c.Do("SADD", "monorepos", projectRoot)
+	return err
+}
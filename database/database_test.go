@@ -16,8 +16,11 @@ package database
 
 import (
 	"math"
+	"math/rand"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,7 +28,7 @@ import (
 	"github.com/garyburd/redigo/redis"
 )
 
-func newDB(t *testing.T) *Database {
+func newDB(t testing.TB) *Database {
 	p := redis.NewPool(func() (redis.Conn, error) {
 		c, err := redis.DialTimeout("tcp", ":6379", 0, 1*time.Second, 1*time.Second)
 		if err != nil {
@@ -145,7 +148,7 @@ func TestPutGet(t *testing.T) {
 	if err != nil {
 		t.Fatalf("db.Importers() retunred error %v", err)
 	}
-	expectedImporters := []Package{{"github.com/user/repo/foo/bar", "hello"}}
+	expectedImporters := []Package{{Path: "github.com/user/repo/foo/bar", Synopsis: "hello"}}
 	if !reflect.DeepEqual(actualImporters, expectedImporters) {
 		t.Errorf("db.Importers() = %v, want %v", actualImporters, expectedImporters)
 	}
@@ -158,7 +161,7 @@ func TestPutGet(t *testing.T) {
 			actualImports[i].Synopsis = ""
 		}
 	}
-	expectedImports := []Package{{"C", ""}, {"errors", ""}, {"github.com/user/repo/foo/bar", "hello"}}
+	expectedImports := []Package{{Path: "C"}, {Path: "errors"}, {Path: "github.com/user/repo/foo/bar", Synopsis: "hello"}}
 	if !reflect.DeepEqual(actualImports, expectedImports) {
 		t.Errorf("db.Imports() = %v, want %v", actualImports, expectedImports)
 	}
@@ -195,8 +198,11 @@ func TestPutGet(t *testing.T) {
 	c.Send("DEL", "maxQueryId")
 	c.Send("DEL", "maxPackageId")
 	c.Send("DEL", "block")
+	c.Send("DEL", "blockAdded")
+	c.Send("DEL", "blockHits")
 	c.Send("DEL", "popular:0")
 	c.Send("DEL", "newCrawl")
+	c.Send("DEL", "indexChanges")
 	if n, err := c.Do("DBSIZE"); n != int64(0) || err != nil {
 		t.Errorf("c.Do(DBSIZE) = %d, %v, want 0, nil", n, err)
 	}
@@ -241,3 +247,1049 @@ func TestPopular(t *testing.T) {
 		}
 	}
 }
+
+func TestCopy(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	original := &doc.Package{
+		ImportPath:  "github.com/user/stack",
+		Name:        "stack",
+		ProjectRoot: "github.com/user/stack",
+		Fingerprint: "abc",
+	}
+	copy := &doc.Package{
+		ImportPath:  "github.com/other/app/stack",
+		Name:        "stack",
+		ProjectRoot: "github.com/other/app",
+		Fingerprint: "abc",
+	}
+	// Other major versions and packages in the same project are not copies.
+	v2 := &doc.Package{
+		ImportPath:  "github.com/user/stack/v2",
+		Name:        "stack",
+		ProjectRoot: "github.com/user/stack",
+		Fingerprint: "abc",
+	}
+	sub := &doc.Package{
+		ImportPath:  "github.com/user/stack/internal/stack",
+		Name:        "stack",
+		ProjectRoot: "github.com/user/stack",
+		Fingerprint: "abc",
+	}
+	for _, pdoc := range []*doc.Package{original, copy, v2, sub, original} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%s) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for _, tt := range []struct{ path, copyOf string }{
+		{original.ImportPath, ""},
+		{copy.ImportPath, original.ImportPath},
+		{v2.ImportPath, ""},
+		{sub.ImportPath, ""},
+	} {
+		pdoc, _, _, err := db.Get(tt.path)
+		if err != nil {
+			t.Fatalf("db.Get(%s) returned error %v", tt.path, err)
+		}
+		if pdoc.CopyOf != tt.copyOf {
+			t.Errorf("db.Get(%s) returned CopyOf %q, want %q", tt.path, pdoc.CopyOf, tt.copyOf)
+		}
+	}
+}
+
+func TestActivity(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{
+		ImportPath:  "github.com/user/repo/pkg",
+		Name:        "pkg",
+		ProjectRoot: "github.com/user/repo",
+		Synopsis:    "Package pkg does things.",
+		Funcs:       []*doc.Func{{}},
+	}
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	for _, stale := range []bool{true, false, true} {
+		a := &doc.ProjectActivity{LastCommit: time.Now().UTC(), Contributors: 3, OpenIssues: -1, Fetched: time.Now().UTC()}
+		if stale {
+			a.LastCommit = a.LastCommit.Add(-2 * 365 * 24 * time.Hour)
+		}
+		if err := db.PutActivity(pdoc.ProjectRoot, a); err != nil {
+			t.Fatalf("db.PutActivity() returned error %v", err)
+		}
+
+		actual, _, _, err := db.Get(pdoc.ImportPath)
+		if err != nil {
+			t.Fatalf("db.Get() returned error %v", err)
+		}
+		if actual.Activity == nil || !actual.Activity.LastCommit.Equal(a.LastCommit) {
+			t.Errorf("db.Get() returned activity %v, want %v", actual.Activity, a)
+		}
+
+		pkgs, err := db.Query("stale:yes")
+		if err != nil {
+			t.Fatalf("db.Query() returned error %v", err)
+		}
+		if found := len(pkgs) == 1; found != stale {
+			t.Errorf("stale=%v, db.Query(stale:yes) returned %v", stale, pkgs)
+		}
+	}
+
+	// Put preserves the stale term.
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+	if pkgs, err := db.Query("stale:yes"); err != nil || len(pkgs) != 1 {
+		t.Errorf("db.Query(stale:yes) after put returned %v, %v", pkgs, err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const ttl = 200 * time.Millisecond
+	for _, tt := range []struct {
+		holder string
+		ok     bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"a", true},
+	} {
+		ok, err := db.AcquireLease("crawl", tt.holder, ttl)
+		if err != nil {
+			t.Fatalf("db.AcquireLease(%s) returned error %v", tt.holder, err)
+		}
+		if ok != tt.ok {
+			t.Errorf("db.AcquireLease(%s) = %v, want %v", tt.holder, ok, tt.ok)
+		}
+	}
+
+	// Release by another holder does not release the lease.
+	if err := db.ReleaseLease("crawl", "b"); err != nil {
+		t.Fatalf("db.ReleaseLease(b) returned error %v", err)
+	}
+	if ok, _ := db.AcquireLease("crawl", "b", ttl); ok {
+		t.Errorf("db.AcquireLease(b) after release by b = true, want false")
+	}
+
+	// The lease expires when not renewed.
+	time.Sleep(2 * ttl)
+	if ok, _ := db.AcquireLease("crawl", "b", ttl); !ok {
+		t.Errorf("db.AcquireLease(b) after expiration = false, want true")
+	}
+
+	if err := db.ReleaseLease("crawl", "b"); err != nil {
+		t.Fatalf("db.ReleaseLease(b) returned error %v", err)
+	}
+	if ok, _ := db.AcquireLease("crawl", "a", ttl); !ok {
+		t.Errorf("db.AcquireLease(a) after release = false, want true")
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	want := map[string]APIToken{
+		"a": {Label: "alice", Tier: "standard"},
+		"b": {Label: "bob", Tier: "high"},
+	}
+	for token, at := range want {
+		if err := db.PutAPIToken(token, at); err != nil {
+			t.Fatalf("db.PutAPIToken(%s) returned error %v", token, err)
+		}
+	}
+	tokens, err := db.APITokens()
+	if err != nil {
+		t.Fatalf("db.APITokens() returned error %v", err)
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("db.APITokens() = %v, want %v", tokens, want)
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	c := db.Pool.Get()
+	defer c.Close()
+
+	for _, hash := range []string{"a1", "b1", "b2"} {
+		if err := db.PutFile(hash, []byte("content of "+hash)); err != nil {
+			t.Fatalf("db.PutFile(%s) returned error %v", hash, err)
+		}
+	}
+	p, err := db.GetFile("a1")
+	if err != nil || string(p) != "content of a1" {
+		t.Errorf("db.GetFile(a1) = %q, %v, want %q", p, err, "content of a1")
+	}
+	if p, err := db.GetFile("x"); p != nil || err != nil {
+		t.Errorf("db.GetFile(x) = %q, %v, want nil, nil", p, err)
+	}
+
+	// ttl returns the time to live of a cached file, -1 if the file does
+	// not expire.
+	ttl := func(hash string) int {
+		n, err := redis.Int(c.Do("TTL", "file:"+hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	pdoc := &doc.Package{
+		ImportPath: "github.com/user/repo/foo",
+		Name:       "foo",
+		Files:      []*doc.File{{Name: "a.go", Hash: "a1"}, {Name: "b.go", Hash: "b1"}},
+	}
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl("a1") != -1 || ttl("b1") != -1 || ttl("b2") <= 0 {
+		t.Errorf("after put, ttl a1=%d b1=%d b2=%d, want referenced files to persist", ttl("a1"), ttl("b1"), ttl("b2"))
+	}
+
+	// Replacing b1 with b2 releases b1.
+	pdoc.Files[1].Hash = "b2"
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl("a1") != -1 || ttl("b1") <= 0 || ttl("b2") != -1 {
+		t.Errorf("after update, ttl a1=%d b1=%d b2=%d, want b1 to expire", ttl("a1"), ttl("b1"), ttl("b2"))
+	}
+
+	if err := db.Delete(pdoc.ImportPath); err != nil {
+		t.Fatal(err)
+	}
+	if ttl("a1") <= 0 || ttl("b2") <= 0 {
+		t.Errorf("after delete, ttl a1=%d b2=%d, want files to expire", ttl("a1"), ttl("b2"))
+	}
+}
+
+func TestQueryScope(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdocs := []*doc.Package{
+		{ImportPath: "example.com/oauth", ProjectRoot: "example.com/oauth", Name: "oauth", Synopsis: "Package oauth implements OAuth string signing.", Funcs: []*doc.Func{{}}},
+		{ImportPath: "example.com/oauth/util", ProjectRoot: "example.com/oauth", Name: "util", Synopsis: "Package util formats OAuth strings.", Funcs: []*doc.Func{{}}},
+	}
+	for _, tt := range indexTests {
+		pdocs = append(pdocs, tt.pdoc)
+	}
+	for _, pdoc := range pdocs {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		q, scope string
+		paths    []string
+	}{
+		{"oauth", "", []string{"example.com/oauth", "example.com/oauth/util", "github.com/user/repo/dir"}},
+		{"oauth", "example.com/oauth", []string{"example.com/oauth", "example.com/oauth/util"}},
+		{"string", "example.com/oauth", []string{"example.com/oauth", "example.com/oauth/util"}},
+		{"string", "go", []string{"strconv"}},
+		{"conversions", "example.com/oauth", nil},
+	} {
+		pkgs, err := db.QueryScope(tt.q, tt.scope)
+		if err != nil {
+			t.Fatalf("db.QueryScope(%q, %q) returned error %v", tt.q, tt.scope, err)
+		}
+		var paths []string
+		for _, pkg := range pkgs {
+			paths = append(paths, pkg.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("db.QueryScope(%q, %q) = %v, want %v", tt.q, tt.scope, paths, tt.paths)
+		}
+	}
+}
+
+func TestTermStats(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "example.com/oauth", ProjectRoot: "example.com/oauth", Name: "oauth", Synopsis: "Package oauth implements OAuth string signing.", Funcs: []*doc.Func{{}}},
+		{ImportPath: "example.com/oauth/util", ProjectRoot: "example.com/oauth", Name: "util", Synopsis: "Package util formats OAuth strings.", Funcs: []*doc.Func{{}}},
+	} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := db.TermStats("", 0)
+	if err != nil {
+		t.Fatalf("db.TermStats() returned error %v", err)
+	}
+	counts := make(map[string]int)
+	for i, s := range stats {
+		if strings.Contains(s.Term, ":") {
+			t.Errorf("db.TermStats() returned filter term %q", s.Term)
+		}
+		if i > 0 && s.Count > stats[i-1].Count {
+			t.Errorf("db.TermStats() not sorted by count: %v", stats)
+		}
+		counts[s.Term] = s.Count
+	}
+	for term, n := range map[string]int{"oau": 2, stem("string"): 2, stem("signing"): 1, "util": 1} {
+		if counts[term] != n {
+			t.Errorf("count of %q = %d, want %d", term, counts[term], n)
+		}
+	}
+
+	stats, err = db.TermStats("oa", 0)
+	if err != nil {
+		t.Fatalf("db.TermStats(oa) returned error %v", err)
+	}
+	if want := []TermStat{{"oau", 2}}; !reflect.DeepEqual(stats, want) {
+		t.Errorf("db.TermStats(oa) = %v, want %v", stats, want)
+	}
+
+	stats, err = db.TermStats("", 1)
+	if err != nil {
+		t.Fatalf("db.TermStats(limit 1) returned error %v", err)
+	}
+	if len(stats) != 1 || stats[0].Count != 2 {
+		t.Errorf("db.TermStats(limit 1) = %v, want one term with count 2", stats)
+	}
+}
+
+func TestProjectUpdated(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	root := &doc.Package{ImportPath: "example.com/proj", ProjectRoot: "example.com/proj", Name: "proj", Updated: time.Unix(1365000000, 0)}
+	sub := &doc.Package{ImportPath: "example.com/proj/sub", ProjectRoot: "example.com/proj", Name: "sub", Updated: time.Unix(1366000000, 0)}
+	for _, pdoc := range []*doc.Package{root, sub} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, updated, err := db.ProjectUpdated("example.com/proj")
+	if err != nil {
+		t.Fatalf("db.ProjectUpdated() returned error %v", err)
+	}
+	if n != 2 || !updated.Equal(sub.Updated) {
+		t.Errorf("db.ProjectUpdated() = %d, %v, want 2, %v", n, updated, sub.Updated)
+	}
+
+	if err := db.Delete(sub.ImportPath); err != nil {
+		t.Fatal(err)
+	}
+	n, updated, err = db.ProjectUpdated("example.com/proj")
+	if err != nil {
+		t.Fatalf("db.ProjectUpdated() after delete returned error %v", err)
+	}
+	if n != 1 || !updated.Equal(root.Updated) {
+		t.Errorf("db.ProjectUpdated() after delete = %d, %v, want 1, %v", n, updated, root.Updated)
+	}
+}
+
+func TestMonorepo(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	if ok, err := db.IsMonorepo("github.com/org/big"); err != nil || ok {
+		t.Errorf("db.IsMonorepo() before set = %v, %v, want false", ok, err)
+	}
+	if err := db.SetMonorepo("github.com/org/big"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.IsMonorepo("github.com/org/big"); err != nil || !ok {
+		t.Errorf("db.IsMonorepo() after set = %v, %v, want true", ok, err)
+	}
+	if ok, err := db.IsMonorepo("github.com/org/small"); err != nil || ok {
+		t.Errorf("db.IsMonorepo(other) = %v, %v, want false", ok, err)
+	}
+}
+
+func TestMonorepoViewed(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdocs := []*doc.Package{
+		{ImportPath: "github.com/org/big/a", ProjectRoot: "github.com/org/big", Name: "a", Monorepo: true},
+		{ImportPath: "github.com/org/big/b", ProjectRoot: "github.com/org/big", Name: "b", Monorepo: true},
+	}
+	for _, pdoc := range pdocs {
+		if err := db.Put(pdoc, time.Unix(100, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lastViewed, err := db.LastViewed("github.com/org/big/a"); err != nil || !lastViewed.IsZero() {
+		t.Errorf("db.LastViewed() before view = %v, %v, want zero time", lastViewed, err)
+	}
+	if err := db.SetViewed("github.com/org/big/a", time.Unix(200, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if lastViewed, err := db.LastViewed("github.com/org/big/a"); err != nil || lastViewed.Unix() != 200 {
+		t.Errorf("db.LastViewed() = %v, %v, want 200", lastViewed, err)
+	}
+
+	// Postponing one package does not change the other packages in the
+	// project.
+	if err := db.SetPackageNextCrawl("github.com/org/big/a", time.Unix(300, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int64{"github.com/org/big/a": 300, "github.com/org/big/b": 100} {
+		_, _, nextCrawl, err := db.Get(path)
+		if err != nil || nextCrawl.Unix() != want {
+			t.Errorf("next crawl for %s = %v, %v, want %d", path, nextCrawl, err, want)
+		}
+	}
+
+	if err := db.Delete("github.com/org/big/a"); err != nil {
+		t.Fatal(err)
+	}
+	if lastViewed, err := db.LastViewed("github.com/org/big/a"); err != nil || !lastViewed.IsZero() {
+		t.Errorf("db.LastViewed() after delete = %v, %v, want zero time", lastViewed, err)
+	}
+}
+
+func TestInPathTree(t *testing.T) {
+	for _, tt := range []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"github.com/user/repo", "", true},
+		{"github.com/user/repo", "github.com/user/repo", true},
+		{"github.com/user/repo/sub", "github.com/user/repo", true},
+		{"github.com/user/repox", "github.com/user/repo", false},
+		{"github.com/user", "github.com/user/repo", false},
+	} {
+		if got := inPathTree(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("inPathTree(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestIndexPaths(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	changes, err := db.IndexChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/repo", ProjectRoot: "github.com/user/repo", Name: "repo", Funcs: []*doc.Func{{}}, Updated: time.Unix(100, 0)},
+		{ImportPath: "github.com/user/repo/sub", ProjectRoot: "github.com/user/repo", Name: "sub", Funcs: []*doc.Func{{}}, Updated: time.Unix(300, 0)},
+		{ImportPath: "github.com/user/repox", ProjectRoot: "github.com/user/repox", Name: "repox", Funcs: []*doc.Func{{}}, Updated: time.Unix(300, 0)},
+		{ImportPath: "github.com/user/repo/dir", ProjectRoot: "github.com/user/repo", Updated: time.Unix(300, 0)},
+	} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		since  time.Time
+		paths  []string
+	}{
+		{"", time.Time{}, []string{"github.com/user/repo", "github.com/user/repo/sub", "github.com/user/repox"}},
+		{"github.com/user/repo", time.Time{}, []string{"github.com/user/repo", "github.com/user/repo/sub"}},
+		{"", time.Unix(200, 0), []string{"github.com/user/repo/sub", "github.com/user/repox"}},
+		{"github.com/user/repo", time.Unix(200, 0), []string{"github.com/user/repo/sub"}},
+		{"example.com", time.Time{}, nil},
+	} {
+		var paths []string
+		err := db.IndexPaths(tt.prefix, tt.since, func(path string) error {
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("db.IndexPaths(%q, %v) returned error %v", tt.prefix, tt.since.Unix(), err)
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("db.IndexPaths(%q, %v) = %v, want %v", tt.prefix, tt.since.Unix(), paths, tt.paths)
+		}
+	}
+
+	var entries []string
+	if err := db.IndexFunc(func(path string, updated time.Time) bool {
+		entries = append(entries, path+" "+strconv.FormatInt(updated.Unix(), 10))
+		return true
+	}); err != nil {
+		t.Fatalf("db.IndexFunc returned error %v", err)
+	}
+	if want := []string{"github.com/user/repo 100", "github.com/user/repo/sub 300", "github.com/user/repox 300"}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("db.IndexFunc() = %v, want %v", entries, want)
+	}
+
+	if n, err := db.IndexChanges(); err != nil || n != changes+4 {
+		t.Errorf("db.IndexChanges() after put = %d, %v, want %d", n, err, changes+4)
+	}
+	if err := db.Delete("github.com/user/repox"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.IndexChanges(); err != nil || n != changes+5 {
+		t.Errorf("db.IndexChanges() after delete = %d, %v, want %d", n, err, changes+5)
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	defer doc.SetCaseInsensitiveHosts(nil)
+	doc.SetCaseInsensitiveHosts([]string{"github.com"})
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/User/Repo", ProjectRoot: "github.com/User/Repo", Name: "repo", Funcs: []*doc.Func{{}}},
+		{ImportPath: "example.com/User/Repo", ProjectRoot: "example.com/User/Repo", Name: "repo", Funcs: []*doc.Func{{}}},
+		{ImportPath: "github.com/user/app", ProjectRoot: "github.com/user/app", Name: "app", Funcs: []*doc.Func{{}},
+			Imports: []string{"github.com/user/repo", "example.com/user/repo"}},
+	} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"github.com/user/repo":  "github.com/User/Repo",
+		"github.com/User/Repo":  "github.com/User/Repo",
+		"github.com/user/other": "",
+		"example.com/user/repo": "",
+	} {
+		if canonical, err := db.CanonicalPath(path); err != nil || canonical != want {
+			t.Errorf("db.CanonicalPath(%q) = %q, %v, want %q", path, canonical, err, want)
+		}
+	}
+
+	// The import with the wrong case on the case-insensitive host is
+	// attributed to the stored package with a warning.
+	if n, err := db.ImporterCount("github.com/User/Repo"); err != nil || n != 1 {
+		t.Errorf("db.ImporterCount(github.com/User/Repo) = %d, %v, want 1", n, err)
+	}
+	if n, err := db.ImporterCount("example.com/User/Repo"); err != nil || n != 0 {
+		t.Errorf("db.ImporterCount(example.com/User/Repo) = %d, %v, want 0", n, err)
+	}
+	pdoc, _, _, err := db.Get("github.com/user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []string
+	for _, d := range pdoc.Diagnostics {
+		codes = append(codes, d.Code)
+	}
+	if !reflect.DeepEqual(codes, []string{doc.DiagnosticImportCase}) {
+		t.Errorf("diagnostics = %v, want one %s", codes, doc.DiagnosticImportCase)
+	}
+
+	if err := db.Delete("github.com/User/Repo"); err != nil {
+		t.Fatal(err)
+	}
+	if canonical, err := db.CanonicalPath("github.com/user/repo"); err != nil || canonical != "" {
+		t.Errorf("db.CanonicalPath() after delete = %q, %v, want \"\"", canonical, err)
+	}
+}
+
+func TestListingSummary(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/repo", ProjectRoot: "github.com/user/repo", Name: "repo", Synopsis: "Package repo does things.", Funcs: []*doc.Func{{}}},
+		{ImportPath: "github.com/user/repo/internal", ProjectRoot: "github.com/user/repo"},
+		{ImportPath: "github.com/user/repo/internal/wire", ProjectRoot: "github.com/user/repo", Name: "wire",
+			Types: []*doc.Type{{Name: "Conn", Methods: []*doc.Func{{Name: "Close"}}}}, Funcs: []*doc.Func{{Name: "Dial"}}},
+		{ImportPath: "github.com/user/repo/internal/codec", ProjectRoot: "github.com/user/repo", Name: "codec", Synopsis: "Package codec encodes.", Funcs: []*doc.Func{{}}},
+	} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summaries := func(pkgs []Package) map[string]string {
+		m := make(map[string]string)
+		for _, pkg := range pkgs {
+			m[pkg.Path] = pkg.Summary
+		}
+		return m
+	}
+
+	pkgs, err := db.Packages([]string{"github.com/user/repo/internal/wire", "github.com/user/repo/internal/codec"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"github.com/user/repo/internal/wire":  "1 type, 1 func; notable: Conn",
+		"github.com/user/repo/internal/codec": "",
+	}
+	if got := summaries(pkgs); !reflect.DeepEqual(got, want) {
+		t.Errorf("db.Packages() summaries = %v, want %v", got, want)
+	}
+
+	_, pkgs, _, err = db.Get("github.com/user/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summaries(pkgs); !reflect.DeepEqual(got, want) {
+		t.Errorf("db.Get() subdirectory summaries = %v, want %v", got, want)
+	}
+
+	pkgs, err = db.Project("github.com/user/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summaries(pkgs)["github.com/user/repo/internal"]; got != "2 packages" {
+		t.Errorf("directory summary = %q, want %q", got, "2 packages")
+	}
+}
+
+func TestDerivedSynopsis(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/repo", ProjectRoot: "github.com/user/repo", Name: "repo",
+			Synopsis: "Package repo does things.", Doc: "Package repo does things.\n\nThe parser subpackage reads input.", Funcs: []*doc.Func{{}}},
+		{ImportPath: "github.com/user/repo/parser", ProjectRoot: "github.com/user/repo", Name: "parser", Funcs: []*doc.Func{{}}},
+		{ImportPath: "github.com/user/repo/codec", ProjectRoot: "github.com/user/repo", Name: "codec", Funcs: []*doc.Func{{}}},
+		{ImportPath: "github.com/user/repo/codec/json", ProjectRoot: "github.com/user/repo", Name: "json", Synopsis: "Package json encodes JSON.", Funcs: []*doc.Func{{}}},
+	} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, pkgs, _, err := db.Get("github.com/user/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]Package)
+	for _, pkg := range pkgs {
+		got[pkg.Path] = pkg
+	}
+	for _, want := range []Package{
+		{Path: "github.com/user/repo/parser", Synopsis: "The parser subpackage reads input.", SynopsisDerived: true},
+		{Path: "github.com/user/repo/codec", Synopsis: "Subpackage of package repo does things.", SynopsisDerived: true},
+		{Path: "github.com/user/repo/codec/json", Synopsis: "Package json encodes JSON."},
+	} {
+		pkg := got[want.Path]
+		if pkg.Synopsis != want.Synopsis || pkg.SynopsisDerived != want.SynopsisDerived {
+			t.Errorf("%s synopsis = %q, %v, want %q, %v", want.Path, pkg.Synopsis, pkg.SynopsisDerived, want.Synopsis, want.SynopsisDerived)
+		}
+	}
+
+	pdoc, _, err := db.GetDoc("github.com/user/repo/parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pdoc.SynopsisDerived {
+		t.Error("stored documentation does not have a derived synopsis")
+	}
+
+	pkgs, err = db.Query("parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range pkgs {
+		if pkg.Path == "github.com/user/repo/parser" && !pkg.SynopsisDerived {
+			t.Error("search result does not have a derived synopsis")
+		}
+	}
+}
+
+func TestMajorVersions(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const root = "github.com/user/versioned"
+	for _, path := range []string{root, root + "/v2", root + "/v3"} {
+		pdoc := &doc.Package{ImportPath: path, ProjectRoot: root, Name: "versioned", Synopsis: "Package versioned parses widgets.", Funcs: []*doc.Func{{}}}
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkVersions := func(path string, want []string) {
+		pdoc, _, err := db.GetDoc(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pdoc.MajorVersions, want) {
+			t.Errorf("%s MajorVersions = %v, want %v", path, pdoc.MajorVersions, want)
+		}
+	}
+	all := []string{root, root + "/v2", root + "/v3"}
+	for _, path := range all {
+		checkVersions(path, all)
+	}
+
+	pkgs, err := db.Query("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newest := make(map[string]string)
+	for _, pkg := range pkgs {
+		newest[pkg.Path] = pkg.NewestMajor
+	}
+	want := map[string]string{root: root + "/v3", root + "/v2": root + "/v3", root + "/v3": ""}
+	if !reflect.DeepEqual(newest, want) {
+		t.Errorf("db.Query() newest major versions = %v, want %v", newest, want)
+	}
+
+	// Deleting a version updates the other versions.
+	if err := db.Delete(root + "/v3"); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(root, all[:2])
+	checkVersions(root+"/v2", all[:2])
+
+	if err := db.Delete(root + "/v2"); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(root, nil)
+}
+
+func TestText(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{ImportPath: "github.com/user/repo/text", ProjectRoot: "github.com/user/repo", Name: "text", Funcs: []*doc.Func{{}}}
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := db.GetText(pdoc.ImportPath); err != nil || text != nil {
+		t.Errorf("GetText() before put = %v, %v, want nil", text, err)
+	}
+
+	updated := time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)
+	text := &Text{Version: 1, Updated: updated, Summary: []byte("summary"), All: []byte("all")}
+	if err := db.PutText(pdoc.ImportPath, text); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetText(pdoc.ImportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, text) {
+		t.Errorf("GetText() = %+v, want %+v", got, text)
+	}
+
+	// The etag is returned when the text is rendered from the stored
+	// documentation.
+	pdoc.Updated = updated
+	pdoc.Etag = "etag"
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetText(pdoc.ImportPath); err != nil || got == nil || got.Etag != "etag" {
+		t.Errorf("GetText() after put of rendered documentation = %+v, %v, want etag %q", got, err, "etag")
+	}
+
+	for _, tt := range []struct {
+		version int
+		paths   []string
+	}{
+		{1, nil},
+		{2, []string{pdoc.ImportPath}},
+	} {
+		paths, err := db.StaleText(tt.version, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != len(tt.paths) || len(paths) > 0 && !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("StaleText(%d) = %v, want %v", tt.version, paths, tt.paths)
+		}
+	}
+
+	if err := db.Delete(pdoc.ImportPath); err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := db.StaleText(2, 10); err != nil || len(paths) != 0 {
+		t.Errorf("StaleText() after delete = %v, %v, want none", paths, err)
+	}
+}
+
+func TestReports(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	now := time.Unix(1400000000, 0).UTC()
+	for i, r := range []Report{
+		{Path: "example.com/a", Reason: "malware", Text: "steals keys", Time: now, Reporter: "r1"},
+		{Path: "example.com/a", Reason: "malware", Time: now.Add(time.Second), Reporter: "r2"},
+		{Path: "example.com/b", Reason: "rendering", Time: now.Add(2 * time.Second), Reporter: "r1"},
+		{Path: "example.com/a", Reason: "copyright", Text: "copied", Time: now.Add(3 * time.Second), Reporter: "r3"},
+	} {
+		if err := db.PutReport(r); err != nil {
+			t.Fatalf("db.PutReport(%d) returned error %v", i, err)
+		}
+	}
+
+	groups, err := db.OpenReports(10)
+	if err != nil {
+		t.Fatalf("db.OpenReports() returned error %v", err)
+	}
+	if len(groups) != 2 || groups[0].Path != "example.com/a" || groups[1].Path != "example.com/b" {
+		t.Fatalf("db.OpenReports() = %+v, want example.com/a, example.com/b", groups)
+	}
+	a := groups[0]
+	if !reflect.DeepEqual(a.Reasons, map[string]int{"malware": 2, "copyright": 1}) || a.Count() != 3 {
+		t.Errorf("reasons = %v, want malware 2, copyright 1", a.Reasons)
+	}
+	if !a.Last.Equal(now.Add(3 * time.Second)) {
+		t.Errorf("last = %v, want %v", a.Last, now.Add(3*time.Second))
+	}
+	if len(a.Texts) != 2 || a.Texts[0].Text != "copied" || a.Texts[1].Text != "steals keys" {
+		t.Errorf("texts = %+v, want copied, steals keys", a.Texts)
+	}
+
+	if err := db.DismissReports("example.com/a"); err != nil {
+		t.Fatalf("db.DismissReports() returned error %v", err)
+	}
+	groups, err = db.OpenReports(10)
+	if err != nil {
+		t.Fatalf("db.OpenReports() returned error %v", err)
+	}
+	if len(groups) != 1 || groups[0].Path != "example.com/b" {
+		t.Errorf("db.OpenReports() after dismiss = %+v, want example.com/b", groups)
+	}
+}
+
+func TestPackageID(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{ImportPath: "example.com/a", ProjectRoot: "example.com/a", Name: "a"}
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.PackageID("example.com/a")
+	if err != nil || id == 0 {
+		t.Fatalf("db.PackageID() = %d, %v, want id", id, err)
+	}
+	if path, err := db.PackagePath(id); err != nil || path != "example.com/a" {
+		t.Errorf("db.PackagePath(%d) = %q, %v, want example.com/a", id, path, err)
+	}
+
+	// The id does not change when the package is stored again and is not
+	// reused after the package is deleted.
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if id2, _ := db.PackageID("example.com/a"); id2 != id {
+		t.Errorf("id after second put = %d, want %d", id2, id)
+	}
+	if err := db.Delete("example.com/a"); err != nil {
+		t.Fatal(err)
+	}
+	if id2, err := db.PackageID("example.com/a"); err != nil || id2 != 0 {
+		t.Errorf("db.PackageID() after delete = %d, %v, want 0", id2, err)
+	}
+	if path, err := db.PackagePath(id); err != nil || path != "" {
+		t.Errorf("db.PackagePath(%d) after delete = %q, %v, want none", id, path, err)
+	}
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if id2, _ := db.PackageID("example.com/a"); id2 == id || id2 == 0 {
+		t.Errorf("id after delete and put = %d, want new id", id2)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	now := time.Unix(1400000000, 0).UTC()
+	next := now.Add(time.Hour)
+	pdoc := &doc.Package{ImportPath: "example.com/a/b", ProjectRoot: "example.com/a", Name: "b"}
+	if err := db.Put(pdoc, next); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.GetSchedule("example.com/a/b", "example.com/a")
+	if err != nil {
+		t.Fatalf("db.GetSchedule() returned error %v", err)
+	}
+	if !s.NextCrawl.Equal(next) || !s.LastFetch.Time.IsZero() || s.Cadence.Interval != 0 {
+		t.Errorf("db.GetSchedule() = %+v, want next crawl %v only", s, next)
+	}
+
+	r := FetchResult{Time: now, Result: "not modified"}
+	if err := db.PutFetchResult("example.com/a/b", r); err != nil {
+		t.Fatal(err)
+	}
+	c := Cadence{Interval: time.Hour, Expires: time.Now().Add(time.Hour).Truncate(time.Second).UTC()}
+	if err := db.PutCadence("example.com/a", c); err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.GetSchedule("example.com/a/b", "example.com/a")
+	if err != nil {
+		t.Fatalf("db.GetSchedule() returned error %v", err)
+	}
+	if !s.LastFetch.Time.Equal(now) || s.LastFetch.Result != r.Result || s.Cadence != c {
+		t.Errorf("db.GetSchedule() = %+v, want fetch result %+v and cadence %+v", s, r, c)
+	}
+
+	if err := db.PutRefreshToken("example.com/a", "token", "key", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if token, author, err := db.GetRefreshToken("example.com/a"); err != nil || token != "token" || author != "key" {
+		t.Errorf("db.GetRefreshToken() = %q, %q, %v, want token, key", token, author, err)
+	}
+	if err := db.DeleteRefreshToken("example.com/a"); err != nil {
+		t.Fatal(err)
+	}
+	if token, _, err := db.GetRefreshToken("example.com/a"); err != nil || token != "" {
+		t.Errorf("db.GetRefreshToken() after delete = %q, %v, want empty", token, err)
+	}
+}
+
+func TestViews(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	// The view keys expire at a fixed time after the day of the views, so the
+	// test uses the current time.
+	now := time.Now().UTC()
+	path := "example.com/a"
+	for i, tt := range []struct {
+		counts map[string]int
+		t      time.Time
+	}{
+		{map[string]int{"Copy": 2, "Buffer": 1}, now},
+		{map[string]int{"Buffer": 3, "Buffer.Len": 1}, now.Add(-24 * time.Hour)},
+		// Views before the window are not counted.
+		{map[string]int{"Copy": 10}, now.Add(-ViewDays * 24 * time.Hour)},
+	} {
+		if err := db.IncrementViews(path, tt.counts, tt.t); err != nil {
+			t.Fatalf("db.IncrementViews(%d) returned error %v", i, err)
+		}
+	}
+
+	views, err := db.TopViews(path, now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AnchorViews{{"Buffer", 4}, {"Copy", 2}, {"Buffer.Len", 1}}
+	if !reflect.DeepEqual(views, want) {
+		t.Errorf("db.TopViews() = %v, want %v", views, want)
+	}
+	if views, _ := db.TopViews(path, now, 1); len(views) != 1 || views[0].Anchor != "Buffer" {
+		t.Errorf("db.TopViews(n=1) = %v, want Buffer", views)
+	}
+
+	if err := db.PruneViews(path, []string{"Buffer", "Buffer.Len"}, now); err != nil {
+		t.Fatal(err)
+	}
+	views, err = db.TopViews(path, now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []AnchorViews{{"Buffer", 4}, {"Buffer.Len", 1}}
+	if !reflect.DeepEqual(views, want) {
+		t.Errorf("db.TopViews() after prune = %v, want %v", views, want)
+	}
+}
+
+func TestImportEdges(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	var paths []string
+	for i := 0; i < 8; i++ {
+		paths = append(paths, "github.com/user/repo/p"+strconv.Itoa(i))
+	}
+
+	// Apply random puts and deletes and track the stored imports.
+	r := rand.New(rand.NewSource(1))
+	stored := make(map[string][]string)
+	for i := 0; i < 300; i++ {
+		path := paths[r.Intn(len(paths))]
+		if r.Intn(4) == 0 {
+			if err := db.Delete(path); err != nil {
+				t.Fatal(err)
+			}
+			delete(stored, path)
+			continue
+		}
+		var imports []string
+		for _, p := range paths {
+			if p != path && r.Intn(3) == 0 {
+				imports = append(imports, p)
+			}
+		}
+		pdoc := &doc.Package{ImportPath: path, ProjectRoot: "github.com/user/repo", Name: "p", Imports: imports, Funcs: []*doc.Func{{}}}
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		stored[path] = imports
+	}
+
+	termsOnly, setsOnly, err := db.CheckImportEdges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(termsOnly) != 0 || len(setsOnly) != 0 {
+		t.Fatalf("CheckImportEdges() = %v, %v, want no edges", termsOnly, setsOnly)
+	}
+
+	for _, path := range paths {
+		var want []string
+		for from, imports := range stored {
+			for _, p := range imports {
+				if p == path {
+					want = append(want, from)
+				}
+			}
+		}
+		sort.Strings(want)
+		pkgs, err := db.Importers(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Path)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Importers(%s) = %v, want %v", path, got, want)
+		}
+	}
+
+	// Remove one edge from an import set.
+	var edge ImportEdge
+	for from, imports := range stored {
+		if len(imports) > 0 {
+			edge = ImportEdge{From: from, To: imports[0]}
+			break
+		}
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := redis.String(c.Do("GET", "id:"+edge.From))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do("SREM", si.key("import:"+edge.To), id); err != nil {
+		t.Fatal(err)
+	}
+	termsOnly, setsOnly, err = db.CheckImportEdges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(termsOnly, []ImportEdge{edge}) || len(setsOnly) != 0 {
+		t.Errorf("CheckImportEdges() = %v, %v, want %v, none", termsOnly, setsOnly, edge)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+var indexDerivedSynopsis = flag.Bool("db-index-derived-synopsis", false, "Index the words of synopses derived from ancestor packages. Packages with a derived synopsis are ranked as packages without a synopsis either way.")
+
+// maxSynopsisAncestors is the number of ancestor packages searched for the
+// synopsis of a package without a package comment.
+const maxSynopsisAncestors = 3
+
+// derivedSynopsis returns a synopsis for a package without a package
+// comment from the stored documentation of its ancestors in the project.
+// A sentence mentioning the package in an ancestor's comment is preferred
+// over the synopsis of the nearest ancestor. Ancestors with a derived
+// synopsis are skipped.
+func (db *Database) derivedSynopsis(c redis.Conn, pdoc *doc.Package) (string, error) {
+	if pdoc.Name == "" {
+		return "", nil
+	}
+	fallback := ""
+	p := pdoc.ImportPath
+	for i := 0; i < maxSynopsisAncestors; i++ {
+		j := strings.LastIndex(p, "/")
+		if j < len(pdoc.ProjectRoot) || j <= 0 {
+			break
+		}
+		p = p[:j]
+		ancestor, _, err := db.getDoc(c, p)
+		if err != nil {
+			return "", err
+		}
+		if ancestor == nil || ancestor.Name == "" || ancestor.SynopsisDerived {
+			continue
+		}
+		if s := doc.SubpackageSentence(ancestor.Doc, pdoc.ImportPath, pdoc.ImportPath[j+1:], pdoc.Name); s != "" {
+			return s, nil
+		}
+		if fallback == "" {
+			fallback = doc.SubpackageSynopsis(ancestor.Synopsis)
+		}
+	}
+	return fallback, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The import edges of the live search index are stored twice: as the
+// import:<path> terms of the importing package, read by ImportGraph, and as
+// the members of the index import:<path> sets, read by Importers and
+// ImporterCount. The put and delete scripts update both in one script, so
+// the two copies only drift if the database is changed by other means.
+
+// ImportEdge is an edge from an importing package to an imported package.
+type ImportEdge struct {
+	From string
+	To   string
+}
+
+type byEdge []ImportEdge
+
+func (p byEdge) Len() int      { return len(p) }
+func (p byEdge) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byEdge) Less(i, j int) bool {
+	if p[i].From != p[j].From {
+		return p[i].From < p[j].From
+	}
+	return p[i].To < p[j].To
+}
+
+// CheckImportEdges compares the two copies of the import edges in the live
+// search index. It returns the edges found only in the terms of the
+// importing package and the edges found only in the import sets. Edges
+// from a package id that is not in the database are reported with From
+// set to "pkg:<id>".
+//
+// The keys are read with SCAN and both copies are held in memory, so the
+// check is meant for administration tools, not for request handlers.
+func (db *Database) CheckImportEdges() (termsOnly, setsOnly []ImportEdge, err error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Edges from the package terms, keyed by package id.
+	paths := make(map[string]string)
+	forward := make(map[string]map[string]bool)
+	err = scanKeys(c, "pkg:*", func(keys []string) error {
+		for _, key := range keys {
+			c.Send("HMGET", key, "path", si.termsField())
+		}
+		values, err := redis.Values(c.Do(""))
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			fields, err := redis.Values(values[i], nil)
+			if err != nil {
+				return err
+			}
+			var path, terms string
+			if _, err := redis.Scan(fields, &path, &terms); err != nil {
+				return err
+			}
+			if path == "" {
+				continue
+			}
+			id := key[len("pkg:"):]
+			paths[id] = path
+			imports := make(map[string]bool)
+			for _, term := range strings.Fields(terms) {
+				if strings.HasPrefix(term, "import:") {
+					imports[term[len("import:"):]] = true
+				}
+			}
+			forward[id] = imports
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Edges from the import sets.
+	base := si.key("import:")
+	reverse := make(map[string]map[string]bool)
+	err = scanKeys(c, escapePattern(base)+"*", func(keys []string) error {
+		for _, key := range keys {
+			c.Send("SMEMBERS", key)
+		}
+		values, err := redis.Values(c.Do(""))
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			ids, err := redis.Strings(values[i], nil)
+			if err != nil {
+				return err
+			}
+			importers := make(map[string]bool)
+			for _, id := range ids {
+				importers[id] = true
+			}
+			reverse[key[len(base):]] = importers
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for id, imports := range forward {
+		for to := range imports {
+			if !reverse[to][id] {
+				termsOnly = append(termsOnly, ImportEdge{From: paths[id], To: to})
+			}
+		}
+	}
+	for to, importers := range reverse {
+		for id := range importers {
+			if !forward[id][to] {
+				from, ok := paths[id]
+				if !ok {
+					from = "pkg:" + id
+				}
+				setsOnly = append(setsOnly, ImportEdge{From: from, To: to})
+			}
+		}
+	}
+	sort.Sort(byEdge(termsOnly))
+	sort.Sort(byEdge(setsOnly))
+	return termsOnly, setsOnly, nil
+}
+
+// scanKeys calls fn with each batch of keys matching pattern.
+func scanKeys(c redis.Conn, pattern string, fn func(keys []string) error) error {
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", termStatsScanCount))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// fileLua counts references to cached source files from stored packages.
+// Files without references expire after a day so that files fetched for
+// packages that are never stored do not accumulate.
+const fileLua = `
+    local fileTTL = 86400
+
+    local function updateFileRefs(hashes, n)
+        for hash in string.gmatch(hashes, '([^ ]+)') do
+            if redis.call('HINCRBY', 'fileRefs', hash, n) > 0 then
+                redis.call('PERSIST', 'file:' .. hash)
+            else
+                redis.call('HDEL', 'fileRefs', hash)
+                redis.call('EXPIRE', 'file:' .. hash, fileTTL)
+            end
+        end
+    end
+`
+
+var putFileScript = newScript(0, fileLua+`
+    local hash = ARGV[1]
+    local p = ARGV[2]
+
+    redis.call('SET', 'file:' .. hash, p)
+    if redis.call('HEXISTS', 'fileRefs', hash) == 0 then
+        redis.call('EXPIRE', 'file:' .. hash, fileTTL)
+    end
+`)
+
+// PutFile adds the content of a source file to the file cache.
+func (db *Database) PutFile(hash string, p []byte) error {
+	p, err := snappy.Encode(nil, p)
+	if err != nil {
+		return err
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err = putFileScript.Do(c, hash, p)
+	return err
+}
+
+// GetFile returns the content of a source file in the file cache or nil if
+// the file is not in the cache.
+func (db *Database) GetFile(hash string) ([]byte, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	p, err := redis.Bytes(c.Do("GET", "file:"+hash))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return snappy.Decode(nil, p)
+}
+
+// fileHashes returns the space separated hashes of the package's source
+// files.
+func fileHashes(pdoc *doc.Package) string {
+	var buf []byte
+	for _, files := range [][]*doc.File{pdoc.Files, pdoc.TestFiles} {
+		for _, f := range files {
+			if f == nil || f.Hash == "" {
+				continue
+			}
+			if len(buf) > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = append(buf, f.Hash...)
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,220 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// maxDocField is the maximum length in bytes of the package comment
+	// stored for search result excerpts.
+	maxDocField = 1000
+
+	// excerptLen is the maximum length in bytes of an excerpt of the
+	// package comment shown in search results.
+	excerptLen = 160
+
+	// excerptContext is the length in bytes of the package comment shown
+	// before the first match in an excerpt.
+	excerptContext = 40
+
+	ellipsis = "…"
+)
+
+// Match is a range of bytes in a text that matches a query term.
+type Match struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type byStart []Match
+
+func (m byStart) Len() int           { return len(m) }
+func (m byStart) Less(i, j int) bool { return m[i].Start < m[j].Start }
+func (m byStart) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// docField returns the package comment of pdoc with the white space
+// collapsed and truncated to maxDocField bytes.
+func docField(pdoc *doc.Package) string {
+	return truncateText(strings.Join(strings.Fields(pdoc.Doc), " "), maxDocField)
+}
+
+// truncateText returns the prefix of s with at most n bytes that does not
+// end in the middle of a UTF-8 encoded rune.
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// termMatches returns the ranges of the words in text that match the query
+// terms. Parse is the query parser of the tokenizer used to find the terms.
+// Terms of Chinese, Japanese and Korean text match the bigram in the word.
+// Overlapping ranges are merged.
+func termMatches(parse func(string) []string, terms []string, text string) []Match {
+	want := make(map[string]bool)
+	for _, t := range terms {
+		want[t] = true
+	}
+	var matches []Match
+	start := -1
+	for i, r := range text + " " {
+		if !isTermSep(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+		word := text[start:i]
+		for _, t := range parse(word) {
+			if !want[t] {
+				continue
+			}
+			if !isCJKTerm(t) {
+				matches = append(matches, Match{start, i})
+				continue
+			}
+			for j := 0; ; {
+				k := strings.Index(word[j:], t)
+				if k < 0 {
+					break
+				}
+				matches = append(matches, Match{start + j + k, start + j + k + len(t)})
+				_, size := utf8.DecodeRuneInString(word[j+k:])
+				j += k + size
+			}
+		}
+		start = -1
+	}
+	return mergeMatches(matches)
+}
+
+// mergeMatches returns the matches sorted by start with the overlapping and
+// adjacent ranges merged.
+func mergeMatches(matches []Match) []Match {
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Sort(byStart(matches))
+	result := matches[:1]
+	for _, m := range matches[1:] {
+		last := &result[len(result)-1]
+		if m.Start <= last.End {
+			if m.End > last.End {
+				last.End = m.End
+			}
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// docExcerpt returns the part of the package comment text around the first
+// match and the matches in the excerpt. The excerpt starts and ends at word
+// boundaries where possible and an ellipsis marks the text left out.
+func docExcerpt(text string, matches []Match) (string, []Match) {
+	if len(matches) == 0 {
+		return "", nil
+	}
+	first := matches[0]
+	start := 0
+	if first.Start > excerptContext {
+		start = first.Start - excerptContext
+		if i := strings.IndexByte(text[start:first.Start], ' '); i >= 0 {
+			start += i + 1
+		}
+		for start < first.Start && !utf8.RuneStart(text[start]) {
+			start++
+		}
+	}
+	end := len(text)
+	if end-start > excerptLen {
+		end = start + excerptLen
+		if end < first.End {
+			end = first.End
+		}
+		if i := strings.LastIndex(text[first.End:end], " "); i >= 0 {
+			end = first.End + i
+		}
+		end = start + len(truncateText(text[start:], end-start))
+	}
+
+	prefix, suffix := "", ""
+	if start > 0 {
+		prefix = ellipsis + " "
+	}
+	if end < len(text) {
+		suffix = " " + ellipsis
+	}
+	var result []Match
+	for _, m := range matches {
+		if m.Start >= end {
+			break
+		}
+		if m.End > end {
+			m.End = end
+		}
+		result = append(result, Match{m.Start - start + len(prefix), m.End - start + len(prefix)})
+	}
+	return prefix + text[start:end] + suffix, result
+}
+
+// setMatches sets the synopsis matches of the packages. If no term matches
+// the synopsis of a package, then the excerpt is set from the package
+// comment in docs. Docs maps import paths to package comments.
+func (si searchIndex) setMatches(terms []string, pkgs []Package, docs map[string]string) {
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		pkg.SynopsisMatches = termMatches(si.tok.parseQuery, terms, pkg.Synopsis)
+		if len(pkg.SynopsisMatches) == 0 {
+			text := docs[pkg.Path]
+			pkg.Excerpt, pkg.ExcerptMatches = docExcerpt(text, termMatches(si.tok.parseQuery, terms, text))
+		}
+	}
+}
+
+// searchResultsWithDocs is like searchResults for replies with the package
+// comment after the lang field. The package comments are returned by import
+// path.
+func searchResultsWithDocs(reply interface{}) ([]Package, map[string]string, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	const n = 7
+	var fields []interface{}
+	docs := make(map[string]string)
+	for i := 0; i+n <= len(values); i += n {
+		fields = append(fields, values[i:i+n-1]...)
+		p, _ := redis.String(values[i], nil)
+		docs[p], _ = redis.String(values[i+n-1], nil)
+	}
+	pkgs, err := searchResults(fields)
+	return pkgs, docs, err
+}
@@ -0,0 +1,81 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var termMatchesTests = []struct {
+	q    string
+	text string
+	want []Match
+}{
+	{"reader", "Package bufio implements buffered readers.", []Match{{34, 41}}},
+	{"buffer read", "Package bufio implements buffered readers.", []Match{{25, 33}, {34, 41}}},
+	{"yaml", "Package goyaml reads YAML.", []Match{{21, 25}}},
+	{"import:fmt", "Package fmt formats.", nil},
+	{"café", "Le café, c'est bon.", []Match{{3, 8}}},
+	{"日本語", "日本語のテキスト", []Match{{0, 9}}},
+	{"本語 日本", "日本語", []Match{{0, 9}}},
+}
+
+func TestTermMatches(t *testing.T) {
+	for _, tt := range termMatchesTests {
+		got := termMatches(parseQuery, parseQuery(tt.q), tt.text)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("termMatches(%q, %q) = %v, want %v", tt.q, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestMergeMatches(t *testing.T) {
+	got := mergeMatches([]Match{{10, 12}, {0, 3}, {2, 5}, {5, 6}, {11, 12}})
+	want := []Match{{0, 6}, {10, 12}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeMatches = %v, want %v", got, want)
+	}
+}
+
+func TestDocExcerpt(t *testing.T) {
+	short := "The package parses YAML documents."
+	excerpt, matches := docExcerpt(short, []Match{{19, 23}})
+	if excerpt != short || !reflect.DeepEqual(matches, []Match{{19, 23}}) {
+		t.Errorf("docExcerpt(short) = %q, %v", excerpt, matches)
+	}
+
+	long := strings.Repeat("ééé word ", 20) + "target " + strings.Repeat("après mot ", 30)
+	i := strings.Index(long, "target")
+	excerpt, matches = docExcerpt(long, []Match{{i, i + 6}, {len(long) - 4, len(long) - 1}})
+	if !utf8.ValidString(excerpt) {
+		t.Fatalf("docExcerpt returned invalid UTF-8 %q", excerpt)
+	}
+	if !strings.HasPrefix(excerpt, ellipsis+" ") || !strings.HasSuffix(excerpt, " "+ellipsis) {
+		t.Errorf("docExcerpt = %q, want ellipsis at both ends", excerpt)
+	}
+	if len(excerpt) > excerptLen+2*len(ellipsis+" ") {
+		t.Errorf("docExcerpt returned %d bytes, want at most %d", len(excerpt), excerptLen)
+	}
+	if len(matches) != 1 || excerpt[matches[0].Start:matches[0].End] != "target" {
+		t.Errorf("docExcerpt matches = %v, want the first match only", matches)
+	}
+
+	if s := truncateText("aé", 2); s != "a" {
+		t.Errorf("truncateText(\"aé\", 2) = %q, want \"a\"", s)
+	}
+}
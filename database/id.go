@@ -0,0 +1,47 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// PackageID returns the numeric id of the stored package with the given
+// import path or 0 if the package is not stored. The id is assigned when
+// the package is first stored and does not change until the package is
+// deleted. The search index sets hold package ids.
+func (db *Database) PackageID(path string) (int, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	id, err := redis.Int(c.Do("GET", "id:"+path))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return id, err
+}
+
+// PackagePath returns the import path of the stored package with the given
+// id or "" if no package has the id.
+func (db *Database) PackagePath(id int) (string, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	path, err := redis.String(c.Do("HGET", "pkg:"+strconv.Itoa(id), "path"))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return path, err
+}
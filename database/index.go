@@ -17,8 +17,10 @@ package database
 import (
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/garyburd/gddo/doc"
 )
@@ -40,7 +42,288 @@ func normalizeProjectRoot(projectRoot string) string {
 
 var httpPat = regexp.MustCompile(`https?://\S+`)
 
+// staleTerm is the search term for packages in projects with no recent
+// commits.
+const staleTerm = "stale:yes"
+
+// errorsOnlyTerm is the search term for packages whose only content is the
+// errors found when fetching or building the package.
+const errorsOnlyTerm = "errors:only"
+
+// allQueryPrefix is the query prefix that includes the packages with the
+// errorsOnlyTerm in the search results.
+const allQueryPrefix = "all:"
+
+// stabilityTermPrefix is the prefix of the search term for the API
+// stability of a package.
+const stabilityTermPrefix = "stability:"
+
+// languageTermPrefix is the prefix of the search term for the detected
+// language of the package comment.
+const languageTermPrefix = "lang:"
+
+// importTermPrefix is the prefix of the search term for the packages that
+// import a path.
+const importTermPrefix = "import:"
+
+// testImportTermPrefix is the prefix of the search term for the packages
+// with tests that import a path.
+const testImportTermPrefix = "testimport:"
+
+// testImportTerms returns the search terms for the paths imported by the
+// tests of pdoc. The package itself is omitted from the imports of its
+// external tests.
+func testImportTerms(pdoc *doc.Package) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, imports := range [][]string{pdoc.TestImports, pdoc.XTestImports} {
+		for _, path := range imports {
+			if path == pdoc.ImportPath || seen[path] || !doc.IsValidPath(path) {
+				continue
+			}
+			seen[path] = true
+			terms = append(terms, testImportTermPrefix+path)
+		}
+	}
+	return terms
+}
+
+// importFilter returns the search term for a query field of the form
+// import:<path>. The path is used as is because import paths are case
+// sensitive. A query with several import fields matches the packages that
+// import all of the paths.
+func importFilter(f string) (string, bool) {
+	if len(f) <= len(importTermPrefix) || !strings.EqualFold(f[:len(importTermPrefix)], importTermPrefix) {
+		return "", false
+	}
+	return importTermPrefix + f[len(importTermPrefix):], true
+}
+
+// pathTermPrefix is the prefix of the search term for the import path of a
+// package. The path terms are not stored in a set for each term. The index
+// keeps the paths in a sorted set so that a query for the packages under a
+// path prefix reads only the matching paths.
+const pathTermPrefix = "path:"
+
+// pathTermVersion is the first tokenizer version with path terms.
+const pathTermVersion = 7
+
+// pathFilter returns the search term for a query field of the form
+// path:<prefix>. The prefix is used as is because import paths are case
+// sensitive.
+func pathFilter(f string) (string, bool) {
+	if len(f) <= len(pathTermPrefix) || !strings.EqualFold(f[:len(pathTermPrefix)], pathTermPrefix) {
+		return "", false
+	}
+	return pathTermPrefix + f[len(pathTermPrefix):], true
+}
+
+// updatedTermPrefix is the prefix of the search term for the time that a
+// package in the index was fetched. The updated terms are not stored in a
+// set for each term. The index keeps the packages in a sorted set scored by
+// the time so that the packages fetched after a time can be read directly.
+const updatedTermPrefix = "updated:"
+
+// updatedTermVersion is the first tokenizer version with updated terms.
+const updatedTermVersion = 9
+
+// nameTermPrefix is the prefix of the search term for the name of an
+// exported function, type or method.
+const nameTermPrefix = "name:"
+
+// nameFilter returns the search term for a query field of the form
+// name:<identifier>. Names are matched without regard to case.
+func nameFilter(f string) (string, bool) {
+	if len(f) <= len(nameTermPrefix) || !strings.EqualFold(f[:len(nameTermPrefix)], nameTermPrefix) {
+		return "", false
+	}
+	return nameTermPrefix + strings.ToLower(f[len(nameTermPrefix):]), true
+}
+
+// identifierTerms returns the search terms for the names of the exported
+// functions, types and methods of pdoc.
+func identifierTerms(pdoc *doc.Package) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name == "" {
+			return
+		}
+		term := nameTermPrefix + strings.ToLower(name)
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	for _, f := range pdoc.Funcs {
+		add(f.Name)
+	}
+	for _, t := range pdoc.Types {
+		add(t.Name)
+		for _, f := range t.Funcs {
+			add(f.Name)
+		}
+		for _, m := range t.Methods {
+			add(m.Name)
+		}
+	}
+	return terms
+}
+
+// queryFilters is the set of search terms that are used as is when found in
+// a query.
+var queryFilters = map[string]bool{
+	staleTerm:    true,
+	advisoryTerm: true,
+	stabilityTermPrefix + doc.StabilityFrozen:       true,
+	stabilityTermPrefix + doc.StabilityStable:       true,
+	stabilityTermPrefix + doc.StabilityExperimental: true,
+	stabilityTermPrefix + doc.StabilityDeprecated:   true,
+}
+
+func init() {
+	for _, lang := range doc.Languages {
+		queryFilters[languageTermPrefix+lang] = true
+	}
+}
+
+// TokenizerVersion is the version of the functions that compute the search
+// terms and score for a package and the search terms for a query. Increment
+// the version when changing the functions so that servers rebuild the search
+// index.
+const TokenizerVersion = 9
+
+// tokenizer is a version of the functions used to build and query the search
+// index.
+type tokenizer struct {
+	version       int
+	documentTerms func(pdoc *doc.Package, score float64) []string
+	documentScore func(pdoc *doc.Package) float64
+	parseQuery    func(q string) []string
+}
+
+// tokenizers maps versions to tokenizers. A server queries the live search
+// index with the tokenizer used to build the index, so keep the previous
+// version in the map until all servers run the current version.
+var tokenizers = map[int]*tokenizer{
+	1: {1, documentTermsV1, documentScoreV7, parseQueryV2},
+	2: {2, documentTermsV2, documentScoreV7, parseQueryV2},
+	3: {3, documentTermsV3, documentScoreV7, parseQuery},
+	4: {4, documentTermsV4, documentScoreV7, parseQuery},
+	5: {5, documentTermsV5, documentScoreV7, parseQuery},
+	6: {6, documentTermsV6, documentScoreV7, parseQuery},
+	7: {7, documentTermsV7, documentScoreV7, parseQuery},
+	8: {8, documentTermsV8, documentScore, parseQuery},
+	9: {9, documentTerms, documentScore, parseQuery},
+}
+
+// documentTerms returns the search terms of the current tokenizer version.
+// Version 9 adds the updated term of the packages in the index.
 func documentTerms(pdoc *doc.Package, score float64) []string {
+	terms := documentTermsV8(pdoc, score)
+	if score > 0 && !isStandardPackage(pdoc.ImportPath) && !pdoc.Updated.IsZero() {
+		terms = append(terms, updatedTermPrefix+strconv.FormatInt(pdoc.Updated.Unix(), 10))
+	}
+	return terms
+}
+
+// documentTermsV8 returns the search terms of tokenizer version 8. Packages
+// whose only content is errors are indexed by the name of the package
+// directory and the errorsOnlyTerm.
+func documentTermsV8(pdoc *doc.Package, score float64) []string {
+	terms := documentTermsV7(pdoc, score)
+	if errorsOnly(pdoc) {
+		terms = append(terms, errorsOnlyTerm)
+		terms = append(terms, parseQuery(path.Base(pdoc.ImportPath))...)
+	}
+	return terms
+}
+
+// documentTermsV7 returns the search terms of tokenizer version 7. Version
+// 8 adds the terms of packages whose only content is errors.
+func documentTermsV7(pdoc *doc.Package, score float64) []string {
+	return append(documentTermsV6(pdoc, score), pathTermPrefix+pdoc.ImportPath)
+}
+
+// documentTermsV6 returns the search terms of tokenizer version 6. Version
+// 7 adds the import path term.
+func documentTermsV6(pdoc *doc.Package, score float64) []string {
+	return append(documentTermsV5(pdoc, score), testImportTerms(pdoc)...)
+}
+
+// documentTermsV5 returns the search terms of tokenizer version 5. Version
+// 6 adds the test import terms.
+func documentTermsV5(pdoc *doc.Package, score float64) []string {
+	terms := documentTermsV4(pdoc, score)
+	if score > 0 {
+		terms = append(terms, identifierTerms(pdoc)...)
+	}
+	return terms
+}
+
+// documentTermsV4 returns the search terms of tokenizer version 4. Version
+// 5 adds the identifier name terms.
+func documentTermsV4(pdoc *doc.Package, score float64) []string {
+	terms := documentTermsV3(pdoc, score)
+	if score > 0 {
+		terms = append(terms, methodSetTerms(pdoc)...)
+	}
+	return terms
+}
+
+// documentTermsV3 returns the search terms of tokenizer version 3. Version
+// 4 adds the method set terms.
+func documentTermsV3(pdoc *doc.Package, score float64) []string {
+	var terms []string
+	for _, term := range documentTermsV2(pdoc, score) {
+		if !hasCJK(term) {
+			terms = append(terms, term)
+		}
+	}
+	if pdoc.DetectedLanguage != "" && pdoc.DetectedLanguage != doc.LanguageUnknown {
+		terms = append(terms, languageTermPrefix+pdoc.DetectedLanguage)
+	}
+	if score > 0 && (!pdoc.SynopsisDerived || *indexDerivedSynopsis) && hasCJK(pdoc.Synopsis) {
+		seen := make(map[string]bool)
+		for _, term := range terms {
+			seen[term] = true
+		}
+		synopsis := httpPat.ReplaceAllLiteralString(pdoc.Synopsis, "")
+		for _, f := range strings.FieldsFunc(strings.ToLower(synopsis), isTermSep) {
+			if !hasCJK(f) {
+				continue
+			}
+			for _, term := range splitCJK(f) {
+				if !isCJKTerm(term) {
+					if stopWord[term] {
+						continue
+					}
+					term = stem(term)
+				}
+				if !seen[term] {
+					seen[term] = true
+					terms = append(terms, term)
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// documentTermsV2 returns the search terms of tokenizer version 2. Version
+// 3 adds the language term and indexes text in Chinese, Japanese and Korean
+// as bigrams.
+func documentTermsV2(pdoc *doc.Package, score float64) []string {
+	terms := documentTermsV1(pdoc, score)
+	if pdoc.Stability != "" {
+		terms = append(terms, stabilityTermPrefix+pdoc.Stability)
+	}
+	return terms
+}
+
+// documentTermsV1 returns the search terms of tokenizer version 1. Version
+// 2 adds the stability term.
+func documentTermsV1(pdoc *doc.Package, score float64) []string {
 
 	terms := make(map[string]bool)
 
@@ -49,37 +332,51 @@ func documentTerms(pdoc *doc.Package, score float64) []string {
 	projectRoot := normalizeProjectRoot(pdoc.ProjectRoot)
 	terms["project:"+projectRoot] = true
 
+	// Fingerprint
+
+	if pdoc.Fingerprint != "" {
+		terms["fingerprint:"+pdoc.Fingerprint] = true
+	}
+
 	// Imports
 
 	for _, path := range pdoc.Imports {
 		if doc.IsValidPath(path) {
-			terms["import:"+path] = true
+			terms[importTermPrefix+path] = true
 		}
 	}
 
+	// Imports written with the wrong case are attributed to the indexed
+	// package.
+	for _, path := range pdoc.CanonicalImports {
+		terms[importTermPrefix+path] = true
+	}
+
 	if score > 0 {
 
 		if isStandardPackage(pdoc.ImportPath) {
-			for _, term := range parseQuery(pdoc.ImportPath) {
+			for _, term := range parseQueryV2(pdoc.ImportPath) {
 				terms[term] = true
 			}
 		} else {
 			terms["all:"] = true
-			for _, term := range parseQuery(pdoc.ProjectName) {
+			for _, term := range parseQueryV2(pdoc.ProjectName) {
 				terms[term] = true
 			}
-			for _, term := range parseQuery(pdoc.Name) {
+			for _, term := range parseQueryV2(pdoc.Name) {
 				terms[term] = true
 			}
 		}
 
 		// Synopsis
 
-		synopsis := httpPat.ReplaceAllLiteralString(pdoc.Synopsis, "")
-		for i, s := range strings.FieldsFunc(synopsis, isTermSep) {
-			s = strings.ToLower(s)
-			if !stopWord[s] && (i > 3 || s != "package") {
-				terms[stem(s)] = true
+		if !pdoc.SynopsisDerived || *indexDerivedSynopsis {
+			synopsis := httpPat.ReplaceAllLiteralString(pdoc.Synopsis, "")
+			for i, s := range strings.FieldsFunc(synopsis, isTermSep) {
+				s = strings.ToLower(s)
+				if !stopWord[s] && (i > 3 || s != "package") {
+					terms[stem(s)] = true
+				}
 			}
 		}
 	}
@@ -91,7 +388,34 @@ func documentTerms(pdoc *doc.Package, score float64) []string {
 	return result
 }
 
+// errorsOnly returns true if the package has errors and no package comment,
+// declarations or examples. A package with a package comment only is not
+// errors only.
+func errorsOnly(pdoc *doc.Package) bool {
+	return len(pdoc.Errors) > 0 &&
+		pdoc.Doc == "" &&
+		len(pdoc.Consts) == 0 &&
+		len(pdoc.Vars) == 0 &&
+		len(pdoc.Funcs) == 0 &&
+		len(pdoc.Types) == 0 &&
+		len(pdoc.Examples) == 0
+}
+
+// documentScore returns the score of the current tokenizer version. A
+// package with errors is scored by the documentation built from the files
+// that parse, at half the score of a package without errors.
 func documentScore(pdoc *doc.Package) float64 {
+	if len(pdoc.Errors) == 0 {
+		return documentScoreV7(pdoc)
+	}
+	p := *pdoc
+	p.Errors = nil
+	return documentScoreV7(&p) / 2
+}
+
+// documentScoreV7 returns the score of tokenizer versions 1 through 7.
+// Packages with errors are not scored.
+func documentScoreV7(pdoc *doc.Package) float64 {
 	if pdoc.Name == "" || pdoc.IsCmd || len(pdoc.Errors) > 0 || strings.HasSuffix(pdoc.ImportPath, ".go") {
 		return 0
 	}
@@ -117,6 +441,10 @@ func documentScore(pdoc *doc.Package) float64 {
 		r = 1000
 	case strings.HasPrefix(pdoc.ImportPath, "code.google.com/p/go."):
 		r = 500
+	case pdoc.SynopsisDerived:
+		// Rank packages with a derived synopsis as packages without a
+		// synopsis.
+		r = 1
 	case strings.HasPrefix(pdoc.Synopsis, "Package "+pdoc.Name+" "):
 		r = 100
 	case len(pdoc.Synopsis) > 0:
@@ -142,11 +470,121 @@ func documentScore(pdoc *doc.Package) float64 {
 
 func parseQuery(q string) []string {
 	var terms []string
-	q = strings.ToLower(q)
-	for _, s := range strings.FieldsFunc(q, isTermSep) {
-		if !stopWord[s] {
-			terms = append(terms, stem(s))
+	for _, f := range strings.Fields(q) {
+		if term, ok := importFilter(f); ok {
+			terms = append(terms, term)
+			continue
+		}
+		if term, ok := nameFilter(f); ok {
+			terms = append(terms, term)
+			continue
+		}
+		if term, ok := pathFilter(f); ok {
+			terms = append(terms, term)
+			continue
+		}
+		f = strings.ToLower(f)
+		if queryFilters[f] {
+			terms = append(terms, f)
+			continue
+		}
+		for _, s := range strings.FieldsFunc(f, isTermSep) {
+			for _, s := range splitCJK(s) {
+				switch {
+				case isCJKTerm(s):
+					terms = append(terms, s)
+				case !stopWord[s]:
+					terms = append(terms, stem(s))
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// trimAllPrefix removes the allQueryPrefix from the query. The function
+// returns true if the query has the prefix.
+func trimAllPrefix(q string) (string, bool) {
+	q = strings.TrimSpace(q)
+	if len(q) < len(allQueryPrefix) || !strings.EqualFold(q[:len(allQueryPrefix)], allQueryPrefix) {
+		return q, false
+	}
+	return strings.TrimSpace(q[len(allQueryPrefix):]), true
+}
+
+// parseQueryV2 returns the query terms of tokenizer versions 1 and 2.
+func parseQueryV2(q string) []string {
+	var terms []string
+	for _, f := range strings.Fields(q) {
+		if term, ok := importFilter(f); ok {
+			terms = append(terms, term)
+			continue
+		}
+		f = strings.ToLower(f)
+		if queryFilters[f] {
+			terms = append(terms, f)
+			continue
+		}
+		for _, s := range strings.FieldsFunc(f, isTermSep) {
+			if !stopWord[s] {
+				terms = append(terms, stem(s))
+			}
 		}
 	}
 	return terms
 }
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func hasCJK(s string) bool {
+	return strings.IndexFunc(s, isCJK) >= 0
+}
+
+func isCJKTerm(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return isCJK(r)
+}
+
+// splitCJK splits a word at the boundaries of runs of Chinese, Japanese and
+// Korean characters. These scripts are written without spaces between
+// words, so each run is returned as its overlapping bigrams. A query for a
+// word matches a synopsis containing the word because the synopsis has all
+// bigrams of the word. A run of one character is returned as is.
+func splitCJK(s string) []string {
+	if !hasCJK(s) {
+		return []string{s}
+	}
+	var parts []string
+	var run []rune
+	flush := func() {
+		if len(run) == 1 {
+			parts = append(parts, string(run))
+		}
+		for i := 0; i+2 <= len(run); i++ {
+			parts = append(parts, string(run[i:i+2]))
+		}
+		run = run[:0]
+	}
+	start := -1
+	for i, r := range s {
+		if isCJK(r) {
+			if start >= 0 {
+				parts = append(parts, s[start:i])
+				start = -1
+			}
+			run = append(run, r)
+			continue
+		}
+		flush()
+		if start < 0 {
+			start = i
+		}
+	}
+	flush()
+	if start >= 0 {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
@@ -16,9 +16,12 @@ package database
 
 import (
 	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+	"path"
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 )
 
 var indexTests = []struct {
@@ -42,6 +45,7 @@ var indexTests = []struct {
 			"import:errors",
 			"import:math",
 			"import:unicode/utf8",
+			"path:strconv",
 			"project:go",
 			"repres",
 			"strconv",
@@ -90,7 +94,38 @@ var indexTests = []struct {
 			"import:fmt", "import:io", "import:io/ioutil", "import:net/http",
 			"import:net/url", "import:regexp", "import:sort", "import:strconv",
 			"import:strings", "import:sync", "import:time", "interfac",
-			"oau", "project:github.com/user/repo", "rfc", "subset",
+			"oau", "path:github.com/user/repo/dir", "project:github.com/user/repo", "rfc", "subset",
+			"testimport:bytes", "testimport:net/url", "testimport:testing",
+		},
+	},
+	{&doc.Package{
+		ImportPath:        "github.com/user/frozen",
+		ProjectRoot:       "github.com/user/frozen",
+		ProjectName:       "frozen",
+		Name:              "frozen",
+		Doc:               "This package is frozen.",
+		Stability:         doc.StabilityFrozen,
+		StabilityEvidence: "This package is frozen.",
+		Funcs:             []*doc.Func{{}},
+		Updated:           time.Unix(1000, 0),
+	},
+		[]string{
+			"all:", "froz", "path:github.com/user/frozen", "project:github.com/user/frozen", "stability:frozen", "updated:1000",
+		},
+	},
+	{&doc.Package{
+		ImportPath:       "github.com/user/cache",
+		ProjectRoot:      "github.com/user/cache",
+		ProjectName:      "cache",
+		Name:             "cache",
+		Synopsis:         "Package cache 提供HTTP内存缓存。",
+		Doc:              "Package cache 提供HTTP内存缓存。支持过期时间和容量限制。",
+		DetectedLanguage: doc.LanguageChinese,
+		Funcs:            []*doc.Func{{}},
+	},
+		[]string{
+			"all:", "cach", "path:github.com/user/cache", "project:github.com/user/cache", "lang:zh",
+			"提供", "http", "内存", "存缓", "缓存",
 		},
 	},
 }
@@ -106,3 +141,434 @@ func TestDocTerms(t *testing.T) {
 		}
 	}
 }
+
+var parseQueryTests = []struct {
+	q     string
+	terms []string
+}{
+	{"OAuth client", []string{"oau", "cly"}},
+	{"oauth stale:yes", []string{"oau", "stale:yes"}},
+	{"oauth stale:no", []string{"oau", "stal", "no"}},
+	{"oauth Stability:Stable", []string{"oau", "stability:stable"}},
+	{"内存缓存", []string{"内存", "存缓", "缓存"}},
+	{"http客户端", []string{"http", "客户", "户端"}},
+	{"缓 lang:ZH", []string{"缓", "lang:zh"}},
+	{"cache lang:unknown", []string{"cach", "lang", "unknown"}},
+	{"import:net/http Import:encoding/json", []string{"import:net/http", "import:encoding/json"}},
+	{"OAuth import:github.com/User/Repo", []string{"oau", "import:github.com/User/Repo"}},
+	{"import:", []string{"import"}},
+	{"name:Marshal json", []string{"name:marshal", "json"}},
+	{"NAME:newReader", []string{"name:newreader"}},
+	{"name:", []string{"nam"}},
+	{"path:github.com/User/ oauth", []string{"path:github.com/User/", "oau"}},
+	{"Path:gopkg.in", []string{"path:gopkg.in"}},
+}
+
+func TestIdentifierTerms(t *testing.T) {
+	pdoc := &doc.Package{
+		ImportPath:  "example.com/codec",
+		ProjectRoot: "example.com/codec",
+		Name:        "codec",
+		Funcs:       []*doc.Func{{Name: "Marshal"}, {Name: "Unmarshal"}},
+		Types: []*doc.Type{{
+			Name:    "Decoder",
+			Funcs:   []*doc.Func{{Name: "NewDecoder"}},
+			Methods: []*doc.Func{{Name: "Decode"}, {Name: "Marshal"}},
+		}},
+	}
+	terms := identifierTerms(pdoc)
+	sort.Strings(terms)
+	want := []string{"name:decode", "name:decoder", "name:marshal", "name:newdecoder", "name:unmarshal"}
+	if !reflect.DeepEqual(terms, want) {
+		t.Errorf("identifierTerms() = %v, want %v", terms, want)
+	}
+
+	found := false
+	for _, term := range documentTerms(pdoc, documentScore(pdoc)) {
+		if term == "name:marshal" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("documentTerms() does not include name:marshal")
+	}
+}
+
+func TestTestImportTerms(t *testing.T) {
+	pdoc := &doc.Package{
+		ImportPath:   "example.com/codec",
+		ProjectRoot:  "example.com/codec",
+		Name:         "codec",
+		TestImports:  []string{"testing", "./testutil"},
+		XTestImports: []string{"example.com/codec", "testing", "github.com/user/fixture"},
+	}
+	terms := testImportTerms(pdoc)
+	want := []string{"testimport:testing", "testimport:github.com/user/fixture"}
+	if !reflect.DeepEqual(terms, want) {
+		t.Errorf("testImportTerms() = %v, want %v", terms, want)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, tt := range parseQueryTests {
+		terms := parseQuery(tt.q)
+		if !reflect.DeepEqual(terms, tt.terms) {
+			t.Errorf("parseQuery(%q)=%#v, want %#v", tt.q, terms, tt.terms)
+		}
+	}
+}
+
+func TestDropStopWords(t *testing.T) {
+	SetQueryStopWords([]string{"Go", "library", "# Packages"})
+	defer SetQueryStopWords(nil)
+
+	for _, tt := range []struct {
+		q     string
+		terms []string
+		err   error
+	}{
+		{"oauth library for go", []string{"oau"}, nil},
+		{"OAuth libraries", []string{"oau"}, nil},
+		{"go packages stale:yes", nil, ErrStopWordQuery},
+		{"go library", nil, ErrStopWordQuery},
+		{"oauth", []string{"oau"}, nil},
+		{"", nil, nil},
+	} {
+		terms, err := dropStopWords(parseQuery(tt.q))
+		if err != tt.err || !reflect.DeepEqual(terms, tt.terms) {
+			t.Errorf("dropStopWords(parseQuery(%q)) = %#v, %v, want %#v, %v", tt.q, terms, err, tt.terms, tt.err)
+		}
+	}
+
+	// Stop words are not applied when building the index.
+	pdoc := &doc.Package{ImportPath: "example.com/golib", ProjectRoot: "example.com/golib", Name: "library", Synopsis: "Package library is a library.", Funcs: []*doc.Func{{}}}
+	found := false
+	for _, term := range documentTerms(pdoc, documentScore(pdoc)) {
+		if term == stem("library") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("documentTerms() does not include stop word %q", stem("library"))
+	}
+}
+
+func TestRelativeImportTerms(t *testing.T) {
+	// Packages stored before relative imports were excluded from Imports.
+	pdoc := &doc.Package{
+		ImportPath:      "github.com/user/repo/dir",
+		ProjectRoot:     "github.com/user/repo",
+		Name:            "dir",
+		Imports:         []string{"../common", "./util", "io"},
+		RelativeImports: []string{"../common", "./util"},
+	}
+	for _, term := range documentTerms(pdoc, 0) {
+		if term == "import:./util" || term == "import:../common" {
+			t.Errorf("documentTerms returned importer edge %s", term)
+		}
+	}
+}
+
+func TestDerivedSynopsisTerms(t *testing.T) {
+	pdoc := &doc.Package{
+		ImportPath:      "github.com/user/repo/parser",
+		ProjectRoot:     "github.com/user/repo",
+		ProjectName:     "repo",
+		Name:            "parser",
+		Synopsis:        "The parser subpackage exposes the event stream.",
+		SynopsisDerived: true,
+		Funcs:           []*doc.Func{{}},
+	}
+
+	score := documentScore(pdoc)
+	if want := documentScore(&doc.Package{ImportPath: pdoc.ImportPath, ProjectRoot: pdoc.ProjectRoot, Name: pdoc.Name, Funcs: pdoc.Funcs}); score != want {
+		t.Errorf("documentScore = %v, want %v for package without synopsis", score, want)
+	}
+
+	defer func(b bool) { *indexDerivedSynopsis = b }(*indexDerivedSynopsis)
+	for _, index := range []bool{false, true} {
+		*indexDerivedSynopsis = index
+		found := false
+		for _, term := range documentTerms(pdoc, score) {
+			if term == "stream" {
+				found = true
+			}
+		}
+		if found != index {
+			t.Errorf("with indexing %v, synopsis term found = %v", index, found)
+		}
+	}
+}
+
+func TestQueryImports(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "example.com/a", ProjectRoot: "example.com/a", Name: "a", Imports: []string{"net/http", "encoding/json", "io"}, Funcs: []*doc.Func{{}}},
+		{ImportPath: "example.com/b", ProjectRoot: "example.com/b", Name: "b", Imports: []string{"net/http", "encoding/json"}, Funcs: []*doc.Func{{}}},
+		{ImportPath: "example.com/c", ProjectRoot: "example.com/c", Name: "c", Imports: []string{"net/http", "io"}, Funcs: []*doc.Func{{}}},
+	} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		q     string
+		paths []string
+	}{
+		{"import:net/http", []string{"example.com/a", "example.com/b", "example.com/c"}},
+		{"import:net/http import:encoding/json", []string{"example.com/a", "example.com/b"}},
+		{"import:net/http import:encoding/json import:io", []string{"example.com/a"}},
+		{"import:net/http import:os", []string{}},
+	} {
+		pkgs, err := db.Query(tt.q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", tt.q, err)
+		}
+		if pkgs == nil {
+			t.Errorf("db.Query(%q) returned nil", tt.q)
+		}
+		paths := []string{}
+		for _, pkg := range pkgs {
+			paths = append(paths, pkg.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("db.Query(%q) = %v, want %v", tt.q, paths, tt.paths)
+		}
+	}
+}
+
+// useCurrentTokenizer sets the tokenizer of the empty search index to the
+// current version. An index without a version uses version 1.
+func useCurrentTokenizer(t *testing.T, db *Database) {
+	c := db.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("HSET", "searchIndex", "version", TokenizerVersion); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryNames(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	useCurrentTokenizer(t, db)
+
+	a := &doc.Package{ImportPath: "example.com/a", ProjectRoot: "example.com/a", Name: "a",
+		Funcs: []*doc.Func{{Name: "Marshal"}}}
+	b := &doc.Package{ImportPath: "example.com/b", ProjectRoot: "example.com/b", Name: "b",
+		Types: []*doc.Type{{Name: "Encoder", Methods: []*doc.Func{{Name: "Marshal"}}}}}
+	for _, pdoc := range []*doc.Package{a, b} {
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(q string, want ...string) {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		paths := []string{}
+		for _, pkg := range pkgs {
+			paths = append(paths, pkg.Path)
+		}
+		sort.Strings(paths)
+		if want == nil {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("db.Query(%q) = %v, want %v", q, paths, want)
+		}
+	}
+
+	query("name:marshal", "example.com/a", "example.com/b")
+	query("name:Encoder", "example.com/b")
+	query("name:Unmarshal")
+
+	// Putting a package again replaces its identifier terms.
+	a.Funcs = []*doc.Func{{Name: "Unmarshal"}}
+	if err := db.Put(a, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	query("name:marshal", "example.com/b")
+	query("name:unmarshal", "example.com/a")
+
+	if err := db.Delete("example.com/b"); err != nil {
+		t.Fatal(err)
+	}
+	query("name:marshal")
+}
+
+func TestTestImporters(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	useCurrentTokenizer(t, db)
+
+	pdoc := &doc.Package{ImportPath: "example.com/a", ProjectRoot: "example.com/a", Name: "a",
+		Imports: []string{"net/http"}, TestImports: []string{"net/http/httptest"}, Funcs: []*doc.Func{{}}}
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(path string, want int) {
+		n, err := db.TestImporterCount(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkgs, err := db.TestImporters(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want || len(pkgs) != want {
+			t.Errorf("test importers of %s = %d, %d packages, want %d", path, n, len(pkgs), want)
+		}
+	}
+	check("net/http/httptest", 1)
+	check("net/http", 0)
+
+	// Putting the package with other imports removes the stale entries.
+	pdoc.Imports = []string{"io"}
+	pdoc.TestImports = []string{"testing/iotest"}
+	if err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	check("net/http/httptest", 0)
+	check("testing/iotest", 1)
+	if n, err := db.ImporterCount("net/http"); err != nil || n != 0 {
+		t.Errorf("db.ImporterCount(net/http) = %d, %v, want 0", n, err)
+	}
+	if n, err := db.ImporterCount("io"); err != nil || n != 1 {
+		t.Errorf("db.ImporterCount(io) = %d, %v, want 1", n, err)
+	}
+}
+
+func TestQueryPathPrefix(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	useCurrentTokenizer(t, db)
+
+	for _, p := range []struct{ path, root string }{
+		{"github.com/user/a", "github.com/user/a"},
+		{"github.com/user/a/sub", "github.com/user/a"},
+		{"github.com/user/ab", "github.com/user/ab"},
+		{"github.com/other/a", "github.com/other/a"},
+	} {
+		pdoc := &doc.Package{ImportPath: p.path, ProjectRoot: p.root, Name: path.Base(p.path),
+			Funcs: []*doc.Func{{Name: "Dial"}}}
+		if p.path == "github.com/user/ab" {
+			pdoc.Funcs = []*doc.Func{{Name: "Listen"}}
+		}
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(q string, want ...string) {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		paths := []string{}
+		for _, pkg := range pkgs {
+			paths = append(paths, pkg.Path)
+		}
+		sort.Strings(paths)
+		if want == nil {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("db.Query(%q) = %v, want %v", q, paths, want)
+		}
+	}
+
+	query("path:github.com/user/", "github.com/user/a", "github.com/user/a/sub", "github.com/user/ab")
+	query("path:github.com/user/a", "github.com/user/a", "github.com/user/a/sub", "github.com/user/ab")
+	query("path:github.com/user/a/", "github.com/user/a/sub")
+	query("path:github.com/User/")
+	query("path:github.com/user/ name:dial", "github.com/user/a", "github.com/user/a/sub")
+	query("path:github.com/ path:github.com/other/", "github.com/other/a")
+
+	// The subdirectories of a path without a package are found with the
+	// path prefix.
+	if _, subdirs, _, err := db.Get("github.com/user"); err != nil {
+		t.Fatal(err)
+	} else if len(subdirs) != 3 {
+		t.Errorf("subdirectories of github.com/user = %v, want 3 packages", subdirs)
+	}
+
+	if err := db.Delete("github.com/user/a/sub"); err != nil {
+		t.Fatal(err)
+	}
+	query("path:github.com/user/a", "github.com/user/a", "github.com/user/ab")
+
+	// The temporary keys are deleted.
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, err := redis.Strings(c.Do("KEYS", "tmp:*"))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("temporary keys %v, %v remain", keys, err)
+	}
+}
+
+func TestErrorsOnly(t *testing.T) {
+	broken := &doc.Package{
+		ImportPath:  "github.com/user/broken",
+		ProjectRoot: "github.com/user/broken",
+		Errors:      []string{"a.go:1:1: expected 'package', found 'EOF'"},
+	}
+	docOnly := &doc.Package{
+		ImportPath:  "github.com/user/docs",
+		ProjectRoot: "github.com/user/docs",
+		Name:        "docs",
+		Doc:         "Package docs describes the project.",
+		Synopsis:    "Package docs describes the project.",
+	}
+	partial := &doc.Package{
+		ImportPath:  "github.com/user/partial",
+		ProjectRoot: "github.com/user/partial",
+		Name:        "partial",
+		Errors:      []string{"b.go:3:1: expected declaration, found 'IDENT' x"},
+		Funcs:       []*doc.Func{{}},
+	}
+
+	if !errorsOnly(broken) || errorsOnly(docOnly) || errorsOnly(partial) {
+		t.Errorf("errorsOnly(broken, docOnly, partial) = %v, %v, %v, want true, false, false", errorsOnly(broken), errorsOnly(docOnly), errorsOnly(partial))
+	}
+
+	terms := documentTerms(broken, documentScore(broken))
+	sort.Strings(terms)
+	want := []string{"brok", "errors:only", "path:github.com/user/broken", "project:github.com/user/broken"}
+	if !reflect.DeepEqual(terms, want) {
+		t.Errorf("documentTerms(broken) = %q, want %q", terms, want)
+	}
+
+	p := *partial
+	p.Errors = nil
+	if s, want := documentScore(partial), documentScore(&p)/2; s != want || s == 0 {
+		t.Errorf("documentScore(partial) = %v, want %v", s, want)
+	}
+	if s := documentScoreV7(partial); s != 0 {
+		t.Errorf("documentScoreV7(partial) = %v, want 0", s)
+	}
+}
+
+func TestTrimAllPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		q, want string
+		all     bool
+	}{
+		{"all: broken", "broken", true},
+		{"ALL:broken yaml", "broken yaml", true},
+		{"all:", "", true},
+		{"broken", "broken", false},
+		{"al", "al", false},
+		{"install: broken", "install: broken", false},
+	} {
+		if got, all := trimAllPrefix(tt.q); got != tt.want || all != tt.all {
+			t.Errorf("trimAllPrefix(%q) = %q, %v, want %q, %v", tt.q, got, all, tt.want, tt.all)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Leases coordinate work between server instances that share the database.
+// A lease expires on the Redis server's clock. Because the holder only
+// measures elapsed time from before its request, the expiration does not
+// depend on the holders' clocks agreeing with each other or with the
+// server.
+
+var acquireLeaseScript = newScript(0, `
+    local key = 'lease:' .. ARGV[1]
+    local holder = ARGV[2]
+    local ttl = ARGV[3]
+
+    local current = redis.call('GET', key)
+    if current and current ~= holder then
+        return 0
+    end
+    redis.call('SET', key, holder, 'PX', ttl)
+    return 1
+`)
+
+// AcquireLease acquires or renews the named lease for holder. AcquireLease
+// returns false if the lease is held by another holder.
+func (db *Database) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	return redis.Bool(acquireLeaseScript.Do(c, name, holder, int64(ttl/time.Millisecond)))
+}
+
+var releaseLeaseScript = newScript(0, `
+    local key = 'lease:' .. ARGV[1]
+    local holder = ARGV[2]
+
+    if redis.call('GET', key) == holder then
+        redis.call('DEL', key)
+    end
+`)
+
+// ReleaseLease releases the named lease if it is held by holder.
+func (db *Database) ReleaseLease(name, holder string) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := releaseLeaseScript.Do(c, name, holder)
+	return err
+}
@@ -0,0 +1,58 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// majorVersionLua sets the newestMajor field of the stored major versions of
+// a project root. The field is updated when any of the versions is stored
+// or deleted so that the older versions learn about a new major version
+// without a crawl.
+const majorVersionLua = `
+    local function updateMajorVersions(root)
+        local paths = redis.call('ZRANGE', 'majorVersions:' .. root, 0, -1)
+        local newest = paths[#paths]
+        for _, p in ipairs(paths) do
+            local id = redis.call('GET', 'id:' .. p)
+            if id then
+                if #paths > 1 then
+                    redis.call('HSET', 'pkg:' .. id, 'newestMajor', newest)
+                else
+                    redis.call('HDEL', 'pkg:' .. id, 'newestMajor')
+                end
+            end
+        end
+    end
+`
+
+// getMajorVersions returns the stored major versions of the project root of
+// pdoc if pdoc is the project root or a major version subdirectory and
+// other major versions are stored.
+func getMajorVersions(c redis.Conn, pdoc *doc.Package) ([]string, error) {
+	if doc.MajorVersion(pdoc.ImportPath, pdoc.ProjectRoot) == 0 {
+		return nil, nil
+	}
+	paths, err := redis.Strings(c.Do("ZRANGE", "majorVersions:"+pdoc.ProjectRoot, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 || (len(paths) == 1 && paths[0] == pdoc.ImportPath) {
+		return nil, nil
+	}
+	return paths, nil
+}
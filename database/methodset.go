@@ -0,0 +1,416 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// This file implements queries for the types that implement an interface.
+// The method sets of the exported types of a package are stored with the
+// package. The search index has a term for the hash of each method set and
+// a term for each method name. A query of the form implements:io.Reader is
+// resolved to a method set with doc.StandardInterfaces or from the stored
+// interfaces of an indexed package. Types with the same method set are
+// found with the hash term. Types with more methods are found by checking
+// the stored method sets of the packages with the rarest method name of the
+// interface.
+
+var (
+	maxMethodSetBytes    = flag.Int("db-method-set-bytes", 32<<10, "Maximum size in bytes of the method sets stored for a package. Types over the limit are not found by implements: queries.")
+	maxImplementsChecked = flag.Int("db-implements-candidates", 2000, "Maximum number of packages checked for an implements: query. The packages with the highest search scores are checked.")
+)
+
+const (
+	// implementsPrefix is the prefix of the query field for the types
+	// that implement an interface.
+	implementsPrefix = "implements:"
+
+	// methodTermPrefix is the prefix of the search term for a method name
+	// of an exported concrete type.
+	methodTermPrefix = "method:"
+
+	// methodSetTermPrefix is the prefix of the search term for the hash of
+	// the method set of an exported concrete type.
+	methodSetTermPrefix = "methods:"
+)
+
+// typeMethods is the stored method set of an exported type.
+type typeMethods struct {
+	Name      string   `json:"name"`
+	Interface bool     `json:"interface,omitempty"`
+	Methods   []string `json:"methods"`
+}
+
+// packageMethodSets returns the method sets of the exported types of pdoc
+// in declaration order. Types are omitted when the method sets of the
+// previous types reach the size limit.
+func packageMethodSets(pdoc *doc.Package) []typeMethods {
+	var result []typeMethods
+	n := 0
+	for _, t := range pdoc.Types {
+		if len(t.MethodSet) == 0 {
+			continue
+		}
+		size := len(t.Name)
+		for _, m := range t.MethodSet {
+			size += len(m)
+		}
+		if n+size > *maxMethodSetBytes {
+			break
+		}
+		n += size
+		result = append(result, typeMethods{Name: t.Name, Interface: t.Interface, Methods: t.MethodSet})
+	}
+	return result
+}
+
+// encodeMethodSets returns the stored method sets for a package or "" if
+// the package has no exported types with methods.
+func encodeMethodSets(pdoc *doc.Package) (string, error) {
+	sets := packageMethodSets(pdoc)
+	if len(sets) == 0 {
+		return "", nil
+	}
+	p, err := json.Marshal(sets)
+	return string(p), err
+}
+
+func decodeMethodSets(p []byte) ([]typeMethods, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	var sets []typeMethods
+	err := json.Unmarshal(p, &sets)
+	return sets, err
+}
+
+// methodSetHash returns the hash of a sorted method set.
+func methodSetHash(methods []string) string {
+	h := sha1.New()
+	for _, m := range methods {
+		h.Write([]byte(m))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// methodName returns the name of the method with the canonical signature
+// sig.
+func methodName(sig string) string {
+	if i := strings.Index(sig, "("); i >= 0 {
+		return sig[:i]
+	}
+	return sig
+}
+
+// methodSetTerms returns the search terms for the method sets of the
+// exported concrete types of pdoc. Interface types are stored to resolve
+// queries, but are not returned as implementations.
+func methodSetTerms(pdoc *doc.Package) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	add := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	for _, set := range packageMethodSets(pdoc) {
+		if set.Interface {
+			continue
+		}
+		add(methodSetTermPrefix + methodSetHash(set.Methods))
+		for _, m := range set.Methods {
+			add(methodTermPrefix + methodName(m))
+		}
+	}
+	return terms
+}
+
+// hasMethods returns true if the sorted method set have contains every
+// method in the sorted method set want.
+func hasMethods(have, want []string) bool {
+	i := 0
+	for _, m := range want {
+		for i < len(have) && have[i] < m {
+			i++
+		}
+		if i == len(have) || have[i] != m {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// implementsQuery splits a query into the interface name of an
+// implements: field and the other fields. The function returns false if
+// the query does not have an implements: field.
+func implementsQuery(q string) (name string, rest string, ok bool) {
+	var other []string
+	for _, f := range strings.Fields(q) {
+		if !ok && len(f) > len(implementsPrefix) && strings.EqualFold(f[:len(implementsPrefix)], implementsPrefix) {
+			name = f[len(implementsPrefix):]
+			ok = true
+			continue
+		}
+		other = append(other, f)
+	}
+	return name, strings.Join(other, " "), ok
+}
+
+// interfaceMethods returns the method set of the interface with the given
+// qualified name or nil if the interface is not known.
+func interfaceMethods(c redis.Conn, name string) ([]string, error) {
+	if methods, ok := doc.StandardInterfaces[name]; ok {
+		return methods, nil
+	}
+	i := strings.LastIndex(name, ".")
+	if i <= 0 {
+		return nil, nil
+	}
+	path, typeName := name[:i], name[i+1:]
+	id, err := redis.String(c.Do("GET", "id:"+path))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	p, err := redis.Bytes(c.Do("HGET", "pkg:"+id, "methods"))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sets, err := decodeMethodSets(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if set.Interface && set.Name == typeName {
+			return set.Methods, nil
+		}
+	}
+	return nil, nil
+}
+
+// MethodSetStats reports the stored method sets and the implements:
+// queries run by the process.
+type MethodSetStats struct {
+	// Number of packages with stored method sets and the total size of
+	// the stored method sets.
+	Packages int   `json:"packages"`
+	Bytes    int64 `json:"bytes"`
+
+	// Number of implements: queries and the number of queries for an
+	// interface that is not known.
+	Queries    int64 `json:"queries"`
+	Unresolved int64 `json:"unresolved"`
+
+	// Number of packages checked for the queries, the number of types
+	// found by the hash of the method set and the number of queries with
+	// more candidate packages than the limit.
+	Checked      int64 `json:"checked"`
+	ExactMatches int64 `json:"exactMatches"`
+	Truncated    int64 `json:"truncated"`
+}
+
+// implementsCounters counts the implements: queries run by the process.
+// The zero value is ready to use.
+type implementsCounters struct {
+	mu    sync.Mutex
+	stats MethodSetStats
+}
+
+func (ic *implementsCounters) add(f func(s *MethodSetStats)) {
+	ic.mu.Lock()
+	f(&ic.stats)
+	ic.mu.Unlock()
+}
+
+// MethodSetStats returns the usage of the stored method sets and the
+// counters for the implements: queries run by the process.
+func (db *Database) MethodSetStats() (MethodSetStats, error) {
+	db.implements.mu.Lock()
+	stats := db.implements.stats
+	db.implements.mu.Unlock()
+
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("HMGET", "methodSetStats", "packages", "bytes"))
+	if err != nil {
+		return stats, err
+	}
+	_, err = redis.Scan(values, &stats.Packages, &stats.Bytes)
+	return stats, err
+}
+
+// queryImplements returns the packages with exported types that implement
+// the interface with the given name. The other query fields in rest and the
+// scope restrict the packages as in QueryScope. The names of the
+// implementing types are returned in the Implementations field of the
+// packages.
+func (db *Database) queryImplements(c redis.Conn, si searchIndex, name string, rest string, scope string) ([]Package, error) {
+	db.implements.add(func(s *MethodSetStats) { s.Queries++ })
+	want, err := interfaceMethods(c, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(want) == 0 {
+		db.implements.add(func(s *MethodSetStats) { s.Unresolved++ })
+		return nil, nil
+	}
+
+	var terms []string
+	if strings.TrimSpace(rest) != "" {
+		terms, err = si.queryTerms(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys, temp, err := si.termKeys(c, terms)
+	if len(temp) > 0 {
+		defer c.Do("DEL", temp...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var filters []interface{}
+	if scope != "" {
+		filters = append(filters, si.key("project:"+normalizeProjectRoot(scope)))
+	}
+	filters = append(filters, keys...)
+
+	// Candidates are the packages with the rarest method name of the
+	// interface.
+	var names []string
+	for _, m := range want {
+		if n := methodName(m); len(names) == 0 || names[len(names)-1] != n {
+			names = append(names, n)
+		}
+	}
+	for _, n := range names {
+		c.Send("SCARD", si.key(methodTermPrefix+n))
+	}
+	counts, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	rarest := 0
+	for i, n := range counts {
+		if n < counts[rarest] {
+			rarest = i
+		}
+	}
+	if counts[rarest] == 0 {
+		return nil, nil
+	}
+
+	exactKey, err := tempKey(c)
+	if err != nil {
+		return nil, err
+	}
+	candidateKey, err := tempKey(c)
+	if err != nil {
+		return nil, err
+	}
+	hash := methodSetHash(want)
+	sortArgs := []interface{}{"DESC", "BY", "pkg:*->" + si.scoreField(), "LIMIT", 0, *maxImplementsChecked,
+		"GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->derived", "GET", "pkg:*->kind", "GET", "pkg:*->newestMajor", "GET", "pkg:*->lang", "GET", "pkg:*->methods"}
+	c.Send("SINTERSTORE", append([]interface{}{exactKey, si.key(methodSetTermPrefix + hash)}, filters...)...)
+	c.Send("SINTERSTORE", append([]interface{}{candidateKey, si.key(methodTermPrefix + names[rarest])}, filters...)...)
+	c.Send("SORT", append([]interface{}{candidateKey}, sortArgs...)...)
+	c.Send("SORT", append([]interface{}{exactKey}, sortArgs...)...)
+	c.Send("DEL", exactKey, candidateKey)
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := redis.Int(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result  []Package
+		seen    = make(map[string]bool)
+		checked int
+		exact   int
+	)
+	// The candidates are checked in score order. Exact matches outside of
+	// the checked candidates are added after the candidates.
+	for _, reply := range values[2:4] {
+		rows, err := redis.Values(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		for len(rows) > 0 {
+			var (
+				pkg     Package
+				kind    string
+				methods []byte
+			)
+			rows, err = redis.Scan(rows, &pkg.Path, &pkg.Synopsis, &pkg.SynopsisDerived, &kind, &pkg.NewestMajor, &pkg.Language, &methods)
+			if err != nil {
+				return nil, err
+			}
+			if kind == "d" || seen[pkg.Path] {
+				continue
+			}
+			seen[pkg.Path] = true
+			checked++
+			sets, err := decodeMethodSets(methods)
+			if err != nil {
+				return nil, err
+			}
+			for _, set := range sets {
+				if set.Interface {
+					continue
+				}
+				if methodSetHash(set.Methods) == hash {
+					exact++
+				} else if !hasMethods(set.Methods, want) {
+					continue
+				}
+				pkg.Implementations = append(pkg.Implementations, set.Name)
+			}
+			if len(pkg.Implementations) == 0 {
+				continue
+			}
+			if pkg.NewestMajor == pkg.Path {
+				pkg.NewestMajor = ""
+			}
+			result = append(result, pkg)
+		}
+	}
+
+	db.implements.add(func(s *MethodSetStats) {
+		s.Checked += int64(checked)
+		s.ExactMatches += int64(exact)
+		if candidates > *maxImplementsChecked {
+			s.Truncated++
+		}
+	})
+	return result, nil
+}
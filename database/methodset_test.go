@@ -0,0 +1,162 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var readCloser = []string{"Close() error", "Read([]byte) (int, error)"}
+
+// methodSetTestPackage returns a package with a type that implements
+// io.ReadCloser with an extra method, a type that nearly implements it and
+// an interface with the same methods.
+func methodSetTestPackage(path string) *doc.Package {
+	return &doc.Package{
+		ImportPath:  path,
+		ProjectRoot: path,
+		Name:        "stream",
+		Synopsis:    "Package stream reads streams.",
+		Types: []*doc.Type{
+			{Name: "File", MethodSet: []string{"Close() error", "Name() string", "Read([]byte) (int, error)"}},
+			{Name: "Pipe", MethodSet: []string{"Close() error", "Read(string) (int, error)"}},
+			{Name: "Source", MethodSet: readCloser, Interface: true},
+		},
+	}
+}
+
+func TestImplementsQuery(t *testing.T) {
+	for _, tt := range []struct {
+		q, name, rest string
+		ok            bool
+	}{
+		{"implements:io.Reader", "io.Reader", "", true},
+		{"json Implements:encoding/json.Marshaler fast", "encoding/json.Marshaler", "json fast", true},
+		{"implements: reader", "", "implements: reader", false},
+		{"reader", "", "reader", false},
+	} {
+		name, rest, ok := implementsQuery(tt.q)
+		if name != tt.name || rest != tt.rest || ok != tt.ok {
+			t.Errorf("implementsQuery(%q) = %q, %q, %v, want %q, %q, %v", tt.q, name, rest, ok, tt.name, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestHasMethods(t *testing.T) {
+	file := methodSetTestPackage("example.com/stream").Types[0].MethodSet
+	for _, tt := range []struct {
+		have, want []string
+		ok         bool
+	}{
+		{file, readCloser, true},
+		{readCloser, readCloser, true},
+		{readCloser, file, false},
+		{[]string{"Close() error", "Read(string) (int, error)"}, readCloser, false},
+		{nil, readCloser, false},
+	} {
+		if ok := hasMethods(tt.have, tt.want); ok != tt.ok {
+			t.Errorf("hasMethods(%q, %q) = %v, want %v", tt.have, tt.want, ok, tt.ok)
+		}
+	}
+}
+
+func TestMethodSetTerms(t *testing.T) {
+	pdoc := methodSetTestPackage("example.com/stream")
+	want := []string{
+		methodSetTermPrefix + methodSetHash(pdoc.Types[0].MethodSet),
+		"method:Close", "method:Name", "method:Read",
+		methodSetTermPrefix + methodSetHash(pdoc.Types[1].MethodSet),
+	}
+	if terms := methodSetTerms(pdoc); !reflect.DeepEqual(terms, want) {
+		t.Errorf("methodSetTerms() = %q, want %q", terms, want)
+	}
+
+	// Types over the size limit are not stored or indexed.
+	defer func(n int) { *maxMethodSetBytes = n }(*maxMethodSetBytes)
+	*maxMethodSetBytes = 60
+	if sets := packageMethodSets(pdoc); len(sets) != 1 || sets[0].Name != "File" {
+		t.Errorf("packageMethodSets() with limit = %+v, want File only", sets)
+	}
+	*maxMethodSetBytes = 0
+	if s, err := encodeMethodSets(pdoc); s != "" || err != nil {
+		t.Errorf("encodeMethodSets() with zero limit = %q, %v, want empty", s, err)
+	}
+}
+
+func TestImplements(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	useCurrentTokenizer(t, db)
+
+	for _, path := range []string{"example.com/stream", "example.com/other"} {
+		if err := db.Put(methodSetTestPackage(path), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exact := methodSetTestPackage("example.com/exact")
+	exact.Types = []*doc.Type{{Name: "Body", MethodSet: readCloser}}
+	if err := db.Put(exact, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"implements:io.ReadCloser", "implements:example.com/stream.Source"} {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("Query(%q) returned error %v", q, err)
+		}
+		got := make(map[string][]string)
+		for _, pkg := range pkgs {
+			got[pkg.Path] = pkg.Implementations
+		}
+		want := map[string][]string{
+			"example.com/stream": {"File"},
+			"example.com/other":  {"File"},
+			"example.com/exact":  {"Body"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Query(%q) = %v, want %v", q, got, want)
+		}
+	}
+
+	// Other query fields and the scope restrict the results.
+	pkgs, err := db.QueryScope("implements:io.ReadCloser", "example.com/exact")
+	if err != nil || len(pkgs) != 1 || pkgs[0].Path != "example.com/exact" {
+		t.Errorf("QueryScope(implements) = %v, %v, want example.com/exact", pkgs, err)
+	}
+	if pkgs, err := db.Query("implements:io.Writer"); err != nil || len(pkgs) != 0 {
+		t.Errorf("Query(implements:io.Writer) = %v, %v, want no packages", pkgs, err)
+	}
+	if pkgs, err := db.Query("implements:example.com/missing.Source"); err != nil || len(pkgs) != 0 {
+		t.Errorf("Query(unknown interface) = %v, %v, want no packages", pkgs, err)
+	}
+
+	stats, err := db.MethodSetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Packages != 3 || stats.Bytes == 0 || stats.Queries != 5 || stats.Unresolved != 1 || stats.ExactMatches != 3 {
+		t.Errorf("MethodSetStats() = %+v", stats)
+	}
+	if err := db.Delete("example.com/exact"); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := db.MethodSetStats(); err != nil || stats.Packages != 2 {
+		t.Errorf("MethodSetStats() after delete = %+v, %v, want 2 packages", stats, err)
+	}
+}
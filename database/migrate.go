@@ -0,0 +1,542 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+// Migration mode moves the database to a new Redis server without downtime.
+// Commands that change the database are sent to both servers. Reads are
+// served by the old server and a sample of reads is compared with the new
+// server. A background comparator walks the keys of the old server with
+// SCAN, counts the keys that are present and equal on the new server and
+// copies the missing and different keys to the new server with DUMP and
+// RESTORE. After the new server is verified, the cutover flag serves reads
+// from the new server while the old server receives writes for rollback.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	migrateServer  = flag.String("db-migrate-server", "", "URI of Redis server to migrate to. Writes are sent to both servers when set.")
+	migrateCutover = flag.Bool("db-migrate-cutover", false, "Serve reads from the server set by db-migrate-server.")
+	migrateShadow  = flag.Float64("db-migrate-shadow", 0.01, "Fraction of reads compared between the servers during migration.")
+)
+
+const (
+	// compareInterval is the time between comparator batches.
+	compareInterval = time.Second
+
+	// compareBatchSize is the COUNT hint of the SCAN command that reads a
+	// batch of keys to compare.
+	compareBatchSize = 100
+)
+
+// scripts is the Lua scripts used by the package. The scripts are loaded
+// into the new server when the new server does not have a script.
+var scripts []*redis.Script
+
+// scriptHashes maps a script to the SHA1 hash of its source.
+var scriptHashes = make(map[*redis.Script]string)
+
+func newScript(keyCount int, src string) *redis.Script {
+	s := redis.NewScript(keyCount, src)
+	scripts = append(scripts, s)
+	scriptHashes[s] = hashScript(src)
+	return s
+}
+
+func hashScript(src string) string {
+	h := sha1.New()
+	h.Write([]byte(src))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// copyKeys maps the SHA1 hash of a script to a function that returns the
+// keys copied from the primary server to the secondary server before the
+// script runs on the secondary server. The function is called with the
+// ARGV of the script. Scripts that assign values that the servers would
+// otherwise assign independently, such as package ids, register the keys
+// holding the values so that the servers assign the same values.
+var copyKeys = make(map[string]func(argv []interface{}) []string)
+
+// setCopyKeys sets the function that returns the keys copied before s runs
+// on the secondary server.
+func setCopyKeys(s *redis.Script, keys func(argv []interface{}) []string) {
+	copyKeys[scriptHashes[s]] = keys
+}
+
+// readCommands is the set of commands that do not change the database. The
+// value is true if the reply does not depend on the server's encoding of
+// the value and can be compared between servers.
+var readCommands = map[string]bool{
+	"EXISTS":    true,
+	"GET":       true,
+	"HGET":      true,
+	"HMGET":     true,
+	"SCARD":     true,
+	"SISMEMBER": true,
+	"TYPE":      true,
+	"ZCARD":     true,
+	"ZSCORE":    true,
+	"HGETALL":   false,
+	"KEYS":      false,
+	"LRANGE":    false,
+	"PING":      false,
+	"SMEMBERS":  false,
+	"SORT":      false,
+	"TTL":       false,
+	"ZRANGE":    false,
+	"ZREVRANGE": false,
+}
+
+// MigrationStatus is the progress of a migration.
+type MigrationStatus struct {
+	Cutover bool `json:"cutover"`
+
+	// Number of completed comparator passes over the keys of the old
+	// server.
+	Passes int `json:"passes"`
+
+	// Keys of the old server when the current pass started and the number
+	// of keys checked, present on the new server and equal on the new
+	// server. Keys that are missing or different are copied to the new
+	// server.
+	Keys     int `json:"keys"`
+	Checked  int `json:"checked"`
+	Present  int `json:"present"`
+	Matching int `json:"matching"`
+	Copied   int `json:"copied"`
+
+	// Result of the last completed pass.
+	LastPresentFraction  float64 `json:"last_present_fraction"`
+	LastMatchingFraction float64 `json:"last_matching_fraction"`
+
+	// Reads compared between the servers and the number of reads with
+	// different replies.
+	Sampled    int `json:"sampled"`
+	Mismatches int `json:"mismatches"`
+
+	// Errors from the secondary server on commands that change the
+	// database.
+	WriteErrors int `json:"write_errors"`
+}
+
+type migration struct {
+	old, new interface {
+		Get() redis.Conn
+	}
+	cutover bool
+	shadow  float64
+	random  func() float64
+
+	mu      sync.Mutex
+	status  MigrationStatus
+	started bool   // a pass is in progress
+	cursor  string // SCAN cursor of the next batch in the current pass
+}
+
+func newMigration(old, new interface {
+	Get() redis.Conn
+}, cutover bool, shadow float64) *migration {
+	return &migration{
+		old:     old,
+		new:     new,
+		cutover: cutover,
+		shadow:  shadow,
+		random:  rand.Float64,
+		status:  MigrationStatus{Cutover: cutover},
+	}
+}
+
+// Get returns a connection that sends commands that change the database to
+// both servers.
+func (m *migration) Get() redis.Conn {
+	c := &migrationConn{m: m, primary: m.old.Get(), secondary: m.new.Get()}
+	if m.cutover {
+		c.primary, c.secondary = c.secondary, c.primary
+	}
+	return c
+}
+
+func (m *migration) count(p *int) {
+	m.mu.Lock()
+	*p++
+	m.mu.Unlock()
+}
+
+// Status returns the progress of the migration.
+func (m *migration) Status() MigrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// compare compares a batch of keys of the old server with the new server
+// and copies the keys that are missing or different to the new server. The
+// size of the batch is about n. A new pass starts when the previous pass
+// has scanned all keys.
+func (m *migration) compare(n int) error {
+	oldConn := m.old.Get()
+	defer oldConn.Close()
+	newConn := m.new.Get()
+	defer newConn.Close()
+
+	m.mu.Lock()
+	if !m.started {
+		m.mu.Unlock()
+		keys, err := redis.Int(oldConn.Do("DBSIZE"))
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.started = true
+		m.cursor = "0"
+		m.status.Keys = keys
+		m.status.Checked, m.status.Present, m.status.Matching, m.status.Copied = 0, 0, 0, 0
+	}
+	cursor := m.cursor
+	m.mu.Unlock()
+
+	values, err := redis.Values(oldConn.Do("SCAN", cursor, "COUNT", n))
+	if err != nil {
+		return err
+	}
+	if len(values) != 2 {
+		return fmt.Errorf("unexpected SCAN reply %s", formatReply(values))
+	}
+	cursor, err = redis.String(values[0], nil)
+	if err != nil {
+		return err
+	}
+	batch, err := redis.Strings(values[1], nil)
+	if err != nil {
+		return err
+	}
+	batch = comparableKeys(batch)
+
+	var present, matching, copied int
+	for _, key := range batch {
+		oldValue, err := keyValue(oldConn, key)
+		if err != nil {
+			return err
+		}
+		newValue, err := keyValue(newConn, key)
+		if err != nil {
+			return err
+		}
+		if newValue != nil {
+			present++
+		}
+		switch {
+		case oldValue == nil:
+			// The key expired or was deleted after SCAN returned it.
+			matching++
+			if newValue == nil {
+				present++
+			}
+		case reflect.DeepEqual(oldValue, newValue):
+			matching++
+		default:
+			if newValue != nil {
+				log.Printf("migration: key %q differs: old %s, new %s", key, formatReply(oldValue), formatReply(newValue))
+			}
+			ok, err := copyKey(oldConn, newConn, key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				copied++
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &m.status
+	s.Checked += len(batch)
+	s.Present += present
+	s.Matching += matching
+	s.Copied += copied
+	m.cursor = cursor
+	if cursor == "0" {
+		s.Passes++
+		s.LastPresentFraction, s.LastMatchingFraction = 1, 1
+		if s.Checked > 0 {
+			s.LastPresentFraction = float64(s.Present) / float64(s.Checked)
+			s.LastMatchingFraction = float64(s.Matching) / float64(s.Checked)
+		}
+		m.started = false
+	}
+	return nil
+}
+
+// copyKey copies key from the old server to the new server with DUMP and
+// RESTORE. The time to live of the key is kept. The result is false if the
+// key does not exist on the old server.
+func copyKey(oldConn, newConn redis.Conn, key string) (bool, error) {
+	oldConn.Send("PTTL", key)
+	oldConn.Send("DUMP", key)
+	values, err := redis.Values(oldConn.Do(""))
+	if err != nil {
+		return false, err
+	}
+	var (
+		ttl  int64
+		data []byte
+	)
+	if _, err := redis.Scan(values, &ttl, &data); err != nil {
+		return false, err
+	}
+	if data == nil {
+		return false, nil
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	if _, err := newConn.Do("RESTORE", key, ttl, data, "REPLACE"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// comparableKeys removes temporary keys and keys that expire from keys.
+func comparableKeys(keys []string) []string {
+	result := keys[:0]
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "tmp:") && !strings.HasPrefix(key, "lease:") {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// runComparator compares keys in the background for the life of the
+// process.
+func (m *migration) runComparator() {
+	for {
+		if err := m.compare(compareBatchSize); err != nil {
+			log.Printf("migration: compare: %v", err)
+		}
+		time.Sleep(compareInterval)
+	}
+}
+
+// keyValue returns the value of key in a form that does not depend on the
+// server's encoding of the value or nil if the key does not exist.
+func keyValue(c redis.Conn, key string) (interface{}, error) {
+	t, err := redis.String(c.Do("TYPE", key))
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case "none":
+		return nil, nil
+	case "string":
+		return redis.String(c.Do("GET", key))
+	case "list":
+		return redis.Strings(c.Do("LRANGE", key, 0, -1))
+	case "zset":
+		return redis.Strings(c.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+	case "set":
+		members, err := redis.Strings(c.Do("SMEMBERS", key))
+		sort.Strings(members)
+		return members, err
+	case "hash":
+		values, err := redis.Strings(c.Do("HGETALL", key))
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]string)
+		for i := 0; i+1 < len(values); i += 2 {
+			m[values[i]] = values[i+1]
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown type %q for key %q", t, key)
+}
+
+// migrationConn serves reads from the primary server and sends commands
+// that change the database to the primary and secondary servers. Errors
+// from the secondary server are logged.
+type migrationConn struct {
+	m                  *migration
+	primary, secondary redis.Conn
+}
+
+func (c *migrationConn) Close() error {
+	c.secondary.Close()
+	return c.primary.Close()
+}
+
+func (c *migrationConn) Err() error {
+	return c.primary.Err()
+}
+
+func (c *migrationConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// Flush and receive pipelined commands.
+		if _, err := c.secondary.Do(""); err != nil {
+			c.writeError(cmd, args, err)
+		}
+		return c.primary.Do("")
+	}
+
+	compare, read := readCommands[strings.ToUpper(cmd)]
+	if read && strings.ToUpper(cmd) == "SORT" {
+		for _, arg := range args {
+			if s, ok := arg.(string); ok && strings.ToUpper(s) == "STORE" {
+				read = false
+			}
+		}
+	}
+
+	reply, err := c.primary.Do(cmd, args...)
+	switch {
+	case !read:
+		if err == nil {
+			c.copyScriptKeys(cmd, args)
+		}
+		_, err2 := c.secondary.Do(cmd, args...)
+		if isNoScript(err2) {
+			// The secondary server does not have the script. Load all
+			// scripts and try again.
+			for _, s := range scripts {
+				s.Load(c.secondary)
+			}
+			_, err2 = c.secondary.Do(cmd, args...)
+		}
+		if err2 != nil && err == nil {
+			c.writeError(cmd, args, err2)
+		}
+	case compare && c.m.shadow > 0 && c.m.random() < c.m.shadow:
+		reply2, err2 := c.secondary.Do(cmd, args...)
+		c.m.count(&c.m.status.Sampled)
+		if !reflect.DeepEqual(reply, reply2) || (err == nil) != (err2 == nil) {
+			c.m.count(&c.m.status.Mismatches)
+			log.Printf("migration: %s %s differs: primary %s, %v, secondary %s, %v",
+				cmd, formatArgs(args), formatReply(reply), err, formatReply(reply2), err2)
+		}
+	}
+	return reply, err
+}
+
+// copyScriptKeys copies the keys registered with setCopyKeys for the script
+// run by cmd from the primary server to the secondary server.
+func (c *migrationConn) copyScriptKeys(cmd string, args []interface{}) {
+	var hash string
+	switch strings.ToUpper(cmd) {
+	case "EVALSHA":
+		hash, _ = redis.String(args[0], nil)
+	case "EVAL":
+		src, _ := redis.String(args[0], nil)
+		hash = hashScript(src)
+	default:
+		return
+	}
+	keys := copyKeys[hash]
+	if keys == nil {
+		return
+	}
+	keyCount, ok := args[1].(int)
+	if !ok {
+		var err error
+		if keyCount, err = redis.Int(args[1], nil); err != nil {
+			return
+		}
+	}
+	for _, key := range keys(args[2+keyCount:]) {
+		if _, err := copyKey(c.primary, c.secondary, key); err != nil {
+			c.writeError("copy", []interface{}{key}, err)
+		}
+	}
+}
+
+func (c *migrationConn) Send(cmd string, args ...interface{}) error {
+	if err := c.secondary.Send(cmd, args...); err != nil {
+		c.writeError(cmd, args, err)
+	}
+	return c.primary.Send(cmd, args...)
+}
+
+func (c *migrationConn) Flush() error {
+	if err := c.secondary.Flush(); err != nil {
+		c.writeError("flush", nil, err)
+	}
+	return c.primary.Flush()
+}
+
+func (c *migrationConn) Receive() (interface{}, error) {
+	if _, err := c.secondary.Receive(); err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			c.writeError("receive", nil, err)
+		}
+	}
+	return c.primary.Receive()
+}
+
+func (c *migrationConn) writeError(cmd string, args []interface{}, err error) {
+	c.m.count(&c.m.status.WriteErrors)
+	log.Printf("migration: secondary %s %s: %v", cmd, formatArgs(args), err)
+}
+
+func isNoScript(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "NOSCRIPT ")
+}
+
+// maxLogValue is the maximum length of a value in a log message.
+const maxLogValue = 200
+
+func truncate(s string) string {
+	if len(s) > maxLogValue {
+		return s[:maxLogValue] + "..."
+	}
+	return s
+}
+
+func formatArgs(args []interface{}) string {
+	var parts []string
+	for _, arg := range args {
+		parts = append(parts, formatReply(arg))
+	}
+	return truncate(strings.Join(parts, " "))
+}
+
+func formatReply(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return truncate(fmt.Sprintf("%q", v))
+	case []interface{}:
+		var parts []string
+		for _, e := range v {
+			parts = append(parts, formatReply(e))
+		}
+		return truncate("[" + strings.Join(parts, " ") + "]")
+	case nil:
+		return "nil"
+	}
+	return truncate(fmt.Sprint(v))
+}
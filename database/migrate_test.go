@@ -0,0 +1,314 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// memoryStore is an in-memory server that supports the string commands used
+// by the migration tests. The dump of a value is the value and SCAN returns
+// the keys in order.
+type memoryStore struct {
+	m          map[string]string
+	failWrites bool
+}
+
+func newMemoryStore(kv ...string) *memoryStore {
+	s := &memoryStore{m: make(map[string]string)}
+	for i := 0; i < len(kv); i += 2 {
+		s.m[kv[i]] = kv[i+1]
+	}
+	return s
+}
+
+func (s *memoryStore) Get() redis.Conn { return &memoryConn{s: s} }
+
+type memoryConn struct {
+	s       *memoryStore
+	pending []memoryCommand
+}
+
+type memoryCommand struct {
+	cmd  string
+	args []interface{}
+}
+
+func (c *memoryConn) Close() error { return nil }
+func (c *memoryConn) Err() error   { return nil }
+
+func (c *memoryConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		var replies []interface{}
+		for len(c.pending) > 0 {
+			reply, err := c.Receive()
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+		return replies, nil
+	}
+	var a []string
+	for _, arg := range args {
+		s, err := redis.String(arg, nil)
+		if err != nil {
+			s = fmt.Sprint(arg)
+		}
+		a = append(a, s)
+	}
+	switch strings.ToUpper(cmd) {
+	case "GET":
+		v, ok := c.s.m[a[0]]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "TYPE":
+		if _, ok := c.s.m[a[0]]; ok {
+			return "string", nil
+		}
+		return "none", nil
+	case "DBSIZE":
+		return int64(len(c.s.m)), nil
+	case "SCAN":
+		var keys []string
+		for k := range c.s.m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cursor, _ := strconv.Atoi(a[0])
+		count, _ := strconv.Atoi(a[2])
+		end := cursor + count
+		if end >= len(keys) {
+			end = 0
+			keys = keys[cursor:]
+		} else {
+			keys = keys[cursor:end]
+		}
+		var reply []interface{}
+		for _, k := range keys {
+			reply = append(reply, []byte(k))
+		}
+		return []interface{}{[]byte(strconv.Itoa(end)), reply}, nil
+	case "PTTL":
+		if _, ok := c.s.m[a[0]]; ok {
+			return int64(-1), nil
+		}
+		return int64(-2), nil
+	case "DUMP":
+		v, ok := c.s.m[a[0]]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "RESTORE":
+		c.s.m[a[0]] = a[2]
+		return "OK", nil
+	case "EVALSHA":
+		// The put script assigns the next id to a new path.
+		if a[0] != "put" {
+			return nil, redis.Error("NOSCRIPT No matching script.")
+		}
+		key := "id:" + a[2]
+		if _, ok := c.s.m[key]; !ok {
+			n, _ := strconv.Atoi(c.s.m["maxPackageId"])
+			c.s.m["maxPackageId"] = strconv.Itoa(n + 1)
+			c.s.m[key] = c.s.m["maxPackageId"]
+		}
+		return int64(1), nil
+	case "SET", "DEL":
+		if c.s.failWrites {
+			return nil, errors.New("write failed")
+		}
+		if strings.ToUpper(cmd) == "SET" {
+			c.s.m[a[0]] = a[1]
+			return "OK", nil
+		}
+		_, ok := c.s.m[a[0]]
+		delete(c.s.m, a[0])
+		if ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, redis.Error("ERR unknown command " + cmd)
+}
+
+func (c *memoryConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, memoryCommand{cmd, args})
+	return nil
+}
+
+func (c *memoryConn) Flush() error { return nil }
+
+func (c *memoryConn) Receive() (interface{}, error) {
+	p := c.pending[0]
+	c.pending = c.pending[1:]
+	return c.Do(p.cmd, p.args...)
+}
+
+func TestMigrationWrite(t *testing.T) {
+	old, new := newMemoryStore(), newMemoryStore()
+	m := newMigration(old, new, false, 0)
+	c := m.Get()
+	defer c.Close()
+
+	if _, err := c.Do("SET", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	c.Send("SET", "b", "2")
+	c.Send("DEL", "a")
+	if _, err := c.Do(""); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*memoryStore{old, new} {
+		if len(s.m) != 1 || s.m["b"] != "2" {
+			t.Errorf("store = %v, want map[b:2]", s.m)
+		}
+	}
+
+	// Errors from the new server are counted and not returned.
+	new.failWrites = true
+	if _, err := c.Do("SET", "c", "3"); err != nil {
+		t.Errorf("SET with failing new server returned error %v", err)
+	}
+	if old.m["c"] != "3" {
+		t.Errorf("old server did not store c")
+	}
+	if status := m.Status(); status.WriteErrors != 1 {
+		t.Errorf("WriteErrors = %d, want 1", status.WriteErrors)
+	}
+}
+
+func TestMigrationShadowRead(t *testing.T) {
+	old := newMemoryStore("a", "1", "b", "2")
+	new := newMemoryStore("a", "1", "b", "x")
+	m := newMigration(old, new, false, 0.5)
+	var sample float64
+	m.random = func() float64 { return sample }
+	c := m.Get()
+	defer c.Close()
+
+	for _, tt := range []struct {
+		key    string
+		sample float64
+		want   string
+	}{
+		{"a", 0, "1"},
+		{"b", 0, "2"},
+		{"b", 0.9, "2"},
+	} {
+		sample = tt.sample
+		v, err := redis.String(c.Do("GET", tt.key))
+		if err != nil || v != tt.want {
+			t.Errorf("GET %s = %q, %v, want %q", tt.key, v, err, tt.want)
+		}
+	}
+	if status := m.Status(); status.Sampled != 2 || status.Mismatches != 1 {
+		t.Errorf("Sampled, Mismatches = %d, %d, want 2, 1", status.Sampled, status.Mismatches)
+	}
+}
+
+func TestMigrationCutover(t *testing.T) {
+	old := newMemoryStore("a", "old")
+	new := newMemoryStore("a", "new")
+	m := newMigration(old, new, true, 0)
+	c := m.Get()
+	defer c.Close()
+
+	if v, _ := redis.String(c.Do("GET", "a")); v != "new" {
+		t.Errorf("GET a = %q, want new", v)
+	}
+	c.Do("SET", "b", "1")
+	if old.m["b"] != "1" || new.m["b"] != "1" {
+		t.Errorf("SET after cutover not written to both servers")
+	}
+}
+
+func TestMigrationScriptIDs(t *testing.T) {
+	copyKeys["put"] = func(argv []interface{}) []string {
+		path, _ := redis.String(argv[0], nil)
+		return []string{"id:" + path, "maxPackageId"}
+	}
+	defer delete(copyKeys, "put")
+
+	// The servers assigned different ids before the migration started.
+	old := newMemoryStore("maxPackageId", "5")
+	new := newMemoryStore("maxPackageId", "1")
+	m := newMigration(old, new, false, 0)
+	c := m.Get()
+	defer c.Close()
+
+	for _, path := range []string{"a", "b", "a"} {
+		if _, err := c.Do("EVALSHA", "put", 0, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"maxPackageId": "7", "id:a": "6", "id:b": "7"}
+	for _, s := range []*memoryStore{old, new} {
+		if !reflect.DeepEqual(s.m, want) {
+			t.Errorf("store = %v, want %v", s.m, want)
+		}
+	}
+}
+
+func TestMigrationCompare(t *testing.T) {
+	old := newMemoryStore("a", "1", "b", "2", "c", "3", "d", "4", "lease:x", "1")
+	new := newMemoryStore("a", "1", "b", "x", "d", "4")
+	m := newMigration(old, new, false, 0)
+
+	if err := m.compare(3); err != nil {
+		t.Fatal(err)
+	}
+	status := m.Status()
+	if status.Keys != 5 || status.Checked != 3 || status.Present != 2 || status.Matching != 1 || status.Copied != 2 {
+		t.Errorf("after first batch status = %+v, want keys 5, checked 3, present 2, matching 1, copied 2", status)
+	}
+
+	// The next batch completes the pass.
+	if err := m.compare(3); err != nil {
+		t.Fatal(err)
+	}
+	status = m.Status()
+	if status.Checked != 4 || status.Present != 3 || status.Matching != 2 || status.Passes != 1 {
+		t.Errorf("after second batch status = %+v, want checked 4, present 3, matching 2, passes 1", status)
+	}
+	if status.LastPresentFraction != 0.75 || status.LastMatchingFraction != 0.5 {
+		t.Errorf("after pass status = %+v, want present 0.75, matching 0.5", status)
+	}
+	if want := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}; !reflect.DeepEqual(new.m, want) {
+		t.Errorf("new server = %v, want %v", new.m, want)
+	}
+
+	// The copied keys match in the next pass.
+	for i := 0; i < 2; i++ {
+		if err := m.compare(3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status = m.Status()
+	if status.Passes != 2 || status.LastPresentFraction != 1 || status.LastMatchingFraction != 1 || status.Copied != 0 {
+		t.Errorf("after second pass status = %+v, want passes 2, present 1, matching 1, copied 0", status)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"errors"
+	"math"
+	"path"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// SortOrder is the order of search results.
+type SortOrder int
+
+const (
+	// SortByDocumentScore orders the results by the score computed from the
+	// documentation when the package is stored. Query and QueryScope use
+	// this order.
+	SortByDocumentScore SortOrder = iota
+
+	// SortByRank orders the results by the relevance of the query to the
+	// package times the rank of the package. The rank combines the document
+	// score, the number of importers and the hint set with SetRank.
+	SortByRank
+)
+
+// Weights of a query term that matches the package name, a word of the
+// synopsis or another term of the package such as an import.
+const (
+	nameTermWeight     = 4
+	synopsisTermWeight = 2
+	otherTermWeight    = 1
+)
+
+var setRankScript = newScript(0, `
+    local id = redis.call('GET', 'id:' .. ARGV[1])
+    if not id then
+        return 0
+    end
+    redis.call('HSET', 'pkg:' .. id, 'rank', ARGV[2])
+    return 1
+`)
+
+// SetRank sets the popularity hint used to rank the package with the
+// import path in search results sorted by SortByRank. Larger is more
+// popular. The server sets the hint from the page views. Unknown paths are
+// ignored.
+func (db *Database) SetRank(path string, rank float64) error {
+	if rank < 0 || math.IsNaN(rank) || math.IsInf(rank, 0) {
+		return errors.New("database: invalid rank")
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := setRankScript.Do(c, path, rank)
+	return err
+}
+
+// QueryOrder executes a query restricted to scope as QueryScope does and
+// returns the results in the given order. Implements queries are returned
+// in the order of QueryScope.
+func (db *Database) QueryOrder(q string, scope string, order SortOrder) ([]Package, error) {
+	return db.queryScope(q, scope, order)
+}
+
+// packageRank returns the rank of a package from the document score, the
+// number of packages that import the package and the rank hint.
+func packageRank(score float64, importers int, hint float64) float64 {
+	return score * (1 + math.Log1p(float64(importers))) * (1 + math.Log1p(hint))
+}
+
+// termRelevance returns the relevance of the package to the query terms.
+// Parse is the query parser of the tokenizer used to find the terms.
+func termRelevance(parse func(string) []string, terms []string, pkg Package) float64 {
+	name := make(map[string]bool)
+	for _, t := range parse(path.Base(pkg.Path)) {
+		name[t] = true
+	}
+	synopsis := make(map[string]bool)
+	for _, t := range parse(pkg.Synopsis) {
+		synopsis[t] = true
+	}
+	var r float64
+	for _, t := range terms {
+		switch {
+		case name[t]:
+			r += nameTermWeight
+		case synopsis[t]:
+			r += synopsisTermWeight
+		default:
+			r += otherTermWeight
+		}
+	}
+	return r
+}
+
+type rankedPackage struct {
+	pkg  Package
+	rank float64
+}
+
+type byRank []rankedPackage
+
+func (p byRank) Len() int      { return len(p) }
+func (p byRank) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byRank) Less(i, j int) bool {
+	if p[i].rank != p[j].rank {
+		return p[i].rank > p[j].rank
+	}
+	return p[i].pkg.Path < p[j].pkg.Path
+}
+
+// rankedSortArgs are the SORT arguments that get the search result fields,
+// the package comment, the document score and the rank hint of each package.
+func (si searchIndex) rankedSortArgs(id string) []interface{} {
+	return []interface{}{id, "BY", "nosort", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->derived", "GET", "pkg:*->kind", "GET", "pkg:*->newestMajor", "GET", "pkg:*->lang", "GET", "pkg:*->doc", "GET", "pkg:*->" + si.scoreField(), "GET", "pkg:*->rank"}
+}
+
+// rankResults returns the packages in a reply to the rankedSortArgs sort
+// ordered by the relevance to the terms times the rank.
+func (si searchIndex) rankResults(c redis.Conn, terms []string, reply interface{}) ([]Package, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	const n = 9
+	var fields []interface{}
+	scores := make(map[string][2]float64)
+	docs := make(map[string]string)
+	for i := 0; i+n <= len(values); i += n {
+		fields = append(fields, values[i:i+n-3]...)
+		var p string
+		if _, err := redis.Scan(values[i:i+1], &p); err != nil {
+			return nil, err
+		}
+		docs[p], _ = redis.String(values[i+n-3], nil)
+		score, _ := redis.Float64(values[i+n-2], nil)
+		hint, _ := redis.Float64(values[i+n-1], nil)
+		scores[p] = [2]float64{score, hint}
+	}
+	pkgs, err := searchResults(fields)
+	if err != nil || len(pkgs) == 0 {
+		return pkgs, err
+	}
+	for _, pkg := range pkgs {
+		c.Send("SCARD", si.key("import:"+pkg.Path))
+	}
+	counts, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	ranked := make([]rankedPackage, len(pkgs))
+	for i, pkg := range pkgs {
+		s := scores[pkg.Path]
+		ranked[i] = rankedPackage{pkg, termRelevance(si.tok.parseQuery, terms, pkg) * packageRank(s[0], counts[i], s[1])}
+	}
+	sort.Sort(byRank(ranked))
+	for i := range ranked {
+		pkgs[i] = ranked[i].pkg
+	}
+	si.setMatches(terms, pkgs, docs)
+	return pkgs, nil
+}
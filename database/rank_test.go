@@ -0,0 +1,101 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var rankCorpus = []struct {
+	pkg       Package
+	score     float64
+	importers int
+	hint      float64
+}{
+	{Package{Path: "example.com/d/httpx", Synopsis: "Package httpx extends http."}, 10, 0, 100},
+	{Package{Path: "example.com/c/util", Synopsis: "Package util has helpers."}, 100, 10, 0},
+	{Package{Path: "example.com/a/http", Synopsis: "Package http is a client."}, 100, 0, 0},
+	{Package{Path: "example.com/b/web", Synopsis: "Package web serves HTTP requests."}, 100, 20, 0},
+	{Package{Path: "example.com/e/empty"}, 0, 50, 50},
+}
+
+func TestRankOrder(t *testing.T) {
+	terms := parseQuery("http")
+	var ranked []rankedPackage
+	for _, tt := range rankCorpus {
+		ranked = append(ranked, rankedPackage{tt.pkg, termRelevance(parseQuery, terms, tt.pkg) * packageRank(tt.score, tt.importers, tt.hint)})
+	}
+	sort.Sort(byRank(ranked))
+	var got []string
+	for _, r := range ranked {
+		got = append(got, r.pkg.Path)
+	}
+	want := []string{"example.com/b/web", "example.com/a/http", "example.com/c/util", "example.com/d/httpx", "example.com/e/empty"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ranked = %v, want %v", got, want)
+	}
+
+	// A synopsis match beats a match on other terms for the same rank.
+	if s, o := termRelevance(parseQuery, terms, rankCorpus[3].pkg), termRelevance(parseQuery, terms, rankCorpus[1].pkg); s <= o {
+		t.Errorf("synopsis relevance %v <= other relevance %v", s, o)
+	}
+}
+
+func TestQueryOrder(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, p := range []string{"example.com/a/widget", "example.com/b/widget", "example.com/c/widget"} {
+		pdoc := &doc.Package{ImportPath: p, ProjectRoot: p, Name: "widget", Synopsis: "Package widget draws widgets.", Funcs: []*doc.Func{{Name: "F"}}}
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetRank("example.com/c/widget", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRank("example.com/missing", 100); err != nil {
+		t.Errorf("SetRank(missing) returned error %v", err)
+	}
+	if err := db.SetRank("example.com/a/widget", -1); err == nil {
+		t.Error("SetRank(-1) did not return an error")
+	}
+
+	pkgs, err := db.QueryOrder("widget", "", SortByRank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pkg := range pkgs {
+		got = append(got, pkg.Path)
+	}
+	want := []string{"example.com/c/widget", "example.com/a/widget", "example.com/b/widget"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryOrder(widget, SortByRank) = %v, want %v", got, want)
+	}
+
+	byScore, err := db.QueryOrder("widget", "", SortByDocumentScore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query, err := db.Query("widget"); err != nil || !reflect.DeepEqual(query, byScore) {
+		t.Errorf("Query(widget) = %v, %v, want %v", query, err, byScore)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"strconv"
+	"time"
+
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+var refTTL = flag.Duration("db-ref-ttl", 7*24*time.Hour, "Time that the documentation of an explicitly requested tag or branch is kept.")
+
+// refKey returns the key of the documentation for the tag or branch ref of
+// the package with the given import path.
+func refKey(path, ref string) string {
+	return "ref:" + path + "@" + ref
+}
+
+// PutRef stores the documentation of the package for the tag or branch ref
+// fetched at time t. The documentation of a ref is not indexed and expires
+// after the db-ref-ttl flag.
+func (db *Database) PutRef(pdoc *doc.Package, ref string, t time.Time) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(pdoc); err != nil {
+		return err
+	}
+	gobBytes, err := snappy.Encode(nil, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	key := refKey(pdoc.ImportPath, ref)
+	c.Send("MULTI")
+	c.Send("HMSET", key, "gob", gobBytes, "updated", t.Unix())
+	c.Send("EXPIRE", key, int64(*refTTL/time.Second))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// GetRef returns the documentation of the package with the given import
+// path for the tag or branch ref and the time the documentation was
+// fetched. Nil is returned if the documentation is not stored.
+func (db *Database) GetRef(path, ref string) (*doc.Package, time.Time, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("HMGET", refKey(path, ref), "gob", "updated"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var (
+		p       []byte
+		updated string
+	)
+	if _, err := redis.Scan(values, &p, &updated); err != nil {
+		return nil, time.Time{}, err
+	}
+	if p == nil {
+		return nil, time.Time{}, nil
+	}
+	pdoc, err := decodePackage(p, path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	n, _ := strconv.ParseInt(updated, 10, 64)
+	return pdoc, time.Unix(n, 0).UTC(), nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestRef(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const path = "github.com/user/repo"
+	if pdoc, _, err := db.GetRef(path, "v1.0.0"); pdoc != nil || err != nil {
+		t.Fatalf("GetRef() = %v, %v, want nil", pdoc, err)
+	}
+
+	updated := time.Unix(1400000000, 0).UTC()
+	pdoc := &doc.Package{ImportPath: path, Name: "repo", Synopsis: "Package repo handles aardvarks.", DefaultBranch: "v1.0.0"}
+	if err := db.PutRef(pdoc, "v1.0.0", updated); err != nil {
+		t.Fatal(err)
+	}
+	got, gotUpdated, err := db.GetRef(path, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Synopsis != pdoc.Synopsis || !gotUpdated.Equal(updated) {
+		t.Errorf("GetRef() = %+v, %v, want %+v, %v", got, gotUpdated, pdoc, updated)
+	}
+
+	// The documentation of a ref is not the current documentation.
+	if pdoc, _, _, err := db.Get(path); pdoc != nil || err != nil {
+		t.Errorf("Get() = %v, %v, want nil", pdoc, err)
+	}
+	if pdoc, _, err := db.GetRef(path, "v2.0.0"); pdoc != nil || err != nil {
+		t.Errorf("GetRef(v2.0.0) = %v, %v, want nil", pdoc, err)
+	}
+}
@@ -0,0 +1,473 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// The search index is stored in generations. Each generation has its own
+// index sets and package hash fields for terms and score, so that a new
+// generation can be built with a new tokenizer while the live generation
+// serves queries. Generation 0 uses the keys and fields from before
+// generations were introduced.
+
+// searchIndex is a generation of the search index and the tokenizer used to
+// build it.
+type searchIndex struct {
+	generation int
+	tok        *tokenizer
+}
+
+// key returns the key of the index set for term.
+func (si searchIndex) key(term string) string {
+	if si.generation == 0 {
+		return "index:" + term
+	}
+	return "index" + strconv.Itoa(si.generation) + ":" + term
+}
+
+// queryTerms returns the search terms for the query q. The query stop
+// words are dropped from the terms.
+func (si searchIndex) queryTerms(q string) ([]string, error) {
+	return dropStopWords(si.tok.parseQuery(q))
+}
+
+var pathPrefixScript = newScript(0, indexLua+`
+    local gen = ARGV[1]
+    local prefix = ARGV[2]
+    local dest = ARGV[3]
+    local members = redis.call('ZRANGEBYLEX', indexKey(gen, 'path:'), '[' .. prefix, '(' .. prefix .. '\255')
+    local ids = {}
+    for i, m in ipairs(members) do
+        table.insert(ids, string.match(m, ' (%d+)$'))
+        if (#ids == 1000 or i == #members) and #ids > 0 then
+            redis.call('SADD', dest, unpack(ids))
+            ids = {}
+        end
+    end
+    return #members
+`)
+
+// termKeys returns the keys of the index sets for the terms. The packages
+// under the prefix of a path term are copied from the sorted set of paths
+// to a temporary set. The work is proportional to the number of matching
+// paths, not to the number of packages. The caller deletes the temporary
+// keys.
+func (si searchIndex) termKeys(c redis.Conn, terms []string) (keys []interface{}, temp []interface{}, err error) {
+	for _, term := range terms {
+		if !strings.HasPrefix(term, pathTermPrefix) {
+			keys = append(keys, si.key(term))
+			continue
+		}
+		key, err := tempKey(c)
+		if err != nil {
+			return nil, temp, err
+		}
+		temp = append(temp, key)
+		if _, err := pathPrefixScript.Do(c, si.generation, term[len(pathTermPrefix):], key); err != nil {
+			return nil, temp, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, temp, nil
+}
+
+// termsField returns the package hash field for the space separated terms.
+func (si searchIndex) termsField() string {
+	if si.generation == 0 {
+		return "terms"
+	}
+	return "terms" + strconv.Itoa(si.generation)
+}
+
+// scoreField returns the package hash field for the search score.
+func (si searchIndex) scoreField() string {
+	if si.generation == 0 {
+		return "score"
+	}
+	return "score" + strconv.Itoa(si.generation)
+}
+
+// indexLua defines the Lua equivalents of the searchIndex methods. The
+// generation is passed to the functions as a string.
+const indexLua = `
+    local function indexKey(gen, term)
+        if gen == '0' then
+            return 'index:' .. term
+        end
+        return 'index' .. gen .. ':' .. term
+    end
+
+    local function termsField(gen)
+        if gen == '0' then
+            return 'terms'
+        end
+        return 'terms' .. gen
+    end
+
+    local function scoreField(gen)
+        if gen == '0' then
+            return 'score'
+        end
+        return 'score' .. gen
+    end
+
+    -- addTerm and removeTerm update the index for a term of a package. The
+    -- path terms are members "<path> <id>" of the sorted set 'path:'. The
+    -- updated terms are members <id> of the sorted set 'updated:' scored by
+    -- the time.
+    local function addTerm(gen, term, id)
+        if string.sub(term, 1, 5) == 'path:' then
+            redis.call('ZADD', indexKey(gen, 'path:'), 0, string.sub(term, 6) .. ' ' .. id)
+        elseif string.sub(term, 1, 8) == 'updated:' then
+            redis.call('ZADD', indexKey(gen, 'updated:'), string.sub(term, 9), id)
+        else
+            redis.call('SADD', indexKey(gen, term), id)
+        end
+    end
+
+    local function removeTerm(gen, term, id)
+        if string.sub(term, 1, 5) == 'path:' then
+            redis.call('ZREM', indexKey(gen, 'path:'), string.sub(term, 6) .. ' ' .. id)
+        elseif string.sub(term, 1, 8) == 'updated:' then
+            -- The member is kept when the new time was added first.
+            if tonumber(redis.call('ZSCORE', indexKey(gen, 'updated:'), id)) == tonumber(string.sub(term, 9)) then
+                redis.call('ZREM', indexKey(gen, 'updated:'), id)
+            end
+        else
+            redis.call('SREM', indexKey(gen, term), id)
+        end
+    end
+`
+
+// indexCheckInterval is the maximum time that a server uses the live
+// generation loaded from the database.
+const indexCheckInterval = 10 * time.Second
+
+// indexCleanupDelay is the time that a replaced generation is kept after a
+// rebuild. Servers that loaded the replaced generation before the swap use
+// it until they load the live generation again.
+var indexCleanupDelay = 3 * indexCheckInterval
+
+// reindexLeaseTTL is the time that a rebuild holds the reindex lease without
+// renewal.
+const reindexLeaseTTL = 10 * time.Minute
+
+// ErrReindexInProgress is returned by Reindex when another rebuild of the
+// search index is running.
+var ErrReindexInProgress = errors.New("database: reindex in progress")
+
+// errIndexChanged is the error returned by scripts when the live generation
+// passed to the script is not the live generation in the database.
+var errIndexChanged = redis.Error("search index changed")
+
+// indexCache is the live generation loaded from the database.
+type indexCache struct {
+	mu      sync.Mutex
+	si      searchIndex
+	expires time.Time
+}
+
+func (ic *indexCache) set(si searchIndex) {
+	ic.mu.Lock()
+	ic.si = si
+	ic.expires = time.Now().Add(indexCheckInterval)
+	ic.mu.Unlock()
+}
+
+func (ic *indexCache) invalidate() {
+	ic.mu.Lock()
+	ic.expires = time.Time{}
+	ic.mu.Unlock()
+}
+
+// loadSearchIndex loads the live generation from the database.
+func loadSearchIndex(c redis.Conn) (searchIndex, error) {
+	values, err := redis.Values(c.Do("HMGET", "searchIndex", "generation", "version"))
+	if err != nil {
+		return searchIndex{}, err
+	}
+	generation, version := 0, 1
+	if _, err := redis.Scan(values, &generation, &version); err != nil {
+		return searchIndex{}, err
+	}
+	tok := tokenizers[version]
+	if tok == nil {
+		return searchIndex{}, errors.New("database: search index built with unknown tokenizer version " + strconv.Itoa(version))
+	}
+	return searchIndex{generation: generation, tok: tok}, nil
+}
+
+// searchIndex returns the live generation of the search index.
+func (db *Database) searchIndex(c redis.Conn) (searchIndex, error) {
+	db.index.mu.Lock()
+	defer db.index.mu.Unlock()
+	now := time.Now()
+	if now.Before(db.index.expires) {
+		return db.index.si, nil
+	}
+	si, err := loadSearchIndex(c)
+	if err != nil {
+		return searchIndex{}, err
+	}
+	db.index.si = si
+	db.index.expires = now.Add(indexCheckInterval)
+	return si, nil
+}
+
+// IndexVersion returns the tokenizer version of the live search index. The
+// index should be rebuilt with Reindex when the version is not equal to
+// TokenizerVersion.
+func (db *Database) IndexVersion() (int, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := loadSearchIndex(c)
+	if err != nil {
+		return 0, err
+	}
+	return si.tok.version, nil
+}
+
+// indexTerms returns the search terms and score for a package. The package
+// CopyOf, project activity and advisories are used as in Put.
+func indexTerms(tok *tokenizer, pdoc *doc.Package, activity *doc.ProjectActivity, advisory bool) ([]string, float64) {
+	score := tok.documentScore(pdoc)
+	if pdoc.CopyOf != "" {
+		score *= copyScoreFactor
+	}
+	terms := tok.documentTerms(pdoc, score)
+	if activity != nil && activity.IsStale(time.Now()) {
+		terms = append(terms, staleTerm)
+	}
+	if advisory {
+		terms = append(terms, advisoryTerm)
+	}
+	return terms, score
+}
+
+var startReindexScript = newScript(0, `
+    redis.call('DEL', 'reindex:updated')
+    return redis.call('HMSET', 'reindex', 'generation', ARGV[1], 'version', ARGV[2])
+`)
+
+var indexPackageScript = newScript(0, indexLua+`
+    local id = ARGV[1]
+    local gen = ARGV[2]
+    local score = ARGV[3]
+    local terms = ARGV[4]
+
+    -- Do not recreate the hash for a deleted package.
+    if redis.call('EXISTS', 'pkg:' .. id) == 0 then
+        return false
+    end
+
+    local update = {}
+    for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, termsField(gen)) or '', '([^ ]+)') do
+        update[term] = 1
+    end
+
+    for term in string.gmatch(terms, '([^ ]+)') do
+        update[term] = (update[term] or 0) + 2
+    end
+
+    for term, x in pairs(update) do
+        if x == 1 then
+            removeTerm(gen, term, id)
+        elseif x == 2 then
+            addTerm(gen, term, id)
+        end
+    end
+
+    return redis.call('HMSET', 'pkg:' .. id, termsField(gen), terms, scoreField(gen), score)
+`)
+
+var popUpdatedScript = newScript(0, `
+    local ids = redis.call('SMEMBERS', 'reindex:updated')
+    redis.call('DEL', 'reindex:updated')
+    return ids
+`)
+
+var swapIndexScript = newScript(0, `
+    if redis.call('SCARD', 'reindex:updated') > 0 then
+        return 0
+    end
+    redis.call('HMSET', 'searchIndex', 'generation', ARGV[1], 'version', ARGV[2])
+    redis.call('DEL', 'reindex', 'reindex:updated')
+    return 1
+`)
+
+// indexPackage adds the package with the given id to a generation of the
+// search index.
+func indexPackage(c redis.Conn, si searchIndex, id string) error {
+	values, err := redis.Values(c.Do("HMGET", "pkg:"+id, "gob", "path"))
+	if err != nil {
+		return err
+	}
+	var (
+		p    []byte
+		path string
+	)
+	if _, err := redis.Scan(values, &p, &path); err != nil {
+		return err
+	}
+	if p == nil {
+		// The package was deleted.
+		return nil
+	}
+	pdoc, err := decodePackage(p, path)
+	if err != nil {
+		return err
+	}
+	activity, err := getActivity(c, pdoc.ProjectRoot)
+	if err != nil {
+		return err
+	}
+	advisory, err := hasAdvisory(c, pdoc.ImportPath)
+	if err != nil {
+		return err
+	}
+	terms, score := indexTerms(si.tok, pdoc, activity, advisory)
+	_, err = indexPackageScript.Do(c, id, si.generation, score, strings.Join(terms, " "))
+	return err
+}
+
+// deleteGeneration deletes the index sets and package hash fields for a
+// generation of the search index.
+func deleteGeneration(c redis.Conn, si searchIndex) error {
+	const batchSize = 1000
+	keys, err := redis.Strings(c.Do("KEYS", si.key("*")))
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > batchSize {
+			n = batchSize
+		}
+		args := make([]interface{}, n)
+		for i := range args {
+			args[i] = keys[i]
+		}
+		if _, err := c.Do("DEL", args...); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	keys, err = redis.Strings(c.Do("KEYS", "pkg:*"))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		c.Send("HDEL", key, si.termsField(), si.scoreField())
+	}
+	_, err = c.Do("")
+	return err
+}
+
+// Reindex builds a new generation of the search index with the current
+// tokenizer and replaces the live generation with the new generation.
+// Queries use the live generation until the swap. Packages stored during the
+// rebuild are indexed again before the swap. If progress is not nil, then
+// progress is called with the number of packages indexed and the total
+// number of packages.
+func (db *Database) Reindex(progress func(done, total int)) error {
+	return db.reindex(tokenizers[TokenizerVersion], progress)
+}
+
+func (db *Database) reindex(tok *tokenizer, progress func(done, total int)) error {
+	holder, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	if ok, err := db.AcquireLease("reindex", holder, reindexLeaseTTL); err != nil {
+		return err
+	} else if !ok {
+		return ErrReindexInProgress
+	}
+	defer db.ReleaseLease("reindex", holder)
+
+	c := db.Pool.Get()
+	defer c.Close()
+
+	live, err := loadSearchIndex(c)
+	if err != nil {
+		return err
+	}
+	next := searchIndex{generation: live.generation + 1, tok: tok}
+
+	// Remove the keys left by an interrupted rebuild.
+	if err := deleteGeneration(c, next); err != nil {
+		return err
+	}
+	if _, err := startReindexScript.Do(c, next.generation, tok.version); err != nil {
+		return err
+	}
+
+	keys, err := redis.Strings(c.Do("KEYS", "pkg:*"))
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := indexPackage(c, next, key[len("pkg:"):]); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i+1, len(keys))
+		}
+		if (i+1)%1000 == 0 {
+			if ok, err := db.AcquireLease("reindex", holder, reindexLeaseTTL); err != nil {
+				return err
+			} else if !ok {
+				return ErrReindexInProgress
+			}
+		}
+	}
+
+	// Index the packages stored during the rebuild until the swap finds no
+	// more updated packages.
+	for {
+		ids, err := redis.Strings(popUpdatedScript.Do(c))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := indexPackage(c, next, id); err != nil {
+				return err
+			}
+		}
+		if len(ids) > 0 {
+			continue
+		}
+		swapped, err := redis.Bool(swapIndexScript.Do(c, next.generation, tok.version))
+		if err != nil {
+			return err
+		}
+		if swapped {
+			break
+		}
+	}
+	db.index.set(next)
+
+	time.Sleep(indexCleanupDelay)
+	return deleteGeneration(c, live)
+}
@@ -0,0 +1,200 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var searchIndexKeyTests = []struct {
+	generation int
+	key        string
+	terms      string
+	score      string
+}{
+	{0, "index:project:go", "terms", "score"},
+	{1, "index1:project:go", "terms1", "score1"},
+	{12, "index12:project:go", "terms12", "score12"},
+}
+
+func TestSearchIndexKeys(t *testing.T) {
+	for _, tt := range searchIndexKeyTests {
+		si := searchIndex{generation: tt.generation}
+		if key := si.key("project:go"); key != tt.key {
+			t.Errorf("generation %d key = %q, want %q", tt.generation, key, tt.key)
+		}
+		if f := si.termsField(); f != tt.terms {
+			t.Errorf("generation %d termsField = %q, want %q", tt.generation, f, tt.terms)
+		}
+		if f := si.scoreField(); f != tt.score {
+			t.Errorf("generation %d scoreField = %q, want %q", tt.generation, f, tt.score)
+		}
+	}
+}
+
+func reindexTestPackage(i int) *doc.Package {
+	return &doc.Package{
+		ImportPath:  "example.com/pkg" + strconv.Itoa(i),
+		ProjectRoot: "example.com/pkg" + strconv.Itoa(i),
+		Name:        "pkg" + strconv.Itoa(i),
+		Synopsis:    "Package widget.",
+		Funcs:       []*doc.Func{{Name: "F"}},
+	}
+}
+
+// reindexTestTokenizer indexes the packages with an even number and scores
+// the packages by number.
+var reindexTestTokenizer = &tokenizer{
+	version: 1000,
+	documentTerms: func(pdoc *doc.Package, score float64) []string {
+		if int(score)%2 != 0 {
+			return []string{"project:" + pdoc.ProjectRoot}
+		}
+		return []string{"project:" + pdoc.ProjectRoot, "widget"}
+	},
+	documentScore: func(pdoc *doc.Package) float64 {
+		n, _ := strconv.Atoi(strings.TrimPrefix(pdoc.Name, "pkg"))
+		return float64(n)
+	},
+	parseQuery: parseQuery,
+}
+
+func queryPaths(db *Database, q string) (string, error) {
+	pkgs, err := db.Query(q)
+	if err != nil {
+		return "", err
+	}
+	var paths []string
+	for _, pkg := range pkgs {
+		paths = append(paths, pkg.Path)
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, " "), nil
+}
+
+func TestReindex(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	tokenizers[reindexTestTokenizer.version] = reindexTestTokenizer
+	defer delete(tokenizers, reindexTestTokenizer.version)
+	defer func(d time.Duration) { indexCleanupDelay = d }(indexCleanupDelay)
+	// The queries that started before the swap finish with the replaced
+	// generation before it is deleted.
+	indexCleanupDelay = 500 * time.Millisecond
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(reindexTestPackage(i), time.Time{}); err != nil {
+			t.Fatalf("db.Put(%d) returned error %v", i, err)
+		}
+	}
+
+	// The package stored during the rebuild is in the result before and after
+	// the swap.
+	paths := func(even bool, stored bool) string {
+		var p []string
+		for i := 0; i <= n; i++ {
+			if (i < n || stored) && (!even || i%2 == 0) {
+				p = append(p, "example.com/pkg"+strconv.Itoa(i))
+			}
+		}
+		sort.Strings(p)
+		return strings.Join(p, " ")
+	}
+	valid := map[string]bool{
+		paths(false, false): true,
+		paths(false, true):  true,
+		paths(true, false):  true,
+		paths(true, true):   true,
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				got, err := queryPaths(db, "widget")
+				if err != nil {
+					t.Errorf("db.Query() during reindex returned error %v", err)
+					return
+				}
+				if !valid[got] {
+					t.Errorf("db.Query() during reindex = %q, want result from old or new index", got)
+					return
+				}
+			}
+		}()
+	}
+
+	var putErr error
+	err := db.reindex(reindexTestTokenizer, func(done, total int) {
+		if done == 1 {
+			putErr = db.Put(reindexTestPackage(n), time.Time{})
+		}
+	})
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("db.reindex() returned error %v", err)
+	}
+	if putErr != nil {
+		t.Fatalf("db.Put() during reindex returned error %v", putErr)
+	}
+
+	if version, err := db.IndexVersion(); err != nil || version != reindexTestTokenizer.version {
+		t.Errorf("db.IndexVersion() = %d, %v, want %d", version, err, reindexTestTokenizer.version)
+	}
+	got, err := queryPaths(db, "widget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := paths(true, true); got != want {
+		t.Errorf("db.Query() after reindex = %q, want %q", got, want)
+	}
+
+	pkgs, err := db.Query("widget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) == 0 || pkgs[0].Path != "example.com/pkg10" {
+		t.Errorf("db.Query() after reindex = %v, want example.com/pkg10 first", pkgs)
+	}
+
+	// The keys of the replaced generation are deleted.
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, err := c.Do("KEYS", "index:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.([]interface{})) != 0 {
+		t.Errorf("found %d keys from old generation after reindex", len(keys.([]interface{})))
+	}
+}
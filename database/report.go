@@ -0,0 +1,148 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// maxReportTexts is the number of reports with text kept for a package.
+const maxReportTexts = 20
+
+// Report is a user report that a package page needs review.
+type Report struct {
+	Path   string    `json:"path"`
+	Reason string    `json:"reason"`
+	Text   string    `json:"text,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// Hash of the reporter's IP address.
+	Reporter string `json:"reporter"`
+}
+
+// ReportGroup is the open reports for a package. Reports with the same
+// reason are counted together.
+type ReportGroup struct {
+	Path string
+
+	// Time of the last report.
+	Last time.Time
+
+	// Number of reports for each reason.
+	Reasons map[string]int
+
+	// The most recent reports with text, most recent first.
+	Texts []Report
+}
+
+// Count returns the number of reports in the group.
+func (g *ReportGroup) Count() int {
+	n := 0
+	for _, count := range g.Reasons {
+		n += count
+	}
+	return n
+}
+
+// PutReport stores a report. The report is added to the count for the path
+// and reason. The text of the report is kept with the most recent reports
+// for the path.
+func (db *Database) PutReport(r Report) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	c.Send("ZADD", "reports", r.Time.Unix(), r.Path)
+	c.Send("HINCRBY", "report:"+r.Path, r.Reason, 1)
+	if r.Text != "" {
+		p, err := json.Marshal(&r)
+		if err != nil {
+			return err
+		}
+		c.Send("LPUSH", "reportText:"+r.Path, p)
+		c.Send("LTRIM", "reportText:"+r.Path, 0, maxReportTexts-1)
+	}
+	_, err := c.Do("")
+	return err
+}
+
+// OpenReports returns the open reports for up to n packages, most recently
+// reported first.
+func (db *Database) OpenReports(n int) ([]ReportGroup, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("ZREVRANGE", "reports", 0, n-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	var groups []ReportGroup
+	for len(values) > 0 {
+		var path string
+		var last int64
+		values, err = redis.Scan(values, &path, &last)
+		if err != nil {
+			return nil, err
+		}
+		c.Send("HGETALL", "report:"+path)
+		c.Send("LRANGE", "reportText:"+path, 0, -1)
+		groups = append(groups, ReportGroup{Path: path, Last: time.Unix(last, 0).UTC(), Reasons: make(map[string]int)})
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	replies, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		counts, err := redis.Values(replies[2*i], nil)
+		if err != nil {
+			return nil, err
+		}
+		for len(counts) > 0 {
+			var reason string
+			var count int
+			counts, err = redis.Scan(counts, &reason, &count)
+			if err != nil {
+				return nil, err
+			}
+			groups[i].Reasons[reason] = count
+		}
+		texts, err := redis.Values(replies[2*i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, text := range texts {
+			p, _ := text.([]byte)
+			var r Report
+			if err := json.Unmarshal(p, &r); err != nil {
+				return nil, err
+			}
+			groups[i].Texts = append(groups[i].Texts, r)
+		}
+	}
+	return groups, nil
+}
+
+// DismissReports removes the open reports for a package.
+func (db *Database) DismissReports(path string) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	c.Send("ZREM", "reports", path)
+	c.Send("DEL", "report:"+path, "reportText:"+path)
+	_, err := c.Do("")
+	return err
+}
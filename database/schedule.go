@@ -0,0 +1,182 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fetchResultTTL is the time a fetch result is kept after the fetch.
+const fetchResultTTL = 30 * 24 * time.Hour
+
+// FetchResult is the outcome of the last fetch of a package from the
+// repository.
+type FetchResult struct {
+	Time time.Time
+
+	// Result is "updated", "not modified", "not found", "rate limited" or
+	// "error".
+	Result string
+}
+
+// Cadence is a refresh interval requested by the author of a project. The
+// cadence applies to the packages in the project until the cadence
+// expires.
+type Cadence struct {
+	Interval time.Duration
+	Expires  time.Time
+}
+
+// Active returns true if the cadence has not expired at time t.
+func (c Cadence) Active(t time.Time) bool {
+	return c.Interval > 0 && t.Before(c.Expires)
+}
+
+// Schedule is the crawl schedule of a package. The fields are zero if the
+// information is not available.
+type Schedule struct {
+	LastFetch FetchResult
+	NextCrawl time.Time
+	Cadence   Cadence
+}
+
+// PutFetchResult records the result of a fetch of the package with the
+// given import path.
+func (db *Database) PutFetchResult(path string, r FetchResult) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	key := "fetch:" + path
+	c.Send("HMSET", key, "time", r.Time.Unix(), "result", r.Result)
+	c.Send("EXPIRE", key, int64(fetchResultTTL/time.Second))
+	_, err := c.Do("")
+	return err
+}
+
+// PutCadence sets the refresh cadence of the project with the given root.
+func (db *Database) PutCadence(root string, cadence Cadence) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	key := "cadence:" + root
+	c.Send("HMSET", key, "interval", int64(cadence.Interval/time.Second), "expires", cadence.Expires.Unix())
+	c.Send("EXPIREAT", key, cadence.Expires.Unix())
+	_, err := c.Do("")
+	return err
+}
+
+// GetCadence returns the refresh cadence of the project with the given
+// root. The cadence is zero if the project does not have a cadence.
+func (db *Database) GetCadence(root string) (Cadence, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	return scanCadence(c.Do("HMGET", "cadence:"+root, "interval", "expires"))
+}
+
+func scanCadence(reply interface{}, err error) (Cadence, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return Cadence{}, err
+	}
+	var interval, expires int64
+	if _, err := redis.Scan(values, &interval, &expires); err != nil {
+		return Cadence{}, err
+	}
+	if interval == 0 {
+		return Cadence{}, nil
+	}
+	return Cadence{Interval: time.Duration(interval) * time.Second, Expires: time.Unix(expires, 0).UTC()}, nil
+}
+
+// GetSchedule returns the crawl schedule of the package with the given
+// import path in the project with the given root.
+func (db *Database) GetSchedule(path, root string) (Schedule, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	c.Send("HMGET", "fetch:"+path, "time", "result")
+	c.Send("HMGET", "cadence:"+root, "interval", "expires")
+	c.Send("GET", "id:"+path)
+	replies, err := redis.Values(c.Do(""))
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	var s Schedule
+	fetch, err := redis.Values(replies[0], nil)
+	if err != nil {
+		return s, err
+	}
+	var t int64
+	if _, err := redis.Scan(fetch, &t, &s.LastFetch.Result); err != nil {
+		return s, err
+	}
+	if t != 0 {
+		s.LastFetch.Time = time.Unix(t, 0).UTC()
+	}
+	if s.Cadence, err = scanCadence(replies[1], nil); err != nil {
+		return s, err
+	}
+
+	id, err := redis.String(replies[2], nil)
+	if err == redis.ErrNil {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	next, err := redis.Int64(c.Do("ZSCORE", "nextCrawl", id))
+	if err == redis.ErrNil {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	s.NextCrawl = time.Unix(next, 0).UTC()
+	return s, nil
+}
+
+// PutRefreshToken stores the token that the author of the project with the
+// given root adds to the repository to request a refresh cadence and the
+// author key of the client that requested the token. The token expires
+// after ttl.
+func (db *Database) PutRefreshToken(root, token, author string, ttl time.Duration) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	c.Send("DEL", "refreshToken:"+root)
+	c.Send("HMSET", "refreshToken:"+root, "token", token, "author", author)
+	c.Send("EXPIRE", "refreshToken:"+root, int64(ttl/time.Second))
+	_, err := c.Do("")
+	return err
+}
+
+// GetRefreshToken returns the stored refresh token and author key for the
+// project with the given root or "" if there is no token.
+func (db *Database) GetRefreshToken(root string) (token, author string, err error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("HMGET", "refreshToken:"+root, "token", "author"))
+	if err != nil {
+		return "", "", err
+	}
+	_, err = redis.Scan(values, &token, &author)
+	return token, author, err
+}
+
+// DeleteRefreshToken deletes the refresh token for the project with the
+// given root.
+func (db *Database) DeleteRefreshToken(root string) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", "refreshToken:"+root)
+	return err
+}
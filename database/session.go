@@ -0,0 +1,290 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// querySessionTTL is the time that a query session is kept after the
+	// last query in the session.
+	querySessionTTL = 2 * time.Minute
+
+	// maxQuerySessions is the maximum number of query sessions.
+	maxQuerySessions = 1000
+)
+
+// querySession is the state saved between the queries in a search as you
+// type session.
+type querySession struct {
+	// terms is all but the last term of the previous query.
+	terms []string
+
+	// key is the Redis key for the intersection of the index sets for
+	// terms. The key is empty if terms is empty.
+	key string
+
+	// generation is the generation of the search index used for key.
+	generation int
+
+	expires time.Time
+}
+
+// querySessions is a bounded collection of query sessions. The zero value
+// is ready to use.
+type querySessions struct {
+	mu sync.Mutex
+	m  map[string]*querySession
+}
+
+func (qs *querySessions) get(token string, now time.Time) *querySession {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	s := qs.m[token]
+	if s == nil || now.After(s.expires) {
+		return nil
+	}
+	return s
+}
+
+func (qs *querySessions) put(token string, s *querySession, now time.Time) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.m == nil {
+		qs.m = make(map[string]*querySession)
+	}
+	if _, ok := qs.m[token]; !ok && len(qs.m) >= maxQuerySessions {
+		qs.evict(now)
+	}
+	qs.m[token] = s
+}
+
+// evict removes expired sessions. If the collection is still full, then
+// evict removes the session closest to expiration.
+func (qs *querySessions) evict(now time.Time) {
+	var oldest string
+	for token, s := range qs.m {
+		if now.After(s.expires) {
+			delete(qs.m, token)
+		} else if oldest == "" || s.expires.Before(qs.m[oldest].expires) {
+			oldest = token
+		}
+	}
+	if len(qs.m) >= maxQuerySessions {
+		delete(qs.m, oldest)
+	}
+}
+
+// sessionOverhead is the approximate size in bytes of a session excluding
+// the terms and key.
+const sessionOverhead = 128
+
+// usage returns the number of sessions and the approximate size in bytes
+// of a session sampled from the collection.
+func (qs *querySessions) usage() (int, int) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	for token, s := range qs.m {
+		size := sessionOverhead + len(token) + len(s.key)
+		for _, term := range s.terms {
+			size += len(term)
+		}
+		return len(qs.m), size
+	}
+	return 0, 0
+}
+
+// evictFraction removes the given fraction of the sessions, closest to
+// expiration first, and returns the number of sessions removed.
+func (qs *querySessions) evictFraction(fraction float64) int {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	n := int(math.Ceil(fraction * float64(len(qs.m))))
+	if n <= 0 {
+		return 0
+	}
+	sessions := make(sessionsByExpiration, 0, len(qs.m))
+	for token, s := range qs.m {
+		sessions = append(sessions, sessionToken{token, s.expires})
+	}
+	sort.Sort(sessions)
+	if n > len(sessions) {
+		n = len(sessions)
+	}
+	for _, s := range sessions[:n] {
+		delete(qs.m, s.token)
+	}
+	return n
+}
+
+type sessionToken struct {
+	token   string
+	expires time.Time
+}
+
+type sessionsByExpiration []sessionToken
+
+func (p sessionsByExpiration) Len() int           { return len(p) }
+func (p sessionsByExpiration) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p sessionsByExpiration) Less(i, j int) bool { return p[i].expires.Before(p[j].expires) }
+
+// QuerySessionUsage returns the number of cached query sessions and the
+// approximate size in bytes of a session.
+func (db *Database) QuerySessionUsage() (sessions, sessionSize int) {
+	return db.sessions.usage()
+}
+
+// EvictQuerySessions removes the given fraction of the cached query
+// sessions and returns the number of sessions removed. The searches of
+// removed sessions continue without reusing the previous query.
+func (db *Database) EvictQuerySessions(fraction float64) int {
+	return db.sessions.evictFraction(fraction)
+}
+
+func newSessionToken() (string, error) {
+	var p [12]byte
+	if _, err := rand.Read(p[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(p[:]), nil
+}
+
+func equalTerms(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// QuerySession executes a query in a search as you type session. The token
+// is the session token returned from the previous query in the session or
+// "" to start a new session. When the query changes only the last term of the
+// previous query, as when the user extends the last term, the intersection
+// of the other terms is reused from the previous query. QuerySession returns
+// the same results as Query.
+func (db *Database) QuerySession(q string, token string) ([]Package, string, error) {
+	now := time.Now()
+
+	var prev *querySession
+	if token != "" {
+		prev = db.sessions.get(token, now)
+	}
+	if prev == nil {
+		var err error
+		token, err = newSessionToken()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Implements queries do not use the session.
+	if name, rest, ok := implementsQuery(q); ok {
+		pkgs, err := db.queryImplements(c, si, name, rest, "")
+		return pkgs, token, err
+	}
+
+	sq, err := si.parseSearchQuery(q)
+	if err != nil {
+		return nil, "", err
+	}
+	terms := sq.terms
+	if len(terms) == 0 {
+		return nil, token, nil
+	}
+	last := terms[len(terms)-1]
+	s := &querySession{
+		terms:      terms[:len(terms)-1],
+		generation: si.generation,
+		expires:    now.Add(querySessionTTL),
+	}
+
+	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	if err != nil {
+		return nil, "", err
+	}
+	id := "tmp:query-" + strconv.Itoa(n)
+
+	// The Redis key outlives the session so that the key is not expired
+	// while a concurrent query uses the session.
+	ttl := int(2 * querySessionTTL / time.Second)
+
+	// The index keys are found before the commands are pipelined because
+	// the keys of path terms are created with separate commands.
+	reuse := len(s.terms) > 0 && prev != nil && prev.key != "" && prev.generation == s.generation && equalTerms(s.terms, prev.terms)
+	queryTerms := []string{last}
+	if len(s.terms) > 0 && !reuse {
+		queryTerms = terms
+	}
+	keys, temp, err := si.termKeys(c, queryTerms)
+	if len(temp) > 0 {
+		defer c.Do("DEL", temp...)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	lastKey := keys[len(keys)-1]
+
+	switch {
+	case len(s.terms) == 0:
+	case reuse:
+		s.key = prev.key
+		c.Send("EXPIRE", s.key, ttl)
+	default:
+		s.key = "tmp:session-" + strconv.Itoa(n)
+		args := []interface{}{s.key}
+		args = append(args, keys[:len(keys)-1]...)
+		c.Send("SINTERSTORE", args...)
+		c.Send("EXPIRE", s.key, ttl)
+	}
+
+	if s.key == "" {
+		sq.sendStore(c, id, lastKey)
+	} else {
+		sq.sendStore(c, id, s.key, lastKey)
+	}
+	c.Send("SORT", append([]interface{}{id}, sq.sortOptions()...)...)
+	c.Send("DEL", id)
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, "", err
+	}
+	pkgs, err := sq.results(values[len(values)-2])
+	if err != nil {
+		return nil, "", err
+	}
+	db.sessions.put(token, s, now)
+	return moveStandardMatch(pkgs, sq.q), token, nil
+}
@@ -0,0 +1,327 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestQuerySessionsBounded(t *testing.T) {
+	var qs querySessions
+	now := time.Now()
+	for i := 0; i < maxQuerySessions+10; i++ {
+		qs.put(strconv.Itoa(i), &querySession{expires: now.Add(time.Duration(i) * time.Second)}, now)
+	}
+	if len(qs.m) != maxQuerySessions {
+		t.Errorf("len(qs.m) = %d, want %d", len(qs.m), maxQuerySessions)
+	}
+	// The sessions closest to expiration are evicted first.
+	if s := qs.get("0", now); s != nil {
+		t.Errorf("get(0) = %v, want nil", s)
+	}
+	if s := qs.get(strconv.Itoa(maxQuerySessions+9), now); s == nil {
+		t.Errorf("get(%d) = nil, want session", maxQuerySessions+9)
+	}
+
+	// Expired sessions are not returned and are evicted before live
+	// sessions.
+	later := now.Add(time.Duration(maxQuerySessions) * time.Second)
+	if s := qs.get("100", later); s != nil {
+		t.Errorf("get(100) after expiration = %v, want nil", s)
+	}
+	qs.put("new", &querySession{expires: later.Add(querySessionTTL)}, later)
+	if len(qs.m) != 11 {
+		t.Errorf("len(qs.m) after eviction = %d, want 11", len(qs.m))
+	}
+}
+
+func TestQuerySessionsConcurrent(t *testing.T) {
+	var qs querySessions
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < maxQuerySessions; j++ {
+				token := strconv.Itoa(i*maxQuerySessions + j)
+				qs.put(token, &querySession{expires: now.Add(querySessionTTL)}, now)
+				qs.get(token, now)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(qs.m) > maxQuerySessions {
+		t.Errorf("len(qs.m) = %d, want <= %d", len(qs.m), maxQuerySessions)
+	}
+}
+
+func TestQuerySessionsEvictFraction(t *testing.T) {
+	var qs querySessions
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		qs.put(strconv.Itoa(i), &querySession{terms: []string{"a", "b"}, expires: now.Add(time.Duration(i) * time.Second)}, now)
+	}
+	if n, size := qs.usage(); n != 10 || size != sessionOverhead+3 {
+		t.Errorf("usage() = %d, %d, want 10, %d", n, size, sessionOverhead+3)
+	}
+	if n := qs.evictFraction(0.25); n != 3 {
+		t.Errorf("evictFraction(0.25) = %d, want 3", n)
+	}
+	// The sessions closest to expiration are evicted.
+	for i := 0; i < 10; i++ {
+		if s := qs.get(strconv.Itoa(i), now); (s == nil) != (i < 3) {
+			t.Errorf("get(%d) = %v after eviction", i, s)
+		}
+	}
+	if n := qs.evictFraction(2); n != 7 {
+		t.Errorf("evictFraction(2) = %d, want 7", n)
+	}
+	if n, _ := qs.usage(); n != 0 {
+		t.Errorf("usage() after evicting all = %d, want 0", n)
+	}
+}
+
+// putSyntheticCorpus adds n packages to the index. Every package has the
+// term "common", package i has the terms "a<i%10>" and "b<i%100>". The path
+// of package i is example.com/g<i/100>/p<i>.
+func putSyntheticCorpus(t testing.TB, db *Database, n int) {
+	c := db.Pool.Get()
+	defer c.Close()
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		path := "example.com/g" + strconv.Itoa(i/100) + "/p" + id
+		c.Send("HMSET", "pkg:"+id, "path", path, "synopsis", "", "kind", "p", "score", i%17)
+		c.Send("ZADD", "index:path:", 0, path+" "+id)
+		c.Send("SADD", "index:common", id)
+		c.Send("SADD", "index:a"+strconv.Itoa(i%10), id)
+		c.Send("SADD", "index:b"+strconv.Itoa(i%100), id)
+	}
+	if _, err := c.Do(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putErrorsOnly marks every tenth package of a synthetic corpus with n
+// packages as a package whose only content is errors.
+func putErrorsOnly(t testing.TB, db *Database, n int) {
+	c := db.Pool.Get()
+	defer c.Close()
+	for i := 0; i < n; i += 10 {
+		c.Send("SADD", "index:"+errorsOnlyTerm, strconv.Itoa(i))
+	}
+	if _, err := c.Do(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuerySession(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	putSyntheticCorpus(t, db, 1000)
+	putErrorsOnly(t, db, 1000)
+
+	var token string
+	for _, q := range []string{"c", "common", "common a", "common a1", "common a1 b", "common a1 b1", "common a1 b11", "common a1 b1", "common a2 b12", "b12 common",
+		"path:example.com/g3/ a1", "path:example.com/g3/ a2", "a2 path:example.com/g3/", "all: common a1", "all: common a1 b1"} {
+		want, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		var got []Package
+		got, token, err = db.QuerySession(q, token)
+		if err != nil {
+			t.Fatalf("db.QuerySession(%q) returned error %v", q, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("db.QuerySession(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	db := newDB(b)
+	defer closeDB(db)
+	putSyntheticCorpus(b, db, 100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Query("common a1 b" + strconv.Itoa(i%10*10+1)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQuerySession(b *testing.B) {
+	db := newDB(b)
+	defer closeDB(db)
+	putSyntheticCorpus(b, db, 100000)
+	_, token, err := db.QuerySession("common a1 b", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Each query extends the last term of the query that started
+		// the session.
+		if _, _, err := db.QuerySession("common a1 b"+strconv.Itoa(i%10*10+1), token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkQueryPathPrefix queries a path prefix that matches 100 packages
+// in a corpus of n packages.
+func benchmarkQueryPathPrefix(b *testing.B, n int) {
+	db := newDB(b)
+	defer closeDB(db)
+	putSyntheticCorpus(b, db, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkgs, err := db.Query("path:example.com/g" + strconv.Itoa(i%(n/100)) + "/ common")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(pkgs) != 100 {
+			b.Fatalf("query returned %d packages, want 100", len(pkgs))
+		}
+	}
+}
+
+func BenchmarkQueryPathPrefix1000(b *testing.B)   { benchmarkQueryPathPrefix(b, 1000) }
+func BenchmarkQueryPathPrefix100000(b *testing.B) { benchmarkQueryPathPrefix(b, 100000) }
+
+func TestQueryFunc(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	putSyntheticCorpus(t, db, 2*streamPageSize+10)
+	putErrorsOnly(t, db, 2*streamPageSize+10)
+
+	for _, q := range []string{"common", "common a1", "b12 common", "missing", "path:example.com/g1", "all: common a1"} {
+		want, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		var got []Package
+		if err := db.QueryFunc(q, "", func(pkg Package) bool {
+			got = append(got, pkg)
+			return true
+		}); err != nil {
+			t.Fatalf("db.QueryFunc(%q) returned error %v", q, err)
+		}
+		if len(got) != len(want) || len(got) > 0 && !reflect.DeepEqual(got, want) {
+			t.Errorf("db.QueryFunc(%q) returned %d results, want the %d results from db.Query", q, len(got), len(want))
+		}
+	}
+
+	n := 0
+	if err := db.QueryFunc("common", "", func(pkg Package) bool {
+		n++
+		return n < 3
+	}); err != nil || n != 3 {
+		t.Errorf("db.QueryFunc stopped after %d results with error %v, want 3", n, err)
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	for i := 0; i < 2*streamPageSize+10; i++ {
+		c.Send("ZADD", "nextCrawl", i, strconv.Itoa(i))
+	}
+	if _, err := c.Do(""); err != nil {
+		t.Fatal(err)
+	}
+	want, err := db.AllPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Package
+	if err := db.AllPackagesFunc(func(pkg Package) bool {
+		got = append(got, pkg)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("db.AllPackagesFunc returned %d packages, want the %d packages from db.AllPackages", len(got), len(want))
+	}
+
+	// The temporary keys are deleted.
+	keys, err := redis.Strings(c.Do("KEYS", "tmp:*"))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("temporary keys %v, %v remain", keys, err)
+	}
+}
+
+func TestQueryFuncWithoutDerived(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	c := db.Pool.Get()
+	defer c.Close()
+
+	// Package 1 is stored without the derived field as by a version of
+	// Put before the field was added.
+	c.Send("HMSET", "pkg:1", "path", "example.com/old", "synopsis", "", "kind", "p", "score", 2)
+	c.Send("HMSET", "pkg:2", "path", "example.com/new", "synopsis", "", "kind", "p", "score", 1, "derived", 1)
+	c.Send("SADD", "index:common", "1", "2")
+	if _, err := c.Do(""); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Package
+	if err := db.QueryFunc("common", "", func(pkg Package) bool {
+		got = append(got, pkg)
+		return true
+	}); err != nil {
+		t.Fatalf("db.QueryFunc returned error %v", err)
+	}
+	want := []Package{{Path: "example.com/old"}, {Path: "example.com/new", SynopsisDerived: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("db.QueryFunc returned %v, want %v", got, want)
+	}
+}
+
+func BenchmarkQueryAllSlice(b *testing.B) {
+	db := newDB(b)
+	defer closeDB(db)
+	putSyntheticCorpus(b, db, 100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkgs, err := db.Query("common")
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _ = range pkgs {
+		}
+	}
+}
+
+func BenchmarkQueryAllFunc(b *testing.B) {
+	db := newDB(b)
+	defer closeDB(db)
+	putSyntheticCorpus(b, db, 100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.QueryFunc("common", "", func(Package) bool { return true }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"flag"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	snapshotCount = flag.Int("db-snapshot-count", 3, "Number of recent builds of a popular package kept as historical snapshots. Zero disables snapshots.")
+	snapshotRank  = flag.Int("db-snapshot-rank", 10000, "Snapshots are kept for the packages with this many or fewer more popular packages.")
+)
+
+// putSnapshotScript stores the compressed documentation of a build as a
+// snapshot if the package is popular enough and removes the oldest
+// snapshots of the package over the limit. The total size of the snapshots
+// is kept in snapshotStats.
+var putSnapshotScript = newScript(0, `
+    local path = ARGV[1]
+    local t = ARGV[2]
+    local gob = ARGV[3]
+    local count = tonumber(ARGV[4])
+    local rank = tonumber(ARGV[5])
+
+    local id = redis.call('GET', 'id:' .. path)
+    if not id then
+        return 0
+    end
+    local r = redis.call('ZREVRANK', 'popular', id)
+    if not r or r >= rank then
+        return 0
+    end
+
+    local old = redis.call('HGET', 'snapshot:' .. path, t)
+    if old then
+        redis.call('HINCRBY', 'snapshotStats', 'bytes', -string.len(old))
+        redis.call('HINCRBY', 'snapshotStats', 'count', -1)
+    end
+    redis.call('HSET', 'snapshot:' .. path, t, gob)
+    redis.call('ZADD', 'snapshots:' .. path, t, t)
+    redis.call('HINCRBY', 'snapshotStats', 'bytes', string.len(gob))
+    redis.call('HINCRBY', 'snapshotStats', 'count', 1)
+
+    local drop = redis.call('ZRANGE', 'snapshots:' .. path, 0, -(count + 1))
+    for i=1,#drop do
+        local p = redis.call('HGET', 'snapshot:' .. path, drop[i])
+        if p then
+            redis.call('HINCRBY', 'snapshotStats', 'bytes', -string.len(p))
+            redis.call('HINCRBY', 'snapshotStats', 'count', -1)
+        end
+        redis.call('HDEL', 'snapshot:' .. path, drop[i])
+        redis.call('ZREM', 'snapshots:' .. path, drop[i])
+    end
+    return 1
+`)
+
+var deleteSnapshotsScript = newScript(0, `
+    local path = ARGV[1]
+    local values = redis.call('HVALS', 'snapshot:' .. path)
+    for i=1,#values do
+        redis.call('HINCRBY', 'snapshotStats', 'bytes', -string.len(values[i]))
+        redis.call('HINCRBY', 'snapshotStats', 'count', -1)
+    end
+    redis.call('DEL', 'snapshot:' .. path, 'snapshots:' .. path)
+`)
+
+// putSnapshot stores the compressed gob encoded documentation of a build
+// as a snapshot of the package at time t.
+func putSnapshot(c redis.Conn, path string, t time.Time, gobBytes []byte) error {
+	if *snapshotCount <= 0 {
+		return nil
+	}
+	_, err := putSnapshotScript.Do(c, path, t.Unix(), gobBytes, *snapshotCount, *snapshotRank)
+	return err
+}
+
+// Snapshots returns the times of the stored snapshots of the package with
+// the given import path, newest first. The time of a snapshot is the time
+// the documentation was fetched.
+func (db *Database) Snapshots(path string) ([]time.Time, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("ZREVRANGE", "snapshots:"+path, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	var times []time.Time
+	for _, v := range values {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, time.Unix(n, 0).UTC())
+	}
+	return times, nil
+}
+
+// GetSnapshot returns the snapshot of the package with the given import
+// path at time t or nil if there is no such snapshot. Snapshots are not
+// indexed; the search index and the package listings only return the
+// current documentation.
+func (db *Database) GetSnapshot(path string, t time.Time) (*doc.Package, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	p, err := redis.Bytes(c.Do("HGET", "snapshot:"+path, t.Unix()))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodePackage(p, path)
+}
+
+// SnapshotUsage returns the number and total size in bytes of the stored
+// snapshots.
+func (db *Database) SnapshotUsage() (int, int64, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("HMGET", "snapshotStats", "count", "bytes"))
+	if err != nil {
+		return 0, 0, err
+	}
+	var n int
+	var size int64
+	_, err = redis.Scan(values, &n, &size)
+	return n, size, err
+}
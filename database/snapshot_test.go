@@ -0,0 +1,92 @@
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestSnapshots(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	defer func(n, r int) { *snapshotCount, *snapshotRank = n, r }(*snapshotCount, *snapshotRank)
+	*snapshotCount, *snapshotRank = 2, 10
+
+	const path = "github.com/user/repo"
+	put := func(synopsis string, updated time.Time) {
+		pdoc := &doc.Package{ImportPath: path, ProjectRoot: path, Name: "repo", Synopsis: synopsis, Updated: updated, Funcs: []*doc.Func{{}}}
+		if err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t1 := time.Unix(1400000000, 0).UTC()
+	t2, t3, t4 := t1.Add(time.Hour), t1.Add(2*time.Hour), t1.Add(3*time.Hour)
+
+	// Packages that are not popular do not have snapshots.
+	put("Package repo handles aardvarks.", t1)
+	if times, err := db.Snapshots(path); len(times) != 0 || err != nil {
+		t.Fatalf("Snapshots() = %v, %v, want none for unpopular package", times, err)
+	}
+
+	if err := db.IncrementPopularScore(path); err != nil {
+		t.Fatal(err)
+	}
+	put("Package repo handles badgers.", t2)
+	put("Package repo handles zebras.", t3)
+	put("Package repo handles giraffes.", t4)
+
+	times, err := db.Snapshots(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Time{t4, t3}; !reflect.DeepEqual(times, want) {
+		t.Errorf("Snapshots() = %v, want %v", times, want)
+	}
+	if pdoc, err := db.GetSnapshot(path, t2); pdoc != nil || err != nil {
+		t.Errorf("GetSnapshot(rotated out) = %v, %v, want nil", pdoc, err)
+	}
+	pdoc, err := db.GetSnapshot(path, t3)
+	if err != nil || pdoc == nil || pdoc.Synopsis != "Package repo handles zebras." {
+		t.Fatalf("GetSnapshot(t3) = %v, %v, want the zebras build", pdoc, err)
+	}
+
+	// Search and the stored package only have the current build.
+	for _, q := range []string{"zebras", "badgers"} {
+		if pkgs, err := db.Query(q); len(pkgs) != 0 || err != nil {
+			t.Errorf("Query(%q) = %v, %v, want no results", q, pkgs, err)
+		}
+	}
+	if pkgs, err := db.Query("giraffes"); len(pkgs) != 1 || err != nil {
+		t.Errorf("Query(giraffes) = %v, %v, want the package", pkgs, err)
+	}
+	if pdoc, _, err := db.GetDoc(path); err != nil || pdoc.Synopsis != "Package repo handles giraffes." {
+		t.Errorf("GetDoc() = %v, %v, want the current build", pdoc, err)
+	}
+
+	n, size, err := db.SnapshotUsage()
+	if n != 2 || size <= 0 || err != nil {
+		t.Errorf("SnapshotUsage() = %d, %d, %v, want 2 snapshots", n, size, err)
+	}
+	if err := db.Delete(path); err != nil {
+		t.Fatal(err)
+	}
+	if n, size, err := db.SnapshotUsage(); n != 0 || size != 0 || err != nil {
+		t.Errorf("SnapshotUsage() after delete = %d, %d, %v, want 0, 0", n, size, err)
+	}
+}
@@ -15,9 +15,12 @@
 package database
 
 import (
+	"errors"
 	"strings"
+	"sync"
 )
 
+// stopWord is the set of words that are not indexed or searched.
 var stopWord = createStopWordMap()
 
 func createStopWordMap() map[string]bool {
@@ -28,6 +31,59 @@ func createStopWordMap() map[string]bool {
 	return m
 }
 
+// ErrStopWordQuery is returned for a query that contains only query stop
+// words.
+var ErrStopWordQuery = errors.New("database: query contains only stop words")
+
+// queryStopWords is the set of stemmed terms dropped from queries. The set
+// is not used to build the search index, so the set can be changed without
+// a reindex.
+var queryStopWords struct {
+	sync.RWMutex
+	m map[string]bool
+}
+
+// SetQueryStopWords sets the words dropped from search queries.
+func SetQueryStopWords(words []string) {
+	m := make(map[string]bool)
+	for _, w := range words {
+		for _, s := range strings.FieldsFunc(strings.ToLower(w), isTermSep) {
+			m[stem(s)] = true
+		}
+	}
+	queryStopWords.Lock()
+	queryStopWords.m = m
+	queryStopWords.Unlock()
+}
+
+// dropStopWords returns the query terms without the query stop words. Query
+// filters are kept. ErrStopWordQuery is returned if all of the other terms
+// are stop words.
+func dropStopWords(terms []string) ([]string, error) {
+	queryStopWords.RLock()
+	defer queryStopWords.RUnlock()
+	if len(queryStopWords.m) == 0 {
+		return terms, nil
+	}
+	var result []string
+	words, dropped := 0, 0
+	for _, term := range terms {
+		switch {
+		case queryFilters[term]:
+			result = append(result, term)
+		case queryStopWords.m[term]:
+			dropped++
+		default:
+			words++
+			result = append(result, term)
+		}
+	}
+	if dropped > 0 && words == 0 {
+		return nil, ErrStopWordQuery
+	}
+	return result, nil
+}
+
 const stopText = `
 a
 about
@@ -0,0 +1,315 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// streamPageSize is the number of packages read from the database at a time
+// by QueryFunc, AllPackagesFunc and IndexFunc.
+const streamPageSize = 1000
+
+// tempKeyTTL is the time to live in seconds of a temporary key. The caller
+// deletes the key when done. The time to live removes the keys of a walk
+// that does not finish.
+const tempKeyTTL = 3600
+
+// tempKey returns a key for a temporary value. The caller deletes the key
+// and sets the time to live of the key with EXPIRE after storing the value.
+func tempKey(c redis.Conn) (string, error) {
+	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	if err != nil {
+		return "", err
+	}
+	return "tmp:query-" + strconv.Itoa(n), nil
+}
+
+// sortPages sorts the set or sorted set with key src with the SORT options
+// args and calls fn with the values of streamPageSize elements at a time.
+// The args include n GET patterns. The sort is done once: the values are
+// stored in a temporary list and the pages are read from the list with
+// LRANGE. Elements added to src after the sort are not included. The
+// values of a missing hash field are empty strings. sortPages stops when
+// fn returns false or an error.
+func sortPages(c redis.Conn, src string, n int, args []interface{}, fn func(values []interface{}) (bool, error)) error {
+	list, err := tempKey(c)
+	if err != nil {
+		return err
+	}
+	defer c.Do("DEL", list)
+	c.Send("MULTI")
+	c.Send("SORT", append(append([]interface{}{src}, args...), "STORE", list)...)
+	c.Send("EXPIRE", list, tempKeyTTL)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	page := streamPageSize * n
+	for start := 0; ; start += page {
+		values, err := redis.Values(c.Do("LRANGE", list, start, start+page-1))
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		more, err := fn(values)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// QueryFunc is like QueryScope, but calls fn for each result in order
+// instead of returning the results. QueryFunc stops when fn returns false.
+//
+// The matching packages are copied to a temporary set and sorted once
+// before the first call to fn. The results are read a page at a time.
+// Packages stored after QueryFunc is called are not included.
+func (db *Database) QueryFunc(q string, scope string, fn func(Package) bool) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
+	if name, rest, ok := implementsQuery(q); ok {
+		pkgs, err := db.queryImplements(c, si, name, rest, scope)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range pkgs {
+			if !fn(pkg) {
+				break
+			}
+		}
+		return nil
+	}
+	sq, err := si.parseSearchQuery(q)
+	if err != nil {
+		return err
+	}
+	if len(sq.terms) == 0 {
+		return nil
+	}
+	keys, temp, err := si.termKeys(c, sq.terms)
+	if len(temp) > 0 {
+		defer c.Do("DEL", temp...)
+	}
+	if err != nil {
+		return err
+	}
+	id, err := tempKey(c)
+	if err != nil {
+		return err
+	}
+	if scope != "" {
+		keys = append([]interface{}{si.key("project:" + normalizeProjectRoot(scope))}, keys...)
+	}
+	c.Send("MULTI")
+	sq.sendStore(c, id, keys...)
+	c.Send("EXPIRE", id, tempKeyTTL)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	defer c.Do("DEL", id)
+
+	first := true
+	return sortPages(c, id, sortFields, sq.sortOptions(),
+		func(values []interface{}) (bool, error) {
+			pkgs, err := sq.results(values)
+			if err != nil {
+				return false, err
+			}
+			if first {
+				// The exact match on a standard package is moved to
+				// the top of the first page. Standard packages sort
+				// before other packages, so the match is on the first
+				// page.
+				first = false
+				pkgs = moveStandardMatch(pkgs, sq.q)
+			}
+			for _, pkg := range pkgs {
+				if !fn(pkg) {
+					return false, nil
+				}
+			}
+			return true, nil
+		})
+}
+
+// AllPackagesFunc is like AllPackages, but calls fn for each package in
+// order instead of returning the packages. AllPackagesFunc stops when fn
+// returns false. The packages are sorted once before the first call to fn
+// and read a page at a time.
+func (db *Database) AllPackagesFunc(fn func(Package) bool) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
+	return sortPages(c, "nextCrawl", 2, []interface{}{"DESC", "BY", "pkg:*->" + si.scoreField(), "GET", "pkg:*->path", "GET", "pkg:*->kind"},
+		func(values []interface{}) (bool, error) {
+			for len(values) > 0 {
+				var pkg Package
+				var kind string
+				values, err = redis.Scan(values, &pkg.Path, &kind)
+				if err != nil {
+					return false, err
+				}
+				if kind == "d" {
+					continue
+				}
+				if !fn(pkg) {
+					return false, nil
+				}
+			}
+			return true, nil
+		})
+}
+
+// IndexFunc calls fn with the import path of each package in the index and
+// the time the package was fetched. The packages are in import path order.
+// IndexFunc stops when fn returns false. The index is sorted once before the
+// first call to fn and the packages are read a page at a time.
+func (db *Database) IndexFunc(fn func(path string, updated time.Time) bool) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
+	return indexPages(c, si.key("all:"), fn)
+}
+
+// indexPages sorts the packages in the set with key src by import path and
+// calls fn with the import path and fetch time of each package.
+func indexPages(c redis.Conn, src string, fn func(path string, updated time.Time) bool) error {
+	return sortPages(c, src, 3, []interface{}{"ALPHA", "BY", "pkg:*->path", "GET", "pkg:*->path", "GET", "pkg:*->kind", "GET", "pkg:*->updated"},
+		func(values []interface{}) (bool, error) {
+			var err error
+			for len(values) > 0 {
+				var path, kind, updated string
+				values, err = redis.Scan(values, &path, &kind, &updated)
+				if err != nil {
+					return false, err
+				}
+				if kind == "d" || path == "" {
+					continue
+				}
+				var t time.Time
+				if n, _ := strconv.ParseInt(updated, 10, 64); n != 0 {
+					t = time.Unix(n, 0).UTC()
+				}
+				if !fn(path, t) {
+					return false, nil
+				}
+			}
+			return true, nil
+		})
+}
+
+var indexPathsScript = newScript(0, indexLua+`
+    local gen = ARGV[1]
+    local prefix = ARGV[2]
+    local since = ARGV[3]
+    local dest = ARGV[4]
+
+    local ids = {}
+    if prefix == '' then
+        ids = redis.call('ZRANGEBYSCORE', indexKey(gen, 'updated:'), since, '+inf')
+    else
+        -- Members are "<path> <id>". The ranges are the prefix and the paths
+        -- below the prefix.
+        for _, r in ipairs({{prefix .. ' ', prefix .. '!'}, {prefix .. '/', prefix .. '0'}}) do
+            for _, m in ipairs(redis.call('ZRANGEBYLEX', indexKey(gen, 'path:'), '[' .. r[1], '(' .. r[2])) do
+                local id = string.match(m, ' (%d+)$')
+                if since == '' then
+                    if redis.call('SISMEMBER', indexKey(gen, 'all:'), id) == 1 then
+                        table.insert(ids, id)
+                    end
+                else
+                    local t = redis.call('ZSCORE', indexKey(gen, 'updated:'), id)
+                    if t and tonumber(t) >= tonumber(since) then
+                        table.insert(ids, id)
+                    end
+                end
+            end
+        end
+    end
+    for i = 1, #ids, 1000 do
+        redis.call('SADD', dest, unpack(ids, i, math.min(i + 999, #ids)))
+    end
+    redis.call('EXPIRE', dest, ARGV[5])
+    return #ids
+`)
+
+// IndexPaths calls f with the import path of each package in the index in
+// sorted order. If prefix is not "", then only the package with import path
+// prefix and the packages below prefix are included. If since is not zero,
+// then only packages fetched at or after since are included.
+//
+// The matching packages are read from the sorted set of import paths for
+// prefix and from the sorted set of fetch times for since. The matches are
+// copied to a temporary set and sorted once. The work is proportional to
+// the number of matching packages, not to the number of packages.
+func (db *Database) IndexPaths(prefix string, since time.Time, f func(path string) error) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return err
+	}
+	src := si.key("all:")
+	if (prefix != "" || !since.IsZero()) && si.tok.version >= updatedTermVersion {
+		src, err = tempKey(c)
+		if err != nil {
+			return err
+		}
+		defer c.Do("DEL", src)
+		var min string
+		if !since.IsZero() {
+			min = strconv.FormatInt(since.Unix(), 10)
+		}
+		if _, err := indexPathsScript.Do(c, si.generation, prefix, min, src, tempKeyTTL); err != nil {
+			return err
+		}
+	}
+	// The packages are filtered again for the generations built before
+	// the updated terms.
+	var ferr error
+	err = indexPages(c, src, func(path string, updated time.Time) bool {
+		if !inPathTree(path, prefix) || (!since.IsZero() && updated.Before(since)) {
+			return true
+		}
+		ferr = f(path)
+		return ferr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+// inPathTree returns true if path is prefix or below prefix. All paths are
+// in the tree of the empty prefix.
+func inPathTree(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// termStatsMaxKeys is the maximum number of index keys examined by
+	// TermStats.
+	termStatsMaxKeys = 200000
+
+	// termStatsShortPrefixKeys is the maximum number of index keys examined
+	// by TermStats for prefixes shorter than termStatsShortPrefix bytes.
+	termStatsShortPrefixKeys = 20000
+	termStatsShortPrefix     = 2
+
+	// termStatsScanCount is the number of keys requested from each SCAN.
+	termStatsScanCount = 1000
+)
+
+// TermStat is the number of packages with a search term.
+type TermStat struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+type byTermCount []TermStat
+
+func (p byTermCount) Len() int      { return len(p) }
+func (p byTermCount) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byTermCount) Less(i, j int) bool {
+	if p[i].Count != p[j].Count {
+		return p[i].Count > p[j].Count
+	}
+	return p[i].Term < p[j].Term
+}
+
+// escapePattern escapes the glob characters in s for use in a Redis key
+// pattern.
+func escapePattern(s string) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// TermStats returns the search terms with the given prefix in the live
+// search index and the number of packages with each term. The terms are
+// sorted by decreasing count. If limit is greater than zero, then at most
+// limit terms are returned. Filter terms such as import:<path> are not
+// included.
+//
+// The index keys are read with SCAN so that other clients are not blocked
+// while the statistics are computed. The scan stops after a fixed number of
+// keys, with a lower limit for short prefixes, so the counts for a short or
+// empty prefix may be incomplete.
+func (db *Database) TermStats(prefix string, limit int) ([]TermStat, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	si, err := db.searchIndex(c)
+	if err != nil {
+		return nil, err
+	}
+
+	maxKeys := termStatsMaxKeys
+	if len(prefix) < termStatsShortPrefix {
+		maxKeys = termStatsShortPrefixKeys
+	}
+	base := si.key("")
+	pattern := escapePattern(base+prefix) + "*"
+
+	var stats []TermStat
+	cursor, scanned := 0, 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", termStatsScanCount))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		var terms []string
+		for _, key := range keys {
+			term := key[len(base):]
+			if strings.Contains(term, ":") {
+				continue
+			}
+			terms = append(terms, term)
+			c.Send("SCARD", key)
+		}
+		if len(terms) > 0 {
+			counts, err := redis.Ints(c.Do(""))
+			if err != nil {
+				return nil, err
+			}
+			for i, term := range terms {
+				stats = append(stats, TermStat{Term: term, Count: counts[i]})
+			}
+		}
+		scanned += len(keys)
+		if cursor == 0 || scanned >= maxKeys {
+			break
+		}
+	}
+
+	sort.Sort(byTermCount(stats))
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats, nil
+}
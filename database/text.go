@@ -0,0 +1,139 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"time"
+
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Text is the plain text documentation of a package rendered ahead of the
+// requests for the documentation.
+type Text struct {
+	// Version of the renderer that produced the text.
+	Version int
+
+	// Time the rendered package documentation was fetched.
+	Updated time.Time
+
+	// The package summary and the package with all declarations.
+	Summary []byte
+	All     []byte
+
+	// Etag of the stored package documentation if the text was rendered
+	// from the stored documentation. Etag is not stored by PutText.
+	Etag string
+}
+
+var putTextScript = newScript(0, `
+    local path = ARGV[1]
+    local version = ARGV[2]
+
+    local id = redis.call('GET', 'id:' .. path)
+    if not id then
+        return false
+    end
+
+    redis.call('ZADD', 'textVersion', version, id)
+    return redis.call('HMSET', 'pkg:' .. id, 'textVersion', version, 'textUpdated', ARGV[3], 'textSummary', ARGV[4], 'textAll', ARGV[5])
+`)
+
+// PutText stores the rendered text documentation for the package with the
+// given import path. The text is not stored if the package is not in the
+// database.
+func (db *Database) PutText(path string, t *Text) error {
+	summary, err := snappy.Encode(nil, t.Summary)
+	if err != nil {
+		return err
+	}
+	all, err := snappy.Encode(nil, t.All)
+	if err != nil {
+		return err
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err = putTextScript.Do(c, path, t.Version, t.Updated.Unix(), summary, all)
+	return err
+}
+
+var getTextScript = newScript(0, `
+    local id = redis.call('GET', 'id:' .. ARGV[1])
+    if not id then
+        return false
+    end
+    return redis.call('HMGET', 'pkg:' .. id, 'textVersion', 'textUpdated', 'textSummary', 'textAll', 'updated', 'etag', 'kind')
+`)
+
+// GetText returns the stored text documentation for the package with the
+// given import path or nil if the text is not stored.
+func (db *Database) GetText(path string) (*Text, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Values(getTextScript.Do(c, path))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var (
+		t          Text
+		updated    int64
+		summary    []byte
+		all        []byte
+		pkgUpdated int64
+		etag       string
+		kind       string
+	)
+	if _, err := redis.Scan(values, &t.Version, &updated, &summary, &all, &pkgUpdated, &etag, &kind); err != nil {
+		return nil, err
+	}
+	if t.Version == 0 {
+		return nil, nil
+	}
+	t.Updated = time.Unix(updated, 0).UTC()
+	if updated == pkgUpdated && kind != "d" {
+		t.Etag = etag
+	}
+	if t.Summary, err = snappy.Decode(nil, summary); err != nil {
+		return nil, err
+	}
+	if t.All, err = snappy.Decode(nil, all); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+var staleTextScript = newScript(0, `
+    local result = {}
+    for _, id in ipairs(redis.call('ZRANGEBYSCORE', 'textVersion', '-inf', '(' .. ARGV[1], 'LIMIT', 0, ARGV[2])) do
+        local path = redis.call('HGET', 'pkg:' .. id, 'path')
+        if path then
+            result[#result+1] = path
+        else
+            redis.call('ZREM', 'textVersion', id)
+        end
+    end
+    return result
+`)
+
+// StaleText returns the import paths of up to n packages with stored text
+// rendered by a renderer older than version.
+func (db *Database) StaleText(version, n int) ([]string, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	return redis.Strings(staleTextScript.Do(c, version, n))
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"encoding/json"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// APIToken describes a token issued to an API client.
+type APIToken struct {
+	// Label identifies the client to administrators.
+	Label string `json:"label"`
+
+	// Tier is the name of the quota tier for the client.
+	Tier string `json:"tier"`
+
+	// Roots are the roots of the projects with declaration views that the
+	// client can read. The roots are added when the holder of the token
+	// verifies a refresh cadence request for the project.
+	Roots []string `json:"roots,omitempty"`
+}
+
+// HasRoot returns true if the token is authorized for the project with the
+// given root.
+func (t *APIToken) HasRoot(root string) bool {
+	for _, r := range t.Roots {
+		if r == root {
+			return true
+		}
+	}
+	return false
+}
+
+// PutAPIToken stores the description of an API token.
+func (db *Database) PutAPIToken(token string, t APIToken) error {
+	p, err := json.Marshal(&t)
+	if err != nil {
+		return err
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err = c.Do("HSET", "apiToken", token, p)
+	return err
+}
+
+// APITokens returns the descriptions of all API tokens keyed by token.
+func (db *Database) APITokens() (map[string]APIToken, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("HGETALL", "apiToken"))
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]APIToken)
+	for len(values) > 0 {
+		var token string
+		var p []byte
+		values, err = redis.Scan(values, &token, &p)
+		if err != nil {
+			return nil, err
+		}
+		var t APIToken
+		if err := json.Unmarshal(p, &t); err != nil {
+			return nil, err
+		}
+		tokens[token] = t
+	}
+	return tokens, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ViewDays is the number of days that declaration views are kept.
+const ViewDays = 30
+
+const secondsPerDay = 24 * 60 * 60
+
+// AnchorViews is the number of views of the documentation of a declaration.
+type AnchorViews struct {
+	Anchor string `json:"anchor"`
+	Views  int    `json:"views"`
+}
+
+type byViews []AnchorViews
+
+func (p byViews) Len() int      { return len(p) }
+func (p byViews) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byViews) Less(i, j int) bool {
+	if p[i].Views != p[j].Views {
+		return p[i].Views > p[j].Views
+	}
+	return p[i].Anchor < p[j].Anchor
+}
+
+func viewsKey(path string, day int64) string {
+	return "views:" + path + ":" + strconv.FormatInt(day, 10)
+}
+
+// viewKeys returns the keys of the view counts for the ViewDays days
+// ending with the day of t.
+func viewKeys(path string, t time.Time) []string {
+	day := t.Unix() / secondsPerDay
+	keys := make([]string, ViewDays)
+	for i := range keys {
+		keys[i] = viewsKey(path, day-int64(i))
+	}
+	return keys
+}
+
+// IncrementViews adds counts of declaration views keyed by anchor to the
+// counts for the package on the day of t.
+func (db *Database) IncrementViews(path string, counts map[string]int, t time.Time) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	day := t.Unix() / secondsPerDay
+	key := viewsKey(path, day)
+	c := db.Pool.Get()
+	defer c.Close()
+	for anchor, n := range counts {
+		c.Send("HINCRBY", key, anchor, n)
+	}
+	c.Send("EXPIREAT", key, (day+ViewDays+1)*secondsPerDay)
+	_, err := c.Do("")
+	return err
+}
+
+// TopViews returns up to n declarations of the package with the most views
+// in the ViewDays days ending with the day of t, most viewed first. All
+// declarations with views are returned if n is zero.
+func (db *Database) TopViews(path string, t time.Time, n int) ([]AnchorViews, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	for _, key := range viewKeys(path, t) {
+		c.Send("HGETALL", key)
+	}
+	replies, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int)
+	for _, reply := range replies {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		for len(values) > 0 {
+			var anchor string
+			var count int
+			values, err = redis.Scan(values, &anchor, &count)
+			if err != nil {
+				return nil, err
+			}
+			totals[anchor] += count
+		}
+	}
+	var result []AnchorViews
+	for anchor, count := range totals {
+		result = append(result, AnchorViews{Anchor: anchor, Views: count})
+	}
+	sort.Sort(byViews(result))
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
+}
+
+// PruneViews removes the view counts for anchors of the package that are
+// not in anchors. Call after storing a new version of the package so that
+// the counts are kept for the current declarations only.
+func (db *Database) PruneViews(path string, anchors []string, t time.Time) error {
+	keep := make(map[string]bool, len(anchors))
+	for _, anchor := range anchors {
+		keep[anchor] = true
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	keys := viewKeys(path, t)
+	for _, key := range keys {
+		c.Send("HKEYS", key)
+	}
+	replies, err := redis.Values(c.Do(""))
+	if err != nil {
+		return err
+	}
+	n := 0
+	for i, reply := range replies {
+		fields, err := redis.Strings(reply, nil)
+		if err != nil {
+			return err
+		}
+		args := redis.Args{keys[i]}
+		for _, field := range fields {
+			if !keep[field] {
+				args = append(args, field)
+			}
+		}
+		if len(args) > 1 {
+			c.Send("HDEL", args...)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	_, err = c.Do("")
+	return err
+}
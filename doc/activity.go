@@ -0,0 +1,255 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ProjectActivity summarizes the recent activity in a project.
+type ProjectActivity struct {
+	// LastCommit is the time of the last commit to the default branch.
+	LastCommit time.Time
+
+	// Contributors is the number of contributors to the project, capped
+	// at MaxContributors.
+	Contributors int
+
+	// OpenIssues is the number of open issues or -1 if not known.
+	OpenIssues int
+
+	// DefaultBranch is the default branch reported by the project host.
+	DefaultBranch string
+
+	// Fetched is the time that the activity was fetched from the project
+	// host.
+	Fetched time.Time
+
+	// RawLastCommit is the last commit time reported by the project host
+	// if the reported time is later than Fetched. LastCommit is set to
+	// Fetched in that case.
+	RawLastCommit time.Time
+
+	// ClockSkew is the amount RawLastCommit is later than Fetched.
+	ClockSkew time.Duration
+}
+
+const (
+	// MaxContributors is the maximum contributor count reported in
+	// ProjectActivity.
+	MaxContributors = 50
+
+	// ActivityMaxAge is the maximum age of project activity before it is
+	// fetched again. Activity is refreshed independently of the package
+	// documentation.
+	ActivityMaxAge = 24 * time.Hour
+
+	// staleActivityAge is the age of the last commit after which a project
+	// is considered stale.
+	staleActivityAge = 365 * 24 * time.Hour
+
+	// MaxClockSkew is the amount a time reported by a project host can be
+	// later than the local clock before the difference is reported as a
+	// diagnostic.
+	MaxClockSkew = 5 * time.Minute
+)
+
+// IsStale returns true if the last commit to the project is older than a
+// year.
+func (a *ProjectActivity) IsStale(now time.Time) bool {
+	return !a.LastCommit.IsZero() && now.Sub(a.LastCommit) > staleActivityAge
+}
+
+// NeedsRefresh returns true if the activity should be fetched again.
+func (a *ProjectActivity) NeedsRefresh(now time.Time) bool {
+	return a == nil || now.Sub(a.Fetched) > ActivityMaxAge
+}
+
+// clampTimes sets a last commit time later than the fetch time to the fetch
+// time. A project host with a clock ahead of the local clock reports commits
+// in the future. The reported time is kept in RawLastCommit.
+func (a *ProjectActivity) clampTimes() {
+	if a.LastCommit.After(a.Fetched) {
+		a.RawLastCommit = a.LastCommit
+		a.ClockSkew = a.LastCommit.Sub(a.Fetched)
+		a.LastCommit = a.Fetched
+	}
+}
+
+// Diagnostics returns the problems found when fetching the activity.
+func (a *ProjectActivity) Diagnostics() []*Diagnostic {
+	if a == nil || a.ClockSkew <= MaxClockSkew {
+		return nil
+	}
+	return []*Diagnostic{{
+		Code:     DiagnosticClockSkew,
+		Severity: SeverityInfo,
+		Message:  fmt.Sprintf("The project host reported the last commit at %s, %v after the activity was fetched. The fetch time is shown as the last commit time.", a.RawLastCommit.Format(time.RFC3339), a.ClockSkew),
+	}}
+}
+
+var activityToken string
+
+// SetActivityToken sets the GitHub API token used to fetch project activity.
+// Project activity is not fetched until the token is set.
+func SetActivityToken(token string) {
+	activityToken = token
+}
+
+// ActivityEnabled returns true if fetching project activity is enabled.
+func ActivityEnabled() bool {
+	return activityToken != ""
+}
+
+var (
+	githubProjectPattern    = regexp.MustCompile(`^github\.com/(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<repo>[a-z0-9A-Z_.\-]+)$`)
+	bitbucketProjectPattern = regexp.MustCompile(`^bitbucket\.org/(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<repo>[a-z0-9A-Z_.\-]+)$`)
+)
+
+// GetProjectActivity fetches the activity for the project with the given
+// root from the project host. GetProjectActivity returns nil, nil if
+// activity is not enabled or not supported for the project's host.
+func GetProjectActivity(client *http.Client, projectRoot string) (*ProjectActivity, error) {
+	if !ActivityEnabled() {
+		return nil, nil
+	}
+	for _, s := range []struct {
+		pattern *regexp.Regexp
+		get     func(*http.Client, map[string]string) (*ProjectActivity, error)
+	}{
+		{githubProjectPattern, getGithubActivity},
+		{bitbucketProjectPattern, getBitbucketActivity},
+	} {
+		m := s.pattern.FindStringSubmatch(projectRoot)
+		if m == nil {
+			continue
+		}
+		match := make(map[string]string)
+		for i, n := range s.pattern.SubexpNames() {
+			if n != "" {
+				match[n] = m[i]
+			}
+		}
+		a, err := s.get(client, match)
+		if err != nil {
+			return nil, err
+		}
+		a.Fetched = time.Now().UTC()
+		a.clampTimes()
+		return a, nil
+	}
+	return nil, nil
+}
+
+func httpGetJSONHeader(client *http.Client, url string, header http.Header, v interface{}) error {
+	rc, err := httpGet(client, url, header)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(v)
+	if _, ok := err.(*json.SyntaxError); ok {
+		err = NotFoundError{"JSON syntax error at " + url}
+	}
+	return err
+}
+
+func getGithubActivity(client *http.Client, match map[string]string) (*ProjectActivity, error) {
+	header := http.Header{"Authorization": {"token " + activityToken}}
+
+	var repo struct {
+		DefaultBranch   string `json:"default_branch"`
+		OpenIssuesCount int    `json:"open_issues_count"`
+	}
+	if err := httpGetJSONHeader(client, expand("https://api.github.com/repos/{owner}/{repo}", match), header, &repo); err != nil {
+		return nil, err
+	}
+	match["branch"] = repo.DefaultBranch
+	if match["branch"] == "" {
+		match["branch"] = "master"
+	}
+
+	var commits []struct {
+		Commit struct {
+			Committer struct {
+				Date time.Time
+			}
+		}
+	}
+	if err := httpGetJSONHeader(client, expand("https://api.github.com/repos/{owner}/{repo}/commits?sha={branch}&per_page=1", match), header, &commits); err != nil {
+		return nil, err
+	}
+
+	var contributors []struct {
+		Login string
+	}
+	if err := httpGetJSONHeader(client, expand("https://api.github.com/repos/{owner}/{repo}/contributors?per_page={0}", match, strconv.Itoa(MaxContributors)), header, &contributors); err != nil {
+		return nil, err
+	}
+
+	a := &ProjectActivity{
+		Contributors:  len(contributors),
+		OpenIssues:    repo.OpenIssuesCount,
+		DefaultBranch: repo.DefaultBranch,
+	}
+	if len(commits) > 0 {
+		a.LastCommit = commits[0].Commit.Committer.Date.UTC()
+	}
+	if a.Contributors > MaxContributors {
+		a.Contributors = MaxContributors
+	}
+	return a, nil
+}
+
+func getBitbucketActivity(client *http.Client, match map[string]string) (*ProjectActivity, error) {
+	var changesets struct {
+		Changesets []struct {
+			RawAuthor    string `json:"raw_author"`
+			UTCTimestamp string `json:"utctimestamp"`
+		}
+	}
+	if err := httpGetJSON(client, expand("https://api.bitbucket.org/1.0/repositories/{owner}/{repo}/changesets?limit={0}", match, strconv.Itoa(MaxContributors)), &changesets); err != nil {
+		return nil, err
+	}
+
+	a := &ProjectActivity{OpenIssues: -1}
+
+	// The count of contributors is the number of authors in the most
+	// recent changesets.
+	authors := make(map[string]bool)
+	for _, c := range changesets.Changesets {
+		authors[c.RawAuthor] = true
+		t, err := time.Parse("2006-01-02 15:04:05-07:00", c.UTCTimestamp)
+		if err == nil && t.After(a.LastCommit) {
+			a.LastCommit = t.UTC()
+		}
+	}
+	a.Contributors = len(authors)
+
+	// Projects without an issue tracker return an error.
+	var issues struct {
+		Count int
+	}
+	if err := httpGetJSON(client, expand("https://api.bitbucket.org/1.0/repositories/{owner}/{repo}/issues?status=new&status=open&limit=0", match), &issues); err == nil {
+		a.OpenIssues = issues.Count
+	}
+
+	return a, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixtureTransport serves HTTP responses from a map of URLs to response
+// bodies. Requests for other URLs return status 404.
+type fixtureTransport map[string]string
+
+func (t fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := 200
+	body, ok := t[req.URL.String()]
+	if !ok {
+		status = 404
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+var activityFixtures = fixtureTransport{
+	"https://api.github.com/repos/user/repo":                             `{"default_branch": "main", "open_issues_count": 7}`,
+	"https://api.github.com/repos/user/repo/commits?sha=main&per_page=1": `[{"sha": "abc", "commit": {"committer": {"name": "x", "date": "2013-03-01T10:00:00Z"}}}]`,
+	"https://api.github.com/repos/user/repo/contributors?per_page=50":    `[{"login": "a"}, {"login": "b"}, {"login": "c"}]`,
+
+	"https://api.bitbucket.org/1.0/repositories/user/repo/changesets?limit=50": `{"count": 3, "changesets": [
+		{"raw_author": "A <a@example.com>", "utctimestamp": "2011-01-01 10:00:00+00:00"},
+		{"raw_author": "B <b@example.com>", "utctimestamp": "2011-02-01 10:00:00+00:00"},
+		{"raw_author": "A <a@example.com>", "utctimestamp": "2011-03-01 10:00:00+00:00"}]}`,
+
+	// Hosts with clocks ahead of the local clock.
+	"https://api.github.com/repos/user/future":                               `{"default_branch": "master", "open_issues_count": 0}`,
+	"https://api.github.com/repos/user/future/commits?sha=master&per_page=1": `[{"sha": "abc", "commit": {"committer": {"name": "x", "date": "2999-01-01T00:00:00Z"}}}]`,
+	"https://api.github.com/repos/user/future/contributors?per_page=50":      `[{"login": "a"}]`,
+
+	"https://api.bitbucket.org/1.0/repositories/user/future/changesets?limit=50": `{"count": 2, "changesets": [
+		{"raw_author": "A <a@example.com>", "utctimestamp": "2011-01-01 10:00:00+00:00"},
+		{"raw_author": "A <a@example.com>", "utctimestamp": "2999-01-01 00:00:00+00:00"}]}`,
+}
+
+var getProjectActivityTests = []struct {
+	projectRoot string
+	activity    *ProjectActivity
+}{
+	{"github.com/user/repo", &ProjectActivity{LastCommit: time.Date(2013, 3, 1, 10, 0, 0, 0, time.UTC), Contributors: 3, OpenIssues: 7, DefaultBranch: "main"}},
+	{"bitbucket.org/user/repo", &ProjectActivity{LastCommit: time.Date(2011, 3, 1, 10, 0, 0, 0, time.UTC), Contributors: 2, OpenIssues: -1}},
+	{"code.google.com/p/project", nil},
+}
+
+func TestGetProjectActivity(t *testing.T) {
+	client := &http.Client{Transport: activityFixtures}
+
+	defer SetActivityToken("")
+	SetActivityToken("")
+	if a, err := GetProjectActivity(client, "github.com/user/repo"); a != nil || err != nil {
+		t.Errorf("GetProjectActivity() with no token = %v, %v, want nil, nil", a, err)
+	}
+
+	SetActivityToken("token")
+	for _, tt := range getProjectActivityTests {
+		a, err := GetProjectActivity(client, tt.projectRoot)
+		if err != nil {
+			t.Errorf("GetProjectActivity(%q) returned error %v", tt.projectRoot, err)
+			continue
+		}
+		if tt.activity == nil {
+			if a != nil {
+				t.Errorf("GetProjectActivity(%q) = %+v, want nil", tt.projectRoot, a)
+			}
+			continue
+		}
+		if a == nil {
+			t.Errorf("GetProjectActivity(%q) = nil, want %+v", tt.projectRoot, tt.activity)
+			continue
+		}
+		if a.Fetched.IsZero() {
+			t.Errorf("GetProjectActivity(%q) did not set fetch time", tt.projectRoot)
+		}
+		a.Fetched = time.Time{}
+		if *a != *tt.activity {
+			t.Errorf("GetProjectActivity(%q) = %+v, want %+v", tt.projectRoot, a, tt.activity)
+		}
+	}
+
+	if _, err := GetProjectActivity(client, "github.com/user/missing"); err == nil {
+		t.Errorf("GetProjectActivity(missing) did not return error")
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	client := &http.Client{Transport: activityFixtures}
+	defer SetActivityToken("")
+	SetActivityToken("token")
+
+	raw := time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, projectRoot := range []string{"github.com/user/future", "bitbucket.org/user/future"} {
+		a, err := GetProjectActivity(client, projectRoot)
+		if err != nil {
+			t.Errorf("GetProjectActivity(%q) returned error %v", projectRoot, err)
+			continue
+		}
+		if !a.LastCommit.Equal(a.Fetched) {
+			t.Errorf("%s: LastCommit = %v, want fetch time %v", projectRoot, a.LastCommit, a.Fetched)
+		}
+		if !a.RawLastCommit.Equal(raw) {
+			t.Errorf("%s: RawLastCommit = %v, want %v", projectRoot, a.RawLastCommit, raw)
+		}
+		if want := raw.Sub(a.Fetched); a.ClockSkew != want {
+			t.Errorf("%s: ClockSkew = %v, want %v", projectRoot, a.ClockSkew, want)
+		}
+		if a.IsStale(a.Fetched) {
+			t.Errorf("%s: activity is stale", projectRoot)
+		}
+		d := a.Diagnostics()
+		if len(d) != 1 || d[0].Code != DiagnosticClockSkew || d[0].Severity != SeverityInfo {
+			t.Errorf("%s: Diagnostics() = %+v, want one clock-skew diagnostic", projectRoot, d)
+		}
+	}
+
+	// Small differences are clamped without a diagnostic.
+	now := time.Date(2013, 4, 1, 0, 0, 0, 0, time.UTC)
+	a := &ProjectActivity{LastCommit: now.Add(time.Minute), Fetched: now}
+	a.clampTimes()
+	if !a.LastCommit.Equal(now) || a.ClockSkew != time.Minute || len(a.Diagnostics()) != 0 {
+		t.Errorf("clamped activity = %+v, diagnostics %v", a, a.Diagnostics())
+	}
+	a = &ProjectActivity{LastCommit: now.Add(-time.Minute), Fetched: now}
+	a.clampTimes()
+	if !a.LastCommit.Equal(now.Add(-time.Minute)) || !a.RawLastCommit.IsZero() || a.ClockSkew != 0 {
+		t.Errorf("activity in the past was modified: %+v", a)
+	}
+	if d := (*ProjectActivity)(nil).Diagnostics(); d != nil {
+		t.Errorf("nil activity diagnostics = %v", d)
+	}
+}
+
+func TestProjectActivityAge(t *testing.T) {
+	now := time.Date(2013, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	var a *ProjectActivity
+	if !a.NeedsRefresh(now) {
+		t.Errorf("nil activity does not need refresh")
+	}
+	a = &ProjectActivity{LastCommit: now.Add(-400 * 24 * time.Hour), Fetched: now.Add(-time.Hour)}
+	if a.NeedsRefresh(now) {
+		t.Errorf("activity fetched one hour ago needs refresh")
+	}
+	if !a.NeedsRefresh(now.Add(ActivityMaxAge)) {
+		t.Errorf("activity fetched a day ago does not need refresh")
+	}
+	if !a.IsStale(now) {
+		t.Errorf("activity with last commit 400 days ago is not stale")
+	}
+	a.LastCommit = now.Add(-30 * 24 * time.Hour)
+	if a.IsStale(now) {
+		t.Errorf("activity with last commit 30 days ago is stale")
+	}
+}
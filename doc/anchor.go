@@ -0,0 +1,342 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/ast"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// AnchorKind is the kind of documentation element identified by an anchor.
+type AnchorKind int
+
+const (
+	// DeclAnchor is the anchor of an exported declaration. The names are
+	// the identifier or the type name and the method or field name. The
+	// anchor is the names joined by ".", as in "Buffer.Len".
+	DeclAnchor AnchorKind = iota
+
+	// ExampleAnchor is the anchor of an example. The names are the example
+	// object and the optional example suffix. The object is "package", a
+	// function name, a type name or a type and method name joined by "-".
+	// The anchor is "_ex_" followed by the names joined by "-", as in
+	// "_ex_Buffer-Len-Basic".
+	ExampleAnchor
+
+	// ExampleGroupAnchor is the anchor of the examples for an object. The
+	// name is the example object. The anchor is "_example_" followed by the
+	// object, as in "_example_Buffer-Len".
+	ExampleGroupAnchor
+
+	// NoteAnchor is the anchor of the notes with a tag. The name is the
+	// tag. The anchor is "_" followed by the lower case plural tag, as in
+	// "_bugs".
+	NoteAnchor
+)
+
+// AnchorID returns the canonical HTML id for a documentation element. See
+// the AnchorKind constants for the format of the anchors.
+func AnchorID(kind AnchorKind, names ...string) string {
+	switch kind {
+	case ExampleAnchor:
+		return "_ex_" + joinNonEmpty(names, "-")
+	case ExampleGroupAnchor:
+		return "_example_" + joinNonEmpty(names, "-")
+	case NoteAnchor:
+		return "_" + strings.ToLower(joinNonEmpty(names, "")) + "s"
+	}
+	return joinNonEmpty(names, ".")
+}
+
+func joinNonEmpty(names []string, sep string) string {
+	var a []string
+	for _, n := range names {
+		if n != "" {
+			a = append(a, n)
+		}
+	}
+	return strings.Join(a, sep)
+}
+
+// Identifier is an exported identifier declared by a package.
+type Identifier struct {
+	// Kind is "const", "var", "func", "type" or "method".
+	Kind string
+
+	// Name is the identifier. The name of a method is the type and method
+	// names joined by ".", as in "Buffer.Len".
+	Name string
+
+	// Anchor of the declaration.
+	Anchor string
+
+	// Synopsis is the first sentence of the declaration comment. The
+	// constants and variables of a group share the comment of the group.
+	Synopsis string
+}
+
+// Identifiers returns the exported identifiers declared by the package in
+// the order of the declaration index. The package constants and variables
+// are first and the constants and variables of a type follow the type.
+func Identifiers(pdoc *Package) []*Identifier {
+	var ids []*Identifier
+	addValues := func(kind string, values []*Value) {
+		for _, v := range values {
+			for _, name := range valueIdentifiers(v.Decl) {
+				ids = append(ids, &Identifier{kind, name, AnchorID(DeclAnchor, name), synopsis(v.Doc)})
+			}
+		}
+	}
+	addFuncs := func(funcs []*Func) {
+		for _, f := range funcs {
+			ids = append(ids, &Identifier{"func", f.Name, AnchorID(DeclAnchor, f.Name), synopsis(f.Doc)})
+		}
+	}
+	addValues("const", pdoc.Consts)
+	addValues("var", pdoc.Vars)
+	funcs, groups := IndexGroups(pdoc)
+	addFuncs(funcs)
+	for _, g := range groups {
+		t := g.Type
+		ids = append(ids, &Identifier{"type", t.Name, AnchorID(DeclAnchor, t.Name), synopsis(t.Doc)})
+		addValues("const", t.Consts)
+		addValues("var", t.Vars)
+		addFuncs(g.Funcs)
+		for _, f := range g.Methods {
+			name := AnchorID(DeclAnchor, t.Name, f.Name)
+			ids = append(ids, &Identifier{"method", name, name, synopsis(f.Doc)})
+		}
+	}
+	return ids
+}
+
+// valueIdentifiers returns the exported names declared by a printed
+// constant or variable declaration. The names are the anchors annotated by
+// the printer.
+func valueIdentifiers(decl Code) []string {
+	var names []string
+	for _, a := range decl.Annotations {
+		if a.Kind != AnchorAnnotation || a.Pos < 0 || a.Pos > a.End || int(a.End) > len(decl.Text) {
+			continue
+		}
+		if name := decl.Text[a.Pos:a.End]; ast.IsExported(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// legacySectionAnchors maps the section anchors used by other Go
+// documentation sites to the anchors used here.
+var legacySectionAnchors = map[string]string{
+	"pkg-index":          "_index",
+	"pkg-examples":       "_examples",
+	"pkg-constants":      "_constants",
+	"pkg-variables":      "_variables",
+	"pkg-files":          "_files",
+	"pkg-subdirectories": "_subdirs",
+}
+
+// exampleObject is an object with examples.
+type exampleObject struct {
+	// name is the object name used in anchors here, as in "Buffer-Len".
+	name string
+
+	// recv and ident are the type and identifier names. The names are
+	// empty for the package.
+	recv, ident string
+
+	examples []*Example
+}
+
+func exampleObjects(pdoc *Package) []exampleObject {
+	objs := []exampleObject{{name: "package", examples: pdoc.Examples}}
+	for _, f := range pdoc.Funcs {
+		objs = append(objs, exampleObject{f.Name, "", f.Name, f.Examples})
+	}
+	for _, t := range pdoc.Types {
+		objs = append(objs, exampleObject{t.Name, "", t.Name, t.Examples})
+		for _, f := range t.Funcs {
+			objs = append(objs, exampleObject{f.Name, "", f.Name, f.Examples})
+		}
+		for _, f := range t.Methods {
+			objs = append(objs, exampleObject{t.Name + "-" + f.Name, t.Name, f.Name, f.Examples})
+		}
+	}
+	return objs
+}
+
+// lowerFirst converts the first letter of s to lower case. Example suffixes
+// are title cased here and lower case in example function names.
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToLower(r)) + s[n:]
+}
+
+// LegacyAnchors returns a map from the anchors used for the package by other
+// Go documentation sites to the anchors used here. Anchors that are the same
+// here are not included in the map.
+func LegacyAnchors(pdoc *Package) map[string]string {
+	m := make(map[string]string)
+	for legacy, id := range legacySectionAnchors {
+		m[legacy] = id
+	}
+	for tag := range pdoc.Notes {
+		m["pkg-note-"+tag] = AnchorID(NoteAnchor, tag)
+	}
+	for _, obj := range exampleObjects(pdoc) {
+		if len(obj.examples) == 0 {
+			continue
+		}
+		// Example function name without the "Example" prefix, as in
+		// "Buffer_Len". The name is empty for the package.
+		goName := obj.ident
+		if obj.recv != "" {
+			goName = obj.recv + "_" + obj.ident
+		}
+		// Object name with "." between the type and method, as in
+		// "Buffer.Len".
+		dotName := AnchorID(DeclAnchor, obj.recv, obj.ident)
+		if dotName == "" {
+			dotName = "package"
+		}
+		for _, e := range obj.examples {
+			id := AnchorID(ExampleAnchor, obj.name, e.Name)
+			suffix := ""
+			if e.Name != "" {
+				suffix = "_" + lowerFirst(e.Name)
+			}
+			m["example_"+goName+suffix] = id
+			m["example-"+joinNonEmpty([]string{dotName, e.Name}, "-")] = id
+			m["example-"+joinNonEmpty([]string{dotName, lowerFirst(e.Name)}, "-")] = id
+		}
+	}
+	return m
+}
+
+// ResolveAnchor returns the anchor used here for the given anchor. The
+// anchor can be an anchor used here or an anchor used by other Go
+// documentation sites. A method can also be named with the receiver, as in
+// "(*Buffer).Len", or by the method name alone if a single type in the
+// package has a method with the name. ResolveAnchor returns false if the
+// anchor is not found in the package.
+func ResolveAnchor(pdoc *Package, anchor string) (string, bool) {
+	if hasAnchor(pdoc, anchor) {
+		return anchor, true
+	}
+	if id, ok := LegacyAnchors(pdoc)[anchor]; ok {
+		return id, true
+	}
+	return resolveMethodAnchor(pdoc, anchor)
+}
+
+// ResolveScopedAnchor is like ResolveAnchor, but a method name without a
+// type resolves to the method of the type named by scope. The anchor does not
+// resolve if scope is set and the type does not have the method.
+func ResolveScopedAnchor(pdoc *Package, scope, anchor string) (string, bool) {
+	if scope == "" || strings.Contains(anchor, ".") {
+		return ResolveAnchor(pdoc, anchor)
+	}
+	for _, t := range pdoc.Types {
+		if t.Name != scope {
+			continue
+		}
+		for _, f := range t.Methods {
+			if f.Name == anchor {
+				return AnchorID(DeclAnchor, t.Name, f.Name), true
+			}
+		}
+	}
+	return "", false
+}
+
+// resolveMethodAnchor resolves a method named with a parenthesized
+// receiver or by the method name alone. The method name alone resolves if
+// exactly one type has a method with the name.
+func resolveMethodAnchor(pdoc *Package, anchor string) (string, bool) {
+	recv, name := "", anchor
+	if strings.HasPrefix(anchor, "(") {
+		i := strings.Index(anchor, ").")
+		if i < 0 {
+			return "", false
+		}
+		recv, name = strings.TrimPrefix(anchor[1:i], "*"), anchor[i+2:]
+		if recv == "" {
+			return "", false
+		}
+	} else if strings.Contains(anchor, ".") {
+		return "", false
+	}
+	id := ""
+	for _, t := range pdoc.Types {
+		if recv != "" && t.Name != recv {
+			continue
+		}
+		for _, f := range t.Methods {
+			if f.Name != name {
+				continue
+			}
+			if id != "" {
+				// The method name is ambiguous.
+				return "", false
+			}
+			id = AnchorID(DeclAnchor, t.Name, f.Name)
+		}
+	}
+	return id, id != ""
+}
+
+func hasAnchor(pdoc *Package, anchor string) bool {
+	for _, id := range legacySectionAnchors {
+		if id == anchor {
+			return true
+		}
+	}
+	for tag := range pdoc.Notes {
+		if AnchorID(NoteAnchor, tag) == anchor {
+			return true
+		}
+	}
+	for _, id := range Identifiers(pdoc) {
+		if id.Anchor == anchor {
+			return true
+		}
+	}
+	for _, obj := range exampleObjects(pdoc) {
+		if len(obj.examples) > 0 && AnchorID(ExampleGroupAnchor, obj.name) == anchor {
+			return true
+		}
+		for _, e := range obj.examples {
+			if AnchorID(ExampleAnchor, obj.name, e.Name) == anchor {
+				return true
+			}
+		}
+	}
+	if len(pdoc.ReadmeExamples) > 0 && AnchorID(ExampleGroupAnchor, "readme") == anchor {
+		return true
+	}
+	for i := range pdoc.ReadmeExamples {
+		if AnchorID(ExampleAnchor, "readme", strconv.Itoa(i+1)) == anchor {
+			return true
+		}
+	}
+	return false
+}
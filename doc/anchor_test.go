@@ -0,0 +1,206 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"strings"
+	"testing"
+)
+
+var anchorTestPackage = &Package{
+	Examples: []*Example{{Name: ""}, {Name: "Basic"}},
+	Funcs: []*Func{
+		{Name: "Compact", Examples: []*Example{{Name: ""}}},
+	},
+	Types: []*Type{{
+		Name:  "Buffer",
+		Funcs: []*Func{{Name: "NewBuffer"}},
+		Methods: []*Func{
+			{Name: "Len", Examples: []*Example{{Name: ""}, {Name: "Empty"}}},
+			{Name: "Reset"},
+		},
+	}},
+	Notes: map[string][]*Note{"BUG": {{Body: "broken"}}},
+}
+
+var anchorIDTests = []struct {
+	kind  AnchorKind
+	names []string
+	id    string
+}{
+	{DeclAnchor, []string{"Compact"}, "Compact"},
+	{DeclAnchor, []string{"Buffer", "Len"}, "Buffer.Len"},
+	{ExampleAnchor, []string{"package", ""}, "_ex_package"},
+	{ExampleAnchor, []string{"Buffer-Len", "Empty"}, "_ex_Buffer-Len-Empty"},
+	{ExampleGroupAnchor, []string{"Buffer-Len"}, "_example_Buffer-Len"},
+	{NoteAnchor, []string{"BUG"}, "_bugs"},
+}
+
+func TestAnchorID(t *testing.T) {
+	for _, tt := range anchorIDTests {
+		if id := AnchorID(tt.kind, tt.names...); id != tt.id {
+			t.Errorf("AnchorID(%d, %q) = %q, want %q", tt.kind, tt.names, id, tt.id)
+		}
+	}
+}
+
+var resolveAnchorTests = []struct {
+	anchor string
+	id     string
+	ok     bool
+}{
+	// Anchors used here.
+	{"Compact", "Compact", true},
+	{"NewBuffer", "NewBuffer", true},
+	{"Buffer.Len", "Buffer.Len", true},
+	{"_ex_Buffer-Len-Empty", "_ex_Buffer-Len-Empty", true},
+	{"_example_Buffer-Len", "_example_Buffer-Len", true},
+	{"_bugs", "_bugs", true},
+	{"_index", "_index", true},
+
+	// Section and note anchors.
+	{"pkg-index", "_index", true},
+	{"pkg-subdirectories", "_subdirs", true},
+	{"pkg-note-BUG", "_bugs", true},
+
+	// Example anchors with Go example function names.
+	{"example_", "_ex_package", true},
+	{"example__basic", "_ex_package-Basic", true},
+	{"example_Compact", "_ex_Compact", true},
+	{"example_Buffer_Len", "_ex_Buffer-Len", true},
+	{"example_Buffer_Len_empty", "_ex_Buffer-Len-Empty", true},
+
+	// Example anchors with dotted object names.
+	{"example-package", "_ex_package", true},
+	{"example-package-Basic", "_ex_package-Basic", true},
+	{"example-package-basic", "_ex_package-Basic", true},
+	{"example-Compact", "_ex_Compact", true},
+	{"example-Buffer.Len", "_ex_Buffer-Len", true},
+	{"example-Buffer.Len-Empty", "_ex_Buffer-Len-Empty", true},
+
+	// Unknown anchors.
+	{"Missing", "", false},
+	{"Buffer.Reset-x", "", false},
+	{"example-Buffer.Reset", "", false},
+	{"pkg-note-TODO", "", false},
+}
+
+func TestResolveAnchor(t *testing.T) {
+	for _, tt := range resolveAnchorTests {
+		id, ok := ResolveAnchor(anchorTestPackage, tt.anchor)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("ResolveAnchor(%q) = %q, %v, want %q, %v", tt.anchor, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+// methodTestPackage has two types with methods of the same name.
+func methodTestPackage() *Package {
+	return &Package{
+		Funcs: []*Func{
+			{Name: "Dial", Decl: Code{Text: "func Dial(addr string) (net.Conn, error)"}},
+			{Name: "NewClient", Decl: Code{Text: "func NewClient(addr string) (*Client, error)"}},
+			{Name: "NewPool", Decl: Code{Text: "func NewPool(c *Client, n int) (*Pool, error)"}},
+			{Name: "NewReader", Decl: Code{Text: "func NewReader(c *Client, p *Pool) (*Client, *Pool)"}},
+		},
+		Types: []*Type{
+			{Name: "Client", Methods: []*Func{
+				{Name: "Close", Recv: "*Client"},
+				{Name: "Do", Recv: "*Client"},
+			}},
+			{Name: "Pool", Methods: []*Func{
+				{Name: "Close", Recv: "Pool"},
+				{Name: "Do", Recv: "*Pool"},
+				{Name: "Get", Recv: "*Pool"},
+			}},
+		},
+	}
+}
+
+var resolveScopedAnchorTests = []struct {
+	scope  string
+	anchor string
+	id     string
+	ok     bool
+}{
+	{"", "Client.Do", "Client.Do", true},
+	{"", "(*Client).Do", "Client.Do", true},
+	{"", "(Pool).Do", "Pool.Do", true},
+	{"", "(*Pool).Get", "Pool.Get", true},
+	{"", "Get", "Pool.Get", true},
+	{"", "Dial", "Dial", true},
+	{"Client", "Do", "Client.Do", true},
+	{"Pool", "Do", "Pool.Do", true},
+	{"Pool", "Close", "Pool.Close", true},
+	{"Pool", "Client.Do", "Client.Do", true},
+
+	// Ambiguous and unknown methods.
+	{"", "Do", "", false},
+	{"Missing", "Do", "", false},
+	{"Client", "Get", "", false},
+	{"Client", "Dial", "", false},
+	{"", "(*Client).Get", "", false},
+	{"", "().Do", "", false},
+	{"", "Client.Get", "", false},
+}
+
+func TestResolveScopedAnchor(t *testing.T) {
+	pdoc := methodTestPackage()
+	for _, tt := range resolveScopedAnchorTests {
+		id, ok := ResolveScopedAnchor(pdoc, tt.scope, tt.anchor)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("ResolveScopedAnchor(%q, %q) = %q, %v, want %q, %v", tt.scope, tt.anchor, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	pdoc := methodTestPackage()
+	pdoc.Consts = []*Value{{
+		Decl: Code{
+			Text:        "const (\n\tMaxSize = 10\n\tminSize = 1\n)",
+			Annotations: []Annotation{{Pos: 9, End: 16, Kind: AnchorAnnotation}, {Pos: 23, End: 30, Kind: AnchorAnnotation}},
+		},
+		Doc: "Size limits. The limits are in bytes.",
+	}}
+	pdoc.Funcs[0].Doc = "Dial connects to the server at addr."
+	var got []string
+	for _, id := range Identifiers(pdoc) {
+		got = append(got, id.Kind+" "+id.Name+" #"+id.Anchor)
+	}
+	want := []string{
+		"const MaxSize #MaxSize",
+		"func Dial #Dial",
+		"func NewReader #NewReader",
+		"type Client #Client",
+		"func NewClient #NewClient",
+		"method Client.Close #Client.Close",
+		"method Client.Do #Client.Do",
+		"type Pool #Pool",
+		"func NewPool #NewPool",
+		"method Pool.Close #Pool.Close",
+		"method Pool.Do #Pool.Do",
+		"method Pool.Get #Pool.Get",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Identifiers() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if ids := Identifiers(pdoc); ids[0].Synopsis != "Size limits." || ids[1].Synopsis != "Dial connects to the server at addr." {
+		t.Errorf("Identifiers() synopses = %q, %q", ids[0].Synopsis, ids[1].Synopsis)
+	}
+	if id, ok := ResolveAnchor(pdoc, "MaxSize"); id != "MaxSize" || !ok {
+		t.Errorf("ResolveAnchor(MaxSize) = %q, %v, want MaxSize, true", id, ok)
+	}
+}
@@ -45,7 +45,7 @@ func GetBitbucketPerson(client *http.Client, match map[string]string)(*Person, e
 	return p, nil
 }
 
-func getBitbucketDoc(client *http.Client, match map[string]string, savedEtag string) (*Package, error) {
+func getBitbucketDoc(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) (*Package, error) {
 
 	if m := bitbucketEtagRe.FindStringSubmatch(savedEtag); m != nil {
 		match["vcs"] = m[1]
@@ -69,6 +69,7 @@ func getBitbucketDoc(client *http.Client, match map[string]string, savedEtag str
 
 
 	tags := make(map[string]string)
+	var tagNames []string
 	for _, nodeType := range []string{"branches", "tags"} {
 		var nodes map[string]struct {
 			Node string
@@ -78,11 +79,23 @@ func getBitbucketDoc(client *http.Client, match map[string]string, savedEtag str
 		}
 		for t, n := range nodes {
 			tags[t] = n.Node
+			if nodeType == "tags" {
+				tagNames = append(tagNames, t)
+			}
 		}
 	}
 
-	var err error
-	match["tag"], match["commit"], err = bestTag(tags, defaultTags[match["vcs"]])
+	// The static default branch is used if the repository does not have a
+	// main branch.
+	var mainBranch struct {
+		Name string
+	}
+	err := httpGetJSON(client, expand("https://api.bitbucket.org/1.0/repositories/{owner}/{repo}/main-branch", match), &mainBranch)
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+
+	match["tag"], match["commit"], err = chooseTag(tags, mainBranch.Name, defaultTags, match["vcs"])
 	if err != nil {
 		return nil, err
 	}
@@ -120,16 +133,19 @@ func getBitbucketDoc(client *http.Client, match map[string]string, savedEtag str
 
 	b := builder{
 		pdoc: &Package{
-			LineFmt:     "%s#cl-%d",
-			ImportPath:  match["originalImportPath"],
-			ProjectRoot: expand("bitbucket.org/{owner}/{repo}", match),
-			ProjectName: match["repo"],
-			ProjectURL:  expand("https://bitbucket.org/{owner}/{repo}/", match),
-			BrowseURL:   expand("https://bitbucket.org/{owner}/{repo}/src/{tag}{dir}", match),
-			Etag:        etag,
-			VCS:         match["vcs"],
-			StarCount:   starCount,
+			LineFmt:       "%s#cl-%d",
+			ImportPath:    match["originalImportPath"],
+			ProjectRoot:   expand("bitbucket.org/{owner}/{repo}", match),
+			ProjectName:   match["repo"],
+			ProjectURL:    expand("https://bitbucket.org/{owner}/{repo}/", match),
+			BrowseURL:     expand("https://bitbucket.org/{owner}/{repo}/src/{tag}{dir}", match),
+			Etag:          etag,
+			VCS:           match["vcs"],
+			DefaultBranch: match["tag"],
+			ResolvedFrom:  resolve(match["tag"], mainBranch.Name),
+			StarCount:     starCount,
 		},
+		tags: tagNames,
 	}
 
 	return b.build(files)
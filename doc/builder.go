@@ -26,7 +26,6 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"regexp"
 	"sort"
 	"strings"
@@ -141,6 +140,30 @@ type builder struct {
 	fset     *token.FileSet
 	examples []*doc.Example
 	buf      []byte // scratch space for printNode method.
+
+	// Examples returned from getExamples.
+	shownExamples map[*doc.Example]bool
+
+	// Scope of the package-level identifiers visible to each example.
+	exampleScopes map[*doc.Example]*ast.Scope
+
+	// Number of example and test functions that reference each exported
+	// identifier. Methods are keyed by "." + name.
+	exampleUses map[string]int
+	testUses    map[string]int
+
+	// Version control tags of the repository or nil if the fetcher does
+	// not list tags.
+	tags []string
+
+	// Names of the symbolic links in the directory skipped by the fetcher.
+	symlinks []string
+
+	// Sorted names of the Go files in the documented build context.
+	names []string
+
+	// Files with syntax errors excluded from the package and the errors.
+	excluded map[string]error
 }
 
 type Value struct {
@@ -197,9 +220,16 @@ type Example struct {
 	Code   Code
 	Play   string
 	Output string
+
+	// Unordered is true if the example output comment is "Unordered output:".
+	Unordered bool
+
+	// WholeFile is true if the example is a file with its own imports and
+	// declarations. The code of a whole file example is the file.
+	WholeFile bool
 }
 
-var exampleOutputRx = regexp.MustCompile(`(?i)//[[:space:]]*output:`)
+var exampleOutputRx = regexp.MustCompile(`(?i)//[[:space:]]*(unordered[[:space:]]+)?output:`)
 
 func (b *builder) getExamples(name string) []*Example {
 	var docs []*Example
@@ -219,7 +249,8 @@ func (b *builder) getExamples(name string) []*Example {
 			n = strings.Title(n)
 		}
 
-		code, output := b.printExample(e)
+		code, output, unordered := b.printExample(e)
+		_, wholeFile := e.Code.(*ast.File)
 
 		play := ""
 		if e.Play != nil {
@@ -231,12 +262,15 @@ func (b *builder) getExamples(name string) []*Example {
 			}
 		}
 
+		b.shownExamples[e] = true
 		docs = append(docs, &Example{
-			Name:   n,
-			Doc:    e.Doc,
-			Code:   code,
-			Output: output,
-			Play:   play})
+			Name:      n,
+			Doc:       e.Doc,
+			Code:      code,
+			Output:    output,
+			Unordered: unordered,
+			WholeFile: wholeFile,
+			Play:      play})
 	}
 	return docs
 }
@@ -248,6 +282,11 @@ type Func struct {
 	Name     string
 	Recv     string
 	Examples []*Example
+
+	// Number of example and test functions in the package that reference
+	// the function.
+	ExampleUses int
+	TestUses    int
 }
 
 func (b *builder) funcs(fdocs []*doc.Func) []*Func {
@@ -262,18 +301,31 @@ func (b *builder) funcs(fdocs []*doc.Func) []*Func {
 		default:
 			exampleName = d.Recv + "_" + d.Name
 		}
+		useName := d.Name
+		if d.Recv != "" {
+			useName = "." + d.Name
+		}
 		result = append(result, &Func{
-			Decl:     b.printDecl(d.Decl),
-			Pos:      b.position(d.Decl),
-			Doc:      d.Doc,
-			Name:     d.Name,
-			Recv:     d.Recv,
-			Examples: b.getExamples(exampleName),
+			Decl:        b.printDecl(d.Decl),
+			Pos:         b.position(d.Decl),
+			Doc:         d.Doc,
+			Name:        d.Name,
+			Recv:        d.Recv,
+			Examples:    b.getExamples(exampleName),
+			ExampleUses: b.exampleUses[useName],
+			TestUses:    b.testUses[useName],
 		})
 	}
 	return result
 }
 
+// Field is an exported struct field or interface method named in a type
+// declaration.
+type Field struct {
+	Name string
+	Doc  string
+}
+
 type Type struct {
 	Doc      string
 	Name     string
@@ -284,11 +336,31 @@ type Type struct {
 	Funcs    []*Func
 	Methods  []*Func
 	Examples []*Example
+
+	// Exported struct fields or interface methods in the declaration in
+	// declaration order. The anchor of a field is the DeclAnchor of the
+	// type and field names. Fields with the name of a method of the type
+	// are omitted so that the anchors do not collide.
+	Fields []*Field
+
+	// Number of example and test functions in the package that reference
+	// the type.
+	ExampleUses int
+	TestUses    int
+
+	// Sorted canonical signatures of the exported methods of the type or
+	// nil if the method set is empty or not known. See StandardInterfaces
+	// for the format.
+	MethodSet []string
+
+	// True if the type is an interface type.
+	Interface bool
 }
 
 func (b *builder) types(tdocs []*doc.Type) []*Type {
 	var result []*Type
 	for _, d := range tdocs {
+		methodSet, isInterface := b.typeMethodSet(d)
 		result = append(result, &Type{
 			Doc:      d.Doc,
 			Name:     d.Name,
@@ -299,11 +371,63 @@ func (b *builder) types(tdocs []*doc.Type) []*Type {
 			Funcs:    b.funcs(d.Funcs),
 			Methods:  b.funcs(d.Methods),
 			Examples: b.getExamples(d.Name),
+			Fields:   typeFields(d),
+
+			ExampleUses: b.exampleUses[d.Name],
+			TestUses:    b.testUses[d.Name],
+			MethodSet:   methodSet,
+			Interface:   isInterface,
 		})
 	}
 	return result
 }
 
+// HasMethod returns true if the type has a method with the given name.
+func (t *Type) HasMethod(name string) bool {
+	for _, m := range t.Methods {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// typeFields returns the exported fields or interface methods in the
+// declaration of a type.
+func typeFields(d *doc.Type) []*Field {
+	methods := make(map[string]bool)
+	for _, m := range d.Methods {
+		methods[m.Name] = true
+	}
+	var list *ast.FieldList
+	for _, spec := range d.Decl.Specs {
+		if s, ok := spec.(*ast.TypeSpec); ok && s.Name.Name == d.Name {
+			switch t := s.Type.(type) {
+			case *ast.StructType:
+				list = t.Fields
+			case *ast.InterfaceType:
+				list = t.Methods
+			}
+		}
+	}
+	if list == nil {
+		return nil
+	}
+	var result []*Field
+	for _, f := range list.List {
+		text := f.Doc.Text()
+		if text == "" {
+			text = f.Comment.Text()
+		}
+		for _, n := range f.Names {
+			if ast.IsExported(n.Name) && !methods[n.Name] {
+				result = append(result, &Field{Name: n.Name, Doc: text})
+			}
+		}
+	}
+	return result
+}
+
 var packageNamePats = []*regexp.Regexp{
 	// Strip suffix and prefix separated by illegal id runes "." and "-".
 	regexp.MustCompile(`/([^-./]+)[-.](?:go|git)$`),
@@ -342,9 +466,47 @@ func simpleImporter(imports map[string]*ast.Object, path string) (*ast.Object, e
 	return pkg, nil
 }
 
+// addExamples adds the examples in a test file. The identifiers in the file
+// are resolved for the links in the examples, so whole-file examples link
+// through the imports of the example file. PkgScope is the scope of the
+// package for tests in the package and nil for tests in the _test package.
+func (b *builder) addExamples(name string, file *ast.File, pkgScope *ast.Scope, pkgName string) {
+	if pkgScope == nil {
+		pkgScope = ast.NewScope(nil)
+	}
+	ast.NewPackage(b.fset, map[string]*ast.File{name: file}, packageImporter(b.pdoc.ImportPath, pkgName), pkgScope)
+	for _, e := range doc.Examples(file) {
+		b.exampleScopes[e] = pkgScope
+		b.examples = append(b.examples, e)
+	}
+}
+
+// packageImporter returns an importer that uses name for the package at
+// importPath and guesses the names of the other packages.
+func packageImporter(importPath, name string) ast.Importer {
+	return func(imports map[string]*ast.Object, path string) (*ast.Object, error) {
+		if path == importPath && imports[path] == nil {
+			pkg := ast.NewObj(ast.Pkg, name)
+			pkg.Data = ast.NewScope(nil)
+			imports[path] = pkg
+		}
+		return simpleImporter(imports, path)
+	}
+}
+
 type File struct {
 	Name string
 	URL  string
+
+	// Hash of the file content reported by the repository host or "" if
+	// the host does not report hashes.
+	Hash string
+
+	// Generated is true if the file is marked as generated code.
+	Generated bool
+
+	// GoGenerate is the commands in the file's //go:generate directives.
+	GoGenerate []string
 }
 
 type Pos struct {
@@ -357,6 +519,7 @@ type source struct {
 	name      string
 	browseURL string
 	rawURL    string
+	hash      string
 	data      []byte
 	index     int
 }
@@ -372,9 +535,18 @@ func (b *builder) readDir(dir string) ([]os.FileInfo, error) {
 	if dir != "/" {
 		panic("unexpected")
 	}
-	fis := make([]os.FileInfo, 0, len(b.srcs))
-	for _, src := range b.srcs {
-		fis = append(fis, src)
+	// The files are sorted by name as in ioutil.ReadDir so that the file
+	// lists of the build package do not depend on map order.
+	names := make([]string, 0, len(b.srcs))
+	for name := range b.srcs {
+		if b.excluded[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fis := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		fis[i] = b.srcs[name]
 	}
 	return fis, nil
 }
@@ -387,7 +559,7 @@ func (b *builder) openFile(path string) (io.ReadCloser, error) {
 }
 
 // PackageVersion is modified when previously stored packages are invalid.
-const PackageVersion = "6"
+const PackageVersion = "8"
 
 type Package struct {
 	// The import path for this package.
@@ -405,12 +577,33 @@ type Package struct {
 	// Errors found when fetching or parsing this package.
 	Errors []string
 
+	// Problems found when building the documentation, sorted by file and
+	// line.
+	Diagnostics []*Diagnostic
+
 	// Packages referenced in README files.
 	References []string
 
 	// Version control system: git, hg, bzr, ...
 	VCS string
 
+	// Tag or branch documented: the go1 tag, the default branch reported by
+	// the repository host or the default branch for the VCS. The field is ""
+	// if the VCS does not have branches.
+	DefaultBranch string
+
+	// How DefaultBranch was chosen.
+	ResolvedFrom Resolution
+
+	// True if the project is fetched one directory at a time. The project
+	// page lists the subdirectories of a monorepo package instead of all
+	// packages in the project.
+	Monorepo bool
+
+	// Names of the subdirectories of the package directory. Set for
+	// monorepo packages only.
+	Subdirectories []string
+
 	// The time this object was created.
 	Updated time.Time
 
@@ -426,6 +619,24 @@ type Package struct {
 	Synopsis string
 	Doc      string
 
+	// SynopsisDerived is true if the package does not have a package
+	// comment and the synopsis was derived from the documentation of an
+	// ancestor package.
+	SynopsisDerived bool
+
+	// API stability of the package: frozen, stable, experimental,
+	// deprecated or "" if unknown, and the sentence from the package
+	// comment or the description of the version tags that gives the
+	// stability.
+	Stability         string
+	StabilityEvidence string
+
+	// Language of the package comment as detected by DetectLanguage.
+	DetectedLanguage string
+
+	// Version of Normalize last applied to the package.
+	NormalizeVersion int
+
 	// Format this package as a command.
 	IsCmd bool
 
@@ -435,6 +646,14 @@ type Package struct {
 	// Environment
 	GOOS, GOARCH string
 
+	// Documentation for the other build contexts where it differs from
+	// the documentation above. See ForContext.
+	Variants []*Package
+
+	// Keys of the declarations, examples and files of the package
+	// documentation that a variant does not have. Set on variants only.
+	Removed []string
+
 	// Top-level declarations.
 	Consts []*Value
 	Funcs  []*Func
@@ -444,6 +663,9 @@ type Package struct {
 	// Package examples
 	Examples []*Example
 
+	// Go code blocks from the README files in the package directory.
+	ReadmeExamples []*ReadmeExample
+
 	Notes map[string][]*Note
 	Bugs  []string
 
@@ -461,22 +683,63 @@ type Package struct {
 	Imports      []string
 	TestImports  []string
 	XTestImports []string
+
+	// Relative imports, as in "./util", from the package and test files.
+	// The relative imports are not included in the lists above.
+	RelativeImports []string
 	
+	// Hash of the exported API and package comment. Packages with the same
+	// fingerprint are probably copies of each other. The fingerprint is ""
+	// for small packages.
+	Fingerprint string
+
+	// Import path of the package that this package appears to be a copy
+	// of. Set by the database when the package is stored.
+	CopyOf string
+
+	// Maps imports that differ only in case from the import path of an
+	// indexed package to the path of the indexed package. Set by the
+	// database when the package is stored.
+	CanonicalImports map[string]string
+
+	// Activity of the project containing the package. Set by the database
+	// when the package is loaded. The activity is stored separately from
+	// the package because it's refreshed on a different schedule.
+	Activity *ProjectActivity
+
+	// Import paths of the major versions of the project root kept in
+	// subdirectories v2, v3 and so on, ordered by version. The project root
+	// is version 1. Set by the database when the root or a major version
+	// subdirectory is loaded and other major versions are stored.
+	MajorVersions []string
+
 	// The number of stargazers/watchers
 	StarCount int
 	// Filename and content of readme.* files
 	ReadmeFiles map[string][]byte
 }
 
-var goEnvs = []struct{ GOOS, GOARCH string }{
-	{"linux", "amd64"},
-	{"darwin", "amd64"},
-	{"windows", "amd64"},
+func (b *builder) build(srcs []*source) (*Package, error) {
+	fetched := *b.pdoc
+	pdoc, err := b.buildContexts(srcs, BuildContexts)
+	if err != nil || pdoc.Name == "" {
+		return pdoc, err
+	}
+	b.addVariants(srcs, fetched)
+	return pdoc, nil
 }
 
-func (b *builder) build(srcs []*source) (*Package, error) {
+// buildContexts builds the documentation for the first of the build
+// contexts with Go files.
+func (b *builder) buildContexts(srcs []*source, ctxts []BuildContext) (*Package, error) {
 
 	b.pdoc.Updated = time.Now().UTC()
+	if b.pdoc.ResolvedFrom.Kind != "" {
+		b.pdoc.ResolvedFrom.Resolved = b.pdoc.Updated
+	}
+
+	b.addSymlinkDiagnostics()
+	srcs = b.removeDuplicateSources(srcs)
 
 	references := make(map[string]bool)
 	b.srcs = make(map[string]*source)
@@ -509,74 +772,96 @@ func (b *builder) build(srcs []*source) (*Package, error) {
 
 	// Find the package and associated files.
 
-	ctxt := build.Context{
-		GOOS:          "linux",
-		GOARCH:        "amd64",
-		CgoEnabled:    true,
-		ReleaseTags:   build.Default.ReleaseTags,
-		JoinPath:      path.Join,
-		IsAbsPath:     path.IsAbs,
-		SplitPathList: func(list string) []string { return strings.Split(list, ":") },
-		IsDir:         func(path string) bool { panic("unexpected") },
-		HasSubdir:     func(root, dir string) (rel string, ok bool) { panic("unexpected") },
-		ReadDir:       func(dir string) (fi []os.FileInfo, err error) { return b.readDir(dir) },
-		OpenFile:      func(path string) (r io.ReadCloser, err error) { return b.openFile(path) },
-		Compiler:      "gc",
-	}
-
 	var err error
 	var bpkg *build.Package
+	var ctxt *build.Context
 
-	for _, env := range goEnvs {
-		ctxt.GOOS = env.GOOS
-		ctxt.GOARCH = env.GOARCH
-		bpkg, err = ctxt.ImportDir("/", 0)
+	for _, c := range ctxts {
+		ctxt = b.buildContext(c)
+		bpkg, err = b.importDir(ctxt)
 		if _, ok := err.(*build.NoGoError); !ok {
 			break
 		}
 	}
+	b.addExcludedErrors()
+	if _, ok := err.(*build.NoGoError); ok && hasIgnoredGoFiles(bpkg) {
+		err = errNoBuildableGoFiles
+	}
 	if err != nil {
 		if _, ok := err.(*build.NoGoError); !ok {
 			b.pdoc.Errors = append(b.pdoc.Errors, err.Error())
+			b.addBuildDiagnostics(bpkg, err, ctxt)
 		}
+		sortDiagnostics(b.pdoc.Diagnostics)
 		return b.pdoc, nil
 	}
 
+	b.addBuildDiagnostics(bpkg, nil, ctxt)
+
 	// Parse the Go files
 
 	files := make(map[string]*ast.File)
 	names := append(bpkg.GoFiles, bpkg.CgoFiles...)
 	sort.Strings(names)
-	b.pdoc.Files = make([]*File, len(names))
-	for i, name := range names {
+	b.names = names
+	b.pdoc.Files = make([]*File, 0, len(names))
+	for _, name := range names {
 		file, err := parser.ParseFile(b.fset, name, b.srcs[name].data, parser.ParseComments)
 		if err != nil {
 			b.pdoc.Errors = append(b.pdoc.Errors, err.Error())
+			b.addParseErrorDiagnostics(name, err)
 			continue
 		}
 		src := b.srcs[name]
-		src.index = i
-		b.pdoc.Files[i] = &File{Name: name, URL: src.browseURL}
+		src.index = len(b.pdoc.Files)
+		b.pdoc.Files = append(b.pdoc.Files, &File{
+			Name:       name,
+			URL:        src.browseURL,
+			Hash:       src.hash,
+			Generated:  isGenerated(file),
+			GoGenerate: goGenerateCommands(file),
+		})
 		b.pdoc.SourceSize += len(src.data)
 		files[name] = file
 	}
 
 	apkg, _ := ast.NewPackage(b.fset, files, simpleImporter, nil)
 
-	// Find examples in the test files.
+	// Find examples and uses of the package API in the test files.
+
+	xtest := make(map[string]bool)
+	for _, name := range bpkg.XTestGoFiles {
+		xtest[name] = true
+	}
+	b.exampleUses = make(map[string]int)
+	b.testUses = make(map[string]int)
+	b.shownExamples = make(map[*doc.Example]bool)
+	b.exampleScopes = make(map[*doc.Example]*ast.Scope)
 
 	names = append(bpkg.TestGoFiles, bpkg.XTestGoFiles...)
 	sort.Strings(names)
-	b.pdoc.TestFiles = make([]*File, len(names))
-	for i, name := range names {
+	b.pdoc.TestFiles = make([]*File, 0, len(names))
+	for _, name := range names {
 		file, err := parser.ParseFile(b.fset, name, b.srcs[name].data, parser.ParseComments)
 		if err != nil {
 			b.pdoc.Errors = append(b.pdoc.Errors, err.Error())
+			b.addParseErrorDiagnostics(name, err)
 			continue
 		}
-		b.pdoc.TestFiles[i] = &File{Name: name, URL: b.srcs[name].browseURL}
+		b.pdoc.TestFiles = append(b.pdoc.TestFiles, &File{
+			Name:       name,
+			URL:        b.srcs[name].browseURL,
+			Hash:       b.srcs[name].hash,
+			Generated:  isGenerated(file),
+			GoGenerate: goGenerateCommands(file),
+		})
 		b.pdoc.TestSourceSize += len(b.srcs[name].data)
-		b.examples = append(b.examples, doc.Examples(file)...)
+		pkgScope := apkg.Scope
+		if xtest[name] {
+			pkgScope = nil
+		}
+		b.addExamples(name, file, pkgScope, bpkg.Name)
+		b.countUses(file, b.srcs[name].data, xtest[name], bpkg.Name)
 	}
 
 	b.vetPackage(apkg)
@@ -593,6 +878,7 @@ func (b *builder) build(srcs []*source) (*Package, error) {
 	b.pdoc.Synopsis = synopsis(b.pdoc.Doc)
 
 	b.pdoc.Examples = b.getExamples("")
+	b.pdoc.ReadmeExamples = b.readmeExamples()
 	b.pdoc.IsCmd = bpkg.IsCommand()
 	b.pdoc.GOOS = ctxt.GOOS
 	b.pdoc.GOARCH = ctxt.GOARCH
@@ -602,10 +888,19 @@ func (b *builder) build(srcs []*source) (*Package, error) {
 	b.pdoc.Types = b.types(dpkg.Types)
 	b.pdoc.Vars = b.values(dpkg.Vars)
 	b.pdoc.Notes = b.notes(dpkg.Notes)
+	b.removeDuplicateDecls()
+	Normalize(b.pdoc)
+	b.pdoc.Fingerprint = fingerprint(b.pdoc)
+
+	b.addExampleDiagnostics()
+	if b.pdoc.Doc == "" {
+		b.addDiagnostic(DiagnosticNoPackageDoc, SeverityInfo, token.Position{}, "Package "+b.pdoc.Name+" does not have a package comment.")
+	}
+	b.setStability()
+	b.pdoc.DetectedLanguage = DetectLanguage(b.pdoc.Doc)
+	sortDiagnostics(b.pdoc.Diagnostics)
 
-	b.pdoc.Imports = bpkg.Imports
-	b.pdoc.TestImports = bpkg.TestImports
-	b.pdoc.XTestImports = bpkg.XTestImports
+	b.setImports(bpkg)
 
 	return b.pdoc, nil
 }
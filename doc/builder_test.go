@@ -16,6 +16,11 @@ package doc
 
 import (
 	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -95,3 +100,306 @@ func TestSimpleImporter(t *testing.T) {
 		}
 	}
 }
+
+var splitExampleOutputTests = []struct {
+	in        string
+	code      string
+	output    string
+	unordered bool
+}{
+	{"fmt.Println(1)", "fmt.Println(1)", "", false},
+	{"fmt.Println(1)\n// Output: 1\n", "fmt.Println(1)", "1", false},
+	{"fmt.Println(1)\nfmt.Println(2)\n// Output:\n// 1\n// 2\n", "fmt.Println(1)\nfmt.Println(2)", "1\n2", false},
+	{"fmt.Println(m)\n// output:\n//   indented\n", "fmt.Println(m)", "indented", false},
+	{"for k := range m {\n    fmt.Println(k)\n}\n// Unordered output:\n// a\n// b\n", "for k := range m {\n    fmt.Println(k)\n}", "a\nb", true},
+	{"fmt.Println(\"a \")\n// Output: \n// a   \n//\t\n// b\t\n\n", "fmt.Println(\"a \")", "a\n\nb", false},
+}
+
+func TestSplitExampleOutput(t *testing.T) {
+	for _, tt := range splitExampleOutputTests {
+		code, output, unordered := splitExampleOutput([]byte(tt.in))
+		if string(code) != tt.code || output != tt.output || unordered != tt.unordered {
+			t.Errorf("splitExampleOutput(%q) = %q, %q, %v; want %q, %q, %v",
+				tt.in, code, output, unordered, tt.code, tt.output, tt.unordered)
+		}
+	}
+}
+
+var cutExampleOutputTests = []struct {
+	in        string
+	code      string
+	output    string
+	unordered bool
+}{
+	{"package main\n\nfunc main() {\n}\n", "package main\n\nfunc main() {\n}\n", "", false},
+	{"package main\n\nfunc main() {\n    f()\n    // Output:\n    // 1\n    // 2\n}\n\nfunc f() {}\n", "package main\n\nfunc main() {\n    f()\n}\n\nfunc f() {}\n", "1\n2", false},
+	{"func main() {\n    f()\n    // Unordered output: a\n    // b\n}", "func main() {\n    f()\n}", "a\nb", true},
+	{"func main() {\n    f() // Output: 1\n}\n", "func main() {\n    f() // Output: 1\n}\n", "", false},
+}
+
+func TestCutExampleOutput(t *testing.T) {
+	for _, tt := range cutExampleOutputTests {
+		code, output, unordered := cutExampleOutput([]byte(tt.in))
+		if string(code) != tt.code || output != tt.output || unordered != tt.unordered {
+			t.Errorf("cutExampleOutput(%q) = %q, %q, %v; want %q, %q, %v",
+				tt.in, code, output, unordered, tt.code, tt.output, tt.unordered)
+		}
+	}
+}
+
+var exampleLinksSrcs = []struct {
+	name  string
+	src   string
+	xtest bool
+}{
+	{"example_test.go", `package widget_test
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/widget"
+)
+
+func ExampleNew() {
+	// Make a widget.
+	var w *widget.Widget = widget.New()
+	type Local struct{ Name string }
+	fmt.Println(strings.ToUpper("w"), w, Local{})
+	// Output: W <nil> {}
+}
+`, true},
+	{"internal_test.go", `package widget
+
+import "os"
+
+func ExampleWidget() {
+	var w Widget
+	Exported := New()
+	os.Exit(len([]*Widget{&w, Exported}))
+}
+`, false},
+	{"whole_test.go", `package widget_test
+
+import (
+	"fmt"
+	str "strings"
+
+	"example.com/widget"
+)
+
+var Sep = ","
+
+func Example_whole() {
+	fmt.Println(str.Join([]string{"a"}, Sep), widget.New())
+}
+`, true},
+}
+
+// exampleLinks returns the links in code as target and text pairs.
+func exampleLinks(code Code) []string {
+	var links []string
+	for _, a := range code.Annotations {
+		switch a.Kind {
+		case ExportLinkAnnotation, PackageLinkAnnotation:
+			target := ""
+			if a.PathIndex >= 0 {
+				target = code.Paths[a.PathIndex]
+			}
+			links = append(links, target+" "+code.Text[a.Pos:a.End])
+		case AnchorAnnotation:
+			links = append(links, "anchor "+code.Text[a.Pos:a.End])
+		}
+	}
+	return links
+}
+
+func TestExampleLinks(t *testing.T) {
+	b := &builder{
+		pdoc:          &Package{ImportPath: "example.com/widget"},
+		fset:          token.NewFileSet(),
+		shownExamples: make(map[*doc.Example]bool),
+		exampleScopes: make(map[*doc.Example]*ast.Scope),
+	}
+	file, err := parser.ParseFile(b.fset, "widget.go", "package widget\n\ntype Widget struct{}\n\nfunc New() *Widget { return nil }\n", parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apkg, _ := ast.NewPackage(b.fset, map[string]*ast.File{"widget.go": file}, simpleImporter, nil)
+	for _, tt := range exampleLinksSrcs {
+		testFile, err := parser.ParseFile(b.fset, tt.name, tt.src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkgScope := apkg.Scope
+		if tt.xtest {
+			pkgScope = nil
+		}
+		b.addExamples(tt.name, testFile, pkgScope, "widget")
+	}
+	dpkg := doc.New(apkg, b.pdoc.ImportPath, 0)
+	b.pdoc.Examples = b.getExamples("")
+	b.pdoc.Types = b.types(dpkg.Types)
+
+	examples := map[string]*Example{}
+	for _, e := range b.pdoc.Examples {
+		examples["package "+e.Name] = e
+	}
+	for _, typ := range b.pdoc.Types {
+		for _, e := range typ.Examples {
+			examples[typ.Name] = e
+		}
+		for _, f := range typ.Funcs {
+			for _, e := range f.Examples {
+				examples[f.Name] = e
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		links []string
+	}{
+		// Links to the package through the import, other packages and
+		// not to the local type.
+		{"New", []string{
+			"example.com/widget widget.Widget",
+			"example.com/widget widget.New",
+			"fmt fmt.Println",
+			"strings strings.ToUpper",
+		}},
+		// Links to the declarations of the package in a test in the
+		// package and not to the local variable.
+		{"Widget", []string{
+			" Widget",
+			" New",
+			"os os.Exit",
+			" Widget",
+		}},
+		// The imports of the example file, including renamed imports.
+		{"package Whole", []string{
+			"fmt fmt.Println",
+			"strings str.Join",
+			"example.com/widget widget.New",
+		}},
+	} {
+		e := examples[tt.name]
+		if e == nil {
+			t.Errorf("example %q not found", tt.name)
+			continue
+		}
+		if links := exampleLinks(e.Code); !reflect.DeepEqual(links, tt.links) {
+			t.Errorf("example %q links = %q, want %q", tt.name, links, tt.links)
+		}
+	}
+
+	// The output comment is moved to the output and the positions of the
+	// annotations are in the code without the comment.
+	e := examples["New"]
+	if e == nil {
+		return
+	}
+	if e.Output != "W <nil> {}" {
+		t.Errorf("output = %q, want %q", e.Output, "W <nil> {}")
+	}
+	if a := e.Code.Annotations[0]; a.Kind != CommentAnnotation || e.Code.Text[a.Pos:a.End] != "// Make a widget." {
+		t.Errorf("first annotation = %+v, want comment", a)
+	}
+	if last := e.Code.Annotations[len(e.Code.Annotations)-1]; int(last.End) > len(e.Code.Text) {
+		t.Errorf("annotation %+v is past the end of the code", last)
+	}
+}
+
+const typeFieldsSrc = `package widget
+
+// Client is a client.
+type Client struct {
+	// Timeout is the request timeout.
+	Timeout int
+	Name, label string
+	retries int
+	Close   bool
+}
+
+func (c *Client) Close() error { return nil }
+
+type Handler interface {
+	Serve() // Serve serves.
+	reset()
+}
+`
+
+func TestTypeFields(t *testing.T) {
+	pdoc := diffTestPackage(t, typeFieldsSrc, "1")
+	want := map[string][]Field{
+		"Client":  {{"Timeout", "Timeout is the request timeout.\n"}, {"Name", ""}},
+		"Handler": {{"Serve", "Serve serves.\n"}},
+	}
+	for _, typ := range pdoc.Types {
+		var fields []Field
+		for _, f := range typ.Fields {
+			fields = append(fields, *f)
+		}
+		if !reflect.DeepEqual(fields, want[typ.Name]) {
+			t.Errorf("%s fields = %v, want %v", typ.Name, fields, want[typ.Name])
+		}
+	}
+}
+
+func TestFieldAnchors(t *testing.T) {
+	b := &builder{fset: token.NewFileSet()}
+	file, err := parser.ParseFile(b.fset, "widget.go", typeFieldsSrc, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The declaration is printed with the unexported fields.
+	got := exampleLinks(b.printDecl(file.Decls[0]))
+	want := []string{"anchor Timeout", "anchor Name", "anchor Close"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("anchors = %q, want %q", got, want)
+	}
+}
+
+func TestWholeFileExample(t *testing.T) {
+	b := &builder{
+		pdoc:          &Package{ImportPath: "example.com/widget"},
+		fset:          token.NewFileSet(),
+		shownExamples: make(map[*doc.Example]bool),
+		exampleScopes: make(map[*doc.Example]*ast.Scope),
+	}
+	const src = `package widget_test
+
+import "fmt"
+
+type greeter struct{}
+
+func (greeter) greet() { fmt.Println("hello") }
+
+func Example() {
+	greeter{}.greet()
+	// Output: hello
+}
+`
+	file, err := parser.ParseFile(b.fset, "whole_test.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.addExamples("whole_test.go", file, nil, "widget")
+	examples := b.getExamples("")
+	if len(examples) != 1 {
+		t.Fatalf("got %d examples, want 1", len(examples))
+	}
+	e := examples[0]
+	if !e.WholeFile {
+		t.Error("example is not a whole file example")
+	}
+	if e.Output != "hello" || e.Unordered {
+		t.Errorf("output = %q, %v, want hello", e.Output, e.Unordered)
+	}
+	if strings.Contains(e.Code.Text, "Output:") || !strings.Contains(e.Code.Text, "type greeter struct{}") {
+		t.Errorf("code = %q, want file without output comment", e.Code.Text)
+	}
+	if !strings.HasPrefix(e.Play, "package main\n") || !strings.Contains(e.Play, `import "fmt"`) {
+		t.Errorf("play = %q, want complete program", e.Play)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"strings"
+	"sync"
+)
+
+var caseInsensitiveHosts = struct {
+	sync.Mutex
+	m map[string]bool
+}{}
+
+// SetCaseInsensitiveHosts sets the repository hosts where owner and
+// repository names are not case-sensitive.
+func SetCaseInsensitiveHosts(hosts []string) {
+	m := make(map[string]bool)
+	for _, host := range hosts {
+		m[host] = true
+	}
+	caseInsensitiveHosts.Lock()
+	caseInsensitiveHosts.m = m
+	caseInsensitiveHosts.Unlock()
+}
+
+// FoldImportPath returns the key used to compare import paths on hosts where
+// owner and repository names are not case-sensitive. The host, owner and
+// repository elements of the path are converted to lower case; the
+// directories in the repository are case-sensitive. FoldImportPath returns ""
+// for import paths on other hosts.
+func FoldImportPath(importPath string) string {
+	parts := strings.SplitN(importPath, "/", 4)
+	caseInsensitiveHosts.Lock()
+	ok := caseInsensitiveHosts.m[parts[0]]
+	caseInsensitiveHosts.Unlock()
+	if !ok {
+		return ""
+	}
+	for i := 0; i < len(parts) && i < 3; i++ {
+		parts[i] = strings.ToLower(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// CanonicalPathError is returned by Get when the repository host reports
+// that the import path differs in case from the path of the repository.
+type CanonicalPathError struct {
+	// Import path with the case reported by the repository host.
+	ImportPath string
+}
+
+func (e CanonicalPathError) Error() string {
+	return "import path has incorrect case, use " + e.ImportPath
+}
@@ -0,0 +1,91 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"testing"
+)
+
+var foldImportPathTests = []struct {
+	path, fold string
+}{
+	{"github.com/User/Repo", "github.com/user/repo"},
+	{"github.com/User/Repo/Sub/Dir", "github.com/user/repo/Sub/Dir"},
+	{"github.com/User", "github.com/user"},
+	{"example.com/User/Repo", ""},
+	{"fmt", ""},
+}
+
+func TestFoldImportPath(t *testing.T) {
+	defer SetCaseInsensitiveHosts(nil)
+	SetCaseInsensitiveHosts([]string{"github.com"})
+	for _, tt := range foldImportPathTests {
+		if fold := FoldImportPath(tt.path); fold != tt.fold {
+			t.Errorf("FoldImportPath(%q) = %q, want %q", tt.path, fold, tt.fold)
+		}
+	}
+}
+
+// githubCaseFixtures are responses from the GitHub API for the repository
+// Owner/Repo requested as owner/repo.
+var githubCaseFixtures = map[string]string{
+	"/repos/owner/repo":             `{"watchers": 7, "default_branch": "main", "full_name": "Owner/Repo"}`,
+	"/repos/owner/repo/git/refs":    githubFixtures["/repos/owner/repo/git/refs"],
+	"/repos/Owner/Repo":             `{"watchers": 7, "default_branch": "main", "full_name": "Owner/Repo"}`,
+	"/repos/Owner/Repo/git/refs":    githubFixtures["/repos/owner/repo/git/refs"],
+	"/repos/owner/renamed":          `{"watchers": 7, "default_branch": "main", "full_name": "owner/other"}`,
+	"/repos/owner/renamed/git/refs": githubFixtures["/repos/owner/repo/git/refs"],
+}
+
+func TestGithubCanonicalPath(t *testing.T) {
+	defer SetCaseInsensitiveHosts(nil)
+	client, done := newGithubTestClient(githubCaseFixtures)
+	defer done()
+
+	// GitHub is not known to be case-insensitive.
+	match := map[string]string{"owner": "owner", "repo": "repo", "dir": "/sub"}
+	if _, _, err := getGithubTag(client, match, "", newDefaultTags()); err != nil {
+		t.Errorf("getGithubTag() for case-sensitive host returned error %v", err)
+	}
+
+	SetCaseInsensitiveHosts([]string{"github.com"})
+	match = map[string]string{"owner": "owner", "repo": "repo", "dir": "/sub"}
+	_, _, err := getGithubTag(client, match, "", newDefaultTags())
+	if e, ok := err.(CanonicalPathError); !ok || e.ImportPath != "github.com/Owner/Repo/sub" {
+		t.Errorf("getGithubTag() returned %v, want CanonicalPathError for github.com/Owner/Repo/sub", err)
+	}
+
+	// The case is checked before the commit of an unchanged repository.
+	for _, ref := range []string{"", "v1.0.0"} {
+		match = map[string]string{"owner": "owner", "repo": "repo", "dir": ""}
+		defaultTags := newDefaultTags()
+		defaultTags[refKey] = ref
+		_, _, err = getGithubTag(client, match, "1111111111111111111111111111111111111111", defaultTags)
+		if _, ok := err.(CanonicalPathError); !ok {
+			t.Errorf("getGithubTag(ref %q) for unchanged repository returned %v, want CanonicalPathError", ref, err)
+		}
+	}
+
+	match = map[string]string{"owner": "Owner", "repo": "Repo", "dir": ""}
+	if _, _, err := getGithubTag(client, match, "", newDefaultTags()); err != nil {
+		t.Errorf("getGithubTag() with correct case returned error %v", err)
+	}
+
+	// A renamed repository is not a case mismatch.
+	match = map[string]string{"owner": "owner", "repo": "renamed", "dir": ""}
+	if _, _, err := getGithubTag(client, match, "", newDefaultTags()); err != nil {
+		t.Errorf("getGithubTag() for renamed repository returned error %v", err)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"go/token"
 	"math"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -115,6 +116,11 @@ type annotationVisitor struct {
 	annotations []Annotation
 	paths       []string
 	pathIndex   map[string]int
+
+	// If pkgScope is not nil, identifiers are linked as exports of the
+	// documented package only if they are declared in pkgScope. Examples
+	// set pkgScope to skip exported names declared in the example.
+	pkgScope *ast.Scope
 }
 
 func (v *annotationVisitor) add(kind AnnotationKind, importPath string) {
@@ -150,8 +156,12 @@ func (v *annotationVisitor) Visit(n ast.Node) ast.Visitor {
 			ast.Walk(v, n.Type)
 		} else {
 			for _, f := range list.List {
-				for _ = range f.Names {
-					v.add(AnchorAnnotation, "")
+				for _, name := range f.Names {
+					if ast.IsExported(name.Name) {
+						v.add(AnchorAnnotation, "")
+					} else {
+						v.ignoreName()
+					}
 				}
 				ast.Walk(v, f.Type)
 			}
@@ -162,6 +172,11 @@ func (v *annotationVisitor) Visit(n ast.Node) ast.Visitor {
 		}
 		v.ignoreName()
 		ast.Walk(v, n.Type)
+		if n.Body != nil {
+			// Declarations are printed without bodies. Bodies are
+			// printed for examples.
+			ast.Walk(v, n.Body)
+		}
 	case *ast.Field:
 		for _ = range n.Names {
 			v.ignoreName()
@@ -181,7 +196,7 @@ func (v *annotationVisitor) Visit(n ast.Node) ast.Visitor {
 		switch {
 		case n.Obj == nil && predeclared[n.Name] != notPredeclared:
 			v.add(BuiltinAnnotation, "")
-		case n.Obj != nil && ast.IsExported(n.Name):
+		case n.Obj != nil && ast.IsExported(n.Name) && (v.pkgScope == nil || v.pkgScope.Lookup(n.Name) == n.Obj):
 			v.add(ExportLinkAnnotation, "")
 		default:
 			v.ignoreName()
@@ -191,10 +206,16 @@ func (v *annotationVisitor) Visit(n ast.Node) ast.Visitor {
 			if obj := x.Obj; obj != nil && obj.Kind == ast.Pkg {
 				if spec, _ := obj.Decl.(*ast.ImportSpec); spec != nil {
 					if path, err := strconv.Unquote(spec.Path.Value); err == nil {
-						v.add(PackageLinkAnnotation, path)
-						if path == "C" {
+						switch {
+						case IsRelativeImport(path):
+							// There is no page to link to.
+							v.ignoreName()
 							v.ignoreName()
-						} else {
+						case path == "C":
+							v.add(PackageLinkAnnotation, path)
+							v.ignoreName()
+						default:
+							v.add(PackageLinkAnnotation, path)
 							v.add(ExportLinkAnnotation, path)
 						}
 						return nil
@@ -218,12 +239,17 @@ func (b *builder) printDecl(decl ast.Decl) (d Code) {
 	if err != nil {
 		return Code{Text: err.Error()}
 	}
+	return Code{Text: string(b.buf), Annotations: v.annotate(b.buf), Paths: v.paths}
+}
 
+// annotate matches the identifiers in the printed source to the annotations
+// collected by the visitor and returns the annotations with positions.
+func (v *annotationVisitor) annotate(src []byte) []Annotation {
 	var annotations []Annotation
 	var s scanner.Scanner
 	fset := token.NewFileSet()
-	file := fset.AddFile("", fset.Base(), len(b.buf))
-	s.Init(file, b.buf, nil, scanner.ScanComments)
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, src, nil, scanner.ScanComments)
 loop:
 	for {
 		pos, tok, lit := s.Scan()
@@ -262,7 +288,7 @@ loop:
 			annotations = append(annotations, annotation)
 		}
 	}
-	return Code{Text: string(b.buf), Annotations: annotations, Paths: v.paths}
+	return annotations
 }
 
 func (b *builder) position(n ast.Node) Pos {
@@ -283,9 +309,66 @@ func (b *builder) position(n ast.Node) Pos {
 	return position
 }
 
-func (b *builder) printExample(e *doc.Example) (code Code, output string) {
+// splitExampleOutput splits a formatted example function body into the code
+// and the expected output from the trailing output comment. Comment markers
+// and trailing white space are removed from the lines of the output.
+func splitExampleOutput(p []byte) (code []byte, output string, unordered bool) {
+	m := exampleOutputRx.FindSubmatchIndex(p)
+	if m == nil {
+		return p, "", false
+	}
+	lines := strings.Split(string(p[m[1]:]), "\n")
+	for i, line := range lines {
+		if i > 0 {
+			line = strings.TrimLeft(line, " \t")
+			line = strings.TrimPrefix(line, "//")
+			line = strings.TrimPrefix(line, " ")
+		}
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return bytes.TrimSpace(p[:m[0]]), strings.TrimSpace(strings.Join(lines, "\n")), m[2] >= 0
+}
+
+// cutExampleOutput removes the output comment from a formatted whole file
+// example and returns the expected output. The output comment is the line
+// with the output marker and the comment lines that follow it.
+func cutExampleOutput(p []byte) (code []byte, output string, unordered bool) {
+	m := exampleOutputRx.FindIndex(p)
+	if m == nil {
+		return p, "", false
+	}
+	start := bytes.LastIndex(p[:m[0]], []byte("\n")) + 1
+	if len(bytes.TrimSpace(p[start:m[0]])) != 0 {
+		// The marker follows code on the line.
+		return p, "", false
+	}
+	end := start
+	for end < len(p) {
+		n := bytes.IndexByte(p[end:], '\n') + 1
+		if n == 0 {
+			n = len(p) - end
+		}
+		if !bytes.HasPrefix(bytes.TrimLeft(p[end:end+n], " \t"), []byte("//")) {
+			break
+		}
+		end += n
+	}
+	_, output, unordered = splitExampleOutput(p[start:end])
+	code = append(append([]byte(nil), p[:start]...), p[end:]...)
+	return code, output, unordered
+}
+
+// printExample formats an example. The identifiers in the example are
+// linked to the documentation of the packages that declare them.
+func (b *builder) printExample(e *doc.Example) (code Code, output string, unordered bool) {
 	output = e.Output
 
+	v := &annotationVisitor{pathIndex: make(map[string]int), pkgScope: b.exampleScopes[e]}
+	if v.pkgScope == nil {
+		v.pkgScope = ast.NewScope(nil)
+	}
+	ast.Walk(v, e.Code)
+
 	b.buf = b.buf[:0]
 	err := (&printer.Config{Mode: printer.UseSpaces, Tabwidth: 4}).Fprint(
 		sliceWriter{&b.buf},
@@ -295,7 +378,7 @@ func (b *builder) printExample(e *doc.Example) (code Code, output string) {
 			Comments: e.Comments,
 		})
 	if err != nil {
-		return Code{Text: err.Error()}, output
+		return Code{Text: err.Error()}, output, false
 	}
 
 	// additional formatting if this is a function body
@@ -304,20 +387,39 @@ func (b *builder) printExample(e *doc.Example) (code Code, output string) {
 		b.buf = b.buf[1 : i-1]
 		// unindent
 		b.buf = bytes.Replace(b.buf, []byte("\n    "), []byte("\n"), -1)
-		// remove output comment
-		if j := exampleOutputRx.FindIndex(b.buf); j != nil {
-			b.buf = bytes.TrimSpace(b.buf[:j[0]])
+		// move output comment to output
+		var o string
+		b.buf, o, unordered = splitExampleOutput(b.buf)
+		if o != "" {
+			output = o
 		}
+	} else if _, ok := e.Code.(*ast.File); ok {
+		// move output comment of whole file example to output
+		b.buf, output, unordered = cutExampleOutput(b.buf)
 	} else {
 		// drop output, as the output comment will appear in the code
 		output = ""
 	}
 
+	// The annotations are matched to the identifiers after the output
+	// comment is removed, so the positions are relative to the final text.
+	// Anchors for declarations in the example are dropped.
+	var annotations []Annotation
+	for _, a := range v.annotate(b.buf) {
+		if a.Kind != AnchorAnnotation {
+			annotations = append(annotations, a)
+		}
+	}
+	return Code{Text: string(b.buf), Annotations: annotations, Paths: v.paths}, output, unordered
+}
+
+// commentAnnotations returns annotations for the comments in src.
+func commentAnnotations(src []byte) []Annotation {
 	var annotations []Annotation
 	var s scanner.Scanner
 	fset := token.NewFileSet()
-	file := fset.AddFile("", fset.Base(), len(b.buf))
-	s.Init(file, b.buf, nil, scanner.ScanComments)
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, src, nil, scanner.ScanComments)
 scanLoop:
 	for {
 		pos, tok, lit := s.Scan()
@@ -330,6 +432,5 @@ scanLoop:
 			annotations = append(annotations, Annotation{Kind: CommentAnnotation, Pos: int32(p), End: int32(e)})
 		}
 	}
-
-	return Code{Text: string(b.buf), Annotations: annotations}, output
+	return annotations
 }
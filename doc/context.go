@@ -0,0 +1,370 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"errors"
+	"go/build"
+	"go/scanner"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// BuildContext is an operating system and architecture for which the
+// documentation of a package is built.
+type BuildContext struct {
+	GOOS, GOARCH string
+}
+
+func (c BuildContext) String() string {
+	return c.GOOS + "/" + c.GOARCH
+}
+
+// BuildContexts are the contexts for which documentation is built, in order
+// of preference. The package documentation is for the first context with Go
+// files. The documentation for the other contexts is stored in
+// Package.Variants when it differs. A variant stores only the declarations,
+// examples and files that differ from the package documentation.
+var BuildContexts = []BuildContext{
+	{"linux", "amd64"},
+	{"darwin", "amd64"},
+	{"windows", "amd64"},
+}
+
+// Context returns the build context of the documentation.
+func (pdoc *Package) Context() BuildContext {
+	return BuildContext{pdoc.GOOS, pdoc.GOARCH}
+}
+
+// Contexts returns the build contexts with documentation for the package in
+// the order of BuildContexts. Nil is returned if the documentation is the
+// same for all contexts.
+func (pdoc *Package) Contexts() []BuildContext {
+	if len(pdoc.Variants) == 0 {
+		return nil
+	}
+	have := map[BuildContext]bool{pdoc.Context(): true}
+	for _, v := range pdoc.Variants {
+		have[v.Context()] = true
+	}
+	var result []BuildContext
+	for _, c := range BuildContexts {
+		if have[c] {
+			result = append(result, c)
+			delete(have, c)
+		}
+	}
+	for c := range have {
+		result = append(result, c)
+	}
+	return result
+}
+
+// ForContext returns the documentation of the package for the build
+// context. The documentation of a variant is returned as a copy of pdoc with
+// the fields of the variant. The variants of the copy are the other contexts
+// of the package.
+func (pdoc *Package) ForContext(c BuildContext) (*Package, bool) {
+	if c == pdoc.Context() {
+		return pdoc, true
+	}
+	for i, v := range pdoc.Variants {
+		if v.Context() != c {
+			continue
+		}
+		v = expandVariant(pdoc, v)
+		p := *pdoc
+		p.Errors = v.Errors
+		p.Diagnostics = v.Diagnostics
+		p.Name = v.Name
+		p.Synopsis = v.Synopsis
+		p.Doc = v.Doc
+		p.IsCmd = v.IsCmd
+		p.GOOS = v.GOOS
+		p.GOARCH = v.GOARCH
+		p.Consts = v.Consts
+		p.Funcs = v.Funcs
+		p.Types = v.Types
+		p.Vars = v.Vars
+		p.Examples = v.Examples
+		p.Notes = v.Notes
+		p.Bugs = v.Bugs
+		p.Files = v.Files
+		p.TestFiles = v.TestFiles
+		p.SourceSize = v.SourceSize
+		p.TestSourceSize = v.TestSourceSize
+		p.Imports = v.Imports
+		p.TestImports = v.TestImports
+		p.XTestImports = v.XTestImports
+		p.RelativeImports = v.RelativeImports
+		p.Variants = []*Package{variantDelta(&p, variant(pdoc))}
+		for j, other := range pdoc.Variants {
+			if j != i {
+				p.Variants = append(p.Variants, variantDelta(&p, expandVariant(pdoc, other)))
+			}
+		}
+		return &p, true
+	}
+	return nil, false
+}
+
+// variant returns the fields of pdoc that depend on the build context.
+func variant(pdoc *Package) *Package {
+	return &Package{
+		Errors:          pdoc.Errors,
+		Diagnostics:     pdoc.Diagnostics,
+		Name:            pdoc.Name,
+		Synopsis:        pdoc.Synopsis,
+		Doc:             pdoc.Doc,
+		IsCmd:           pdoc.IsCmd,
+		GOOS:            pdoc.GOOS,
+		GOARCH:          pdoc.GOARCH,
+		Consts:          pdoc.Consts,
+		Funcs:           pdoc.Funcs,
+		Types:           pdoc.Types,
+		Vars:            pdoc.Vars,
+		Examples:        pdoc.Examples,
+		Notes:           pdoc.Notes,
+		Bugs:            pdoc.Bugs,
+		Files:           pdoc.Files,
+		TestFiles:       pdoc.TestFiles,
+		SourceSize:      pdoc.SourceSize,
+		TestSourceSize:  pdoc.TestSourceSize,
+		Imports:         pdoc.Imports,
+		TestImports:     pdoc.TestImports,
+		XTestImports:    pdoc.XTestImports,
+		RelativeImports: pdoc.RelativeImports,
+	}
+}
+
+// variantLists are the lists of a variant that are stored as the
+// differences from the package documentation. The key function returns the
+// key of an element of the list.
+var variantLists = []struct {
+	field string
+	key   func(v reflect.Value) string
+}{
+	{"Consts", valueKey},
+	{"Vars", valueKey},
+	{"Funcs", nameKey},
+	{"Types", nameKey},
+	{"Examples", nameKey},
+	{"Files", nameKey},
+	{"TestFiles", nameKey},
+}
+
+func valueKey(v reflect.Value) string { return v.Interface().(*Value).Decl.Text }
+func nameKey(v reflect.Value) string  { return v.Elem().FieldByName("Name").String() }
+
+// variantDelta returns the variant v with the lists in variantLists reduced
+// to the elements that are not in pdoc. The keys of the elements of pdoc
+// that v does not have are stored in Removed.
+func variantDelta(pdoc, v *Package) *Package {
+	d := *v
+	for _, l := range variantLists {
+		base := reflect.ValueOf(pdoc).Elem().FieldByName(l.field)
+		list := reflect.ValueOf(v).Elem().FieldByName(l.field)
+		have := make(map[string]reflect.Value)
+		for i := 0; i < base.Len(); i++ {
+			have[l.key(base.Index(i))] = base.Index(i)
+		}
+		delta := reflect.Zero(list.Type())
+		keep := make(map[string]bool)
+		for i := 0; i < list.Len(); i++ {
+			e := list.Index(i)
+			k := l.key(e)
+			keep[k] = true
+			if b, ok := have[k]; ok && reflect.DeepEqual(b.Interface(), e.Interface()) {
+				continue
+			}
+			delta = reflect.Append(delta, e)
+		}
+		for i := 0; i < base.Len(); i++ {
+			if k := l.key(base.Index(i)); !keep[k] {
+				d.Removed = append(d.Removed, l.field+":"+k)
+			}
+		}
+		reflect.ValueOf(&d).Elem().FieldByName(l.field).Set(delta)
+	}
+	return &d
+}
+
+// expandVariant returns the variant stored as the delta d from pdoc.
+func expandVariant(pdoc, d *Package) *Package {
+	v := *d
+	v.Removed = nil
+	removed := make(map[string]bool)
+	for _, k := range d.Removed {
+		removed[k] = true
+	}
+	for _, l := range variantLists {
+		base := reflect.ValueOf(pdoc).Elem().FieldByName(l.field)
+		delta := reflect.ValueOf(d).Elem().FieldByName(l.field)
+		changed := make(map[string]reflect.Value)
+		for i := 0; i < delta.Len(); i++ {
+			changed[l.key(delta.Index(i))] = delta.Index(i)
+		}
+		list := reflect.Zero(delta.Type())
+		for i := 0; i < base.Len(); i++ {
+			e := base.Index(i)
+			k := l.key(e)
+			if removed[l.field+":"+k] {
+				continue
+			}
+			if c, ok := changed[k]; ok {
+				e = c
+				delete(changed, k)
+			}
+			list = reflect.Append(list, e)
+		}
+		for i := 0; i < delta.Len(); i++ {
+			if _, ok := changed[l.key(delta.Index(i))]; ok {
+				list = reflect.Append(list, delta.Index(i))
+			}
+		}
+		reflect.ValueOf(&v).Elem().FieldByName(l.field).Set(list)
+	}
+	return &v
+}
+
+// buildContext returns the go/build context for c that reads the files of
+// the builder.
+func (b *builder) buildContext(c BuildContext) *build.Context {
+	return &build.Context{
+		GOOS:          c.GOOS,
+		GOARCH:        c.GOARCH,
+		CgoEnabled:    true,
+		ReleaseTags:   build.Default.ReleaseTags,
+		JoinPath:      path.Join,
+		IsAbsPath:     path.IsAbs,
+		SplitPathList: func(list string) []string { return strings.Split(list, ":") },
+		IsDir:         func(path string) bool { panic("unexpected") },
+		HasSubdir:     func(root, dir string) (rel string, ok bool) { panic("unexpected") },
+		ReadDir:       func(dir string) (fi []os.FileInfo, err error) { return b.readDir(dir) },
+		OpenFile:      func(path string) (r io.ReadCloser, err error) { return b.openFile(path) },
+		Compiler:      "gc",
+	}
+}
+
+// errNoBuildableGoFiles is the error for a directory with Go files that are
+// all excluded by build constraints.
+var errNoBuildableGoFiles = errors.New("build constraints exclude all Go files")
+
+// importDir loads the package of the builder with ctxt. A file with syntax
+// errors is excluded from the package and the package is loaded again, so
+// that the documentation is built from the files that parse.
+func (b *builder) importDir(ctxt *build.Context) (*build.Package, error) {
+	for {
+		bpkg, err := ctxt.ImportDir("/", 0)
+		name := syntaxErrorFile(err)
+		if name == "" || b.srcs[name] == nil || b.excluded[name] != nil {
+			return bpkg, err
+		}
+		if b.excluded == nil {
+			b.excluded = make(map[string]error)
+		}
+		b.excluded[name] = err
+	}
+}
+
+// syntaxErrorFile returns the name of the file with the syntax error err or
+// "" if err is not a syntax error.
+func syntaxErrorFile(err error) string {
+	list, ok := err.(scanner.ErrorList)
+	if !ok || len(list) == 0 || list[0].Pos.Filename == "" {
+		return ""
+	}
+	return path.Base(list[0].Pos.Filename)
+}
+
+// addExcludedErrors adds the errors of the files excluded by importDir to
+// the package errors and diagnostics. The errors are formatted as
+// file:line:column: message.
+func (b *builder) addExcludedErrors() {
+	var names []string
+	for name := range b.excluded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := b.excluded[name]
+		if list, ok := err.(scanner.ErrorList); ok {
+			for _, e := range list {
+				e.Pos.Filename = name
+			}
+		}
+		b.pdoc.Errors = append(b.pdoc.Errors, err.Error())
+		b.addParseErrorDiagnostics(name, err)
+	}
+}
+
+// hasIgnoredGoFiles returns true if build constraints exclude a Go file
+// other than a test from the package.
+func hasIgnoredGoFiles(bpkg *build.Package) bool {
+	if bpkg == nil {
+		return false
+	}
+	for _, name := range bpkg.IgnoredGoFiles {
+		if !strings.HasSuffix(name, "_test.go") {
+			return true
+		}
+	}
+	return false
+}
+
+// goFiles returns the sorted names of the Go files selected by the build
+// context c or nil if the context does not select a package.
+func (b *builder) goFiles(c BuildContext) []string {
+	bpkg, err := b.buildContext(c).ImportDir("/", 0)
+	if err != nil {
+		return nil
+	}
+	names := append(bpkg.GoFiles, bpkg.CgoFiles...)
+	sort.Strings(names)
+	return names
+}
+
+// addVariants builds the documentation for the build contexts that select
+// different files than the context of b.pdoc. The documentation is added to
+// b.pdoc.Variants if the API or package comment differs. Fetched is the
+// package as it was before the build.
+func (b *builder) addVariants(srcs []*source, fetched Package) {
+	for _, c := range BuildContexts {
+		if c == b.pdoc.Context() {
+			continue
+		}
+		names := b.goFiles(c)
+		if names == nil || strings.Join(names, "\n") == strings.Join(b.names, "\n") {
+			continue
+		}
+		p := fetched
+		p.Errors = append([]string(nil), fetched.Errors...)
+		p.Diagnostics = append([]*Diagnostic(nil), fetched.Diagnostics...)
+		vb := &builder{pdoc: &p, tags: b.tags, symlinks: b.symlinks}
+		vdoc, err := vb.buildContexts(srcs, []BuildContext{c})
+		if err != nil || vdoc.Name == "" {
+			continue
+		}
+		v := variant(vdoc)
+		if Diff(b.pdoc, v).Identical {
+			continue
+		}
+		b.pdoc.Variants = append(b.pdoc.Variants, variantDelta(b.pdoc, v))
+	}
+}
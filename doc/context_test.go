@@ -0,0 +1,140 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/build"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForContext(t *testing.T) {
+	pdoc := &Package{
+		ImportPath: "example.com/term",
+		Etag:       "e",
+		Name:       "term",
+		GOOS:       "linux",
+		GOARCH:     "amd64",
+		Funcs:      []*Func{{Name: "Size"}},
+		Variants: []*Package{
+			{Name: "term", GOOS: "windows", GOARCH: "amd64", Funcs: []*Func{{Name: "Console"}, {Name: "Size"}}},
+		},
+	}
+
+	if got, want := pdoc.Contexts(), []BuildContext{{"linux", "amd64"}, {"windows", "amd64"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Contexts() = %v, want %v", got, want)
+	}
+	if p, ok := pdoc.ForContext(BuildContext{"linux", "amd64"}); !ok || p != pdoc {
+		t.Errorf("ForContext(linux) = %v, %v, want pdoc", p, ok)
+	}
+	if _, ok := pdoc.ForContext(BuildContext{"darwin", "amd64"}); ok {
+		t.Errorf("ForContext(darwin) found documentation, want none")
+	}
+
+	p, ok := pdoc.ForContext(BuildContext{"windows", "amd64"})
+	if !ok {
+		t.Fatal("ForContext(windows) did not find documentation")
+	}
+	if p.ImportPath != pdoc.ImportPath || p.Etag != pdoc.Etag || p.GOOS != "windows" || len(p.Funcs) != 2 {
+		t.Errorf("ForContext(windows) = %+v, want windows variant of pdoc", p)
+	}
+	if got, want := p.Contexts(), pdoc.Contexts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("variant Contexts() = %v, want %v", got, want)
+	}
+	if back, ok := p.ForContext(BuildContext{"linux", "amd64"}); !ok || len(back.Funcs) != 1 {
+		t.Errorf("ForContext(windows).ForContext(linux) = %+v, %v, want linux documentation", back, ok)
+	}
+	if len(pdoc.Funcs) != 1 || pdoc.GOOS != "linux" {
+		t.Errorf("ForContext modified pdoc")
+	}
+
+	if c := (&Package{GOOS: "linux", GOARCH: "amd64"}).Contexts(); c != nil {
+		t.Errorf("Contexts() without variants = %v, want nil", c)
+	}
+}
+
+func TestVariantDelta(t *testing.T) {
+	pdoc := &Package{
+		GOOS:   "linux",
+		GOARCH: "amd64",
+		Funcs:  []*Func{{Name: "Open"}, {Name: "Size", Doc: "linux"}, {Name: "Pty"}},
+		Files:  []*File{{Name: "term.go"}, {Name: "term_linux.go"}},
+	}
+	v := &Package{
+		GOOS:   "windows",
+		GOARCH: "amd64",
+		Funcs:  []*Func{{Name: "Open"}, {Name: "Size", Doc: "windows"}, {Name: "Console"}},
+		Files:  []*File{{Name: "term.go"}, {Name: "term_windows.go"}},
+	}
+	d := variantDelta(pdoc, v)
+	if got, want := d.Funcs, []*Func{{Name: "Size", Doc: "windows"}, {Name: "Console"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delta Funcs = %+v, want %+v", got, want)
+	}
+	if got, want := d.Removed, []string{"Funcs:Pty", "Files:term_linux.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delta Removed = %q, want %q", got, want)
+	}
+	if got := expandVariant(pdoc, d); !reflect.DeepEqual(got, v) {
+		t.Errorf("expandVariant(variantDelta(v)) = %+v, want %+v", got, v)
+	}
+}
+
+func TestImportDirSyntaxError(t *testing.T) {
+	b := &builder{
+		pdoc: &Package{ImportPath: "example.com/broken"},
+		srcs: map[string]*source{
+			"a.go":      {name: "a.go", data: []byte("package broken\n\nfunc A() {}\n")},
+			"b.go":      {name: "b.go", data: []byte("packag broken\n")},
+			"doc.go":    {name: "doc.go", data: []byte("// Package broken is broken.\npackage broken\n")},
+			"README.md": {name: "README.md", data: []byte("# broken\n")},
+		},
+	}
+	ctxt := b.buildContext(BuildContexts[0])
+	ctxt.IsDir = func(p string) bool { return p == "/" }
+	bpkg, err := b.importDir(ctxt)
+	if err != nil {
+		t.Fatalf("importDir returned %v", err)
+	}
+	if want := []string{"a.go", "doc.go"}; !reflect.DeepEqual(bpkg.GoFiles, want) {
+		t.Errorf("GoFiles = %v, want %v", bpkg.GoFiles, want)
+	}
+	b.addExcludedErrors()
+	if len(b.pdoc.Errors) != 1 || !strings.HasPrefix(b.pdoc.Errors[0], "b.go:1:1: ") {
+		t.Errorf("Errors = %q, want a b.go:1:1 error", b.pdoc.Errors)
+	}
+	if len(b.pdoc.Diagnostics) != 1 || b.pdoc.Diagnostics[0].Code != DiagnosticParseError {
+		t.Errorf("Diagnostics = %v, want a parse error", b.pdoc.Diagnostics)
+	}
+}
+
+func TestHasIgnoredGoFiles(t *testing.T) {
+	for _, tt := range []struct {
+		bpkg *build.Package
+		want bool
+	}{
+		{nil, false},
+		{&build.Package{}, false},
+		{&build.Package{IgnoredGoFiles: []string{"a_test.go"}}, false},
+		{&build.Package{IgnoredGoFiles: []string{"a_test.go", "gen.go"}}, true},
+	} {
+		if got := hasIgnoredGoFiles(tt.bpkg); got != tt.want {
+			var files []string
+			if tt.bpkg != nil {
+				files = tt.bpkg.IgnoredGoFiles
+			}
+			t.Errorf("hasIgnoredGoFiles(%v) = %v, want %v", files, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type credentials struct {
+	username, password string
+}
+
+// hostCredentials maps host names to the credentials for the host. The map
+// is set at startup.
+var hostCredentials = make(map[string]credentials)
+
+// SetCredentials sets the HTTP basic auth credentials for requests to host.
+// The credentials are only sent with HTTPS requests to exactly the given
+// host.
+func SetCredentials(host, username, password string) {
+	hostCredentials[host] = credentials{username, password}
+}
+
+// ReadNetrc sets the credentials for the machines in a netrc file. The
+// default entry and macro definitions are ignored.
+func ReadNetrc(path string) error {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for host, c := range parseNetrc(string(p)) {
+		hostCredentials[host] = c
+	}
+	return nil
+}
+
+func parseNetrc(s string) map[string]credentials {
+	m := make(map[string]credentials)
+	var (
+		host  string
+		c     credentials
+		macro bool
+	)
+	flush := func() {
+		if host != "" {
+			m[host] = c
+		}
+		host = ""
+		c = credentials{}
+	}
+	for _, line := range strings.Split(s, "\n") {
+		if macro {
+			// A macro definition ends with an empty line.
+			macro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			var value string
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				flush()
+				host = value
+				i++
+			case "default":
+				flush()
+			case "login":
+				c.username = value
+				i++
+			case "password":
+				c.password = value
+				i++
+			case "account":
+				i++
+			case "macdef":
+				flush()
+				macro = true
+				i = len(fields)
+			}
+		}
+	}
+	flush()
+	return m
+}
+
+// hostToken is an access token header for a self-hosted repository
+// service.
+type hostToken struct {
+	header, value string
+}
+
+// hostTokens maps host names to the access token header for the host. The
+// map is set with the self-hosted services.
+var hostTokens = struct {
+	sync.Mutex
+	m map[string]hostToken
+}{m: make(map[string]hostToken)}
+
+func setHostTokens(tokens map[string]hostToken) {
+	hostTokens.Lock()
+	hostTokens.m = tokens
+	hostTokens.Unlock()
+}
+
+// githubCredential is an OAuth application key for the GitHub API. Reset is
+// the time at which the credential's rate limit window ends.
+type githubCredential struct {
+	id, secret string
+	reset      time.Time
+}
+
+// githubCredentials is the pool of GitHub API credentials. Requests use the
+// first credential with remaining quota.
+var githubCredentials struct {
+	sync.Mutex
+	creds []*githubCredential
+}
+
+// SetGithubCredentials sets the OAuth application key sent with GitHub API
+// requests, replacing any credentials set before.
+func SetGithubCredentials(id, secret string) {
+	githubCredentials.Lock()
+	githubCredentials.creds = nil
+	githubCredentials.Unlock()
+	AddGithubCredentials(id, secret)
+}
+
+// AddGithubCredentials adds an OAuth application key to the GitHub API
+// credentials. When the rate limit for one key is exhausted, requests are
+// sent with the next key.
+func AddGithubCredentials(id, secret string) {
+	if id == "" {
+		return
+	}
+	githubCredentials.Lock()
+	githubCredentials.creds = append(githubCredentials.creds, &githubCredential{id: id, secret: secret})
+	githubCredentials.Unlock()
+}
+
+// nextGithubCredential returns the first credential that is not rate limited
+// or nil if there is no such credential.
+func nextGithubCredential() *githubCredential {
+	now := time.Now()
+	githubCredentials.Lock()
+	defer githubCredentials.Unlock()
+	for _, c := range githubCredentials.creds {
+		if !c.reset.After(now) {
+			return c
+		}
+	}
+	return nil
+}
+
+// earliestGithubReset returns the earliest time at which a GitHub
+// credential has quota again.
+func earliestGithubReset() time.Time {
+	githubCredentials.Lock()
+	defer githubCredentials.Unlock()
+	var t time.Time
+	for _, c := range githubCredentials.creds {
+		if t.IsZero() || c.reset.Before(t) {
+			t = c.reset
+		}
+	}
+	return t
+}
+
+// exhaust marks the credential as rate limited until reset.
+func (c *githubCredential) exhaust(reset time.Time) {
+	githubCredentials.Lock()
+	c.reset = reset
+	githubCredentials.Unlock()
+}
+
+// setGithubCredential adds the next available GitHub API credential to a
+// request for api.github.com that does not have an authorization header.
+// The credential is returned so that it can be marked as exhausted when the
+// response reports that the rate limit is exceeded.
+func setGithubCredential(req *http.Request) *githubCredential {
+	if req.URL.Scheme != "https" || req.URL.Host != "api.github.com" || req.Header.Get("Authorization") != "" {
+		return nil
+	}
+	c := nextGithubCredential()
+	if c != nil {
+		req.SetBasicAuth(c.id, c.secret)
+	}
+	return c
+}
+
+// setCredentials adds the access token or the basic auth credentials for the
+// request's host to the request. Credentials are not added to plain HTTP
+// requests or to requests that already have an authorization header.
+func setCredentials(req *http.Request) {
+	if req.URL.Scheme != "https" || req.Header.Get("Authorization") != "" {
+		return
+	}
+	hostTokens.Lock()
+	t, ok := hostTokens.m[req.URL.Host]
+	hostTokens.Unlock()
+	if ok {
+		req.Header.Set(t.header, t.value)
+		return
+	}
+	if c, ok := hostCredentials[req.URL.Host]; ok {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// CheckRedirect is the redirect policy for clients passed to this package.
+// Authorization headers are removed from requests redirected to another host
+// or to plain HTTP. Credentials for the new host are added as for the
+// original request.
+func CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Scheme != "https" || req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+		req.Header.Del("Private-Token")
+	}
+	setCredentials(req)
+	return nil
+}
+
+var userinfoPattern = regexp.MustCompile(`//[^/@\s]+@`)
+
+// scrubCredentials removes URL user information and configured passwords
+// from s.
+func scrubCredentials(s string) string {
+	s = userinfoPattern.ReplaceAllString(s, "//")
+	for _, c := range hostCredentials {
+		if c.password != "" {
+			s = strings.Replace(s, c.password, "xxxxx", -1)
+		}
+	}
+	hostTokens.Lock()
+	for _, t := range hostTokens.m {
+		s = strings.Replace(s, strings.TrimPrefix(t.value, "token "), "xxxxx", -1)
+	}
+	hostTokens.Unlock()
+	githubCredentials.Lock()
+	for _, c := range githubCredentials.creds {
+		if c.secret != "" {
+			s = strings.Replace(s, c.secret, "xxxxx", -1)
+		}
+	}
+	githubCredentials.Unlock()
+	return s
+}
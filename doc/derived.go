@@ -0,0 +1,157 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"strings"
+)
+
+// maxDerivedSynopsis is the maximum length in bytes of a derived synopsis.
+const maxDerivedSynopsis = 200
+
+// packageWords are the words that mark a name in a sentence as the name of
+// a package.
+var packageWords = map[string]bool{
+	"package":      true,
+	"packages":     true,
+	"subpackage":   true,
+	"subpackages":  true,
+	"sub-package":  true,
+	"sub-packages": true,
+	"directory":    true,
+}
+
+// SubpackageSentence returns the first sentence of an ancestor package
+// comment that mentions a subpackage or "" if there is no such sentence.
+// Rel is the path of the subpackage relative to the ancestor and name is
+// the package name. A sentence mentions the subpackage if it contains the
+// import path of the subpackage, rel if rel has more than one element, or
+// rel or name next to a word like "package" or "subpackage".
+func SubpackageSentence(doc, importPath, rel, name string) string {
+	for _, s := range sentences(doc) {
+		if mentionsSubpackage(s, importPath, rel, name) {
+			return truncateSynopsis(s)
+		}
+	}
+	return ""
+}
+
+// SubpackageSynopsis returns the synopsis of a subpackage derived from the
+// synopsis of an ancestor package.
+func SubpackageSynopsis(ancestorSynopsis string) string {
+	if ancestorSynopsis == "" {
+		return ""
+	}
+	// Lower the case of the first word unless it is an acronym.
+	if len(ancestorSynopsis) > 1 && isASCIIUpper(ancestorSynopsis[0]) && !isASCIIUpper(ancestorSynopsis[1]) {
+		ancestorSynopsis = strings.ToLower(ancestorSynopsis[:1]) + ancestorSynopsis[1:]
+	}
+	return truncateSynopsis("Subpackage of " + ancestorSynopsis)
+}
+
+func isASCIIUpper(b byte) bool {
+	return 'A' <= b && b <= 'Z'
+}
+
+func mentionsSubpackage(s, importPath, rel, name string) bool {
+	words := strings.Fields(s)
+	for i := range words {
+		words[i] = strings.TrimRight(strings.Trim(words[i], "`\"'()[]{}<>*,;:!?"), "./")
+	}
+	for i, w := range words {
+		switch {
+		case w == importPath:
+			return true
+		case w == rel && strings.Contains(rel, "/"):
+			return true
+		case w == name || w == rel:
+			if i > 0 && packageWords[strings.ToLower(words[i-1])] {
+				return true
+			}
+			if i+1 < len(words) && packageWords[strings.ToLower(words[i+1])] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sentences splits a package comment into sentences. Runs of whitespace
+// are replaced by a single space. Each line of preformatted text is a
+// sentence.
+func sentences(doc string) []string {
+	var result []string
+	var words []string
+	flush := func() {
+		if len(words) > 0 {
+			result = append(result, strings.Join(words, " "))
+			words = words[:0]
+		}
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			flush()
+			words = strings.Fields(line)
+			flush()
+			continue
+		}
+		for _, w := range strings.Fields(line) {
+			words = append(words, w)
+			if endsSentence(w) {
+				flush()
+			}
+		}
+	}
+	flush()
+	return result
+}
+
+// endsSentence returns true if word w ends a sentence. Abbreviations like
+// "e.g." and initials do not end a sentence.
+func endsSentence(w string) bool {
+	w = strings.TrimRight(w, `"')`)
+	if w == "" {
+		return false
+	}
+	switch w[len(w)-1] {
+	case '!', '?':
+		return true
+	case '.':
+		for _, part := range strings.Split(w[:len(w)-1], ".") {
+			if len(part) != 1 {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// truncateSynopsis truncates s to maxDerivedSynopsis bytes at a word
+// boundary.
+func truncateSynopsis(s string) string {
+	if len(s) <= maxDerivedSynopsis {
+		return s
+	}
+	s = s[:maxDerivedSynopsis]
+	if i := strings.LastIndex(s, " "); i > 0 {
+		s = s[:i]
+	}
+	return s + " ..."
+}
@@ -0,0 +1,87 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"strings"
+	"testing"
+)
+
+const parentDoc = `Package yaml implements YAML support for the Go language.
+
+The encoding is described in the specification. See e.g. the
+YAML 1.2 spec for details. The parser subpackage
+exposes the event stream used by the decoder.
+
+Subpackages:
+
+	github.com/example/yaml/internal/scan - scanner used by the parser
+	emit/json: emitters for other formats
+`
+
+var subpackageSentenceTests = []struct {
+	doc, importPath, rel, name string
+	sentence                   string
+}{
+	{parentDoc, "github.com/example/yaml/parser", "parser", "parser",
+		"The parser subpackage exposes the event stream used by the decoder."},
+	{parentDoc, "github.com/example/yaml/internal/scan", "internal/scan", "scan",
+		"github.com/example/yaml/internal/scan - scanner used by the parser"},
+	{parentDoc, "github.com/example/yaml/emit/json", "emit/json", "json",
+		"emit/json: emitters for other formats"},
+	// The name is not next to a package word.
+	{parentDoc, "github.com/example/yaml/spec", "spec", "spec", ""},
+	{parentDoc, "github.com/example/yaml/decoder", "decoder", "decoder", ""},
+	{"Package x does things. Use package `y` for the rest.", "example.com/x/y", "y", "y",
+		"Use package `y` for the rest."},
+	{"Package x does things. Use the y/z directory! Done.", "example.com/x/y/z", "y/z", "z",
+		"Use the y/z directory!"},
+	{"Package x. Package names like U.S. or e.g. things are not sentence ends. See package z.", "example.com/x/z", "z", "z",
+		"See package z."},
+	{"", "example.com/x/y", "y", "y", ""},
+}
+
+func TestSubpackageSentence(t *testing.T) {
+	for _, tt := range subpackageSentenceTests {
+		if s := SubpackageSentence(tt.doc, tt.importPath, tt.rel, tt.name); s != tt.sentence {
+			t.Errorf("SubpackageSentence(doc, %q, %q, %q) = %q, want %q", tt.importPath, tt.rel, tt.name, s, tt.sentence)
+		}
+	}
+}
+
+func TestSubpackageSentenceTruncated(t *testing.T) {
+	doc := "The foo package " + strings.Repeat("does many things ", 20) + "in one place."
+	s := SubpackageSentence(doc, "example.com/x/foo", "foo", "foo")
+	if len(s) > maxDerivedSynopsis+len(" ...") || !strings.HasSuffix(s, " ...") || !strings.HasPrefix(s, "The foo package does ") {
+		t.Errorf("SubpackageSentence returned %q, want truncated sentence", s)
+	}
+}
+
+var subpackageSynopsisTests = []struct {
+	ancestor, synopsis string
+}{
+	{"", ""},
+	{"Package yaml implements YAML support.", "Subpackage of package yaml implements YAML support."},
+	{"Tools for working with YAML.", "Subpackage of tools for working with YAML."},
+	{"HTTP helpers.", "Subpackage of HTTP helpers."},
+}
+
+func TestSubpackageSynopsis(t *testing.T) {
+	for _, tt := range subpackageSynopsisTests {
+		if s := SubpackageSynopsis(tt.ancestor); s != tt.synopsis {
+			t.Errorf("SubpackageSynopsis(%q) = %q, want %q", tt.ancestor, s, tt.synopsis)
+		}
+	}
+}
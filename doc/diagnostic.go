@@ -0,0 +1,201 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/build"
+	"go/scanner"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// Diagnostic severities.
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+var severityLevels = map[string]int{
+	SeverityInfo:    1,
+	SeverityWarning: 2,
+	SeverityError:   3,
+}
+
+// SeverityAtLeast returns true if severity s is at or above severity min.
+// Unknown severities are below all known severities.
+func SeverityAtLeast(s, min string) bool {
+	return severityLevels[s] >= severityLevels[min]
+}
+
+// Diagnostic codes. The codes are stable; clients should test the code, not
+// the message.
+const (
+	// A file could not be parsed. The file is not documented.
+	DiagnosticParseError = "parse-error"
+
+	// A file is excluded by build constraints for the documented GOOS and
+	// GOARCH.
+	DiagnosticBuildConstraints = "build-constraints"
+
+	// The files in the directory declare different packages.
+	DiagnosticPackageClause = "package-clause"
+
+	// The package could not be loaded for a reason other than those above.
+	DiagnosticBuildError = "build-error"
+
+	// An import path is not valid.
+	DiagnosticImportPath = "import-path"
+
+	// An import path is relative to the directory of the package. The go
+	// get command cannot resolve the import.
+	DiagnosticRelativeImport = "relative-import"
+
+	// A file uses an API removed before Go 1.
+	DiagnosticDeprecatedAPI = "deprecated-api"
+
+	// An example does not match the package or an exported identifier and
+	// is not shown.
+	DiagnosticExampleDropped = "example-dropped"
+
+	// The package does not have a package comment.
+	DiagnosticNoPackageDoc = "no-package-doc"
+
+	// The documentation is too large to store and declarations are not
+	// shown.
+	DiagnosticTruncated = "truncated"
+
+	// An import path differs only in case from the path of an indexed
+	// package on a host where repository names are not case-sensitive.
+	DiagnosticImportCase = "import-case"
+
+	// The package comment declares a stability that conflicts with the
+	// version tags of the repository. The declared stability is shown.
+	DiagnosticStabilityConflict = "stability-conflict"
+
+	// A Go file has the same content as another file in the directory. The
+	// file that is first in path order is documented.
+	DiagnosticDuplicateFile = "duplicate-file"
+
+	// A file in the directory is a symbolic link. The link is not
+	// followed.
+	DiagnosticSymlink = "symlink"
+
+	// A declaration with the same name and signature is in more than one
+	// file. The declaration is shown once.
+	DiagnosticDuplicateDecl = "duplicate-declaration"
+
+	// The source position of a declaration refers to a file that is not in
+	// the package. The declaration is shown without a source link.
+	DiagnosticFilePosition = "file-position"
+
+	// A time reported by the project host is later than the time the data
+	// was fetched by more than MaxClockSkew. The fetch time is used
+	// instead.
+	DiagnosticClockSkew = "clock-skew"
+)
+
+// Diagnostic describes a problem found when building the documentation for
+// a package.
+type Diagnostic struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+
+	// File and line of the problem. File is "" for problems with the
+	// package as a whole. Line is 0 for problems with the file as a whole.
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+func (b *builder) addDiagnostic(code, severity string, pos token.Position, message string) {
+	b.pdoc.Diagnostics = append(b.pdoc.Diagnostics, &Diagnostic{
+		Code:     code,
+		Severity: severity,
+		Message:  message,
+		File:     pos.Filename,
+		Line:     pos.Line,
+	})
+}
+
+// addParseErrorDiagnostics adds a diagnostic for each error returned from
+// parsing the named file.
+func (b *builder) addParseErrorDiagnostics(name string, err error) {
+	if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+		for _, e := range list {
+			pos := e.Pos
+			if pos.Filename == "" {
+				pos.Filename = name
+			}
+			b.addDiagnostic(DiagnosticParseError, SeverityError, pos, e.Msg)
+		}
+		return
+	}
+	b.addDiagnostic(DiagnosticParseError, SeverityError, token.Position{Filename: name}, err.Error())
+}
+
+// addBuildDiagnostics adds diagnostics for the error returned from loading
+// the package and for the files excluded from the package.
+func (b *builder) addBuildDiagnostics(bpkg *build.Package, err error, ctxt *build.Context) {
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "found packages ") {
+			b.addDiagnostic(DiagnosticPackageClause, SeverityError, token.Position{}, err.Error())
+		} else {
+			b.addDiagnostic(DiagnosticBuildError, SeverityError, token.Position{}, err.Error())
+		}
+	}
+	if bpkg == nil {
+		return
+	}
+	for _, name := range bpkg.IgnoredGoFiles {
+		b.addDiagnostic(DiagnosticBuildConstraints, SeverityInfo, token.Position{Filename: name},
+			"File excluded by build constraints for "+ctxt.GOOS+"/"+ctxt.GOARCH+".")
+	}
+}
+
+// addExampleDiagnostics adds a diagnostic for each example that is not
+// shown.
+func (b *builder) addExampleDiagnostics() {
+	for _, e := range b.examples {
+		if b.shownExamples[e] {
+			continue
+		}
+		b.addDiagnostic(DiagnosticExampleDropped, SeverityWarning, b.fset.Position(e.Code.Pos()),
+			"Example"+e.Name+" does not refer to the package or an exported identifier.")
+	}
+}
+
+// sortDiagnostics sorts the diagnostics by file, line and code. Diagnostics
+// for the package as a whole are first.
+func sortDiagnostics(diags []*Diagnostic) {
+	sort.Sort(diagnosticsByPosition(diags))
+}
+
+type diagnosticsByPosition []*Diagnostic
+
+func (p diagnosticsByPosition) Len() int      { return len(p) }
+func (p diagnosticsByPosition) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p diagnosticsByPosition) Less(i, j int) bool {
+	switch {
+	case p[i].File != p[j].File:
+		return p[i].File < p[j].File
+	case p[i].Line != p[j].Line:
+		return p[i].Line < p[j].Line
+	case p[i].Code != p[j].Code:
+		return p[i].Code < p[j].Code
+	}
+	return p[i].Message < p[j].Message
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"errors"
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+)
+
+const diagnosticPackageSrc = `package widget
+
+func Spin() {}
+`
+
+const diagnosticTestSrc = `package widget
+
+func ExampleSpin() {}
+
+func ExampleTwirl() {}
+`
+
+const diagnosticBadSrc = `package widget
+
+func Broken( {
+`
+
+func TestDiagnostics(t *testing.T) {
+	b := &builder{
+		pdoc:          &Package{ImportPath: "example.com/widget"},
+		fset:          token.NewFileSet(),
+		exampleUses:   make(map[string]int),
+		testUses:      make(map[string]int),
+		shownExamples: make(map[*doc.Example]bool),
+	}
+	ctxt := &build.Context{GOOS: "linux", GOARCH: "amd64"}
+	b.addBuildDiagnostics(&build.Package{IgnoredGoFiles: []string{"widget_windows.go"}}, nil, ctxt)
+
+	if _, err := parser.ParseFile(b.fset, "bad.go", diagnosticBadSrc, parser.ParseComments); err == nil {
+		t.Fatal("bad.go parsed without error")
+	} else {
+		b.addParseErrorDiagnostics("bad.go", err)
+	}
+
+	file, err := parser.ParseFile(b.fset, "widget.go", diagnosticPackageSrc, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFile, err := parser.ParseFile(b.fset, "widget_test.go", diagnosticTestSrc, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.examples = doc.Examples(testFile)
+	apkg, _ := ast.NewPackage(b.fset, map[string]*ast.File{"widget.go": file}, simpleImporter, nil)
+	dpkg := doc.New(apkg, b.pdoc.ImportPath, 0)
+	b.pdoc.Funcs = b.funcs(dpkg.Funcs)
+	b.addExampleDiagnostics()
+	sortDiagnostics(b.pdoc.Diagnostics)
+
+	var got [][3]interface{}
+	for _, d := range b.pdoc.Diagnostics {
+		got = append(got, [3]interface{}{d.Code, d.File, d.Line})
+		if d.Message == "" {
+			t.Errorf("%s diagnostic for %s has no message", d.Code, d.File)
+		}
+	}
+	want := [][3]interface{}{
+		{DiagnosticParseError, "bad.go", 3},
+		{DiagnosticExampleDropped, "widget_test.go", 5},
+		{DiagnosticBuildConstraints, "widget_windows.go", 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diagnostics = %v, want %v", got, want)
+	}
+}
+
+func TestBuildErrorDiagnostics(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		code string
+	}{
+		{errors.New("found packages widget (a.go) and gadget (b.go) in /"), DiagnosticPackageClause},
+		{errors.New("import cycle"), DiagnosticBuildError},
+	} {
+		b := &builder{pdoc: &Package{}}
+		b.addBuildDiagnostics(nil, tt.err, &build.Context{})
+		if len(b.pdoc.Diagnostics) != 1 || b.pdoc.Diagnostics[0].Code != tt.code || b.pdoc.Diagnostics[0].Severity != SeverityError {
+			t.Errorf("diagnostics for %q = %v, want one %s error", tt.err, b.pdoc.Diagnostics, tt.code)
+		}
+	}
+}
+
+func TestSeverityAtLeast(t *testing.T) {
+	if !SeverityAtLeast(SeverityError, SeverityWarning) || SeverityAtLeast(SeverityInfo, SeverityWarning) || !SeverityAtLeast(SeverityWarning, SeverityWarning) {
+		t.Errorf("SeverityAtLeast does not order info < warning < error")
+	}
+}
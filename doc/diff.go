@@ -0,0 +1,176 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DeclChange is a change to an exported declaration between two versions of
+// a package.
+type DeclChange struct {
+	// Kind is "added", "removed" or "changed".
+	Kind string
+
+	// Name of the declaration: the identifier, the type name and method
+	// name joined by "." or the names in a constant or variable group.
+	Name string
+
+	// Anchor of the declaration in the package page.
+	Anchor string
+
+	// Declaration text and documentation in the old and new versions.
+	OldDecl, NewDecl string
+	OldDoc, NewDoc   string
+}
+
+// SignatureChanged returns true if the declaration text changed other than
+// in white space.
+func (c *DeclChange) SignatureChanged() bool {
+	return normalizeDecl(c.OldDecl) != normalizeDecl(c.NewDecl)
+}
+
+// DocChanged returns true if the documentation of the declaration changed.
+func (c *DeclChange) DocChanged() bool {
+	return c.OldDoc != c.NewDoc
+}
+
+// PackageDiff is the difference in the exported API and documentation
+// between two versions of a package.
+type PackageDiff struct {
+	// Identical is true if the versions have the same documentation.
+	Identical bool
+
+	// Package comment in the old and new versions.
+	OldDoc, NewDoc string
+
+	// Changes sorted by name.
+	Changes []*DeclChange
+
+	// Number of changes of each kind.
+	Added, Removed, Changed int
+}
+
+// DocChanged returns true if the package comment changed.
+func (d *PackageDiff) DocChanged() bool {
+	return d.OldDoc != d.NewDoc
+}
+
+// Diff returns the difference between the old and new versions of a
+// package. Versions with the same etag are identical without comparing the
+// declarations.
+func Diff(old, new *Package) *PackageDiff {
+	d := &PackageDiff{OldDoc: old.Doc, NewDoc: new.Doc}
+	if old.Etag != "" && old.Etag == new.Etag {
+		d.Identical = true
+		return d
+	}
+
+	oldDecls := apiDecls(old)
+	newDecls := apiDecls(new)
+	for name, n := range newDecls {
+		o, ok := oldDecls[name]
+		switch {
+		case !ok:
+			d.Changes = append(d.Changes, &DeclChange{Kind: "added", Name: n.name, Anchor: n.anchor, NewDecl: n.decl, NewDoc: n.doc})
+			d.Added++
+		case normalizeDecl(o.decl) != normalizeDecl(n.decl) || o.doc != n.doc:
+			d.Changes = append(d.Changes, &DeclChange{Kind: "changed", Name: n.name, Anchor: n.anchor, OldDecl: o.decl, NewDecl: n.decl, OldDoc: o.doc, NewDoc: n.doc})
+			d.Changed++
+		}
+	}
+	for name, o := range oldDecls {
+		if _, ok := newDecls[name]; !ok {
+			d.Changes = append(d.Changes, &DeclChange{Kind: "removed", Name: o.name, Anchor: o.anchor, OldDecl: o.decl, OldDoc: o.doc})
+			d.Removed++
+		}
+	}
+	sort.Sort(changesByName(d.Changes))
+	d.Identical = len(d.Changes) == 0 && !d.DocChanged()
+	return d
+}
+
+type changesByName []*DeclChange
+
+func (s changesByName) Len() int      { return len(s) }
+func (s changesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s changesByName) Less(i, j int) bool {
+	if s[i].Name != s[j].Name {
+		return s[i].Name < s[j].Name
+	}
+	return s[i].Kind < s[j].Kind
+}
+
+type apiDecl struct {
+	name, anchor, decl, doc string
+}
+
+// apiDecls returns the exported declarations in pdoc keyed by the kind and
+// name of the declaration.
+func apiDecls(pdoc *Package) map[string]apiDecl {
+	m := make(map[string]apiDecl)
+	addValues := func(values []*Value) {
+		for _, v := range values {
+			names := valueNames(v.Decl.Text)
+			if len(names) == 0 {
+				continue
+			}
+			name := strings.Join(names, ", ")
+			m[strings.SplitN(v.Decl.Text, " ", 2)[0]+" "+name] = apiDecl{name, AnchorID(DeclAnchor, names[0]), v.Decl.Text, v.Doc}
+		}
+	}
+	addFuncs := func(funcs []*Func, typeName string) {
+		for _, f := range funcs {
+			name := f.Name
+			if typeName != "" {
+				name = typeName + "." + f.Name
+			}
+			m["func "+name] = apiDecl{name, AnchorID(DeclAnchor, typeName, f.Name), f.Decl.Text, f.Doc}
+		}
+	}
+	addValues(pdoc.Consts)
+	addValues(pdoc.Vars)
+	addFuncs(pdoc.Funcs, "")
+	for _, t := range pdoc.Types {
+		m["type "+t.Name] = apiDecl{t.Name, AnchorID(DeclAnchor, t.Name), t.Decl.Text, t.Doc}
+		addValues(t.Consts)
+		addValues(t.Vars)
+		addFuncs(t.Funcs, "")
+		addFuncs(t.Methods, t.Name)
+	}
+	return m
+}
+
+// valueNamePat matches the first name in each spec of a constant or
+// variable declaration.
+var valueNamePat = regexp.MustCompile(`(?m)^(?:(?:const|var) |\t)([\pL_][\pL\pN_]*)`)
+
+// valueNames returns the first name of each spec in a printed constant or
+// variable declaration.
+func valueNames(decl string) []string {
+	var names []string
+	for _, m := range valueNamePat.FindAllStringSubmatch(decl, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// normalizeDecl collapses white space in a printed declaration so that
+// reformatting a declaration is not reported as a signature change.
+func normalizeDecl(decl string) string {
+	return strings.Join(strings.Fields(decl), " ")
+}
@@ -0,0 +1,157 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+)
+
+var diffOldSrc = `// Package widget makes widgets.
+package widget
+
+// Size is the size of a widget.
+const Size = 10
+
+// Open opens a widget.
+func Open(name string) error { return nil }
+
+// Close closes a widget.
+func Close() {}
+
+// Thing is a widget.
+type Thing struct{}
+
+// Run runs the thing.
+func (t *Thing) Run() {}
+
+// Stop stops the thing.
+func (t *Thing) Stop() {}
+`
+
+var diffNewSrc = `// Package widget makes widgets.
+package widget
+
+// Size is the size of a widget.
+const Size = 10
+
+// Open opens a widget.
+func Open(name string, flag int) error { return nil }
+
+// Close closes the widget and releases its resources.
+func Close() {}
+
+// Flush flushes a widget.
+func Flush() {}
+
+// Thing is a widget.
+type Thing struct{}
+
+// Run runs the thing.
+func (t *Thing) Run() {}
+`
+
+const diffGolden = `changed Close #Close
+  doc: "Close closes a widget.\n" -> "Close closes the widget and releases its resources.\n"
+added Flush #Flush
+  new: func Flush()
+changed Open #Open
+  decl: func Open(name string) error -> func Open(name string, flag int) error
+removed Thing.Stop #Thing.Stop
+  old: func (t *Thing) Stop()
+`
+
+// diffTestPackage returns the documentation for a single file package.
+func diffTestPackage(t *testing.T, src, etag string) *Package {
+	b := &builder{
+		pdoc:        &Package{ImportPath: "example.com/widget", Etag: etag},
+		fset:        token.NewFileSet(),
+		exampleUses: make(map[string]int),
+		testUses:    make(map[string]int),
+	}
+	file, err := parser.ParseFile(b.fset, "widget.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apkg, _ := ast.NewPackage(b.fset, map[string]*ast.File{"widget.go": file}, simpleImporter, nil)
+	dpkg := doc.New(apkg, b.pdoc.ImportPath, 0)
+	b.pdoc.Doc = dpkg.Doc
+	b.pdoc.Consts = b.values(dpkg.Consts)
+	b.pdoc.Vars = b.values(dpkg.Vars)
+	b.pdoc.Funcs = b.funcs(dpkg.Funcs)
+	b.pdoc.Types = b.types(dpkg.Types)
+	return b.pdoc
+}
+
+func TestDiff(t *testing.T) {
+	d := Diff(diffTestPackage(t, diffOldSrc, "1"), diffTestPackage(t, diffNewSrc, "2"))
+	var buf bytes.Buffer
+	for _, c := range d.Changes {
+		fmt.Fprintf(&buf, "%s %s #%s\n", c.Kind, c.Name, c.Anchor)
+		switch c.Kind {
+		case "added":
+			fmt.Fprintf(&buf, "  new: %s\n", c.NewDecl)
+		case "removed":
+			fmt.Fprintf(&buf, "  old: %s\n", c.OldDecl)
+		default:
+			if c.SignatureChanged() {
+				fmt.Fprintf(&buf, "  decl: %s -> %s\n", c.OldDecl, c.NewDecl)
+			}
+			if c.DocChanged() {
+				fmt.Fprintf(&buf, "  doc: %q -> %q\n", c.OldDoc, c.NewDoc)
+			}
+		}
+	}
+	if buf.String() != diffGolden {
+		t.Errorf("diff is\n%s\nwant\n%s", buf.String(), diffGolden)
+	}
+	if d.Added != 1 || d.Removed != 1 || d.Changed != 2 || d.Identical {
+		t.Errorf("counts = %d added, %d removed, %d changed, identical %v", d.Added, d.Removed, d.Changed, d.Identical)
+	}
+
+	d = Diff(diffTestPackage(t, diffOldSrc, "1"), diffTestPackage(t, diffOldSrc, "2"))
+	if !d.Identical || d.Changes != nil {
+		t.Errorf("diff of same source = %+v, want identical", d)
+	}
+
+	// Equal etags are identical without comparing declarations.
+	d = Diff(&Package{Etag: "1", Doc: "a"}, &Package{Etag: "1", Doc: "b"})
+	if !d.Identical {
+		t.Errorf("diff with equal etags is not identical")
+	}
+}
+
+var valueNamesTests = []struct {
+	decl  string
+	names []string
+}{
+	{"const Size = 10", []string{"Size"}},
+	{"var X, Y int", []string{"X"}},
+	{"const (\n\t// A is a.\n\tA Kind = iota\n\tB\n)", []string{"A", "B"}},
+}
+
+func TestValueNames(t *testing.T) {
+	for _, tt := range valueNamesTests {
+		if names := valueNames(tt.decl); !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("valueNames(%q) = %v, want %v", tt.decl, names, tt.names)
+		}
+	}
+}
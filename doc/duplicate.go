@@ -0,0 +1,164 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// symlinkMode is the git file mode of a symbolic link.
+const symlinkMode = "120000"
+
+// contentHash returns the hash reported by the repository host for the
+// source or, if the host does not report hashes, the SHA-1 hash of the
+// content.
+func (s *source) contentHash() string {
+	if s.hash != "" {
+		return s.hash
+	}
+	h := sha1.New()
+	h.Write(s.data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type sourcesByName []*source
+
+func (p sourcesByName) Len() int           { return len(p) }
+func (p sourcesByName) Less(i, j int) bool { return p[i].name < p[j].name }
+func (p sourcesByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// removeDuplicateSources returns the sources without the Go files that have
+// the same content as a Go file earlier in path order. A diagnostic is
+// added for each removed file. Generated mirrors and copied files would
+// otherwise document the same declarations twice.
+func (b *builder) removeDuplicateSources(srcs []*source) []*source {
+	sorted := make([]*source, len(srcs))
+	copy(sorted, srcs)
+	sort.Sort(sourcesByName(sorted))
+	first := make(map[string]string)
+	removed := make(map[*source]bool)
+	for _, src := range sorted {
+		if !strings.HasSuffix(src.name, ".go") {
+			continue
+		}
+		h := src.contentHash()
+		if name, ok := first[h]; ok {
+			removed[src] = true
+			b.addDiagnostic(DiagnosticDuplicateFile, SeverityWarning, token.Position{Filename: src.name},
+				"File has the same content as "+name+" and is not documented.")
+			continue
+		}
+		first[h] = src.name
+	}
+	if len(removed) == 0 {
+		return srcs
+	}
+	var result []*source
+	for _, src := range srcs {
+		if !removed[src] {
+			result = append(result, src)
+		}
+	}
+	return result
+}
+
+// addSymlink records the name of a symbolic link skipped by a fetcher in
+// match["symlinks"].
+func addSymlink(match map[string]string, name string) {
+	if match["symlinks"] != "" {
+		name = match["symlinks"] + " " + name
+	}
+	match["symlinks"] = name
+}
+
+// addSymlinkDiagnostics adds a diagnostic for each symbolic link skipped by
+// the fetcher.
+func (b *builder) addSymlinkDiagnostics() {
+	for _, name := range b.symlinks {
+		b.addDiagnostic(DiagnosticSymlink, SeverityInfo, token.Position{Filename: name},
+			"File is a symbolic link and is not documented.")
+	}
+}
+
+// declFile returns the name of the file containing the declaration at pos.
+func (b *builder) declFile(pos Pos) string {
+	if pos.Line == 0 || int(pos.File) >= len(b.pdoc.Files) || b.pdoc.Files[pos.File] == nil {
+		return ""
+	}
+	return b.pdoc.Files[pos.File].Name
+}
+
+// duplicateDecl returns true if a declaration with the same text was seen
+// in another file. The first file with the declaration is recorded in
+// seen. A diagnostic is added for the duplicate.
+func (b *builder) duplicateDecl(seen map[string]string, decl Code, pos Pos) bool {
+	file := b.declFile(pos)
+	first, ok := seen[decl.Text]
+	if !ok {
+		seen[decl.Text] = file
+		return false
+	}
+	if first == file {
+		return false
+	}
+	line := decl.Text
+	if i := strings.Index(line, "\n"); i >= 0 {
+		line = line[:i]
+	}
+	b.addDiagnostic(DiagnosticDuplicateDecl, SeverityWarning, token.Position{Filename: file, Line: int(pos.Line)},
+		"Declaration "+strings.TrimSpace(line)+" is also declared in "+first+" and is shown once.")
+	return true
+}
+
+func (b *builder) uniqueValues(seen map[string]string, values []*Value) []*Value {
+	var result []*Value
+	for _, v := range values {
+		if !b.duplicateDecl(seen, v.Decl, v.Pos) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (b *builder) uniqueFuncs(seen map[string]string, funcs []*Func) []*Func {
+	var result []*Func
+	for _, f := range funcs {
+		if !b.duplicateDecl(seen, f.Decl, f.Pos) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// removeDuplicateDecls removes declarations with the same name and
+// signature as a declaration in another file. The go/doc package keeps one
+// function or method for each name, but lists the value declarations from
+// every file.
+func (b *builder) removeDuplicateDecls() {
+	seen := make(map[string]string)
+	b.pdoc.Consts = b.uniqueValues(seen, b.pdoc.Consts)
+	b.pdoc.Vars = b.uniqueValues(seen, b.pdoc.Vars)
+	b.pdoc.Funcs = b.uniqueFuncs(seen, b.pdoc.Funcs)
+	for _, t := range b.pdoc.Types {
+		t.Consts = b.uniqueValues(seen, t.Consts)
+		t.Vars = b.uniqueValues(seen, t.Vars)
+		t.Funcs = b.uniqueFuncs(seen, t.Funcs)
+		t.Methods = b.uniqueFuncs(seen, t.Methods)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func sourceNames(srcs []*source) []string {
+	var names []string
+	for _, src := range srcs {
+		names = append(names, src.name)
+	}
+	return names
+}
+
+func TestRemoveDuplicateSources(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		srcs    []*source
+		want    []string
+		skipped string
+	}{
+		{"content",
+			[]*source{
+				{name: "b.go", data: []byte("package p\n")},
+				{name: "a.go", data: []byte("package p\n")},
+				{name: "c.go", data: []byte("package p\n\nvar C int\n")},
+			},
+			[]string{"a.go", "c.go"},
+			"b.go"},
+		{"host hash",
+			[]*source{
+				{name: "a.go", hash: "1234", data: []byte("package p\n")},
+				{name: "z.go", hash: "1234", data: []byte("package p\n")},
+				{name: "README", data: []byte("package p\n")},
+			},
+			[]string{"a.go", "README"},
+			"z.go"},
+		{"unique",
+			[]*source{
+				{name: "a.go", data: []byte("package p\n")},
+				{name: "README", data: []byte("package p\n")},
+			},
+			[]string{"a.go", "README"},
+			""},
+	} {
+		b := &builder{pdoc: &Package{}}
+		got := sourceNames(b.removeDuplicateSources(tt.srcs))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: removeDuplicateSources() = %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.skipped == "" {
+			if len(b.pdoc.Diagnostics) != 0 {
+				t.Errorf("%s: diagnostics = %+v, want none", tt.name, b.pdoc.Diagnostics)
+			}
+			continue
+		}
+		if len(b.pdoc.Diagnostics) != 1 {
+			t.Errorf("%s: got %d diagnostics, want 1", tt.name, len(b.pdoc.Diagnostics))
+			continue
+		}
+		d := b.pdoc.Diagnostics[0]
+		if d.Code != DiagnosticDuplicateFile || d.File != tt.skipped {
+			t.Errorf("%s: diagnostic = %s in %s, want %s in %s", tt.name, d.Code, d.File, DiagnosticDuplicateFile, tt.skipped)
+		}
+	}
+}
+
+func TestRemoveDuplicateDecls(t *testing.T) {
+	b := &builder{pdoc: &Package{
+		Files: []*File{{Name: "a.go"}, {Name: "a_copy.go"}},
+		Consts: []*Value{
+			{Decl: Code{Text: "const A = 1"}, Pos: Pos{Line: 3, File: 0}},
+			{Decl: Code{Text: "const A = 1"}, Pos: Pos{Line: 3, File: 1}},
+		},
+		Funcs: []*Func{
+			{Name: "F", Decl: Code{Text: "func F()"}, Pos: Pos{Line: 5, File: 0}},
+		},
+		Types: []*Type{{
+			Name: "T",
+			Vars: []*Value{
+				{Decl: Code{Text: "var Default T"}, Pos: Pos{Line: 7, File: 0}},
+				{Decl: Code{Text: "var Default T"}, Pos: Pos{Line: 7, File: 1}},
+			},
+		}},
+	}}
+	b.removeDuplicateDecls()
+	if len(b.pdoc.Consts) != 1 || b.pdoc.Consts[0].Pos.File != 0 {
+		t.Errorf("consts = %+v, want the declaration in a.go", b.pdoc.Consts)
+	}
+	if len(b.pdoc.Funcs) != 1 {
+		t.Errorf("funcs = %+v, want F", b.pdoc.Funcs)
+	}
+	if len(b.pdoc.Types[0].Vars) != 1 {
+		t.Errorf("type vars = %+v, want one", b.pdoc.Types[0].Vars)
+	}
+	if len(b.pdoc.Diagnostics) != 2 {
+		t.Fatalf("got %d diagnostics, want 2", len(b.pdoc.Diagnostics))
+	}
+	for _, d := range b.pdoc.Diagnostics {
+		if d.Code != DiagnosticDuplicateDecl || d.File != "a_copy.go" {
+			t.Errorf("diagnostic = %s in %s, want %s in a_copy.go", d.Code, d.File, DiagnosticDuplicateDecl)
+		}
+	}
+}
+
+func TestGithubTreeSymlink(t *testing.T) {
+	client, done := newGithubTestClient(map[string]string{
+		"/repos/owner/repo/git/trees/main": `{
+			"url": "https://api.github.com/repos/owner/repo/git/trees/main",
+			"tree": [
+				{"path": "p.go", "mode": "100644", "type": "blob", "sha": "1111", "url": "https://api.github.com/repos/owner/repo/git/blobs/1111"},
+				{"path": "link.go", "mode": "120000", "type": "blob", "sha": "2222", "url": "https://api.github.com/repos/owner/repo/git/blobs/2222"}
+			]
+		}`,
+	})
+	defer done()
+
+	match := map[string]string{"owner": "owner", "repo": "repo", "tag": "main", "dir": ""}
+	files, _, err := getGithubTree(client, match)
+	if err != nil {
+		t.Fatalf("getGithubTree() returned error %v", err)
+	}
+	if got := sourceNames(files); !reflect.DeepEqual(got, []string{"p.go"}) {
+		t.Errorf("getGithubTree() files = %v, want [p.go]", got)
+	}
+	if match["symlinks"] != "link.go" {
+		t.Errorf("match[symlinks] = %q, want %q", match["symlinks"], "link.go")
+	}
+
+	b := &builder{pdoc: &Package{}, symlinks: []string{match["symlinks"]}}
+	b.addSymlinkDiagnostics()
+	if len(b.pdoc.Diagnostics) != 1 || b.pdoc.Diagnostics[0].Code != DiagnosticSymlink {
+		t.Errorf("diagnostics = %+v, want one %s", b.pdoc.Diagnostics, DiagnosticSymlink)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"log"
+	"net/http"
+)
+
+// FileCache stores the content of source files keyed by the content hash
+// reported by the repository host.
+type FileCache interface {
+	// GetFile returns the content of the file with the given hash or nil
+	// if the file is not in the cache.
+	GetFile(hash string) ([]byte, error)
+
+	// PutFile adds the content of a file to the cache.
+	PutFile(hash string, p []byte) error
+}
+
+var fileCache FileCache
+
+// SetFileCache sets the cache used to avoid fetching files that did not
+// change since the package was last fetched.
+func SetFileCache(c FileCache) {
+	fileCache = c
+}
+
+// fetchChangedFiles fetches the files that are not in the file cache and
+// adds the fetched files to the cache. Files without a hash are always
+// fetched. Errors from the cache are logged and the file is fetched from the
+// repository host.
+func fetchChangedFiles(client *http.Client, files []*source, header http.Header) error {
+	if fileCache == nil {
+		return fetchFiles(client, files, header)
+	}
+
+	var changed []*source
+	for _, f := range files {
+		if f.hash != "" {
+			p, err := fileCache.GetFile(f.hash)
+			if err != nil {
+				log.Printf("ERROR get file %s from cache: %v", f.hash, err)
+			} else if p != nil {
+				f.data = p
+				continue
+			}
+		}
+		changed = append(changed, f)
+	}
+
+	if err := fetchFiles(client, changed, header); err != nil {
+		return err
+	}
+
+	for _, f := range changed {
+		if f.hash != "" {
+			if err := fileCache.PutFile(f.hash, f.data); err != nil {
+				log.Printf("ERROR put file %s in cache: %v", f.hash, err)
+			}
+		}
+	}
+	return nil
+}
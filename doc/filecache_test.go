@@ -0,0 +1,81 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// memFileCache is an in-memory FileCache.
+type memFileCache map[string][]byte
+
+func (c memFileCache) GetFile(hash string) ([]byte, error) { return c[hash], nil }
+func (c memFileCache) PutFile(hash string, p []byte) error { c[hash] = p; return nil }
+
+func TestFetchChangedFiles(t *testing.T) {
+	defer SetFileCache(nil)
+	cache := memFileCache{}
+	SetFileCache(cache)
+
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path[1:])
+		w.Write([]byte("content of " + r.URL.Path[1:]))
+	}))
+	defer server.Close()
+
+	sources := func(hashes ...string) []*source {
+		var files []*source
+		for i, hash := range hashes {
+			files = append(files, &source{name: string(rune('a'+i)) + ".go", rawURL: server.URL + "/" + hash, hash: hash})
+		}
+		return files
+	}
+
+	if err := fetchChangedFiles(http.DefaultClient, sources("a1", "b1", "c1", "d1", "e1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 5 || len(cache) != 5 {
+		t.Fatalf("initial fetch got %d files and cached %d, want 5", len(fetched), len(cache))
+	}
+
+	// Refresh after one of the five files changed.
+	fetched = nil
+	files := sources("a1", "b1", "c1", "d1", "e2")
+	if err := fetchChangedFiles(http.DefaultClient, files, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 || fetched[0] != "e2" {
+		t.Errorf("refresh fetched %v, want [e2]", fetched)
+	}
+	for _, f := range files {
+		if want := "content of " + f.hash; string(f.data) != want {
+			t.Errorf("%s data = %q, want %q", f.name, f.data, want)
+		}
+	}
+
+	// Files without a hash are always fetched.
+	fetched = nil
+	files = sources("a1")
+	files[0].hash = ""
+	if err := fetchChangedFiles(http.DefaultClient, files, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 {
+		t.Errorf("fetch of file without hash got %d files, want 1", len(fetched))
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+)
+
+// minFingerprintDecls is the minimum number of exported declarations for a
+// package to get a fingerprint. Small packages are not fingerprinted because
+// unrelated packages with the same small API are common.
+const minFingerprintDecls = 3
+
+// fingerprint returns a hash of the exported API and package comment of
+// pdoc. Packages with identical fingerprints are probably copies of each
+// other. The empty string is returned for small packages.
+func fingerprint(pdoc *Package) string {
+	var decls []string
+	for _, v := range pdoc.Consts {
+		decls = append(decls, v.Decl.Text)
+	}
+	for _, v := range pdoc.Vars {
+		decls = append(decls, v.Decl.Text)
+	}
+	for _, f := range pdoc.Funcs {
+		decls = append(decls, f.Decl.Text)
+	}
+	for _, t := range pdoc.Types {
+		decls = append(decls, t.Decl.Text)
+		for _, v := range t.Consts {
+			decls = append(decls, v.Decl.Text)
+		}
+		for _, v := range t.Vars {
+			decls = append(decls, v.Decl.Text)
+		}
+		for _, f := range t.Funcs {
+			decls = append(decls, f.Decl.Text)
+		}
+		for _, f := range t.Methods {
+			decls = append(decls, f.Decl.Text)
+		}
+	}
+
+	if len(decls) < minFingerprintDecls {
+		return ""
+	}
+
+	sort.Strings(decls)
+	h := sha1.New()
+	h.Write([]byte(pdoc.Doc))
+	for _, d := range decls {
+		h.Write([]byte{0})
+		h.Write([]byte(d))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
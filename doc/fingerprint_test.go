@@ -0,0 +1,64 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"testing"
+)
+
+func stackPackage(importPath string, decls ...string) *Package {
+	pdoc := &Package{
+		ImportPath: importPath,
+		Doc:        "Package stack implements a stack.\n",
+	}
+	t := &Type{Decl: Code{Text: decls[0]}}
+	for _, d := range decls[1:] {
+		t.Methods = append(t.Methods, &Func{Decl: Code{Text: d}})
+	}
+	pdoc.Types = []*Type{t}
+	return pdoc
+}
+
+func TestFingerprint(t *testing.T) {
+	original := stackPackage("github.com/user/stack",
+		"type Stack struct {\n    // contains filtered or unexported fields\n}",
+		"func (s *Stack) Push(v int)",
+		"func (s *Stack) Pop() int")
+	// The copy lists the same declarations in a different order.
+	copy := stackPackage("github.com/other/app/stack",
+		"type Stack struct {\n    // contains filtered or unexported fields\n}",
+		"func (s *Stack) Pop() int",
+		"func (s *Stack) Push(v int)")
+	small := stackPackage("github.com/user/small",
+		"type Stack []int",
+		"func (s *Stack) Push(v int)")
+
+	fp := fingerprint(original)
+	if fp == "" {
+		t.Fatal("fingerprint(original) is empty")
+	}
+	if fpCopy := fingerprint(copy); fpCopy != fp {
+		t.Errorf("fingerprint(copy) = %q, want %q", fpCopy, fp)
+	}
+
+	original.Doc = "Package stack implements a LIFO stack.\n"
+	if fpDoc := fingerprint(original); fpDoc == fp {
+		t.Errorf("fingerprint did not change with package comment")
+	}
+
+	if fpSmall := fingerprint(small); fpSmall != "" {
+		t.Errorf("fingerprint(small) = %q, want empty", fpSmall)
+	}
+}
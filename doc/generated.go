@@ -0,0 +1,54 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/ast"
+	"regexp"
+	"strings"
+)
+
+var generatedPattern = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGenerated returns true if the file is marked as generated code. By
+// convention, the marker comment is a line comment before the package
+// clause.
+func isGenerated(file *ast.File) bool {
+	for _, g := range file.Comments {
+		if g.Pos() >= file.Package {
+			break
+		}
+		for _, c := range g.List {
+			if generatedPattern.MatchString(strings.TrimRight(c.Text, "\r")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// goGenerateCommands returns the commands in the file's //go:generate
+// directives.
+func goGenerateCommands(file *ast.File) []string {
+	var commands []string
+	for _, g := range file.Comments {
+		for _, c := range g.List {
+			if strings.HasPrefix(c.Text, "//go:generate ") {
+				commands = append(commands, strings.TrimSpace(c.Text[len("//go:generate "):]))
+			}
+		}
+	}
+	return commands
+}
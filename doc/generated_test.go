@@ -0,0 +1,71 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+)
+
+var generatedTests = []struct {
+	name      string
+	src       string
+	generated bool
+	commands  []string
+}{
+	{"generated.go", `// Code generated by stringer -type=Color; DO NOT EDIT.
+
+package color
+
+func (c Color) String() string { return "" }
+`, true, nil},
+	{"color.go", `// Package color defines colors.
+package color
+
+//go:generate stringer -type=Color
+//go:generate   go run gen.go
+
+// Color is a color.
+type Color int
+`, false, []string{"stringer -type=Color", "go run gen.go"}},
+	{"late.go", `package color
+
+// Code generated by hand; DO NOT EDIT.
+var x int
+`, false, nil},
+	{"loose.go", `/* Code generated by tool; DO NOT EDIT. */
+
+// Code generated by tool, do not edit.
+// This file was generated. DO NOT EDIT.
+package color
+`, false, nil},
+}
+
+func TestGenerated(t *testing.T) {
+	for _, tt := range generatedTests {
+		file, err := parser.ParseFile(token.NewFileSet(), tt.name, tt.src, parser.ParseComments)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if g := isGenerated(file); g != tt.generated {
+			t.Errorf("isGenerated(%s) = %v, want %v", tt.name, g, tt.generated)
+		}
+		if c := goGenerateCommands(file); !reflect.DeepEqual(c, tt.commands) {
+			t.Errorf("goGenerateCommands(%s) = %q, want %q", tt.name, c, tt.commands)
+		}
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 type NotFoundError struct {
@@ -44,8 +46,21 @@ type RemoteError struct {
 	err  error
 }
 
+// Error returns the error message with credentials removed.
 func (e *RemoteError) Error() string {
-	return e.err.Error()
+	return scrubCredentials(e.err.Error())
+}
+
+// RateLimitError is returned when a repository host refuses a request
+// because the rate limit is exceeded. The request can be tried again after
+// Reset.
+type RateLimitError struct {
+	Host  string
+	Reset time.Time
+}
+
+func (e RateLimitError) Error() string {
+	return "rate limit exceeded for " + e.Host + " until " + e.Reset.UTC().Format(time.RFC3339)
 }
 
 var (
@@ -57,7 +72,7 @@ var (
 type service struct {
 	pattern         *regexp.Regexp
 	prefix          string
-	get             func(*http.Client, map[string]string, string) (*Package, error)
+	get             func(*http.Client, map[string]string, string, map[string]string) (*Package, error)
 	getPresentation func(*http.Client, map[string]string) (*Presentation, error)
 }
 
@@ -105,6 +120,8 @@ func fetchMeta(client *http.Client, importPath string) (map[string]string, error
 
 func parseMeta(scheme, importPath string, r io.Reader) (map[string]string, error) {
 	var match map[string]string
+	var content string
+	var prefixes []string
 
 	d := xml.NewDecoder(r)
 	d.Strict = false
@@ -128,18 +145,29 @@ metaScan:
 				continue metaScan
 			}
 			f := strings.Fields(attrValue(t.Attr, "content"))
-			if len(f) != 3 ||
-				!strings.HasPrefix(importPath, f[0]) ||
-				!(len(importPath) == len(f[0]) || importPath[len(f[0])] == '/') {
+			if len(f) != 3 {
+				continue metaScan
+			}
+			projectRoot, vcs, repo := strings.TrimSuffix(f[0], "/"), f[1], f[2]
+			if !strings.HasPrefix(importPath, projectRoot) ||
+				!(len(importPath) == len(projectRoot) || importPath[len(projectRoot)] == '/') {
+				prefixes = append(prefixes, projectRoot)
 				continue metaScan
 			}
 			if match != nil {
+				if strings.Join(f, " ") == content {
+					// Ignore a repeated tag.
+					continue metaScan
+				}
 				return nil, NotFoundError{"More than one <meta> found at " + scheme + "://" + importPath}
 			}
-
-			projectRoot, vcs, repo := f[0], f[1], f[2]
+			content = strings.Join(f, " ")
 
 			repo = strings.TrimSuffix(repo, "."+vcs)
+			if strings.HasPrefix(repo, "//") {
+				// The repository URL is relative to the scheme of the page.
+				repo = scheme + ":" + repo
+			}
 			i := strings.Index(repo, "://")
 			if i < 0 {
 				return nil, NotFoundError{"Bad repo URL in <meta>."}
@@ -154,7 +182,7 @@ metaScan:
 				"vcs":        vcs,
 				"dir":        importPath[len(projectRoot):],
 
-				// Used in getVCSDoc
+				// Used in getVCSDoc and getHgwebDoc.
 				"scheme": proto,
 
 				// Used in getDynamic.
@@ -165,31 +193,108 @@ metaScan:
 		}
 	}
 	if match == nil {
+		if len(prefixes) > 0 {
+			return nil, NotFoundError{"The <meta name=\"go-import\"> prefix " + strings.Join(prefixes, ", ") + " at " + scheme + "://" + importPath + " is not a prefix of the import path."}
+		}
 		return nil, NotFoundError{"<meta> not found."}
 	}
 	return match, nil
 }
 
-// getDynamic gets a document from a service that is not statically known.
-func getDynamic(client *http.Client, importPath, etag string) (*Package, error) {
+// metaCacheTTL is the time that the go-import meta tag of a project root is
+// used without fetching the tag again.
+const metaCacheTTL = time.Hour
+
+// metaCache holds the meta tag matches of project roots so that the
+// packages below a vanity import path do not fetch the meta tag again. A
+// repository nested below a cached root is found after the entry expires.
+var metaCache = struct {
+	sync.Mutex
+	m map[string]metaCacheEntry
+}{m: make(map[string]metaCacheEntry)}
+
+type metaCacheEntry struct {
+	match   map[string]string
+	expires time.Time
+}
+
+// cachedMeta returns the match for importPath from the cached match of a
+// project root that is importPath or a parent of importPath.
+func cachedMeta(importPath string, now time.Time) (map[string]string, bool) {
+	metaCache.Lock()
+	defer metaCache.Unlock()
+	for p := importPath; ; p = path.Dir(p) {
+		if e, ok := metaCache.m[p]; ok {
+			if now.After(e.expires) {
+				delete(metaCache.m, p)
+			} else {
+				match := make(map[string]string, len(e.match))
+				for k, v := range e.match {
+					match[k] = v
+				}
+				match["importPath"] = importPath
+				match["dir"] = importPath[len(p):]
+				return match, true
+			}
+		}
+		if !strings.Contains(p, "/") {
+			return nil, false
+		}
+	}
+}
+
+func cacheMeta(match map[string]string, now time.Time) {
+	metaCache.Lock()
+	metaCache.m[match["projectRoot"]] = metaCacheEntry{match, now.Add(metaCacheTTL)}
+	metaCache.Unlock()
+}
+
+// resolveMeta returns the match for the go-import meta tag of importPath.
+// The meta tag at the project root declared by the tag must declare the
+// same root.
+func resolveMeta(client *http.Client, importPath string) (map[string]string, error) {
+	now := time.Now()
+	if match, ok := cachedMeta(importPath, now); ok {
+		return match, nil
+	}
 	match, err := fetchMeta(client, importPath)
 	if err != nil {
 		return nil, err
 	}
-
+	rootMatch := match
 	if match["projectRoot"] != importPath {
-		rootMatch, err := fetchMeta(client, match["projectRoot"])
+		rootMatch, err = fetchMeta(client, match["projectRoot"])
 		if err != nil {
 			return nil, err
 		}
 		if rootMatch["projectRoot"] != match["projectRoot"] {
-			return nil, NotFoundError{"Project root mismatch."}
+			return nil, NotFoundError{"Project root mismatch: the <meta> tag at " + importPath + " declares " + match["projectRoot"] + ", the tag at " + match["projectRoot"] + " declares " + rootMatch["projectRoot"] + "."}
 		}
 	}
+	cacheMeta(rootMatch, now)
+	return match, nil
+}
 
-	pdoc, err := getStatic(client, expand("{repo}{dir}", match), importPath, etag)
+// getDynamic gets a document from a service that is not statically known.
+func getDynamic(client *http.Client, importPath, etag string, defaultTags map[string]string) (*Package, error) {
+	match, err := resolveMeta(client, importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The repository can be on a host that is not active.
+	if err := checkServiceState(match["repo"]); err != nil {
+		return nil, err
+	}
+
+	pdoc, err := getStatic(client, expand("{repo}{dir}", match), importPath, etag, defaultTags)
+	// Mercurial repositories are read from the hgweb server if there is
+	// one and with a checkout otherwise.
+	if err == errNoMatch && match["vcs"] == "hg" {
+		pdoc, err = getHgwebDoc(client, match, etag, defaultTags)
+	}
 	if err == errNoMatch {
-		pdoc, err = getVCSDoc(client, match, etag)
+		pdoc, err = getVCSDoc(client, match, etag, defaultTags)
 	}
 	if err != nil {
 		return nil, err
@@ -205,8 +310,13 @@ func getDynamic(client *http.Client, importPath, etag string) (*Package, error)
 }
 
 // getStatic gets a document from a statically known service. getStatic
-// returns errNoMatch if the import path is not recognized.
-func getStatic(client *http.Client, importPath, originalImportPath, etag string) (*Package, error) {
+// returns errNoMatch if the import path is not recognized. The defaultTags
+// map specifies the branch documented for each VCS when the repository host
+// does not report a default branch.
+func getStatic(client *http.Client, importPath, originalImportPath, etag string, defaultTags map[string]string) (*Package, error) {
+	if c, ok := hostedService(importPath); ok {
+		return getHostedDoc(client, c, importPath, originalImportPath, etag, defaultTags)
+	}
 	for _, s := range services {
 		if s.get == nil || !strings.HasPrefix(importPath, s.prefix) {
 			continue
@@ -224,12 +334,27 @@ func getStatic(client *http.Client, importPath, originalImportPath, etag string)
 				match[n] = m[i]
 			}
 		}
-		return s.get(client, match, etag)
+		return s.get(client, match, etag, defaultTags)
 	}
 	return nil, errNoMatch
 }
 
-func Get(client *http.Client, importPath string, etag string) (pdoc *Package, err error) {
+// Get gets the documentation for the package at the tag or branch chosen by
+// bestTag. ErrNotModified is returned if the documentation is not modified
+// since the fetch that returned etag.
+func Get(client *http.Client, importPath string, etag string) (*Package, error) {
+	return GetRef(client, importPath, "", etag)
+}
+
+// GetRef gets the documentation for the package at the tag or branch ref.
+// The tag or branch is chosen by bestTag if ref is "". A NotFoundError that
+// names the ref is returned if the repository does not have the ref or the
+// repository host does not support documenting a ref.
+func GetRef(client *http.Client, importPath string, ref string, etag string) (pdoc *Package, err error) {
+
+	if err := checkServiceState(importPath); err != nil {
+		return nil, err
+	}
 
 	const versionPrefix = PackageVersion + "-"
 
@@ -240,12 +365,18 @@ func Get(client *http.Client, importPath string, etag string) (pdoc *Package, er
 	}
 
 	switch {
+	case IsGoRepoPath(importPath) && ref != "":
+		return nil, NotFoundError{"Tag or branch " + ref + " not available for standard packages."}
 	case IsGoRepoPath(importPath):
 		pdoc, err = getStandardDoc(client, importPath, etag)
 	case IsValidRemotePath(importPath):
-		pdoc, err = getStatic(client, importPath, importPath, etag)
+		defaultTags := newDefaultTags()
+		if ref != "" {
+			defaultTags[refKey] = ref
+		}
+		pdoc, err = getStatic(client, importPath, importPath, etag, defaultTags)
 		if err == errNoMatch {
-			pdoc, err = getDynamic(client, importPath, etag)
+			pdoc, err = getDynamic(client, importPath, etag, defaultTags)
 		}
 	default:
 		err = errNoMatch
@@ -260,6 +391,13 @@ func Get(client *http.Client, importPath string, etag string) (pdoc *Package, er
 		if pdoc.ImportPath != importPath {
 			return nil, fmt.Errorf("Get: pdoc.ImportPath = %q, want %q", pdoc.ImportPath, importPath)
 		}
+		if ref != "" {
+			// Fetchers that do not list tags and branches ignore the ref.
+			if pdoc.DefaultBranch != ref {
+				return nil, NotFoundError{"Tag or branch " + ref + " not available for " + importPath + "."}
+			}
+			pdoc.ResolvedFrom.Kind = ResolvedExplicit
+		}
 	}
 
 	return pdoc, err
@@ -274,6 +412,9 @@ func GetPresentation(client *http.Client, importPath string) (*Presentation, err
 
 	importPath, file := path.Split(importPath)
 	importPath = strings.TrimSuffix(importPath, "/")
+	if err := checkServiceState(importPath); err != nil {
+		return nil, err
+	}
 	for _, s := range services {
 		if s.getPresentation == nil || !strings.HasPrefix(importPath, s.prefix) {
 			continue
@@ -0,0 +1,125 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var parseMetaTests = []struct {
+	importPath string
+	html       string
+	root       string
+	repo       string
+	dir        string
+	err        string
+}{
+	{
+		"example.com/pdf/sub",
+		`<meta name="go-import" content="example.com/pdf git https://github.com/user/pdf">`,
+		"example.com/pdf", "github.com/user/pdf", "/sub", "",
+	},
+	{
+		"example.com/pdf",
+		`<meta name="go-import" content="example.com/other git https://github.com/user/other">
+		<meta name="go-import" content="example.com/pdf/ hg https://hg.example.com/pdf">`,
+		"example.com/pdf", "hg.example.com/pdf", "", "",
+	},
+	{
+		"example.com/pdf",
+		`<meta name="go-import" content="example.com/pdf git //git.example.com/pdf.git">`,
+		"example.com/pdf", "git.example.com/pdf", "", "",
+	},
+	{
+		"example.com/pdf",
+		`<meta name="go-import" content="example.com/pdf git https://github.com/user/pdf">
+		<meta name="go-import" content="example.com/pdf git https://github.com/user/pdf">`,
+		"example.com/pdf", "github.com/user/pdf", "", "",
+	},
+	{
+		"example.com/pdf",
+		`<meta name="go-import" content="example.com/pdf git https://github.com/user/pdf">
+		<meta name="go-import" content="example.com/pdf git https://github.com/user/fork">`,
+		"", "", "", "More than one",
+	},
+	{
+		"example.com/pdfx",
+		`<meta name="go-import" content="example.com/pdf git https://github.com/user/pdf">`,
+		"", "", "", "prefix example.com/pdf at https://example.com/pdfx is not a prefix",
+	},
+	{
+		"example.com/pdf",
+		`<html><body><meta name="go-import" content="example.com/pdf git https://github.com/user/pdf">`,
+		"", "", "", "<meta> not found",
+	},
+}
+
+func TestParseMeta(t *testing.T) {
+	for _, tt := range parseMetaTests {
+		match, err := parseMeta("https", tt.importPath, strings.NewReader(tt.html))
+		if tt.err != "" {
+			if !IsNotFound(err) || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseMeta(%s) returned error %v, want NotFoundError containing %q", tt.importPath, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMeta(%s) returned error %v", tt.importPath, err)
+			continue
+		}
+		if match["projectRoot"] != tt.root || match["repo"] != tt.repo || match["dir"] != tt.dir {
+			t.Errorf("parseMeta(%s) = root %q, repo %q, dir %q, want %q, %q, %q", tt.importPath,
+				match["projectRoot"], match["repo"], match["dir"], tt.root, tt.repo, tt.dir)
+		}
+	}
+}
+
+func TestResolveMetaCache(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		w.Write([]byte(`<meta name="go-import" content="` + r.Host + `/pdf git https://github.com/user/pdf">`))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	defer func() { delete(metaCache.m, host+"/pdf") }()
+
+	match, err := resolveMeta(http.DefaultClient, host+"/pdf/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match["projectRoot"] != host+"/pdf" || match["dir"] != "/sub" {
+		t.Errorf("resolveMeta(pdf/sub) = %v", match)
+	}
+	n := len(requests)
+
+	match, err = resolveMeta(http.DefaultClient, host+"/pdf/other/deep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match["projectRoot"] != host+"/pdf" || match["dir"] != "/other/deep" || match["importPath"] != host+"/pdf/other/deep" {
+		t.Errorf("resolveMeta(pdf/other/deep) = %v", match)
+	}
+	if len(requests) != n {
+		t.Errorf("resolveMeta(pdf/other/deep) fetched %v, want cached root", requests[n:])
+	}
+
+	if _, err := resolveMeta(http.DefaultClient, host+"/pdfx"); !IsNotFound(err) {
+		t.Errorf("resolveMeta(pdfx) returned error %v, want NotFoundError", err)
+	}
+}
@@ -0,0 +1,617 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Limits on the data read from a Git server. A shallow fetch returns every
+// file in the repository at the commit, not only the files in the package
+// directory.
+const (
+	gitMaxRefsBytes     = 1 << 20
+	gitMaxPackBytes     = 32 << 20
+	gitMaxUnpackedBytes = 128 << 20
+)
+
+// Types of objects in a Git pack.
+const (
+	gitCommit   = 1
+	gitTree     = 2
+	gitBlob     = 3
+	gitTag      = 4
+	gitOfsDelta = 6
+	gitRefDelta = 7
+)
+
+var gitTypeNames = map[int]string{
+	gitCommit: "commit",
+	gitTree:   "tree",
+	gitBlob:   "blob",
+	gitTag:    "tag",
+}
+
+var errGitPack = errors.New("git: bad pack")
+
+// gitRefs is the reference advertisement of a Git repository.
+type gitRefs struct {
+	// Commits of the branches and tags by name.
+	tags map[string]string
+
+	// Names of the tags.
+	tagNames []string
+
+	// Branch of HEAD or "" if the server does not report the branch.
+	head string
+
+	// Capabilities of the server.
+	caps map[string]bool
+}
+
+// readPktLine reads a line in the Git packet line format. The line is nil
+// for a flush packet.
+func readPktLine(r io.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseUint(string(n[:]), 16, 16)
+	if err != nil || (size > 0 && size < 4) {
+		return nil, errors.New("git: bad packet line length")
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	p := make([]byte, size-4)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// pktLine returns s in the Git packet line format.
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// getGitRefs gets the references of the repository at base with the smart
+// HTTP protocol. errNoMatch is returned if the server does not support the
+// smart protocol.
+func getGitRefs(client *http.Client, base string) (*gitRefs, error) {
+	req, err := http.NewRequest("GET", base+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	setCredentials(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &RemoteError{req.URL.Host, err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		return nil, errNoMatch
+	}
+	r := bufio.NewReader(io.LimitReader(resp.Body, gitMaxRefsBytes))
+
+	refs := &gitRefs{tags: make(map[string]string), caps: make(map[string]bool)}
+	peeled := make(map[string]string)
+	first := true
+	for {
+		p, err := readPktLine(r)
+		if err != nil {
+			return nil, &RemoteError{req.URL.Host, err}
+		}
+		if first && bytes.HasPrefix(p, []byte("# service=")) {
+			// Skip the service announcement and the flush that ends it.
+			if _, err := readPktLine(r); err != nil {
+				return nil, &RemoteError{req.URL.Host, err}
+			}
+			continue
+		}
+		if p == nil {
+			break
+		}
+		line := strings.TrimSuffix(string(p), "\n")
+		if first {
+			first = false
+			if i := strings.IndexByte(line, 0); i >= 0 {
+				for _, c := range strings.Fields(line[i+1:]) {
+					refs.caps[c] = true
+					if strings.HasPrefix(c, "symref=HEAD:refs/heads/") {
+						refs.head = c[len("symref=HEAD:refs/heads/"):]
+					}
+				}
+				line = line[:i]
+			}
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 || len(f[0]) != 40 {
+			continue
+		}
+		id, name := f[0], f[1]
+		switch {
+		case strings.HasPrefix(name, "refs/heads/"):
+			refs.tags[name[len("refs/heads/"):]] = id
+		case strings.HasPrefix(name, "refs/tags/") && strings.HasSuffix(name, "^{}"):
+			peeled[name[len("refs/tags/"):len(name)-len("^{}")]] = id
+		case strings.HasPrefix(name, "refs/tags/"):
+			name = name[len("refs/tags/"):]
+			refs.tags[name] = id
+			refs.tagNames = append(refs.tagNames, name)
+		}
+	}
+	// Annotated tags refer to the commit through the peeled reference.
+	for name, id := range peeled {
+		refs.tags[name] = id
+	}
+	return refs, nil
+}
+
+// fetchGitPack fetches a pack with the objects of the commit from the
+// repository at base. The fetch is shallow if the server supports it.
+func fetchGitPack(client *http.Client, base, commit string, caps map[string]bool) ([]byte, error) {
+	var want []string
+	for _, c := range []string{"ofs-delta", "shallow", "no-progress"} {
+		if caps[c] {
+			want = append(want, c)
+		}
+	}
+	body := pktLine("want " + commit + " " + strings.Join(want, " ") + "\n")
+	if caps["shallow"] {
+		body += pktLine("deepen 1\n")
+	}
+	body += "0000" + pktLine("done\n")
+
+	req, err := http.NewRequest("POST", base+"/git-upload-pack", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	setCredentials(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &RemoteError{req.URL.Host, err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &RemoteError{req.URL.Host, fmt.Errorf("post %s -> %d", req.URL, resp.StatusCode)}
+	}
+	r := bufio.NewReader(io.LimitReader(resp.Body, gitMaxPackBytes+1))
+
+	// The pack follows the shallow updates and the NAK.
+	for {
+		p, err := readPktLine(r)
+		if err != nil {
+			return nil, &RemoteError{req.URL.Host, err}
+		}
+		if bytes.HasPrefix(p, []byte("ERR ")) {
+			return nil, &RemoteError{req.URL.Host, errors.New(strings.TrimSpace(string(p)))}
+		}
+		if bytes.HasPrefix(p, []byte("NAK")) || bytes.HasPrefix(p, []byte("ACK")) {
+			break
+		}
+	}
+	pack, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &RemoteError{req.URL.Host, err}
+	}
+	if len(pack) > gitMaxPackBytes {
+		return nil, NotFoundError{"Repository is too large."}
+	}
+	return pack, nil
+}
+
+// gitObject is an object in a Git repository.
+type gitObject struct {
+	typ  int
+	data []byte
+}
+
+// gitObjectID returns the name of an object.
+func gitObjectID(typ int, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", gitTypeNames[typ], len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// gitDelta is a deltified object in a pack. The base is named by id for a
+// ref delta and by the offset in the pack for an offset delta.
+type gitDelta struct {
+	offset     int64
+	baseID     string
+	baseOffset int64
+	data       []byte
+}
+
+// readGitPack returns the objects in a pack by name.
+func readGitPack(pack []byte) (map[string]*gitObject, error) {
+	if len(pack) < 12 || string(pack[:4]) != "PACK" {
+		return nil, errGitPack
+	}
+	if v := binary.BigEndian.Uint32(pack[4:8]); v != 2 && v != 3 {
+		return nil, fmt.Errorf("git: pack version %d not supported", v)
+	}
+	n := binary.BigEndian.Uint32(pack[8:12])
+
+	objects := make(map[string]*gitObject)
+	byOffset := make(map[int64]*gitObject)
+	var deltas []*gitDelta
+	unpacked := 0
+
+	r := bytes.NewReader(pack[12:])
+	for i := uint32(0); i < n; i++ {
+		offset := int64(len(pack) - r.Len())
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, errGitPack
+		}
+		typ := int(c>>4) & 7
+		size := uint64(c & 0xf)
+		for shift := uint(4); c&0x80 != 0; shift += 7 {
+			if c, err = r.ReadByte(); err != nil || shift > 56 {
+				return nil, errGitPack
+			}
+			size |= uint64(c&0x7f) << shift
+		}
+
+		var d *gitDelta
+		switch typ {
+		case gitCommit, gitTree, gitBlob, gitTag:
+		case gitOfsDelta:
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, errGitPack
+			}
+			rel := int64(c & 0x7f)
+			for c&0x80 != 0 {
+				if c, err = r.ReadByte(); err != nil || rel > offset {
+					return nil, errGitPack
+				}
+				rel = (rel+1)<<7 | int64(c&0x7f)
+			}
+			d = &gitDelta{offset: offset, baseOffset: offset - rel}
+		case gitRefDelta:
+			var id [20]byte
+			if _, err := io.ReadFull(r, id[:]); err != nil {
+				return nil, errGitPack
+			}
+			d = &gitDelta{offset: offset, baseID: hex.EncodeToString(id[:])}
+		default:
+			return nil, errGitPack
+		}
+
+		unpacked += int(size)
+		if size > gitMaxUnpackedBytes || unpacked > gitMaxUnpackedBytes {
+			return nil, NotFoundError{"Repository is too large."}
+		}
+		data, err := inflateGitObject(r, int64(size))
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			d.data = data
+			deltas = append(deltas, d)
+			continue
+		}
+		o := &gitObject{typ, data}
+		objects[gitObjectID(typ, data)] = o
+		byOffset[offset] = o
+	}
+
+	// A base can follow the delta in the pack. Resolve the deltas with
+	// available bases until no more can be resolved.
+	for len(deltas) > 0 {
+		var pending []*gitDelta
+		for _, d := range deltas {
+			base := byOffset[d.baseOffset]
+			if d.baseID != "" {
+				base = objects[d.baseID]
+			}
+			if base == nil {
+				pending = append(pending, d)
+				continue
+			}
+			data, err := applyGitDelta(base.data, d.data)
+			if err != nil {
+				return nil, err
+			}
+			unpacked += len(data)
+			if unpacked > gitMaxUnpackedBytes {
+				return nil, NotFoundError{"Repository is too large."}
+			}
+			o := &gitObject{base.typ, data}
+			objects[gitObjectID(o.typ, data)] = o
+			byOffset[d.offset] = o
+		}
+		if len(pending) == len(deltas) {
+			return nil, errors.New("git: delta base not found in pack")
+		}
+		deltas = pending
+	}
+	return objects, nil
+}
+
+// inflateGitObject reads a compressed object of the given size from r. The
+// reader is left at the end of the compressed data.
+func inflateGitObject(r *bytes.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, errGitPack
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(zr, size))
+	if err != nil || int64(len(data)) != size {
+		return nil, errGitPack
+	}
+	// Read to the end of the stream to consume the checksum.
+	var extra [1]byte
+	if n, err := zr.Read(extra[:]); n != 0 || err != io.EOF {
+		return nil, errGitPack
+	}
+	return data, nil
+}
+
+// readGitDeltaSize reads a size from the header of a delta.
+func readGitDeltaSize(p []byte) (int, []byte, error) {
+	var size uint64
+	for shift := uint(0); ; shift += 7 {
+		if len(p) == 0 || shift > 56 {
+			return 0, nil, errGitPack
+		}
+		c := p[0]
+		p = p[1:]
+		size |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	if size > gitMaxUnpackedBytes {
+		return 0, nil, NotFoundError{"Repository is too large."}
+	}
+	return int(size), p, nil
+}
+
+// applyGitDelta returns the object created by applying delta to base.
+func applyGitDelta(base, delta []byte) ([]byte, error) {
+	baseSize, delta, err := readGitDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != len(base) {
+		return nil, errGitPack
+	}
+	size, delta, err := readGitDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, 0, size)
+	for len(delta) > 0 {
+		c := delta[0]
+		delta = delta[1:]
+		switch {
+		case c&0x80 != 0:
+			// Copy from the base. The bits of c select the bytes of the
+			// offset and size that follow.
+			var offset, n int
+			for i := uint(0); i < 7; i++ {
+				if c&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errGitPack
+				}
+				if i < 4 {
+					offset |= int(delta[0]) << (8 * i)
+				} else {
+					n |= int(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if offset+n > len(base) || len(p)+n > size {
+				return nil, errGitPack
+			}
+			p = append(p, base[offset:offset+n]...)
+		case c != 0:
+			// Insert the bytes that follow.
+			n := int(c)
+			if n > len(delta) || len(p)+n > size {
+				return nil, errGitPack
+			}
+			p = append(p, delta[:n]...)
+			delta = delta[n:]
+		default:
+			return nil, errGitPack
+		}
+	}
+	if len(p) != size {
+		return nil, errGitPack
+	}
+	return p, nil
+}
+
+// gitTreeEntry is an entry in a Git tree object.
+type gitTreeEntry struct {
+	mode string
+	name string
+	id   string
+}
+
+// gitTreeEntries returns the entries of the tree with the given name.
+func gitTreeEntries(objects map[string]*gitObject, id string) ([]gitTreeEntry, error) {
+	o := objects[id]
+	if o == nil || o.typ != gitTree {
+		return nil, errors.New("git: tree " + id + " not found in pack")
+	}
+	var entries []gitTreeEntry
+	p := o.data
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, ' ')
+		j := bytes.IndexByte(p, 0)
+		if i < 0 || j < i || len(p) < j+21 {
+			return nil, errGitPack
+		}
+		entries = append(entries, gitTreeEntry{
+			mode: string(p[:i]),
+			name: string(p[i+1 : j]),
+			id:   hex.EncodeToString(p[j+1 : j+21]),
+		})
+		p = p[j+21:]
+	}
+	return entries, nil
+}
+
+// getGitHTTPFiles fetches the documentation files for a package in a Git
+// repository with the smart HTTP protocol. The repository URL is
+// {scheme}://{repo}.git. The etag is the commit of the documented branch or
+// tag. errNoMatch is returned if the server does not support the protocol.
+func getGitHTTPFiles(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) ([]*source, string, error) {
+	base := expand("{scheme}://{repo}.git", match)
+
+	refs, err := getGitRefs(client, base)
+	if err != nil {
+		return nil, "", err
+	}
+	match["tags"] = strings.Join(refs.tagNames, " ")
+
+	match["tag"], match["commit"], err = chooseTag(refs.tags, refs.head, defaultTags, "git")
+	if err != nil {
+		return nil, "", err
+	}
+
+	etag := match["commit"]
+	if etag == savedEtag {
+		return nil, "", ErrNotModified
+	}
+
+	pack, err := fetchGitPack(client, base, match["commit"], refs.caps)
+	if err != nil {
+		return nil, "", err
+	}
+	objects, err := readGitPack(pack)
+	if err != nil {
+		return nil, "", err
+	}
+
+	commit := objects[match["commit"]]
+	if commit == nil || commit.typ != gitCommit || !bytes.HasPrefix(commit.data, []byte("tree ")) || len(commit.data) < 45 {
+		return nil, "", errors.New("git: commit " + match["commit"] + " not found in pack")
+	}
+	entries, err := gitTreeEntries(objects, string(commit.data[5:45]))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, name := range strings.Split(strings.Trim(match["dir"], "/"), "/") {
+		if name == "" {
+			continue
+		}
+		id := ""
+		for _, e := range entries {
+			if e.mode == "40000" && e.name == name {
+				id = e.id
+				break
+			}
+		}
+		if id == "" {
+			return nil, "", NotFoundError{expand("Directory {dir} not found at {tag}.", match)}
+		}
+		if entries, err = gitTreeEntries(objects, id); err != nil {
+			return nil, "", err
+		}
+	}
+
+	urlTemplate, urlMatch, _ := lookupURLTemplate(match["repo"], match["dir"], match["tag"])
+
+	var files []*source
+	for _, e := range entries {
+		// Symbolic links and submodules are skipped.
+		if (e.mode != "100644" && e.mode != "100755") || !isDocFile(e.name) {
+			continue
+		}
+		o := objects[e.id]
+		if o == nil || o.typ != gitBlob {
+			return nil, "", errors.New("git: blob " + e.id + " not found in pack")
+		}
+		files = append(files, &source{
+			name:      e.name,
+			browseURL: expand(urlTemplate, urlMatch, e.name),
+			data:      o.data,
+		})
+	}
+	return files, etag, nil
+}
+
+// getGitHTTPDoc gets the documentation for a package in a Git repository
+// served over HTTP without a provider API. The schemes are tried in order.
+// errNoMatch is returned if no scheme reaches a smart HTTP server so that the
+// caller can fall back to the git command.
+func getGitHTTPDoc(client *http.Client, match map[string]string, schemes []string, savedEtag string, defaultTags map[string]string) (*Package, error) {
+	for _, scheme := range schemes {
+		if scheme != "https" && scheme != "http" {
+			continue
+		}
+		m := make(map[string]string, len(match))
+		for k, v := range match {
+			m[k] = v
+		}
+		m["scheme"] = scheme
+		files, etag, err := getGitHTTPFiles(client, m, savedEtag, defaultTags)
+		if _, ok := err.(*RemoteError); ok || err == errNoMatch {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Source links are available only for repositories with a known
+		// web interface.
+		_, _, lineFmt := lookupURLTemplate(m["repo"], m["dir"], m["tag"])
+
+		b := &builder{
+			pdoc: &Package{
+				LineFmt:       lineFmt,
+				ImportPath:    m["importPath"],
+				ProjectRoot:   expand("{repo}.{vcs}", m),
+				ProjectName:   path.Base(m["repo"]),
+				Etag:          etag,
+				VCS:           "git",
+				DefaultBranch: m["tag"],
+				ResolvedFrom:  resolve(m["tag"], ""),
+			},
+			tags: strings.Fields(m["tags"]),
+		}
+		return b.build(files)
+	}
+	return nil, errNoMatch
+}
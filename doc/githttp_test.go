@@ -0,0 +1,234 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// gitPackWriter writes a pack for tests.
+type gitPackWriter struct {
+	buf     bytes.Buffer
+	n       uint32
+	offsets map[string]int
+}
+
+func (w *gitPackWriter) header(typ int, size int) {
+	c := byte(typ<<4) | byte(size&0xf)
+	size >>= 4
+	for size > 0 {
+		w.buf.WriteByte(c | 0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	w.buf.WriteByte(c)
+}
+
+func (w *gitPackWriter) deflate(p []byte) {
+	zw := zlib.NewWriter(&w.buf)
+	zw.Write(p)
+	zw.Close()
+}
+
+// object adds an object and returns its name.
+func (w *gitPackWriter) object(typ int, data string) string {
+	id := gitObjectID(typ, []byte(data))
+	w.offsets[id] = w.buf.Len()
+	w.header(typ, len(data))
+	w.deflate([]byte(data))
+	w.n++
+	return id
+}
+
+// delta adds a delta against the base with the given name. An offset delta
+// is written if ofs is true.
+func (w *gitPackWriter) delta(base string, ofs bool, delta []byte) {
+	offset := w.buf.Len()
+	if ofs {
+		w.header(gitOfsDelta, len(delta))
+		rel := offset - w.offsets[base]
+		var p []byte
+		p = append(p, byte(rel&0x7f))
+		for rel >>= 7; rel > 0; rel >>= 7 {
+			rel--
+			p = append([]byte{byte(0x80 | rel&0x7f)}, p...)
+		}
+		w.buf.Write(p)
+	} else {
+		w.header(gitRefDelta, len(delta))
+		id, _ := hex.DecodeString(base)
+		w.buf.Write(id)
+	}
+	w.deflate(delta)
+	w.n++
+}
+
+func (w *gitPackWriter) bytes() []byte {
+	var h [12]byte
+	copy(h[:], "PACK")
+	binary.BigEndian.PutUint32(h[4:], 2)
+	binary.BigEndian.PutUint32(h[8:], w.n)
+	return append(h[:], w.buf.Bytes()...)
+}
+
+// gitTreeData returns the data of a tree object with the given entries.
+func gitTreeData(entries ...gitTreeEntry) string {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		id, _ := hex.DecodeString(e.id)
+		buf.WriteString(e.mode + " " + e.name + "\x00")
+		buf.Write(id)
+	}
+	return buf.String()
+}
+
+// newGitHTTPServer returns a smart HTTP server for a repository at
+// /proj.git. The files sub/doc.go and sub/sub.go are stored as deltas.
+func newGitHTTPServer(t *testing.T) (*httptest.Server, string) {
+	w := &gitPackWriter{offsets: make(map[string]int)}
+	base := "package sub\n\nfunc A() {}\n"
+	baseID := w.object(gitBlob, base)
+	readme := w.object(gitBlob, "Package sub.\n")
+	makefile := w.object(gitBlob, "all:\n")
+	main := w.object(gitBlob, "package main\n")
+
+	// sub.go is base with a function appended. doc.go is the first line of
+	// base with a comment inserted before it.
+	subGo := base + "func B() {}\n"
+	docGo := "// Package sub does things.\npackage sub\n"
+	w.delta(baseID, true, append([]byte{byte(len(base)), byte(len(subGo)), 0x90, byte(len(base)), 12}, "func B() {}\n"...))
+	w.delta(baseID, false, append(append([]byte{byte(len(base)), byte(len(docGo)), 28}, "// Package sub does things.\n"...), 0x90, 12))
+
+	sub := w.object(gitTree, gitTreeData(
+		gitTreeEntry{"100644", "Makefile", makefile},
+		gitTreeEntry{"100644", "README", readme},
+		gitTreeEntry{"100644", "doc.go", gitObjectID(gitBlob, []byte(docGo))},
+		gitTreeEntry{"120000", "link.go", baseID},
+		gitTreeEntry{"100755", "sub.go", gitObjectID(gitBlob, []byte(subGo))},
+	))
+	root := w.object(gitTree, gitTreeData(
+		gitTreeEntry{"100644", "main.go", main},
+		gitTreeEntry{"40000", "sub", sub},
+	))
+	commit := w.object(gitCommit, "tree "+root+"\nauthor A <a@example.com> 0 +0000\ncommitter A <a@example.com> 0 +0000\n\nInitial.\n")
+	pack := w.bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/proj.git/info/refs":
+			if r.URL.Query().Get("service") != "git-upload-pack" {
+				http.NotFound(rw, r)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			rw.Write([]byte(pktLine("# service=git-upload-pack\n") + "0000" +
+				pktLine(commit+" HEAD\x00multi_ack shallow ofs-delta no-progress symref=HEAD:refs/heads/main\n") +
+				pktLine(commit+" refs/heads/main\n") +
+				pktLine("0000000000000000000000000000000000000001 refs/heads/old\n") +
+				"0000"))
+		case "/proj.git/git-upload-pack":
+			p, _ := ioutil.ReadAll(r.Body)
+			if !bytes.Contains(p, []byte("want "+commit+" ")) || !bytes.Contains(p, []byte("deepen 1\n")) {
+				t.Errorf("upload-pack request = %q, want shallow fetch of %s", p, commit)
+			}
+			rw.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			rw.Write([]byte(pktLine("shallow "+commit) + "0000" + pktLine("NAK\n")))
+			rw.Write(pack)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	return server, commit
+}
+
+func gitHTTPMatch(server *httptest.Server, dir string) map[string]string {
+	return map[string]string{
+		"repo":       strings.TrimPrefix(server.URL, "http://") + "/proj",
+		"vcs":        "git",
+		"dir":        dir,
+		"importPath": "example.com/proj.git" + dir,
+	}
+}
+
+func TestGitHTTPFiles(t *testing.T) {
+	server, commit := newGitHTTPServer(t)
+	defer server.Close()
+
+	match := gitHTTPMatch(server, "/sub")
+	match["scheme"] = "http"
+	files, etag, err := getGitHTTPFiles(http.DefaultClient, match, "", newDefaultTags())
+	if err != nil {
+		t.Fatalf("getGitHTTPFiles() returned error %v", err)
+	}
+	if etag != commit {
+		t.Errorf("etag = %q, want %q", etag, commit)
+	}
+	if match["tag"] != "main" {
+		t.Errorf("tag = %q, want main", match["tag"])
+	}
+	var names []string
+	data := make(map[string]string)
+	for _, f := range files {
+		names = append(names, f.name)
+		data[f.name] = string(f.data)
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, " "), "README doc.go sub.go"; got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+	if got, want := data["sub.go"], "package sub\n\nfunc A() {}\nfunc B() {}\n"; got != want {
+		t.Errorf("sub.go = %q, want %q", got, want)
+	}
+	if got, want := data["doc.go"], "// Package sub does things.\npackage sub\n"; got != want {
+		t.Errorf("doc.go = %q, want %q", got, want)
+	}
+
+	if _, _, err := getGitHTTPFiles(http.DefaultClient, match, etag, newDefaultTags()); err != ErrNotModified {
+		t.Errorf("getGitHTTPFiles(etag) returned error %v, want ErrNotModified", err)
+	}
+
+	match = gitHTTPMatch(server, "/missing")
+	match["scheme"] = "http"
+	if _, _, err := getGitHTTPFiles(http.DefaultClient, match, "", newDefaultTags()); !IsNotFound(err) {
+		t.Errorf("getGitHTTPFiles(/missing) returned error %v, want NotFoundError", err)
+	}
+}
+
+func TestGitHTTPSchemes(t *testing.T) {
+	server, commit := newGitHTTPServer(t)
+	defer server.Close()
+
+	// The https scheme fails on the test server and the http scheme is
+	// tried next.
+	if _, err := getGitHTTPDoc(http.DefaultClient, gitHTTPMatch(server, "/sub"), []string{"https", "http"}, commit, newDefaultTags()); err != ErrNotModified {
+		t.Errorf("getGitHTTPDoc(https, http) returned error %v, want ErrNotModified", err)
+	}
+
+	// Servers without the smart protocol are left to the git command.
+	match := gitHTTPMatch(server, "/sub")
+	match["repo"] += "/missing"
+	if _, err := getGitHTTPDoc(http.DefaultClient, match, []string{"http", "git"}, "", newDefaultTags()); err != errNoMatch {
+		t.Errorf("getGitHTTPDoc(dumb server) returned error %v, want errNoMatch", err)
+	}
+}
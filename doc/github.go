@@ -26,24 +26,18 @@ import (
 
 var githubRawHeader = http.Header{"Accept": {"application/vnd.github-blob.raw"}}
 var githubPattern = regexp.MustCompile(`^github\.com/(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<repo>[a-z0-9A-Z_.\-]+)(?P<dir>/[a-z0-9A-Z_.\-/]*)?$`)
-var githubCred string
-
-func SetGithubCredentials(id, secret string) {
-	githubCred = "client_id=" + id + "&client_secret=" + secret
-}
 
 type Person struct {
 	Projects []string
 }
 func GetGithubPerson(client *http.Client, match map[string]string)(*Person, error) {
-	match["cred"] = githubCred
 	var projects []*struct {
 		Full_Name string
 		Fork      bool
 		Language  string
 	}
 	
-	err := httpGetJSON(client, expand("https://api.github.com/users/{owner}/repos?{cred}", match), &projects)
+	err := httpGetJSON(client, expand("https://api.github.com/users/{owner}/repos", match), &projects)
 	if err != nil {
 		return nil, err
 	}
@@ -65,9 +59,23 @@ log.Printf("[GetGithubPerson] %s %v", match["owner"], projects)
 	return p, nil
 }
 
-func getGithubDoc(client *http.Client, match map[string]string, savedEtag string) (*Package, error) {
+// setGithubDefaults sets the API and web URLs of the public GitHub service in
+// match if the URLs are not set for a self-hosted service.
+func setGithubDefaults(match map[string]string) {
+	if match["api"] == "" {
+		match["api"] = "https://api.github.com"
+		match["web"] = "https://github.com"
+		match["host"] = "github.com"
+	}
+}
 
-	match["cred"] = githubCred
+// getGithubTag sets match["tag"] to the tag or branch to document and
+// match["tags"] to the space separated tags of the repository and returns
+// the commit for the tag and the number of watchers. The number of watchers
+// is -1 if the repository information is not available. ErrNotModified is
+// returned if the commit is savedEtag.
+func getGithubTag(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) (string, int, error) {
+	setGithubDefaults(match)
 
 	var refs []*struct {
 		Object struct {
@@ -79,107 +87,133 @@ func getGithubDoc(client *http.Client, match map[string]string, savedEtag string
 		Url string
 	}
 
-	err := httpGetJSON(client, expand("https://api.github.com/repos/{owner}/{repo}/git/refs?{cred}", match), &refs)
+	err := httpGetJSON(client, expand("{api}/repos/{owner}/{repo}/git/refs", match), &refs)
 	if err != nil {
-		return nil, err
+		return "", -1, err
 	}
 
 	tags := make(map[string]string)
+	var tagNames, branches []string
 	for _, ref := range refs {
 		switch {
 		case strings.HasPrefix(ref.Ref, "refs/heads/"):
 			tags[ref.Ref[len("refs/heads/"):]] = ref.Object.Sha
+			branches = append(branches, ref.Ref[len("refs/heads/"):])
 		case strings.HasPrefix(ref.Ref, "refs/tags/"):
 			tags[ref.Ref[len("refs/tags/"):]] = ref.Object.Sha
+			tagNames = append(tagNames, ref.Ref[len("refs/tags/"):])
 		}
 	}
+	match["tags"] = strings.Join(tagNames, " ")
 
-	var commit string
-	match["tag"], commit, err = bestTag(tags, "master")
-	if err != nil {
-		return nil, err
+	// The default branch is not needed to choose the tag when a tag or
+	// branch is requested, when the repository has the go1 tag or when the
+	// repository has one branch. The repository information is then fetched
+	// only for a modified commit, so that a refresh of an unchanged
+	// repository makes one API request. On a case-insensitive host, the
+	// repository information is always fetched because the case of the
+	// path is checked before the commit.
+	userRepo := match["owner"] + "/" + match["repo"]
+	if (defaultTags[refKey] != "" || tags["go1"] != "" || len(branches) == 1) && FoldImportPath(match["host"]+"/"+userRepo) == "" {
+		var defaultBranch string
+		if len(branches) == 1 {
+			defaultBranch = branches[0]
+		}
+		if _, commit, err := chooseTag(tags, defaultBranch, defaultTags, "git"); err == nil && commit == savedEtag {
+			return "", -1, ErrNotModified
+		}
 	}
 
-	if commit == savedEtag {
-		return nil, ErrNotModified
-	}
-	
+	// The repository information includes the default branch.
 	var repoInfo struct {
-		Watchers int `json:"watchers"`
+		Watchers      int    `json:"watchers"`
+		DefaultBranch string `json:"default_branch"`
+		FullName      string `json:"full_name"`
 	}
 	var starCount = -1
 
-	err = httpGetJSON(client, expand("https://api.github.com/repos/{owner}/{repo}?{cred}", match), &repoInfo)
+	err = httpGetJSON(client, expand("{api}/repos/{owner}/{repo}", match), &repoInfo)
 	if err == nil {
 		starCount = repoInfo.Watchers
 	}
+
+	// GitHub reports the repository name with the correct case.
+	if repoInfo.FullName != userRepo &&
+		strings.EqualFold(repoInfo.FullName, userRepo) &&
+		FoldImportPath(match["host"]+"/"+userRepo) != "" {
+		return "", -1, CanonicalPathError{match["host"] + "/" + repoInfo.FullName + match["dir"]}
+	}
 	log.Printf("[github-star]: %v, [%d]", err, repoInfo.Watchers)
 
-	var tree struct {
-		Tree []struct {
-			Url  string
-			Path string
-			Type string
-		}
-		Url string
+	var commit string
+	match["defaultBranch"] = repoInfo.DefaultBranch
+	match["tag"], commit, err = chooseTag(tags, repoInfo.DefaultBranch, defaultTags, "git")
+	if err != nil {
+		return "", -1, err
+	}
+	if commit == savedEtag {
+		return "", -1, ErrNotModified
 	}
+	return commit, starCount, nil
+}
+
+func getGithubDoc(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) (*Package, error) {
 
-	err = httpGetJSON(client, expand("https://api.github.com/repos/{owner}/{repo}/git/trees/{tag}?recursive=1&{cred}", match), &tree)
+	commit, starCount, err := getGithubTag(client, match, savedEtag, defaultTags)
 	if err != nil {
 		return nil, err
 	}
 
-	// Because Github API URLs are case-insensitive, we need to check that the
-	// userRepo returned from Github matches the one that we are requesting.
-	if !strings.HasPrefix(tree.Url, expand("https://api.github.com/repos/{owner}/{repo}/", match)) {
-		return nil, NotFoundError{"Github import path has incorrect case."}
-	}
+	projectRoot := expand("{host}/{owner}/{repo}", match)
+	monorepo := IsMonorepo(projectRoot)
 
-	inTree := false
-	dirPrefix := match["dir"]
-	if dirPrefix != "" {
-		dirPrefix = dirPrefix[1:] + "/"
-	}
 	var files []*source
-	for _, node := range tree.Tree {
-		if node.Type != "blob" || !strings.HasPrefix(node.Path, dirPrefix) {
-			continue
-		}
-		inTree = true
-		if d, f := path.Split(node.Path); d == dirPrefix && isDocFile(f) {
-			files = append(files, &source{
-				name:      f,
-				browseURL: expand("https://github.com/{owner}/{repo}/blob/{tag}/{0}", match, node.Path),
-				rawURL:    node.Url + "?" + githubCred,
-			})
+	var subdirs []string
+	if !monorepo {
+		var truncated bool
+		files, truncated, err = getGithubTree(client, match)
+		if err != nil {
+			return nil, err
 		}
+		// GitHub truncates the trees of very large repositories.
+		monorepo = truncated
 	}
-
-	if !inTree {
-		return nil, NotFoundError{"Directory tree does not contain Go files."}
+	if monorepo {
+		files, subdirs, err = getGithubDir(client, match)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if err := fetchFiles(client, files, githubRawHeader); err != nil {
+	if err := fetchChangedFiles(client, files, githubRawHeader); err != nil {
 		return nil, err
 	}
 
-	browseURL := expand("https://github.com/{owner}/{repo}", match)
-	if match["dir"] != "" {
-		browseURL = expand("https://github.com/{owner}/{repo}/tree/{tag}{dir}", match)
+	browseURL := expand("{web}/{owner}/{repo}", match)
+	if match["dir"] != "" || defaultTags[refKey] != "" {
+		browseURL = expand("{web}/{owner}/{repo}/tree/{tag}{dir}", match)
 	}
 
 	b := &builder{
 		pdoc: &Package{
-			LineFmt:     "%s#L%d",
-			ImportPath:  match["originalImportPath"],
-			ProjectRoot: expand("github.com/{owner}/{repo}", match),
-			ProjectName: match["repo"],
-			ProjectURL:  expand("https://github.com/{owner}/{repo}", match),
-			BrowseURL:   browseURL,
-			Etag:        commit,
-			VCS:         "git",
-			StarCount:   starCount,
+			LineFmt:       "%s#L%d",
+			ImportPath:    match["originalImportPath"],
+			ProjectRoot:   projectRoot,
+			ProjectName:   match["repo"],
+			ProjectURL:    expand("{web}/{owner}/{repo}", match),
+			BrowseURL:     browseURL,
+			Etag:          commit,
+			VCS:           "git",
+			DefaultBranch: match["tag"],
+			ResolvedFrom:  resolve(match["tag"], match["defaultBranch"]),
+			StarCount:     starCount,
+			Monorepo:      monorepo,
 		},
+		tags:     strings.Fields(match["tags"]),
+		symlinks: strings.Fields(match["symlinks"]),
+	}
+	if monorepo {
+		b.pdoc.Subdirectories = subdirs
 	}
 
 	return b.build(files)
@@ -187,14 +221,12 @@ func getGithubDoc(client *http.Client, match map[string]string, savedEtag string
 
 func getGithubPresentation(client *http.Client, match map[string]string) (*Presentation, error) {
 
-	match["cred"] = githubCred
-
-	p, err := httpGetBytes(client, expand("https://api.github.com/repos/{owner}/{repo}/contents{dir}/{file}?{cred}", match), githubRawHeader)
+	p, err := httpGetBytes(client, expand("https://api.github.com/repos/{owner}/{repo}/contents{dir}/{file}", match), githubRawHeader)
 	if err != nil {
 		return nil, err
 	}
 
-	apiBase, err := url.Parse(expand("https://api.github.com/repos/{owner}/{repo}/contents{dir}/?{cred}", match))
+	apiBase, err := url.Parse(expand("https://api.github.com/repos/{owner}/{repo}/contents{dir}/", match))
 	if err != nil {
 		return nil, err
 	}
@@ -231,3 +263,73 @@ func getGithubPresentation(client *http.Client, match map[string]string) (*Prese
 
 	return b.build()
 }
+
+// getGithubTree returns the documentation files in the directory match["dir"]
+// from the tree of the repository. The repository is marked as a monorepo if
+// the tree is large. Truncated is true if GitHub did not return the complete
+// tree.
+func getGithubTree(client *http.Client, match map[string]string) (files []*source, truncated bool, err error) {
+	setGithubDefaults(match)
+	var tree struct {
+		Tree []struct {
+			Url  string
+			Path string
+			Mode string
+			Type string
+			Sha  string
+		}
+		Url       string
+		Truncated bool
+	}
+
+	err = httpGetJSON(client, expand("{api}/repos/{owner}/{repo}/git/trees/{tag}?recursive=1", match), &tree)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Because Github API URLs are case-insensitive, we need to check that the
+	// userRepo returned from Github matches the one that we are requesting.
+	if !strings.HasPrefix(tree.Url, expand("{api}/repos/{owner}/{repo}/", match)) {
+		return nil, false, NotFoundError{"Github import path has incorrect case."}
+	}
+
+	if tree.Truncated || len(tree.Tree) > monorepoFileThreshold {
+		setDetectedMonorepo(expand("{host}/{owner}/{repo}", match))
+	}
+	if tree.Truncated {
+		return nil, true, nil
+	}
+
+	inTree := false
+	dirPrefix := match["dir"]
+	if dirPrefix != "" {
+		dirPrefix = dirPrefix[1:] + "/"
+	}
+	for _, node := range tree.Tree {
+		if node.Type != "blob" || !strings.HasPrefix(node.Path, dirPrefix) {
+			continue
+		}
+		inTree = true
+		if d, f := path.Split(node.Path); d == dirPrefix && isDocFile(f) {
+			if node.Mode == symlinkMode {
+				addSymlink(match, f)
+				continue
+			}
+			rawURL := node.Url
+			if match["raw"] != "" {
+				rawURL = rawFileURL(match, node.Path)
+			}
+			files = append(files, &source{
+				name:      f,
+				browseURL: expand("{web}/{owner}/{repo}/blob/{tag}/{0}", match, node.Path),
+				rawURL:    rawURL,
+				hash:      node.Sha,
+			})
+		}
+	}
+
+	if !inTree {
+		return nil, false, NotFoundError{"Directory tree does not contain Go files."}
+	}
+	return files, false, nil
+}
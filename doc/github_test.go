@@ -0,0 +1,198 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var bestTagTests = []struct {
+	tags          map[string]string
+	defaultBranch string
+	staticDefault string
+	tag           string
+}{
+	{map[string]string{"go1": "1", "main": "2", "master": "3"}, "main", "master", "go1"},
+	{map[string]string{"main": "2", "master": "3"}, "main", "master", "main"},
+	{map[string]string{"develop": "2", "master": "3"}, "main", "master", "master"},
+	{map[string]string{"master": "3"}, "", "master", "master"},
+	{map[string]string{"main": "2"}, "", "master", ""},
+	{map[string]string{"main": "2"}, "", "", ""},
+}
+
+func TestBestTag(t *testing.T) {
+	for _, tt := range bestTagTests {
+		tag, commit, err := bestTag(tt.tags, tt.defaultBranch, tt.staticDefault)
+		if tt.tag == "" {
+			if !IsNotFound(err) {
+				t.Errorf("bestTag(%v, %q, %q) returned %q, %v, want NotFoundError", tt.tags, tt.defaultBranch, tt.staticDefault, tag, err)
+			}
+			continue
+		}
+		if err != nil || tag != tt.tag || commit != tt.tags[tt.tag] {
+			t.Errorf("bestTag(%v, %q, %q) = %q, %q, %v, want %q, %q", tt.tags, tt.defaultBranch, tt.staticDefault, tag, commit, err, tt.tag, tt.tags[tt.tag])
+		}
+	}
+}
+
+const githubMainSha = "8f7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c"
+
+// githubFixtures are responses from the GitHub API for a repository with the
+// default branch main and no master branch.
+var githubFixtures = map[string]string{
+	"/repos/owner/repo": `{"watchers": 7, "default_branch": "main"}`,
+	"/repos/owner/repo/git/refs": `[
+		{"ref": "refs/heads/main", "object": {"type": "commit", "sha": "` + githubMainSha + `"}},
+		{"ref": "refs/heads/develop", "object": {"type": "commit", "sha": "0000000000000000000000000000000000000000"}},
+		{"ref": "refs/tags/v1.0.0", "object": {"type": "commit", "sha": "1111111111111111111111111111111111111111"}}]`,
+}
+
+// rewriteTransport sends all requests to a test server.
+type rewriteTransport struct {
+	u *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := *req
+	u := *req.URL
+	u.Scheme = t.u.Scheme
+	u.Host = t.u.Host
+	r.URL = &u
+	return http.DefaultTransport.RoundTrip(&r)
+}
+
+func newGithubTestClient(fixtures map[string]string) (*http.Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(s))
+	}))
+	u, _ := url.Parse(server.URL)
+	return &http.Client{Transport: rewriteTransport{u}}, server.Close
+}
+
+func TestGithubDefaultBranch(t *testing.T) {
+	client, done := newGithubTestClient(githubFixtures)
+	defer done()
+
+	match := map[string]string{"owner": "owner", "repo": "repo"}
+	commit, starCount, err := getGithubTag(client, match, "", newDefaultTags())
+	if err != nil {
+		t.Fatalf("getGithubTag() returned error %v", err)
+	}
+	if match["tag"] != "main" || commit != githubMainSha || starCount != 7 {
+		t.Errorf("getGithubTag() = %q, %q, %d, want %q, %q, %d", match["tag"], commit, starCount, "main", githubMainSha, 7)
+	}
+}
+
+func TestGithubStaticDefaultBranch(t *testing.T) {
+	// The repository information is not available, so the static default
+	// branch is used.
+	fixtures := map[string]string{"/repos/owner/repo/git/refs": githubFixtures["/repos/owner/repo/git/refs"]}
+	client, done := newGithubTestClient(fixtures)
+	defer done()
+
+	match := map[string]string{"owner": "owner", "repo": "repo"}
+	if _, _, err := getGithubTag(client, match, "", newDefaultTags()); !IsNotFound(err) {
+		t.Errorf("getGithubTag() with default master returned tag %q, error %v, want NotFoundError", match["tag"], err)
+	}
+
+	commit, starCount, err := getGithubTag(client, match, "", map[string]string{"git": "main"})
+	if err != nil {
+		t.Fatalf("getGithubTag() with default main returned error %v", err)
+	}
+	if match["tag"] != "main" || commit != githubMainSha || starCount != -1 {
+		t.Errorf("getGithubTag() = %q, %q, %d, want %q, %q, %d", match["tag"], commit, starCount, "main", githubMainSha, -1)
+	}
+}
+
+func TestGithubExplicitRef(t *testing.T) {
+	client, done := newGithubTestClient(githubFixtures)
+	defer done()
+
+	match := map[string]string{"owner": "owner", "repo": "repo"}
+	defaultTags := newDefaultTags()
+	defaultTags[refKey] = "v1.0.0"
+	commit, _, err := getGithubTag(client, match, "", defaultTags)
+	if err != nil {
+		t.Fatalf("getGithubTag() with ref v1.0.0 returned error %v", err)
+	}
+	if match["tag"] != "v1.0.0" || commit != "1111111111111111111111111111111111111111" {
+		t.Errorf("getGithubTag() with ref v1.0.0 = %q, %q", match["tag"], commit)
+	}
+
+	match = map[string]string{"owner": "owner", "repo": "repo"}
+	defaultTags[refKey] = "v2.0.0"
+	_, _, err = getGithubTag(client, match, "", defaultTags)
+	if !IsNotFound(err) || !strings.Contains(err.Error(), "v2.0.0") {
+		t.Errorf("getGithubTag() with ref v2.0.0 returned error %v, want NotFoundError naming the ref", err)
+	}
+}
+
+// recordTransport records the paths of the requests sent with the transport.
+type recordTransport struct {
+	rt    http.RoundTripper
+	paths *[]string
+}
+
+func (t recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	*t.paths = append(*t.paths, req.URL.Path)
+	return t.rt.RoundTrip(req)
+}
+
+func TestGithubNotModified(t *testing.T) {
+	oneBranch := map[string]string{
+		"/repos/owner/repo": githubFixtures["/repos/owner/repo"],
+		"/repos/owner/repo/git/refs": `[
+			{"ref": "refs/heads/main", "object": {"type": "commit", "sha": "` + githubMainSha + `"}}]`,
+	}
+	for _, tt := range []struct {
+		fixtures  map[string]string
+		ref       string
+		savedEtag string
+		requests  int
+		modified  bool
+	}{
+		// The tag is chosen without the default branch.
+		{githubFixtures, "v1.0.0", "1111111111111111111111111111111111111111", 1, false},
+		{oneBranch, "", githubMainSha, 1, false},
+		// The default branch is needed to choose between the branches.
+		{githubFixtures, "", githubMainSha, 2, false},
+		{githubFixtures, "", "0000000000000000000000000000000000000000", 2, true},
+	} {
+		client, done := newGithubTestClient(tt.fixtures)
+		var paths []string
+		client.Transport = recordTransport{client.Transport, &paths}
+
+		match := map[string]string{"owner": "owner", "repo": "repo"}
+		defaultTags := newDefaultTags()
+		defaultTags[refKey] = tt.ref
+		_, _, err := getGithubTag(client, match, tt.savedEtag, defaultTags)
+		done()
+		if modified := err != ErrNotModified; modified != tt.modified || modified && err != nil {
+			t.Errorf("getGithubTag(ref %q, etag %q) returned error %v, want modified %v", tt.ref, tt.savedEtag, err, tt.modified)
+		}
+		if len(paths) != tt.requests {
+			t.Errorf("getGithubTag(ref %q, etag %q) requested %v, want %d requests", tt.ref, tt.savedEtag, paths, tt.requests)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// isGitlabV3 returns true if match["api"] is the base URL of version 3 of
+// the GitLab API. Version 3 names the tree ref parameter ref_name, does not
+// return the path of tree entries and does not have the raw file endpoint.
+func isGitlabV3(match map[string]string) bool {
+	return strings.HasSuffix(match["api"], "/v3")
+}
+
+// getGitlabTag sets match["tag"] to the tag or branch to document and
+// match["tags"] to the space separated tags of the repository and returns
+// the commit for the tag and the number of stars.
+func getGitlabTag(client *http.Client, match map[string]string, defaultTags map[string]string) (string, int, error) {
+	var project struct {
+		DefaultBranch     string `json:"default_branch"`
+		StarCount         int    `json:"star_count"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	}
+	if err := httpGetJSON(client, expand("{api}/projects/{project}", match), &project); err != nil {
+		return "", -1, err
+	}
+
+	// Project paths are case-insensitive in the GitLab API.
+	if userRepo := match["owner"] + "/" + match["repo"]; project.PathWithNamespace != userRepo {
+		if strings.EqualFold(project.PathWithNamespace, userRepo) {
+			return "", -1, CanonicalPathError{match["host"] + "/" + project.PathWithNamespace + match["dir"]}
+		}
+		return "", -1, NotFoundError{"Project not found."}
+	}
+
+	tags := make(map[string]string)
+	var tagNames []string
+	for _, nodeType := range []string{"branches", "tags"} {
+		var nodes []struct {
+			Name   string
+			Commit struct {
+				ID string
+			}
+		}
+		if err := httpGetJSONPages(client, expand("{api}/projects/{project}/repository/{0}?per_page=100", match, nodeType), &nodes); err != nil {
+			return "", -1, err
+		}
+		for _, n := range nodes {
+			tags[n.Name] = n.Commit.ID
+			if nodeType == "tags" {
+				tagNames = append(tagNames, n.Name)
+			}
+		}
+	}
+	match["tags"] = strings.Join(tagNames, " ")
+
+	var commit string
+	var err error
+	match["defaultBranch"] = project.DefaultBranch
+	match["tag"], commit, err = chooseTag(tags, project.DefaultBranch, defaultTags, "git")
+	if err != nil {
+		return "", -1, err
+	}
+	return commit, project.StarCount, nil
+}
+
+// getGitlabDoc gets the documentation for a package on a GitLab-compatible
+// service. The match map must contain the URLs set by getHostedDoc.
+func getGitlabDoc(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) (*Package, error) {
+	match["project"] = url.QueryEscape(match["owner"] + "/" + match["repo"])
+
+	commit, starCount, err := getGitlabTag(client, match, defaultTags)
+	if err != nil {
+		return nil, err
+	}
+
+	if commit == savedEtag {
+		return nil, ErrNotModified
+	}
+
+	v3 := isGitlabV3(match)
+	refParam := "ref"
+	if v3 {
+		refParam = "ref_name"
+	}
+
+	dir := strings.TrimPrefix(match["dir"], "/")
+	var tree []struct {
+		ID   string
+		Name string
+		Type string
+		Path string
+		Mode string
+	}
+	if err := httpGetJSONPages(client, expand("{api}/projects/{project}/repository/tree?{0}={1}&path={2}&per_page=100", match,
+		refParam, url.QueryEscape(match["tag"]), url.QueryEscape(dir)), &tree); err != nil {
+		return nil, err
+	}
+
+	var files []*source
+	for _, node := range tree {
+		if node.Type != "blob" || !isDocFile(node.Name) {
+			continue
+		}
+		if node.Mode == symlinkMode {
+			addSymlink(match, node.Name)
+			continue
+		}
+		if node.Path == "" {
+			node.Path = path.Join(dir, node.Name)
+		}
+		var rawURL string
+		switch {
+		case match["raw"] != "":
+			rawURL = rawFileURL(match, node.Path)
+		case v3:
+			rawURL = expand("{api}/projects/{project}/repository/raw_blobs/{0}", match, node.ID)
+		default:
+			rawURL = expand("{api}/projects/{project}/repository/files/{0}/raw?ref={1}", match,
+				url.QueryEscape(node.Path), url.QueryEscape(match["tag"]))
+		}
+		files = append(files, &source{
+			name:      node.Name,
+			browseURL: expand("{web}/{owner}/{repo}/blob/{tag}/{0}", match, node.Path),
+			rawURL:    rawURL,
+			hash:      node.ID,
+		})
+	}
+	if len(files) == 0 {
+		return nil, NotFoundError{"Directory tree does not contain Go files."}
+	}
+
+	if err := fetchChangedFiles(client, files, nil); err != nil {
+		return nil, err
+	}
+
+	browseURL := expand("{web}/{owner}/{repo}", match)
+	if match["dir"] != "" {
+		browseURL = expand("{web}/{owner}/{repo}/tree/{tag}{dir}", match)
+	}
+
+	b := &builder{
+		pdoc: &Package{
+			LineFmt:       "%s#L%d",
+			ImportPath:    match["originalImportPath"],
+			ProjectRoot:   expand("{host}/{owner}/{repo}", match),
+			ProjectName:   match["repo"],
+			ProjectURL:    expand("{web}/{owner}/{repo}", match),
+			BrowseURL:     browseURL,
+			Etag:          commit,
+			VCS:           "git",
+			DefaultBranch: match["tag"],
+			ResolvedFrom:  resolve(match["tag"], match["defaultBranch"]),
+			StarCount:     starCount,
+		},
+		tags:     strings.Fields(match["tags"]),
+		symlinks: strings.Fields(match["symlinks"]),
+	}
+	return b.build(files)
+}
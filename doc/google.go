@@ -35,7 +35,7 @@ var (
 	// googleStarRe     = regexp.MustCompile(`<span\s+id="star_count">\s*([0-9])+\s*</span>`)
 )
 
-func getGoogleDoc(client *http.Client, match map[string]string, savedEtag string) (*Package, error) {
+func getGoogleDoc(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) (*Package, error) {
 	setupGoogleMatch(match)
 	if m := googleEtagRe.FindStringSubmatch(savedEtag); m != nil {
 		match["vcs"] = m[1]
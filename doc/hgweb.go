@@ -0,0 +1,139 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// hgwebMaxFiles is the maximum number of files in a package directory
+// fetched from an hgweb server.
+const hgwebMaxFiles = 200
+
+// getHgwebFiles fetches the documentation files for a package in a Mercurial
+// repository served by hgweb. The repository URL is {scheme}://{repo}. The
+// hgweb server can be mounted at any path. The tags of the repository are
+// stored in match["tags"] separated by spaces. errNoMatch is returned if the
+// server does not answer the hgweb branches request.
+func getHgwebFiles(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) ([]*source, string, error) {
+	base := expand("{scheme}://{repo}", match)
+
+	tags := make(map[string]string)
+
+	var branches struct {
+		Branches []struct {
+			Branch string
+			Node   string
+		}
+	}
+	if err := httpGetJSON(client, base+"/json-branches", &branches); err != nil {
+		return nil, "", errNoMatch
+	}
+	for _, b := range branches.Branches {
+		tags[b.Branch] = b.Node
+	}
+
+	var tagList struct {
+		Tags []struct {
+			Tag  string
+			Node string
+		}
+	}
+	if err := httpGetJSON(client, base+"/json-tags", &tagList); err != nil {
+		return nil, "", err
+	}
+	var tagNames []string
+	for _, t := range tagList.Tags {
+		tags[t.Tag] = t.Node
+		tagNames = append(tagNames, t.Tag)
+	}
+	match["tags"] = strings.Join(tagNames, " ")
+
+	var err error
+	match["tag"], match["commit"], err = chooseTag(tags, "", defaultTags, "hg")
+	if err != nil {
+		return nil, "", err
+	}
+
+	etag := expand("hgweb-{commit}", match)
+	if etag == savedEtag {
+		return nil, "", ErrNotModified
+	}
+
+	var manifest struct {
+		Files []struct {
+			Abspath  string
+			Basename string
+		}
+	}
+	if err := httpGetJSON(client, expand("{0}/json-manifest/{commit}{dir}/", match, base), &manifest); err != nil {
+		if IsNotFound(err) {
+			err = NotFoundError{expand("Directory {dir} not found at {tag}.", match)}
+		}
+		return nil, "", err
+	}
+	if len(manifest.Files) > hgwebMaxFiles {
+		return nil, "", NotFoundError{"Directory has too many files."}
+	}
+
+	var files []*source
+	for _, f := range manifest.Files {
+		name := f.Basename
+		if name == "" {
+			name = path.Base(f.Abspath)
+		}
+		if !isDocFile(name) {
+			continue
+		}
+		p := strings.TrimPrefix(f.Abspath, "/")
+		files = append(files, &source{
+			name:      name,
+			browseURL: expand("{0}/file/{commit}/{1}", match, base, p),
+			rawURL:    expand("{0}/raw-file/{commit}/{1}", match, base, p),
+		})
+	}
+
+	if err := fetchFiles(client, files, nil); err != nil {
+		return nil, "", err
+	}
+	return files, etag, nil
+}
+
+func getHgwebDoc(client *http.Client, match map[string]string, savedEtag string, defaultTags map[string]string) (*Package, error) {
+	files, etag, err := getHgwebFiles(client, match, savedEtag, defaultTags)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &builder{
+		pdoc: &Package{
+			LineFmt:       "%s#l%d",
+			ImportPath:    match["importPath"],
+			ProjectRoot:   match["projectRoot"],
+			ProjectName:   match["projectName"],
+			ProjectURL:    match["projectURL"],
+			BrowseURL:     expand("{scheme}://{repo}/file/{commit}{dir}", match),
+			Etag:          etag,
+			VCS:           "hg",
+			DefaultBranch: match["tag"],
+			ResolvedFrom:  resolve(match["tag"], ""),
+		},
+		tags: strings.Fields(match["tags"]),
+	}
+
+	return b.build(files)
+}
@@ -0,0 +1,115 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const hgwebNode = "9f1c5d3b8a7e6f4d2c1b0a9f8e7d6c5b4a3f2e1d"
+
+// hgwebFixtures are responses from an hgweb server mounted at /hg/.
+var hgwebFixtures = map[string]string{
+	"/hg/proj/json-branches": `{"node": "` + hgwebNode + `", "branches": [
+		{"branch": "default", "node": "` + hgwebNode + `", "status": "open"},
+		{"branch": "stable", "node": "0000000000000000000000000000000000000000", "status": "closed"}]}`,
+	"/hg/proj/json-tags": `{"node": "` + hgwebNode + `", "tags": [
+		{"tag": "tip", "node": "` + hgwebNode + `"}]}`,
+	"/hg/proj/json-manifest/" + hgwebNode + "/sub/": `{"node": "` + hgwebNode + `", "abspath": "/sub/",
+		"directories": [{"abspath": "/sub/testdata", "basename": "testdata"}],
+		"files": [
+			{"abspath": "sub/sub.go", "basename": "sub.go"},
+			{"abspath": "sub/README", "basename": "README"},
+			{"abspath": "sub/Makefile", "basename": "Makefile"}]}`,
+	"/hg/proj/raw-file/" + hgwebNode + "/sub/sub.go": "package sub\n",
+	"/hg/proj/raw-file/" + hgwebNode + "/sub/README": "Package sub.\n",
+}
+
+func newHgwebServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := hgwebFixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(s))
+	}))
+}
+
+func hgwebMatch(server *httptest.Server, dir string) map[string]string {
+	return map[string]string{
+		"scheme":     "http",
+		"repo":       strings.TrimPrefix(server.URL, "http://") + "/hg/proj",
+		"dir":        dir,
+		"importPath": "example.com/proj" + dir,
+	}
+}
+
+func TestHgwebFiles(t *testing.T) {
+	server := newHgwebServer()
+	defer server.Close()
+
+	match := hgwebMatch(server, "/sub")
+	files, etag, err := getHgwebFiles(http.DefaultClient, match, "", newDefaultTags())
+	if err != nil {
+		t.Fatalf("getHgwebFiles() returned error %v", err)
+	}
+	if etag != "hgweb-"+hgwebNode {
+		t.Errorf("etag = %q, want %q", etag, "hgweb-"+hgwebNode)
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+		if want := hgwebFixtures["/hg/proj/raw-file/"+hgwebNode+"/sub/"+f.name]; string(f.data) != want {
+			t.Errorf("%s data = %q, want %q", f.name, f.data, want)
+		}
+		if want := "http://" + match["repo"] + "/file/" + hgwebNode + "/sub/" + f.name; f.browseURL != want {
+			t.Errorf("%s browseURL = %q, want %q", f.name, f.browseURL, want)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "README sub.go" {
+		t.Errorf("files = %v, want [README sub.go]", names)
+	}
+
+	if _, _, err := getHgwebFiles(http.DefaultClient, hgwebMatch(server, "/sub"), etag, newDefaultTags()); err != ErrNotModified {
+		t.Errorf("getHgwebFiles(etag) returned error %v, want ErrNotModified", err)
+	}
+}
+
+func TestHgwebNoServer(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, _, err := getHgwebFiles(http.DefaultClient, hgwebMatch(server, "/sub"), "", newDefaultTags())
+	if err != errNoMatch {
+		t.Errorf("getHgwebFiles(not hgweb) returned error %v, want errNoMatch", err)
+	}
+}
+
+func TestHgwebMissingDirectory(t *testing.T) {
+	server := newHgwebServer()
+	defer server.Close()
+
+	_, _, err := getHgwebFiles(http.DefaultClient, hgwebMatch(server, "/missing"), "", newDefaultTags())
+	if !IsNotFound(err) {
+		t.Errorf("getHgwebFiles(/missing) returned error %v, want NotFoundError", err)
+	}
+}
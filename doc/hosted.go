@@ -0,0 +1,160 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Kinds of self-hosted repository services.
+const (
+	// The API of the service has the shape of the GitHub API, as in
+	// GitHub Enterprise.
+	HostGithubCompatible = "github-compatible"
+
+	// The API of the service has the shape of the GitLab API, as in
+	// self-hosted GitLab.
+	HostGitlabCompatible = "gitlab-compatible"
+)
+
+// HostConfig configures a self-hosted repository service. Import paths on
+// the service have the form host/owner/repo/dir.
+type HostConfig struct {
+	// First element of import paths on the service.
+	Host string
+
+	// HostGithubCompatible or HostGitlabCompatible.
+	Kind string
+
+	// Base URL of the API, as in "https://ghe.example.com/api/v3" or
+	// "https://gitlab.example.com/api/v4". Versions 3 and 4 of the GitLab
+	// API are supported.
+	APIURL string
+
+	// Optional template for the URL of a file in a repository. The
+	// template can refer to {owner}, {repo}, {tag} and {path}. Files are
+	// fetched with the API if the template is empty.
+	RawURL string
+
+	// Base URL of the repository web pages. The default is "https://"
+	// followed by the host.
+	WebURL string
+
+	// Optional access token sent with requests to the hosts of the API
+	// and raw file URLs.
+	Token string
+}
+
+var hostedPattern = regexp.MustCompile(`^(?P<host>[^/]+)/(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<repo>[a-z0-9A-Z_.\-]+)(?P<dir>/[a-z0-9A-Z_.\-/]*)?$`)
+
+var hostedServices = struct {
+	sync.Mutex
+	m map[string]HostConfig
+}{m: make(map[string]HostConfig)}
+
+// SetHosts sets the self-hosted repository services. The previous services
+// are kept if a configuration is not valid.
+func SetHosts(configs []HostConfig) error {
+	m := make(map[string]HostConfig)
+	tokens := make(map[string]hostToken)
+	for _, c := range configs {
+		if c.Host == "" || strings.Contains(c.Host, "/") {
+			return fmt.Errorf("invalid host %q", c.Host)
+		}
+		var header string
+		switch c.Kind {
+		case HostGithubCompatible:
+			header = "Authorization"
+		case HostGitlabCompatible:
+			header = "Private-Token"
+		default:
+			return fmt.Errorf("unknown kind %q for host %s", c.Kind, c.Host)
+		}
+		c.APIURL = strings.TrimSuffix(c.APIURL, "/")
+		c.WebURL = strings.TrimSuffix(c.WebURL, "/")
+		if c.WebURL == "" {
+			c.WebURL = "https://" + c.Host
+		}
+		// The token is sent to the API and raw file hosts, not to the
+		// web pages.
+		urls := []string{c.WebURL, c.APIURL}
+		if c.RawURL != "" {
+			urls = append(urls, c.RawURL)
+		}
+		for i, s := range urls {
+			u, err := url.Parse(s)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("invalid URL %q for host %s", s, c.Host)
+			}
+			if c.Token != "" && i > 0 {
+				value := c.Token
+				if c.Kind == HostGithubCompatible {
+					value = "token " + c.Token
+				}
+				tokens[u.Host] = hostToken{header, value}
+			}
+		}
+		m[c.Host] = c
+	}
+	hostedServices.Lock()
+	hostedServices.m = m
+	hostedServices.Unlock()
+	setHostTokens(tokens)
+	return nil
+}
+
+// hostedService returns the configuration of the self-hosted service for
+// the host of an import path.
+func hostedService(importPath string) (HostConfig, bool) {
+	host := strings.SplitN(importPath, "/", 2)[0]
+	hostedServices.Lock()
+	c, ok := hostedServices.m[host]
+	hostedServices.Unlock()
+	return c, ok
+}
+
+// getHostedDoc gets the documentation for a package on a self-hosted
+// service. The fetchers for the public services are used with the URLs of
+// the self-hosted service.
+func getHostedDoc(client *http.Client, c HostConfig, importPath, originalImportPath, etag string, defaultTags map[string]string) (*Package, error) {
+	m := hostedPattern.FindStringSubmatch(importPath)
+	if m == nil {
+		return nil, NotFoundError{"Import path prefix matches configured host, but regexp does not."}
+	}
+	match := map[string]string{"importPath": importPath, "originalImportPath": originalImportPath}
+	for i, n := range hostedPattern.SubexpNames() {
+		if n != "" {
+			match[n] = m[i]
+		}
+	}
+	match["api"] = c.APIURL
+	match["web"] = c.WebURL
+	match["raw"] = c.RawURL
+	if c.Kind == HostGitlabCompatible {
+		return getGitlabDoc(client, match, etag, defaultTags)
+	}
+	return getGithubDoc(client, match, etag, defaultTags)
+}
+
+// rawFileURL returns the URL of the file at path p in the repository from
+// the raw URL template in match["raw"].
+func rawFileURL(match map[string]string, p string) string {
+	return expand(strings.Replace(match["raw"], "{path}", "{0}", -1), match, p)
+}
@@ -0,0 +1,277 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const hostedSha = "2a3b4c5d6e7f80912a3b4c5d6e7f80912a3b4c5d"
+
+// gheFixtures are responses from a GitHub Enterprise API with the base URL
+// https://ghe.example.com/api/v3.
+var gheFixtures = map[string]string{
+	"/api/v3/repos/team/tool": `{"watchers": 3, "default_branch": "trunk", "full_name": "team/tool"}`,
+	"/api/v3/repos/team/tool/git/refs": `[
+		{"ref": "refs/heads/trunk", "object": {"type": "commit", "sha": "` + hostedSha + `"}},
+		{"ref": "refs/tags/v1.2.0", "object": {"type": "commit", "sha": "1111111111111111111111111111111111111111"}}]`,
+	"/api/v3/repos/team/tool/git/trees/trunk": `{
+		"url": "https://ghe.example.com/api/v3/repos/team/tool/git/trees/` + hostedSha + `",
+		"tree": [
+			{"path": "cmd/README.md", "type": "blob", "sha": "a1", "url": "https://ghe.example.com/api/v3/repos/team/tool/git/blobs/a1"},
+			{"path": "README.md", "type": "blob", "sha": "a2", "url": "https://ghe.example.com/api/v3/repos/team/tool/git/blobs/a2"}]}`,
+	"/api/v3/repos/team/tool/git/blobs/a1": "Tool command.",
+}
+
+// gitlabFixtures are responses from a GitLab API with the base URL
+// https://gitlab.example.com/api/v4. The fixtures are keyed by the request
+// URI because the project path is escaped.
+var gitlabFixtures = map[string]string{
+	"/api/v4/projects/group%2Fproj": `{"default_branch": "main", "star_count": 5, "path_with_namespace": "group/proj"}`,
+	"/api/v4/projects/group%2Fproj/repository/branches?per_page=100": `[
+		{"name": "main", "commit": {"id": "` + hostedSha + `"}}]`,
+	"/api/v4/projects/group%2Fproj/repository/tags?per_page=100": `[
+		{"name": "v0.1.0", "commit": {"id": "2222222222222222222222222222222222222222"}}]`,
+	"/api/v4/projects/group%2Fproj/repository/tree?ref=main&path=sub&per_page=100": `[
+		{"id": "b1", "name": "README", "type": "blob", "path": "sub/README"},
+		{"id": "b2", "name": "internal", "type": "tree", "path": "sub/internal"}]`,
+	"/api/v4/projects/group%2Fproj/repository/files/sub%2FREADME/raw?ref=main": "Sub package.",
+}
+
+// gitlabV3Fixtures are responses from version 3 of the GitLab API with the
+// base URL https://gitlab.example.com/api/v3.
+var gitlabV3Fixtures = map[string]string{
+	"/api/v3/projects/group%2Fproj": `{"default_branch": "main", "star_count": 5, "path_with_namespace": "group/proj"}`,
+	"/api/v3/projects/group%2Fproj/repository/branches?per_page=100": `[
+		{"name": "main", "commit": {"id": "` + hostedSha + `"}}]`,
+	"/api/v3/projects/group%2Fproj/repository/tags?per_page=100": `[]`,
+	"/api/v3/projects/group%2Fproj/repository/tree?ref_name=main&path=sub%2Fdeep&per_page=100": `[
+		{"id": "b1", "name": "README", "type": "blob"}]`,
+	"/api/v3/projects/group%2Fproj/repository/raw_blobs/b1": "Deep package.",
+}
+
+// newHostedTestClient returns a client for a test server with the fixtures
+// keyed by request URI. The server records the headers of the requests.
+func newHostedTestClient(fixtures map[string]string) (*http.Client, *[]http.Header, func()) {
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		key := r.URL.Path
+		if _, ok := fixtures[key]; !ok {
+			key = r.RequestURI
+		}
+		s, ok := fixtures[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(s))
+	}))
+	u, _ := url.Parse(server.URL)
+	return &http.Client{Transport: rewriteTransport{u}}, &headers, server.Close
+}
+
+func TestHostedGithubCompatible(t *testing.T) {
+	err := SetHosts([]HostConfig{{
+		Host:   "ghe.example.com",
+		Kind:   HostGithubCompatible,
+		APIURL: "https://ghe.example.com/api/v3/",
+		Token:  "secret",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+
+	client, headers, done := newHostedTestClient(gheFixtures)
+	defer done()
+
+	pdoc, err := getStatic(client, "ghe.example.com/team/tool/cmd", "ghe.example.com/team/tool/cmd", "", newDefaultTags())
+	if err != nil {
+		t.Fatalf("getStatic() returned error %v", err)
+	}
+	if pdoc.Etag != hostedSha || pdoc.DefaultBranch != "trunk" || pdoc.StarCount != 3 {
+		t.Errorf("etag, branch, stars = %q, %q, %d, want %q, %q, %d", pdoc.Etag, pdoc.DefaultBranch, pdoc.StarCount, hostedSha, "trunk", 3)
+	}
+	if pdoc.ProjectRoot != "ghe.example.com/team/tool" {
+		t.Errorf("ProjectRoot = %q, want %q", pdoc.ProjectRoot, "ghe.example.com/team/tool")
+	}
+	if want := "https://ghe.example.com/team/tool/tree/trunk/cmd"; pdoc.BrowseURL != want {
+		t.Errorf("BrowseURL = %q, want %q", pdoc.BrowseURL, want)
+	}
+	if s := string(pdoc.ReadmeFiles["README.md"]); s != "Tool command." {
+		t.Errorf("README.md = %q, want %q", s, "Tool command.")
+	}
+	for _, h := range *headers {
+		if s := h.Get("Authorization"); s != "token secret" {
+			t.Errorf("Authorization header = %q, want %q", s, "token secret")
+		}
+	}
+
+	// The etag semantics of the public service are kept.
+	if _, err := getStatic(client, "ghe.example.com/team/tool/cmd", "ghe.example.com/team/tool/cmd", hostedSha, newDefaultTags()); err != ErrNotModified {
+		t.Errorf("getStatic() with current etag returned %v, want ErrNotModified", err)
+	}
+}
+
+func TestHostedGitlabCompatible(t *testing.T) {
+	err := SetHosts([]HostConfig{{
+		Host:   "gitlab.example.com",
+		Kind:   HostGitlabCompatible,
+		APIURL: "https://gitlab.example.com/api/v4",
+		Token:  "glpat",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+
+	client, headers, done := newHostedTestClient(gitlabFixtures)
+	defer done()
+
+	pdoc, err := getStatic(client, "gitlab.example.com/group/proj/sub", "gitlab.example.com/group/proj/sub", "", newDefaultTags())
+	if err != nil {
+		t.Fatalf("getStatic() returned error %v", err)
+	}
+	if pdoc.Etag != hostedSha || pdoc.DefaultBranch != "main" || pdoc.StarCount != 5 {
+		t.Errorf("etag, branch, stars = %q, %q, %d, want %q, %q, %d", pdoc.Etag, pdoc.DefaultBranch, pdoc.StarCount, hostedSha, "main", 5)
+	}
+	if want := "https://gitlab.example.com/group/proj"; pdoc.ProjectURL != want {
+		t.Errorf("ProjectURL = %q, want %q", pdoc.ProjectURL, want)
+	}
+	if s := string(pdoc.ReadmeFiles["README"]); s != "Sub package." {
+		t.Errorf("README = %q, want %q", s, "Sub package.")
+	}
+	for _, h := range *headers {
+		if s := h.Get("Private-Token"); s != "glpat" {
+			t.Errorf("Private-Token header = %q, want %q", s, "glpat")
+		}
+	}
+
+	if _, err := getStatic(client, "gitlab.example.com/Group/proj/sub", "gitlab.example.com/Group/proj/sub", "", newDefaultTags()); err == nil {
+		t.Errorf("getStatic() with wrong case returned nil error")
+	}
+
+	// The tree and files are not fetched if the commit is not changed.
+	n := len(*headers)
+	if _, err := getStatic(client, "gitlab.example.com/group/proj/sub", "gitlab.example.com/group/proj/sub", hostedSha, newDefaultTags()); err != ErrNotModified {
+		t.Errorf("getStatic() with current etag returned %v, want ErrNotModified", err)
+	}
+	// The project, branches and tags are fetched to find the commit.
+	if n = len(*headers) - n; n != 3 {
+		t.Errorf("getStatic() with current etag made %d requests, want 3", n)
+	}
+}
+
+func TestHostedGitlabV3(t *testing.T) {
+	err := SetHosts([]HostConfig{{
+		Host:   "gitlab.example.com",
+		Kind:   HostGitlabCompatible,
+		APIURL: "https://gitlab.example.com/api/v3",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+
+	client, _, done := newHostedTestClient(gitlabV3Fixtures)
+	defer done()
+
+	pdoc, err := getStatic(client, "gitlab.example.com/group/proj/sub/deep", "gitlab.example.com/group/proj/sub/deep", "", newDefaultTags())
+	if err != nil {
+		t.Fatalf("getStatic() returned error %v", err)
+	}
+	if s := string(pdoc.ReadmeFiles["README"]); s != "Deep package." {
+		t.Errorf("README = %q, want %q", s, "Deep package.")
+	}
+	if want := "https://gitlab.example.com/group/proj/tree/main/sub/deep"; pdoc.BrowseURL != want {
+		t.Errorf("BrowseURL = %q, want %q", pdoc.BrowseURL, want)
+	}
+	if want := "%s#L%d"; pdoc.LineFmt != want {
+		t.Errorf("LineFmt = %q, want %q", pdoc.LineFmt, want)
+	}
+}
+
+func TestHostedRawURL(t *testing.T) {
+	err := SetHosts([]HostConfig{{
+		Host:   "gitlab.example.com",
+		Kind:   HostGitlabCompatible,
+		APIURL: "https://gitlab.example.com/api/v4",
+		RawURL: "https://raw.example.com/{owner}/{repo}/{tag}/{path}",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+
+	fixtures := map[string]string{"/group/proj/main/sub/README": "Raw sub package."}
+	for k, v := range gitlabFixtures {
+		fixtures[k] = v
+	}
+	client, _, done := newHostedTestClient(fixtures)
+	defer done()
+
+	pdoc, err := getStatic(client, "gitlab.example.com/group/proj/sub", "gitlab.example.com/group/proj/sub", "", newDefaultTags())
+	if err != nil {
+		t.Fatalf("getStatic() returned error %v", err)
+	}
+	if s := string(pdoc.ReadmeFiles["README"]); s != "Raw sub package." {
+		t.Errorf("README = %q, want %q", s, "Raw sub package.")
+	}
+}
+
+func TestHostedValidPath(t *testing.T) {
+	if IsValidRemotePath("git.corp/team/tool") {
+		t.Errorf("IsValidRemotePath(git.corp/team/tool) = true before configuration")
+	}
+	if err := SetHosts([]HostConfig{{Host: "git.corp", Kind: HostGitlabCompatible, APIURL: "https://git.corp/api/v4"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+	if !IsValidRemotePath("git.corp/team/tool") {
+		t.Errorf("IsValidRemotePath(git.corp/team/tool) = false for configured host")
+	}
+	if IsValidRemotePath("git.corp/team/testdata") {
+		t.Errorf("IsValidRemotePath(git.corp/team/testdata) = true")
+	}
+}
+
+var setHostsErrorTests = []HostConfig{
+	{Host: "", Kind: HostGithubCompatible, APIURL: "https://ghe.example.com/api/v3"},
+	{Host: "ghe.example.com/x", Kind: HostGithubCompatible, APIURL: "https://ghe.example.com/api/v3"},
+	{Host: "ghe.example.com", Kind: "svn", APIURL: "https://ghe.example.com/api/v3"},
+	{Host: "ghe.example.com", Kind: HostGithubCompatible},
+	{Host: "ghe.example.com", Kind: HostGithubCompatible, APIURL: "ftp://ghe.example.com/api/v3"},
+	{Host: "ghe.example.com", Kind: HostGithubCompatible, APIURL: "https://ghe.example.com/api/v3", RawURL: "raw"},
+}
+
+func TestSetHostsError(t *testing.T) {
+	if err := SetHosts([]HostConfig{{Host: "ghe.example.com", Kind: HostGithubCompatible, APIURL: "https://ghe.example.com/api/v3"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+	for _, c := range setHostsErrorTests {
+		if err := SetHosts([]HostConfig{c}); err == nil {
+			t.Errorf("SetHosts(%+v) returned nil error", c)
+		}
+	}
+	// The previous services are kept.
+	if _, ok := hostedService("ghe.example.com/team/tool"); !ok {
+		t.Errorf("ghe.example.com is not configured after bad configurations")
+	}
+}
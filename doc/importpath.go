@@ -0,0 +1,155 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"path"
+	"strings"
+)
+
+const (
+	// maxImportPathLen is the maximum length in bytes of an import path.
+	maxImportPathLen = 512
+
+	// maxPathElementLen is the maximum length in bytes of an element of
+	// an import path.
+	maxPathElementLen = 255
+)
+
+// ImportPathError is the error returned by CheckImportPath.
+type ImportPathError struct {
+	ImportPath string
+	Reason     string
+}
+
+func (e *ImportPathError) Error() string {
+	return "invalid import path " + quoteImportPath(e.ImportPath) + ": " + e.Reason
+}
+
+// quoteImportPath quotes an import path for an error message. Long paths
+// are truncated.
+func quoteImportPath(p string) string {
+	if len(p) > 64 {
+		p = p[:64] + "..."
+	}
+	return `"` + p + `"`
+}
+
+// CheckImportPath returns an error if importPath is not the path of a
+// package that can be documented. A valid path is "C", the path of a
+// standard package or a remote path. The rules for a remote path are:
+//
+//   - The path is at most 512 bytes and has a host element followed by one
+//     or more elements separated by "/". Elements are not empty.
+//   - The host contains lower case ASCII letters, digits, '-' and '.'. The
+//     host does not start or end with '.' or '-' and does not contain "..".
+//   - The host contains a '.' and ends with a known top-level domain, or
+//     the host is a configured self-hosted service.
+//   - The host is not blocked.
+//   - The other elements contain ASCII letters, digits and the characters
+//     '-', '.', '_', '~' and '+'. An element does not start with '.' or
+//     '_', does not end with '.', is not "testdata" and is at most 255
+//     bytes.
+//
+// Spaces, '%', backslashes, non-ASCII characters and other runes are not
+// valid in any element.
+func CheckImportPath(importPath string) error {
+	if importPath == "C" || standardPath[importPath] {
+		return nil
+	}
+	if reason := checkRemotePath(importPath); reason != "" {
+		return &ImportPathError{ImportPath: importPath, Reason: reason}
+	}
+	return nil
+}
+
+// checkRemotePath returns the reason a remote import path is not valid or
+// "" if the path is valid.
+func checkRemotePath(importPath string) string {
+	if len(importPath) > maxImportPathLen {
+		return "path too long"
+	}
+	parts := strings.Split(importPath, "/")
+	if len(parts) <= 1 {
+		return "missing element after host"
+	}
+	if reason := checkHost(importPath, parts[0]); reason != "" {
+		return reason
+	}
+	for _, part := range parts[1:] {
+		if reason := checkPathElement(part); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// checkHost returns the reason the host element of an import path is not
+// valid or "" if the host is valid.
+func checkHost(importPath, host string) string {
+	if host == "" {
+		return "empty host"
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.') {
+			return "invalid character in host"
+		}
+	}
+	switch {
+	case host[0] == '.' || host[0] == '-' || host[len(host)-1] == '.' || host[len(host)-1] == '-':
+		return "host starts or ends with '.' or '-'"
+	case strings.Contains(host, ".."):
+		return "empty label in host"
+	case blackHosts[host]:
+		return "blocked host"
+	}
+	// The hosts of the self-hosted services are valid without a known
+	// top-level domain.
+	if _, ok := hostedService(importPath); ok {
+		return ""
+	}
+	if !strings.Contains(host, ".") {
+		return "host does not contain '.'"
+	}
+	if !validTLD[path.Ext(host)] {
+		return "unknown top-level domain"
+	}
+	return ""
+}
+
+// checkPathElement returns the reason an element after the host is not
+// valid or "" if the element is valid.
+func checkPathElement(elem string) string {
+	switch {
+	case elem == "":
+		return "empty element"
+	case len(elem) > maxPathElementLen:
+		return "element too long"
+	case elem[0] == '.' || elem[0] == '_':
+		return "element starts with '.' or '_'"
+	case elem[len(elem)-1] == '.':
+		return "element ends with '.'"
+	case elem == "testdata":
+		return "testdata element"
+	}
+	for i := 0; i < len(elem); i++ {
+		c := elem[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-._~+", rune(c))) {
+			return "invalid character in element"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"strings"
+	"testing"
+)
+
+var checkImportPathTests = []struct {
+	path  string
+	valid bool
+}{
+	// Standard packages and cgo.
+	{"C", true},
+	{"fmt", true},
+	{"net/http", true},
+	{"builtin", true},
+	{"notstd", false},
+	{"net/notstd", false},
+
+	// Remote paths.
+	{"github.com/user/repo", true},
+	{"github.com/user", true},
+	{"github.com/User/Repo", true},
+	{"github.com/user/repo/v2", true},
+	{"github.com/user/go-repo/sub_pkg", true},
+	{"github.com/user/repo.go", true},
+	{"example.com/foo.git", true},
+	{"launchpad.net/~user/foo/trunk", true},
+	{"launchpad.net/~user/+junk/version", true},
+	{"gopkg.in/yaml.v1", true},
+	{"my-host.example.com/pkg", true},
+	{"xn--fiqs8s.xn--fiqs8s/pkg", true},
+	{"127.0.0.1.com/pkg", true},
+	{"github.com/user/-repo", true},
+
+	// Single element and missing host.
+	{"", false},
+	{"foobar", false},
+	{"example.com", false},
+	{"/github.com/user/repo", false},
+	{"foobar/pkg", false},
+
+	// Host rules.
+	{"GitHub.com/user/repo", false},
+	{".github.com/user/repo", false},
+	{"github.com./user/repo", false},
+	{"-github.com/user/repo", false},
+	{"github.com-/user/repo", false},
+	{"github..com/user/repo", false},
+	{"exmpple.cmo/user/repo", false},
+	{"favicon.ico/x", false},
+	{"gist.github.com/user/1234", false},
+	{"github.com:443/user/repo", false},
+	{"user@github.com/user/repo", false},
+	{"git_hub.com/user/repo", false},
+
+	// Empty elements.
+	{"github.com/user/repo/", false},
+	{"github.com//repo", false},
+	{"github.com/user//repo", false},
+
+	// Leading and trailing dots and underscores.
+	{"github.com/user/.repo", false},
+	{"github.com/user/_repo", false},
+	{"github.com/user/repo.", false},
+	{"github.com/user/repo/.", false},
+	{"github.com/user/repo/..", false},
+	{"github.com/user/repo/../other", false},
+	{"github.com/user/repo/testdata", false},
+	{"github.com/user/repo/testdata/x", false},
+
+	// Characters.
+	{"github.com/user/my repo", false},
+	{"github.com/user/repo\t", false},
+	{"github.com/user/repo%2Fx", false},
+	{"github.com/user/repo%20", false},
+	{`github.com\user\repo`, false},
+	{`github.com/user\repo`, false},
+	{`C:\go\src\pkg`, false},
+	{"github.com/user/répo", false},
+	{"github.com/user/仓库", false},
+	{"bücher.example.com/pkg", false},
+	{"github.com/user/repo\x00", false},
+	{"github.com/user/repo?x=1", false},
+	{"github.com/user/repo#x", false},
+	{"github.com/user/re:po", false},
+	{"github.com/user/re*po", false},
+	{`github.com/user/"repo"`, false},
+	{"github.com/user/<repo>", false},
+	{"github.com/user/repo,", false},
+	{"github.com/user/repo)", false},
+	{"github.com/user/repo@v1", false},
+
+	// Lengths.
+	{"github.com/user/" + strings.Repeat("a", maxPathElementLen), true},
+	{"github.com/user/" + strings.Repeat("a", maxPathElementLen+1), false},
+	{"github.com/" + strings.Repeat("a/", 200) + "b", true},
+	{"github.com/" + strings.Repeat("a/", 300) + "b", false},
+}
+
+func TestCheckImportPath(t *testing.T) {
+	for _, tt := range checkImportPathTests {
+		err := CheckImportPath(tt.path)
+		if (err == nil) != tt.valid {
+			t.Errorf("CheckImportPath(%q) = %v, want valid %v", tt.path, err, tt.valid)
+		}
+		if IsValidPath(tt.path) != tt.valid {
+			t.Errorf("IsValidPath(%q) = %v, want %v", tt.path, !tt.valid, tt.valid)
+		}
+		if err != nil {
+			if _, ok := err.(*ImportPathError); !ok {
+				t.Errorf("CheckImportPath(%q) returned %T, want *ImportPathError", tt.path, err)
+			}
+		}
+		if tt.path != "C" && !standardPath[tt.path] && IsValidRemotePath(tt.path) != tt.valid {
+			t.Errorf("IsValidRemotePath(%q) = %v, want %v", tt.path, !tt.valid, tt.valid)
+		}
+	}
+}
+
+func TestCheckImportPathHosted(t *testing.T) {
+	if err := SetHosts([]HostConfig{{Host: "gitserver", Kind: HostGitlabCompatible, APIURL: "https://gitserver/api/v4"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+	for _, tt := range []struct {
+		path  string
+		valid bool
+	}{
+		{"gitserver/team/tool", true},
+		{"gitserver/team/.tool", false},
+		{"gitserver", false},
+		{"otherserver/team/tool", false},
+	} {
+		if err := CheckImportPath(tt.path); (err == nil) != tt.valid {
+			t.Errorf("CheckImportPath(%q) = %v, want valid %v", tt.path, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"strings"
+)
+
+// RecvType returns the name of the receiver type of a method and true if
+// the receiver is a pointer. The name is empty for a function.
+func (f *Func) RecvType() (name string, pointer bool) {
+	fields := strings.Fields(f.Recv)
+	if len(fields) == 0 {
+		return "", false
+	}
+	name = fields[len(fields)-1]
+	if strings.HasPrefix(name, "*") {
+		return name[1:], true
+	}
+	return name, false
+}
+
+// IndexGroup is a type and the functions and methods listed with the type
+// in the declaration index of a package.
+type IndexGroup struct {
+	Type *Type
+
+	// Functions associated with the type, including the constructors
+	// promoted from the package functions.
+	Funcs []*Func
+
+	Methods []*Func
+}
+
+// IndexGroups returns the package functions and the types with their
+// functions and methods in the order used by the declaration index. The
+// go/doc package associates a function with a type when the function
+// returns the type only. Package functions with a name starting with
+// "New" that return the type among other results are also promoted into
+// the type's group.
+func IndexGroups(pdoc *Package) (funcs []*Func, groups []*IndexGroup) {
+	types := make(map[string]*IndexGroup)
+	for _, t := range pdoc.Types {
+		g := &IndexGroup{
+			Type:    t,
+			Funcs:   append([]*Func(nil), t.Funcs...),
+			Methods: t.Methods,
+		}
+		types[t.Name] = g
+		groups = append(groups, g)
+	}
+	for _, f := range pdoc.Funcs {
+		if g := constructorGroup(f, types); g != nil {
+			g.Funcs = append(g.Funcs, f)
+		} else {
+			funcs = append(funcs, f)
+		}
+	}
+	return funcs, groups
+}
+
+// constructorGroup returns the group for the type constructed by f or nil
+// if f is not a constructor. A constructor returns exactly one of the
+// package types.
+func constructorGroup(f *Func, types map[string]*IndexGroup) *IndexGroup {
+	if !strings.HasPrefix(f.Name, "New") {
+		return nil
+	}
+	var group *IndexGroup
+	for _, r := range resultTypes(f.Decl.Text) {
+		if g := types[strings.TrimPrefix(r, "*")]; g != nil {
+			if group != nil && group != g {
+				return nil
+			}
+			group = g
+		}
+	}
+	return group
+}
+
+// resultTypes returns the result types in the text of a function
+// declaration.
+func resultTypes(decl string) []string {
+	i := strings.Index(decl, "(")
+	if strings.HasPrefix(decl, "func (") {
+		// Skip the receiver.
+		if j := closingParen(decl, i); j >= 0 {
+			i = strings.Index(decl[j:], "(")
+			if i >= 0 {
+				i += j
+			}
+		}
+	}
+	if i < 0 {
+		return nil
+	}
+	j := closingParen(decl, i)
+	if j < 0 {
+		return nil
+	}
+	results := strings.TrimSpace(decl[j+1:])
+	if strings.HasPrefix(results, "(") {
+		if k := closingParen(results, 0); k >= 0 {
+			results = results[1:k]
+		}
+	}
+	var types []string
+	for _, r := range splitTopLevel(results) {
+		fields := strings.Fields(r)
+		if len(fields) > 0 {
+			types = append(types, fields[len(fields)-1])
+		}
+	}
+	return types
+}
+
+// closingParen returns the index of the parenthesis that closes the
+// parenthesis at s[i] or -1 if the parenthesis is not closed.
+func closingParen(s string, i int) int {
+	depth := 0
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits s at the commas that are not nested in brackets.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
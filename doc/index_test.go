@@ -0,0 +1,88 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"reflect"
+	"testing"
+)
+
+var recvTypeTests = []struct {
+	recv    string
+	name    string
+	pointer bool
+}{
+	{"", "", false},
+	{"Client", "Client", false},
+	{"*Client", "Client", true},
+	{"c *Client", "Client", true},
+}
+
+func TestRecvType(t *testing.T) {
+	for _, tt := range recvTypeTests {
+		name, pointer := (&Func{Recv: tt.recv}).RecvType()
+		if name != tt.name || pointer != tt.pointer {
+			t.Errorf("RecvType() for %q = %q, %v, want %q, %v", tt.recv, name, pointer, tt.name, tt.pointer)
+		}
+	}
+}
+
+var resultTypesTests = []struct {
+	decl  string
+	types []string
+}{
+	{"func F()", nil},
+	{"func F(a, b int) *T", []string{"*T"}},
+	{"func F(f func(int) error) (T, error)", []string{"T", "error"}},
+	{"func F() (t *T, m map[string]int, err error)", []string{"*T", "map[string]int", "error"}},
+	{"func (c *Client) Do(r *Request) (*Response, error)", []string{"*Response", "error"}},
+}
+
+func TestResultTypes(t *testing.T) {
+	for _, tt := range resultTypesTests {
+		if types := resultTypes(tt.decl); !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("resultTypes(%q) = %q, want %q", tt.decl, types, tt.types)
+		}
+	}
+}
+
+func TestIndexGroups(t *testing.T) {
+	pdoc := methodTestPackage()
+	funcs, groups := IndexGroups(pdoc)
+	var names []string
+	for _, f := range funcs {
+		names = append(names, f.Name)
+	}
+	for _, g := range groups {
+		names = append(names, "type "+g.Type.Name)
+		for _, f := range g.Funcs {
+			names = append(names, f.Name)
+		}
+		for _, f := range g.Methods {
+			names = append(names, g.Type.Name+"."+f.Name)
+		}
+	}
+	want := []string{
+		"Dial", "NewReader",
+		"type Client", "NewClient", "Client.Close", "Client.Do",
+		"type Pool", "NewPool", "Pool.Close", "Pool.Do", "Pool.Get",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("IndexGroups() = %q, want %q", names, want)
+	}
+	if len(pdoc.Funcs) != 4 || len(pdoc.Types[1].Funcs) != 0 {
+		t.Errorf("IndexGroups() modified the package")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Languages detected in package comments. The values are ISO 639-1 codes.
+const (
+	LanguageUnknown    = "unknown"
+	LanguageEnglish    = "en"
+	LanguageChinese    = "zh"
+	LanguageJapanese   = "ja"
+	LanguageKorean     = "ko"
+	LanguageRussian    = "ru"
+	LanguageUkrainian  = "uk"
+	LanguageGerman     = "de"
+	LanguageFrench     = "fr"
+	LanguageSpanish    = "es"
+	LanguagePortuguese = "pt"
+	LanguageItalian    = "it"
+)
+
+// Languages is the list of languages returned by DetectLanguage other than
+// LanguageUnknown.
+var Languages = []string{
+	LanguageChinese,
+	LanguageEnglish,
+	LanguageFrench,
+	LanguageGerman,
+	LanguageItalian,
+	LanguageJapanese,
+	LanguageKorean,
+	LanguagePortuguese,
+	LanguageRussian,
+	LanguageSpanish,
+	LanguageUkrainian,
+}
+
+// languageTrigrams are the frequent trigrams of the languages written in
+// the Latin and Cyrillic scripts. A space stands for a word boundary.
+var languageTrigrams = map[string][]string{
+	LanguageEnglish: {
+		" th", "the", "he ", " an", "and", "nd ", " of", "of ", " to", "to ",
+		"ing", "ng ", " in", "ion", "tio", " is", "is ", "es ", " fo", "for",
+		"or ", "ed ", "hat", "tha", " wi", "ith", "rns", "urn", "ret", "rs ",
+		"er ", "ent", "nt ", "ts ", "ns ", "ati", "ons", " pr", "pro", "ver",
+		" re", "st ", "ter", " ma", "ke ", "ly ", "al ", "ect", " a ", "ble",
+	},
+	LanguageGerman: {
+		"en ", "er ", "ch ", "ich", "sch", "der", " de", "die", " di", "ie ",
+		"ein", " ei", "und", " un", "cht", "ine", "den", " da", "ung", "gen",
+		"ten", "ist", " zu", "che", " au", "ber", "nen", " we", "wir", "ird",
+	},
+	LanguageFrench: {
+		" de", "de ", "es ", "le ", " le", "ent", "nt ", " la", "la ", " et",
+		"et ", "les", " un", "que", " qu", "ue ", " po", "our", "pou", "ur ",
+		"des", " pa", "une", "re ", "ett", " du", "du ", "ons", " ce", "ée ",
+	},
+	LanguageSpanish: {
+		" de", "de ", "os ", " la", "la ", " el", "el ", "que", " qu", "ue ",
+		" co", "ión", "ció", "as ", "ara", "par", " pa", "ra ", " un", "una",
+		"con", "nte", "ado", "los", " lo", " se", "se ", " es", "est", " y ",
+	},
+	LanguagePortuguese: {
+		" de", "de ", "os ", "do ", " do", "da ", " da", " co", "que", " qu",
+		"ção", "ão ", " pa", "ara", "par", " um", "um ", "uma", "com", " em",
+		"em ", "ões", "nte", "ado", " se", " no", "no ", " na", "na ", "ma ",
+	},
+	LanguageItalian: {
+		" di", "di ", "la ", " la", "che", " ch", "he ", " il", "il ", "re ",
+		"to ", "ell", "lla", "del", " de", "ne ", " co", "one", "zio", "ion",
+		" pe", "per", "are", " un", "una", "no ", "le ", "ato", "gli", " è ",
+	},
+	LanguageRussian: {
+		" пр", "ет ", "ть ", " по", "ого", " на", "ени", "ост", " не", "ов ",
+		" и ", "ния", "ных", "ый ", "ся ", " в ", "ает", "то ", "ие ", "ых ",
+		"что", " ко", "ля ", " дл", "для", "ыва", "ват", " сп", "ить", "ой ",
+	},
+	LanguageUkrainian: {
+		" пр", "ння", " на", "ня ", "ого", "ти ", "ть ", " що", "що ", "их ",
+		"ів ", " і ", "ій ", " по", "ає ", "ся ", "ні ", "ова", "ати", " ві",
+		" дл", "для", "ює ", "ють", " ко", "ний", "ног", "ими", " та", "та ",
+		" як", "які", "кі ", "ськ", "цій", "ції", "ями", " з ", "ує ", "ці ",
+	},
+}
+
+var languageTrigramSets = map[string]map[string]bool{}
+
+func init() {
+	for lang, trigrams := range languageTrigrams {
+		m := make(map[string]bool)
+		for _, t := range trigrams {
+			m[t] = true
+		}
+		languageTrigramSets[lang] = m
+	}
+}
+
+const (
+	// minLanguageWords is the number of words in a comment written with
+	// spaces between words needed to detect the language.
+	minLanguageWords = 8
+
+	// minLanguageCJK is the number of Chinese, Japanese or Korean
+	// characters needed to detect the language.
+	minLanguageCJK = 8
+
+	// minScriptShare is the share of the words and characters of a
+	// comment that must be written in one script.
+	minScriptShare = 0.7
+
+	// minTrigramShare is the share of the trigrams of a comment that must
+	// be frequent trigrams of the detected language.
+	minTrigramShare = 0.1
+
+	// minTrigramMargin is the factor by which the trigram share of the
+	// detected language must exceed the share of the next language.
+	minTrigramMargin = 1.4
+
+	// maxLanguageText is the number of bytes of a comment examined.
+	maxLanguageText = 2000
+)
+
+var languageURLPat = regexp.MustCompile(`https?://\S+`)
+
+// languageText returns the prose of a package comment. Preformatted
+// blocks and URLs are removed.
+func languageText(comment string) string {
+	var lines []string
+	for _, line := range strings.Split(comment, "\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	text := languageURLPat.ReplaceAllString(strings.Join(lines, " "), " ")
+	if len(text) > maxLanguageText {
+		text = text[:maxLanguageText]
+	}
+	return text
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// DetectLanguage returns the language of a package comment. The detection
+// is conservative: LanguageUnknown is returned for short comments and for
+// comments without a clearly dominant language.
+func DetectLanguage(comment string) string {
+	text := languageText(comment)
+
+	// Count words written in the Latin and Cyrillic scripts and the
+	// characters of the scripts written without spaces between words.
+	var latin, cyrillic, other, han, kana, hangul int
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		wordScript := ""
+		for _, r := range word {
+			switch {
+			case unicode.Is(unicode.Han, r):
+				han++
+			case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+				kana++
+			case unicode.Is(unicode.Hangul, r):
+				hangul++
+			case unicode.Is(unicode.Latin, r):
+				wordScript = "latin"
+			case unicode.Is(unicode.Cyrillic, r):
+				wordScript = "cyrillic"
+			default:
+				wordScript = "other"
+			}
+		}
+		switch wordScript {
+		case "latin":
+			latin++
+		case "cyrillic":
+			cyrillic++
+		case "other":
+			other++
+		}
+	}
+	cjk := han + kana + hangul
+	total := float64(latin + cyrillic + other + cjk)
+
+	switch {
+	case cjk >= minLanguageCJK && float64(cjk) >= minScriptShare*total:
+		switch {
+		case hangul > han+kana:
+			return LanguageKorean
+		case hangul == 0 && kana*10 >= cjk:
+			return LanguageJapanese
+		case hangul == 0 && kana == 0:
+			return LanguageChinese
+		}
+	case latin >= minLanguageWords && float64(latin) >= minScriptShare*total:
+		return trigramLanguage(text, LanguageEnglish, LanguageGerman, LanguageFrench, LanguageSpanish, LanguagePortuguese, LanguageItalian)
+	case cyrillic >= minLanguageWords && float64(cyrillic) >= minScriptShare*total:
+		return trigramLanguage(text, LanguageRussian, LanguageUkrainian)
+	}
+	return LanguageUnknown
+}
+
+// trigramLanguage returns the candidate language with the most frequent
+// trigrams in text or LanguageUnknown if no language stands out.
+func trigramLanguage(text string, candidates ...string) string {
+	var b []rune
+	space := true
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) {
+			b = append(b, r)
+			space = false
+		} else if !space {
+			b = append(b, ' ')
+			space = true
+		}
+	}
+	b = append([]rune{' '}, b...)
+	if !space {
+		b = append(b, ' ')
+	}
+
+	hits := make(map[string]int)
+	n := 0
+	for i := 0; i+3 <= len(b); i++ {
+		t := string(b[i : i+3])
+		n++
+		for _, lang := range candidates {
+			if languageTrigramSets[lang][t] {
+				hits[lang]++
+			}
+		}
+	}
+	if n == 0 {
+		return LanguageUnknown
+	}
+	best, second := "", 0
+	for _, lang := range candidates {
+		switch {
+		case best == "" || hits[lang] > hits[best]:
+			if best != "" {
+				second = hits[best]
+			}
+			best = lang
+		case hits[lang] > second:
+			second = hits[lang]
+		}
+	}
+	if float64(hits[best]) < minTrigramShare*float64(n) || float64(hits[best]) < minTrigramMargin*float64(second) {
+		return LanguageUnknown
+	}
+	return best
+}
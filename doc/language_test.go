@@ -0,0 +1,64 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import "testing"
+
+var languageTests = []struct {
+	comment string
+	lang    string
+}{
+	// English.
+	{"Package http provides HTTP client and server implementations. Get, Head, Post, and PostForm make HTTP (or HTTPS) requests.", LanguageEnglish},
+	{"Package redis is a client for the Redis database. The Conn interface is the primary interface for working with Redis.", LanguageEnglish},
+
+	// Chinese, Japanese and Korean, with identifiers in the Latin script.
+	{"Package cache 提供了一个简单的内存缓存，支持过期时间和容量限制。", LanguageChinese},
+	{"Package orm 是一个轻量级的 ORM 框架，支持 MySQL 和 PostgreSQL 数据库。", LanguageChinese},
+	{"Package kana はひらがなとカタカナを変換するためのライブラリです。", LanguageJapanese},
+	{"Package config は設定ファイルを読み込み、構造体にマッピングします。", LanguageJapanese},
+	{"Package hangul 패키지는 한글 자모를 조합하고 분해하는 기능을 제공합니다.", LanguageKorean},
+
+	// Cyrillic.
+	{"Пакет config предоставляет функции для чтения настроек из файлов и переменных окружения.", LanguageRussian},
+	{"Пакет config надає функції для читання налаштувань з файлів та змінних середовища, які використовує сервіс.", LanguageUkrainian},
+
+	// Other languages in the Latin script.
+	{"Paket config liest die Einstellungen aus einer Datei und stellt sie für die Anwendung bereit, die den Server startet.", LanguageGerman},
+	{"Le paquet config lit les paramètres depuis un fichier et les met à disposition de l'application pour le serveur.", LanguageFrench},
+	{"El paquete config lee la configuración desde un archivo y la pone a disposición de la aplicación para el servidor.", LanguageSpanish},
+	{"O pacote config lê a configuração de um arquivo e a disponibiliza para a aplicação com o servidor da empresa.", LanguagePortuguese},
+	{"Il pacchetto config legge la configurazione da un file e la rende disponibile all'applicazione per il server.", LanguageItalian},
+
+	// Short comments.
+	{"Package foo does things.", LanguageUnknown},
+	{"Package cache 内存缓存。", LanguageUnknown},
+	{"", LanguageUnknown},
+
+	// Mixed languages.
+	{"Package cache provides an in-memory cache with expiration. 提供了一个简单的内存缓存。", LanguageUnknown},
+	{"Package api wraps the service. Пакет api оборачивает сервис и предоставляет клиент.", LanguageUnknown},
+
+	// Code blocks and URLs are ignored.
+	{"Package cache 提供了一个简单的内存缓存，支持过期时间。\n\n\tc := cache.New(time.Minute)\n\tc.Set(\"key\", value, time.Second)\n\nhttps://github.com/user/cache/blob/master/README.md", LanguageChinese},
+}
+
+func TestDetectLanguage(t *testing.T) {
+	for _, tt := range languageTests {
+		if lang := DetectLanguage(tt.comment); lang != tt.lang {
+			t.Errorf("DetectLanguage(%q) = %q, want %q", tt.comment, lang, tt.lang)
+		}
+	}
+}
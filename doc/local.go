@@ -15,11 +15,17 @@
 package doc
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"go/build"
+	"io"
 	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -69,3 +75,91 @@ func GetLocal(importPath string, goroot, gopath string, browseURLFmt, lineFmt st
 	}
 	return b.build(files)
 }
+
+// GetDir gets the documentation for the package in the directory
+// root/importPath of a local source tree, for example $GOPATH/src. The
+// browse URL of a file is browseURLFmt formatted with the file name.
+// ErrNotModified is returned if the names, sizes and modification times of
+// the files match etag.
+func GetDir(root, importPath, etag, browseURLFmt, lineFmt string) (*Package, error) {
+	dir, err := LocalDir(root, importPath)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NotFoundError{"Directory not found in local source tree."}
+		}
+		return nil, err
+	}
+	fis = localDocFiles(fis)
+	if len(fis) == 0 {
+		return nil, NotFoundError{"No files in local source tree."}
+	}
+	localEtag := PackageVersion + "-local-" + localFilesEtag(fis)
+	if localEtag == etag {
+		return nil, ErrNotModified
+	}
+	var files []*source
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &source{
+			name:      fi.Name(),
+			browseURL: fmt.Sprintf(browseURLFmt, fi.Name()),
+			data:      b,
+		})
+	}
+	b := &builder{
+		pdoc: &Package{
+			LineFmt:     lineFmt,
+			ImportPath:  importPath,
+			ProjectRoot: importPath,
+			ProjectName: path.Base(importPath),
+			Etag:        localEtag,
+		},
+	}
+	return b.build(files)
+}
+
+// LocalDir returns the directory for the slash separated path p in the local
+// source tree at root. An error is returned if p is not a clean relative
+// path.
+func LocalDir(root, p string) (string, error) {
+	if p == "" || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") || strings.Contains(p, "\\") {
+		return "", NotFoundError{"Invalid path for local source tree."}
+	}
+	return filepath.Join(root, filepath.FromSlash(p)), nil
+}
+
+// IsDocFile returns true if the file with name n is used to build the
+// documentation of a package.
+func IsDocFile(n string) bool {
+	return isDocFile(n)
+}
+
+// localDocFiles returns the documentation files in fis.
+func localDocFiles(fis []os.FileInfo) []os.FileInfo {
+	var result []os.FileInfo
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && isDocFile(fi.Name()) {
+			result = append(result, fi)
+		}
+	}
+	return result
+}
+
+// localFilesEtag returns a hash of the names, sizes and modification times
+// of fis. Reading the directory is enough to check for changes.
+func localFilesEtag(fis []os.FileInfo) string {
+	h := sha1.New()
+	for _, fi := range fis {
+		io.WriteString(h, fi.Name())
+		io.WriteString(h, "\x00"+strconv.FormatInt(fi.Size(), 10))
+		io.WriteString(h, "\x00"+strconv.FormatInt(fi.ModTime().UnixNano(), 10)+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
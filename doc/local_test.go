@@ -0,0 +1,95 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var localDirTests = []struct {
+	p  string
+	ok bool
+}{
+	{"example.com/a", true},
+	{"example.com/a/b", true},
+	{"", false},
+	{"/etc", false},
+	{"..", false},
+	{"../a", false},
+	{"example.com/../../a", false},
+	{"example.com//a", false},
+	{"example.com/a/", false},
+	{`example.com\..\a`, false},
+}
+
+func TestLocalDir(t *testing.T) {
+	for _, tt := range localDirTests {
+		dir, err := LocalDir("/src", tt.p)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("LocalDir(%q) = %q, %v, want ok %v", tt.p, dir, err, tt.ok)
+		}
+	}
+}
+
+func TestGetDirEtag(t *testing.T) {
+	root, err := ioutil.TempDir("", "localsrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if _, err := GetDir(root, "example.com/a", "", "%s", "#L%d"); !IsNotFound(err) {
+		t.Fatalf("GetDir(missing) returned %v, want not found", err)
+	}
+
+	dir := filepath.Join(root, "example.com", "a")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.go", "_b.go", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("package a\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readEtag := func() string {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fis = localDocFiles(fis)
+		if len(fis) != 1 || fis[0].Name() != "a.go" {
+			t.Fatalf("localDocFiles returned %d files, want a.go only", len(fis))
+		}
+		return PackageVersion + "-local-" + localFilesEtag(fis)
+	}
+
+	etag := readEtag()
+	if _, err := GetDir(root, "example.com/a", etag, "%s", "#L%d"); err != ErrNotModified {
+		t.Fatalf("GetDir(etag) returned %v, want ErrNotModified", err)
+	}
+
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "a.go"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if readEtag() == etag {
+		t.Error("etag did not change with modification time")
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var majorVersionPat = regexp.MustCompile(`^v[2-9][0-9]*$`)
+
+// MajorVersion returns the major version of the package with the given
+// import path in the project with the given root. Projects keep newer major
+// versions in subdirectories of the project root named v2, v3 and so on.
+// The project root is major version 1. MajorVersion returns 0 for other
+// packages.
+func MajorVersion(importPath, projectRoot string) int {
+	switch {
+	case projectRoot == "":
+		return 0
+	case importPath == projectRoot:
+		return 1
+	case len(importPath) > len(projectRoot)+1 &&
+		importPath[:len(projectRoot)+1] == projectRoot+"/" &&
+		majorVersionPat.MatchString(importPath[len(projectRoot)+1:]):
+		n, _ := strconv.Atoi(importPath[len(projectRoot)+2:])
+		return n
+	}
+	return 0
+}
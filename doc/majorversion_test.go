@@ -0,0 +1,42 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import "testing"
+
+var majorVersionTests = []struct {
+	importPath, projectRoot string
+	major                   int
+}{
+	{"github.com/user/repo", "github.com/user/repo", 1},
+	{"github.com/user/repo/v2", "github.com/user/repo", 2},
+	{"github.com/user/repo/v3", "github.com/user/repo", 3},
+	{"github.com/user/repo/v20", "github.com/user/repo", 20},
+	{"github.com/user/repo/v1", "github.com/user/repo", 0},
+	{"github.com/user/repo/v0", "github.com/user/repo", 0},
+	{"github.com/user/repo/v2x", "github.com/user/repo", 0},
+	{"github.com/user/repo/v2/sub", "github.com/user/repo", 0},
+	{"github.com/user/repo/sub", "github.com/user/repo", 0},
+	{"github.com/user/repov2", "github.com/user/repo", 0},
+	{"io", "", 0},
+}
+
+func TestMajorVersion(t *testing.T) {
+	for _, tt := range majorVersionTests {
+		if major := MajorVersion(tt.importPath, tt.projectRoot); major != tt.major {
+			t.Errorf("MajorVersion(%q, %q) = %d, want %d", tt.importPath, tt.projectRoot, major, tt.major)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"bytes"
+	"go/ast"
+	"go/doc"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file computes the method sets of exported types. A method set is the
+// sorted list of the canonical signatures of the exported methods of a
+// type. The canonical signature of a method is the method name followed by
+// the signature without parameter names. Named types are qualified with the
+// import path of the declaring package, byte and rune are written as byte
+// and rune instead of uint8 and int32:
+//
+//  Read([]byte) (int, error)
+//  ServeHTTP(net/http.ResponseWriter, *net/http.Request)
+//
+// The method set of a concrete type includes the methods declared with a
+// pointer receiver and the methods promoted from embedded types in the same
+// package and from embedded interfaces in StandardInterfaces. Methods
+// promoted from other embedded types are not known to the builder.
+
+// StandardInterfaces maps the qualified names of common interfaces in the
+// standard library to their method sets. The builder uses the table to
+// expand embedded interfaces and the search index uses the table to resolve
+// implements: queries.
+var StandardInterfaces = map[string][]string{
+	"error":                      {"Error() string"},
+	"fmt.Formatter":              {"Format(fmt.State, rune)"},
+	"fmt.GoStringer":             {"GoString() string"},
+	"fmt.Scanner":                {"Scan(fmt.ScanState, rune) error"},
+	"fmt.Stringer":               {"String() string"},
+	"io.ByteReader":              {"ReadByte() (byte, error)"},
+	"io.ByteScanner":             {"ReadByte() (byte, error)", "UnreadByte() error"},
+	"io.ByteWriter":              {"WriteByte(byte) error"},
+	"io.Closer":                  {"Close() error"},
+	"io.Reader":                  {"Read([]byte) (int, error)"},
+	"io.ReaderAt":                {"ReadAt([]byte, int64) (int, error)"},
+	"io.ReaderFrom":              {"ReadFrom(io.Reader) (int64, error)"},
+	"io.RuneReader":              {"ReadRune() (rune, int, error)"},
+	"io.RuneScanner":             {"ReadRune() (rune, int, error)", "UnreadRune() error"},
+	"io.Seeker":                  {"Seek(int64, int) (int64, error)"},
+	"io.Writer":                  {"Write([]byte) (int, error)"},
+	"io.WriterAt":                {"WriteAt([]byte, int64) (int, error)"},
+	"io.WriterTo":                {"WriteTo(io.Writer) (int64, error)"},
+	"sort.Interface":             {"Len() int", "Less(int, int) bool", "Swap(int, int)"},
+	"flag.Value":                 {"Set(string) error", "String() string"},
+	"encoding.BinaryMarshaler":   {"MarshalBinary() ([]byte, error)"},
+	"encoding.BinaryUnmarshaler": {"UnmarshalBinary([]byte) error"},
+	"encoding.TextMarshaler":     {"MarshalText() ([]byte, error)"},
+	"encoding.TextUnmarshaler":   {"UnmarshalText([]byte) error"},
+	"encoding/json.Marshaler":    {"MarshalJSON() ([]byte, error)"},
+	"encoding/json.Unmarshaler":  {"UnmarshalJSON([]byte) error"},
+	"encoding/xml.Marshaler":     {"MarshalXML(*encoding/xml.Encoder, encoding/xml.StartElement) error"},
+	"encoding/xml.Unmarshaler":   {"UnmarshalXML(*encoding/xml.Decoder, encoding/xml.StartElement) error"},
+	"database/sql.Scanner":       {"Scan(interface{}) error"},
+	"database/sql/driver.Valuer": {"Value() (database/sql/driver.Value, error)"},
+	"image/color.Color":          {"RGBA() (uint32, uint32, uint32, uint32)"},
+	"image.Image":                {"At(int, int) image/color.Color", "Bounds() image.Rectangle", "ColorModel() image/color.Model"},
+	"net.Addr":                   {"Network() string", "String() string"},
+	"net.Listener":               {"Accept() (net.Conn, error)", "Addr() net.Addr", "Close() error"},
+	"net/http.CloseNotifier":     {"CloseNotify() <-chan bool"},
+	"net/http.Flusher":           {"Flush()"},
+	"net/http.Handler":           {"ServeHTTP(net/http.ResponseWriter, *net/http.Request)"},
+	"net/http.Hijacker":          {"Hijack() (net.Conn, *bufio.ReadWriter, error)"},
+	"net/http.ResponseWriter":    {"Header() net/http.Header", "Write([]byte) (int, error)", "WriteHeader(int)"},
+	"net/http.RoundTripper":      {"RoundTrip(*net/http.Request) (*net/http.Response, error)"},
+	"runtime.Error":              {"Error() string", "RuntimeError()"},
+}
+
+// standardEmbeds lists the interfaces embedded by the composite interfaces
+// in StandardInterfaces and the methods that the composite interfaces
+// declare themselves.
+var standardEmbeds = map[string]struct {
+	embeds  []string
+	methods []string
+}{
+	"io.ReadCloser":            {[]string{"io.Reader", "io.Closer"}, nil},
+	"io.ReadSeeker":            {[]string{"io.Reader", "io.Seeker"}, nil},
+	"io.ReadWriteCloser":       {[]string{"io.Reader", "io.Writer", "io.Closer"}, nil},
+	"io.ReadWriteSeeker":       {[]string{"io.Reader", "io.Writer", "io.Seeker"}, nil},
+	"io.ReadWriter":            {[]string{"io.Reader", "io.Writer"}, nil},
+	"io.WriteCloser":           {[]string{"io.Writer", "io.Closer"}, nil},
+	"io.WriteSeeker":           {[]string{"io.Writer", "io.Seeker"}, nil},
+	"container/heap.Interface": {[]string{"sort.Interface"}, []string{"Pop() interface{}", "Push(interface{})"}},
+	"hash.Hash":                {[]string{"io.Writer"}, []string{"BlockSize() int", "Reset()", "Size() int", "Sum([]byte) []byte"}},
+	"hash.Hash32":              {[]string{"hash.Hash"}, []string{"Sum32() uint32"}},
+	"hash.Hash64":              {[]string{"hash.Hash"}, []string{"Sum64() uint64"}},
+	"net.Conn":                 {[]string{"io.Reader", "io.Writer", "io.Closer"}, []string{"LocalAddr() net.Addr", "RemoteAddr() net.Addr", "SetDeadline(time.Time) error", "SetReadDeadline(time.Time) error", "SetWriteDeadline(time.Time) error"}},
+	"net.Error":                {[]string{"error"}, []string{"Temporary() bool", "Timeout() bool"}},
+}
+
+func init() {
+	// Composite interfaces can embed other composite interfaces. Expand
+	// until every composite interface is in the table.
+	for len(standardEmbeds) > 0 {
+		for name, e := range standardEmbeds {
+			methods := append([]string(nil), e.methods...)
+			ok := true
+			for _, embed := range e.embeds {
+				m, found := StandardInterfaces[embed]
+				if !found {
+					ok = false
+					break
+				}
+				methods = append(methods, m...)
+			}
+			if ok {
+				StandardInterfaces[name] = methodSet(methods)
+				delete(standardEmbeds, name)
+			}
+		}
+	}
+	for name, methods := range StandardInterfaces {
+		StandardInterfaces[name] = methodSet(methods)
+	}
+}
+
+// methodSet sorts the methods and removes duplicates.
+func methodSet(methods []string) []string {
+	sort.Strings(methods)
+	result := methods[:0]
+	for i, m := range methods {
+		if i == 0 || m != methods[i-1] {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// maxEmbedDepth is the maximum depth of embedded interfaces expanded by the
+// builder.
+const maxEmbedDepth = 10
+
+// typeMethodSet returns the method set of the exported type d and true if
+// the type is an interface. The method set is nil if the type has no
+// exported methods or if the methods of the interface are not all known.
+func (b *builder) typeMethodSet(d *doc.Type) (methods []string, isInterface bool) {
+	var spec *ast.TypeSpec
+	for _, s := range d.Decl.Specs {
+		if s, ok := s.(*ast.TypeSpec); ok && s.Name.Name == d.Name {
+			spec = s
+		}
+	}
+	if spec == nil {
+		return nil, false
+	}
+	switch t := spec.Type.(type) {
+	case *ast.InterfaceType:
+		methods, ok := b.interfaceMethods(t, 0)
+		if !ok {
+			return nil, true
+		}
+		return methodSet(methods), true
+	case *ast.StructType:
+		for _, f := range t.Fields.List {
+			if len(f.Names) > 0 {
+				continue
+			}
+			x := f.Type
+			if star, ok := x.(*ast.StarExpr); ok {
+				x = star.X
+			}
+			if m, ok := StandardInterfaces[b.typeString(x)]; ok {
+				methods = append(methods, m...)
+			}
+		}
+	}
+	for _, f := range d.Methods {
+		methods = append(methods, f.Name+b.signature(f.Decl.Type))
+	}
+	if len(methods) == 0 {
+		return nil, false
+	}
+	return methodSet(methods), false
+}
+
+// interfaceMethods returns the methods of the interface type t including
+// the methods of embedded interfaces. The function returns false if t has
+// unexported methods or embeds an interface that is not known.
+func (b *builder) interfaceMethods(t *ast.InterfaceType, depth int) ([]string, bool) {
+	if t.Incomplete || depth > maxEmbedDepth {
+		return nil, false
+	}
+	var methods []string
+	for _, f := range t.Methods.List {
+		if len(f.Names) > 0 {
+			ftype, ok := f.Type.(*ast.FuncType)
+			if !ok {
+				return nil, false
+			}
+			for _, name := range f.Names {
+				methods = append(methods, name.Name+b.signature(ftype))
+			}
+			continue
+		}
+		if ident, ok := f.Type.(*ast.Ident); ok && ident.Obj != nil {
+			spec, _ := ident.Obj.Decl.(*ast.TypeSpec)
+			if spec == nil {
+				return nil, false
+			}
+			embedded, ok := spec.Type.(*ast.InterfaceType)
+			if !ok {
+				return nil, false
+			}
+			m, ok := b.interfaceMethods(embedded, depth+1)
+			if !ok {
+				return nil, false
+			}
+			methods = append(methods, m...)
+			continue
+		}
+		m, ok := StandardInterfaces[b.typeString(f.Type)]
+		if !ok {
+			return nil, false
+		}
+		methods = append(methods, m...)
+	}
+	return methods, true
+}
+
+// signature returns the canonical signature of a function type.
+func (b *builder) signature(t *ast.FuncType) string {
+	var buf bytes.Buffer
+	b.writeSignature(&buf, t)
+	return buf.String()
+}
+
+func (b *builder) writeSignature(buf *bytes.Buffer, t *ast.FuncType) {
+	buf.WriteByte('(')
+	b.writeFieldTypes(buf, t.Params)
+	buf.WriteByte(')')
+	if t.Results == nil || len(t.Results.List) == 0 {
+		return
+	}
+	buf.WriteByte(' ')
+	if len(t.Results.List) == 1 && len(t.Results.List[0].Names) <= 1 {
+		b.writeType(buf, t.Results.List[0].Type)
+		return
+	}
+	buf.WriteByte('(')
+	b.writeFieldTypes(buf, t.Results)
+	buf.WriteByte(')')
+}
+
+// writeFieldTypes writes the types of the fields in list separated by
+// commas. A field with several names is written once for each name.
+func (b *builder) writeFieldTypes(buf *bytes.Buffer, list *ast.FieldList) {
+	if list == nil {
+		return
+	}
+	first := true
+	for _, f := range list.List {
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			if !first {
+				buf.WriteString(", ")
+			}
+			first = false
+			b.writeType(buf, f.Type)
+		}
+	}
+}
+
+// typeString returns the canonical form of a type expression.
+func (b *builder) typeString(x ast.Expr) string {
+	var buf bytes.Buffer
+	b.writeType(&buf, x)
+	return buf.String()
+}
+
+// canonicalTypeNames maps the predeclared type aliases to the names used in
+// method sets.
+var canonicalTypeNames = map[string]string{
+	"uint8": "byte",
+	"int32": "rune",
+}
+
+func (b *builder) writeType(buf *bytes.Buffer, x ast.Expr) {
+	switch x := x.(type) {
+	case *ast.Ident:
+		switch {
+		case x.Obj == nil && predeclared[x.Name] == predeclaredType:
+			if name, ok := canonicalTypeNames[x.Name]; ok {
+				buf.WriteString(name)
+			} else {
+				buf.WriteString(x.Name)
+			}
+		case x.Obj != nil && x.Obj.Kind == ast.Typ:
+			buf.WriteString(b.pdoc.ImportPath)
+			buf.WriteByte('.')
+			buf.WriteString(x.Name)
+		default:
+			buf.WriteString(x.Name)
+		}
+	case *ast.SelectorExpr:
+		if pkg, ok := x.X.(*ast.Ident); ok && pkg.Obj != nil && pkg.Obj.Kind == ast.Pkg {
+			if spec, _ := pkg.Obj.Decl.(*ast.ImportSpec); spec != nil {
+				if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+					buf.WriteString(path)
+					buf.WriteByte('.')
+					buf.WriteString(x.Sel.Name)
+					return
+				}
+			}
+		}
+		b.writeType(buf, x.X)
+		buf.WriteByte('.')
+		buf.WriteString(x.Sel.Name)
+	case *ast.StarExpr:
+		buf.WriteByte('*')
+		b.writeType(buf, x.X)
+	case *ast.ParenExpr:
+		b.writeType(buf, x.X)
+	case *ast.Ellipsis:
+		buf.WriteString("...")
+		b.writeType(buf, x.Elt)
+	case *ast.ArrayType:
+		buf.WriteByte('[')
+		if x.Len != nil {
+			if lit, ok := x.Len.(*ast.BasicLit); ok {
+				buf.WriteString(lit.Value)
+			} else {
+				buf.WriteString("...")
+			}
+		}
+		buf.WriteByte(']')
+		b.writeType(buf, x.Elt)
+	case *ast.MapType:
+		buf.WriteString("map[")
+		b.writeType(buf, x.Key)
+		buf.WriteByte(']')
+		b.writeType(buf, x.Value)
+	case *ast.ChanType:
+		switch x.Dir {
+		case ast.SEND:
+			buf.WriteString("chan<- ")
+		case ast.RECV:
+			buf.WriteString("<-chan ")
+		default:
+			buf.WriteString("chan ")
+		}
+		b.writeType(buf, x.Value)
+	case *ast.FuncType:
+		buf.WriteString("func")
+		b.writeSignature(buf, x)
+	case *ast.InterfaceType:
+		buf.WriteString("interface{")
+		for i, f := range x.Methods.List {
+			if i > 0 {
+				buf.WriteString("; ")
+			}
+			if ftype, ok := f.Type.(*ast.FuncType); ok && len(f.Names) > 0 {
+				buf.WriteString(f.Names[0].Name)
+				b.writeSignature(buf, ftype)
+			} else {
+				b.writeType(buf, f.Type)
+			}
+		}
+		buf.WriteByte('}')
+	case *ast.StructType:
+		buf.WriteString("struct{")
+		for i, f := range x.Fields.List {
+			if i > 0 {
+				buf.WriteString("; ")
+			}
+			var names []string
+			for _, name := range f.Names {
+				names = append(names, name.Name)
+			}
+			if len(names) > 0 {
+				buf.WriteString(strings.Join(names, ", "))
+				buf.WriteByte(' ')
+			}
+			b.writeType(buf, f.Type)
+		}
+		buf.WriteByte('}')
+	default:
+		buf.WriteString("?")
+	}
+}
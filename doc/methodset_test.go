@@ -0,0 +1,124 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const methodSetSrc = `package widget
+
+import (
+	"io"
+	"net/http"
+)
+
+// Closer closes.
+type Closer interface {
+	Close() error
+}
+
+// ReadCloser embeds a local and a standard interface.
+type ReadCloser interface {
+	io.Reader
+	Closer
+}
+
+// hidden is not exported.
+type hidden interface {
+	Hide()
+}
+
+// Private embeds an unexported interface.
+type Private interface {
+	hidden
+	Show()
+}
+
+// File implements ReadCloser.
+type File struct{}
+
+func (f *File) Read(p []byte) (n int, err error) { return 0, nil }
+func (f File) Close() error                      { return nil }
+func (f *File) Name() string                     { return "" }
+func (f *File) unexported()                      {}
+
+// Pipe nearly implements ReadCloser. The Read method takes a string.
+type Pipe struct{}
+
+func (p *Pipe) Read(s string) (int, error) { return 0, nil }
+func (p *Pipe) Close() error             { return nil }
+
+// Conn embeds an io.Writer.
+type Conn struct {
+	io.Writer
+	Addr string
+}
+
+func (c *Conn) Serve(h http.Handler, ch <-chan []uint8, fn func(...interface{}) *File) {}
+
+// Count has no methods.
+type Count int
+`
+
+func TestMethodSets(t *testing.T) {
+	pdoc := diffTestPackage(t, methodSetSrc, "1")
+	want := map[string]struct {
+		methods     []string
+		isInterface bool
+	}{
+		"Closer":     {[]string{"Close() error"}, true},
+		"ReadCloser": {[]string{"Close() error", "Read([]byte) (int, error)"}, true},
+		"Private":    {nil, true},
+		"File":       {[]string{"Close() error", "Name() string", "Read([]byte) (int, error)"}, false},
+		"Pipe":       {[]string{"Close() error", "Read(string) (int, error)"}, false},
+		"Conn": {[]string{
+			"Serve(net/http.Handler, <-chan []byte, func(...interface{}) *example.com/widget.File)",
+			"Write([]byte) (int, error)",
+		}, false},
+		"Count": {nil, false},
+	}
+	for _, typ := range pdoc.Types {
+		w, ok := want[typ.Name]
+		if !ok {
+			t.Errorf("unexpected type %s", typ.Name)
+			continue
+		}
+		delete(want, typ.Name)
+		if !reflect.DeepEqual(typ.MethodSet, w.methods) || typ.Interface != w.isInterface {
+			t.Errorf("%s: method set %q, interface %v; want %q, %v", typ.Name, typ.MethodSet, typ.Interface, w.methods, w.isInterface)
+		}
+	}
+	for name := range want {
+		t.Errorf("missing type %s", name)
+	}
+}
+
+func TestStandardInterfaces(t *testing.T) {
+	for name, methods := range StandardInterfaces {
+		if len(methods) == 0 || !sort.StringsAreSorted(methods) {
+			t.Errorf("%s: method set %q is empty or not sorted", name, methods)
+		}
+	}
+	want := []string{"Close() error", "Read([]byte) (int, error)", "Write([]byte) (int, error)"}
+	if got := StandardInterfaces["io.ReadWriteCloser"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("io.ReadWriteCloser = %q, want %q", got, want)
+	}
+	if got := StandardInterfaces["hash.Hash32"]; len(got) != 6 {
+		t.Errorf("hash.Hash32 = %q, want 6 methods", got)
+	}
+}
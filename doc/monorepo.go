@@ -0,0 +1,139 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// monorepoFileThreshold is the number of entries in a repository tree above
+// which the repository is fetched one directory at a time.
+const monorepoFileThreshold = 10000
+
+// MonorepoStore stores the project roots detected as monorepos by the size
+// of the repository tree.
+type MonorepoStore interface {
+	IsMonorepo(projectRoot string) (bool, error)
+	SetMonorepo(projectRoot string) error
+}
+
+var monorepos = struct {
+	sync.Mutex
+	configured map[string]bool
+	store      MonorepoStore
+}{}
+
+// SetMonorepoStore sets the store for the detected monorepos. Detected
+// monorepos are not remembered if the store is not set.
+func SetMonorepoStore(store MonorepoStore) {
+	monorepos.Lock()
+	monorepos.store = store
+	monorepos.Unlock()
+}
+
+// SetMonorepos sets the project roots that are always fetched one directory
+// at a time. Project roots detected by the size of the repository tree are
+// not changed.
+func SetMonorepos(projectRoots []string) {
+	m := make(map[string]bool)
+	for _, root := range projectRoots {
+		m[root] = true
+	}
+	monorepos.Lock()
+	monorepos.configured = m
+	monorepos.Unlock()
+}
+
+// IsMonorepo returns true if the project with the given root is fetched one
+// directory at a time.
+func IsMonorepo(projectRoot string) bool {
+	monorepos.Lock()
+	configured, store := monorepos.configured[projectRoot], monorepos.store
+	monorepos.Unlock()
+	if configured || store == nil {
+		return configured
+	}
+	detected, err := store.IsMonorepo(projectRoot)
+	if err != nil {
+		log.Printf("ERROR IsMonorepo(%q): %v", projectRoot, err)
+	}
+	return detected
+}
+
+func setDetectedMonorepo(projectRoot string) {
+	monorepos.Lock()
+	store := monorepos.store
+	monorepos.Unlock()
+	if store == nil {
+		return
+	}
+	if err := store.SetMonorepo(projectRoot); err != nil {
+		log.Printf("ERROR SetMonorepo(%q): %v", projectRoot, err)
+	}
+}
+
+// isSubdirectory returns true if the directory name can hold a package
+// shown in the directory listing.
+func isSubdirectory(name string) bool {
+	return name != "" && name[0] != '.' && name[0] != '_' && name != "testdata"
+}
+
+// getGithubDir returns the documentation files and subdirectories of the
+// directory match["dir"]. The directory is listed with the contents API
+// instead of fetching the tree of the whole repository. All pages of the
+// listing are read.
+func getGithubDir(client *http.Client, match map[string]string) ([]*source, []string, error) {
+	setGithubDefaults(match)
+	var contents []struct {
+		Type   string `json:"type"`
+		Name   string `json:"name"`
+		Path   string `json:"path"`
+		Sha    string `json:"sha"`
+		GitURL string `json:"git_url"`
+	}
+	if err := httpGetJSONPages(client, expand("{api}/repos/{owner}/{repo}/contents{dir}?ref={tag}&per_page=100", match), &contents); err != nil {
+		return nil, nil, err
+	}
+
+	var files []*source
+	var subdirs []string
+	for _, c := range contents {
+		switch {
+		case c.Type == "dir" && isSubdirectory(c.Name):
+			subdirs = append(subdirs, c.Name)
+		case c.Type == "symlink" && isDocFile(c.Name):
+			addSymlink(match, c.Name)
+		case c.Type == "file" && isDocFile(c.Name):
+			rawURL := c.GitURL
+			if match["raw"] != "" {
+				rawURL = rawFileURL(match, c.Path)
+			}
+			files = append(files, &source{
+				name:      c.Name,
+				browseURL: expand("{web}/{owner}/{repo}/blob/{tag}/{0}", match, c.Path),
+				rawURL:    rawURL,
+				hash:      c.Sha,
+			})
+		}
+	}
+	if len(files) == 0 && len(subdirs) == 0 {
+		return nil, nil, NotFoundError{"Directory does not contain Go files or subdirectories."}
+	}
+	sort.Strings(subdirs)
+	return files, subdirs, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// monorepoFixtures is a three level repository tree:
+//
+//	doc.go
+//	a/a.go
+//	a/c/c.go
+//	b/b.go
+var monorepoFixtures = map[string]string{
+	"/repos/owner/big/contents": `[
+		{"type": "file", "name": "doc.go", "path": "doc.go", "sha": "h0", "git_url": "https://api.github.com/repos/owner/big/git/blobs/h0"},
+		{"type": "file", "name": "README.md", "path": "README.md", "sha": "h1", "git_url": "https://api.github.com/repos/owner/big/git/blobs/h1"},
+		{"type": "dir", "name": "b", "path": "b"},
+		{"type": "dir", "name": "a", "path": "a"},
+		{"type": "dir", "name": ".github", "path": ".github"},
+		{"type": "dir", "name": "testdata", "path": "testdata"}]`,
+	"/repos/owner/big/contents/a": `[
+		{"type": "file", "name": "a.go", "path": "a/a.go", "sha": "h2", "git_url": "https://api.github.com/repos/owner/big/git/blobs/h2"},
+		{"type": "dir", "name": "c", "path": "a/c"}]`,
+	"/repos/owner/big/contents/a/c": `[
+		{"type": "file", "name": "c.go", "path": "a/c/c.go", "sha": "h3", "git_url": "https://api.github.com/repos/owner/big/git/blobs/h3"}]`,
+	"/repos/owner/big/contents/b": `[
+		{"type": "file", "name": "b.go", "path": "b/b.go", "sha": "h4", "git_url": "https://api.github.com/repos/owner/big/git/blobs/h4"}]`,
+	"/repos/owner/big/git/trees/master": `{"url": "https://api.github.com/repos/owner/big/git/trees/master", "truncated": true, "tree": []}`,
+	"/repos/owner/small/git/trees/master": `{"url": "https://api.github.com/repos/owner/small/git/trees/master", "tree": [
+		{"path": "small.go", "type": "blob", "sha": "h5", "url": "https://api.github.com/repos/owner/small/git/blobs/h5"}]}`,
+}
+
+// newCountingTestClient returns a client for a server that responds with
+// the fixtures and counts the requests for each path.
+func newCountingTestClient(fixtures map[string]string) (*http.Client, func() map[string]int, func()) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		s, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(s))
+	}))
+	u, _ := url.Parse(server.URL)
+	getHits := func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		result := make(map[string]int)
+		for k, v := range hits {
+			result[k] = v
+		}
+		return result
+	}
+	return &http.Client{Transport: rewriteTransport{u}}, getHits, server.Close
+}
+
+// fakeMonorepoStore is a MonorepoStore in memory.
+type fakeMonorepoStore map[string]bool
+
+func (s fakeMonorepoStore) IsMonorepo(projectRoot string) (bool, error) {
+	return s[projectRoot], nil
+}
+
+func (s fakeMonorepoStore) SetMonorepo(projectRoot string) error {
+	s[projectRoot] = true
+	return nil
+}
+
+func resetMonorepos() {
+	monorepos.Lock()
+	monorepos.configured = nil
+	monorepos.store = fakeMonorepoStore{}
+	monorepos.Unlock()
+}
+
+func TestGetGithubDir(t *testing.T) {
+	client, hits, done := newCountingTestClient(monorepoFixtures)
+	defer done()
+
+	for _, tt := range []struct {
+		dir     string
+		files   []string
+		subdirs []string
+	}{
+		{"", []string{"doc.go", "README.md"}, []string{"a", "b"}},
+		{"/a", []string{"a.go"}, []string{"c"}},
+		{"/a/c", []string{"c.go"}, nil},
+	} {
+		match := map[string]string{"owner": "owner", "repo": "big", "tag": "master", "dir": tt.dir}
+		files, subdirs, err := getGithubDir(client, match)
+		if err != nil {
+			t.Errorf("getGithubDir(%q) returned error %v", tt.dir, err)
+			continue
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.name)
+			if f.hash == "" {
+				t.Errorf("getGithubDir(%q) file %s has no hash", tt.dir, f.name)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.files) || !reflect.DeepEqual(subdirs, tt.subdirs) {
+			t.Errorf("getGithubDir(%q) = %v, %v, want %v, %v", tt.dir, names, subdirs, tt.files, tt.subdirs)
+		}
+	}
+
+	// Each directory is listed with one request. The repository tree and
+	// the sibling directory b are not fetched.
+	want := map[string]int{
+		"/repos/owner/big/contents":     1,
+		"/repos/owner/big/contents/a":   1,
+		"/repos/owner/big/contents/a/c": 1,
+	}
+	if got := hits(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %v, want %v", got, want)
+	}
+
+	match := map[string]string{"owner": "owner", "repo": "big", "tag": "master", "dir": "/missing"}
+	if _, _, err := getGithubDir(client, match); !IsNotFound(err) {
+		t.Errorf("getGithubDir(/missing) returned %v, want not found", err)
+	}
+}
+
+func TestDetectMonorepo(t *testing.T) {
+	resetMonorepos()
+	defer SetMonorepoStore(nil)
+	client, _, done := newCountingTestClient(monorepoFixtures)
+	defer done()
+
+	match := map[string]string{"owner": "owner", "repo": "big", "tag": "master", "dir": ""}
+	if _, truncated, err := getGithubTree(client, match); err != nil || !truncated {
+		t.Errorf("getGithubTree(big) = %v, %v, want truncated", truncated, err)
+	}
+	if !IsMonorepo("github.com/owner/big") {
+		t.Errorf("truncated repository not detected as monorepo")
+	}
+
+	match = map[string]string{"owner": "owner", "repo": "small", "tag": "master", "dir": ""}
+	files, truncated, err := getGithubTree(client, match)
+	if err != nil || truncated || len(files) != 1 {
+		t.Errorf("getGithubTree(small) = %d files, %v, %v, want 1 file", len(files), truncated, err)
+	}
+	if IsMonorepo("github.com/owner/small") {
+		t.Errorf("small repository detected as monorepo")
+	}
+}
+
+func TestSetMonorepos(t *testing.T) {
+	resetMonorepos()
+	defer SetMonorepoStore(nil)
+	defer SetMonorepos(nil)
+	setDetectedMonorepo("github.com/owner/detected")
+	SetMonorepos([]string{"github.com/owner/configured"})
+	SetMonorepos([]string{"github.com/owner/other"})
+	for root, want := range map[string]bool{
+		"github.com/owner/detected":   true,
+		"github.com/owner/configured": false,
+		"github.com/owner/other":      true,
+	} {
+		if got := IsMonorepo(root); got != want {
+			t.Errorf("IsMonorepo(%q) = %v, want %v", root, got, want)
+		}
+	}
+}
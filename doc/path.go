@@ -15,8 +15,6 @@
 package doc
 
 import (
-	"path"
-	"regexp"
 	"strings"
 )
 
@@ -484,42 +482,13 @@ var validTLD = map[string]bool{
 	".zw":                     true,
 }
 
-var validHost = regexp.MustCompile(`^[-a-z0-9]+(?:\.[-a-z0-9]+)+$`)
-var validPathElement = regexp.MustCompile(`^[-A-Za-z0-9~+][-A-Za-z0-9_.]*$`)
-
 var blackHosts = map[string]bool {
 	"gist.github.com": true,
 }
 
 // IsValidRemotePath returns true if importPath is structurally valid for "go get".
 func IsValidRemotePath(importPath string) bool {
-
-	parts := strings.Split(importPath, "/")
-
-	if len(parts) <= 1 {
-		// Import path must contain at least one "/".
-		return false
-	}
-
-	if !validTLD[path.Ext(parts[0])] {
-		return false
-	}
-
-	if !validHost.MatchString(parts[0]) {
-		return false
-	}
-	
-	if blackHosts[parts[0]] {
-		return false
-	}
-
-	for _, part := range parts[1:] {
-		if !validPathElement.MatchString(part) || part == "testdata" {
-			return false
-		}
-	}
-
-	return true
+	return checkRemotePath(importPath) == ""
 }
 
 var goRepoPath = map[string]bool{}
@@ -541,6 +510,8 @@ func IsGoRepoPath(importPath string) bool {
 	return goRepoPath[importPath]
 }
 
+// IsValidPath returns true if importPath is the path of a standard package,
+// "C" or a valid remote path. See CheckImportPath for the rules.
 func IsValidPath(importPath string) bool {
-	return importPath == "C" || standardPath[importPath] || IsValidRemotePath(importPath)
+	return CheckImportPath(importPath) == nil
 }
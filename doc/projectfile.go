@@ -0,0 +1,58 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// GetProjectFile returns the content of the named file in the root
+// directory of the default branch of the project with the given root. The
+// file is fetched from the repository with the API of the host. Projects
+// on GitHub and on self-hosted GitHub and GitLab compatible services are
+// supported.
+func GetProjectFile(client *http.Client, root, name string) ([]byte, error) {
+	var pattern *regexp.Regexp
+	match := map[string]string{"file": name}
+	c, hosted := hostedService(root)
+	switch {
+	case hosted:
+		pattern = hostedPattern
+		match["api"] = c.APIURL
+	case githubPattern.MatchString(root):
+		pattern = githubPattern
+		match["api"] = "https://api.github.com"
+	default:
+		return nil, NotFoundError{"Project files are not available for the host."}
+	}
+
+	m := pattern.FindStringSubmatch(root)
+	if m == nil || m[len(m)-1] != "" {
+		return nil, NotFoundError{"Import path is not a project root."}
+	}
+	for i, n := range pattern.SubexpNames() {
+		if n != "" {
+			match[n] = m[i]
+		}
+	}
+
+	if hosted && c.Kind == HostGitlabCompatible {
+		match["project"] = url.QueryEscape(match["owner"] + "/" + match["repo"])
+		return httpGetBytes(client, expand("{api}/projects/{project}/repository/files/{0}/raw?ref=HEAD", match, url.QueryEscape(name)), nil)
+	}
+	return httpGetBytes(client, expand("{api}/repos/{owner}/{repo}/contents/{file}", match), githubRawHeader)
+}
@@ -0,0 +1,57 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"testing"
+)
+
+func TestGetProjectFile(t *testing.T) {
+	client, done := newGithubTestClient(map[string]string{
+		"/repos/owner/repo/contents/.gddo-refresh": "token1\n",
+	})
+	defer done()
+
+	p, err := GetProjectFile(client, "github.com/owner/repo", ".gddo-refresh")
+	if err != nil || string(p) != "token1\n" {
+		t.Errorf("GetProjectFile(github.com/owner/repo) = %q, %v, want %q", p, err, "token1\n")
+	}
+	if _, err := GetProjectFile(client, "github.com/owner/other", ".gddo-refresh"); err == nil {
+		t.Errorf("GetProjectFile() for missing file returned nil error")
+	}
+	if _, err := GetProjectFile(client, "github.com/owner/repo/sub", ".gddo-refresh"); !IsNotFound(err) {
+		t.Errorf("GetProjectFile() for subdirectory returned %v, want NotFoundError", err)
+	}
+	if _, err := GetProjectFile(client, "example.com/repo", ".gddo-refresh"); !IsNotFound(err) {
+		t.Errorf("GetProjectFile() for unsupported host returned %v, want NotFoundError", err)
+	}
+}
+
+func TestGetHostedProjectFile(t *testing.T) {
+	if err := SetHosts([]HostConfig{{Host: "gitlab.example.com", Kind: HostGitlabCompatible, APIURL: "https://gitlab.example.com/api/v4"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetHosts(nil)
+
+	client, _, done := newHostedTestClient(map[string]string{
+		"/api/v4/projects/group%2Fproj/repository/files/.gddo-refresh/raw?ref=HEAD": "token2",
+	})
+	defer done()
+
+	p, err := GetProjectFile(client, "gitlab.example.com/group/proj", ".gddo-refresh")
+	if err != nil || string(p) != "token2" {
+		t.Errorf("GetProjectFile(gitlab.example.com/group/proj) = %q, %v, want %q", p, err, "token2")
+	}
+}
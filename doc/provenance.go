@@ -0,0 +1,96 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"time"
+)
+
+// Kinds of resolution of the tag or branch documented for a package.
+const (
+	// The default branch reported by the repository host, or the default
+	// branch for the VCS if the host does not report one.
+	ResolvedDefaultBranch = "default-branch"
+
+	// The go1 tag or branch, which the go get command prefers over the
+	// default branch.
+	ResolvedGo1 = "go1"
+
+	// The default branch for the VCS because the default branch reported
+	// by the host was not found.
+	ResolvedVCSDefault = "vcs-default"
+
+	// The tag or branch requested explicitly with GetRef.
+	ResolvedExplicit = "explicit"
+)
+
+// Resolution records how the tag or branch documented for a package was
+// chosen.
+type Resolution struct {
+	// Kind of resolution, one of the Resolved constants. Kind is "" for
+	// VCSs without branches and for packages stored before resolutions were
+	// recorded.
+	Kind string
+
+	// Tag or branch documented.
+	Ref string
+
+	// Default branch reported by the repository host at the time of the
+	// resolution or "" if the host does not report a default branch.
+	HostDefault string
+
+	// Time of the resolution.
+	Resolved time.Time
+}
+
+// resolve returns the resolution of tag chosen by bestTag. The time of the
+// resolution is set when the documentation is built.
+func resolve(tag, hostDefault string) Resolution {
+	r := Resolution{Ref: tag, HostDefault: hostDefault}
+	switch {
+	case tag == "":
+		// VCS without branches.
+	case tag == "go1":
+		r.Kind = ResolvedGo1
+	case tag == hostDefault || hostDefault == "":
+		r.Kind = ResolvedDefaultBranch
+	default:
+		r.Kind = ResolvedVCSDefault
+	}
+	return r
+}
+
+// Banner returns a sentence explaining how the documented tag or branch
+// differs from the default branch of the project or "" if the default
+// branch is documented. The argument currentDefault is the default branch
+// most recently reported by the host, for example in the project activity,
+// or "" if not known. A difference between currentDefault and the
+// documented branch means that the host changed the default branch since
+// the documentation was built.
+func (r Resolution) Banner(currentDefault string) (message string, stale bool) {
+	switch r.Kind {
+	case ResolvedGo1:
+		return "You are viewing the documentation for the go1 tag or branch. The go get command prefers go1 over the default branch of the project.", false
+	case ResolvedExplicit:
+		return "You are viewing the documentation for the " + r.Ref + " tag or branch.", false
+	case ResolvedVCSDefault:
+		return "You are viewing the documentation for the " + r.Ref + " branch because the default branch " + r.HostDefault + " of the project was not found.", false
+	case ResolvedDefaultBranch:
+		if r.HostDefault != "" && currentDefault != "" && currentDefault != r.Ref {
+			return "You are viewing the documentation for the " + r.Ref + " branch. The default branch of the project is now " + currentDefault + ".", true
+		}
+	}
+	return "", false
+}
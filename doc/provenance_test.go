@@ -0,0 +1,67 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"testing"
+)
+
+var resolveTests = []struct {
+	tag, hostDefault string
+	kind             string
+}{
+	{"", "", ""},
+	{"go1", "master", ResolvedGo1},
+	{"main", "main", ResolvedDefaultBranch},
+	{"master", "", ResolvedDefaultBranch},
+	{"master", "develop", ResolvedVCSDefault},
+}
+
+func TestResolve(t *testing.T) {
+	for _, tt := range resolveTests {
+		if r := resolve(tt.tag, tt.hostDefault); r.Kind != tt.kind || r.Ref != tt.tag || r.HostDefault != tt.hostDefault {
+			t.Errorf("resolve(%q, %q) = %+v, want kind %q", tt.tag, tt.hostDefault, r, tt.kind)
+		}
+	}
+}
+
+var bannerTests = []struct {
+	resolution     Resolution
+	currentDefault string
+	message        string
+	stale          bool
+}{
+	{Resolution{}, "", "", false},
+	{Resolution{Kind: ResolvedDefaultBranch, Ref: "master", HostDefault: "master"}, "", "", false},
+	{Resolution{Kind: ResolvedDefaultBranch, Ref: "master", HostDefault: "master"}, "master", "", false},
+	{Resolution{Kind: ResolvedDefaultBranch, Ref: "master"}, "main", "", false},
+	{Resolution{Kind: ResolvedDefaultBranch, Ref: "master", HostDefault: "master"}, "main",
+		"You are viewing the documentation for the master branch. The default branch of the project is now main.", true},
+	{Resolution{Kind: ResolvedGo1, Ref: "go1", HostDefault: "master"}, "master",
+		"You are viewing the documentation for the go1 tag or branch. The go get command prefers go1 over the default branch of the project.", false},
+	{Resolution{Kind: ResolvedVCSDefault, Ref: "master", HostDefault: "develop"}, "",
+		"You are viewing the documentation for the master branch because the default branch develop of the project was not found.", false},
+	{Resolution{Kind: ResolvedExplicit, Ref: "v1.0.0", HostDefault: "master"}, "master",
+		"You are viewing the documentation for the v1.0.0 tag or branch.", false},
+}
+
+func TestBanner(t *testing.T) {
+	for _, tt := range bannerTests {
+		message, stale := tt.resolution.Banner(tt.currentDefault)
+		if message != tt.message || stale != tt.stale {
+			t.Errorf("%+v.Banner(%q) = %q, %v, want %q, %v", tt.resolution, tt.currentDefault, message, stale, tt.message, tt.stale)
+		}
+	}
+}
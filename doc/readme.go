@@ -0,0 +1,288 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/scanner"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReadmeExample is a fenced Go code block from a README file in the package
+// directory. Unlike an Example, a README example is not compiled or run by
+// go test.
+type ReadmeExample struct {
+	// Name of the README file.
+	File string
+
+	// Line of the opening code fence.
+	Line int
+
+	Code Code
+}
+
+const (
+	// Maximum number of README examples for a package.
+	maxReadmeExamples = 10
+
+	// Minimum number of non-blank lines in a README example.
+	minReadmeExampleLines = 3
+)
+
+// codeBlock is a fenced code block in a Markdown file.
+type codeBlock struct {
+	// Line of the opening fence.
+	line int
+
+	// First word of the fence info string in lower case.
+	lang string
+
+	text string
+}
+
+// fencedCodeBlocks returns the fenced code blocks in a Markdown file. A
+// block that is not closed ends at the end of the file.
+func fencedCodeBlocks(p []byte) []codeBlock {
+	var (
+		blocks []codeBlock
+		block  *codeBlock
+		lines  []string
+		fence  string
+		indent int
+	)
+	for i, line := range strings.Split(string(p), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if block == nil {
+			n := len(line) - len(strings.TrimLeft(line, " "))
+			if n > 3 {
+				continue
+			}
+			s := line[n:]
+			if !strings.HasPrefix(s, "```") && !strings.HasPrefix(s, "~~~") {
+				continue
+			}
+			j := 0
+			for j < len(s) && s[j] == s[0] {
+				j++
+			}
+			info := strings.TrimSpace(s[j:])
+			if s[0] == '`' && strings.Contains(info, "`") {
+				continue
+			}
+			block = &codeBlock{line: i + 1}
+			if f := strings.Fields(info); len(f) > 0 {
+				block.lang = strings.ToLower(f[0])
+			}
+			fence, indent, lines = s[:j], n, nil
+			continue
+		}
+		if s := strings.TrimLeft(line, " "); len(line)-len(s) <= 3 {
+			s = strings.TrimRight(s, " \t")
+			if len(s) >= len(fence) && strings.Trim(s, fence[:1]) == "" {
+				block.text = strings.Join(lines, "\n")
+				blocks = append(blocks, *block)
+				block = nil
+				continue
+			}
+		}
+		for j := 0; j < indent && strings.HasPrefix(line, " "); j++ {
+			line = line[1:]
+		}
+		lines = append(lines, line)
+	}
+	if block != nil {
+		block.text = strings.TrimRight(strings.Join(lines, "\n"), "\n")
+		blocks = append(blocks, *block)
+	}
+	return blocks
+}
+
+// readmeTokens scans src as Go source. The function returns false if src
+// does not tokenize as Go. The function also reports whether src refers to
+// the package by import path or, except for commands, by a qualified
+// identifier.
+func readmeTokens(src, importPath, name string) (ok, references bool) {
+	var s scanner.Scanner
+	nerr := 0
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, []byte(src), func(token.Position, string) { nerr++ }, 0)
+	prev := token.ILLEGAL
+	prevLit := ""
+	n := 0
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		n++
+		switch {
+		case tok == token.STRING:
+			if p, err := strconv.Unquote(lit); err == nil && p == importPath {
+				references = true
+			}
+		case tok == token.PERIOD && prev == token.IDENT && prevLit == name && name != "main":
+			references = true
+		}
+		prev, prevLit = tok, lit
+	}
+	return nerr == 0 && n > 0, references
+}
+
+type readmeMode int
+
+const (
+	readmeFile readmeMode = iota
+	readmeDecls
+	readmeStmts
+)
+
+// parseReadmeCode parses src as a Go file, as top-level declarations without
+// a package clause or as a list of statements.
+func parseReadmeCode(fset *token.FileSet, src string) (*ast.File, readmeMode, error) {
+	file, err := parser.ParseFile(fset, "readme.go", src, parser.ParseComments)
+	if err == nil {
+		return file, readmeFile, nil
+	}
+	file, err = parser.ParseFile(fset, "readme.go", "package p\n"+src, parser.ParseComments)
+	if err == nil {
+		return file, readmeDecls, nil
+	}
+	file, err = parser.ParseFile(fset, "readme.go", "package p\nfunc _() {\n"+src+"\n}", parser.ParseComments)
+	if err == nil {
+		return file, readmeStmts, nil
+	}
+	return nil, 0, err
+}
+
+// readmeExamples returns the Go code blocks from the README files of the
+// package. Blocks tagged go or golang and untagged blocks that tokenize as
+// Go are examples if they parse and refer to the package. Blocks with fewer
+// than three lines are skipped.
+func (b *builder) readmeExamples() []*ReadmeExample {
+	var names []string
+	for name := range b.pdoc.ReadmeFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var examples []*ReadmeExample
+	for _, name := range names {
+		for _, block := range fencedCodeBlocks(b.pdoc.ReadmeFiles[name]) {
+			if len(examples) >= maxReadmeExamples {
+				return examples
+			}
+			switch block.lang {
+			case "go", "golang", "":
+			default:
+				continue
+			}
+			n := 0
+			for _, line := range strings.Split(block.text, "\n") {
+				if strings.TrimSpace(line) != "" {
+					n++
+				}
+			}
+			if n < minReadmeExampleLines {
+				continue
+			}
+			ok, references := readmeTokens(block.text, b.pdoc.ImportPath, b.pdoc.Name)
+			if !references || block.lang == "" && !ok {
+				continue
+			}
+			fset := token.NewFileSet()
+			file, mode, err := parseReadmeCode(fset, block.text)
+			if err != nil {
+				continue
+			}
+			code, ok := b.printReadmeCode(fset, file, mode)
+			if !ok {
+				continue
+			}
+			examples = append(examples, &ReadmeExample{File: name, Line: block.line, Code: code})
+		}
+	}
+	return examples
+}
+
+// printReadmeCode formats a parsed README example. Identifiers in blocks
+// that import the package are linked to the documentation.
+func (b *builder) printReadmeCode(fset *token.FileSet, file *ast.File, mode readmeMode) (Code, bool) {
+	config := &printer.Config{Mode: printer.UseSpaces, Tabwidth: 4}
+	var buf bytes.Buffer
+
+	if mode == readmeStmts {
+		body := file.Decls[0].(*ast.FuncDecl).Body
+		if err := config.Fprint(&buf, fset, &printer.CommentedNode{Node: body, Comments: file.Comments}); err != nil {
+			return Code{}, false
+		}
+		p := buf.Bytes()
+		p = bytes.TrimSuffix(bytes.TrimPrefix(p, []byte("{")), []byte("}"))
+		p = bytes.TrimSpace(bytes.Replace(p, []byte("\n    "), []byte("\n"), -1))
+		return Code{Text: string(p), Annotations: commentAnnotations(p)}, true
+	}
+
+	if err := config.Fprint(&buf, fset, file); err != nil {
+		return Code{}, false
+	}
+	p := buf.Bytes()
+	if mode == readmeDecls {
+		const clause = "package p\n\n"
+		if !bytes.HasPrefix(p, []byte(clause)) {
+			return Code{}, false
+		}
+		p = p[len(clause):]
+	}
+	p = bytes.TrimSpace(p)
+
+	linked := false
+	for _, spec := range file.Imports {
+		if path, err := strconv.Unquote(spec.Path.Value); err == nil && path == b.pdoc.ImportPath {
+			linked = true
+		}
+	}
+	if !linked {
+		return Code{Text: string(p), Annotations: commentAnnotations(p)}, true
+	}
+
+	// Resolve the imports. The package name is known for the import of the
+	// documented package.
+	ast.NewPackage(fset, map[string]*ast.File{"readme.go": file}, packageImporter(b.pdoc.ImportPath, b.pdoc.Name), nil)
+
+	v := &annotationVisitor{pathIndex: make(map[string]int)}
+	if mode == readmeFile {
+		v.ignoreName()
+	}
+	for _, decl := range file.Decls {
+		ast.Walk(v, decl)
+	}
+
+	// Keep links to imported packages only. Anchors and links to exported
+	// names declared in the example do not refer to the documentation.
+	var annotations []Annotation
+	for _, a := range v.annotate(p) {
+		if a.Kind == AnchorAnnotation || a.Kind == ExportLinkAnnotation && a.PathIndex < 0 {
+			continue
+		}
+		annotations = append(annotations, a)
+	}
+	return Code{Text: string(p), Annotations: annotations, Paths: v.paths}, true
+}
@@ -0,0 +1,166 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var fencedCodeBlocksTests = []struct {
+	src    string
+	blocks []codeBlock
+}{
+	{"```go\nx := 1\n```\n", []codeBlock{{line: 1, lang: "go", text: "x := 1"}}},
+	{"text\n~~~ Go linenos\na\n\nb\n~~~\n", []codeBlock{{line: 2, lang: "go", text: "a\n\nb"}}},
+	{"  ```\n  a\n    b\n  ```\n", []codeBlock{{line: 1, text: "a\n  b"}}},
+	{"````\n```\n````\n", []codeBlock{{line: 1, text: "```"}}},
+	{"```sh\n$ go get x\r\n", []codeBlock{{line: 1, lang: "sh", text: "$ go get x"}}},
+	{"``` a`b\nx\n", nil},
+	{"    ```\n    x\n    ```\n", nil},
+}
+
+func TestFencedCodeBlocks(t *testing.T) {
+	for _, tt := range fencedCodeBlocksTests {
+		blocks := fencedCodeBlocks([]byte(tt.src))
+		if !reflect.DeepEqual(blocks, tt.blocks) {
+			t.Errorf("fencedCodeBlocks(%q) = %+v, want %+v", tt.src, blocks, tt.blocks)
+		}
+	}
+}
+
+const readmeExampleFixture = "# repo\n" +
+	"\n" +
+	"Install:\n" +
+	"\n" +
+	"```sh\n" +
+	"go get github.com/user/repo\n" +
+	"go test github.com/user/repo\n" +
+	"go install github.com/user/repo\n" +
+	"```\n" +
+	"\n" +
+	"Usage:\n" +
+	"\n" +
+	"```go\n" +
+	"package main\n" +
+	"\n" +
+	"import (\n" +
+	"\t\"fmt\"\n" +
+	"\n" +
+	"\t\"github.com/user/repo\"\n" +
+	")\n" +
+	"\n" +
+	"func main() {\n" +
+	"\tc := repo.NewClient() // connect\n" +
+	"\tfmt.Println(c.Get(\"key\"))\n" +
+	"}\n" +
+	"```\n" +
+	"\n" +
+	"```\n" +
+	"c := repo.NewClient()\n" +
+	"defer c.Close()\n" +
+	"c.Put(\"key\", \"value\")\n" +
+	"```\n" +
+	"\n" +
+	"```go\n" +
+	"for each key in repo.Keys():\n" +
+	"    print key\n" +
+	"end\n" +
+	"```\n" +
+	"\n" +
+	"```go\n" +
+	"c := repo.NewClient()\n" +
+	"```\n" +
+	"\n" +
+	"```go\n" +
+	"x := 1\n" +
+	"y := 2\n" +
+	"fmt.Println(x + y)\n" +
+	"```\n" +
+	"\n" +
+	"```\n" +
+	"func Handler(c *repo.Client) error {\n" +
+	"\treturn c.Ping()\n" +
+	"}\n" +
+	"```\n" +
+	"\n" +
+	"```\n" +
+	"$ repo -key x\n" +
+	"repo.Value = 1\n" +
+	"done\n" +
+	"```\n"
+
+var readmeExamplesTests = []struct {
+	line int
+	text string
+}{
+	{13, "package main\n\nimport (\n    \"fmt\"\n\n    \"github.com/user/repo\"\n)\n\nfunc main() {\n    c := repo.NewClient() // connect\n    fmt.Println(c.Get(\"key\"))\n}"},
+	{28, "c := repo.NewClient()\ndefer c.Close()\nc.Put(\"key\", \"value\")"},
+	{50, "func Handler(c *repo.Client) error {\n    return c.Ping()\n}"},
+}
+
+func TestReadmeExamples(t *testing.T) {
+	b := &builder{pdoc: &Package{
+		ImportPath:  "github.com/user/repo",
+		Name:        "repo",
+		ReadmeFiles: map[string][]byte{"README.md": []byte(readmeExampleFixture)},
+	}}
+	examples := b.readmeExamples()
+	if len(examples) != len(readmeExamplesTests) {
+		t.Fatalf("got %d examples, want %d", len(examples), len(readmeExamplesTests))
+	}
+	for i, tt := range readmeExamplesTests {
+		e := examples[i]
+		if e.File != "README.md" || e.Line != tt.line || e.Code.Text != tt.text {
+			t.Errorf("example %d = %s:%d %q, want README.md:%d %q", i, e.File, e.Line, e.Code.Text, tt.line, tt.text)
+		}
+	}
+
+	// The example that imports the package is linked.
+	code := examples[0].Code
+	var links []string
+	for _, a := range code.Annotations {
+		switch a.Kind {
+		case ExportLinkAnnotation, PackageLinkAnnotation:
+			links = append(links, code.Paths[a.PathIndex]+" "+code.Text[a.Pos:a.End])
+		case AnchorAnnotation:
+			t.Errorf("example has anchor %q", code.Text[a.Pos:a.End])
+		}
+	}
+	want := []string{"github.com/user/repo repo.NewClient", "fmt fmt.Println"}
+	if strings.Join(links, ",") != strings.Join(want, ",") {
+		t.Errorf("links = %q, want %q", links, want)
+	}
+	if a := code.Annotations[len(code.Annotations)-2]; a.Kind != CommentAnnotation || code.Text[a.Pos:a.End] != "// connect" {
+		t.Errorf("comment annotation not found")
+	}
+
+	// The statements are not linked.
+	if len(examples[1].Code.Paths) != 0 {
+		t.Errorf("statement example has links to %q", examples[1].Code.Paths)
+	}
+}
+
+func TestReadmeExamplesCommand(t *testing.T) {
+	b := &builder{pdoc: &Package{
+		ImportPath:  "github.com/user/repo/cmd/tool",
+		Name:        "main",
+		ReadmeFiles: map[string][]byte{"README": []byte("```go\nmain.x = 1\nmain.y = 2\nmain.z = 3\n```\n")},
+	}}
+	if examples := b.readmeExamples(); len(examples) != 0 {
+		t.Errorf("got %d examples for command that is not referenced, want 0", len(examples))
+	}
+}
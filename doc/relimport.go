@@ -0,0 +1,68 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/build"
+	"sort"
+	"strings"
+)
+
+// IsRelativeImport returns true if path is relative to the directory of
+// the importing package, as in "./util" or "../common".
+func IsRelativeImport(path string) bool {
+	return path == "." || path == ".." ||
+		strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../")
+}
+
+// splitRelativeImports returns the paths that are not relative and the
+// relative paths.
+func splitRelativeImports(paths []string) (imports, relative []string) {
+	for _, path := range paths {
+		if IsRelativeImport(path) {
+			relative = append(relative, path)
+		} else {
+			imports = append(imports, path)
+		}
+	}
+	return imports, relative
+}
+
+// setImports sets the imports of the package from the loaded package. The
+// relative imports are collected in RelativeImports so that they do not
+// show up as links or as edges in the import graph.
+func (b *builder) setImports(bpkg *build.Package) {
+	seen := make(map[string]bool)
+	var relative []string
+	for _, p := range []struct {
+		dst *[]string
+		src []string
+	}{
+		{&b.pdoc.Imports, bpkg.Imports},
+		{&b.pdoc.TestImports, bpkg.TestImports},
+		{&b.pdoc.XTestImports, bpkg.XTestImports},
+	} {
+		var r []string
+		*p.dst, r = splitRelativeImports(p.src)
+		for _, path := range r {
+			if !seen[path] {
+				seen[path] = true
+				relative = append(relative, path)
+			}
+		}
+	}
+	sort.Strings(relative)
+	b.pdoc.RelativeImports = relative
+}
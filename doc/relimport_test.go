@@ -0,0 +1,112 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const relativeImportSrc = `package widget
+
+import (
+	"io"
+	"../common"
+	"./util"
+)
+
+// Copy copies from r to w.
+func Copy(w io.Writer, r io.Reader) util.Buffer { return nil }
+
+// Merge merges the configurations.
+func Merge(a, b *common.Config) io.Reader { return nil }
+`
+
+func TestRelativeImports(t *testing.T) {
+	b := &builder{
+		pdoc: &Package{ImportPath: "example.com/widget"},
+		fset: token.NewFileSet(),
+	}
+	file, err := parser.ParseFile(b.fset, "widget.go", relativeImportSrc, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apkg, _ := ast.NewPackage(b.fset, map[string]*ast.File{"widget.go": file}, simpleImporter, nil)
+
+	b.vetPackage(apkg)
+	codes := make(map[string]int)
+	for _, d := range b.pdoc.Diagnostics {
+		codes[d.Code]++
+	}
+	if !reflect.DeepEqual(codes, map[string]int{DiagnosticRelativeImport: 2}) {
+		t.Errorf("diagnostic codes = %v, want two %s", codes, DiagnosticRelativeImport)
+	}
+
+	b.setImports(&build.Package{
+		Imports:      []string{"../common", "./util", "io"},
+		TestImports:  []string{"./util", "testing"},
+		XTestImports: []string{"./testutil", "example.com/widget"},
+	})
+	if want := []string{"io"}; !reflect.DeepEqual(b.pdoc.Imports, want) {
+		t.Errorf("Imports = %q, want %q", b.pdoc.Imports, want)
+	}
+	if want := []string{"testing"}; !reflect.DeepEqual(b.pdoc.TestImports, want) {
+		t.Errorf("TestImports = %q, want %q", b.pdoc.TestImports, want)
+	}
+	if want := []string{"example.com/widget"}; !reflect.DeepEqual(b.pdoc.XTestImports, want) {
+		t.Errorf("XTestImports = %q, want %q", b.pdoc.XTestImports, want)
+	}
+	if want := []string{"../common", "./testutil", "./util"}; !reflect.DeepEqual(b.pdoc.RelativeImports, want) {
+		t.Errorf("RelativeImports = %q, want %q", b.pdoc.RelativeImports, want)
+	}
+
+	// Only the standard package is linked in the declarations.
+	for _, f := range b.funcs(doc.New(apkg, b.pdoc.ImportPath, 0).Funcs) {
+		for _, a := range f.Decl.Annotations {
+			if a.Kind == PackageLinkAnnotation || a.Kind == ExportLinkAnnotation {
+				text := f.Decl.Text[a.Pos:a.End]
+				if p := f.Decl.Paths[a.PathIndex]; p != "io" || !strings.HasPrefix(text, "io.") {
+					t.Errorf("%s: %q linked to %q", f.Name, text, p)
+				}
+			}
+		}
+		if !reflect.DeepEqual(f.Decl.Paths, []string{"io"}) {
+			t.Errorf("%s: paths = %q, want [io]", f.Name, f.Decl.Paths)
+		}
+	}
+}
+
+func TestIsRelativeImport(t *testing.T) {
+	for path, want := range map[string]bool{
+		".":                      true,
+		"..":                     true,
+		"./util":                 true,
+		"../common":              true,
+		"io":                     false,
+		"github.com/user/repo":   false,
+		"github.com/user/./repo": false,
+		".hidden/pkg":            false,
+	} {
+		if got := IsRelativeImport(path); got != want {
+			t.Errorf("IsRelativeImport(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
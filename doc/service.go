@@ -0,0 +1,149 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServiceState is the lifecycle state of a repository host.
+type ServiceState int
+
+const (
+	// ServiceActive hosts are fetched from.
+	ServiceActive ServiceState = iota
+
+	// ServiceDeprecated hosts no longer serve repositories. Stored
+	// documentation is served, but packages are not fetched.
+	ServiceDeprecated
+
+	// ServiceRemoved hosts no longer serve repositories and the stored
+	// documentation is not served.
+	ServiceRemoved
+)
+
+var serviceStateNames = []string{"active", "deprecated", "removed"}
+
+func (s ServiceState) String() string {
+	if s < 0 || int(s) >= len(serviceStateNames) {
+		return "unknown"
+	}
+	return serviceStateNames[s]
+}
+
+// ParseServiceState returns the state with the given name.
+func ParseServiceState(name string) (ServiceState, bool) {
+	for i, n := range serviceStateNames {
+		if n == name {
+			return ServiceState(i), true
+		}
+	}
+	return 0, false
+}
+
+// defaultServiceStates is the state of hosts that no longer serve
+// repositories.
+var defaultServiceStates = map[string]ServiceState{
+	"code.google.com": ServiceDeprecated,
+}
+
+var serviceStates = struct {
+	sync.Mutex
+	m map[string]ServiceState
+}{m: defaultServiceStates}
+
+// SetServiceStates sets the state of hosts. Hosts not in states have their
+// default state.
+func SetServiceStates(states map[string]ServiceState) {
+	m := make(map[string]ServiceState)
+	for host, s := range defaultServiceStates {
+		m[host] = s
+	}
+	for host, s := range states {
+		m[host] = s
+	}
+	serviceStates.Lock()
+	serviceStates.m = m
+	serviceStates.Unlock()
+}
+
+// GetServiceState returns the host and state of the service for an import
+// path. Standard packages are always active.
+func GetServiceState(importPath string) (string, ServiceState) {
+	if IsGoRepoPath(importPath) {
+		return "", ServiceActive
+	}
+	host := strings.SplitN(importPath, "/", 2)[0]
+	serviceStates.Lock()
+	s := serviceStates.m[host]
+	serviceStates.Unlock()
+	return host, s
+}
+
+// ServiceStatus is the state of a repository host.
+type ServiceStatus struct {
+	Host  string
+	State ServiceState
+}
+
+// Services returns the state of the statically known hosts and the hosts
+// with a configured state, sorted by host.
+func Services() []ServiceStatus {
+	serviceStates.Lock()
+	defer serviceStates.Unlock()
+	hosts := make(map[string]bool)
+	for _, s := range services {
+		if s.prefix != "" {
+			hosts[strings.TrimSuffix(s.prefix, "/")] = true
+		}
+	}
+	for host := range serviceStates.m {
+		hosts[host] = true
+	}
+	var result []ServiceStatus
+	for host := range hosts {
+		result = append(result, ServiceStatus{host, serviceStates.m[host]})
+	}
+	sort.Sort(servicesByHost(result))
+	return result
+}
+
+type servicesByHost []ServiceStatus
+
+func (s servicesByHost) Len() int           { return len(s) }
+func (s servicesByHost) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s servicesByHost) Less(i, j int) bool { return s[i].Host < s[j].Host }
+
+// ServiceStateError is returned by Get and GetPresentation for import paths
+// on hosts that are not active.
+type ServiceStateError struct {
+	Host  string
+	State ServiceState
+}
+
+func (e *ServiceStateError) Error() string {
+	return e.Host + " no longer hosts repositories (" + e.State.String() + ")."
+}
+
+// checkServiceState returns an error if the host of importPath is not
+// active.
+func checkServiceState(importPath string) error {
+	if host, s := GetServiceState(importPath); s != ServiceActive {
+		return &ServiceStateError{host, s}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"testing"
+)
+
+var serviceStateTests = []struct {
+	importPath string
+	host       string
+	state      ServiceState
+}{
+	{"code.google.com/p/project", "code.google.com", ServiceDeprecated},
+	{"github.com/user/repo", "github.com", ServiceActive},
+	{"example.org/gone/pkg", "example.org", ServiceRemoved},
+	{"fmt", "", ServiceActive},
+}
+
+func TestServiceState(t *testing.T) {
+	defer SetServiceStates(nil)
+	SetServiceStates(map[string]ServiceState{"example.org": ServiceRemoved})
+
+	for _, tt := range serviceStateTests {
+		host, state := GetServiceState(tt.importPath)
+		if host != tt.host || state != tt.state {
+			t.Errorf("GetServiceState(%q) = %q, %v, want %q, %v", tt.importPath, host, state, tt.host, tt.state)
+		}
+		if state == ServiceActive {
+			continue
+		}
+		// The nil client panics if Get or GetPresentation use the network.
+		if _, err := Get(nil, tt.importPath, ""); err == nil {
+			t.Errorf("Get(%q) returned nil error", tt.importPath)
+		} else if e, ok := err.(*ServiceStateError); !ok || e.Host != tt.host || e.State != tt.state {
+			t.Errorf("Get(%q) returned %v, want service state error", tt.importPath, err)
+		}
+		if _, err := GetPresentation(nil, tt.importPath+"/talk.slide"); err == nil {
+			t.Errorf("GetPresentation(%q) returned nil error", tt.importPath)
+		}
+	}
+
+	// Configured states override the defaults and are reverted by the next
+	// call to SetServiceStates.
+	SetServiceStates(map[string]ServiceState{"code.google.com": ServiceActive})
+	if _, state := GetServiceState("code.google.com/p/project"); state != ServiceActive {
+		t.Errorf("code.google.com state = %v, want active", state)
+	}
+	SetServiceStates(nil)
+	if _, state := GetServiceState("code.google.com/p/project"); state != ServiceDeprecated {
+		t.Errorf("code.google.com state = %v, want deprecated", state)
+	}
+	if _, state := GetServiceState("example.org/gone/pkg"); state != ServiceActive {
+		t.Errorf("example.org state = %v, want active", state)
+	}
+}
+
+func TestParseServiceState(t *testing.T) {
+	for _, s := range []ServiceState{ServiceActive, ServiceDeprecated, ServiceRemoved} {
+		if parsed, ok := ParseServiceState(s.String()); !ok || parsed != s {
+			t.Errorf("ParseServiceState(%q) = %v, %v", s.String(), parsed, ok)
+		}
+	}
+	if _, ok := ParseServiceState("gone"); ok {
+		t.Errorf("ParseServiceState(gone) returned ok")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"fmt"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// API stabilities of a package.
+const (
+	StabilityFrozen       = "frozen"
+	StabilityStable       = "stable"
+	StabilityExperimental = "experimental"
+	StabilityDeprecated   = "deprecated"
+)
+
+// stabilityOrder is the stabilities in order of precedence. A package
+// comment that declares more than one stability is classified with the
+// first stability in the list.
+var stabilityOrder = []string{
+	StabilityDeprecated,
+	StabilityFrozen,
+	StabilityExperimental,
+	StabilityStable,
+}
+
+var defaultStabilityPhrases = map[string][]string{
+	StabilityDeprecated: {
+		"deprecated:",
+		"package is deprecated",
+		"is no longer maintained",
+		"is unmaintained",
+	},
+	StabilityFrozen: {
+		"package is frozen",
+		"api is frozen",
+		"no new features will be added",
+	},
+	StabilityExperimental: {
+		"is experimental",
+		"api may change",
+		"api is not stable",
+		"api is unstable",
+		"subject to change",
+		"work in progress",
+	},
+	StabilityStable: {
+		"api is stable",
+		"package is stable",
+		"is considered stable",
+		"backwards compatibility is guaranteed",
+	},
+}
+
+var stabilityPhrases = struct {
+	sync.Mutex
+	m map[string][]string
+}{m: defaultStabilityPhrases}
+
+// SetStabilityPhrases sets the phrases that declare the API stability of a
+// package in the package comment. Stabilities missing from phrases keep
+// the default phrases. A nil map restores the default phrases for all
+// stabilities. Phrases are matched without regard to case.
+func SetStabilityPhrases(phrases map[string][]string) error {
+	m := make(map[string][]string)
+	for s, p := range defaultStabilityPhrases {
+		m[s] = p
+	}
+	for s, p := range phrases {
+		if _, ok := m[s]; !ok {
+			return fmt.Errorf("unknown stability %q", s)
+		}
+		lower := make([]string, len(p))
+		for i := range p {
+			lower[i] = strings.ToLower(p[i])
+		}
+		m[s] = lower
+	}
+	stabilityPhrases.Lock()
+	stabilityPhrases.m = m
+	stabilityPhrases.Unlock()
+	return nil
+}
+
+// commentStability returns the stability declared in a package comment and
+// the sentence that declares the stability.
+func commentStability(comment string) (string, string) {
+	stabilityPhrases.Lock()
+	phrases := stabilityPhrases.m
+	stabilityPhrases.Unlock()
+
+	sentences := splitSentences(comment)
+	for _, s := range stabilityOrder {
+		for _, sentence := range sentences {
+			lower := strings.ToLower(sentence)
+			for _, phrase := range phrases[s] {
+				if strings.Contains(lower, phrase) {
+					return s, sentence
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// splitSentences splits text into sentences. All runs of whitespace are
+// replaced by a single space.
+func splitSentences(text string) []string {
+	var sentences []string
+	for _, para := range strings.Split(text, "\n\n") {
+		s := strings.Join(strings.Fields(para), " ")
+		for s != "" {
+			i := len(s)
+			for _, end := range []string{". ", "! ", "? "} {
+				if j := strings.Index(s, end); j >= 0 && j+1 < i {
+					i = j + 1
+				}
+			}
+			sentences = append(sentences, s[:i])
+			s = strings.TrimLeft(s[i:], " ")
+		}
+	}
+	return sentences
+}
+
+var versionTagPat = regexp.MustCompile(`^v([0-9]+)\.([0-9]+)(?:\.([0-9]+))?$`)
+
+// tagStability returns the stability implied by the version tags of the
+// repository and a sentence describing the evidence. Projects with a v1 or
+// later release are stable. Projects with v0 releases only are
+// experimental. Prerelease tags are ignored.
+func tagStability(tags []string) (string, string) {
+	var newest string
+	var newestVersion [3]int
+	for _, tag := range tags {
+		m := versionTagPat.FindStringSubmatch(tag)
+		if m == nil {
+			continue
+		}
+		var v [3]int
+		for i := range v {
+			v[i], _ = strconv.Atoi(m[i+1])
+		}
+		if newest == "" || versionLess(newestVersion, v) {
+			newest, newestVersion = tag, v
+		}
+	}
+	switch {
+	case newest == "":
+		return "", ""
+	case newestVersion[0] == 0:
+		return StabilityExperimental, "The newest release of the project is " + newest + "."
+	}
+	return StabilityStable, "The project has release " + newest + "."
+}
+
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// classifyStability returns the stability of a package from the package
+// comment and the version tags of the repository and the evidence for the
+// stability. A stability declared in the comment is preferred over the
+// stability implied by the tags. If the signals conflict, classifyStability
+// returns a message describing the conflict.
+func classifyStability(comment string, tags []string) (stability, evidence, conflict string) {
+	stability, evidence = commentStability(comment)
+	tagged, tagEvidence := tagStability(tags)
+	switch {
+	case stability == "":
+		return tagged, tagEvidence, ""
+	case tagged == StabilityStable && (stability == StabilityExperimental || stability == StabilityDeprecated),
+		tagged == StabilityExperimental && (stability == StabilityStable || stability == StabilityFrozen):
+		conflict = fmt.Sprintf("The package comment declares the package %s, but the version tags indicate %s: %s", stability, tagged, tagEvidence)
+	}
+	return stability, evidence, conflict
+}
+
+// setStability sets the stability of the package from the package comment
+// and the version tags listed by the fetcher.
+func (b *builder) setStability() {
+	var conflict string
+	b.pdoc.Stability, b.pdoc.StabilityEvidence, conflict = classifyStability(b.pdoc.Doc, b.tags)
+	if conflict != "" {
+		b.addDiagnostic(DiagnosticStabilityConflict, SeverityWarning, token.Position{}, conflict)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import "testing"
+
+var stabilityTests = []struct {
+	comment   string
+	tags      []string
+	stability string
+	evidence  string
+	conflict  bool
+}{
+	{"Package foo does things.", nil, "", "", false},
+	{"Package foo does things.\n\nThis package is frozen. Bug fixes only.", nil,
+		StabilityFrozen, "This package is frozen.", false},
+	{"Package foo does things. The API is\nexperimental and may change.", nil,
+		StabilityExperimental, "The API is experimental and may change.", false},
+	{"Package foo does things. Note that the API may change\nwithout notice!", nil,
+		StabilityExperimental, "Note that the API may change without notice!", false},
+	{"Package foo does things.\n\nDeprecated: Use package bar instead.", nil,
+		StabilityDeprecated, "Deprecated: Use package bar instead.", false},
+	{"Package foo is stable. It is no longer maintained.", nil,
+		StabilityDeprecated, "It is no longer maintained.", false},
+	{"The API is stable.", []string{"v0.1.0", "v0.2.0"},
+		StabilityStable, "The API is stable.", true},
+	{"Package foo does things.", []string{"v0.1.0", "v0.10.2", "v0.9.0", "release"},
+		StabilityExperimental, "The newest release of the project is v0.10.2.", false},
+	{"Package foo does things.", []string{"v0.1.0", "v1.0.0-rc1"},
+		StabilityExperimental, "The newest release of the project is v0.1.0.", false},
+	{"Package foo does things.", []string{"v0.1.0", "v1.2", "v2.0.1", "go1"},
+		StabilityStable, "The project has release v2.0.1.", false},
+	{"Package foo does things.\n\nDeprecated: Use package bar instead.", []string{"v1.0.0", "v2.0.0"},
+		StabilityDeprecated, "Deprecated: Use package bar instead.", true},
+	{"This package is frozen.", []string{"v1.0.0"},
+		StabilityFrozen, "This package is frozen.", false},
+	{"This package is a work in progress.", []string{"v0.3.0"},
+		StabilityExperimental, "This package is a work in progress.", false},
+}
+
+func TestClassifyStability(t *testing.T) {
+	for _, tt := range stabilityTests {
+		stability, evidence, conflict := classifyStability(tt.comment, tt.tags)
+		if stability != tt.stability || evidence != tt.evidence || (conflict != "") != tt.conflict {
+			t.Errorf("classifyStability(%q, %q) = %q, %q, %q, want %q, %q, conflict %v",
+				tt.comment, tt.tags, stability, evidence, conflict, tt.stability, tt.evidence, tt.conflict)
+		}
+	}
+}
+
+func TestSetStabilityPhrases(t *testing.T) {
+	defer SetStabilityPhrases(nil)
+
+	const comment = "Package foo is Beta quality."
+	if err := SetStabilityPhrases(map[string][]string{StabilityExperimental: {"beta quality"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := commentStability(comment); s != StabilityExperimental {
+		t.Errorf("commentStability(%q) = %q, want %q", comment, s, StabilityExperimental)
+	}
+	if s, _ := commentStability("This package is frozen."); s != StabilityFrozen {
+		t.Errorf("default frozen phrases not kept")
+	}
+
+	if err := SetStabilityPhrases(map[string][]string{"beta": {"beta quality"}}); err == nil {
+		t.Errorf("SetStabilityPhrases with unknown stability returned nil error")
+	}
+
+	SetStabilityPhrases(nil)
+	if s, _ := commentStability(comment); s != "" {
+		t.Errorf("after reset commentStability(%q) = %q, want none", comment, s)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxNotable is the maximum number of identifiers named in a summary.
+const maxNotable = 3
+
+// Summary returns a one line description of the contents of a package for
+// use when the package does not have a synopsis, for example "5 types,
+// 12 funcs, 2 examples; notable: Client, Dial, ListenAndServe". The notable
+// identifiers are the types with the most methods followed by the functions
+// used most by examples. Summary returns "" for directories and packages
+// with no exported declarations or examples.
+func Summary(pdoc *Package) string {
+	if pdoc.Name == "" {
+		return ""
+	}
+
+	funcs := append([]*Func(nil), pdoc.Funcs...)
+	examples := len(pdoc.Examples)
+	for _, f := range pdoc.Funcs {
+		examples += len(f.Examples)
+	}
+	for _, t := range pdoc.Types {
+		funcs = append(funcs, t.Funcs...)
+		examples += len(t.Examples)
+		for _, f := range t.Funcs {
+			examples += len(f.Examples)
+		}
+		for _, m := range t.Methods {
+			examples += len(m.Examples)
+		}
+	}
+
+	var counts []string
+	for _, c := range []struct {
+		n    int
+		noun string
+	}{
+		{len(pdoc.Types), "type"},
+		{len(funcs), "func"},
+		{examples, "example"},
+	} {
+		switch {
+		case c.n == 1:
+			counts = append(counts, "1 "+c.noun)
+		case c.n > 1:
+			counts = append(counts, strconv.Itoa(c.n)+" "+c.noun+"s")
+		}
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+	s := strings.Join(counts, ", ")
+	if notable := notableNames(pdoc.Types, funcs); len(notable) > 0 {
+		var names []string
+		for _, n := range notable {
+			names = append(names, n.name)
+		}
+		s += "; notable: " + strings.Join(names, ", ")
+	}
+	return s
+}
+
+// Notable is a notable identifier of a package.
+type Notable struct {
+	Name string `json:"name"`
+
+	// Synopsis is the first sentence of the documentation of the
+	// identifier.
+	Synopsis string `json:"synopsis,omitempty"`
+}
+
+// NotableIdentifiers returns the identifiers named as notable in the
+// Summary of the package with the first sentence of their documentation.
+func NotableIdentifiers(pdoc *Package) []Notable {
+	if pdoc.Name == "" {
+		return nil
+	}
+	funcs := append([]*Func(nil), pdoc.Funcs...)
+	for _, t := range pdoc.Types {
+		funcs = append(funcs, t.Funcs...)
+	}
+	var result []Notable
+	for _, n := range notableNames(pdoc.Types, funcs) {
+		result = append(result, Notable{Name: n.name, Synopsis: synopsis(n.doc)})
+	}
+	return result
+}
+
+type notableName struct {
+	name  string
+	doc   string
+	score int
+}
+
+type byNotability []notableName
+
+func (p byNotability) Len() int      { return len(p) }
+func (p byNotability) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byNotability) Less(i, j int) bool {
+	if p[i].score != p[j].score {
+		return p[i].score > p[j].score
+	}
+	return p[i].name < p[j].name
+}
+
+// notableNames returns up to maxNotable names: the types with methods
+// ordered by the number of methods, then the functions used by examples
+// ordered by the number of uses.
+func notableNames(types []*Type, funcs []*Func) []notableName {
+	var typeNames, funcNames []notableName
+	for _, t := range types {
+		if len(t.Methods) > 0 {
+			typeNames = append(typeNames, notableName{t.Name, t.Doc, len(t.Methods)})
+		}
+	}
+	for _, f := range funcs {
+		if f.ExampleUses > 0 {
+			funcNames = append(funcNames, notableName{f.Name, f.Doc, f.ExampleUses})
+		}
+	}
+	sort.Sort(byNotability(typeNames))
+	sort.Sort(byNotability(funcNames))
+
+	var result []notableName
+	for _, n := range append(typeNames, funcNames...) {
+		if len(result) == maxNotable {
+			break
+		}
+		result = append(result, n)
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"testing"
+)
+
+var summaryTests = []struct {
+	pdoc    *Package
+	summary string
+}{
+	{&Package{}, ""},
+	{&Package{Name: "empty"}, ""},
+	{&Package{Name: "one", Funcs: []*Func{{Name: "F"}}}, "1 func"},
+	{&Package{
+		Name: "http",
+		Types: []*Type{
+			{Name: "Header", Methods: []*Func{{Name: "Get"}, {Name: "Set"}}},
+			{Name: "Client", Methods: []*Func{{Name: "Do"}, {Name: "Get"}, {Name: "Post"}}, Funcs: []*Func{{Name: "NewClient"}}},
+			{Name: "Status"},
+		},
+		Funcs: []*Func{
+			{Name: "Dial", ExampleUses: 4, Examples: []*Example{{}}},
+			{Name: "ListenAndServe", ExampleUses: 7},
+			{Name: "Error"},
+		},
+		Examples: []*Example{{}},
+	}, "3 types, 4 funcs, 2 examples; notable: Client, Header, ListenAndServe"},
+	{&Package{
+		Name:  "strutil",
+		Funcs: []*Func{{Name: "Reverse", ExampleUses: 1}, {Name: "Pad", ExampleUses: 1}, {Name: "Trim"}},
+	}, "3 funcs; notable: Pad, Reverse"},
+}
+
+func TestSummary(t *testing.T) {
+	for _, tt := range summaryTests {
+		if s := Summary(tt.pdoc); s != tt.summary {
+			t.Errorf("Summary(%s) = %q, want %q", tt.pdoc.Name, s, tt.summary)
+		}
+	}
+}
+
+func TestNotableIdentifiers(t *testing.T) {
+	pdoc := &Package{
+		Name: "http",
+		Types: []*Type{
+			{Name: "Client", Doc: "A Client is an HTTP client. Its zero value is usable.\n", Methods: []*Func{{Name: "Do"}, {Name: "Get"}}},
+			{Name: "Header", Doc: "A Header represents the key-value pairs\nin an HTTP header.\n", Methods: []*Func{{Name: "Get"}}},
+		},
+		Funcs: []*Func{
+			{Name: "ListenAndServe", Doc: "ListenAndServe listens on addr. It blocks.\n", ExampleUses: 2},
+			{Name: "Error", ExampleUses: 1},
+		},
+	}
+	want := []Notable{
+		{"Client", "A Client is an HTTP client."},
+		{"Header", "A Header represents the key-value pairs in an HTTP header."},
+		{"ListenAndServe", "ListenAndServe listens on addr."},
+	}
+	got := NotableIdentifiers(pdoc)
+	if len(got) != len(want) {
+		t.Fatalf("NotableIdentifiers() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("NotableIdentifiers()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := NotableIdentifiers(&Package{}); got != nil {
+		t.Errorf("NotableIdentifiers(directory) = %v, want nil", got)
+	}
+}
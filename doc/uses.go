@@ -0,0 +1,212 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// The uses of the package API in examples and tests are found with a token
+// scan of the example and test functions. The scan does not resolve
+// identifiers, so the counts are approximate. Methods are matched by name
+// in selector expressions on package values. A package value is the result
+// of a call to a package function, a variable assigned from an expression
+// that starts with the package or with another package value, or a variable
+// declared with a type from the package.
+
+// scanUses returns the exported identifiers referenced in src. Qualified
+// identifiers are included if the qualifier is the given package name.
+// Unqualified identifiers are included if the package name is "". Methods
+// selected on package values are included with a leading ".". String
+// literals and comments are skipped by the scanner.
+func scanUses(src []byte, qualifier string) map[string]bool {
+	uses := make(map[string]bool)
+
+	// values is the set of variables that hold package values.
+	values := make(map[string]bool)
+
+	// packageStart returns true if an expression that starts with the
+	// identifier is a package value.
+	packageStart := func(lit string) bool {
+		if qualifier != "" {
+			return lit == qualifier || values[lit]
+		}
+		return ast.IsExported(lit) || values[lit]
+	}
+
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, 0)
+	var (
+		prev, prev2       token.Token
+		prevLit, prev2Lit string
+
+		// pkgVal is true if the scanned tokens end with a package value.
+		pkgVal bool
+
+		// calls is the value of pkgVal at each open parenthesis.
+		calls []bool
+
+		// lhs is the identifier list at the start of the statement.
+		lhs []string
+
+		// inLHS is true while the statement is an identifier list, isVar
+		// is true in a var declaration and inRHS is true at the start of
+		// the expression assigned to lhs.
+		inLHS, isVar, inRHS = true, false, false
+	)
+	// setValues records the first variable in lhs as a package value if
+	// the assigned expression or the declared type starts with lit. The
+	// other variables in a list are usually errors or flags.
+	setValues := func(lit string) {
+		if packageStart(lit) && lhs[0] != "_" {
+			values[lhs[0]] = true
+		}
+	}
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+
+		switch {
+		case inRHS:
+			if tok == token.AND || tok == token.MUL {
+				break
+			}
+			if tok == token.IDENT {
+				setValues(lit)
+			}
+			inRHS = false
+		case tok == token.SEMICOLON || tok == token.LBRACE || tok == token.RBRACE || tok == token.VAR:
+			inLHS, isVar, lhs = true, tok == token.VAR, nil
+		case inLHS && tok == token.IDENT && (len(lhs) == 0 || prev == token.COMMA):
+			lhs = append(lhs, lit)
+		case inLHS && tok == token.COMMA && prev == token.IDENT:
+		case inLHS && len(lhs) > 0 && (tok == token.DEFINE || tok == token.ASSIGN):
+			inLHS, inRHS = false, true
+		case inLHS && isVar && len(lhs) > 0 && tok == token.MUL:
+			inLHS, inRHS = false, true
+		case inLHS && isVar && len(lhs) > 0 && tok == token.IDENT:
+			setValues(lit)
+			inLHS = false
+		default:
+			inLHS = false
+		}
+
+		switch tok {
+		case token.IDENT:
+			exported := ast.IsExported(lit)
+			switch {
+			case prev == token.PERIOD && prev2 == token.IDENT && qualifier != "" && prev2Lit == qualifier:
+				if exported {
+					uses[lit] = true
+				}
+				pkgVal = true
+			case prev == token.PERIOD:
+				if pkgVal && exported {
+					uses["."+lit] = true
+				}
+			case qualifier == "" && exported:
+				uses[lit] = true
+				pkgVal = true
+			default:
+				pkgVal = values[lit]
+			}
+		case token.PERIOD:
+			// The selected identifier is a method or field of the value
+			// before the period.
+		case token.LPAREN:
+			calls = append(calls, pkgVal)
+			pkgVal = false
+		case token.RPAREN:
+			pkgVal = false
+			if n := len(calls); n > 0 {
+				pkgVal = calls[n-1]
+				calls = calls[:n-1]
+			}
+		default:
+			pkgVal = false
+		}
+
+		prev2, prev2Lit = prev, prevLit
+		prev, prevLit = tok, lit
+	}
+	return uses
+}
+
+// testQualifier returns the name used for the package under test in an
+// external test file. The name is "" if the file refers to the package
+// without a qualifier and ok is false if the file does not import the
+// package.
+func testQualifier(file *ast.File, importPath, name string) (qualifier string, ok bool) {
+	for _, spec := range file.Imports {
+		if p, _ := strconv.Unquote(spec.Path.Value); p != importPath {
+			continue
+		}
+		switch {
+		case spec.Name == nil:
+			return name, true
+		case spec.Name.Name == ".":
+			return "", true
+		case spec.Name.Name == "_":
+			return "", false
+		default:
+			return spec.Name.Name, true
+		}
+	}
+	return "", false
+}
+
+// countUses counts the example and test functions in file that reference
+// each exported identifier of the package. The file is an external test
+// file if xtest is true.
+func (b *builder) countUses(file *ast.File, src []byte, xtest bool, name string) {
+	qualifier := ""
+	if xtest {
+		var ok bool
+		if qualifier, ok = testQualifier(file, b.pdoc.ImportPath, name); !ok {
+			return
+		}
+	}
+	for _, decl := range file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Recv != nil || fd.Body == nil {
+			continue
+		}
+		var counts map[string]int
+		switch {
+		case strings.HasPrefix(fd.Name.Name, "Example"):
+			counts = b.exampleUses
+		case strings.HasPrefix(fd.Name.Name, "Test"), strings.HasPrefix(fd.Name.Name, "Benchmark"):
+			counts = b.testUses
+		default:
+			continue
+		}
+		start := b.fset.Position(fd.Body.Pos()).Offset
+		end := b.fset.Position(fd.Body.End()).Offset
+		if start < 0 || end > len(src) || start > end {
+			continue
+		}
+		for id := range scanUses(src[start:end], qualifier) {
+			counts[id]++
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+)
+
+var scanUsesTests = []struct {
+	src       string
+	qualifier string
+	uses      []string
+}{
+	{`w.Alpha(); x := w.Beta; y.Run()`, "w", []string{"Alpha", "Beta"}},
+	{`Alpha(); s := "w.Beta"; c := 'B' // w.Gamma`, "w", nil},
+	{`Alpha(); /* Beta() */ t.Fatal()`, "", []string{"Alpha"}},
+	{"c, err := w.Dial()\nc.Do(x.Get())\nd := c\nd.Close()\nerr.Error()", "w", []string{"Dial", ".Do", ".Close"}},
+	{"var p *w.Pool\np.Get().Err()\nw.NewPool(x).Stats().Print()", "w", []string{"Pool", "NewPool", ".Get", ".Err", ".Stats", ".Print"}},
+	{"t := &Thing{}\nt.Run()\nNewThing().Stop()\nb.ResetTimer()", "", []string{"Thing", "NewThing", ".Run", ".Stop"}},
+}
+
+func TestScanUses(t *testing.T) {
+	for _, tt := range scanUsesTests {
+		want := make(map[string]bool)
+		for _, id := range tt.uses {
+			want[id] = true
+		}
+		if uses := scanUses([]byte(tt.src), tt.qualifier); !reflect.DeepEqual(uses, want) {
+			t.Errorf("scanUses(%q, %q) = %v, want %v", tt.src, tt.qualifier, uses, want)
+		}
+	}
+}
+
+var usesPackageSrc = `package widget
+
+func Alpha() {}
+func Beta() {}
+func Gamma() {}
+func Delta() {}
+
+type Thing struct{}
+
+func NewThing() *Thing { return nil }
+func (t *Thing) Run() {}
+`
+
+var usesTestSrcs = []struct {
+	name  string
+	src   string
+	xtest bool
+}{
+	{"example_test.go", `package widget_test
+
+import (
+	"fmt"
+
+	w "example.com/widget"
+)
+
+func ExampleAlpha() {
+	w.Alpha()
+	fmt.Println(w.Beta)
+	// Output:
+}
+
+func ExampleBeta() {
+	// Call w.Delta to ...
+	fmt.Println("w.Delta", w.Beta)
+}
+`, true},
+	{"widget_test.go", `package widget
+
+import "testing"
+
+func TestGamma(t *testing.T) {
+	Gamma()
+	NewThing().Run()
+}
+
+func helper() {
+	Delta()
+}
+`, false},
+}
+
+func TestCountUses(t *testing.T) {
+	b := &builder{
+		pdoc:        &Package{ImportPath: "example.com/widget"},
+		fset:        token.NewFileSet(),
+		exampleUses: make(map[string]int),
+		testUses:    make(map[string]int),
+	}
+	file, err := parser.ParseFile(b.fset, "widget.go", usesPackageSrc, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range usesTestSrcs {
+		file, err := parser.ParseFile(b.fset, tt.name, tt.src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.countUses(file, []byte(tt.src), tt.xtest, "widget")
+	}
+
+	apkg, _ := ast.NewPackage(b.fset, map[string]*ast.File{"widget.go": file}, simpleImporter, nil)
+	dpkg := doc.New(apkg, b.pdoc.ImportPath, 0)
+
+	uses := make(map[string][2]int)
+	for _, f := range b.funcs(dpkg.Funcs) {
+		uses[f.Name] = [2]int{f.ExampleUses, f.TestUses}
+	}
+	for _, typ := range b.types(dpkg.Types) {
+		uses[typ.Name] = [2]int{typ.ExampleUses, typ.TestUses}
+		for _, f := range typ.Funcs {
+			uses[f.Name] = [2]int{f.ExampleUses, f.TestUses}
+		}
+		for _, f := range typ.Methods {
+			uses[typ.Name+"."+f.Name] = [2]int{f.ExampleUses, f.TestUses}
+		}
+	}
+	want := map[string][2]int{
+		"Alpha":     {1, 0},
+		"Beta":      {2, 0},
+		"Gamma":     {0, 1},
+		"Delta":     {0, 0},
+		"Thing":     {0, 0},
+		"NewThing":  {0, 1},
+		"Thing.Run": {0, 1},
+	}
+	if !reflect.DeepEqual(uses, want) {
+		t.Errorf("uses = %v, want %v", uses, want)
+	}
+}
@@ -18,27 +18,59 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-var defaultTags = map[string]string{"git": "master", "hg": "default"}
+// newDefaultTags returns the branches documented for each VCS when the
+// repository host does not report a default branch. A new map is created for
+// each fetch.
+func newDefaultTags() map[string]string {
+	return map[string]string{"git": "master", "hg": "default"}
+}
 
-func bestTag(tags map[string]string, defaultTag string) (string, string, error) {
-	if commit, ok := tags["go1"]; ok {
-		return "go1", commit, nil
-	}
-	if commit, ok := tags[defaultTag]; ok {
-		return defaultTag, commit, nil
+// bestTag returns the tag or branch to document and its commit. The go1 tag
+// is preferred, then the default branch reported by the repository host and
+// then the static default branch for the VCS.
+func bestTag(tags map[string]string, defaultBranch, staticDefault string) (string, string, error) {
+	for _, tag := range []string{"go1", defaultBranch, staticDefault} {
+		if tag == "" {
+			continue
+		}
+		if commit, ok := tags[tag]; ok {
+			return tag, commit, nil
+		}
 	}
 	return "", "", NotFoundError{"Tag or branch not found."}
 }
 
+// refKey is the key of the tag or branch requested explicitly in the
+// defaultTags map passed to the fetchers.
+const refKey = "ref"
+
+// chooseTag returns the tag or branch to document and its commit. The tag
+// or branch requested explicitly in defaultTags is used if set. Otherwise,
+// the tag is chosen by bestTag with the static default branch for vcs.
+func chooseTag(tags map[string]string, defaultBranch string, defaultTags map[string]string, vcs string) (string, string, error) {
+	if ref := defaultTags[refKey]; ref != "" {
+		if commit, ok := tags[ref]; ok {
+			return ref, commit, nil
+		}
+		return "", "", NotFoundError{"Tag or branch " + ref + " not found."}
+	}
+	return bestTag(tags, defaultBranch, defaultTags[vcs])
+}
+
 // expand replaces {k} in template with match[k] or subs[atoi(k)] if k is not in match.
 func expand(template string, match map[string]string, subs ...string) string {
 	var p []byte
@@ -80,36 +112,161 @@ func SetUserAgent(ua string) {
 	userAgent = ua
 }
 
-// fetchFiles fetches the source files specified by the rawURL field in parallel.
+// defaultRateLimitWait is the time to wait after a rate limit response that
+// does not say when the limit is reset.
+const defaultRateLimitWait = time.Minute
+
+// rateLimitReset returns the time at which the rate limit reported by resp
+// is reset. The second result is false if resp does not report an exceeded
+// rate limit. GitHub responds with status 403 and X-RateLimit-Remaining: 0;
+// other hosts use status 429 with an optional Retry-After header.
+func rateLimitReset(resp *http.Response, now time.Time) (time.Time, bool) {
+	retryAfter := resp.Header.Get("Retry-After")
+	switch {
+	case resp.StatusCode == 429:
+	case resp.StatusCode == 403 && (resp.Header.Get("X-RateLimit-Remaining") == "0" || retryAfter != ""):
+	default:
+		return time.Time{}, false
+	}
+	if retryAfter != "" {
+		if n, err := strconv.Atoi(retryAfter); err == nil {
+			return now.Add(time.Duration(n) * time.Second), true
+		}
+		if t, err := http.ParseTime(retryAfter); err == nil {
+			return t, true
+		}
+	}
+	if n, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return time.Unix(n, 0), true
+	}
+	return now.Add(defaultRateLimitWait), true
+}
+
+// doRequest sends req with the credentials for the request's host. If the
+// host reports that the rate limit for a GitHub credential is exceeded, the
+// request is sent again with the next credential. A RateLimitError is
+// returned when no credential has quota remaining.
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	setCredentials(req)
+	for {
+		c := setGithubCredential(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, &RemoteError{req.URL.Host, err}
+		}
+		reset, limited := rateLimitReset(resp, time.Now())
+		if !limited {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if c == nil {
+			return nil, RateLimitError{req.URL.Host, reset}
+		}
+		c.exhaust(reset)
+		req.Header.Del("Authorization")
+		if nextGithubCredential() == nil {
+			return nil, RateLimitError{req.URL.Host, earliestGithubReset()}
+		}
+	}
+}
+
+// hostLimiter limits the number of concurrent requests to a host and
+// spaces the start of the requests by a minimum delay.
+type hostLimiter struct {
+	slots    chan struct{}
+	minDelay time.Duration
+
+	mu   sync.Mutex
+	next time.Time // earliest start of the next request
+}
+
+// hostLimiters holds the limiters for the file fetches. The limiters are
+// shared by the concurrent package builds in the process.
+var hostLimiters = struct {
+	sync.Mutex
+	m             map[string]*hostLimiter
+	maxConcurrent int
+	minDelay      time.Duration
+}{
+	m:             make(map[string]*hostLimiter),
+	maxConcurrent: 8,
+	minDelay:      10 * time.Millisecond,
+}
+
+// SetHostLimits sets the maximum number of concurrent file requests to a
+// host and the minimum delay between the starts of file requests to the
+// same host.
+func SetHostLimits(maxConcurrent int, minDelay time.Duration) {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	hostLimiters.Lock()
+	hostLimiters.m = make(map[string]*hostLimiter)
+	hostLimiters.maxConcurrent = maxConcurrent
+	hostLimiters.minDelay = minDelay
+	hostLimiters.Unlock()
+}
+
+func limiterForHost(host string) *hostLimiter {
+	hostLimiters.Lock()
+	defer hostLimiters.Unlock()
+	l := hostLimiters.m[host]
+	if l == nil {
+		l = &hostLimiter{
+			slots:    make(chan struct{}, hostLimiters.maxConcurrent),
+			minDelay: hostLimiters.minDelay,
+		}
+		hostLimiters.m[host] = l
+	}
+	return l
+}
+
+// acquire waits for a request slot and the minimum delay since the start of
+// the previous request. The function returns false without a slot if done
+// is closed first.
+func (l *hostLimiter) acquire(done <-chan struct{}) bool {
+	select {
+	case l.slots <- struct{}{}:
+	case <-done:
+		return false
+	}
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.minDelay)
+	l.mu.Unlock()
+	if wait := start.Sub(now); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-done:
+			l.release()
+			return false
+		}
+	}
+	return true
+}
+
+func (l *hostLimiter) release() {
+	<-l.slots
+}
+
+// errFetchCanceled is returned for the files not fetched after the fetch of
+// another file failed.
+var errFetchCanceled = errors.New("fetch canceled")
+
+// fetchFiles fetches the source files specified by the rawURL field in
+// parallel. The requests to each host are limited by the host limiter. The
+// waiting and in-flight requests are canceled when a request fails.
 func fetchFiles(client *http.Client, files []*source, header http.Header) error {
+	done := make(chan struct{})
+	defer close(done)
 	ch := make(chan error, len(files))
 	for i := range files {
 		go func(i int) {
-			req, err := http.NewRequest("GET", files[i].rawURL, nil)
-			if err != nil {
-				ch <- err
-				return
-			}
-			req.Header.Set("User-Agent", userAgent)
-			for k, vs := range header {
-				req.Header[k] = vs
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				ch <- &RemoteError{req.URL.Host, err}
-				return
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				ch <- &RemoteError{req.URL.Host, fmt.Errorf("get %s -> %d", req.URL, resp.StatusCode)}
-				return
-			}
-			files[i].data, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				ch <- &RemoteError{req.URL.Host, err}
-				return
-			}
-			ch <- nil
+			ch <- fetchFile(client, files[i], header, done)
 		}(i)
 	}
 	for _ = range files {
@@ -120,9 +277,57 @@ func fetchFiles(client *http.Client, files []*source, header http.Header) error
 	return nil
 }
 
+// fetchFile fetches one source file for fetchFiles. The request is canceled
+// and the data is not stored if done is closed before the fetch completes.
+func fetchFile(client *http.Client, file *source, header http.Header, done <-chan struct{}) error {
+	req, err := http.NewRequest("GET", file.rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = done
+	req.Header.Set("User-Agent", userAgent)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	l := limiterForHost(req.URL.Host)
+	if !l.acquire(done) {
+		return errFetchCanceled
+	}
+	defer l.release()
+	resp, err := doRequest(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return &RemoteError{req.URL.Host, fmt.Errorf("get %s -> %d", req.URL, resp.StatusCode)}
+	}
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &RemoteError{req.URL.Host, err}
+	}
+	select {
+	case <-done:
+		return errFetchCanceled
+	default:
+	}
+	file.data = p
+	return nil
+}
+
 // httpGet gets the specified resource. ErrNotFound is returned if the
 // server responds with status 404.
 func httpGet(client *http.Client, url string, header http.Header) (io.ReadCloser, error) {
+	resp, err := httpGetResponse(client, url, header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// httpGetResponse is like httpGet, but returns the response so that the
+// caller can read the response header.
+func httpGetResponse(client *http.Client, url string, header http.Header) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -131,16 +336,16 @@ func httpGet(client *http.Client, url string, header http.Header) (io.ReadCloser
 	for k, vs := range header {
 		req.Header[k] = vs
 	}
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
-		return nil, &RemoteError{req.URL.Host, err}
+		return nil, err
 	}
 	if resp.StatusCode == 200 {
-		return resp.Body, nil
+		return resp, nil
 	}
 	resp.Body.Close()
-	if resp.StatusCode == 404 { // 403 can be rate limit error.  || resp.StatusCode == 403 {
-		err = NotFoundError{"Resource not found: " + url}
+	if resp.StatusCode == 404 {
+		err = NotFoundError{"Resource not found: " + scrubCredentials(url)}
 	} else {
 		err = &RemoteError{req.URL.Host, fmt.Errorf("get %s -> %d", url, resp.StatusCode)}
 	}
@@ -160,6 +365,57 @@ func httpGetJSON(client *http.Client, url string, v interface{}) error {
 	return err
 }
 
+// maxJSONPages is the maximum number of pages read by httpGetJSONPages.
+const maxJSONPages = 50
+
+// httpGetJSONPages gets a JSON list that the server splits into pages and
+// appends the elements of the pages to the slice pointed to by v. The next
+// page is found from the Link header or from the X-Next-Page header used by
+// GitLab.
+func httpGetJSONPages(client *http.Client, rawurl string, v interface{}) error {
+	list := reflect.ValueOf(v).Elem()
+	for i := 0; rawurl != "" && i < maxJSONPages; i++ {
+		resp, err := httpGetResponse(client, rawurl, nil)
+		if err != nil {
+			return err
+		}
+		page := reflect.New(list.Type())
+		err = json.NewDecoder(resp.Body).Decode(page.Interface())
+		resp.Body.Close()
+		if _, ok := err.(*json.SyntaxError); ok {
+			err = NotFoundError{"JSON syntax error at " + rawurl}
+		}
+		if err != nil {
+			return err
+		}
+		list.Set(reflect.AppendSlice(list, page.Elem()))
+		rawurl = nextPageURL(rawurl, resp.Header)
+	}
+	return nil
+}
+
+var linkNextPat = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// nextPageURL returns the URL of the page after the page at rawurl or "" if
+// the page is the last page.
+func nextPageURL(rawurl string, header http.Header) string {
+	if m := linkNextPat.FindStringSubmatch(header.Get("Link")); m != nil {
+		return m[1]
+	}
+	page := header.Get("X-Next-Page")
+	if page == "" {
+		return ""
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("page", page)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
 // httpGet gets the specified resource. ErrNotFound is returned if the server
 // responds with status 404.
 func httpGetBytes(client *http.Client, url string, header http.Header) ([]byte, error) {
@@ -182,9 +438,9 @@ func httpGetBytesNoneMatch(client *http.Client, url string, etag string) ([]byte
 	}
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("If-None-Match", `"`+etag+`"`)
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
-		return nil, "", &RemoteError{req.URL.Host, err}
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
@@ -200,7 +456,7 @@ func httpGetBytesNoneMatch(client *http.Client, url string, etag string) ([]byte
 		p, err := ioutil.ReadAll(resp.Body)
 		return p, etag, err
 	case 404:
-		return nil, "", NotFoundError{"Resource not found: " + url}
+		return nil, "", NotFoundError{"Resource not found: " + scrubCredentials(url)}
 	case 304:
 		return nil, "", ErrNotModified
 	default:
@@ -0,0 +1,180 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileServer serves the path of each request as the file content and
+// records the number of requests and the maximum number of concurrent
+// requests.
+type fileServer struct {
+	mu       sync.Mutex
+	active   int
+	max      int
+	requests int
+	status   int
+	delay    time.Duration
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.active++
+	s.requests++
+	if s.active > s.max {
+		s.max = s.active
+	}
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	w.WriteHeader(s.status)
+	w.Write([]byte(r.URL.Path))
+}
+
+func testFiles(url string, n int) []*source {
+	var files []*source
+	for i := 0; i < n; i++ {
+		files = append(files, &source{name: strconv.Itoa(i) + ".go", rawURL: url + "/" + strconv.Itoa(i)})
+	}
+	return files
+}
+
+func TestFetchFilesHostLimit(t *testing.T) {
+	defer SetHostLimits(8, 10*time.Millisecond)
+	SetHostLimits(2, time.Millisecond)
+
+	fs := &fileServer{status: 200, delay: 5 * time.Millisecond}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	files := testFiles(server.URL, 20)
+	if err := fetchFiles(http.DefaultClient, files, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		if want := "/" + strconv.Itoa(i); string(f.data) != want {
+			t.Errorf("file %d = %q, want %q", i, f.data, want)
+		}
+	}
+	if fs.max > 2 {
+		t.Errorf("max concurrent requests = %d, want at most 2", fs.max)
+	}
+}
+
+func TestFetchFilesCancel(t *testing.T) {
+	defer SetHostLimits(8, 10*time.Millisecond)
+	SetHostLimits(1, 0)
+
+	fs := &fileServer{status: 500, delay: 20 * time.Millisecond}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	if err := fetchFiles(http.DefaultClient, testFiles(server.URL, 20), nil); err == nil || err == errFetchCanceled {
+		t.Fatalf("fetchFiles returned error %v, want server error", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.requests > 3 {
+		t.Errorf("%d requests after the first failure, want the remaining fetches canceled", fs.requests)
+	}
+}
+
+func TestFetchFilesCancelInFlight(t *testing.T) {
+	defer SetHostLimits(8, 10*time.Millisecond)
+	SetHostLimits(2, 0)
+
+	canceled := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(500)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	}))
+	defer server.Close()
+
+	files := []*source{
+		{name: "slow.go", rawURL: server.URL + "/slow"},
+		{name: "fail.go", rawURL: server.URL + "/fail"},
+	}
+	if err := fetchFiles(http.DefaultClient, files, nil); err == nil || err == errFetchCanceled {
+		t.Fatalf("fetchFiles returned error %v, want server error", err)
+	}
+	select {
+	case c := <-canceled:
+		if !c {
+			t.Error("slow request was not canceled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("slow request was not canceled")
+	}
+	if files[0].data != nil {
+		t.Errorf("slow file data = %q, want none", files[0].data)
+	}
+}
+
+func TestHTTPGetJSONPages(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/gitlab?per_page=2":
+			w.Header().Set("X-Next-Page", "2")
+			w.Write([]byte(`[1, 2]`))
+		case "/gitlab?page=2&per_page=2":
+			w.Write([]byte(`[3]`))
+		case "/github?per_page=2":
+			w.Header().Set("Link", `<`+server.URL+`/github?page=2>; rel="next", <`+server.URL+`/github?page=2>; rel="last"`)
+			w.Write([]byte(`[4, 5]`))
+		case "/github?page=2":
+			w.Write([]byte(`[6]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		path string
+		want []int
+	}{
+		{"/gitlab?per_page=2", []int{1, 2, 3}},
+		{"/github?per_page=2", []int{4, 5, 6}},
+	} {
+		var got []int
+		if err := httpGetJSONPages(http.DefaultClient, server.URL+tt.path, &got); err != nil {
+			t.Errorf("httpGetJSONPages(%s) returned error %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("httpGetJSONPages(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"fmt"
+	"sort"
+)
+
+type filesByName []*File
+
+func (p filesByName) Len() int           { return len(p) }
+func (p filesByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p filesByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// normalizeFiles returns the files sorted by name without nil entries and
+// later entries with the same name. The returned map maps the index of each
+// kept or duplicate entry in files to its index in the result.
+func normalizeFiles(files []*File) ([]*File, map[int]int) {
+	var result []*File
+	first := make(map[string]*File)
+	for _, f := range files {
+		if f != nil && first[f.Name] == nil {
+			first[f.Name] = f
+			result = append(result, f)
+		}
+	}
+	sort.Sort(filesByName(result))
+	index := make(map[*File]int)
+	for i, f := range result {
+		index[f] = i
+	}
+	remap := make(map[int]int)
+	for i, f := range files {
+		if f != nil {
+			remap[i] = index[first[f.Name]]
+		}
+	}
+	return result, remap
+}
+
+// ValidateFiles repairs the file list and the source positions of the
+// package. Files is sorted by name and nil entries and duplicate names are
+// removed. The positions of the declarations and notes are updated to match.
+// A position that does not refer to a file in the list is cleared so that
+// the declaration is shown without a source link, and a diagnostic is added
+// for the position. ValidateFiles returns the number of cleared positions
+// and true if the package was modified.
+//
+// The builder validates new packages. Packages stored by older versions of
+// the builder may violate these invariants.
+func ValidateFiles(pdoc *Package) (cleared int, modified bool) {
+	files, remap := normalizeFiles(pdoc.Files)
+	modified = len(files) != len(pdoc.Files)
+	for i, f := range files {
+		if pdoc.Files[i] != f {
+			modified = true
+		}
+	}
+	pdoc.Files = files
+	if testFiles, _ := normalizeFiles(pdoc.TestFiles); len(testFiles) != len(pdoc.TestFiles) {
+		pdoc.TestFiles = testFiles
+		modified = true
+	}
+
+	fix := func(pos *Pos, what string) {
+		if pos.Line == 0 {
+			return
+		}
+		i, ok := remap[int(pos.File)]
+		if ok {
+			if i != int(pos.File) {
+				pos.File = int16(i)
+				modified = true
+			}
+			return
+		}
+		pdoc.Diagnostics = append(pdoc.Diagnostics, &Diagnostic{
+			Code:     DiagnosticFilePosition,
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("The source position of %s refers to file %d, which is not in the package. The source link is not shown.", what, pos.File),
+		})
+		*pos = Pos{}
+		cleared++
+		modified = true
+	}
+	fixValues := func(values []*Value, what string) {
+		for _, v := range values {
+			fix(&v.Pos, what)
+		}
+	}
+	fixFuncs := func(funcs []*Func) {
+		for _, f := range funcs {
+			if f.Recv != "" {
+				fix(&f.Pos, "method "+f.Recv+"."+f.Name)
+			} else {
+				fix(&f.Pos, "function "+f.Name)
+			}
+		}
+	}
+	fixValues(pdoc.Consts, "a constant declaration")
+	fixValues(pdoc.Vars, "a variable declaration")
+	fixFuncs(pdoc.Funcs)
+	for _, t := range pdoc.Types {
+		fix(&t.Pos, "type "+t.Name)
+		fixValues(t.Consts, "a constant declaration of type "+t.Name)
+		fixValues(t.Vars, "a variable declaration of type "+t.Name)
+		fixFuncs(t.Funcs)
+		fixFuncs(t.Methods)
+	}
+	var tags []string
+	for tag := range pdoc.Notes {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		for _, n := range pdoc.Notes[tag] {
+			fix(&n.Pos, "a "+tag+" note")
+		}
+	}
+	if cleared > 0 {
+		sortDiagnostics(pdoc.Diagnostics)
+	}
+	return cleared, modified
+}
+
+// NormalizeVersion is the version of Normalize. Increment the version when
+// Normalize repairs more problems so that stored packages are normalized
+// again when loaded.
+const NormalizeVersion = 1
+
+// Normalize repairs the structure of the package so that the package can be
+// rendered. Nil entries are removed from the declaration and example lists
+// and nil lists are replaced with empty lists. Code annotations are clamped
+// to the code text and annotations that cannot be clamped or that refer to
+// a missing path are removed. Examples without code are removed with a
+// diagnostic. The files and positions are repaired with ValidateFiles.
+//
+// Normalize stamps the package with NormalizeVersion. Callers normalize a
+// loaded package when the stamp is older than NormalizeVersion. Normalize
+// returns the number of positions cleared by ValidateFiles and true if the
+// package was modified.
+func Normalize(pdoc *Package) (cleared int, modified bool) {
+	n := normalizer{pdoc: pdoc}
+	pdoc.Consts = n.values(pdoc.Consts)
+	pdoc.Vars = n.values(pdoc.Vars)
+	pdoc.Funcs = n.funcs(pdoc.Funcs)
+	types := make([]*Type, 0, len(pdoc.Types))
+	for _, t := range pdoc.Types {
+		if t == nil {
+			n.modified = true
+			continue
+		}
+		n.code(&t.Decl)
+		t.Consts = n.values(t.Consts)
+		t.Vars = n.values(t.Vars)
+		t.Funcs = n.funcs(t.Funcs)
+		t.Methods = n.funcs(t.Methods)
+		t.Examples = n.examples(t.Examples, "type "+t.Name)
+		types = append(types, t)
+	}
+	pdoc.Types = types
+	pdoc.Examples = n.examples(pdoc.Examples, "the package")
+	readmeExamples := make([]*ReadmeExample, 0, len(pdoc.ReadmeExamples))
+	for _, e := range pdoc.ReadmeExamples {
+		if e == nil {
+			n.modified = true
+			continue
+		}
+		n.code(&e.Code)
+		readmeExamples = append(readmeExamples, e)
+	}
+	pdoc.ReadmeExamples = readmeExamples
+	for tag, notes := range pdoc.Notes {
+		kept := make([]*Note, 0, len(notes))
+		for _, note := range notes {
+			if note == nil {
+				n.modified = true
+				continue
+			}
+			kept = append(kept, note)
+		}
+		pdoc.Notes[tag] = kept
+	}
+
+	cleared, modified = ValidateFiles(pdoc)
+	if n.dropped > 0 {
+		sortDiagnostics(pdoc.Diagnostics)
+	}
+	pdoc.NormalizeVersion = NormalizeVersion
+	return cleared, modified || n.modified
+}
+
+// normalizer holds the state of Normalize.
+type normalizer struct {
+	pdoc     *Package
+	modified bool
+	dropped  int
+}
+
+func (n *normalizer) values(values []*Value) []*Value {
+	result := make([]*Value, 0, len(values))
+	for _, v := range values {
+		if v == nil {
+			n.modified = true
+			continue
+		}
+		n.code(&v.Decl)
+		result = append(result, v)
+	}
+	return result
+}
+
+func (n *normalizer) funcs(funcs []*Func) []*Func {
+	result := make([]*Func, 0, len(funcs))
+	for _, f := range funcs {
+		if f == nil {
+			n.modified = true
+			continue
+		}
+		n.code(&f.Decl)
+		what := "function " + f.Name
+		if f.Recv != "" {
+			what = "method " + f.Recv + "." + f.Name
+		}
+		f.Examples = n.examples(f.Examples, what)
+		result = append(result, f)
+	}
+	return result
+}
+
+func (n *normalizer) examples(examples []*Example, what string) []*Example {
+	result := make([]*Example, 0, len(examples))
+	for _, e := range examples {
+		if e == nil {
+			n.modified = true
+			continue
+		}
+		if e.Code.Text == "" {
+			n.pdoc.Diagnostics = append(n.pdoc.Diagnostics, &Diagnostic{
+				Code:     DiagnosticExampleDropped,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("An example of %s has no code and is not shown.", what),
+			})
+			n.modified = true
+			n.dropped++
+			continue
+		}
+		n.code(&e.Code)
+		result = append(result, e)
+	}
+	return result
+}
+
+// code clamps the annotations of c to the text. Annotations must be in
+// order and must not overlap.
+func (n *normalizer) code(c *Code) {
+	end := int32(len(c.Text))
+	var result []Annotation
+	last := int32(0)
+	for _, a := range c.Annotations {
+		if a.End > end {
+			a.End = end
+			n.modified = true
+		}
+		isLink := a.Kind == PackageLinkAnnotation || a.Kind == ExportLinkAnnotation
+		if a.Pos < last || a.End <= a.Pos ||
+			isLink && int(a.PathIndex) >= len(c.Paths) ||
+			a.Kind == PackageLinkAnnotation && a.PathIndex < 0 {
+			n.modified = true
+			continue
+		}
+		result = append(result, a)
+		last = a.End
+	}
+	c.Annotations = result
+}
@@ -0,0 +1,125 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateFiles(t *testing.T) {
+	a, b, c := &File{Name: "a.go"}, &File{Name: "b.go"}, &File{Name: "c.go"}
+	pdoc := &Package{
+		// A refresh appended c.go and b.go again; d.go failed to parse.
+		Files:  []*File{b, nil, a, c, {Name: "b.go", URL: "stale"}},
+		Consts: []*Value{{Pos: Pos{Line: 1, File: 0}}},
+		Funcs:  []*Func{{Name: "F", Pos: Pos{Line: 2, File: 4}}},
+		Types: []*Type{{
+			Name:    "T",
+			Pos:     Pos{Line: 3, File: 3},
+			Methods: []*Func{{Name: "M", Recv: "*T", Pos: Pos{Line: 4, File: 7}}},
+			Vars:    []*Value{{Pos: Pos{Line: 0, File: 9}}},
+		}},
+		Notes: map[string][]*Note{"BUG": {{Pos: Pos{Line: 5, File: 1}}}},
+	}
+	cleared, modified := ValidateFiles(pdoc)
+	if cleared != 2 || !modified {
+		t.Errorf("ValidateFiles() = %d, %v, want 2, true", cleared, modified)
+	}
+	if want := []*File{a, b, c}; !reflect.DeepEqual(pdoc.Files, want) {
+		t.Errorf("Files = %v, want a.go, b.go, c.go", pdoc.Files)
+	}
+	for _, tt := range []struct {
+		name string
+		pos  Pos
+		want Pos
+	}{
+		{"const", pdoc.Consts[0].Pos, Pos{Line: 1, File: 1}},
+		{"duplicate file", pdoc.Funcs[0].Pos, Pos{Line: 2, File: 1}},
+		{"type", pdoc.Types[0].Pos, Pos{Line: 3, File: 2}},
+		{"out of range", pdoc.Types[0].Methods[0].Pos, Pos{}},
+		{"invalid position", pdoc.Types[0].Vars[0].Pos, Pos{Line: 0, File: 9}},
+		{"nil file", pdoc.Notes["BUG"][0].Pos, Pos{}},
+	} {
+		if tt.pos != tt.want {
+			t.Errorf("%s position = %+v, want %+v", tt.name, tt.pos, tt.want)
+		}
+	}
+	if len(pdoc.Diagnostics) != 2 {
+		t.Fatalf("Diagnostics = %v, want 2 diagnostics", pdoc.Diagnostics)
+	}
+	for _, d := range pdoc.Diagnostics {
+		if d.Code != DiagnosticFilePosition {
+			t.Errorf("diagnostic code = %q, want %q", d.Code, DiagnosticFilePosition)
+		}
+	}
+
+	// A valid package is not modified.
+	if cleared, modified := ValidateFiles(pdoc); cleared != 0 || modified {
+		t.Errorf("second ValidateFiles() = %d, %v, want 0, false", cleared, modified)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	f := &Func{
+		Name: "F",
+		Decl: Code{
+			Text:  "func F(w io.Writer)",
+			Paths: []string{"io"},
+			Annotations: []Annotation{
+				{Kind: ExportLinkAnnotation, PathIndex: 0, Pos: 9, End: 18},
+				{Kind: AnchorAnnotation, Pos: 5, End: 6},
+				{Kind: PackageLinkAnnotation, PathIndex: 3, Pos: 18, End: 19},
+				{Kind: CommentAnnotation, Pos: 18, End: 40},
+			},
+		},
+		Examples: []*Example{nil, {Name: "empty"}, {Code: Code{Text: "F(os.Stdout)"}}},
+	}
+	pdoc := &Package{
+		Funcs: []*Func{nil, f},
+		Types: []*Type{{Name: "T", Methods: []*Func{nil}}, nil},
+		Notes: map[string][]*Note{"BUG": {nil}},
+	}
+	if _, modified := Normalize(pdoc); !modified {
+		t.Errorf("Normalize() did not modify damaged package")
+	}
+	if pdoc.NormalizeVersion != NormalizeVersion {
+		t.Errorf("NormalizeVersion = %d, want %d", pdoc.NormalizeVersion, NormalizeVersion)
+	}
+	if len(pdoc.Funcs) != 1 || len(pdoc.Types) != 1 || len(pdoc.Types[0].Methods) != 0 || len(pdoc.Notes["BUG"]) != 0 {
+		t.Errorf("nil declarations not removed: funcs=%v types=%v", pdoc.Funcs, pdoc.Types)
+	}
+	if pdoc.Consts == nil || pdoc.Vars == nil || pdoc.Examples == nil || pdoc.Types[0].Funcs == nil {
+		t.Errorf("nil lists not replaced with empty lists")
+	}
+	want := []Annotation{
+		{Kind: ExportLinkAnnotation, PathIndex: 0, Pos: 9, End: 18},
+		{Kind: CommentAnnotation, Pos: 18, End: 19},
+	}
+	if !reflect.DeepEqual(f.Decl.Annotations, want) {
+		t.Errorf("Annotations = %+v, want %+v", f.Decl.Annotations, want)
+	}
+	if len(f.Examples) != 1 || f.Examples[0].Code.Text != "F(os.Stdout)" {
+		t.Errorf("Examples = %v, want the example with code", f.Examples)
+	}
+	if len(pdoc.Diagnostics) != 1 || pdoc.Diagnostics[0].Code != DiagnosticExampleDropped {
+		t.Errorf("Diagnostics = %v, want one %s diagnostic", pdoc.Diagnostics, DiagnosticExampleDropped)
+	}
+
+	// A normalized package is not modified.
+	if _, modified := Normalize(pdoc); modified {
+		t.Errorf("second Normalize() modified the package")
+	}
+}
@@ -71,7 +71,7 @@ func lookupURLTemplate(repo, dir, tag string) (string, map[string]string, string
 
 type vcsCmd struct {
 	schemes  []string
-	download func([]string, string, string) (string, string, error)
+	download func([]string, string, string, map[string]string) (string, string, error)
 }
 
 var vcsCmds = map[string]*vcsCmd{
@@ -83,7 +83,7 @@ var vcsCmds = map[string]*vcsCmd{
 
 var lsremoteRe = regexp.MustCompile(`(?m)^([0-9a-f]{40})\s+refs/(?:tags|heads)/(.+)$`)
 
-func downloadGit(schemes []string, repo, savedEtag string) (string, string, error) {
+func downloadGit(schemes []string, repo, savedEtag string, defaultTags map[string]string) (string, string, error) {
 	var p []byte
 	var scheme string
 	for i := range schemes {
@@ -106,7 +106,7 @@ func downloadGit(schemes []string, repo, savedEtag string) (string, string, erro
 		tags[string(m[2])] = string(m[1])
 	}
 
-	tag, commit, err := bestTag(tags, "master")
+	tag, commit, err := chooseTag(tags, "", defaultTags, "git")
 	if err != nil {
 		return "", "", err
 	}
@@ -151,7 +151,7 @@ func downloadGit(schemes []string, repo, savedEtag string) (string, string, erro
 
 var vcsPattern = regexp.MustCompile(`^(?P<repo>(?:[a-z0-9.\-]+\.)+[a-z0-9.\-]+(?::[0-9]+)?/[A-Za-z0-9_.\-/]*?)\.(?P<vcs>bzr|git|hg|svn)(?P<dir>/[A-Za-z0-9_.\-/]*)?$`)
 
-func getVCSDoc(client *http.Client, match map[string]string, etagSaved string) (*Package, error) {
+func getVCSDoc(client *http.Client, match map[string]string, etagSaved string, defaultTags map[string]string) (*Package, error) {
 	cmd := vcsCmds[match["vcs"]]
 	if cmd == nil {
 		return nil, NotFoundError{expand("VCS not supported: {vcs}", match)}
@@ -175,9 +175,19 @@ func getVCSDoc(client *http.Client, match map[string]string, etagSaved string) (
 		}
 	}
 
+	// Git repositories served with the smart HTTP protocol are read
+	// without a checkout.
+
+	if match["vcs"] == "git" {
+		pdoc, err := getGitHTTPDoc(client, match, schemes, etagSaved, defaultTags)
+		if err != errNoMatch {
+			return pdoc, err
+		}
+	}
+
 	// Download and checkout.
 
-	tag, etag, err := cmd.download(schemes, match["repo"], etagSaved)
+	tag, etag, err := cmd.download(schemes, match["repo"], etagSaved, defaultTags)
 	if err != nil {
 		return nil, err
 	}
@@ -221,14 +231,16 @@ func getVCSDoc(client *http.Client, match map[string]string, etagSaved string) (
 
 	b := &builder{
 		pdoc: &Package{
-			LineFmt:     lineFmt,
-			ImportPath:  match["importPath"],
-			ProjectRoot: expand("{repo}.{vcs}", match),
-			ProjectName: path.Base(match["repo"]),
-			ProjectURL:  "",
-			BrowseURL:   "",
-			Etag:        etag,
-			VCS:         match["vcs"],
+			LineFmt:       lineFmt,
+			ImportPath:    match["importPath"],
+			ProjectRoot:   expand("{repo}.{vcs}", match),
+			ProjectName:   path.Base(match["repo"]),
+			ProjectURL:    "",
+			BrowseURL:     "",
+			Etag:          etag,
+			VCS:           match["vcs"],
+			DefaultBranch: tag,
+			ResolvedFrom:  resolve(tag, ""),
 		},
 	}
 
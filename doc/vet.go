@@ -44,8 +44,14 @@ var deprecatedExports = map[string][]string{
 	`"unicode/utf8"`:  {"NewString"},
 }
 
+// vetError is a problem found by vetPackage.
+type vetError struct {
+	code    string
+	message string
+}
+
 type vetVisitor struct {
-	errors map[string]token.Pos
+	errors map[vetError]token.Pos
 }
 
 func (v *vetVisitor) Visit(n ast.Node) ast.Visitor {
@@ -55,7 +61,7 @@ func (v *vetVisitor) Visit(n ast.Node) ast.Visitor {
 				if spec, _ := obj.Decl.(*ast.ImportSpec); spec != nil {
 					for _, name := range deprecatedExports[spec.Path.Value] {
 						if name == sel.Sel.Name {
-							v.errors[fmt.Sprintf("%s.%s not found", spec.Path.Value, sel.Sel.Name)] = n.Pos()
+							v.errors[vetError{DiagnosticDeprecatedAPI, fmt.Sprintf("%s.%s not found", spec.Path.Value, sel.Sel.Name)}] = n.Pos()
 							return nil
 						}
 					}
@@ -67,21 +73,25 @@ func (v *vetVisitor) Visit(n ast.Node) ast.Visitor {
 }
 
 func (b *builder) vetPackage(pkg *ast.Package) {
-	errors := make(map[string]token.Pos)
+	errors := make(map[vetError]token.Pos)
 	for _, file := range pkg.Files {
 		for _, is := range file.Imports {
 			importPath, _ := strconv.Unquote(is.Path.Value)
-			if !IsValidPath(importPath) &&
+			if IsRelativeImport(importPath) {
+				errors[vetError{DiagnosticRelativeImport, fmt.Sprintf("Relative import path %q cannot be resolved by go get", importPath)}] = is.Pos()
+			} else if !IsValidPath(importPath) &&
 				!strings.HasPrefix(importPath, "exp/") &&
 				!strings.HasPrefix(importPath, "appengine") {
-				errors[fmt.Sprintf("Unrecognized import path %q", importPath)] = is.Pos()
+				errors[vetError{DiagnosticImportPath, fmt.Sprintf("Unrecognized import path %q", importPath)}] = is.Pos()
 			}
 		}
 		v := vetVisitor{errors: errors}
 		ast.Walk(&v, file)
 	}
-	for message, pos := range errors {
+	for e, pos := range errors {
+		position := b.fset.Position(pos)
 		b.pdoc.Errors = append(b.pdoc.Errors,
-			fmt.Sprintf("%s (%s)", message, b.fset.Position(pos)))
+			fmt.Sprintf("%s (%s)", e.message, position))
+		b.addDiagnostic(e.code, SeverityError, position, e.message)
 	}
 }
@@ -0,0 +1,55 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/garyburd/gddo/database"
+)
+
+var edgesCommand = &command{
+	name:  "edges",
+	run:   edges,
+	usage: "edges",
+}
+
+// edges prints the import edges that are stored only in the terms of the
+// importing package or only in the importers set of the imported package.
+func edges(c *command) {
+	if len(c.flag.Args()) != 0 {
+		c.printUsage()
+		os.Exit(1)
+	}
+	db, err := database.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	termsOnly, setsOnly, err := db.CheckImportEdges()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range termsOnly {
+		fmt.Printf("%s -> %s: missing from importers\n", e.From, e.To)
+	}
+	for _, e := range setsOnly {
+		fmt.Printf("%s -> %s: missing from imports\n", e.From, e.To)
+	}
+	if len(termsOnly)+len(setsOnly) > 0 {
+		os.Exit(1)
+	}
+}
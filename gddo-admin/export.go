@@ -0,0 +1,137 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	exportCommand = &command{
+		name:  "export",
+		usage: "export [-server url] [-key admin key] [-o file] path",
+	}
+	exportServer = exportCommand.flag.String("server", "http://localhost:8080", "Base URL of the documentation server.")
+	exportKey    = exportCommand.flag.String("key", os.Getenv("GDDO_ADMIN_KEY"), "Admin key of the server. Defaults to $GDDO_ADMIN_KEY.")
+	exportOutput = exportCommand.flag.String("o", "", "Output file. Defaults to <last path element>-doc.tar.gz.")
+)
+
+func init() {
+	exportCommand.run = export
+}
+
+// exportStatus is the status of an export returned by the server.
+type exportStatus struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+	Error  string `json:"error"`
+	Bundle string `json:"bundle"`
+}
+
+// export asks the server to export the documentation of a project, waits
+// for the export to finish and downloads the bundle. The pages are
+// rendered by the server because the templates are part of the server.
+func export(c *command) {
+	if len(c.flag.Args()) != 1 {
+		c.printUsage()
+		os.Exit(1)
+	}
+	root := c.flag.Args()[0]
+	output := *exportOutput
+	if output == "" {
+		output = path.Base(root) + "-doc.tar.gz"
+	}
+	server := strings.TrimRight(*exportServer, "/")
+
+	var s exportStatus
+	if err := exportRequest("POST", server+"/-/export", url.Values{"path": {root}}, &s); err != nil {
+		log.Fatal(err)
+	}
+	for s.State == "queued" || s.State == "running" {
+		fmt.Fprintf(os.Stderr, "%s: %s %d/%d\n", root, s.State, s.Done, s.Total)
+		time.Sleep(2 * time.Second)
+		if err := exportRequest("GET", server+"/-/export/"+s.ID, nil, &s); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if s.State != "done" {
+		log.Fatalf("export %s: %s", s.State, s.Error)
+	}
+
+	resp, err := exportDo("GET", server+"/-/export/"+s.ID+"/bundle", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s\n", output)
+}
+
+// exportDo sends a request with the admin cookie and returns the response
+// if the request succeeded.
+func exportDo(method, u string, form url.Values) (*http.Response, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.AddCookie(&http.Cookie{Name: "admin", Value: *exportKey})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, u, resp.Status, strings.TrimSpace(string(p)))
+	}
+	return resp, nil
+}
+
+func exportRequest(method, u string, form url.Values, s *exportStatus) error {
+	resp, err := exportDo(method, u, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(s)
+}
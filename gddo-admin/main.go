@@ -41,7 +41,9 @@ var commands = []*command{
 	deleteCommand,
 	popularCommand,
 	dangleCommand,
+	edgesCommand,
 	crawlCommand,
+	exportCommand,
 }
 
 func printUsage() {
@@ -0,0 +1,124 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Command gddo-cli prints package documentation from a GoDoc.org server in
+// the format of the go doc command.
+//
+// Usage:
+//
+//	gddo-cli [flags] importPath [identifier]
+//
+// With one argument, gddo-cli prints the package comment and a summary of the
+// exported declarations. With two arguments, gddo-cli prints the declaration
+// and comment for the identifier. Methods are specified as Type.Method.
+//
+// The exit status is 1 if the package or identifier is not found and 2 for
+// usage and server errors.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	exitNotFound = 1
+	exitError    = 2
+)
+
+func usage(fs *flag.FlagSet, stderr io.Writer) {
+	fmt.Fprintf(stderr, "usage: gddo-cli [flags] importPath [identifier]\n")
+	fs.PrintDefaults()
+}
+
+// docURL returns the URL of the text documentation for the package or
+// identifier.
+func docURL(server, importPath, ident string, src, all bool, width int) string {
+	u := strings.TrimRight(server, "/") + "/-/api/txt/" + (&url.URL{Path: importPath}).String()
+	q := url.Values{}
+	if ident != "" {
+		q.Set("anchor", ident)
+	}
+	if src {
+		q.Set("src", "1")
+	}
+	if all {
+		q.Set("all", "1")
+	}
+	if width > 0 {
+		q.Set("width", strconv.Itoa(width))
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("gddo-cli", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", "http://godoc.org", "Base URL of the documentation server.")
+	src := fs.Bool("src", false, "Include the source location of declarations.")
+	all := fs.Bool("all", false, "Print all documentation for the package or type.")
+	width := fs.Int("width", 0, "Line width for comments. The default is the terminal width.")
+	fs.Usage = func() { usage(fs, stderr) }
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		usage(fs, stderr)
+		return exitError
+	}
+
+	if *width <= 0 {
+		*width = terminalWidth()
+	}
+
+	importPath, ident := fs.Arg(0), fs.Arg(1)
+	resp, err := http.Get(docURL(*server, importPath, ident, *src, *all, *width))
+	if err != nil {
+		fmt.Fprintf(stderr, "gddo-cli: %v\n", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if _, err := io.Copy(stdout, resp.Body); err != nil {
+			fmt.Fprintf(stderr, "gddo-cli: %v\n", err)
+			return exitError
+		}
+		return 0
+	case http.StatusNotFound:
+		if ident != "" {
+			fmt.Fprintf(stderr, "gddo-cli: %s not found in %s\n", ident, importPath)
+		} else {
+			fmt.Fprintf(stderr, "gddo-cli: package %s not found\n", importPath)
+		}
+		return exitNotFound
+	default:
+		fmt.Fprintf(stderr, "gddo-cli: server returned %s\n", resp.Status)
+		return exitError
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,94 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// cliFixtures are server responses keyed by request URI.
+var cliFixtures = map[string]string{
+	"/-/api/txt/net/http?width=80":                         "package http // import \"net/http\"\n",
+	"/-/api/txt/net/http?anchor=Client.Do&width=80":        "func (c *Client) Do(req *Request) (*Response, error)\n",
+	"/-/api/txt/net/http?all=1&anchor=Client&width=80":     "type Client struct { ... }\n",
+	"/-/api/txt/net/http?anchor=Get&src=1&width=60":        "func Get(url string) (*Response, error)\n",
+	"/-/api/txt/example.com/broken?width=80":               "",
+	"/-/api/txt/example.com/p%20q?anchor=Missing&width=80": "",
+}
+
+func newCLIServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/-/api/txt/example.com/broken") {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		s, ok := cliFixtures[r.URL.RequestURI()]
+		if !ok || s == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(s))
+	}))
+}
+
+var runTests = []struct {
+	args   []string
+	status int
+	stdout string
+}{
+	{nil, exitError, ""},
+	{[]string{"a", "b", "c"}, exitError, ""},
+	{[]string{"-bogus"}, exitError, ""},
+	{[]string{"net/http"}, 0, cliFixtures["/-/api/txt/net/http?width=80"]},
+	{[]string{"net/http", "Client.Do"}, 0, cliFixtures["/-/api/txt/net/http?anchor=Client.Do&width=80"]},
+	{[]string{"-all", "net/http", "Client"}, 0, cliFixtures["/-/api/txt/net/http?all=1&anchor=Client&width=80"]},
+	{[]string{"-src", "-width=60", "net/http", "Get"}, 0, cliFixtures["/-/api/txt/net/http?anchor=Get&src=1&width=60"]},
+	{[]string{"net/http", "Missing"}, exitNotFound, ""},
+	{[]string{"example.com/p q", "Missing"}, exitNotFound, ""},
+	{[]string{"example.com/broken"}, exitError, ""},
+}
+
+func TestRun(t *testing.T) {
+	server := newCLIServer()
+	defer server.Close()
+
+	for _, tt := range runTests {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-server", server.URL + "/", "-width=80"}, tt.args...)
+		status := run(args, &stdout, &stderr)
+		if status != tt.status {
+			t.Errorf("run(%q) = %d, want %d; stderr %q", tt.args, status, tt.status, stderr.String())
+		}
+		if stdout.String() != tt.stdout {
+			t.Errorf("run(%q) printed %q, want %q", tt.args, stdout.String(), tt.stdout)
+		}
+		if tt.status != 0 && stderr.Len() == 0 {
+			t.Errorf("run(%q) did not print an error", tt.args)
+		}
+	}
+}
+
+func TestServerUnavailable(t *testing.T) {
+	server := newCLIServer()
+	server.Close()
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-server", server.URL, "net/http"}, &stdout, &stderr); status != exitError {
+		t.Errorf("run() with closed server = %d, want %d", status, exitError)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+// activityRetryInterval is the minimum time between attempts to fetch the
+// activity for a project.
+const activityRetryInterval = time.Hour
+
+// clockSkew is the clock skew in seconds observed in the last activity
+// fetched from each project host. A host with a clock ahead of the local
+// clock reports commits in the future.
+var clockSkew = expvar.NewMap("clockSkewSeconds")
+
+// observeClockSkew records the clock skew of the host of the project.
+func observeClockSkew(projectRoot string, a *doc.ProjectActivity) {
+	host := projectRoot
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	v := new(expvar.Int)
+	v.Set(int64(a.ClockSkew / time.Second))
+	clockSkew.Set(host, v)
+	if a.ClockSkew > doc.MaxClockSkew {
+		log.Printf("Clock skew of %v for %s from %s", a.ClockSkew, host, projectRoot)
+	}
+}
+
+var activityAttempts = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// startActivityRefresh returns true if the caller should fetch the activity
+// for the project. The function records the attempt so that failing
+// projects are not fetched on every request.
+func startActivityRefresh(projectRoot string, a *doc.ProjectActivity, now time.Time) bool {
+	if !doc.ActivityEnabled() || projectRoot == "" || !a.NeedsRefresh(now) {
+		return false
+	}
+	activityAttempts.Lock()
+	defer activityAttempts.Unlock()
+	if t, ok := activityAttempts.m[projectRoot]; ok && now.Sub(t) < activityRetryInterval {
+		return false
+	}
+	for root, t := range activityAttempts.m {
+		if now.Sub(t) >= activityRetryInterval {
+			delete(activityAttempts.m, root)
+		}
+	}
+	activityAttempts.m[projectRoot] = now
+	return true
+}
+
+// refreshActivity fetches and stores the project activity in the background
+// if the stored activity a is missing or old. Errors are logged and
+// otherwise ignored.
+func refreshActivity(projectRoot string, a *doc.ProjectActivity) {
+	if !startActivityRefresh(projectRoot, a, time.Now()) {
+		return
+	}
+	go func() {
+		a, err := doc.GetProjectActivity(httpClient, projectRoot)
+		if err != nil {
+			log.Printf("ERROR doc.GetProjectActivity(%q): %v", projectRoot, err)
+			return
+		}
+		if a == nil {
+			return
+		}
+		observeClockSkew(projectRoot, a)
+		if err := db.PutActivity(projectRoot, a); err != nil {
+			log.Printf("ERROR db.PutActivity(%q): %v", projectRoot, err)
+		}
+	}()
+}
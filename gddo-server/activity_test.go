@@ -0,0 +1,80 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestStartActivityRefresh(t *testing.T) {
+	const root = "github.com/user/repo"
+	now := time.Now()
+
+	if startActivityRefresh(root, nil, now) {
+		t.Errorf("refresh started with activity disabled")
+	}
+
+	doc.SetActivityToken("token")
+	defer doc.SetActivityToken("")
+
+	fresh := &doc.ProjectActivity{Fetched: now.Add(-time.Hour)}
+	if startActivityRefresh(root, fresh, now) {
+		t.Errorf("refresh started for fresh activity")
+	}
+
+	// Activity is refreshed daily, independent of the package crawl.
+	old := &doc.ProjectActivity{Fetched: now.Add(-doc.ActivityMaxAge - time.Minute)}
+	if !startActivityRefresh(root, old, now) {
+		t.Errorf("refresh not started for old activity")
+	}
+	if startActivityRefresh(root, old, now.Add(time.Minute)) {
+		t.Errorf("refresh started again before retry interval")
+	}
+	if !startActivityRefresh(root, old, now.Add(activityRetryInterval)) {
+		t.Errorf("refresh not started after retry interval")
+	}
+}
+
+var activitySummaryTests = []struct {
+	activity doc.ProjectActivity
+	summary  string
+}{
+	{doc.ProjectActivity{Contributors: 0, OpenIssues: -1}, ""},
+	{doc.ProjectActivity{Contributors: 1, OpenIssues: 1}, "1 contributor, 1 open issue"},
+	{doc.ProjectActivity{Contributors: 3, OpenIssues: 0}, "3 contributors, 0 open issues"},
+	{doc.ProjectActivity{Contributors: doc.MaxContributors, OpenIssues: -1}, "50+ contributors"},
+}
+
+func TestActivitySummary(t *testing.T) {
+	for _, tt := range activitySummaryTests {
+		if s := activitySummaryFn(&tt.activity); s != tt.summary {
+			t.Errorf("activitySummary(%+v) = %q, want %q", tt.activity, s, tt.summary)
+		}
+	}
+}
+
+func TestObserveClockSkew(t *testing.T) {
+	observeClockSkew("example.com/user/repo", &doc.ProjectActivity{ClockSkew: 10 * time.Minute})
+	if v := clockSkew.Get("example.com"); v == nil || v.String() != "600" {
+		t.Errorf("clock skew for example.com = %v, want 600", v)
+	}
+	observeClockSkew("example.com/user/other", &doc.ProjectActivity{})
+	if v := clockSkew.Get("example.com"); v == nil || v.String() != "0" {
+		t.Errorf("clock skew for example.com = %v, want 0", v)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements security advisories. Advisories are loaded from a
+// JSON feed and stored in the database. Package pages show a banner for the
+// advisories that match the package and search results flag the packages
+// with an advisory.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var (
+	advisoriesPath     = flag.String("advisories", "", "Path to JSON feed of security advisories. The file is loaded at startup and reloaded on SIGHUP.")
+	advisoriesURL      = flag.String("advisories-url", "", "URL of JSON feed of security advisories. The feed is fetched at startup and every advisories-interval.")
+	advisoriesInterval = flag.Duration("advisories-interval", time.Hour, "Time between fetches of the advisories URL.")
+)
+
+const (
+	// maxAdvisoryFeedSize is the maximum size of an advisory feed.
+	maxAdvisoryFeedSize = 4 << 20
+
+	// advisoryReloadInterval is the time between loads of the stored
+	// advisories. Servers that do not load the feed pick up changes from
+	// the database.
+	advisoryReloadInterval = time.Minute
+)
+
+// advisoryStore is the subset of the database used for advisories.
+type advisoryStore interface {
+	Advisories() ([]database.Advisory, error)
+	PutAdvisories(advisories []database.Advisory) (int, error)
+}
+
+var advisories = struct {
+	sync.Mutex
+	store  advisoryStore
+	list   []database.Advisory
+	loaded time.Time
+}{}
+
+// advisoryFeedError is a validation error for an advisory in a feed.
+type advisoryFeedError struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// advisoryFeedErrors is returned by parseAdvisoryFeed for a feed with
+// invalid advisories.
+type advisoryFeedErrors []advisoryFeedError
+
+func (errs advisoryFeedErrors) Error() string {
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, fmt.Sprintf("advisory %d (%s): %s", e.Index, e.ID, e.Error))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// parseAdvisoryFeed reads and validates an advisory feed. The feed is a
+// JSON object with an advisories field holding a list of advisories. No
+// advisories are returned if any advisory is invalid.
+func parseAdvisoryFeed(r io.Reader) ([]database.Advisory, error) {
+	var feed struct {
+		Advisories []database.Advisory `json:"advisories"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r, maxAdvisoryFeedSize)).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("feed is not a JSON advisory list: %v", err)
+	}
+	var errs advisoryFeedErrors
+	ids := make(map[string]bool)
+	for i := range feed.Advisories {
+		a := &feed.Advisories[i]
+		err := database.ValidateAdvisory(a)
+		if err == nil && ids[a.ID] {
+			err = errors.New("duplicate id")
+		}
+		if err != nil {
+			errs = append(errs, advisoryFeedError{Index: i, ID: a.ID, Error: err.Error()})
+		}
+		ids[a.ID] = true
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return feed.Advisories, nil
+}
+
+// putAdvisories stores the advisories and replaces the loaded advisories.
+func putAdvisories(list []database.Advisory) error {
+	n, err := advisories.store.PutAdvisories(list)
+	if err != nil {
+		return err
+	}
+	log.Printf("Stored %d advisories, %d indexed packages affected", len(list), n)
+	advisories.Lock()
+	advisories.list = list
+	advisories.loaded = time.Now()
+	advisories.Unlock()
+	return nil
+}
+
+// loadAdvisories loads the advisory feed from the file at path.
+func loadAdvisories(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	list, err := parseAdvisoryFeed(f)
+	if err != nil {
+		return err
+	}
+	return putAdvisories(list)
+}
+
+// fetchAdvisories fetches the advisory feed from url. The stored advisories
+// are kept if the feed cannot be fetched or is invalid.
+func fetchAdvisories(url string) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", url, resp.StatusCode)
+	}
+	list, err := parseAdvisoryFeed(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	return putAdvisories(list)
+}
+
+// pollAdvisories fetches the advisory feed from the advisories URL for the
+// life of the process.
+func pollAdvisories() {
+	for {
+		if err := fetchAdvisories(*advisoriesURL); err != nil {
+			log.Printf("ERROR fetching advisories: %v", err)
+		}
+		time.Sleep(*advisoriesInterval)
+	}
+}
+
+// currentAdvisories returns the stored advisories. The advisories are
+// reloaded from the database periodically.
+func currentAdvisories() []database.Advisory {
+	advisories.Lock()
+	defer advisories.Unlock()
+	if advisories.store != nil && time.Since(advisories.loaded) > advisoryReloadInterval {
+		list, err := advisories.store.Advisories()
+		if err != nil {
+			log.Printf("Error loading advisories: %v", err)
+		} else {
+			advisories.list = list
+		}
+		advisories.loaded = time.Now()
+	}
+	return advisories.list
+}
+
+type advisoriesBySeverity []database.Advisory
+
+func (p advisoriesBySeverity) Len() int      { return len(p) }
+func (p advisoriesBySeverity) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p advisoriesBySeverity) Less(i, j int) bool {
+	ri, rj := database.SeverityRank(p[i].Severity), database.SeverityRank(p[j].Severity)
+	if ri != rj {
+		return ri > rj
+	}
+	return p[i].ID < p[j].ID
+}
+
+// advisoriesFor returns the advisories for the given version of the package
+// with the given import path, most severe first. The empty version selects
+// the current documentation.
+func advisoriesFor(path, version string) []database.Advisory {
+	var result []database.Advisory
+	for _, a := range currentAdvisories() {
+		if a.MatchesPath(path) && a.AffectsVersion(version) {
+			result = append(result, a)
+		}
+	}
+	sort.Sort(advisoriesBySeverity(result))
+	return result
+}
+
+// markAdvisories sets the advisory severity of the packages in search
+// results.
+func markAdvisories(pkgs []database.Package) {
+	list := currentAdvisories()
+	if len(list) == 0 {
+		return
+	}
+	for i := range pkgs {
+		for _, a := range list {
+			if a.MatchesPath(pkgs[i].Path) && database.SeverityRank(a.Severity) > database.SeverityRank(pkgs[i].Advisory) {
+				pkgs[i].Advisory = a.Severity
+			}
+		}
+	}
+}
+
+func advisoriesFn(pdoc *doc.Package) []database.Advisory {
+	return advisoriesFor(pdoc.ImportPath, "")
+}
+
+// advisoryClassFn returns the class of an alert or label for an advisory
+// severity.
+func advisoryClassFn(kind, severity string) string {
+	switch severity {
+	case database.SeverityCritical, database.SeverityHigh:
+		if kind == "label" {
+			return "label-important"
+		}
+		return "alert-error"
+	case database.SeverityModerate:
+		if kind == "label" {
+			return "label-warning"
+		}
+		return ""
+	}
+	return kind + "-info"
+}
+
+// serveAdvisories serves the stored advisories to administrators.
+func serveAdvisories(resp web.Response, req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	list, err := advisories.store.Advisories()
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list = []database.Advisory{}
+	}
+	return writeJSON(resp, web.StatusOK, map[string]interface{}{"advisories": list})
+}
+
+// serveAdvisoriesImport replaces the stored advisories with the feed in the
+// request body. Nothing is stored if an advisory is invalid.
+func serveAdvisoriesImport(resp web.Response, req *web.Request) error {
+	if err := checkAdminPost(req); err != nil {
+		return err
+	}
+	list, err := parseAdvisoryFeed(req.Body)
+	if errs, ok := err.(advisoryFeedErrors); ok {
+		return writeJSON(resp, web.StatusBadRequest, map[string]interface{}{"errors": errs})
+	} else if err != nil {
+		writeAPIError(resp, web.StatusBadRequest, "The request body "+strings.TrimPrefix(err.Error(), "feed "))
+		return nil
+	}
+	if err := putAdvisories(list); err != nil {
+		return err
+	}
+	return writeJSON(resp, web.StatusOK, map[string]interface{}{"imported": len(list)})
+}
@@ -0,0 +1,210 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeAdvisoryStore struct {
+	advisories []database.Advisory
+	puts       int
+}
+
+func (s *fakeAdvisoryStore) Advisories() ([]database.Advisory, error) {
+	return s.advisories, nil
+}
+
+func (s *fakeAdvisoryStore) PutAdvisories(advisories []database.Advisory) (int, error) {
+	s.advisories = advisories
+	s.puts++
+	return len(advisories), nil
+}
+
+// setTestAdvisories replaces the advisory store. The returned function
+// restores the previous store.
+func setTestAdvisories(store advisoryStore) func() {
+	advisories.Lock()
+	saved := advisories.store
+	advisories.store = store
+	advisories.loaded = time.Time{}
+	advisories.Unlock()
+	return func() {
+		advisories.Lock()
+		advisories.store = saved
+		advisories.list = nil
+		advisories.loaded = time.Time{}
+		advisories.Unlock()
+	}
+}
+
+const testAdvisoryFeed = `{"advisories":[
+	{"id":"A-1","path":"github.com/user/repo","prefix":true,"severity":"moderate","summary":"Decoder loops forever.","url":"https://example.com/a1"},
+	{"id":"A-2","path":"github.com/user/repo/pkg","versions":[{"introduced":"v1.0.0","fixed":"v1.2.0"}],"severity":"critical","summary":"Parser overflows a buffer.","url":"https://example.com/a2"},
+	{"id":"A-3","path":"github.com/user/repo/pkg/internal","severity":"low","summary":"Timing leak.","url":"https://example.com/a3"}
+]}`
+
+func TestParseAdvisoryFeed(t *testing.T) {
+	list, err := parseAdvisoryFeed(strings.NewReader(testAdvisoryFeed))
+	if err != nil || len(list) != 3 {
+		t.Fatalf("parseAdvisoryFeed() = %v, %v, want 3 advisories", list, err)
+	}
+
+	_, err = parseAdvisoryFeed(strings.NewReader(`{"advisories":[
+		{"id":"B-1","path":"github.com/user/repo","severity":"high","summary":"s","url":"https://example.com/b1"},
+		{"id":"B-2","path":"github.com/user/repo/","severity":"high","summary":"s","url":"https://example.com/b2"},
+		{"id":"B-3","path":"github.com/user/repo","severity":"urgent","summary":"s","url":"https://example.com/b3"},
+		{"id":"B-1","path":"github.com/user/other","severity":"high","summary":"s","url":"https://example.com/b1"},
+		{"id":"B-5","path":"github.com/user/repo","severity":"high","summary":"s","url":"ftp://example.com/b5"}
+	]}`))
+	errs, ok := err.(advisoryFeedErrors)
+	if !ok {
+		t.Fatalf("parseAdvisoryFeed(invalid) returned %v, want feed errors", err)
+	}
+	var indexes []int
+	for _, e := range errs {
+		indexes = append(indexes, e.Index)
+	}
+	if want := []int{1, 2, 3, 4}; len(indexes) != len(want) || indexes[0] != 1 || indexes[3] != 4 {
+		t.Errorf("invalid advisories = %v, want %v", indexes, want)
+	}
+	if !strings.Contains(err.Error(), "advisory 3 (B-1): duplicate id") {
+		t.Errorf("error %q does not report the duplicate id", err)
+	}
+
+	if _, err := parseAdvisoryFeed(strings.NewReader(`[{"id":"C-1"}]`)); err == nil {
+		t.Errorf("parseAdvisoryFeed(list) returned nil error")
+	}
+}
+
+func TestAdvisoriesFor(t *testing.T) {
+	list, err := parseAdvisoryFeed(strings.NewReader(testAdvisoryFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setTestAdvisories(&fakeAdvisoryStore{advisories: list})()
+
+	ids := func(path, version string) string {
+		var result []string
+		for _, a := range advisoriesFor(path, version) {
+			result = append(result, a.ID)
+		}
+		return strings.Join(result, ",")
+	}
+	for _, tt := range []struct {
+		path, version, want string
+	}{
+		{"github.com/user/repo", "", "A-1"},
+		{"github.com/user/repo/pkg", "", "A-2,A-1"},
+		{"github.com/user/repo/pkg", "v1.1.5", "A-2,A-1"},
+		{"github.com/user/repo/pkg", "v1.2.0", "A-1"},
+		{"github.com/user/repo/pkg", "v0.9.0", "A-1"},
+		{"github.com/user/repo/pkg/internal", "", "A-1,A-3"},
+		{"github.com/user/repo/pkgutil", "", "A-1"},
+		{"github.com/user/repository", "", ""},
+		{"github.com/user/repo-tools/pkg", "", ""},
+	} {
+		if got := ids(tt.path, tt.version); got != tt.want {
+			t.Errorf("advisoriesFor(%q, %q) = %s, want %s", tt.path, tt.version, got, tt.want)
+		}
+	}
+
+	pkgs := []database.Package{{Path: "github.com/user/repo/pkg"}, {Path: "github.com/user/repository"}, {Path: "github.com/user/repo/pkg/internal"}}
+	markAdvisories(pkgs)
+	if pkgs[0].Advisory != "critical" || pkgs[1].Advisory != "" || pkgs[2].Advisory != "moderate" {
+		t.Errorf("marked severities = %q, %q, %q, want critical, none, moderate", pkgs[0].Advisory, pkgs[1].Advisory, pkgs[2].Advisory)
+	}
+}
+
+func TestAdvisoryBanner(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"pkg.html", "common.html", "layout.html"},
+		{"results.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := parseAdvisoryFeed(strings.NewReader(testAdvisoryFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setTestAdvisories(&fakeAdvisoryStore{advisories: list})()
+
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "pkg.html", web.StatusOK, nil, map[string]interface{}{"pdoc": fragmentTestPackage()}); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	critical := strings.Index(body, `<div class="alert alert-error"><strong>Security advisory (critical):</strong> Parser overflows a buffer. <a href="https://example.com/a2">A-2</a>`)
+	moderate := strings.Index(body, `<div class="alert "><strong>Security advisory (moderate):</strong>`)
+	if critical < 0 || moderate < critical {
+		t.Errorf("page does not show the critical advisory before the moderate advisory")
+	}
+
+	resp = testResponse{}
+	pkgs := []database.Package{{Path: "github.com/user/repo/pkg"}, {Path: "github.com/user/repository"}}
+	markAdvisories(pkgs)
+	if err := executeTemplate(&resp, nil, "results.html", web.StatusOK, nil, map[string]interface{}{"q": "has:advisory", "pkgs": pkgs, "results": searchResults(nil, pkgs)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(resp.buf.String(), `<span class="label label-important"`); n != 1 {
+		t.Errorf("results show %d advisory labels, want 1", n)
+	}
+}
+
+func TestAdvisoriesImport(t *testing.T) {
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+	store := &fakeAdvisoryStore{}
+	defer setTestAdvisories(store)()
+	admin := url.Values{"admin": {"key"}}
+
+	importFeed := func(body string, cookie url.Values) (*testResponse, error) {
+		var resp testResponse
+		req := &web.Request{Body: strings.NewReader(body), Cookie: cookie, Header: web.Header{"X-Csrf-Token": {adminToken(&web.Request{Cookie: admin})}}}
+		err := serveAdvisoriesImport(&resp, req)
+		return &resp, err
+	}
+
+	if _, err := importFeed(testAdvisoryFeed, nil); err == nil || err.(*web.Error).Status != web.StatusNotFound {
+		t.Errorf("import without admin cookie returned %v, want not found", err)
+	}
+
+	resp, err := importFeed(`{"advisories":[{"id":"X","path":"github.com/x","severity":"high","summary":"","url":"https://example.com"}]}`, admin)
+	if err != nil || resp.status != web.StatusBadRequest || store.puts != 0 {
+		t.Fatalf("import of invalid feed returned %d, %v with %d puts, want bad request and no puts", resp.status, err, store.puts)
+	}
+	var data struct {
+		Errors []advisoryFeedError `json:"errors"`
+	}
+	if err := json.Unmarshal(resp.buf.Bytes(), &data); err != nil || len(data.Errors) != 1 || data.Errors[0].Error != "missing summary" {
+		t.Errorf("errors = %s, want missing summary", resp.buf.Bytes())
+	}
+
+	resp, err = importFeed(testAdvisoryFeed, admin)
+	if err != nil || resp.status != web.StatusOK || store.puts != 1 || len(store.advisories) != 3 {
+		t.Fatalf("import returned %d, %v with %d advisories stored, want 3", resp.status, err, len(store.advisories))
+	}
+	if got := advisoriesFor("github.com/user/repo/pkg", ""); len(got) != 2 {
+		t.Errorf("imported advisories are not in use: %v", got)
+	}
+}
@@ -0,0 +1,576 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var corsOriginsPath = flag.String("cors-origins", "", "Path to file listing the origins allowed to read API responses, one per line. All origins are allowed if not set. The file is reloaded on SIGHUP.")
+
+// Hosts of API routes. The catalog reports the host as a subdomain of the
+// documentation site.
+const (
+	siteHost = ""
+	apiHost  = "api"
+)
+
+type apiParam struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description"`
+}
+
+// apiRoute describes an API endpoint. The router dispatches requests to
+// the API endpoints from the apiRoutes registry and the /-/api endpoint
+// serves the registry as a catalog.
+type apiRoute struct {
+	host        string
+	pattern     string
+	methods     []string
+	params      []apiParam
+	contentType string
+	quota       quotaClass
+	handler     web.HandlerFunc
+
+	// localSafe is set on endpoints that only read stored data. These
+	// endpoints are also served on the local socket. Endpoints that can
+	// fetch a package from the VCS must not set localSafe.
+	localSafe bool
+}
+
+var pathParam = apiParam{Name: "path", In: "path", Required: true, Description: "Import path of the package."}
+
+// The package endpoints are below /-/api/<view>/ so that the view is not
+// confused with the last element of an import path such as encoding/json.
+var apiRoutes = []*apiRoute{
+	{
+		host: apiHost, pattern: "/search", methods: []string{"GET", "POST"},
+		params: []apiParam{
+			{Name: "q", In: "query", Required: true, Description: "Search query."},
+			{Name: "scope", In: "query", Description: "Project root to search in."},
+			{Name: "session", In: "query", Description: "Session token from a previous response for incremental queries."},
+		},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPISearch,
+		localSafe: true,
+	},
+	{
+		host: apiHost, pattern: "/packages", methods: []string{"GET"},
+		contentType: "application/json", quota: expensiveQuota, handler: serveAPIPackages,
+		localSafe: true,
+	},
+	{
+		host: siteHost, pattern: "/-/api/html/<path:.+>", methods: []string{"GET"},
+		params: []apiParam{
+			pathParam,
+			{Name: "anchor", In: "query", Required: true, Description: "Anchor of the declaration."},
+		},
+		contentType: "text/html", quota: cheapQuota, handler: serveAPIDeclHTML,
+	},
+	{
+		host: siteHost, pattern: "/-/api/txt/<path:.+>", methods: []string{"GET"},
+		params: []apiParam{
+			pathParam,
+			{Name: "anchor", In: "query", Description: "Anchor of a declaration. The package is served if not set."},
+			{Name: "all", In: "query", Description: "Include the documentation of all declarations or the methods of a type."},
+			{Name: "src", In: "query", Description: "Include the source of declarations."},
+			{Name: "width", In: "query", Description: "Line width."},
+		},
+		contentType: "text/plain", quota: cheapQuota, handler: serveAPIText,
+	},
+	{
+		host: siteHost, pattern: "/-/api/md/<path:.+>", methods: []string{"GET"},
+		params: []apiParam{
+			pathParam,
+			{Name: "ids", In: "query", Description: "Write the anchors of the package page as explicit heading ids."},
+		},
+		contentType: "text/markdown", quota: cheapQuota, handler: serveAPIMarkdown,
+	},
+	{
+		host: siteHost, pattern: "/-/api/diagnostics/<path:.+>", methods: []string{"GET"},
+		params: []apiParam{
+			pathParam,
+			{Name: "fail_on", In: "query", Description: "Severity at which the response status is 412."},
+		},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIDiagnostics,
+	},
+	{
+		host: siteHost, pattern: "/-/api/uses/<path:.+>", methods: []string{"GET"},
+		params:      []apiParam{pathParam},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIUses,
+	},
+	{
+		host: siteHost, pattern: "/-/api/graph/<path:.+>", methods: []string{"GET"},
+		params: []apiParam{
+			pathParam,
+			{Name: "hide", In: "query", Description: "1 hides standard packages, 2 hides standard packages and their dependencies."},
+		},
+		contentType: "application/json", quota: expensiveQuota, handler: serveAPIGraph,
+	},
+	{
+		host: siteHost, pattern: "/-/api/gates/<path:.+>", methods: []string{"GET"},
+		params:      []apiParam{pathParam},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIFetchGates,
+	},
+	{
+		host: siteHost, pattern: "/-/api/json/<path:.+>", methods: []string{"GET"},
+		params:      []apiParam{pathParam},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIStoredDoc,
+		localSafe: true,
+	},
+	{
+		host: siteHost, pattern: "/-/api/exists/<path:.+>", methods: []string{"GET"},
+		params:      []apiParam{pathParam},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIExists,
+		localSafe: true,
+	},
+	{
+		host: siteHost, pattern: "/-/api/identifiers/<path:.+>", methods: []string{"GET"},
+		params:      []apiParam{pathParam},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIIdentifiers,
+		localSafe: true,
+	},
+	{
+		host: siteHost, pattern: "/-/api/pkg/<path:.+>", methods: []string{"GET"},
+		params: []apiParam{
+			pathParam,
+			{Name: "fields", In: "query", Description: "Comma separated list of the top-level fields in the response. All fields are returned if not set."},
+		},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIPackageDoc,
+	},
+	{
+		host: siteHost, pattern: "/-/api/cardhtml/<path:.+>", methods: []string{"GET"},
+		params:      []apiParam{pathParam},
+		contentType: "text/html", quota: cheapQuota, handler: serveAPICardHTML,
+		localSafe: true,
+	},
+	{
+		host: siteHost, pattern: "/-/api/card/<path:.+>", methods: []string{"GET"},
+		params:      []apiParam{pathParam},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPICard,
+		localSafe: true,
+	},
+	{
+		host: siteHost, pattern: "/-/api/status", methods: []string{"GET", "POST"},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPIStatus,
+		localSafe: true,
+	},
+}
+
+func init() {
+	// The catalog handler refers to apiRoutes, so the catalog route is
+	// added here to avoid an initialization cycle.
+	apiRoutes = append(apiRoutes, &apiRoute{
+		host: siteHost, pattern: "/-/api", methods: []string{"GET"},
+		contentType: "application/json", quota: cheapQuota, handler: serveAPICatalog,
+		localSafe: true,
+	})
+}
+
+// addAPIRoutes adds the routes for host to the router.
+func addAPIRoutes(r *web.Router, routes []*apiRoute, host string) {
+	for _, route := range routes {
+		if route.host != host {
+			continue
+		}
+		var h web.Handler = quotaHandler{route.quota, route.handler}
+		if route.hasParam(pathParam) {
+			h = redirectHandler{route.pattern, h}
+		}
+		if host == siteHost {
+			// The site error handler writes HTML pages.
+			h = web.ErrorHandler(handleAPIError, h)
+		}
+		rr := r.Add(route.pattern)
+		for _, m := range route.methods {
+			rr.Method(m, corsHandler{h})
+		}
+		rr.MethodFunc("OPTIONS", route.servePreflight)
+	}
+}
+
+// hasParam returns true if the route has the parameter p.
+func (route *apiRoute) hasParam(p apiParam) bool {
+	for _, rp := range route.params {
+		if rp.Name == p.Name && rp.In == p.In {
+			return true
+		}
+	}
+	return false
+}
+
+var routeVarPat = regexp.MustCompile(`<([a-z]+):[^>]*>`)
+
+// path returns the path of the route with the variables in braces.
+func (route *apiRoute) path() string {
+	return routeVarPat.ReplaceAllString(route.pattern, "{$1}")
+}
+
+var corsOrigins = struct {
+	sync.Mutex
+	m map[string]bool // nil allows all origins
+}{}
+
+// loadCORSOrigins sets the origins allowed to read API responses from the
+// file at path. Blank lines and lines starting with # are ignored. A line
+// with * allows all origins.
+func loadCORSOrigins(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "*":
+			m = nil
+		case m != nil:
+			m[line] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	setCORSOrigins(m)
+	return nil
+}
+
+func setCORSOrigins(m map[string]bool) {
+	corsOrigins.Lock()
+	corsOrigins.m = m
+	corsOrigins.Unlock()
+}
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header
+// for a request from origin or "" if the origin is not allowed.
+func allowedOrigin(origin string) string {
+	corsOrigins.Lock()
+	defer corsOrigins.Unlock()
+	switch {
+	case corsOrigins.m == nil:
+		return "*"
+	case origin != "" && corsOrigins.m[origin]:
+		return origin
+	}
+	return ""
+}
+
+// corsHeader adds the CORS headers for the request to header.
+func corsHeader(header web.Header, req *web.Request) web.Header {
+	header.Add("Vary", "Origin")
+	if origin := allowedOrigin(req.Header.Get("Origin")); origin != "" {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Expose-Headers", "X-Ratelimit-Limit, X-Ratelimit-Remaining, X-Ratelimit-Reset, Retry-After")
+	}
+	return header
+}
+
+// corsHandler adds the CORS headers to the responses of an API route.
+type corsHandler struct {
+	h web.Handler
+}
+
+func (h corsHandler) ServeWeb(resp web.Response, req *web.Request) error {
+	return h.h.ServeWeb(corsResponse{resp, req}, req)
+}
+
+type corsResponse struct {
+	web.Response
+	req *web.Request
+}
+
+func (r corsResponse) Start(status int, header web.Header) io.Writer {
+	h := web.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	return r.Response.Start(status, corsHeader(h, r.req))
+}
+
+// servePreflight responds to a CORS preflight request for the route.
+func (route *apiRoute) servePreflight(resp web.Response, req *web.Request) error {
+	header := web.Header{}
+	header.Set("Allow", strings.Join(append(route.methods, "OPTIONS"), ", "))
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	method := req.Header.Get("Access-Control-Request-Method")
+	origin := allowedOrigin(req.Header.Get("Origin"))
+	if origin != "" && method != "" && route.allowsMethod(method) {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Methods", strings.Join(route.methods, ", "))
+		header.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		header.Set("Access-Control-Max-Age", "86400")
+	}
+	resp.Start(web.StatusOK, header)
+	return nil
+}
+
+func (route *apiRoute) allowsMethod(method string) bool {
+	for _, m := range route.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// serveAPICatalog serves the description of the API routes.
+func serveAPICatalog(resp web.Response, req *web.Request) error {
+	type endpoint struct {
+		Host        string     `json:"host,omitempty"`
+		Path        string     `json:"path"`
+		Methods     []string   `json:"methods"`
+		Parameters  []apiParam `json:"parameters"`
+		ContentType string     `json:"contentType"`
+	}
+	var data struct {
+		Endpoints []endpoint `json:"endpoints"`
+	}
+	for _, route := range apiRoutes {
+		path := route.path()
+		if route.host == siteHost {
+			path = sitePath(path)
+		}
+		params := route.params
+		if params == nil {
+			params = []apiParam{}
+		}
+		data.Endpoints = append(data.Endpoints, endpoint{
+			Host:        route.host,
+			Path:        path,
+			Methods:     route.methods,
+			Parameters:  params,
+			ContentType: route.contentType,
+		})
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(&data)
+}
+
+// serveAPIStoredDoc serves the stored documentation of a package as JSON.
+// Unlike the other package endpoints, the package is not fetched if it is
+// missing or stale. The contents of the README files are omitted.
+func serveAPIStoredDoc(resp web.Response, req *web.Request) error {
+	pdoc, _, err := packagePages.store.GetDoc(req.RouteVars["path"])
+	if err != nil {
+		return err
+	}
+	if pdoc == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	repairStoredDoc(pdoc)
+	p := *pdoc
+	p.ReadmeFiles = nil
+	advisories := advisoriesFor(pdoc.ImportPath, "")
+	data := api.Package{Package: &p, Advisories: apiAdvisories(advisories)}
+	header := web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}}
+	if pdoc.Etag != "" {
+		etag := storedDocETag(pdoc.Etag, advisories)
+		if etagMatches(req.Header.Get(web.HeaderIfNoneMatch), etag) {
+			resp.Start(web.StatusNotModified, web.Header{web.HeaderETag: {etag}})
+			return nil
+		}
+		header.Set(web.HeaderETag, etag)
+	}
+	w := resp.Start(web.StatusOK, header)
+	return json.NewEncoder(w).Encode(&data)
+}
+
+// serveAPIPackageDoc serves the documentation of a package as JSON. The
+// package is fetched like the package page. The contents of the README
+// files are omitted. The fields parameter selects top-level fields of the
+// response.
+func serveAPIPackageDoc(resp web.Response, req *web.Request) error {
+	path := req.RouteVars["path"]
+	if !doc.IsValidPath(path) && !doc.IsGoRepoPath(path) {
+		writeAPIError(resp, web.StatusBadRequest, "Invalid import path.")
+		return nil
+	}
+	pdoc, _, err := getDoc(path, queryRequest)
+	if e, ok := err.(doc.CanonicalPathError); ok {
+		u := sitePath("/-/api/pkg/" + e.ImportPath)
+		if req.URL.RawQuery != "" {
+			u += "?" + req.URL.RawQuery
+		}
+		return web.Redirect(resp, req, u, 301, nil)
+	} else if err != nil {
+		return err
+	}
+	if pdoc == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+
+	p := *pdoc
+	p.ReadmeFiles = nil
+	advisories := advisoriesFor(pdoc.ImportPath, "")
+	data := api.Package{Package: &p, Advisories: apiAdvisories(advisories)}
+
+	header := web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}}
+	if !pdoc.Updated.IsZero() {
+		header.Set(web.HeaderLastModified, pdoc.Updated.UTC().Format(http.TimeFormat))
+	}
+	if pdoc.Etag != "" {
+		h := fnv.New64a()
+		io.WriteString(h, req.Form.Get("fields"))
+		etag := storedDocETag(pdoc.Etag+"-"+strconv.FormatInt(pdoc.Updated.Unix(), 36)+"-"+strconv.FormatUint(h.Sum64(), 36), advisories)
+		header.Set(web.HeaderETag, etag)
+		if etagMatches(req.Header.Get(web.HeaderIfNoneMatch), etag) {
+			resp.Start(web.StatusNotModified, header)
+			return nil
+		}
+	}
+
+	var v interface{} = &data
+	if fields := req.Form.Get("fields"); fields != "" {
+		var msg string
+		v, msg, err = selectFields(&data, fields)
+		if err != nil {
+			return err
+		}
+		if msg != "" {
+			writeAPIError(resp, web.StatusBadRequest, msg)
+			return nil
+		}
+	}
+	w := resp.Start(web.StatusOK, header)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// selectFields returns the top-level fields of the JSON encoding of v named
+// in the comma separated list. Names are matched without regard to case. A
+// message for the client is returned if a field does not exist.
+func selectFields(v interface{}, list string) (map[string]json.RawMessage, string, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(p, &all); err != nil {
+		return nil, "", err
+	}
+	selected := make(map[string]json.RawMessage)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for k, raw := range all {
+			if strings.EqualFold(k, name) {
+				selected[k] = raw
+				found = true
+			}
+		}
+		if !found {
+			return nil, "Unknown field " + strconv.Quote(name) + ".", nil
+		}
+	}
+	return selected, "", nil
+}
+
+// storedDocETag returns the ETag of the stored documentation response. The
+// advisories are in the response, so the ETag changes when the advisories
+// change.
+func storedDocETag(etag string, advisories []database.Advisory) string {
+	if len(advisories) == 0 {
+		return quoteETag(etag)
+	}
+	h := fnv.New32a()
+	for _, a := range advisories {
+		io.WriteString(h, a.ID+"\x00"+a.Severity+"\x00")
+	}
+	return quoteETag(etag + "-" + strconv.FormatUint(uint64(h.Sum32()), 36))
+}
+
+// apiAdvisories converts advisories to the API type. The result is not nil
+// so that the advisories are encoded as an empty list.
+func apiAdvisories(list []database.Advisory) []api.Advisory {
+	result := make([]api.Advisory, len(list))
+	for i, a := range list {
+		result[i] = api.Advisory{
+			ID:       a.ID,
+			Path:     a.Path,
+			Prefix:   a.Prefix,
+			Commits:  a.Commits,
+			Severity: a.Severity,
+			Summary:  a.Summary,
+			URL:      a.URL,
+		}
+		for _, r := range a.Versions {
+			result[i].Versions = append(result[i].Versions, api.VersionRange{Introduced: r.Introduced, Fixed: r.Fixed})
+		}
+	}
+	return result
+}
+
+// apiSearchResults converts search results to the API type.
+func apiSearchResults(pkgs []database.Package) []api.SearchResult {
+	var result []api.SearchResult
+	for _, pkg := range pkgs {
+		result = append(result, api.SearchResult{
+			Path:            pkg.Path,
+			Synopsis:        pkg.Synopsis,
+			SynopsisDerived: pkg.SynopsisDerived,
+			Summary:         pkg.Summary,
+			NewestMajor:     pkg.NewestMajor,
+			Advisory:        pkg.Advisory,
+			Language:        pkg.Language,
+			Implementations: pkg.Implementations,
+			SynopsisMatches: apiMatches(pkg.SynopsisMatches),
+			Excerpt:         pkg.Excerpt,
+			ExcerptMatches:  apiMatches(pkg.ExcerptMatches),
+		})
+	}
+	return result
+}
+
+func apiMatches(matches []database.Match) []api.Match {
+	var result []api.Match
+	for _, m := range matches {
+		result = append(result, api.Match{Start: m.Start, End: m.End})
+	}
+	return result
+}
+
+// serveAPIExists reports whether a package is in the database.
+func serveAPIExists(resp web.Response, req *web.Request) error {
+	exists, err := db.Exists(req.RouteVars["path"])
+	if err != nil {
+		return err
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(&api.ExistsResponse{Exists: exists})
+}
@@ -0,0 +1,386 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func findAPIRoute(t *testing.T, pattern string) *apiRoute {
+	for _, route := range apiRoutes {
+		if route.pattern == pattern {
+			return route
+		}
+	}
+	t.Fatalf("route %s not found", pattern)
+	return nil
+}
+
+func TestCORSPreflight(t *testing.T) {
+	defer setCORSOrigins(nil)
+	route := findAPIRoute(t, "/search")
+
+	for _, tt := range []struct {
+		origins map[string]bool
+		origin  string
+		method  string
+		allow   string
+	}{
+		{nil, "https://a.example", "GET", "*"},
+		{nil, "https://a.example", "DELETE", ""},
+		{nil, "https://a.example", "", ""},
+		{map[string]bool{"https://a.example": true}, "https://a.example", "GET", "https://a.example"},
+		{map[string]bool{"https://a.example": true}, "https://b.example", "GET", ""},
+	} {
+		setCORSOrigins(tt.origins)
+		req := &web.Request{Method: "OPTIONS", Header: web.Header{
+			"Origin":                        {tt.origin},
+			"Access-Control-Request-Method": {tt.method},
+		}}
+		var resp testResponse
+		if err := route.servePreflight(&resp, req); err != nil {
+			t.Fatal(err)
+		}
+		if resp.status != web.StatusOK {
+			t.Errorf("%s %s: status = %d, want %d", tt.origin, tt.method, resp.status, web.StatusOK)
+		}
+		if got := resp.header.Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("%s %s: Access-Control-Allow-Origin = %q, want %q", tt.origin, tt.method, got, tt.allow)
+		}
+		if tt.allow != "" {
+			if got := resp.header.Get("Access-Control-Allow-Headers"); got != "Authorization, Content-Type" {
+				t.Errorf("%s %s: Access-Control-Allow-Headers = %q, want Authorization, Content-Type", tt.origin, tt.method, got)
+			}
+		}
+		if got := resp.header["Vary"]; len(got) == 0 || got[0] != "Origin" {
+			t.Errorf("%s %s: Vary = %q, want Origin first", tt.origin, tt.method, got)
+		}
+	}
+}
+
+func TestCORSPreflightPost(t *testing.T) {
+	route := findAPIRoute(t, "/-/api/status")
+	header := web.Header{
+		"Origin":                         {"https://a.example"},
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"Content-Type"},
+	}
+
+	var preflight testResponse
+	if err := route.servePreflight(&preflight, &web.Request{Method: "OPTIONS", Header: header}); err != nil {
+		t.Fatal(err)
+	}
+	if got := preflight.header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("preflight Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := preflight.header.Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("preflight Access-Control-Allow-Methods = %q, want GET, POST", got)
+	}
+	if got := preflight.header.Get("Access-Control-Allow-Headers"); got != "Authorization, Content-Type" {
+		t.Errorf("preflight Access-Control-Allow-Headers = %q, want Authorization, Content-Type", got)
+	}
+
+	var resp testResponse
+	req := &web.Request{Method: "POST", Header: web.Header{"Origin": {"https://a.example"}, web.HeaderContentType: {"application/x-www-form-urlencoded"}}}
+	if err := (corsHandler{route.handler}).ServeWeb(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != web.StatusOK {
+		t.Errorf("POST status = %d, want %d", resp.status, web.StatusOK)
+	}
+	if got := resp.header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("POST Access-Control-Allow-Origin = %q, want *", got)
+	}
+	var status struct{ Services interface{} }
+	if err := json.Unmarshal(resp.buf.Bytes(), &status); err != nil {
+		t.Errorf("POST returned %q, want JSON status: %v", resp.buf.Bytes(), err)
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	defer setCORSOrigins(nil)
+	dir, err := ioutil.TempDir("", "cors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "origins")
+
+	h := corsHandler{web.HandlerFunc(func(resp web.Response, req *web.Request) error {
+		resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json"}})
+		return nil
+	})}
+	allowOrigin := func(origin string) string {
+		var resp testResponse
+		if err := h.ServeWeb(&resp, &web.Request{Header: web.Header{"Origin": {origin}}}); err != nil {
+			t.Fatal(err)
+		}
+		if resp.header.Get("Vary") != "Origin" {
+			t.Errorf("Vary = %q, want Origin", resp.header.Get("Vary"))
+		}
+		if resp.header.Get(web.HeaderContentType) != "application/json" {
+			t.Errorf("handler header not kept")
+		}
+		return resp.header.Get("Access-Control-Allow-Origin")
+	}
+
+	if got := allowOrigin("https://a.example"); got != "*" {
+		t.Errorf("default Access-Control-Allow-Origin = %q, want *", got)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("# origins\nhttps://a.example\n\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCORSOrigins(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := allowOrigin("https://a.example"); got != "https://a.example" {
+		t.Errorf("listed origin Access-Control-Allow-Origin = %q, want https://a.example", got)
+	}
+	if got := allowOrigin("https://b.example"); got != "" {
+		t.Errorf("unlisted origin Access-Control-Allow-Origin = %q, want none", got)
+	}
+
+	// Reloading the file changes the allowed origins.
+	if err := ioutil.WriteFile(path, []byte("https://b.example\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCORSOrigins(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := allowOrigin("https://a.example"); got != "" {
+		t.Errorf("removed origin Access-Control-Allow-Origin = %q, want none", got)
+	}
+	if got := allowOrigin("https://b.example"); got != "https://b.example" {
+		t.Errorf("added origin Access-Control-Allow-Origin = %q, want https://b.example", got)
+	}
+}
+
+func TestAPICatalog(t *testing.T) {
+	var resp testResponse
+	if err := serveAPICatalog(&resp, &web.Request{}); err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Endpoints []struct {
+			Host       string
+			Path       string
+			Methods    []string
+			Parameters []apiParam
+		}
+	}
+	if err := json.Unmarshal(resp.buf.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+	catalog := make(map[string]bool)
+	for _, e := range data.Endpoints {
+		catalog[e.Host+" "+e.Path] = true
+		if len(e.Methods) == 0 {
+			t.Errorf("%s %s has no methods", e.Host, e.Path)
+		}
+	}
+	for _, route := range apiRoutes {
+		if !catalog[route.host+" "+route.path()] {
+			t.Errorf("route %s %s not in catalog", route.host, route.pattern)
+		}
+	}
+	for _, path := range []string{" /-/api", " /-/api/txt/{path}", "api /search"} {
+		if !catalog[path] {
+			t.Errorf("catalog does not have %q", path)
+		}
+	}
+}
+
+func TestAPIRouteDispatch(t *testing.T) {
+	// Replace the handlers with handlers that report the matched route.
+	var routes []*apiRoute
+	for _, route := range apiRoutes {
+		r := *route
+		pattern := r.pattern
+		r.handler = func(resp web.Response, req *web.Request) error {
+			io.WriteString(resp.Start(web.StatusOK, web.Header{}), pattern+" "+req.RouteVars["path"])
+			return nil
+		}
+		routes = append(routes, &r)
+	}
+
+	defer func(q *quotaLimiter) { quotas = q }(quotas)
+	quotas = newQuotaLimiter(10)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	r := web.NewRouter()
+	addAPIRoutes(r, routes, siteHost)
+	serveTest(l, r)
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/-/api/pkg/encoding/json", "/-/api/pkg/<path:.+> encoding/json"},
+		{"/-/api/json/encoding/json", "/-/api/json/<path:.+> encoding/json"},
+		{"/-/api/txt/encoding/json", "/-/api/txt/<path:.+> encoding/json"},
+		{"/-/api/pkg/example.com/txt", "/-/api/pkg/<path:.+> example.com/txt"},
+		{"/-/api/uses/example.com/graph", "/-/api/uses/<path:.+> example.com/graph"},
+		{"/-/api/card/html/template", "/-/api/card/<path:.+> html/template"},
+		{"/-/api/cardhtml/html/template", "/-/api/cardhtml/<path:.+> html/template"},
+	} {
+		status, body := getBody(t, http.DefaultClient, "http://"+l.Addr().String()+tt.path)
+		if status != web.StatusOK || body != tt.want {
+			t.Errorf("get %s = %d %q, want %d %q", tt.path, status, body, web.StatusOK, tt.want)
+		}
+	}
+}
+
+func TestWritePackagesJSON(t *testing.T) {
+	for _, pkgs := range [][]database.Package{
+		{},
+		{{Path: "a"}},
+		{{Path: "a"}, {Path: "b", Synopsis: "Package b <does> things."}, {Path: "c"}},
+	} {
+		var want bytes.Buffer
+		data := struct {
+			Results []database.Package `json:"results"`
+		}{pkgs}
+		if err := json.NewEncoder(&want).Encode(&data); err != nil {
+			t.Fatal(err)
+		}
+		var resp testResponse
+		err := writePackagesJSON(&resp, func(fn func(database.Package) bool) error {
+			for _, pkg := range pkgs {
+				if !fn(pkg) {
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.status != web.StatusOK || resp.buf.String() != want.String() {
+			t.Errorf("writePackagesJSON(%v) = %d %s, want %d %s", pkgs, resp.status, resp.buf.String(), web.StatusOK, want.String())
+		}
+	}
+
+	// An error before the first package is returned before the response
+	// is started.
+	errWalk := errors.New("walk")
+	var resp testResponse
+	err := writePackagesJSON(&resp, func(fn func(database.Package) bool) error { return errWalk })
+	if err != errWalk || resp.status != 0 {
+		t.Errorf("writePackagesJSON(error) = %v with status %d, want %v and no response", err, resp.status, errWalk)
+	}
+}
+
+func TestStoredDocETag(t *testing.T) {
+	a := []database.Advisory{{ID: "GO-1", Severity: database.SeverityHigh}}
+	b := []database.Advisory{{ID: "GO-1", Severity: database.SeverityLow}}
+	if etag := storedDocETag("abc", nil); etag != `"abc"` {
+		t.Errorf("storedDocETag(abc, nil) = %s, want %q", etag, `"abc"`)
+	}
+	if storedDocETag("abc", a) == storedDocETag("abc", nil) || storedDocETag("abc", a) == storedDocETag("abc", b) {
+		t.Error("storedDocETag did not change with the advisories")
+	}
+	if storedDocETag("abc", a) != storedDocETag("abc", a) {
+		t.Error("storedDocETag is not stable")
+	}
+}
+
+func TestServeAPIStoredDoc(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	pdoc.ReadmeFiles = map[string][]byte{"README.md": []byte("secret readme")}
+	defer func() { packagePages.store = nil }()
+	packagePages.store = &fakePackageStore{pdocs: map[string]*doc.Package{pdoc.ImportPath: pdoc}}
+
+	var resp testResponse
+	req := &web.Request{URL: &url.URL{}, Header: web.Header{}, RouteVars: map[string]string{"path": pdoc.ImportPath}}
+	if err := serveAPIStoredDoc(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(resp.buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["ImportPath"]; !ok {
+		t.Errorf("stored doc does not have the import path: %s", resp.buf.Bytes())
+	}
+	if v, ok := m["ReadmeFiles"]; ok && string(v) != "null" {
+		t.Errorf("stored doc has README files %s, want none", v)
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	data := struct {
+		Name       string
+		ImportPath string
+		Synopsis   string
+	}{"foo", "example.com/foo", "Package foo does things."}
+
+	m, msg, err := selectFields(&data, "synopsis, NAME,")
+	if err != nil || msg != "" {
+		t.Fatalf("selectFields returned %q, %v", msg, err)
+	}
+	p, _ := json.Marshal(m)
+	if want := `{"Name":"foo","Synopsis":"Package foo does things."}`; string(p) != want {
+		t.Errorf("selectFields(synopsis, NAME) = %s, want %s", p, want)
+	}
+
+	if _, msg, _ := selectFields(&data, "name,files"); msg == "" {
+		t.Error("selectFields(name,files) did not report the unknown field")
+	}
+}
+
+func TestRateLimitErrorResponse(t *testing.T) {
+	err := doc.RateLimitError{Host: "api.github.com", Reset: time.Now().Add(90 * time.Second)}
+	req := &web.Request{URL: &url.URL{Path: "/github.com/owner/repo"}}
+	for _, h := range []struct {
+		name string
+		fn   func(web.Response, *web.Request, int, error, interface{})
+	}{
+		{"handleError", handleError},
+		{"handlePresentError", handlePresentError},
+		{"handleAPIError", handleAPIError},
+	} {
+		var resp testResponse
+		h.fn(&resp, req, web.StatusInternalServerError, err, nil)
+		if resp.status != web.StatusServiceUnavailable {
+			t.Errorf("%s status = %d, want %d", h.name, resp.status, web.StatusServiceUnavailable)
+		}
+		if got := resp.header.Get(web.HeaderRetryAfter); got != "90" && got != "89" {
+			t.Errorf("%s Retry-After = %q, want 90", h.name, got)
+		}
+	}
+
+	if got := retryAfter(doc.RateLimitError{Reset: time.Unix(100, 0)}, time.Unix(200, 0)); got != "1" {
+		t.Errorf("retryAfter(past reset) = %q, want 1", got)
+	}
+}
@@ -210,9 +210,14 @@ $(function() {
 
     $('#_jump_form').on({
         submit: function(e) {
-            $('#_jump').modal('hide');
-            window.location.href = '#' + $('#_jump_text').val();
-            return false;
+            var id = $('#_jump_text').val();
+            if (exportPat.test(id) && document.getElementById(id)) {
+                $('#_jump').modal('hide');
+                window.location.href = '#' + id;
+                return false;
+            }
+            // The server finds the identifiers that start with the text.
+            return true;
         }
     });
 
@@ -291,7 +296,8 @@ $(function() {
         if (thData) {
             return thData.items;
         }
-        return $.get('/-/typeahead', { q: query }, function (data) {
+        // The search form action is the site root, including any path prefix.
+        return $.get($('#_search').closest('form').attr('action') + '-/typeahead', { q: query }, function (data) {
             thData = data
             return process(data.items);
         });
@@ -317,7 +323,55 @@ $(function() {
 
     //$('#_searchBox').typeahead({source: searchSource, sorter: searchSorter});
     $('span.timeago').timeago();
+
+    // Translate anchors used by other Go documentation sites.
+    if (window.location.hash.length > 1 && !document.getElementById(window.location.hash.substring(1))) {
+        $('link[rel=alternate][data-anchor]').each(function() {
+            if ('#' + $(this).attr('data-anchor') == window.location.hash) {
+                window.location.replace($(this).attr('href'));
+                return false;
+            }
+        });
+    }
+
     if (window.location.hash.substring(0, 10) == '#_example_') {
        $('[id|=_ex_' + window.location.hash.substring(10) + ']').addClass('in').height('auto');
+    } else if (window.location.hash.substring(0, 5) == '#_ex_') {
+       $(document.getElementById(window.location.hash.substring(1))).addClass('in').height('auto');
     }
+
+    // Keep the URL fragment in sync with the expanded example so that a
+    // copied link opens to the example.
+    function replaceHash(hash) {
+        if (window.history && window.history.replaceState) {
+            window.history.replaceState(null, '', window.location.pathname + window.location.search + hash);
+        }
+    }
+
+    $('.accordion-body').on({
+        shown: function() { replaceHash('#' + this.id); },
+        hidden: function() {
+            if (window.location.hash == '#' + this.id) {
+                replaceHash('');
+            }
+        }
+    });
+
+    // Add a copy button to shell examples. The button copies the commands
+    // without the prompts shown in the example.
+    $('pre.shell[data-copy]').each(function() {
+        var pre = $(this);
+        $('<button type="button" class="btn btn-mini copy">Copy</button>')
+            .appendTo(pre)
+            .on('click', function() {
+                var text = $('<textarea>').val(pre.attr('data-copy')).css({position: 'fixed', top: 0, left: '-9999px'}).appendTo('body');
+                text[0].select();
+                try {
+                    document.execCommand('copy');
+                } catch (e) {
+                    // The browser does not support copying.
+                }
+                text.remove();
+            });
+    });
 });
@@ -0,0 +1,221 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the documentation status badges that projects embed
+// in their README files, as in /github.com/user/repo?status.svg. Badge loads
+// do not fetch the package. A missing package is queued for the crawler.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+const (
+	// badgeMaxAge is the cache lifetime of a badge for a package with
+	// documentation.
+	badgeMaxAge = 24 * time.Hour
+
+	// notFoundBadgeMaxAge is the cache lifetime of a not found badge. The
+	// lifetime is short so that the badge changes soon after the crawler
+	// fetches the package.
+	notFoundBadgeMaxAge = time.Hour
+)
+
+type badgeStore interface {
+	Exists(path string) (bool, error)
+	IsBlocked(path string) (bool, error)
+	QueueNewCrawl(paths []string) error
+}
+
+// badges holds the store used to look up packages for badges. The store is
+// set in main.
+var badges struct {
+	store badgeStore
+}
+
+// badge is a variant of the status badge.
+type badge struct {
+	Label   string
+	Message string
+	Color   string
+}
+
+var (
+	referenceBadge = &badge{Label: "godoc", Message: "reference", Color: "#5272b4"}
+	notFoundBadge  = &badge{Label: "godoc", Message: "not found", Color: "#9f9f9f"}
+)
+
+// Width of a character and the padding around the text of a badge in
+// pixels.
+const (
+	badgeCharWidth = 7
+	badgePadding   = 6
+)
+
+func (b *badge) LabelWidth() int {
+	return len(b.Label)*badgeCharWidth + 2*badgePadding
+}
+
+func (b *badge) MessageWidth() int {
+	return len(b.Message)*badgeCharWidth + 2*badgePadding
+}
+
+func (b *badge) Width() int {
+	return b.LabelWidth() + b.MessageWidth()
+}
+
+// LabelX and MessageX return the centers of the label and message text.
+func (b *badge) LabelX() int {
+	return b.LabelWidth() / 2
+}
+
+func (b *badge) MessageX() int {
+	return b.LabelWidth() + b.MessageWidth()/2
+}
+
+// badgeFormat returns the format of the badge selected by the request form:
+// "svg" for status.svg and "png" for status.png.
+func badgeFormat(form map[string][]string) (string, bool) {
+	if _, ok := form["status.svg"]; ok {
+		return "svg", true
+	}
+	if _, ok := form["status.png"]; ok {
+		return "png", true
+	}
+	return "", false
+}
+
+// lookupBadge returns the badge for the import path. Missing packages with a
+// valid remote path that is not blocked are queued for the crawler.
+func lookupBadge(store badgeStore, path string) (*badge, error) {
+	if path == "-" || (!doc.IsValidPath(path) && !doc.IsGoRepoPath(path)) {
+		return notFoundBadge, nil
+	}
+	exists, err := store.Exists(path)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return referenceBadge, nil
+	}
+	if !doc.IsValidRemotePath(path) || !fetchAllowed(path) {
+		return notFoundBadge, nil
+	}
+	if blocked, err := store.IsBlocked(path); err != nil {
+		return nil, err
+	} else if blocked {
+		return notFoundBadge, nil
+	}
+	if err := store.QueueNewCrawl([]string{path}); err != nil {
+		log.Printf("ERROR queueing %s for crawl from badge: %v", path, err)
+	}
+	return notFoundBadge, nil
+}
+
+func serveBadge(resp web.Response, req *web.Request, path string, format string) error {
+	b, err := lookupBadge(badges.store, path)
+	if err != nil {
+		return err
+	}
+	maxAge := badgeMaxAge
+	variant := "reference"
+	if b == notFoundBadge {
+		maxAge = notFoundBadgeMaxAge
+		variant = "notfound"
+	}
+	etag := quoteETag("badge-" + variant + "-" + format + "-" + templateDigests["status.svg"])
+	header := web.Header{
+		web.HeaderCacheControl: {"public, max-age=" + strconv.Itoa(int(maxAge/time.Second))},
+		web.HeaderETag:         {etag},
+	}
+	if etagMatches(req.Header.Get(web.HeaderIfNoneMatch), etag) {
+		resp.Start(web.StatusNotModified, header)
+		return nil
+	}
+	if format == "svg" {
+		return executeTemplate(resp, req, "status.svg", web.StatusOK, header, b)
+	}
+	p, err := b.png()
+	if err != nil {
+		return err
+	}
+	header.Set(web.HeaderContentType, "image/png")
+	_, err = resp.Start(web.StatusOK, header).Write(p)
+	return err
+}
+
+// badgeGlyphs are 5x7 pixel bitmaps of the characters in the badges. Each
+// row is five bits, most significant bit on the left.
+var badgeGlyphs = map[rune][7]uint8{
+	' ': {},
+	'c': {0x00, 0x00, 0x0e, 0x10, 0x10, 0x11, 0x0e},
+	'd': {0x01, 0x01, 0x0d, 0x13, 0x11, 0x13, 0x0d},
+	'e': {0x00, 0x00, 0x0e, 0x11, 0x1f, 0x10, 0x0e},
+	'f': {0x06, 0x09, 0x08, 0x1c, 0x08, 0x08, 0x08},
+	'g': {0x00, 0x0f, 0x11, 0x11, 0x0f, 0x01, 0x0e},
+	'n': {0x00, 0x00, 0x16, 0x19, 0x11, 0x11, 0x11},
+	'o': {0x00, 0x00, 0x0e, 0x11, 0x11, 0x11, 0x0e},
+	'r': {0x00, 0x00, 0x16, 0x19, 0x10, 0x10, 0x10},
+	't': {0x08, 0x08, 0x1c, 0x08, 0x08, 0x09, 0x06},
+	'u': {0x00, 0x00, 0x11, 0x11, 0x11, 0x13, 0x0d},
+}
+
+const badgeHeight = 20
+
+// png returns the badge as a PNG image. The text is drawn with
+// badgeGlyphs because the server does not have fonts.
+func (b *badge) png() ([]byte, error) {
+	m := image.NewRGBA(image.Rect(0, 0, b.Width(), badgeHeight))
+	draw.Draw(m, image.Rect(0, 0, b.LabelWidth(), badgeHeight), image.NewUniform(parseBadgeColor("#555555")), image.ZP, draw.Src)
+	draw.Draw(m, image.Rect(b.LabelWidth(), 0, b.Width(), badgeHeight), image.NewUniform(parseBadgeColor(b.Color)), image.ZP, draw.Src)
+	drawBadgeText(m, badgePadding, b.Label)
+	drawBadgeText(m, b.LabelWidth()+badgePadding, b.Message)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func drawBadgeText(m *image.RGBA, x int, s string) {
+	const y = (badgeHeight - 7) / 2
+	for _, r := range s {
+		g := badgeGlyphs[r]
+		for row, bits := range g {
+			for col := 0; col < 5; col++ {
+				if bits&(0x10>>uint(col)) != 0 {
+					m.Set(x+1+col, y+row, color.White)
+				}
+			}
+		}
+		x += badgeCharWidth
+	}
+}
+
+// parseBadgeColor parses a color in the #rrggbb form.
+func parseBadgeColor(s string) color.Color {
+	n, _ := strconv.ParseUint(s[1:], 16, 32)
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image/png"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeBadgeStore struct {
+	paths   map[string]bool
+	blocked map[string]bool
+	queued  []string
+}
+
+func (s *fakeBadgeStore) Exists(path string) (bool, error) {
+	return s.paths[path], nil
+}
+
+func (s *fakeBadgeStore) IsBlocked(path string) (bool, error) {
+	return s.blocked[path], nil
+}
+
+func (s *fakeBadgeStore) QueueNewCrawl(paths []string) error {
+	s.queued = append(s.queued, paths...)
+	return nil
+}
+
+func TestBadge(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseTextTemplates([][]string{{"status.svg"}}); err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeBadgeStore{
+		paths:   map[string]bool{"github.com/user/repo": true},
+		blocked: map[string]bool{"github.com/spam/repo": true},
+	}
+	defer func() { badges.store = nil }()
+	badges.store = store
+
+	for _, tt := range []struct {
+		path    string
+		message string
+		maxAge  string
+	}{
+		{"github.com/user/repo", "reference", "public, max-age=86400"},
+		{"github.com/user/missing", "not found", "public, max-age=3600"},
+		{"github.com/spam/repo", "not found", "public, max-age=3600"},
+		{"net/http", "not found", "public, max-age=3600"},
+		{"not/a/path", "not found", "public, max-age=3600"},
+	} {
+		req := &web.Request{URL: &url.URL{}, Header: web.Header{}}
+		var resp testResponse
+		if err := serveBadge(&resp, req, tt.path, "svg"); err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.header.Get(web.HeaderContentType); ct != "image/svg+xml" {
+			t.Errorf("%s: content type = %q, want image/svg+xml", tt.path, ct)
+		}
+		if cc := resp.header.Get(web.HeaderCacheControl); cc != tt.maxAge {
+			t.Errorf("%s: cache control = %q, want %q", tt.path, cc, tt.maxAge)
+		}
+		var svg struct {
+			Title string `xml:"title"`
+		}
+		if err := xml.Unmarshal(resp.buf.Bytes(), &svg); err != nil {
+			t.Fatalf("%s: badge is not valid XML: %v\n%s", tt.path, err, resp.buf.Bytes())
+		}
+		if want := "godoc: " + tt.message; svg.Title != want {
+			t.Errorf("%s: title = %q, want %q", tt.path, svg.Title, want)
+		}
+
+		etag := resp.header.Get(web.HeaderETag)
+		req.Header.Set(web.HeaderIfNoneMatch, etag)
+		resp = testResponse{}
+		if err := serveBadge(&resp, req, tt.path, "svg"); err != nil {
+			t.Fatal(err)
+		}
+		if resp.status != web.StatusNotModified {
+			t.Errorf("%s: status with If-None-Match = %d, want %d", tt.path, resp.status, web.StatusNotModified)
+		}
+	}
+
+	// Only the missing package with a valid remote path that is not blocked
+	// is queued, once per load.
+	if want := []string{"github.com/user/missing", "github.com/user/missing"}; !reflect.DeepEqual(store.queued, want) {
+		t.Errorf("queued = %v, want %v", store.queued, want)
+	}
+
+	var resp testResponse
+	if err := serveBadge(&resp, &web.Request{URL: &url.URL{}, Header: web.Header{}}, "github.com/user/repo", "png"); err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.header.Get(web.HeaderContentType); ct != "image/png" {
+		t.Errorf("png content type = %q, want image/png", ct)
+	}
+	m, err := png.Decode(bytes.NewReader(resp.buf.Bytes()))
+	if err != nil {
+		t.Fatalf("png badge does not decode: %v", err)
+	}
+	if b := m.Bounds(); b.Dx() != referenceBadge.Width() || b.Dy() != badgeHeight {
+		t.Errorf("png size = %v, want %dx%d", b, referenceBadge.Width(), badgeHeight)
+	}
+	if etag := resp.header.Get(web.HeaderETag); etag == "" {
+		t.Error("png badge does not have an ETag")
+	}
+}
+
+func TestBadgeFormat(t *testing.T) {
+	for q, want := range map[string]string{"status.svg": "svg", "status.png": "png", "status": "", "imports": ""} {
+		form, _ := url.ParseQuery(q)
+		if got, ok := badgeFormat(form); got != want || ok != (want != "") {
+			t.Errorf("badgeFormat(%q) = %q, %v, want %q", q, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the blocklist administration endpoints, the
+// enforcement of CIDR block rules and the buffer of recent requests used to
+// test candidate rules.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+const (
+	// recentRequestsSize is the number of recent requests kept for testing
+	// block rules.
+	recentRequestsSize = 1000
+
+	// blockedNetsTTL is the time between loads of the CIDR rules.
+	blockedNetsTTL = time.Minute
+
+	// maxBlocklistImportSize is the maximum size of an import request body.
+	maxBlocklistImportSize = 1 << 20
+
+	// maxBlocklistTestPackages is the maximum number of packages listed in
+	// a rule test.
+	maxBlocklistTestPackages = 100
+)
+
+// blocklistStore is the subset of the database used by the blocklist.
+type blocklistStore interface {
+	BlockRules() ([]database.BlockRule, error)
+	ImportBlockRules(rules []database.BlockRule) error
+	BlockedCIDRs() ([]string, error)
+	CountBlockHit(kind, rule string) error
+	BlockedPackages(root string, limit int) ([]string, int, error)
+	BlockingRule(path string) (string, error)
+}
+
+// blocklist is set in main.
+var blocklist blocklistStore
+
+type recentRequest struct {
+	Path string    `json:"path"`
+	IP   string    `json:"ip"`
+	Time time.Time `json:"time"`
+}
+
+// requestRing is a ring buffer of recent requests.
+type requestRing struct {
+	mu   sync.Mutex
+	buf  []recentRequest
+	next int
+}
+
+func newRequestRing(n int) *requestRing {
+	return &requestRing{buf: make([]recentRequest, 0, n)}
+}
+
+func (r *requestRing) add(rr recentRequest) {
+	r.mu.Lock()
+	if len(r.buf) < cap(r.buf) {
+		r.buf = append(r.buf, rr)
+	} else {
+		r.buf[r.next] = rr
+	}
+	r.next = (r.next + 1) % cap(r.buf)
+	r.mu.Unlock()
+}
+
+// requests returns the requests in the buffer, oldest first.
+func (r *requestRing) requests() []recentRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) < cap(r.buf) {
+		return append([]recentRequest(nil), r.buf...)
+	}
+	return append(append([]recentRequest(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+var recentRequests = newRequestRing(recentRequestsSize)
+
+// blockedNets caches the CIDR rules of the blocklist.
+var blockedNets = struct {
+	sync.Mutex
+	rules   []string
+	nets    []*net.IPNet
+	expires time.Time
+}{}
+
+// invalidateBlockedNets causes the CIDR rules to be loaded on the next
+// request.
+func invalidateBlockedNets() {
+	blockedNets.Lock()
+	blockedNets.expires = time.Time{}
+	blockedNets.Unlock()
+}
+
+// blockedNet returns the CIDR rule that blocks ip or "" if ip is not
+// blocked.
+func blockedNet(ip string) string {
+	blockedNets.Lock()
+	defer blockedNets.Unlock()
+	if now := time.Now(); now.After(blockedNets.expires) && blocklist != nil {
+		// Keep the old rules if the rules cannot be loaded.
+		blockedNets.expires = now.Add(blockedNetsTTL)
+		rules, err := blocklist.BlockedCIDRs()
+		if err != nil {
+			log.Printf("ERROR loading blocked CIDRs: %v", err)
+		} else {
+			blockedNets.rules = nil
+			blockedNets.nets = nil
+			for _, rule := range rules {
+				_, n, err := net.ParseCIDR(rule)
+				if err != nil {
+					log.Printf("ERROR parsing blocked CIDR %q: %v", rule, err)
+					continue
+				}
+				blockedNets.rules = append(blockedNets.rules, rule)
+				blockedNets.nets = append(blockedNets.nets, n)
+			}
+		}
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	for i, n := range blockedNets.nets {
+		if n.Contains(addr) {
+			return blockedNets.rules[i]
+		}
+	}
+	return ""
+}
+
+// blockHandler records requests in the recent request buffer and rejects
+// requests from blocked IP ranges.
+type blockHandler struct {
+	h web.Handler
+}
+
+func (h blockHandler) ServeWeb(resp web.Response, req *web.Request) error {
+	ip := clientIP(req, trustedProxyNets)
+	recentRequests.add(recentRequest{Path: req.URL.Path, IP: ip, Time: time.Now()})
+	if rule := blockedNet(ip); rule != "" {
+		if err := blocklist.CountBlockHit(database.BlockCIDR, rule); err != nil {
+			log.Printf("ERROR counting hit for %s: %v", rule, err)
+		}
+		w := resp.Start(web.StatusForbidden, web.Header{web.HeaderContentType: {"text/plain; charset=utf-8"}})
+		_, err := io.WriteString(w, "Forbidden.\n")
+		return err
+	}
+	return h.h.ServeWeb(resp, req)
+}
+
+// requestBlocked returns true if the rule blocks the request. Path rules
+// block requests for the pages of the packages at or below the path.
+func requestBlocked(kind, rule string, rr recentRequest) bool {
+	switch kind {
+	case database.BlockPath:
+		path := strings.TrimPrefix(strings.TrimPrefix(rr.Path, *pathPrefix), "/")
+		return path == rule || strings.HasPrefix(path, rule+"/")
+	case database.BlockCIDR:
+		_, n, err := net.ParseCIDR(rule)
+		ip := net.ParseIP(rr.IP)
+		return err == nil && ip != nil && n.Contains(ip)
+	}
+	return false
+}
+
+func writeJSON(resp web.Response, status int, v interface{}) error {
+	w := resp.Start(status, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(v)
+}
+
+// serveBlocklist exports the blocklist.
+func serveBlocklist(resp web.Response, req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	rules, err := blocklist.BlockRules()
+	if err != nil {
+		return err
+	}
+	if rules == nil {
+		rules = []database.BlockRule{}
+	}
+	return writeJSON(resp, web.StatusOK, map[string]interface{}{"rules": rules})
+}
+
+type blockRuleError struct {
+	Index int    `json:"index"`
+	Kind  string `json:"kind"`
+	Rule  string `json:"rule"`
+	Error string `json:"error"`
+}
+
+// serveBlocklistImport adds the rules in the request body to the blocklist.
+// The body has the format of the export. The rules are added only if all
+// rules are valid. Otherwise, the response lists the error for each
+// invalid rule.
+func serveBlocklistImport(resp web.Response, req *web.Request) error {
+	if err := checkAdminPost(req); err != nil {
+		return err
+	}
+	var data struct {
+		Rules []database.BlockRule `json:"rules"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxBlocklistImportSize)).Decode(&data); err != nil {
+		writeAPIError(resp, web.StatusBadRequest, "The request body is not a JSON rule list: "+err.Error())
+		return nil
+	}
+	var errs []blockRuleError
+	for i, r := range data.Rules {
+		if err := database.ValidateBlockRule(r.Kind, r.Rule); err != nil {
+			errs = append(errs, blockRuleError{Index: i, Kind: r.Kind, Rule: r.Rule, Error: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return writeJSON(resp, web.StatusBadRequest, map[string]interface{}{"errors": errs})
+	}
+	if err := blocklist.ImportBlockRules(data.Rules); err != nil {
+		return err
+	}
+	invalidateBlockedNets()
+	return writeJSON(resp, web.StatusOK, map[string]interface{}{"imported": len(data.Rules)})
+}
+
+// serveBlocklistTest reports the stored packages and the recent requests
+// that a candidate rule would block. The rule is not added.
+func serveBlocklistTest(resp web.Response, req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	kind, rule := req.Form.Get("kind"), req.Form.Get("rule")
+	if err := database.ValidateBlockRule(kind, rule); err != nil {
+		writeAPIError(resp, web.StatusBadRequest, err.Error())
+		return nil
+	}
+	var data struct {
+		Packages     []string        `json:"packages"`
+		PackageCount int             `json:"packageCount"`
+		Requests     []recentRequest `json:"requests"`
+	}
+	data.Packages = []string{}
+	if kind == database.BlockPath {
+		var err error
+		data.Packages, data.PackageCount, err = blocklist.BlockedPackages(rule, maxBlocklistTestPackages)
+		if err != nil {
+			return err
+		}
+		if data.Packages == nil {
+			data.Packages = []string{}
+		}
+	}
+	data.Requests = []recentRequest{}
+	for _, rr := range recentRequests.requests() {
+		if requestBlocked(kind, rule, rr) {
+			data.Requests = append(data.Requests, rr)
+		}
+	}
+	return writeJSON(resp, web.StatusOK, &data)
+}
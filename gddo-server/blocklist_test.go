@@ -0,0 +1,293 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeBlocklistStore struct {
+	rules    []database.BlockRule
+	packages []string
+	imports  int
+	hits     []string
+}
+
+func (s *fakeBlocklistStore) BlockRules() ([]database.BlockRule, error) {
+	return s.rules, nil
+}
+
+func (s *fakeBlocklistStore) ImportBlockRules(rules []database.BlockRule) error {
+	s.imports++
+	s.rules = append(s.rules, rules...)
+	return nil
+}
+
+func (s *fakeBlocklistStore) BlockedCIDRs() ([]string, error) {
+	var cidrs []string
+	for _, r := range s.rules {
+		if r.Kind == database.BlockCIDR {
+			cidrs = append(cidrs, r.Rule)
+		}
+	}
+	return cidrs, nil
+}
+
+func (s *fakeBlocklistStore) CountBlockHit(kind, rule string) error {
+	s.hits = append(s.hits, kind+" "+rule)
+	return nil
+}
+
+func (s *fakeBlocklistStore) BlockedPackages(root string, limit int) ([]string, int, error) {
+	var paths []string
+	for _, p := range s.packages {
+		if p == root || strings.HasPrefix(p, root+"/") {
+			paths = append(paths, p)
+		}
+	}
+	n := len(paths)
+	if len(paths) > limit {
+		paths = paths[:limit]
+	}
+	return paths, n, nil
+}
+
+func (s *fakeBlocklistStore) BlockingRule(path string) (string, error) {
+	for _, r := range s.rules {
+		if r.Kind == database.BlockPath && (path == r.Rule || strings.HasPrefix(path, r.Rule+"/")) {
+			return r.Rule, nil
+		}
+	}
+	return "", nil
+}
+
+// setTestBlocklist sets the blocklist store and the recent request buffer.
+// The returned function restores the previous values.
+func setTestBlocklist(store blocklistStore, ring *requestRing) func() {
+	savedStore, savedRing := blocklist, recentRequests
+	blocklist, recentRequests = store, ring
+	invalidateBlockedNets()
+	return func() {
+		blocklist, recentRequests = savedStore, savedRing
+		invalidateBlockedNets()
+	}
+}
+
+func TestRequestRing(t *testing.T) {
+	r := newRequestRing(3)
+	for i, path := range []string{"/a", "/b", "/c", "/d", "/e"} {
+		r.add(recentRequest{Path: path})
+		var got []string
+		for _, rr := range r.requests() {
+			got = append(got, rr.Path)
+		}
+		want := []string{"/a", "/b", "/c", "/d", "/e"}[:i+1]
+		if len(want) > 3 {
+			want = want[len(want)-3:]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("after %d adds, requests = %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestBlocklistImport(t *testing.T) {
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+	store := &fakeBlocklistStore{}
+	defer setTestBlocklist(store, newRequestRing(10))()
+	admin := url.Values{"admin": {"key"}}
+
+	importRules := func(body string, cookie url.Values) (*testResponse, error) {
+		var resp testResponse
+		req := &web.Request{Body: strings.NewReader(body), Cookie: cookie, Header: web.Header{"X-Csrf-Token": {adminToken(&web.Request{Cookie: admin})}}}
+		err := serveBlocklistImport(&resp, req)
+		return &resp, err
+	}
+
+	if _, err := importRules(`{"rules":[]}`, nil); err == nil || err.(*web.Error).Status != web.StatusNotFound {
+		t.Errorf("import without admin cookie returned %v, want not found", err)
+	}
+
+	// One invalid rule rejects the whole import.
+	resp, err := importRules(`{"rules":[
+		{"kind":"path","rule":"github.com/spam"},
+		{"kind":"cidr","rule":"10.0.0.1/8"},
+		{"kind":"path","rule":"not a path"},
+		{"kind":"host","rule":"example.com"}]}`, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != web.StatusBadRequest {
+		t.Errorf("invalid import returned status %d, want %d", resp.status, web.StatusBadRequest)
+	}
+	var report struct {
+		Errors []blockRuleError `json:"errors"`
+	}
+	if err := json.Unmarshal(resp.buf.Bytes(), &report); err != nil {
+		t.Fatalf("decoding %q: %v", resp.buf.String(), err)
+	}
+	var indexes []int
+	for _, e := range report.Errors {
+		if e.Error == "" {
+			t.Errorf("error for rule %d is empty", e.Index)
+		}
+		indexes = append(indexes, e.Index)
+	}
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(indexes, want) {
+		t.Errorf("errors for rules %v, want %v", indexes, want)
+	}
+	if store.imports != 0 || len(store.rules) != 0 {
+		t.Fatalf("invalid import applied %d times, rules %v", store.imports, store.rules)
+	}
+
+	if resp, _ := importRules(`{"rules":`, admin); resp.status != web.StatusBadRequest {
+		t.Errorf("malformed import returned status %d, want %d", resp.status, web.StatusBadRequest)
+	}
+
+	resp, err = importRules(`{"rules":[{"kind":"path","rule":"github.com/spam"},{"kind":"cidr","rule":"10.0.0.0/8"}]}`, admin)
+	if err != nil || resp.status != web.StatusOK {
+		t.Fatalf("valid import returned %v, status %d", err, resp.status)
+	}
+	if store.imports != 1 || len(store.rules) != 2 {
+		t.Errorf("valid import applied %d times, rules %v", store.imports, store.rules)
+	}
+
+	// The export round trips.
+	store.rules[0].Hits = 3
+	resp = &testResponse{}
+	if err := serveBlocklist(resp, &web.Request{Cookie: admin}); err != nil {
+		t.Fatal(err)
+	}
+	var export struct {
+		Rules []database.BlockRule `json:"rules"`
+	}
+	if err := json.Unmarshal(resp.buf.Bytes(), &export); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(export.Rules, store.rules) {
+		t.Errorf("export = %+v, want %+v", export.Rules, store.rules)
+	}
+}
+
+func TestBlocklistTest(t *testing.T) {
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+	defer func(p string) { *pathPrefix = p }(*pathPrefix)
+	*pathPrefix = "/godoc"
+	store := &fakeBlocklistStore{packages: []string{
+		"github.com/spam",
+		"github.com/spam/a",
+		"github.com/spam/a/b",
+		"github.com/spammer/c",
+		"github.com/user/repo",
+	}}
+	ring := newRequestRing(10)
+	defer setTestBlocklist(store, ring)()
+	now := time.Unix(1400000000, 0).UTC()
+	for _, rr := range []recentRequest{
+		{"/godoc/github.com/spam/a", "10.1.2.3", now},
+		{"/godoc/github.com/spammer/c", "10.1.2.4", now},
+		{"/godoc/github.com/user/repo", "192.168.0.1", now},
+		{"/godoc/github.com/spam", "192.168.0.2", now},
+	} {
+		ring.add(rr)
+	}
+
+	type result struct {
+		Packages     []string        `json:"packages"`
+		PackageCount int             `json:"packageCount"`
+		Requests     []recentRequest `json:"requests"`
+	}
+	for _, tt := range []struct {
+		kind, rule string
+		packages   []string
+		requests   []string
+	}{
+		{database.BlockPath, "github.com/spam", []string{"github.com/spam", "github.com/spam/a", "github.com/spam/a/b"}, []string{"/godoc/github.com/spam/a", "/godoc/github.com/spam"}},
+		{database.BlockPath, "github.com/spam/a/b", []string{"github.com/spam/a/b"}, nil},
+		{database.BlockCIDR, "10.0.0.0/8", nil, []string{"/godoc/github.com/spam/a", "/godoc/github.com/spammer/c"}},
+	} {
+		var resp testResponse
+		req := &web.Request{Form: url.Values{"kind": {tt.kind}, "rule": {tt.rule}}, Cookie: url.Values{"admin": {"key"}}}
+		if err := serveBlocklistTest(&resp, req); err != nil {
+			t.Fatal(err)
+		}
+		var r result
+		if err := json.Unmarshal(resp.buf.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, rr := range r.Requests {
+			paths = append(paths, rr.Path)
+		}
+		if len(r.Packages) != 0 || len(tt.packages) != 0 {
+			if !reflect.DeepEqual(r.Packages, tt.packages) || r.PackageCount != len(tt.packages) {
+				t.Errorf("%s %s packages = %v (%d), want %v", tt.kind, tt.rule, r.Packages, r.PackageCount, tt.packages)
+			}
+		}
+		if !reflect.DeepEqual(paths, tt.requests) {
+			t.Errorf("%s %s requests = %v, want %v", tt.kind, tt.rule, paths, tt.requests)
+		}
+	}
+	if store.imports != 0 {
+		t.Errorf("test applied the rule")
+	}
+
+	var resp testResponse
+	req := &web.Request{Form: url.Values{"kind": {"cidr"}, "rule": {"10.0.0.1"}}, Cookie: url.Values{"admin": {"key"}}}
+	if err := serveBlocklistTest(&resp, req); err != nil || resp.status != web.StatusBadRequest {
+		t.Errorf("invalid rule returned %v, status %d, want bad request", err, resp.status)
+	}
+}
+
+func TestBlockHandler(t *testing.T) {
+	store := &fakeBlocklistStore{rules: []database.BlockRule{{Kind: database.BlockCIDR, Rule: "10.0.0.0/8"}}}
+	ring := newRequestRing(10)
+	defer setTestBlocklist(store, ring)()
+	var served []string
+	h := blockHandler{web.HandlerFunc(func(resp web.Response, req *web.Request) error {
+		served = append(served, req.RemoteAddr)
+		return nil
+	})}
+
+	for _, addr := range []string{"10.1.2.3:1234", "192.168.0.1:1234"} {
+		var resp testResponse
+		req := &web.Request{URL: &url.URL{Path: "/github.com/user/repo"}, RemoteAddr: addr, Header: web.Header{}}
+		if err := h.ServeWeb(&resp, req); err != nil {
+			t.Fatal(err)
+		}
+		if blocked := resp.status == web.StatusForbidden; blocked != strings.HasPrefix(addr, "10.") {
+			t.Errorf("request from %s returned status %d", addr, resp.status)
+		}
+	}
+	if want := []string{"192.168.0.1:1234"}; !reflect.DeepEqual(served, want) {
+		t.Errorf("served %v, want %v", served, want)
+	}
+	if want := []string{"cidr 10.0.0.0/8"}; !reflect.DeepEqual(store.hits, want) {
+		t.Errorf("hits = %v, want %v", store.hits, want)
+	}
+	if n := len(ring.requests()); n != 2 {
+		t.Errorf("recorded %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+// cardStore is the subset of the database used to show package cards.
+type cardStore interface {
+	Cards(paths []string) ([]*database.Card, error)
+}
+
+// cards is set in main.
+var cards cardStore
+
+// searchResult is a package in search results with the card of the
+// package.
+type searchResult struct {
+	database.Package
+	Card *database.Card
+}
+
+// searchResults returns the search results with their cards. The cards are
+// loaded in one request to the store; the package documentation is not
+// loaded. Results are shown without cards if the cards cannot be loaded.
+func searchResults(store cardStore, pkgs []database.Package) []searchResult {
+	results := make([]searchResult, len(pkgs))
+	paths := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		results[i].Package = pkg
+		paths[i] = pkg.Path
+	}
+	if store == nil || len(pkgs) == 0 {
+		return results
+	}
+	loaded, err := store.Cards(paths)
+	if err != nil {
+		log.Printf("ERROR loading cards: %v", err)
+		return results
+	}
+	for i := range results {
+		if i < len(loaded) {
+			results[i].Card = loaded[i]
+		}
+	}
+	return results
+}
+
+// loadCard returns the card of the package with the import path in the
+// request route or a not found error.
+func loadCard(req *web.Request) (*database.Card, error) {
+	loaded, err := cards.Cards([]string{req.RouteVars["path"]})
+	if err != nil {
+		return nil, err
+	}
+	if len(loaded) == 0 || loaded[0] == nil {
+		return nil, &web.Error{Status: web.StatusNotFound}
+	}
+	return loaded[0], nil
+}
+
+// serveAPICard serves the card of a package as JSON.
+func serveAPICard(resp web.Response, req *web.Request) error {
+	card, err := loadCard(req)
+	if err != nil {
+		return err
+	}
+	data := api.Card{
+		Path:      card.Path,
+		Name:      card.Name,
+		IsCmd:     card.IsCmd,
+		Synopsis:  card.Synopsis,
+		Notable:   card.Notable,
+		Updated:   card.Updated,
+		Importers: card.Importers,
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(&data)
+}
+
+// serveAPICardHTML serves the card of a package as an HTML fragment for
+// embedding in other sites. Links in the fragment are absolute.
+func serveAPICardHTML(resp web.Response, req *web.Request) error {
+	card, err := loadCard(req)
+	if err != nil {
+		return err
+	}
+	u := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}
+	return executeTemplate(resp, req, "card.html", web.StatusOK, nil, map[string]interface{}{
+		"card": card,
+		"base": u.String(),
+	})
+}
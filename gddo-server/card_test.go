@@ -0,0 +1,152 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// fakeCardStore counts the loads of cards and of full packages.
+type fakeCardStore struct {
+	cards     map[string]*database.Card
+	cardLoads int
+	cardPaths int
+	docLoads  int
+}
+
+func (s *fakeCardStore) Cards(paths []string) ([]*database.Card, error) {
+	s.cardLoads++
+	s.cardPaths += len(paths)
+	result := make([]*database.Card, len(paths))
+	for i, path := range paths {
+		result[i] = s.cards[path]
+	}
+	return result, nil
+}
+
+func (s *fakeCardStore) GetDoc(path string) (*doc.Package, time.Time, error) {
+	s.docLoads++
+	return nil, time.Time{}, nil
+}
+
+func testCard(path string) *database.Card {
+	return &database.Card{
+		Path:     path,
+		Name:     "pkg",
+		Synopsis: "Package pkg copies buffers.",
+		Notable: []doc.Notable{
+			{Name: "Buffer", Synopsis: "Buffer is a buffer."},
+			{Name: "Copy", Synopsis: "Copy copies src to dst."},
+		},
+		Updated:   time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC),
+		Importers: 12,
+	}
+}
+
+func TestSearchResultsCards(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"results.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeCardStore{cards: make(map[string]*database.Card)}
+	var pkgs []database.Package
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("github.com/user/repo%d/pkg", i)
+		pkgs = append(pkgs, database.Package{Path: path, Synopsis: "Package pkg copies buffers."})
+		if i != 7 {
+			store.cards[path] = testCard(path)
+		}
+	}
+
+	var resp testResponse
+	data := map[string]interface{}{"q": "buffers", "pkgs": pkgs, "results": searchResults(store, pkgs)}
+	if err := executeTemplate(&resp, nil, "results.html", web.StatusOK, nil, data); err != nil {
+		t.Fatal(err)
+	}
+	if store.cardLoads != 1 || store.cardPaths != 20 || store.docLoads != 0 {
+		t.Errorf("loads = %d card requests for %d paths and %d packages, want 1 request for 20 paths and no packages", store.cardLoads, store.cardPaths, store.docLoads)
+	}
+	body := resp.buf.String()
+	if n := strings.Count(body, `class="collapse"`); n != 19 {
+		t.Errorf("results have %d cards, want 19", n)
+	}
+	for _, s := range []string{
+		`<div id="_card0" class="collapse">`,
+		`<a href="/github.com/user/repo0/pkg#Buffer"><code>Buffer</code></a> <small>Buffer is a buffer.</small>`,
+		"Imported by 12 packages. Updated 2014-05-01.",
+		"github.com/user/repo7/pkg",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("results do not contain %q", s)
+		}
+	}
+	if strings.Contains(body, `id="_card7"`) {
+		t.Errorf("results show a card for a package without a card")
+	}
+}
+
+func TestServeAPICard(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"card.html", "common.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	const path = "github.com/user/repo/pkg"
+	saved := cards
+	cards = &fakeCardStore{cards: map[string]*database.Card{path: testCard(path)}}
+	defer func() { cards = saved }()
+
+	newRequest := func(path string) *web.Request {
+		return &web.Request{URL: &url.URL{Scheme: "http", Host: "godoc.org"}, RouteVars: map[string]string{"path": path}}
+	}
+
+	var resp testResponse
+	if err := serveAPICard(&resp, newRequest(path)); err != nil {
+		t.Fatal(err)
+	}
+	var card database.Card
+	if err := json.Unmarshal(resp.buf.Bytes(), &card); err != nil {
+		t.Fatal(err)
+	}
+	if card.Name != "pkg" || len(card.Notable) != 2 || card.Importers != 12 {
+		t.Errorf("card = %+v, want the stored card", card)
+	}
+
+	resp = testResponse{}
+	if err := serveAPICardHTML(&resp, newRequest(path)); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	if !strings.HasPrefix(resp.header.Get(web.HeaderContentType), "text/html") {
+		t.Errorf("content type = %q, want HTML", resp.header.Get(web.HeaderContentType))
+	}
+	if !strings.Contains(body, `href="http://godoc.org/github.com/user/repo/pkg#Copy"`) || strings.Contains(body, "<html") {
+		t.Errorf("fragment %s does not link to the package with absolute URLs", body)
+	}
+
+	for _, h := range []web.HandlerFunc{serveAPICard, serveAPICardHTML} {
+		if err := h(&testResponse{}, newRequest("github.com/user/missing")); err == nil || err.(*web.Error).Status != web.StatusNotFound {
+			t.Errorf("card of missing package returned %v, want not found", err)
+		}
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"net"
 	"net/http"
 	"time"
+
+	"github.com/garyburd/gddo/doc"
 )
 
 var (
@@ -49,4 +51,4 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 var httpTransport = &transport{t: http.Transport{Dial: timeoutDial, ResponseHeaderTimeout: *requestTimeout / 2}}
-var httpClient = &http.Client{Transport: httpTransport}
+var httpClient = &http.Client{Transport: httpTransport, CheckRedirect: doc.CheckRedirect}
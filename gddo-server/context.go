@@ -0,0 +1,55 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+type buildContextLink struct {
+	Query   string
+	Label   string
+	Current bool
+}
+
+// buildContextsFn returns links to the documentation of pdoc for each build
+// context or nil if the documentation is the same for all contexts.
+func buildContextsFn(pdoc *doc.Package) []buildContextLink {
+	var links []buildContextLink
+	for _, c := range pdoc.Contexts() {
+		links = append(links, buildContextLink{
+			Query:   "?" + url.Values{"GOOS": {c.GOOS}, "GOARCH": {c.GOARCH}}.Encode(),
+			Label:   c.String(),
+			Current: c == pdoc.Context(),
+		})
+	}
+	return links
+}
+
+// packageForContext returns the documentation for the build context selected
+// by the GOOS and GOARCH parameters. The context of pdoc is used for a
+// missing parameter.
+func packageForContext(pdoc *doc.Package, form url.Values) (*doc.Package, bool) {
+	c := pdoc.Context()
+	if _, ok := form["GOOS"]; ok {
+		c.GOOS = form.Get("GOOS")
+	}
+	if _, ok := form["GOARCH"]; ok {
+		c.GOARCH = form.Get("GOARCH")
+	}
+	return pdoc.ForContext(c)
+}
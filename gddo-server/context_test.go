@@ -0,0 +1,74 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestBuildContexts(t *testing.T) {
+	pdoc := &doc.Package{
+		Name:     "term",
+		GOOS:     "linux",
+		GOARCH:   "amd64",
+		Variants: []*doc.Package{{Name: "term", GOOS: "windows", GOARCH: "amd64"}},
+	}
+
+	for _, tt := range []struct {
+		query string
+		goos  string
+		ok    bool
+	}{
+		{"", "linux", true},
+		{"GOOS=windows", "windows", true},
+		{"GOOS=windows&GOARCH=amd64", "windows", true},
+		{"GOOS=linux&GOARCH=amd64", "linux", true},
+		{"GOOS=darwin", "", false},
+		{"GOOS=windows&GOARCH=386", "", false},
+	} {
+		form, _ := url.ParseQuery(tt.query)
+		p, ok := packageForContext(pdoc, form)
+		if ok != tt.ok || (ok && p.GOOS != tt.goos) {
+			t.Errorf("packageForContext(%q) = %v, %v, want GOOS %q, %v", tt.query, p, ok, tt.goos, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var labels []string
+		current := ""
+		for _, link := range buildContextsFn(p) {
+			labels = append(labels, link.Label+link.Query)
+			if link.Current {
+				current = link.Label
+			}
+		}
+		want := []string{"linux/amd64?GOARCH=amd64&GOOS=linux", "windows/amd64?GOARCH=amd64&GOOS=windows"}
+		if !reflect.DeepEqual(labels, want) {
+			t.Errorf("%q: links = %v, want %v", tt.query, labels, want)
+		}
+		if current != tt.goos+"/amd64" {
+			t.Errorf("%q: current = %q, want %s/amd64", tt.query, current, tt.goos)
+		}
+	}
+
+	if links := buildContextsFn(&doc.Package{Name: "term", GOOS: "linux", GOARCH: "amd64"}); links != nil {
+		t.Errorf("links for package without variants = %v, want nil", links)
+	}
+}
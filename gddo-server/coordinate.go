@@ -0,0 +1,158 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements coordination between server instances that share a
+// database. One instance at a time runs each background crawler and one
+// instance at a time fetches a package on demand.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+var coordinate = flag.Bool("coordinate", false, "Coordinate crawling with other server instances that share the database.")
+
+const (
+	// minCrawlLeaseTTL is the minimum time that a crawler lease is held
+	// without renewal. An instance takes over a crawler after the holder
+	// stops renewing the lease for the TTL.
+	minCrawlLeaseTTL = time.Minute
+
+	// fetchClaimTTL is the maximum time that an instance holds a claim to
+	// fetch a package on demand.
+	fetchClaimTTL = time.Minute
+
+	// fetchPollInterval is the interval for checking the database for a
+	// package fetched by another instance.
+	fetchPollInterval = 250 * time.Millisecond
+)
+
+// instanceID identifies this server instance in leases.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	var p [6]byte
+	rand.Read(p[:])
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(p[:]))
+}
+
+type leaseStore interface {
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(name, holder string) error
+}
+
+// lease is a lease on a shared resource. The lease is renewed after a third
+// of the TTL. The holder assumes that the lease is lost after nine tenths of
+// the TTL measured from before the last renewal. The margin allows for
+// drift between the holder's clock and the database server's clock.
+type lease struct {
+	store  leaseStore
+	name   string
+	holder string
+	ttl    time.Duration
+	now    func() time.Time
+
+	renewAt    time.Time
+	validUntil time.Time
+}
+
+func newLease(store leaseStore, name string, ttl time.Duration) *lease {
+	return &lease{store: store, name: name, holder: instanceID, ttl: ttl, now: time.Now}
+}
+
+// held returns true if the lease is held by this instance. The lease is
+// acquired or renewed as needed.
+func (l *lease) held() bool {
+	now := l.now()
+	if now.Before(l.renewAt) {
+		return true
+	}
+	ok, err := l.store.AcquireLease(l.name, l.holder, l.ttl)
+	if err != nil {
+		log.Printf("ERROR AcquireLease(%q): %v", l.name, err)
+		return now.Before(l.validUntil)
+	}
+	if !ok {
+		l.validUntil = time.Time{}
+		return false
+	}
+	l.renewAt = now.Add(l.ttl / 3)
+	l.validUntil = now.Add(l.ttl - l.ttl/10)
+	return true
+}
+
+// newCrawlLease returns the lease for a background crawler that runs at the
+// given interval or nil if coordination is disabled.
+func newCrawlLease(name string, interval time.Duration) *lease {
+	if !*coordinate {
+		return nil
+	}
+	// The lease must outlive the sleep between iterations of the crawler.
+	ttl := 3 * interval
+	if ttl < minCrawlLeaseTTL {
+		ttl = minCrawlLeaseTTL
+	}
+	return newLease(db, name, ttl)
+}
+
+// claimFetch returns true if this instance should fetch the package with
+// the given import path. If coordination is enabled, claimFetch returns false
+// when another instance is fetching the package.
+func claimFetch(path string) bool {
+	if !*coordinate {
+		return true
+	}
+	ok, err := db.AcquireLease("fetch:"+path, instanceID, fetchClaimTTL)
+	if err != nil {
+		log.Printf("ERROR AcquireLease(fetch:%q): %v", path, err)
+		return true
+	}
+	return ok
+}
+
+// releaseFetch releases the claim made by claimFetch.
+func releaseFetch(path string) {
+	if !*coordinate {
+		return
+	}
+	if err := db.ReleaseLease("fetch:"+path, instanceID); err != nil {
+		log.Printf("ERROR ReleaseLease(fetch:%q): %v", path, err)
+	}
+}
+
+// waitForFetch waits for another instance to store the package with the
+// given import path. The package is stored when the next crawl time
+// changes.
+func waitForFetch(path string, nextCrawl time.Time, timeout time.Duration) crawlResult {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(fetchPollInterval)
+		pdoc, _, t, err := db.Get(path)
+		if err != nil {
+			return crawlResult{nil, err}
+		}
+		if !t.Equal(nextCrawl) {
+			return crawlResult{pdoc, nil}
+		}
+	}
+	return crawlResult{nil, errUpdateTimeout}
+}
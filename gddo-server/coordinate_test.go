@@ -0,0 +1,154 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeLeaseStore is an in-memory leaseStore. Leases expire on the store's
+// clock, which is independent of the holders' clocks.
+type fakeLeaseStore struct {
+	now    time.Time
+	down   bool
+	leases map[string]fakeLease
+}
+
+type fakeLease struct {
+	holder  string
+	expires time.Time
+}
+
+func (s *fakeLeaseStore) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	if s.down {
+		return false, errors.New("store down")
+	}
+	if l, ok := s.leases[name]; ok && l.holder != holder && s.now.Before(l.expires) {
+		return false, nil
+	}
+	s.leases[name] = fakeLease{holder, s.now.Add(ttl)}
+	return true, nil
+}
+
+func (s *fakeLeaseStore) ReleaseLease(name, holder string) error {
+	if l, ok := s.leases[name]; ok && l.holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+// crawlerInstance simulates the crawler in a server instance. The instance
+// clock is skewed from the store clock.
+type crawlerInstance struct {
+	lease   *lease
+	skew    time.Duration
+	stopped bool
+}
+
+func newCrawlerInstance(store *fakeLeaseStore, holder string, skew time.Duration) *crawlerInstance {
+	ci := &crawlerInstance{skew: skew}
+	ci.lease = &lease{
+		store:  store,
+		name:   "crawl",
+		holder: holder,
+		ttl:    time.Minute,
+		now:    func() time.Time { return store.now.Add(ci.skew) },
+	}
+	return ci
+}
+
+func (ci *crawlerInstance) active() bool {
+	return !ci.stopped && ci.lease.held()
+}
+
+func TestCrawlLeaseFailover(t *testing.T) {
+	store := &fakeLeaseStore{now: time.Unix(1365000000, 0), leases: make(map[string]fakeLease)}
+	a := newCrawlerInstance(store, "a", -time.Hour)
+	b := newCrawlerInstance(store, "b", 3*time.Hour)
+
+	step := func(d time.Duration) (bool, bool) {
+		store.now = store.now.Add(d)
+		return a.active(), b.active()
+	}
+
+	// A acquires the lease first and stays the only active crawler while
+	// it runs.
+	for i := 0; i < 20; i++ {
+		activeA, activeB := step(5 * time.Second)
+		if !activeA || activeB {
+			t.Fatalf("step %d: active a=%v b=%v, want a only", i, activeA, activeB)
+		}
+	}
+
+	// A stops renewing. B takes over after the lease expires and no
+	// crawler is active before that.
+	a.stopped = true
+	failover := -1
+	for i := 0; i < 20; i++ {
+		activeA, activeB := step(5 * time.Second)
+		if activeA {
+			t.Fatalf("step %d: stopped instance is active", i)
+		}
+		if activeB && failover < 0 {
+			failover = i
+		}
+	}
+	if failover < 0 || failover > 13 {
+		t.Fatalf("failover at step %d, want within lease TTL", failover)
+	}
+
+	// A restarts, but B holds the lease.
+	a.stopped = false
+	for i := 0; i < 20; i++ {
+		activeA, activeB := step(5 * time.Second)
+		if activeA || !activeB {
+			t.Fatalf("step %d after restart: active a=%v b=%v, want b only", i, activeA, activeB)
+		}
+	}
+}
+
+func TestLeaseStoreDown(t *testing.T) {
+	store := &fakeLeaseStore{now: time.Unix(1365000000, 0), leases: make(map[string]fakeLease)}
+	ci := newCrawlerInstance(store, "a", 0)
+	if !ci.active() {
+		t.Fatal("instance did not acquire lease")
+	}
+
+	// The holder keeps the lease while the store is down until the lease
+	// may have expired.
+	store.down = true
+	store.now = store.now.Add(30 * time.Second)
+	if !ci.active() {
+		t.Errorf("instance lost lease before expiration")
+	}
+	store.now = store.now.Add(25 * time.Second)
+	if ci.active() {
+		t.Errorf("instance has lease after margin with store down")
+	}
+}
+
+func TestClaimFetchStandalone(t *testing.T) {
+	// Without coordination, the instance always fetches and does not
+	// use the database for claims.
+	if !claimFetch("example.com/pkg") {
+		t.Errorf("claimFetch() = false with coordination disabled")
+	}
+	releaseFetch("example.com/pkg")
+	if l := newCrawlLease("crawl", time.Second); l != nil {
+		t.Errorf("newCrawlLease() = %v with coordination disabled", l)
+	}
+}
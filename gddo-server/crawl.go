@@ -20,6 +20,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/garyburd/gddo/database"
 	"github.com/garyburd/gddo/doc"
 )
 
@@ -33,6 +34,46 @@ func exists(path string) bool {
 	return b
 }
 
+func isCanonicalPathError(err error) bool {
+	_, ok := err.(doc.CanonicalPathError)
+	return ok
+}
+
+// Reasons for the crawl interval of a package.
+const (
+	intervalDefault = "default"
+	intervalGithub  = "github"
+	intervalErrors  = "errors"
+)
+
+// packageCrawlInterval returns the time between crawls of the package and
+// the reason for the interval. GitHub packages are crawled less often
+// because the GitHub updates crawler picks up pushed projects. Packages
+// with errors are crawled less often to reduce load on the VCS host. The
+// interval does not include the cadence requested by the author.
+func packageCrawlInterval(path string, pdoc *doc.Package) (time.Duration, string) {
+	switch {
+	case strings.HasPrefix(path, "github.com/"):
+		return *maxAge * 7, intervalGithub
+	case pdoc != nil && len(pdoc.Errors) > 0:
+		return *maxAge * 7, intervalErrors
+	}
+	return *maxAge, intervalDefault
+}
+
+// nextCrawlTime returns the time of the next crawl of a package fetched at
+// the given time. The time is computed from the local time the fetch
+// completed. Times reported by the project host are not used because the
+// clock on the host can be ahead of the local clock.
+func nextCrawlTime(path string, pdoc *doc.Package, fetched time.Time) time.Time {
+	interval, _ := packageCrawlInterval(path, pdoc)
+	next := fetched.Add(interval)
+	if pdoc != nil {
+		next = scheduleNextCrawl(schedules.store, pdoc.ProjectRoot, fetched, next)
+	}
+	return next
+}
+
 // crawlDoc fetches the package documentation from the VCS and updates the database.
 func crawlDoc(source string, path string, pdoc *doc.Package, hasSubdirs bool, nextCrawl time.Time) (*doc.Package, error) {
 	message := []interface{}{source}
@@ -56,7 +97,11 @@ func crawlDoc(source string, path string, pdoc *doc.Package, hasSubdirs bool, ne
 
 	start := time.Now()
 	var err error
-	if i := strings.Index(path, "/src/pkg/"); i > 0 && doc.IsGoRepoPath(path[i+len("/src/pkg/"):]) {
+	if to, ok := redirectImportPath(path); ok {
+		// The package moved. The old path is removed and the new path is
+		// crawled.
+		err = doc.CanonicalPathError{ImportPath: to}
+	} else if i := strings.Index(path, "/src/pkg/"); i > 0 && doc.IsGoRepoPath(path[i+len("/src/pkg/"):]) {
 		// Go source tree mirror.
 		pdoc = nil
 		err = doc.NotFoundError{Message: "Go source tree mirror."}
@@ -67,21 +112,33 @@ func crawlDoc(source string, path string, pdoc *doc.Package, hasSubdirs bool, ne
 	} else if m := nestedProjectPat.FindStringIndex(path); m != nil && exists(path[m[0]+1:]) {
 		pdoc = nil
 		err = doc.NotFoundError{Message: "Copy of other project."}
-	} else if blocked, e := db.IsBlocked(path); blocked && e == nil {
+	} else if rule, e := db.BlockingRule(path); rule != "" && e == nil {
+		if e := db.CountBlockHit(database.BlockPath, rule); e != nil {
+			log.Printf("ERROR counting hit for %s: %v", rule, e)
+		}
 		pdoc = nil
 		err = doc.NotFoundError{Message: "Blocked."}
+	} else if canonical, e := db.CanonicalPath(path); e == nil && canonical != "" && canonical != path {
+		// The package is stored with a different case.
+		err = doc.CanonicalPathError{ImportPath: canonical}
 	} else {
 		var pdocNew *doc.Package
 		pdocNew, err = doc.Get(httpClient, path, etag)
+		pdocNew, err = fetchWithLocalFallback(path, etag, pdocNew, err)
 		message = append(message, "fetch:", int64(time.Since(start)/time.Millisecond))
 		if err != doc.ErrNotModified {
 			pdoc = pdocNew
 		}
 	}
 
-	nextCrawl = start.Add(*maxAge)
-	if strings.HasPrefix(path, "github.com/") || (pdoc != nil && len(pdoc.Errors) > 0) {
-		nextCrawl = start.Add(*maxAge * 7)
+	fetched := time.Now()
+	nextCrawl = nextCrawlTime(path, pdoc, fetched)
+
+	if err == nil || err == doc.ErrNotModified {
+		recordFetch(path, fetched)
+	}
+	if !isCanonicalPathError(err) {
+		recordFetchResult(path, start, err)
 	}
 
 	switch {
@@ -89,17 +146,51 @@ func crawlDoc(source string, path string, pdoc *doc.Package, hasSubdirs bool, ne
 		message = append(message, "put:", pdoc.Etag)
 		if err := db.Put(pdoc, nextCrawl); err != nil {
 			log.Printf("ERROR db.Put(%q): %v", path, err)
+		} else {
+			refreshes.publish(path, pdoc.Etag)
+			invalidateLanding(pdoc.ProjectRoot)
+			if declViews.store != nil {
+				if err := pruneViews(declViews.store, &declViews.pending, pdoc, time.Now()); err != nil {
+					log.Printf("ERROR pruning views for %q: %v", path, err)
+				}
+			}
+			if pdoc.Name != "" {
+				if err := storeText(db, path, textRenderVersion); err != nil {
+					log.Printf("ERROR storing text for %q: %v", path, err)
+				}
+			}
 		}
 	case err == doc.ErrNotModified:
 		message = append(message, "touch")
 		if err := db.SetNextCrawlEtag(pdoc.ProjectRoot, pdoc.Etag, nextCrawl); err != nil {
 			log.Printf("ERROR db.SetNextCrawl(%q): %v", path, err)
 		}
+	case isCanonicalPathError(err):
+		// Remove the package stored with the wrong case and crawl the
+		// package with the correct case.
+		canonical := err.(doc.CanonicalPathError).ImportPath
+		message = append(message, "canonical:", canonical)
+		if err := db.Delete(path); err != nil {
+			log.Printf("ERROR db.Delete(%q): %v", path, err)
+		} else {
+			refreshes.publish(path, "")
+		}
+		if err := db.QueueNewCrawl([]string{canonical}); err != nil {
+			log.Printf("ERROR db.QueueNewCrawl(%q): %v", canonical, err)
+		}
+		return nil, err
 	case doc.IsNotFound(err):
 		message = append(message, "notfound:", err)
 		if err := db.Delete(path); err != nil {
 			log.Printf("ERROR db.Delete(%q): %v", path, err)
+		} else {
+			refreshes.publish(path, "")
 		}
+	case isRateLimitError(err):
+		// Keep the stored package. The caller tries again after the
+		// limit is reset.
+		message = append(message, "ratelimit:", err)
+		return nil, err
 	default:
 		message = append(message, "ERROR:", err)
 		return nil, err
@@ -108,19 +199,66 @@ func crawlDoc(source string, path string, pdoc *doc.Package, hasSubdirs bool, ne
 	return pdoc, nil
 }
 
+func isRateLimitError(err error) bool {
+	_, ok := err.(doc.RateLimitError)
+	return ok
+}
+
+// waitForRateLimit pauses the crawler until the rate limit of the
+// repository host is reset.
+func waitForRateLimit(err doc.RateLimitError) {
+	if d := err.Reset.Sub(time.Now()); d > 0 {
+		log.Printf("Crawler paused for %v by rate limit of %s", d, err.Host)
+		time.Sleep(d)
+	}
+}
+
+// newCrawlStore is the subset of the database used to take paths from the
+// set of new paths to crawl.
+type newCrawlStore interface {
+	GetNewCrawl() (string, error)
+	SetBadCrawl(path string) error
+}
+
+// nextNewCrawl returns a path from the set of new paths to crawl or "" if
+// there is no path to crawl. A path on a host that is not active is moved
+// to the bad crawl set. Otherwise the path is returned on every call and
+// the crawler never gets to the other paths. The path is crawled if it is
+// queued again after the host becomes active.
+func nextNewCrawl(store newCrawlStore) (string, error) {
+	importPath, err := store.GetNewCrawl()
+	if err != nil || importPath == "" {
+		return "", err
+	}
+	if !fetchAllowed(importPath) {
+		return "", store.SetBadCrawl(importPath)
+	}
+	return importPath, nil
+}
+
 func crawl(interval time.Duration) {
+	lease := newCrawlLease("crawl", interval)
 	for {
 		time.Sleep(interval)
 
+		if lease != nil && !lease.held() {
+			// Another server instance is crawling.
+			continue
+		}
+
 		// Look for new package to crawl.
 
-		importPath, err := db.GetNewCrawl()
+		importPath, err := nextNewCrawl(db)
 		if err != nil {
-			log.Printf("db.GetNewCrawl() returned error %v", err)
+			log.Printf("nextNewCrawl() returned error %v", err)
 			continue
 		}
 		if importPath != "" {
-			if pdoc, err := crawlDoc("new", importPath, nil, false, time.Time{}); err != nil || pdoc == nil {
+			pdoc, err := crawlDoc("new", importPath, nil, false, time.Time{})
+			if e, ok := err.(doc.RateLimitError); ok {
+				// The path stays in the new crawl set.
+				waitForRateLimit(e)
+			} else if err != nil || pdoc == nil {
 				if err := db.SetBadCrawl(importPath); err != nil {
 					log.Printf("ERROR db.SetBadCrawl(%q): %v", importPath, err)
 				}
@@ -135,14 +273,50 @@ func crawl(interval time.Duration) {
 			log.Printf("db.Get(\"-\") returned error %v", err)
 			continue
 		}
-		if pdoc == nil || nextCrawl.After(time.Now()) {
+		if pdoc == nil {
+			continue
+		}
+		if !fetchAllowed(pdoc.ImportPath) {
+			// Skip packages on hosts that are not active.
+			if err := db.SetNextCrawlEtag(pdoc.ProjectRoot, pdoc.Etag, time.Now().Add(*maxAge)); err != nil {
+				log.Printf("ERROR db.SetNextCrawlEtag(%q): %v", pdoc.ImportPath, err)
+			}
+			continue
+		}
+		refreshActivity(pdoc.ProjectRoot, pdoc.Activity)
+		if nextCrawl.After(time.Now()) {
 			continue
 		}
+		if pdoc.Monorepo {
+			lastViewed, err := db.LastViewed(pdoc.ImportPath)
+			if err != nil {
+				log.Printf("db.LastViewed(%q) returned error %v", pdoc.ImportPath, err)
+				continue
+			}
+			if !refreshNeeded(pdoc, lastViewed) {
+				// Postpone the package without touching the other
+				// packages in the project.
+				if err := db.SetPackageNextCrawl(pdoc.ImportPath, time.Now().Add(*maxAge)); err != nil {
+					log.Printf("ERROR db.SetPackageNextCrawl(%q): %v", pdoc.ImportPath, err)
+				}
+				continue
+			}
+		}
 		if _, err = crawlDoc("crawl", pdoc.ImportPath, pdoc, len(pkgs) > 0, nextCrawl); err != nil {
-			// Touch package so that crawl advances to next package.
-			if err := db.SetNextCrawlEtag(pdoc.ProjectRoot, pdoc.Etag, time.Now().Add(*maxAge/3)); err != nil {
+			// Touch package so that crawl advances to next package. A
+			// rate limited package is tried again when the limit is
+			// reset.
+			next := time.Now().Add(*maxAge / 3)
+			e, limited := err.(doc.RateLimitError)
+			if limited {
+				next = e.Reset
+			}
+			if err := db.SetNextCrawlEtag(pdoc.ProjectRoot, pdoc.Etag, next); err != nil {
 				log.Printf("ERROR db.TouchLastCrawl(%q): %v", pdoc.ImportPath, err)
 			}
+			if limited {
+				waitForRateLimit(e)
+			}
 		}
 	}
 }
@@ -0,0 +1,69 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+// fakeNewCrawlStore returns the paths in the new crawl set in order.
+type fakeNewCrawlStore struct {
+	newCrawl []string
+	badCrawl []string
+}
+
+func (s *fakeNewCrawlStore) GetNewCrawl() (string, error) {
+	if len(s.newCrawl) == 0 {
+		return "", nil
+	}
+	return s.newCrawl[0], nil
+}
+
+func (s *fakeNewCrawlStore) SetBadCrawl(path string) error {
+	for i, p := range s.newCrawl {
+		if p == path {
+			s.newCrawl = append(s.newCrawl[:i], s.newCrawl[i+1:]...)
+			break
+		}
+	}
+	s.badCrawl = append(s.badCrawl, path)
+	return nil
+}
+
+func TestNextNewCrawl(t *testing.T) {
+	doc.SetServiceStates(map[string]doc.ServiceState{"example.com": doc.ServiceDeprecated})
+	defer doc.SetServiceStates(nil)
+
+	store := &fakeNewCrawlStore{newCrawl: []string{"example.com/old", "example.com/older", "github.com/user/repo"}}
+	var got []string
+	for i := 0; i < 3; i++ {
+		path, err := nextNewCrawl(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, path)
+	}
+	if want := []string{"", "", "github.com/user/repo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nextNewCrawl returned %q, want %q", got, want)
+	}
+	sort.Strings(store.badCrawl)
+	if want := []string{"example.com/old", "example.com/older"}; !reflect.DeepEqual(store.badCrawl, want) {
+		t.Errorf("bad crawl set = %q, want %q", store.badCrawl, want)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// packageDiagnostics returns the diagnostics for the package and the
+// diagnostics for the activity of the project.
+func packageDiagnostics(pdoc *doc.Package) []*doc.Diagnostic {
+	a := pdoc.Activity.Diagnostics()
+	if len(a) == 0 {
+		return pdoc.Diagnostics
+	}
+	return append(append([]*doc.Diagnostic(nil), pdoc.Diagnostics...), a...)
+}
+
+// loadDiagnostics returns the diagnostics and the number of diagnostics
+// with each severity.
+func loadDiagnostics(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	diagnostics := packageDiagnostics(pdoc)
+	counts := make(map[string]int)
+	for _, d := range diagnostics {
+		counts[d.Severity]++
+	}
+	return map[string]interface{}{"diagnostics": diagnostics, "counts": counts}, nil
+}
+
+// diagnosticsResponse returns the status and JSON body of the diagnostics
+// API response. If failOn is a severity, then the status is 412 when a
+// diagnostic has that severity or higher.
+func diagnosticsResponse(pdoc *doc.Package, failOn string) (int, []byte, error) {
+	switch failOn {
+	case "", doc.SeverityInfo, doc.SeverityWarning, doc.SeverityError:
+	default:
+		return 0, nil, &web.Error{Status: web.StatusBadRequest, Reason: errors.New("unknown severity " + failOn)}
+	}
+
+	data := struct {
+		Path        string            `json:"path"`
+		Etag        string            `json:"etag,omitempty"`
+		Diagnostics []*doc.Diagnostic `json:"diagnostics"`
+		Failed      bool              `json:"failed"`
+	}{
+		Path:        pdoc.ImportPath,
+		Etag:        pdoc.Etag,
+		Diagnostics: packageDiagnostics(pdoc),
+	}
+	if data.Diagnostics == nil {
+		data.Diagnostics = []*doc.Diagnostic{}
+	}
+	if failOn != "" {
+		for _, d := range data.Diagnostics {
+			if doc.SeverityAtLeast(d.Severity, failOn) {
+				data.Failed = true
+				break
+			}
+		}
+	}
+
+	p, err := json.Marshal(&data)
+	if err != nil {
+		return 0, nil, err
+	}
+	status := web.StatusOK
+	if data.Failed {
+		status = web.StatusPreconditionFailed
+	}
+	return status, p, nil
+}
+
+// serveAPIDiagnostics serves the diagnostics for a package. CI jobs set the
+// fail_on parameter to a severity and check the response status.
+func serveAPIDiagnostics(resp web.Response, req *web.Request) error {
+	pdoc, _, err := getDoc(req.RouteVars["path"], queryRequest)
+	if err != nil {
+		return err
+	}
+	if pdoc == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	status, p, err := diagnosticsResponse(pdoc, req.Form.Get("fail_on"))
+	if err != nil {
+		return err
+	}
+	_, err = resp.Start(status, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}}).Write(p)
+	return err
+}
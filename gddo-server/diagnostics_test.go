@@ -0,0 +1,124 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func diagnosticsTestPackage() *doc.Package {
+	return &doc.Package{
+		ImportPath:  "github.com/user/repo/pkg",
+		ProjectRoot: "github.com/user/repo",
+		ProjectName: "repo",
+		Name:        "pkg",
+		Diagnostics: []*doc.Diagnostic{
+			{Code: doc.DiagnosticParseError, Severity: doc.SeverityError, Message: "expected ')'", File: "bad.go", Line: 3},
+			{Code: doc.DiagnosticBuildConstraints, Severity: doc.SeverityInfo, Message: "File excluded.", File: "pkg_windows.go"},
+		},
+	}
+}
+
+var diagnosticsResponseTests = []struct {
+	failOn string
+	status int
+}{
+	{"", web.StatusOK},
+	{"error", web.StatusPreconditionFailed},
+	{"warning", web.StatusPreconditionFailed},
+	{"info", web.StatusPreconditionFailed},
+}
+
+func TestDiagnosticsResponse(t *testing.T) {
+	pdoc := diagnosticsTestPackage()
+	for _, tt := range diagnosticsResponseTests {
+		status, p, err := diagnosticsResponse(pdoc, tt.failOn)
+		if err != nil {
+			t.Fatalf("diagnosticsResponse(%q) returned error %v", tt.failOn, err)
+		}
+		if status != tt.status {
+			t.Errorf("diagnosticsResponse(%q) status = %d, want %d", tt.failOn, status, tt.status)
+		}
+		var data struct {
+			Diagnostics []*doc.Diagnostic
+		}
+		if err := json.Unmarshal(p, &data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Diagnostics) != 2 || data.Diagnostics[0].Code != "parse-error" || data.Diagnostics[1].Code != "build-constraints" {
+			t.Errorf("diagnosticsResponse(%q) body = %s", tt.failOn, p)
+		}
+	}
+
+	// Only the parse error has severity error.
+	pdoc.Diagnostics = pdoc.Diagnostics[1:]
+	if status, _, _ := diagnosticsResponse(pdoc, "error"); status != web.StatusOK {
+		t.Errorf("diagnosticsResponse(error) without errors status = %d, want %d", status, web.StatusOK)
+	}
+	pdoc.Diagnostics = nil
+	if _, p, _ := diagnosticsResponse(pdoc, ""); !strings.Contains(string(p), `"diagnostics":[]`) {
+		t.Errorf("diagnosticsResponse without diagnostics body = %s", p)
+	}
+
+	_, _, err := diagnosticsResponse(pdoc, "fatal")
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusBadRequest {
+		t.Errorf("diagnosticsResponse(fatal) returned %v, want bad request", err)
+	}
+}
+
+func TestDiagnosticsView(t *testing.T) {
+	parseTestTemplates(t)
+	var resp testResponse
+	if err := serveView(&resp, &web.Request{Form: url.Values{"diagnostics": {""}}}, viewsByName["diagnostics"], diagnosticsTestPackage()); err != nil {
+		t.Fatal(err)
+	}
+	page := resp.buf.String()
+	for _, s := range []string{
+		"1 errors, 0 warnings, 1 notes",
+		"<code>parse-error</code></td><td>bad.go:3</td>",
+		"<code>build-constraints</code></td><td>pkg_windows.go</td>",
+	} {
+		if !strings.Contains(page, s) {
+			t.Errorf("diagnostics page does not contain %s", s)
+		}
+	}
+}
+
+func TestActivityDiagnostics(t *testing.T) {
+	pdoc := diagnosticsTestPackage()
+	now := time.Unix(1400000000, 0).UTC()
+	pdoc.Activity = &doc.ProjectActivity{LastCommit: now, RawLastCommit: now.Add(time.Hour), ClockSkew: time.Hour, Fetched: now}
+	_, p, err := diagnosticsResponse(pdoc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), `"code":"clock-skew"`) {
+		t.Errorf("diagnosticsResponse body = %s, want clock-skew diagnostic", p)
+	}
+	if len(pdoc.Diagnostics) != 2 {
+		t.Errorf("package diagnostics modified")
+	}
+	data, _ := loadDiagnostics(pdoc, nil)
+	if counts := data["counts"].(map[string]int); counts[doc.SeverityInfo] != 2 {
+		t.Errorf("info count = %d, want 2", counts[doc.SeverityInfo])
+	}
+}
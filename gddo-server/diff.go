@@ -0,0 +1,175 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// maxWordDiffCells limits the size of the table used to compute a word
+// diff. Larger texts are shown as a deletion of the old text followed by an
+// insertion of the new text.
+const maxWordDiffCells = 1 << 20
+
+var wordPat = regexp.MustCompile(`\s+|[^\s]+`)
+
+// wordDiffFn returns the HTML for a word level diff of two texts. Deleted
+// words are wrapped in del elements and inserted words in ins elements.
+func wordDiffFn(old, new string) template.HTML {
+	a := wordPat.FindAllString(old, -1)
+	b := wordPat.FindAllString(new, -1)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	var lcs [][]int
+	if (len(a)+1)*(len(b)+1) <= maxWordDiffCells {
+		lcs = make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				switch {
+				case a[i] == b[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	var del, ins []string
+	flush := func() {
+		if len(del) > 0 {
+			buf.WriteString("<del>")
+			template.HTMLEscape(&buf, []byte(strings.Join(del, "")))
+			buf.WriteString("</del>")
+		}
+		if len(ins) > 0 {
+			buf.WriteString("<ins>")
+			template.HTMLEscape(&buf, []byte(strings.Join(ins, "")))
+			buf.WriteString("</ins>")
+		}
+		del, ins = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case lcs != nil && i < len(a) && j < len(b) && a[i] == b[j]:
+			if len(del) > 0 && len(ins) > 0 && strings.TrimSpace(a[i]) == "" {
+				// Join replacements separated by white space.
+				del = append(del, a[i])
+				ins = append(ins, b[j])
+				i++
+				j++
+				continue
+			}
+			flush()
+			template.HTMLEscape(&buf, []byte(a[i]))
+			i++
+			j++
+		case i < len(a) && (lcs == nil || j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			del = append(del, a[i])
+			i++
+		default:
+			ins = append(ins, b[j])
+			j++
+		}
+	}
+	flush()
+	return template.HTML(buf.String())
+}
+
+// packageVersion returns the stored documentation for a version of a
+// package or nil if the version is not stored. The version is the etag or
+// the documented tag or branch of the current documentation, a tag or
+// branch stored by an explicit request, or a date or time that selects a
+// snapshot as in the asof parameter. Stored tags and branches are not
+// fetched again.
+func packageVersion(pdoc *doc.Package, version string) (*doc.Package, error) {
+	if version == pdoc.Etag || (pdoc.DefaultBranch != "" && version == pdoc.DefaultBranch) {
+		return pdoc, nil
+	}
+	if refDocs.store != nil && validRef(version) {
+		p, _, err := refDocs.store.GetRef(pdoc.ImportPath, version)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			repairStoredDoc(p)
+			return p, nil
+		}
+	}
+	if snapshots != nil {
+		if asof, err := parseAsOf(version); err == nil {
+			times, err := snapshots.Snapshots(pdoc.ImportPath)
+			if err != nil {
+				return nil, err
+			}
+			t, ok := selectSnapshot(times, asof)
+			if !ok {
+				return nil, nil
+			}
+			p, err := snapshots.GetSnapshot(pdoc.ImportPath, t)
+			if err != nil || p == nil {
+				return nil, err
+			}
+			repairStoredDoc(p)
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// loadDiff loads the difference between the versions in the "diff" query
+// parameter, as in /<path>?diff=v1.2.0..v1.3.0.
+func loadDiff(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	versions := strings.SplitN(req.Form.Get("diff"), "..", 2)
+	if len(versions) != 2 || versions[0] == "" || versions[1] == "" {
+		return nil, &web.Error{Status: web.StatusNotFound}
+	}
+	data := map[string]interface{}{"from": versions[0], "to": versions[1]}
+	var missing []string
+	old, err := packageVersion(pdoc, versions[0])
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		missing = append(missing, versions[0])
+	}
+	new, err := packageVersion(pdoc, versions[1])
+	if err != nil {
+		return nil, err
+	}
+	if new == nil {
+		missing = append(missing, versions[1])
+	}
+	if missing != nil {
+		data["missing"] = missing
+		return data, nil
+	}
+	data["diff"] = doc.Diff(old, new)
+	return data, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var wordDiffTests = []struct {
+	old, new string
+	html     string
+}{
+	{"a b c", "a b c", "a b c"},
+	{"Close closes a widget.", "Close closes the widget.", "Close closes <del>a </del><ins>the </ins>widget."},
+	{"x", "x y", "x<ins> y</ins>"},
+	{"x <y>", "x", "x<del> &lt;y&gt;</del>"},
+	{"", "a&b", "<ins>a&amp;b</ins>"},
+}
+
+func TestWordDiff(t *testing.T) {
+	for _, tt := range wordDiffTests {
+		if html := string(wordDiffFn(tt.old, tt.new)); html != tt.html {
+			t.Errorf("wordDiff(%q, %q) = %q, want %q", tt.old, tt.new, html, tt.html)
+		}
+	}
+}
+
+func TestDiffView(t *testing.T) {
+	parseTestTemplates(t)
+	old := fragmentTestPackage()
+	old.Etag = "1"
+	pdoc := fragmentTestPackage()
+	pdoc.Etag = "2"
+	pdoc.DefaultBranch = "v1.3.0"
+	pdoc.Funcs[0].Doc = "Changed <doc>.\n"
+
+	defer func(s refStore) { refDocs.store = s }(refDocs.store)
+	refDocs.store = &fakeRefStore{pdocs: map[string]*doc.Package{old.ImportPath + "@v1.2.0": old}}
+
+	for _, tt := range []struct {
+		diff string
+		want string
+	}{
+		{"v1.2.0..v1.3.0", `<a href="/github.com/user/repo/pkg#` + pdoc.Funcs[0].Name + `">`},
+		{"v1.2.0..v1.3.0", `0 added, 0 removed, 1 changed.`},
+		{"v1.2.0..v1.3.0", `<ins>Changed &lt;doc&gt;.`},
+		{"2..v1.3.0", `The documentation is identical.`},
+		{"v1.1.0..v1.3.0", `Version v1.1.0 of this package is not stored.`},
+	} {
+		var resp testResponse
+		err := serveView(&resp, &web.Request{Form: url.Values{"diff": {tt.diff}}}, viewsByName["diff"], pdoc)
+		if err != nil {
+			t.Fatalf("diff=%s: %v", tt.diff, err)
+		}
+		if !strings.Contains(resp.buf.String(), tt.want) {
+			t.Errorf("diff=%s: page does not contain %s\n%s", tt.diff, tt.want, resp.buf.String())
+		}
+	}
+
+	err := serveView(&testResponse{}, &web.Request{Form: url.Values{"diff": {"v1.2.0"}}}, viewsByName["diff"], pdoc)
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+		t.Errorf("diff=v1.2.0 returned %v, want not found", err)
+	}
+}
+
+func TestDiffStoredVersions(t *testing.T) {
+	parseTestTemplates(t)
+	v1 := fragmentTestPackage()
+	v1.Etag = "1"
+	v2 := fragmentTestPackage()
+	v2.Etag = "2"
+	v2.Funcs[0].Doc = "Changed in v2.\n"
+	snapshot := fragmentTestPackage()
+	snapshot.Etag = "0"
+	snapshot.Funcs[0].Doc = "Snapshot doc.\n"
+	pdoc := fragmentTestPackage()
+	pdoc.Etag = "3"
+
+	defer func(s refStore) { refDocs.store = s }(refDocs.store)
+	refDocs.store = &fakeRefStore{pdocs: map[string]*doc.Package{
+		pdoc.ImportPath + "@v1": v1,
+		pdoc.ImportPath + "@v2": v2,
+	}}
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	defer setTestSnapshots(&fakeSnapshotStore{
+		pdocs: map[time.Time]*doc.Package{day: snapshot},
+		times: []time.Time{day},
+	})()
+
+	for _, tt := range []struct {
+		diff string
+		want string
+	}{
+		{"v1..v2", `<ins>Changed in v2.`},
+		{"v1..v2", `0 added, 0 removed, 1 changed.`},
+		{"2024-03-01..v1", `<del>Snapshot doc.`},
+		{"2024-02-01..v1", `Version 2024-02-01 of this package is not stored.`},
+	} {
+		var resp testResponse
+		err := serveView(&resp, &web.Request{Form: url.Values{"diff": {tt.diff}}}, viewsByName["diff"], pdoc)
+		if err != nil {
+			t.Fatalf("diff=%s: %v", tt.diff, err)
+		}
+		if !strings.Contains(resp.buf.String(), tt.want) {
+			t.Errorf("diff=%s: page does not contain %s\n%s", tt.diff, tt.want, resp.buf.String())
+		}
+	}
+}
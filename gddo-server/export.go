@@ -0,0 +1,481 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements exporting the documentation of a project as a
+// bundle of static pages for reading offline. The bundle is a gzipped tar
+// file with the project landing page at index.html and the page of each
+// package at <import path>/index.html. Links between pages of the bundle
+// and links to static files are rewritten to relative URLs. Other links
+// point to the live site.
+//
+// Exports run in the background one at a time. The status of an export is
+// polled at /-/export/<id> and the finished bundle is downloaded from
+// /-/export/<id>/bundle.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var (
+	exportSite     = flag.String("export_site", "http://godoc.org", "Base URL of the live site for links from exported documentation to pages outside of the export.")
+	exportMaxBytes = flag.Int("export_max_bytes", 64<<20, "Maximum size in bytes of an exported documentation bundle.")
+	exportTimeout  = flag.Duration("export_timeout", 10*time.Minute, "Maximum time to export the documentation of a project.")
+	exportQueueLen = flag.Int("export_queue", 8, "Maximum number of documentation exports waiting to run.")
+	exportKeep     = flag.Duration("export_keep", time.Hour, "Time to keep a finished documentation export for download.")
+)
+
+var (
+	errExportTooLarge  = errors.New("export exceeds the size limit")
+	errExportTimeout   = errors.New("export exceeds the time limit")
+	errExportNotFound  = errors.New("project not found")
+	errExportQueueFull = errors.New("too many exports waiting to run")
+)
+
+// projectDocStore is the database used to export a project.
+type projectDocStore interface {
+	Project(projectRoot string) ([]database.Package, error)
+	GetDoc(path string) (*doc.Package, time.Time, error)
+}
+
+// projectDocs is the store read by exports. The store is set in main.
+var projectDocs projectDocStore
+
+// exporter writes the documentation bundle of a project.
+type exporter struct {
+	store projectDocStore
+
+	// site is the base URL of the live site.
+	site string
+
+	// maxBytes is the maximum size of the compressed bundle.
+	maxBytes int
+
+	// deadline is the time after which the export fails.
+	deadline time.Time
+
+	// progress is called after each page with the number of pages written
+	// and the total number of pages.
+	progress func(done, total int)
+
+	tw     *tar.Writer
+	pages  map[string]bool // import paths of the package pages
+	assets map[string]bool // static files linked from the pages
+}
+
+// limitedWriter fails writes past the size limit of the bundle.
+type limitedWriter struct {
+	w   io.Writer
+	n   int
+	max int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.max {
+		return 0, errExportTooLarge
+	}
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
+
+// export writes the bundle of the project with root path to w.
+func (e *exporter) export(w io.Writer, root string) error {
+	pkgs, err := e.store.Project(root)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == 0 {
+		return errExportNotFound
+	}
+	sort.Sort(&byPath{pkgs, make([]int, len(pkgs))})
+	e.pages = make(map[string]bool)
+	for _, pkg := range pkgs {
+		e.pages[pkg.Path] = true
+	}
+	e.assets = make(map[string]bool)
+
+	gz := gzip.NewWriter(&limitedWriter{w: w, max: e.maxBytes})
+	e.tw = tar.NewWriter(gz)
+
+	// The landing page is written last, after the root package is loaded.
+	total := len(pkgs) + 1
+	rootDoc := &doc.Package{ImportPath: root, ProjectRoot: root, ProjectName: path.Base(root)}
+	for i, pkg := range pkgs {
+		if time.Now().After(e.deadline) {
+			return errExportTimeout
+		}
+		pdoc, _, err := e.store.GetDoc(pkg.Path)
+		if err != nil {
+			return err
+		}
+		if pdoc == nil {
+			// The package was deleted after the project was listed. Links
+			// to the package lead to a missing page in the bundle.
+			continue
+		}
+		if pkg.Path == root {
+			rootDoc = pdoc
+		}
+		var subdirs []database.Package
+		for _, p := range pkgs {
+			if strings.HasPrefix(p.Path, pkg.Path+"/") {
+				subdirs = append(subdirs, p)
+			}
+		}
+		page, err := RenderPackagePage(pdoc, "", &RenderOptions{Pkgs: subdirs})
+		if err != nil {
+			return err
+		}
+		if err := e.writePage(pkg.Path, pkg.Path+"/index.html", page); err != nil {
+			return err
+		}
+		e.reportProgress(i+1, total)
+	}
+
+	readmeName, readme := projectReadme(rootDoc)
+	page, err := renderLanding(rootDoc, readmeName, readme, pkgs)
+	if err != nil {
+		return err
+	}
+	if err := e.writePage(root, "index.html", page); err != nil {
+		return err
+	}
+	e.reportProgress(total, total)
+
+	var names []string
+	for name := range e.assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(*assetsDir, "static", filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		if err := e.writeFile("-/static/"+name, b); err != nil {
+			return err
+		}
+	}
+
+	if err := e.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (e *exporter) reportProgress(done, total int) {
+	if e.progress != nil {
+		e.progress(done, total)
+	}
+}
+
+// writePage adds the page for importPath to the bundle as the named file.
+func (e *exporter) writePage(importPath, name string, page []byte) error {
+	page = exportLinkPat.ReplaceAllFunc(page, func(attr []byte) []byte {
+		m := exportLinkPat.FindSubmatch(attr)
+		u := e.bundleURL(importPath, name, html.UnescapeString(string(m[2])))
+		return []byte(string(m[1]) + `="` + html.EscapeString(u) + `"`)
+	})
+	return e.writeFile(name, page)
+}
+
+func (e *exporter) writeFile(name string, b []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: timeNow(),
+	}
+	if err := e.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := e.tw.Write(b)
+	return err
+}
+
+var exportLinkPat = regexp.MustCompile(`\b(href|src|action)="([^"]*)"`)
+
+// bundleURL returns the URL of link in the bundle file name. The file is
+// the page for importPath.
+func (e *exporter) bundleURL(importPath, name, link string) string {
+	switch {
+	case link == "" || strings.HasPrefix(link, "#"):
+		return link
+	case strings.HasPrefix(link, "?"):
+		// Views of a package are served by the live site only.
+		return e.site + sitePath("/"+importPath) + link
+	case !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//"):
+		return link
+	}
+	prefix := strings.TrimRight(*pathPrefix, "/")
+	if !strings.HasPrefix(link, prefix+"/") {
+		return e.site + link
+	}
+	p := link[len(prefix)+1:]
+	if strings.HasPrefix(p, "-/static/") {
+		asset := p[len("-/static/"):]
+		if i := strings.IndexAny(asset, "?#"); i >= 0 {
+			asset = asset[:i]
+		}
+		asset = path.Clean(asset)
+		if asset == "." || strings.HasPrefix(asset, "../") || asset == ".." {
+			return e.site + link
+		}
+		e.assets[asset] = true
+		return relativeURL(name, "-/static/"+asset)
+	}
+	fragment := ""
+	if i := strings.Index(p, "#"); i >= 0 {
+		p, fragment = p[:i], p[i:]
+	}
+	if e.pages[p] {
+		return relativeURL(name, p+"/index.html") + fragment
+	}
+	return e.site + link
+}
+
+// relativeURL returns the URL of the bundle file to relative to the bundle
+// file from.
+func relativeURL(from, to string) string {
+	return strings.Repeat("../", strings.Count(from, "/")) + to
+}
+
+// exportJob is a queued, running or finished export.
+type exportJob struct {
+	id   string
+	path string
+
+	mu       sync.Mutex
+	state    string // queued, running, done or failed
+	done     int
+	total    int
+	err      string
+	bundle   []byte
+	finished time.Time
+}
+
+// exportStatus is the JSON representation of an export job.
+type exportStatus struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	State  string `json:"state"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+	Bytes  int    `json:"bytes,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Bundle string `json:"bundle,omitempty"`
+}
+
+func (j *exportJob) status() exportStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := exportStatus{
+		ID:    j.id,
+		Path:  j.path,
+		State: j.state,
+		Done:  j.done,
+		Total: j.total,
+		Bytes: len(j.bundle),
+		Error: j.err,
+	}
+	if j.state == "done" {
+		s.Bundle = sitePath("/-/export/" + j.id + "/bundle")
+	}
+	return s
+}
+
+func (j *exportJob) progress(done, total int) {
+	j.mu.Lock()
+	j.done = done
+	j.total = total
+	j.mu.Unlock()
+}
+
+func (j *exportJob) run(store projectDocStore) {
+	j.mu.Lock()
+	j.state = "running"
+	j.mu.Unlock()
+
+	var buf bytes.Buffer
+	e := &exporter{
+		store:    store,
+		site:     strings.TrimRight(*exportSite, "/"),
+		maxBytes: *exportMaxBytes,
+		deadline: time.Now().Add(*exportTimeout),
+		progress: j.progress,
+	}
+	err := e.export(&buf, j.path)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	if err != nil {
+		log.Printf("ERROR export %s: %v", j.path, err)
+		j.state = "failed"
+		j.err = err.Error()
+		return
+	}
+	j.state = "done"
+	j.bundle = buf.Bytes()
+}
+
+// expired returns true if the job finished longer ago than the time
+// bundles are kept.
+func (j *exportJob) expired(now time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finished.IsZero() && now.Sub(j.finished) > *exportKeep
+}
+
+// pending returns true if the job is queued or running.
+func (j *exportJob) pending() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == "queued" || j.state == "running"
+}
+
+var exportJobs = struct {
+	sync.Mutex
+	m     map[string]*exportJob
+	queue chan *exportJob
+}{m: make(map[string]*exportJob)}
+
+// queueExport queues an export of the project with the given root. A
+// pending export of the same project is returned instead of queueing
+// another.
+func queueExport(root string) (*exportJob, error) {
+	exportJobs.Lock()
+	defer exportJobs.Unlock()
+	if exportJobs.queue == nil {
+		exportJobs.queue = make(chan *exportJob, *exportQueueLen)
+		go runExports(exportJobs.queue, projectDocs)
+	}
+	now := time.Now()
+	for id, j := range exportJobs.m {
+		if j.expired(now) {
+			delete(exportJobs.m, id)
+		} else if j.path == root && j.pending() {
+			return j, nil
+		}
+	}
+	var p [8]byte
+	if _, err := rand.Read(p[:]); err != nil {
+		return nil, err
+	}
+	j := &exportJob{id: hex.EncodeToString(p[:]), path: root, state: "queued"}
+	select {
+	case exportJobs.queue <- j:
+	default:
+		return nil, errExportQueueFull
+	}
+	exportJobs.m[j.id] = j
+	return j, nil
+}
+
+func runExports(queue chan *exportJob, store projectDocStore) {
+	for j := range queue {
+		j.run(store)
+	}
+}
+
+func findExport(id string) *exportJob {
+	exportJobs.Lock()
+	defer exportJobs.Unlock()
+	j := exportJobs.m[id]
+	if j != nil && j.expired(time.Now()) {
+		delete(exportJobs.m, id)
+		return nil
+	}
+	return j
+}
+
+// serveExport queues an export of the project in the request form. The
+// endpoint requires an API token or the admin cookie. Requests with the
+// admin cookie are checked with checkAdminPost like the other admin actions.
+func serveExport(resp web.Response, req *web.Request) error {
+	switch {
+	case hasAPIToken(req):
+	case isAdmin(req):
+		if err := checkAdminPost(req); err != nil {
+			return err
+		}
+	default:
+		return &web.Error{Status: web.StatusUnauthorized}
+	}
+	root := req.Form.Get("path")
+	if !doc.IsValidPath(root) {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	j, err := queueExport(root)
+	if err == errExportQueueFull {
+		writeAPIError(resp, web.StatusServiceUnavailable, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(resp, web.StatusOK, j.status())
+}
+
+// serveExportStatus serves the progress of an export.
+func serveExportStatus(resp web.Response, req *web.Request) error {
+	j := findExport(req.RouteVars["id"])
+	if j == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	return writeJSON(resp, web.StatusOK, j.status())
+}
+
+// serveExportBundle serves the bundle of a finished export.
+func serveExportBundle(resp web.Response, req *web.Request) error {
+	j := findExport(req.RouteVars["id"])
+	if j == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	j.mu.Lock()
+	bundle := j.bundle
+	j.mu.Unlock()
+	if bundle == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	w := resp.Start(web.StatusOK, web.Header{
+		web.HeaderContentType: {"application/x-gzip"},
+		"Content-Disposition": {`attachment; filename="` + path.Base(j.path) + `-doc.tar.gz"`},
+	})
+	_, err := w.Write(bundle)
+	return err
+}
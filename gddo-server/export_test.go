@@ -0,0 +1,300 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// exportTestStore is the example.com/proj fixture project.
+type exportTestStore map[string]*doc.Package
+
+func (s exportTestStore) Project(projectRoot string) ([]database.Package, error) {
+	var pkgs []database.Package
+	for p, pdoc := range s {
+		if pdoc.ProjectRoot == projectRoot {
+			pkgs = append(pkgs, database.Package{Path: p, Synopsis: pdoc.Synopsis})
+		}
+	}
+	return pkgs, nil
+}
+
+func (s exportTestStore) GetDoc(path string) (*doc.Package, time.Time, error) {
+	return s[path], time.Time{}, nil
+}
+
+func newExportTestStore() exportTestStore {
+	newCode := func(text string, paths ...string) doc.Code {
+		return doc.Code{
+			Text: text,
+			Annotations: []doc.Annotation{
+				{Kind: doc.ExportLinkAnnotation, PathIndex: 0, Pos: 15, End: 20},
+				{Kind: doc.ExportLinkAnnotation, PathIndex: 1, Pos: 28, End: 33},
+			},
+			Paths: paths,
+		}
+	}
+	s := exportTestStore{}
+	for _, pdoc := range []*doc.Package{
+		{
+			ImportPath:  "example.com/proj",
+			Name:        "proj",
+			Synopsis:    "Package proj is the root of the project.",
+			ReadmeFiles: map[string][]byte{"README.md": []byte("The proj project.")},
+			Funcs: []*doc.Func{{
+				Name: "Run",
+				Doc:  "Run runs the thing.\n",
+				Decl: newCode("func Run(x sub.Thing) other.Thing", "example.com/proj/sub", "example.com/other"),
+			}},
+		},
+		{ImportPath: "example.com/proj/sub", Name: "sub", Synopsis: "Package sub has things.",
+			Types: []*doc.Type{{Name: "Thing", Doc: "Thing is a thing.\n", Decl: doc.Code{Text: "type Thing int"}}}},
+		{ImportPath: "example.com/proj/sub/deep", Name: "deep", Synopsis: "Package deep is deep."},
+		{ImportPath: "example.com/other", ProjectRoot: "example.com/other", Name: "other"},
+	} {
+		if pdoc.ProjectRoot == "" {
+			pdoc.ProjectRoot = "example.com/proj"
+		}
+		pdoc.ProjectName = path.Base(pdoc.ProjectRoot)
+		pdoc.Updated = time.Unix(1365000000, 0)
+		s[pdoc.ImportPath] = pdoc
+	}
+	return s
+}
+
+func parseExportTemplates(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"cmd.html", "common.html", "layout.html"},
+		{"landing.html", "common.html", "layout.html"},
+		{"pkg.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestExporter(store projectDocStore) *exporter {
+	return &exporter{
+		store:    store,
+		site:     "http://godoc.org",
+		maxBytes: 1 << 20,
+		deadline: time.Now().Add(time.Minute),
+	}
+}
+
+// readBundle returns the files in a bundle by name.
+func readBundle(t *testing.T, b []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(p)
+	}
+	return files
+}
+
+func TestExportProject(t *testing.T) {
+	parseExportTemplates(t)
+	var buf bytes.Buffer
+	e := newTestExporter(newExportTestStore())
+	var progress []int
+	e.progress = func(done, total int) { progress = append(progress, done, total) }
+	if err := e.export(&buf, "example.com/proj"); err != nil {
+		t.Fatal(err)
+	}
+	files := readBundle(t, buf.Bytes())
+
+	for _, name := range []string{
+		"index.html",
+		"example.com/proj/index.html",
+		"example.com/proj/sub/index.html",
+		"example.com/proj/sub/deep/index.html",
+		"-/static/css/bootstrap.css",
+		"-/static/site.js",
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("bundle does not contain %s", name)
+		}
+	}
+	if _, ok := files["example.com/other/index.html"]; ok {
+		t.Errorf("bundle contains a page of another project")
+	}
+	if got, want := fmt.Sprint(progress), "[1 4 2 4 3 4 4 4]"; got != want {
+		t.Errorf("progress = %s, want %s", got, want)
+	}
+
+	// Every relative link resolves to a file in the bundle.
+	n := 0
+	for name, page := range files {
+		if !strings.HasSuffix(name, ".html") {
+			continue
+		}
+		for _, m := range exportLinkPat.FindAllStringSubmatch(page, -1) {
+			link := html.UnescapeString(m[2])
+			if i := strings.Index(link, "#"); i >= 0 {
+				link = link[:i]
+			}
+			if link == "" || strings.Contains(link, ":") || strings.HasPrefix(link, "//") {
+				continue
+			}
+			if strings.HasPrefix(link, "/") || strings.Contains(link, "?") {
+				t.Errorf("%s: link %s is not relative to the bundle", name, m[2])
+				continue
+			}
+			if _, ok := files[path.Join(path.Dir(name), link)]; !ok {
+				t.Errorf("%s: link %s does not resolve in the bundle", name, m[2])
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		t.Error("bundle has no relative links")
+	}
+
+	root := files["example.com/proj/index.html"]
+	for _, s := range []string{
+		`href="../../example.com/proj/sub/index.html#Thing"`,
+		`href="http://godoc.org/example.com/other#Thing"`,
+		`href="http://godoc.org/example.com/proj?imports"`,
+		`href="../../-/static/css/bootstrap.css"`,
+	} {
+		if !strings.Contains(root, s) {
+			t.Errorf("root package page does not contain %s", s)
+		}
+	}
+	if landing := files["index.html"]; !strings.Contains(landing, `href="example.com/proj/sub/deep/index.html"`) || !strings.Contains(landing, "The proj project.") {
+		t.Errorf("landing page does not list the packages and README:\n%s", landing)
+	}
+}
+
+func TestExportLimits(t *testing.T) {
+	parseExportTemplates(t)
+	store := newExportTestStore()
+
+	e := newTestExporter(store)
+	e.maxBytes = 4096
+	if err := e.export(ioutil.Discard, "example.com/proj"); err != errExportTooLarge {
+		t.Errorf("export with size limit returned %v, want %v", err, errExportTooLarge)
+	}
+
+	e = newTestExporter(store)
+	e.deadline = time.Now().Add(-time.Second)
+	if err := e.export(ioutil.Discard, "example.com/proj"); err != errExportTimeout {
+		t.Errorf("export after deadline returned %v, want %v", err, errExportTimeout)
+	}
+
+	e = newTestExporter(store)
+	if err := e.export(ioutil.Discard, "example.com/missing"); err != errExportNotFound {
+		t.Errorf("export of missing project returned %v, want %v", err, errExportNotFound)
+	}
+}
+
+func TestServeExport(t *testing.T) {
+	parseExportTemplates(t)
+	secrets.AdminKey = "key"
+	defer func() { secrets.AdminKey = "" }()
+	saved := projectDocs
+	projectDocs = newExportTestStore()
+	defer func() { projectDocs = saved }()
+
+	form := url.Values{"path": {"example.com/proj"}}
+	if err := serveExport(&testResponse{}, &web.Request{Form: form}); err == nil || err.(*web.Error).Status != web.StatusUnauthorized {
+		t.Fatalf("export without credentials returned %v, want unauthorized", err)
+	}
+
+	admin := url.Values{"admin": {"key"}}
+	req := &web.Request{URL: &url.URL{Host: "godoc.org"}, Form: form, Cookie: admin, Header: web.Header{"Origin": {"http://evil.example.com"}}}
+	if err := serveExport(&testResponse{}, req); err == nil || err.(*web.Error).Status != web.StatusForbidden {
+		t.Fatalf("export without CSRF token returned %v, want forbidden", err)
+	}
+	form.Set("csrf", adminToken(&web.Request{Cookie: admin}))
+	if err := serveExport(&testResponse{}, req); err == nil || err.(*web.Error).Status != web.StatusForbidden {
+		t.Fatalf("cross-origin export returned %v, want forbidden", err)
+	}
+
+	var resp testResponse
+	req.Header = web.Header{}
+	if err := serveExport(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	var s exportStatus
+	if err := json.Unmarshal(resp.buf.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"id": s.ID}
+	for i := 0; s.State != "done" && s.State != "failed"; i++ {
+		if i == 500 {
+			t.Fatalf("export did not finish, status %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+		resp = testResponse{}
+		if err := serveExportStatus(&resp, &web.Request{RouteVars: vars}); err != nil {
+			t.Fatal(err)
+		}
+		s = exportStatus{}
+		if err := json.Unmarshal(resp.buf.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.State != "done" || s.Done != 4 || s.Total != 4 || s.Bundle != "/-/export/"+s.ID+"/bundle" {
+		t.Fatalf("status = %+v, want done with 4 pages", s)
+	}
+
+	resp = testResponse{}
+	if err := serveExportBundle(&resp, &web.Request{RouteVars: vars}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readBundle(t, resp.buf.Bytes())["index.html"]; !ok {
+		t.Error("downloaded bundle has no index.html")
+	}
+	if got := resp.header.Get("Content-Disposition"); !strings.Contains(got, "proj-doc.tar.gz") {
+		t.Errorf("Content-Disposition = %q, want the bundle file name", got)
+	}
+
+	err := serveExportStatus(&testResponse{}, &web.Request{RouteVars: map[string]string{"id": "0123"}})
+	if err == nil || err.(*web.Error).Status != web.StatusNotFound {
+		t.Errorf("status of unknown export returned %v, want not found", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/indigo/web"
+)
+
+var maxFileHashes = flag.Int("max_file_hashes", 1000, "Maximum number of static file hashes to cache.")
+
+const (
+	// fileHashRecheck is the minimum time between checks of a file's
+	// modification time and size.
+	fileHashRecheck = time.Second
+
+	// missingFileTTL is the time that a missing file is remembered.
+	missingFileTTL = time.Minute
+)
+
+// fileHash is a cached hash of a file. Missing files are cached with an
+// empty hash.
+type fileHash struct {
+	path    string
+	hash    string
+	modTime time.Time
+	size    int64
+	missing bool
+
+	// checked is the time of the last check of the file. Missing files
+	// are checked again after missingFileTTL.
+	checked time.Time
+
+	elem *list.Element
+}
+
+// fileHashCache is a bounded cache of file hashes. The least recently used
+// hash is discarded when the cache is full. Hashes are recomputed when the
+// file's modification time or size changes.
+type fileHashCache struct {
+	mu     sync.Mutex
+	max    int
+	hashes map[string]*fileHash
+	lru    *list.List // front is most recently used
+	now    func() time.Time
+}
+
+func newFileHashCache(max int) *fileHashCache {
+	return &fileHashCache{
+		max:    max,
+		hashes: make(map[string]*fileHash),
+		lru:    list.New(),
+		now:    time.Now,
+	}
+}
+
+// get returns a copy of the cached hash for path and true if the cached
+// hash does not need to be checked against the file.
+func (c *fileHashCache) get(path string, now time.Time) (fileHash, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.hashes[path]
+	if h == nil {
+		return fileHash{}, false
+	}
+	c.lru.MoveToFront(h.elem)
+	if h.missing {
+		return *h, now.Sub(h.checked) < missingFileTTL
+	}
+	return *h, now.Sub(h.checked) < fileHashRecheck
+}
+
+func (c *fileHashCache) put(h *fileHash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.hashes[h.path]; old != nil {
+		c.lru.Remove(old.elem)
+	} else if e := c.lru.Back(); e != nil && len(c.hashes) >= c.max {
+		// The list is empty if max is less than one.
+		c.lru.Remove(e)
+		delete(c.hashes, e.Value.(*fileHash).path)
+	}
+	h.elem = c.lru.PushFront(h)
+	c.hashes[h.path] = h
+}
+
+// hash returns the hash of the file at path. The error satisfies
+// os.IsNotExist if the file is missing. Other errors are not cached.
+func (c *fileHashCache) hash(path string) (string, error) {
+	now := c.now()
+	cached, ok := c.get(path, now)
+	if ok {
+		if cached.missing {
+			return "", &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+		return cached.hash, nil
+	}
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		c.put(&fileHash{path: path, missing: true, checked: now})
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+
+	if cached.hash != "" && fi.ModTime().Equal(cached.modTime) && fi.Size() == cached.size {
+		cached.checked = now
+		c.put(&cached)
+		return cached.hash, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.put(&fileHash{path: path, missing: true, checked: now})
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+	m := md5.New()
+	m.Write(b)
+	h := &fileHash{
+		path:    path,
+		hash:    hex.EncodeToString(m.Sum(nil)),
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		checked: now,
+	}
+	c.put(h)
+	return h.hash, nil
+}
+
+// flush discards all cached hashes.
+func (c *fileHashCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hashes = make(map[string]*fileHash)
+	c.lru.Init()
+}
+
+// fileHashOverhead is the approximate size in bytes of a cached hash
+// excluding the path and hash strings.
+const fileHashOverhead = 160
+
+// Usage returns the number of cached hashes and the approximate size of
+// the most recently used hash.
+func (c *fileHashCache) Usage() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.lru.Front()
+	if e == nil {
+		return 0, 0
+	}
+	h := e.Value.(*fileHash)
+	return len(c.hashes), fileHashOverhead + len(h.path) + len(h.hash)
+}
+
+// Evict discards the given fraction of the hashes, least recently used
+// first.
+func (c *fileHashCache) Evict(fraction float64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := int(math.Ceil(fraction * float64(len(c.hashes))))
+	evicted := 0
+	for ; evicted < n; evicted++ {
+		e := c.lru.Back()
+		if e == nil {
+			break
+		}
+		c.lru.Remove(e)
+		delete(c.hashes, e.Value.(*fileHash).path)
+	}
+	return evicted
+}
+
+// fileHashes is replaced in main with a cache of the size set by the
+// max_file_hashes flag.
+var fileHashes = newFileHashCache(1000)
+
+// serveFlushFileHashes discards the cached static file hashes. Use after
+// deploying new static files without restarting the server.
+func serveFlushFileHashes(resp web.Response, req *web.Request) error {
+	if err := checkAdminPost(req); err != nil {
+		return err
+	}
+	fileHashes.flush()
+	_, err := io.WriteString(resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"text/plain; charset=utf-8"}}), "Flushed static file hashes.\n")
+	return err
+}
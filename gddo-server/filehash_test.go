@@ -0,0 +1,198 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/indigo/web"
+)
+
+// newFileHashTest returns a cache with a fake clock and a temporary
+// directory. The caller removes the directory.
+func newFileHashTest(t *testing.T, max int) (*fileHashCache, *time.Time, string) {
+	dir, err := ioutil.TempDir("", "filehash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	c := newFileHashCache(max)
+	c.now = func() time.Time { return now }
+	return c, &now, dir
+}
+
+func writeFileHashTest(t *testing.T, path, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileHashRevalidate(t *testing.T) {
+	c, now, dir := newFileHashTest(t, 10)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "site.css")
+
+	writeFileHashTest(t, path, "aaa", time.Unix(1, 0))
+	h1, err := c.hash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is not checked again until fileHashRecheck passes.
+	writeFileHashTest(t, path, "bbb", time.Unix(2, 0))
+	if h, _ := c.hash(path); h != h1 {
+		t.Errorf("hash changed before recheck")
+	}
+
+	*now = now.Add(fileHashRecheck)
+	h2, err := c.hash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2 == h1 {
+		t.Errorf("hash not updated after file modified")
+	}
+
+	// The hash is not recomputed when the modification time and size
+	// are unchanged.
+	writeFileHashTest(t, path, "ccc", time.Unix(2, 0))
+	*now = now.Add(fileHashRecheck)
+	if h, _ := c.hash(path); h != h2 {
+		t.Errorf("hash recomputed for file with same modification time and size")
+	}
+
+	c.flush()
+	if h, _ := c.hash(path); h == h2 {
+		t.Errorf("hash not recomputed after flush")
+	}
+}
+
+func TestFileHashMissing(t *testing.T) {
+	c, now, dir := newFileHashTest(t, 10)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "missing.js")
+
+	if _, err := c.hash(path); !os.IsNotExist(err) {
+		t.Fatalf("hash of missing file returned %v, want not exist error", err)
+	}
+
+	// The missing file is remembered for missingFileTTL.
+	writeFileHashTest(t, path, "x", time.Unix(1, 0))
+	*now = now.Add(missingFileTTL - time.Second)
+	if _, err := c.hash(path); !os.IsNotExist(err) {
+		t.Errorf("hash before TTL returned %v, want not exist error", err)
+	}
+	*now = now.Add(time.Second)
+	if h, err := c.hash(path); err != nil || h == "" {
+		t.Errorf("hash after TTL returned %q, %v, want hash", h, err)
+	}
+
+	// Errors other than a missing file are not cached.
+	if _, err := c.hash(dir); err == nil || os.IsNotExist(err) {
+		t.Errorf("hash of directory returned %v, want read error", err)
+	}
+	if _, ok := c.hashes[dir]; ok {
+		t.Errorf("read error cached")
+	}
+}
+
+func TestFileHashEvict(t *testing.T) {
+	c, _, dir := newFileHashTest(t, 3)
+	defer os.RemoveAll(dir)
+
+	path := func(i int) string { return filepath.Join(dir, strconv.Itoa(i)) }
+	for i := 0; i < 5; i++ {
+		writeFileHashTest(t, path(i), strconv.Itoa(i), time.Unix(1, 0))
+	}
+	for _, i := range []int{0, 1, 2, 0, 3, 4} {
+		if _, err := c.hash(path(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.hashes) != 3 || c.lru.Len() != 3 {
+		t.Fatalf("cache has %d hashes and %d list entries, want 3", len(c.hashes), c.lru.Len())
+	}
+	for i, want := range []bool{true, false, false, true, true} {
+		if _, ok := c.hashes[path(i)]; ok != want {
+			t.Errorf("file %d cached = %v, want %v", i, ok, want)
+		}
+	}
+
+	// Junk paths do not grow the cache beyond the cap.
+	for i := 10; i < 100; i++ {
+		c.hash(path(i))
+	}
+	if len(c.hashes) != 3 {
+		t.Errorf("cache has %d hashes after junk paths, want 3", len(c.hashes))
+	}
+}
+
+func TestFileHashZeroMax(t *testing.T) {
+	c, _, dir := newFileHashTest(t, 0)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name)
+		writeFileHashTest(t, path, name, time.Unix(1, 0))
+		if _, err := c.hash(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.lru.Len() != 1 {
+		t.Errorf("lru has %d entries, want 1", c.lru.Len())
+	}
+}
+
+func TestFileHashEvictFraction(t *testing.T) {
+	c, _, dir := newFileHashTest(t, 10)
+	defer os.RemoveAll(dir)
+
+	path := func(i int) string { return filepath.Join(dir, strconv.Itoa(i)) }
+	for i := 0; i < 4; i++ {
+		writeFileHashTest(t, path(i), strconv.Itoa(i), time.Unix(1, 0))
+		if _, err := c.hash(path(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, size := c.Usage(); n != 4 || size != fileHashOverhead+len(path(3))+32 {
+		t.Errorf("Usage() = %d, %d, want 4, %d", n, size, fileHashOverhead+len(path(3))+32)
+	}
+	// The least recently used hashes are evicted.
+	if n := c.Evict(0.5); n != 2 {
+		t.Errorf("Evict(0.5) = %d, want 2", n)
+	}
+	for i, want := range []bool{false, false, true, true} {
+		if _, ok := c.hashes[path(i)]; ok != want {
+			t.Errorf("file %d cached = %v, want %v", i, ok, want)
+		}
+	}
+	if c.lru.Len() != 2 {
+		t.Errorf("lru has %d entries, want 2", c.lru.Len())
+	}
+}
+
+func TestFlushFileHashesAdmin(t *testing.T) {
+	err := serveFlushFileHashes(&testResponse{}, &web.Request{})
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+		t.Errorf("flush without admin cookie returned %v, want not found", err)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// declHTML returns the HTML for the declaration and comment of the exported
+// identifier with the given anchor. The HTML matches the corresponding
+// section of the package page.
+func declHTML(pdoc *doc.Package, anchor string) ([]byte, bool) {
+	var buf bytes.Buffer
+	write := func(pre string, decl doc.Code, typ *doc.Type, comment string) {
+		buf.WriteString(pre)
+		buf.WriteString(string(codeFn(decl, typ)))
+		buf.WriteString("</pre>")
+		buf.WriteString(string(commentFn(comment)))
+	}
+	for _, f := range pdoc.Funcs {
+		if doc.AnchorID(doc.DeclAnchor, f.Name) == anchor {
+			write("<pre>", f.Decl, nil, f.Doc)
+			return buf.Bytes(), true
+		}
+	}
+	for _, t := range pdoc.Types {
+		if doc.AnchorID(doc.DeclAnchor, t.Name) == anchor {
+			write(`<pre class="pre-x-scrollable">`, t.Decl, t, t.Doc)
+			return buf.Bytes(), true
+		}
+		for _, f := range t.Funcs {
+			if doc.AnchorID(doc.DeclAnchor, f.Name) == anchor {
+				write("<pre>", f.Decl, nil, f.Doc)
+				return buf.Bytes(), true
+			}
+		}
+		for _, f := range t.Methods {
+			if doc.AnchorID(doc.DeclAnchor, t.Name, f.Name) == anchor {
+				write("<pre>", f.Decl, nil, f.Doc)
+				return buf.Bytes(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+var hrefPat = regexp.MustCompile(`href="([^"]*)"`)
+
+// absoluteLinks rewrites site relative links and page fragment links in p to
+// absolute URLs. The base URL is the site root and importPath is the page
+// containing the fragment links.
+func absoluteLinks(p []byte, base string, importPath string) []byte {
+	return replaceAll(p, hrefPat, func(out, src []byte, m []int) []byte {
+		href := src[m[2]:m[3]]
+		out = append(out, src[m[0]:m[2]]...)
+		switch {
+		case bytes.HasPrefix(href, []byte("/")):
+			out = append(out, base...)
+		case bytes.HasPrefix(href, []byte("#")):
+			out = append(out, base...)
+			out = append(out, escapePath(sitePath("/"+importPath))...)
+		}
+		out = append(out, href...)
+		return append(out, src[m[3]:m[1]]...)
+	})
+}
+
+// fragmentHTML returns the embeddable fragment for the declaration with the
+// given anchor. The links in the fragment are relative to the site; use
+// absoluteLinks to make them absolute for the host of a request.
+func fragmentHTML(pdoc *doc.Package, anchor string) ([]byte, bool) {
+	p, ok := declHTML(pdoc, anchor)
+	if !ok {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	buf.WriteString(string(htmlCommentFn(strings.Replace(
+		pdoc.ImportPath+" fetched "+pdoc.Updated.UTC().Format(time.RFC3339), "--", "", -1))))
+	buf.WriteString("\n<div class=\"godoc-decl\">")
+	buf.Write(p)
+	buf.WriteString("</div>\n")
+	return buf.Bytes(), true
+}
+
+// maxFragmentCacheSize is the maximum number of packages with cached
+// fragments.
+const maxFragmentCacheSize = 1000
+
+type fragmentCacheEntry struct {
+	version   string
+	fragments map[string][]byte
+}
+
+type fragmentCacheMap struct {
+	sync.Mutex
+	m map[string]*fragmentCacheEntry
+}
+
+var fragmentCache = fragmentCacheMap{m: make(map[string]*fragmentCacheEntry)}
+
+// Usage returns the number of packages with cached fragments and the
+// approximate size of the fragments of a package.
+func (c *fragmentCacheMap) Usage() (int, int) {
+	c.Lock()
+	defer c.Unlock()
+	for path, e := range c.m {
+		size := len(path) + len(e.version)
+		for anchor, p := range e.fragments {
+			size += len(anchor) + len(p)
+		}
+		return len(c.m), size
+	}
+	return 0, 0
+}
+
+// Evict removes the fragments of the given fraction of the packages.
+func (c *fragmentCacheMap) Evict(fraction float64) int {
+	c.Lock()
+	defer c.Unlock()
+	n := int(math.Ceil(fraction * float64(len(c.m))))
+	evicted := 0
+	for path := range c.m {
+		if evicted >= n {
+			break
+		}
+		delete(c.m, path)
+		evicted++
+	}
+	return evicted
+}
+
+// fragmentVersion returns the cache version for a package document.
+func fragmentVersion(pdoc *doc.Package) string {
+	return pdoc.Etag + " " + pdoc.Updated.String()
+}
+
+// getFragment returns the cached fragment for the given package and anchor.
+func getFragment(pdoc *doc.Package, anchor string) ([]byte, bool) {
+	fragmentCache.Lock()
+	defer fragmentCache.Unlock()
+	e := fragmentCache.m[pdoc.ImportPath]
+	if e == nil || e.version != fragmentVersion(pdoc) {
+		return nil, false
+	}
+	p, ok := e.fragments[anchor]
+	return p, ok
+}
+
+// putFragment adds a fragment to the cache.
+func putFragment(pdoc *doc.Package, anchor string, p []byte) {
+	fragmentCache.Lock()
+	defer fragmentCache.Unlock()
+	version := fragmentVersion(pdoc)
+	e := fragmentCache.m[pdoc.ImportPath]
+	if e == nil || e.version != version {
+		if len(fragmentCache.m) >= maxFragmentCacheSize {
+			fragmentCache.m = make(map[string]*fragmentCacheEntry)
+		}
+		e = &fragmentCacheEntry{version: version, fragments: make(map[string][]byte)}
+		fragmentCache.m[pdoc.ImportPath] = e
+	}
+	e.fragments[anchor] = p
+}
+
+// invalidateFragments removes the cached fragments for a package.
+func invalidateFragments(importPath string) {
+	fragmentCache.Lock()
+	delete(fragmentCache.m, importPath)
+	fragmentCache.Unlock()
+}
+
+func serveAPIDeclHTML(resp web.Response, req *web.Request) error {
+	return servePackageAPI(resp, req, func(pdoc *doc.Package) (web.Header, []byte, error) {
+		anchor, ok := doc.ResolveScopedAnchor(pdoc, req.Form.Get("type"), req.Form.Get("anchor"))
+		if !ok {
+			return nil, nil, nil
+		}
+		// The cached fragment has site relative links. The links are made
+		// absolute for each request because the site is served on more
+		// than one host.
+		p, ok := getFragment(pdoc, anchor)
+		if !ok {
+			p, ok = fragmentHTML(pdoc, anchor)
+			if !ok {
+				return nil, nil, nil
+			}
+			putFragment(pdoc, anchor, p)
+		}
+		u := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}
+		p = absoluteLinks(p, u.String(), pdoc.ImportPath)
+		countView(pdoc, anchor)
+		return web.Header{web.HeaderContentType: {"text/html; charset=utf-8"}}, p, nil
+	})
+}
@@ -0,0 +1,174 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func fragmentTestPackage() *doc.Package {
+	newCode := func(text string, annotations ...doc.Annotation) doc.Code {
+		return doc.Code{Text: text, Annotations: annotations, Paths: []string{"io"}}
+	}
+	return &doc.Package{
+		ImportPath:  "github.com/user/repo/pkg",
+		ProjectRoot: "github.com/user/repo",
+		ProjectName: "repo",
+		Name:        "pkg",
+		Etag:        "1",
+		Updated:     time.Unix(1365000000, 0),
+		Funcs: []*doc.Func{{
+			Name: "Copy",
+			Doc:  "Copy copies src to dst. See package github.com/user/other for more.\n",
+			Decl: newCode("func Copy(dst io.Writer, src io.Reader) Buffer",
+				doc.Annotation{Kind: doc.ExportLinkAnnotation, PathIndex: 0, Pos: 14, End: 23},
+				doc.Annotation{Kind: doc.ExportLinkAnnotation, PathIndex: -1, Pos: 40, End: 46}),
+		}},
+		Types: []*doc.Type{{
+			Name: "Buffer",
+			Doc:  "Buffer is a buffer.\n",
+			Decl: newCode("type Buffer struct{}"),
+			Methods: []*doc.Func{{
+				Name: "Len",
+				Recv: "b *Buffer",
+				Doc:  "Len returns the length.\n",
+				Decl: newCode("func (b *Buffer) Len() int"),
+			}},
+		}},
+	}
+}
+
+func TestDeclHTMLMatchesPage(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+		t.Fatal(err)
+	}
+	page := resp.buf.String()
+
+	for _, anchor := range []string{"Copy", "Buffer", "Buffer.Len"} {
+		p, ok := declHTML(pdoc, anchor)
+		if !ok {
+			t.Errorf("declHTML(%q) not found", anchor)
+			continue
+		}
+		if !strings.Contains(page, string(p)) {
+			t.Errorf("declHTML(%q) = %s, not found in page", anchor, p)
+		}
+	}
+
+	if _, ok := declHTML(pdoc, "Missing"); ok {
+		t.Errorf("declHTML(Missing) found, want not found")
+	}
+}
+
+var absoluteLinksTests = []struct {
+	in, out string
+}{
+	{`<a href="/io#Reader">`, `<a href="http://godoc.org/io#Reader">`},
+	{`<a href="#Buffer">`, `<a href="http://godoc.org/github.com/user/repo/pkg#Buffer">`},
+	{`<a href="http://tools.ietf.org/html/rfc2616">`, `<a href="http://tools.ietf.org/html/rfc2616">`},
+}
+
+func TestAbsoluteLinks(t *testing.T) {
+	for _, tt := range absoluteLinksTests {
+		out := string(absoluteLinks([]byte(tt.in), "http://godoc.org", "github.com/user/repo/pkg"))
+		if out != tt.out {
+			t.Errorf("absoluteLinks(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestFragmentHTML(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	p, ok := fragmentHTML(pdoc, "Copy")
+	if !ok {
+		t.Fatal("fragmentHTML(Copy) not found")
+	}
+	s := string(absoluteLinks(p, "http://godoc.org", pdoc.ImportPath))
+	for _, want := range []string{
+		"<!-- github.com/user/repo/pkg fetched 2013-04-03T14:40:00Z -->",
+		`<div class="godoc-decl">`,
+		`href="http://godoc.org/io#Writer"`,
+		`href="http://godoc.org/github.com/user/repo/pkg#Buffer"`,
+		`href="http://godoc.org/github.com/user/other"`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("fragmentHTML(Copy) = %s, want %s", s, want)
+		}
+	}
+	if strings.Contains(s, `href="/`) || strings.Contains(s, `href="#`) {
+		t.Errorf("fragmentHTML(Copy) = %s, contains relative link", s)
+	}
+}
+
+func TestFragmentCache(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	putFragment(pdoc, "Copy", []byte("x"))
+	if p, ok := getFragment(pdoc, "Copy"); !ok || string(p) != "x" {
+		t.Errorf("getFragment() = %q, %v, want x, true", p, ok)
+	}
+
+	pdoc.Etag = "2"
+	if _, ok := getFragment(pdoc, "Copy"); ok {
+		t.Errorf("getFragment() found fragment for changed etag")
+	}
+
+	putFragment(pdoc, "Copy", []byte("x"))
+	invalidateFragments(pdoc.ImportPath)
+	if _, ok := getFragment(pdoc, "Copy"); ok {
+		t.Errorf("getFragment() found fragment after invalidate")
+	}
+}
+
+func TestServeAPIDeclHTMLHosts(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	invalidateFragments(pdoc.ImportPath)
+	defer invalidateFragments(pdoc.ImportPath)
+	defer func() { packagePages.store = nil }()
+	packagePages.store = &fakePackageStore{pdocs: map[string]*doc.Package{pdoc.ImportPath: pdoc}}
+
+	// The fragment cached for the first host is not served with the links
+	// of that host to the second host.
+	for _, host := range []string{"godoc.org", "mirror.example.com"} {
+		req := &web.Request{
+			URL:       &url.URL{Scheme: "http", Host: host},
+			Header:    web.Header{},
+			Form:      url.Values{"anchor": {"Copy"}},
+			RouteVars: map[string]string{"path": pdoc.ImportPath},
+		}
+		var resp testResponse
+		if err := serveAPIDeclHTML(&resp, req); err != nil {
+			t.Fatal(err)
+		}
+		s := resp.buf.String()
+		if want := `href="http://` + host + `/io#Writer"`; !strings.Contains(s, want) {
+			t.Errorf("%s: fragment = %s, want %s", host, s, want)
+		}
+		if other := "godoc.org"; host != other && strings.Contains(s, other) {
+			t.Errorf("%s: fragment = %s, contains links to %s", host, s, other)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the fetch gates report. The report lists the state
+// of everything that currently affects fetches of a package so that the
+// authors of the project can find out why the package is not refreshed
+// without asking an operator. The report only contains information about
+// the package; it does not show other packages, operator rules that do not
+// match the package or tokens.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// hostGate is the state of the repository host of a package.
+type hostGate struct {
+	Name         string `json:"name"`
+	State        string `json:"state"`
+	FetchAllowed bool   `json:"fetchAllowed"`
+	Message      string `json:"message,omitempty"`
+}
+
+// scheduleGate is the crawl schedule of a package.
+type scheduleGate struct {
+	LastCheck       time.Time `json:"lastCheck"`
+	LastResult      string    `json:"lastResult"`
+	NextCheck       time.Time `json:"nextCheck"`
+	IntervalSeconds int64     `json:"intervalSeconds"`
+	IntervalReason  string    `json:"intervalReason"`
+	CadenceSeconds  int64     `json:"cadenceSeconds,omitempty"`
+	CadenceExpires  time.Time `json:"cadenceExpires,omitempty"`
+}
+
+// Interval returns the check interval.
+func (s *scheduleGate) Interval() time.Duration {
+	return time.Duration(s.IntervalSeconds) * time.Second
+}
+
+// Cadence returns the requested cadence or zero if there is no cadence.
+func (s *scheduleGate) Cadence() time.Duration {
+	return time.Duration(s.CadenceSeconds) * time.Second
+}
+
+// IntervalNote explains the interval reason on the gates view.
+func (s *scheduleGate) IntervalNote() string {
+	switch s.IntervalReason {
+	case intervalGithub:
+		return "GitHub projects are also checked when they are pushed."
+	case intervalErrors:
+		return "The interval is longer because the package had errors."
+	}
+	return ""
+}
+
+// fetchGates is the report of the gates that affect fetches of a package.
+type fetchGates struct {
+	Path string   `json:"path"`
+	Host hostGate `json:"host"`
+
+	// BlockedBy is the blocklist rule that matches the package or "".
+	BlockedBy string `json:"blockedBy"`
+
+	Schedule *scheduleGate `json:"schedule"`
+}
+
+// getFetchGates assembles the fetch gates report for the package from the
+// service states, the blocklist and the schedule store. The report is read
+// only; in particular, the hit count of a matching blocklist rule is not
+// incremented.
+func getFetchGates(pdoc *doc.Package, now time.Time) (*fetchGates, error) {
+	host, state := doc.GetServiceState(pdoc.ImportPath)
+	g := &fetchGates{
+		Path: pdoc.ImportPath,
+		Host: hostGate{
+			Name:         host,
+			State:        state.String(),
+			FetchAllowed: state == doc.ServiceActive,
+			Message:      serviceMessage(pdoc.ImportPath),
+		},
+	}
+	if blocklist != nil {
+		rule, err := blocklist.BlockingRule(pdoc.ImportPath)
+		if err != nil {
+			return nil, err
+		}
+		g.BlockedBy = rule
+	}
+	if schedules.store != nil {
+		s, err := schedules.store.GetSchedule(pdoc.ImportPath, pdoc.ProjectRoot)
+		if err != nil {
+			return nil, err
+		}
+		interval, reason := packageCrawlInterval(pdoc.ImportPath, pdoc)
+		g.Schedule = &scheduleGate{
+			LastCheck:       s.LastFetch.Time,
+			LastResult:      s.LastFetch.Result,
+			NextCheck:       s.NextCrawl,
+			IntervalSeconds: int64(interval / time.Second),
+			IntervalReason:  reason,
+		}
+		if s.Cadence.Active(now) {
+			g.Schedule.CadenceSeconds = int64(s.Cadence.Interval / time.Second)
+			g.Schedule.CadenceExpires = s.Cadence.Expires
+		}
+	}
+	return g, nil
+}
+
+// loadFetchGates returns the fetch gates report for the gates view. The
+// view is not found for clients that are not authorized for the project.
+func loadFetchGates(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	if !authorizedForProject(req, pdoc.ProjectRoot) {
+		return nil, &web.Error{Status: web.StatusNotFound}
+	}
+	g, err := getFetchGates(pdoc, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"gates": g}, nil
+}
+
+// serveAPIFetchGates serves the fetch gates report of a stored package to
+// clients authorized for the project. The package is not fetched.
+func serveAPIFetchGates(resp web.Response, req *web.Request) error {
+	pdoc, _, err := db.GetDoc(req.RouteVars["path"])
+	if err != nil {
+		return err
+	}
+	if pdoc == nil || !authorizedForProject(req, pdoc.ProjectRoot) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	g, err := getFetchGates(pdoc, time.Now())
+	if err != nil {
+		return err
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(g)
+}
@@ -0,0 +1,149 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func TestFetchGates(t *testing.T) {
+	now := time.Unix(1400000000, 0).UTC()
+	pdoc := fragmentTestPackage()
+	errPdoc := fragmentTestPackage()
+	errPdoc.ImportPath = "example.com/repo/pkg"
+	errPdoc.ProjectRoot = "example.com/repo"
+	errPdoc.Errors = []string{"bad file"}
+
+	schedules := newFakeScheduleStore()
+	var calls []string
+	defer setTestSchedules(schedules, nil, &calls)()
+	schedules.results[pdoc.ImportPath] = database.FetchResult{Time: now.Add(-time.Hour), Result: "error"}
+	schedules.schedules[pdoc.ImportPath] = database.Schedule{NextCrawl: now.Add(time.Hour)}
+	schedules.cadences[pdoc.ProjectRoot] = database.Cadence{Interval: time.Hour, Expires: now.Add(24 * time.Hour)}
+	schedules.cadences[errPdoc.ProjectRoot] = database.Cadence{Interval: time.Hour, Expires: now.Add(-time.Hour)}
+
+	blocks := &fakeBlocklistStore{rules: []database.BlockRule{
+		{Kind: database.BlockPath, Rule: "example.com/repo"},
+		{Kind: database.BlockPath, Rule: "github.com/spammer"},
+		{Kind: database.BlockCIDR, Rule: "192.0.2.0/24"},
+	}}
+	defer setTestBlocklist(blocks, newRequestRing(10))()
+
+	doc.SetServiceStates(map[string]doc.ServiceState{"example.com": doc.ServiceDeprecated})
+	defer doc.SetServiceStates(nil)
+	defer func(d time.Duration) { *maxAge = d }(*maxAge)
+	*maxAge = 24 * time.Hour
+
+	g, err := getFetchGates(pdoc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Host.Name != "github.com" || g.Host.State != "active" || !g.Host.FetchAllowed {
+		t.Errorf("host = %+v, want active github.com", g.Host)
+	}
+	if g.BlockedBy != "" {
+		t.Errorf("blockedBy = %q, want not blocked", g.BlockedBy)
+	}
+	s := g.Schedule
+	if s.LastResult != "error" || !s.LastCheck.Equal(now.Add(-time.Hour)) || !s.NextCheck.Equal(now.Add(time.Hour)) {
+		t.Errorf("schedule = %+v, want last check an hour ago and next check in an hour", s)
+	}
+	if s.Interval() != 7*24*time.Hour || s.IntervalReason != intervalGithub {
+		t.Errorf("interval = %v (%s), want 7 days for GitHub", s.Interval(), s.IntervalReason)
+	}
+	if s.Cadence() != time.Hour {
+		t.Errorf("cadence = %v, want the active cadence", s.Cadence())
+	}
+
+	g, err = getFetchGates(errPdoc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Host.State != "deprecated" || g.Host.FetchAllowed || g.Host.Message == "" {
+		t.Errorf("host = %+v, want deprecated example.com", g.Host)
+	}
+	if g.BlockedBy != "example.com/repo" {
+		t.Errorf("blockedBy = %q, want example.com/repo", g.BlockedBy)
+	}
+	if s := g.Schedule; s.Interval() != 7*24*time.Hour || s.IntervalReason != intervalErrors || s.Cadence() != 0 {
+		t.Errorf("schedule = %+v, want backoff for errors and no expired cadence", s)
+	}
+
+	// The report does not include rules that do not match the package.
+	p, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"github.com/spammer", "192.0.2.0"} {
+		if strings.Contains(string(p), s) {
+			t.Errorf("report %s contains %q", p, s)
+		}
+	}
+	if len(blocks.hits) != 0 {
+		t.Errorf("report counted hits %v", blocks.hits)
+	}
+}
+
+func TestFetchGatesView(t *testing.T) {
+	parseTestTemplates(t)
+	const authorKey = "0123456789abcdef0123456789abcdef"
+	const otherKey = "fedcba9876543210fedcba9876543210"
+	defer setTestAPITokens(map[string]database.APIToken{
+		authorKey: {Label: "author", Tier: anonymousTier, Roots: []string{"github.com/user/repo"}},
+		otherKey:  {Label: "author", Tier: anonymousTier, Roots: []string{"github.com/user/other"}},
+	})()
+	schedules := newFakeScheduleStore()
+	var calls []string
+	defer setTestSchedules(schedules, nil, &calls)()
+	defer setTestBlocklist(&fakeBlocklistStore{rules: []database.BlockRule{{Kind: database.BlockPath, Rule: "github.com/user/repo"}}}, newRequestRing(10))()
+	pdoc := fragmentTestPackage()
+
+	for _, tt := range []struct {
+		name   string
+		cookie url.Values
+		ok     bool
+	}{
+		{"anonymous", nil, false},
+		{"other project", url.Values{authorCookie: {otherKey}}, false},
+		{"author", url.Values{authorCookie: {authorKey}}, true},
+	} {
+		var resp testResponse
+		req := &web.Request{Form: url.Values{"view": {"gates"}}, Cookie: tt.cookie, Header: web.Header{}}
+		err := serveView(&resp, req, viewsByName["gates"], pdoc)
+		if !tt.ok {
+			if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+				t.Errorf("%s: gates view returned %v, want not found", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: gates view returned %v", tt.name, err)
+		}
+		body := resp.buf.String()
+		for _, s := range []string{"blocked by the rule <code>github.com/user/repo</code>", "GitHub projects are also checked", "/-/api/gates/github.com/user/repo/pkg"} {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: gates view does not contain %q", tt.name, s)
+			}
+		}
+	}
+}
@@ -70,6 +70,7 @@ func crawlGithubUpdates(interval time.Duration) {
 	defer log.Println("ERROR, exiting github update scraper")
 
 	const key = "ghupdates"
+	lease := newCrawlLease(key, interval)
 	sleep := false
 	for {
 		if sleep {
@@ -77,6 +78,10 @@ func crawlGithubUpdates(interval time.Duration) {
 		}
 		sleep = true
 
+		if lease != nil && !lease.held() {
+			continue
+		}
+
 		updates, err := readGithubUpdates()
 		if err != nil {
 			log.Println("ERROR github crawl:", err)
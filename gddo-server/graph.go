@@ -16,31 +16,166 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os/exec"
+	"sort"
 	"strings"
 
 	"github.com/garyburd/gddo/database"
 	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
 )
 
-func renderGraph(pdoc *doc.Package, pkgs []database.Package, edges [][2]int) ([]byte, error) {
-	var in, out bytes.Buffer
+// importGraph is the dependency graph of a package with the import cycles
+// and the dependencies that are not in the database.
+type importGraph struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges [][2]int    `json:"edges"`
 
-	fmt.Fprintf(&in, "digraph %s { \n", pdoc.Name)
+	// Cycles is the list of import cycles. Each cycle is the list of the
+	// paths of the packages in a strongly connected component of the graph.
+	Cycles [][]string `json:"cycles,omitempty"`
+
+	// Unindexed is the list of the paths of the dependencies that are not in
+	// the database.
+	Unindexed []string `json:"unindexed,omitempty"`
+}
+
+type graphNode struct {
+	Path     string `json:"path"`
+	Synopsis string `json:"synopsis,omitempty"`
+
+	// Cycle is the index of the node's cycle in importGraph.Cycles or -1 if
+	// the node is not in a cycle.
+	Cycle int `json:"cycle"`
+
+	Unindexed bool `json:"unindexed,omitempty"`
+}
+
+// newImportGraph analyzes the graph returned by database ImportGraph.
+func newImportGraph(pkgs []database.Package, edges [][2]int, unindexed []int) *importGraph {
+	g := &importGraph{Nodes: make([]graphNode, len(pkgs)), Edges: edges}
 	for i, pkg := range pkgs {
-		fmt.Fprintf(&in, " n%d [label=\"%s\", URL=\"/%s\", tooltip=\"%s\"];\n",
-			i, pkg.Path, pkg.Path,
-			strings.Replace(pkg.Synopsis, `"`, `\"`, -1))
+		g.Nodes[i] = graphNode{Path: pkg.Path, Synopsis: pkg.Synopsis, Cycle: -1}
+	}
+	for _, i := range unindexed {
+		g.Nodes[i].Unindexed = true
+		g.Unindexed = append(g.Unindexed, pkgs[i].Path)
 	}
-	for _, edge := range edges {
-		fmt.Fprintf(&in, " n%d -> n%d;\n", edge[0], edge[1])
+	for _, scc := range graphCycles(len(pkgs), edges) {
+		var paths []string
+		for _, i := range scc {
+			g.Nodes[i].Cycle = len(g.Cycles)
+			paths = append(paths, pkgs[i].Path)
+		}
+		sort.Strings(paths)
+		g.Cycles = append(g.Cycles, paths)
+	}
+	return g
+}
+
+// graphCycles returns the strongly connected components of the graph with
+// more than one node or with a self edge. The components are found with
+// Tarjan's algorithm.
+func graphCycles(n int, edges [][2]int) [][]int {
+	adj := make([][]int, n)
+	self := make([]bool, n)
+	for _, e := range edges {
+		adj[e[0]] = append(adj[e[0]], e[1])
+		if e[0] == e[1] {
+			self[e[0]] = true
+		}
+	}
+
+	var (
+		index   = make([]int, n) // visit order + 1, 0 if not visited
+		low     = make([]int, n)
+		onStack = make([]bool, n)
+		stack   []int
+		next    = 1
+		result  [][]int
+		visit   func(v int)
+	)
+	visit = func(v int) {
+		index[v] = next
+		low[v] = next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range adj[v] {
+			if index[w] == 0 {
+				visit(w)
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			} else if onStack[w] && index[w] < low[v] {
+				low[v] = index[w]
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		var scc []int
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+		if len(scc) > 1 || self[v] {
+			sort.Ints(scc)
+			result = append(result, scc)
+		}
+	}
+	for v := 0; v < n; v++ {
+		if index[v] == 0 {
+			visit(v)
+		}
+	}
+	return result
+}
+
+// graphDOT returns the graph in the DOT language. Import cycles are drawn
+// in red and dependencies not in the database are drawn with dashed lines.
+func graphDOT(name string, g *importGraph) []byte {
+	var in bytes.Buffer
+	fmt.Fprintf(&in, "digraph %s { \n", name)
+	for i, node := range g.Nodes {
+		tooltip := node.Synopsis
+		attrs := ""
+		if node.Cycle >= 0 {
+			attrs += `, color="red", fontcolor="red"`
+			tooltip = "Import cycle: " + strings.Join(g.Cycles[node.Cycle], ", ")
+		}
+		if node.Unindexed {
+			attrs += `, style="dashed", fontcolor="gray"`
+			tooltip = "Not indexed"
+		}
+		fmt.Fprintf(&in, " n%d [label=\"%s\", URL=\"%s\", tooltip=\"%s\"%s];\n",
+			i, node.Path, sitePath("/"+node.Path),
+			strings.Replace(tooltip, `"`, `\"`, -1), attrs)
+	}
+	for _, edge := range g.Edges {
+		from, to := g.Nodes[edge[0]], g.Nodes[edge[1]]
+		if from.Cycle >= 0 && from.Cycle == to.Cycle {
+			fmt.Fprintf(&in, " n%d -> n%d [color=\"red\"];\n", edge[0], edge[1])
+		} else {
+			fmt.Fprintf(&in, " n%d -> n%d;\n", edge[0], edge[1])
+		}
 	}
 	in.WriteString("}")
+	return in.Bytes()
+}
 
+func renderGraph(pdoc *doc.Package, g *importGraph) ([]byte, error) {
+	var out bytes.Buffer
 	cmd := exec.Command("dot", "-Tsvg")
-	cmd.Stdin = &in
+	cmd.Stdin = bytes.NewReader(graphDOT(pdoc.Name, g))
 	cmd.Stdout = &out
 	if err := cmd.Run(); err != nil {
 		return nil, err
@@ -54,3 +189,65 @@ func renderGraph(pdoc *doc.Package, pkgs []database.Package, edges [][2]int) ([]
 	}
 	return p, nil
 }
+
+func getImportGraph(pdoc *doc.Package, hideStdDeps bool) (*importGraph, error) {
+	pkgs, edges, unindexed, err := db.ImportGraph(pdoc, hideStdDeps)
+	if err != nil {
+		return nil, err
+	}
+	return newImportGraph(pkgs, edges, unindexed), nil
+}
+
+// serveAPIGraph serves the dependency graph of a package as JSON. The graph
+// depends on the other packages in the database, so the response is not
+// conditional on the package ETag.
+func serveAPIGraph(resp web.Response, req *web.Request) error {
+	pdoc, _, err := getDoc(req.RouteVars["path"], queryRequest)
+	if err != nil {
+		return err
+	}
+	if pdoc == nil || pdoc.Name == "" {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	g, err := getImportGraph(pdoc, req.Form.Get("hide") == "1")
+	if err != nil {
+		return err
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(g)
+}
+
+// serveQueueGraph adds the dependencies of a package that are not in the
+// database to the crawler's queue of new packages.
+func serveQueueGraph(resp web.Response, req *web.Request) error {
+	if err := checkAdminPost(req); err != nil {
+		return err
+	}
+	importPath := req.Form.Get("path")
+	pdoc, _, _, err := db.Get(importPath)
+	if err != nil {
+		return err
+	}
+	if pdoc == nil || pdoc.Name == "" {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	hide := req.Form.Get("hide") == "1"
+	g, err := getImportGraph(pdoc, hide)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, p := range g.Unindexed {
+		if doc.IsValidPath(p) {
+			paths = append(paths, p)
+		}
+	}
+	if err := db.QueueNewCrawl(paths); err != nil {
+		return err
+	}
+	u := sitePath("/"+importPath) + "?view=import-graph"
+	if hide {
+		u += "&hide=1"
+	}
+	return web.Redirect(resp, req, u, 302, nil)
+}
@@ -0,0 +1,128 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+)
+
+var graphCyclesTests = []struct {
+	n      int
+	edges  [][2]int
+	cycles [][]int
+}{
+	{3, [][2]int{{0, 1}, {1, 2}}, nil},
+	{3, [][2]int{{0, 1}, {1, 2}, {2, 1}}, [][]int{{1, 2}}},
+	{4, [][2]int{{0, 1}, {1, 2}, {2, 0}, {2, 3}, {3, 3}}, [][]int{{3}, {0, 1, 2}}},
+	{5, [][2]int{{0, 1}, {1, 0}, {2, 3}, {3, 4}, {4, 2}}, [][]int{{0, 1}, {2, 3, 4}}},
+}
+
+func TestGraphCycles(t *testing.T) {
+	for _, tt := range graphCyclesTests {
+		if cycles := graphCycles(tt.n, tt.edges); !reflect.DeepEqual(cycles, tt.cycles) {
+			t.Errorf("graphCycles(%d, %v) = %v, want %v", tt.n, tt.edges, cycles, tt.cycles)
+		}
+	}
+}
+
+// graphTestFixture returns a graph where example.com/a and example.com/b
+// import each other and three leaves are not indexed.
+func graphTestFixture() *importGraph {
+	pkgs := []database.Package{
+		{Path: "example.com/app", Synopsis: "Package app."},
+		{Path: "example.com/a", Synopsis: "Package a."},
+		{Path: "example.com/b", Synopsis: "Package b."},
+		{Path: "example.com/x"},
+		{Path: "example.com/y"},
+		{Path: "example.com/z"},
+	}
+	edges := [][2]int{{0, 1}, {1, 2}, {2, 1}, {1, 3}, {2, 4}, {0, 5}}
+	return newImportGraph(pkgs, edges, []int{3, 4, 5})
+}
+
+func TestNewImportGraph(t *testing.T) {
+	g := graphTestFixture()
+	if want := [][]string{{"example.com/a", "example.com/b"}}; !reflect.DeepEqual(g.Cycles, want) {
+		t.Errorf("cycles = %v, want %v", g.Cycles, want)
+	}
+	if want := []string{"example.com/x", "example.com/y", "example.com/z"}; !reflect.DeepEqual(g.Unindexed, want) {
+		t.Errorf("unindexed = %v, want %v", g.Unindexed, want)
+	}
+	for i, node := range g.Nodes {
+		wantCycle := -1
+		if i == 1 || i == 2 {
+			wantCycle = 0
+		}
+		if node.Cycle != wantCycle || node.Unindexed != (i >= 3) {
+			t.Errorf("node %s has cycle %d, unindexed %v", node.Path, node.Cycle, node.Unindexed)
+		}
+	}
+
+	p, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), `"cycles":[["example.com/a","example.com/b"]]`) {
+		t.Errorf("JSON %s does not contain cycles", p)
+	}
+}
+
+func TestGraphDOT(t *testing.T) {
+	dot := string(graphDOT("app", graphTestFixture()))
+	for _, s := range []string{
+		` n1 -> n2 [color="red"];`,
+		` n2 -> n1 [color="red"];`,
+		` n0 -> n1;`,
+		` n1 -> n3;`,
+		`tooltip="Import cycle: example.com/a, example.com/b", color="red"`,
+		` n5 [label="example.com/z", URL="/example.com/z", tooltip="Not indexed", style="dashed"`,
+	} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("DOT does not contain %s\n%s", s, dot)
+		}
+	}
+}
+
+func TestGraphTemplate(t *testing.T) {
+	parseTestTemplates(t)
+	pdoc := &doc.Package{ImportPath: "example.com/app", ProjectRoot: "example.com/app", Name: "app"}
+	for _, canQueue := range []bool{false, true} {
+		var resp testResponse
+		err := executeTemplate(&resp, nil, "graph.html", 200, nil, map[string]interface{}{
+			"pdoc":     pdoc,
+			"graph":    graphTestFixture(),
+			"canQueue": canQueue,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := resp.buf.String()
+		if !strings.Contains(page, `Import cycle: <a href="/example.com/a">example.com/a</a>, <a href="/example.com/b">example.com/b</a>`) {
+			t.Errorf("canQueue=%v: page does not list the import cycle", canQueue)
+		}
+		if strings.Contains(page, "3 dependencies not yet indexed &mdash; click to queue them") != canQueue {
+			t.Errorf("canQueue=%v: unexpected queue button", canQueue)
+		}
+		if !strings.Contains(page, "3 dependencies not yet indexed") {
+			t.Errorf("canQueue=%v: page does not count unindexed dependencies", canQueue)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the status of the implements: search queries. The
+// status is published as an expvar and the stored method sets are reported
+// with the storage on the memory status.
+
+package main
+
+import (
+	"expvar"
+
+	"github.com/garyburd/gddo/database"
+)
+
+// methodSetStore reports the stored method sets and the implements:
+// queries. The database implements the interface.
+type methodSetStore interface {
+	MethodSetStats() (database.MethodSetStats, error)
+}
+
+// methodSets is set in main.
+var methodSets methodSetStore
+
+func init() {
+	expvar.Publish("implements", expvar.Func(implementsStatus))
+}
+
+func implementsStatus() interface{} {
+	if methodSets == nil {
+		return nil
+	}
+	stats, err := methodSets.MethodSetStats()
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+	return stats
+}
+
+// methodSetStorage adapts the stored method sets to the accountant.
+type methodSetStorage struct {
+	store methodSetStore
+}
+
+func (s methodSetStorage) StorageUsage() (int, int64, error) {
+	stats, err := s.store.MethodSetStats()
+	return stats.Packages, stats.Bytes, err
+}
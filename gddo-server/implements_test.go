@@ -0,0 +1,73 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+func TestImplementationLinks(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"results.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pkgs := []database.Package{
+		{Path: "github.com/user/stream", Synopsis: "Package stream reads streams.", Implementations: []string{"File", "Pipe"}},
+		{Path: "github.com/user/body", Synopsis: "Package body reads bodies.", Implementations: []string{"Body"}},
+	}
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "results.html", web.StatusOK, nil, map[string]interface{}{"q": "implements:io.Reader", "pkgs": pkgs, "results": searchResults(nil, pkgs)}); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	for _, want := range []string{
+		`Implemented by <a href="/github.com/user/stream#File">File</a>, <a href="/github.com/user/stream#Pipe">Pipe</a>`,
+		`Implemented by <a href="/github.com/user/body#Body">Body</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("results do not contain %s", want)
+		}
+	}
+}
+
+type fakeMethodSetStore struct {
+	stats database.MethodSetStats
+	err   error
+}
+
+func (s fakeMethodSetStore) MethodSetStats() (database.MethodSetStats, error) { return s.stats, s.err }
+
+func TestImplementsStatus(t *testing.T) {
+	defer func(s methodSetStore) { methodSets = s }(methodSets)
+
+	methodSets = fakeMethodSetStore{stats: database.MethodSetStats{Packages: 2, Bytes: 300, Queries: 4}}
+	if stats, ok := implementsStatus().(database.MethodSetStats); !ok || stats.Queries != 4 {
+		t.Errorf("implementsStatus() = %v, want the store stats", implementsStatus())
+	}
+	items, size, err := methodSetStorage{methodSets}.StorageUsage()
+	if items != 2 || size != 300 || err != nil {
+		t.Errorf("StorageUsage() = %d, %d, %v, want 2, 300, nil", items, size, err)
+	}
+
+	methodSets = fakeMethodSetStore{err: errors.New("down")}
+	if status, ok := implementsStatus().(map[string]string); !ok || status["error"] != "down" {
+		t.Errorf("implementsStatus() = %v, want the error", implementsStatus())
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/indigo/web"
+)
+
+// indexETag returns the ETag of the plain text index. The ETag changes when
+// a package is stored or deleted and when the redirect rules change.
+func indexETag(changes int64) string {
+	return quoteETag("index-" + strconv.FormatInt(changes, 10) + redirectsETag())
+}
+
+// serveTextIndex serves the import paths of the packages in the index, one
+// per line. The prefix parameter restricts the list to an import path and
+// the packages below it. The modified_since parameter restricts the list to
+// packages fetched at or after an RFC 3339 time.
+func serveTextIndex(resp web.Response, req *web.Request) error {
+	var since time.Time
+	if s := req.Form.Get("modified_since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return &web.Error{Status: web.StatusBadRequest, Reason: err}
+		}
+	}
+
+	changes, err := db.IndexChanges()
+	if err != nil {
+		return err
+	}
+	etag := indexETag(changes)
+	header := web.Header{
+		web.HeaderCacheControl: {"public, max-age=300"},
+		web.HeaderETag:         {etag},
+	}
+	if etagMatches(req.Header.Get(web.HeaderIfNoneMatch), etag) {
+		resp.Start(web.StatusNotModified, header)
+		return nil
+	}
+	header.Set(web.HeaderContentType, "text/plain; charset=utf-8")
+
+	// The response is started with the first path so that a database error
+	// is reported with an error status.
+	var w *bufio.Writer
+	rs := currentRedirectRules()
+	err = db.IndexPaths(req.Form.Get("prefix"), since, func(path string) error {
+		// Redirected paths are not listed.
+		if _, ok := rs.rewrite(path); ok {
+			return nil
+		}
+		if w == nil {
+			w = bufio.NewWriter(resp.Start(web.StatusOK, header))
+		}
+		_, err := io.WriteString(w, path+"\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		resp.Start(web.StatusOK, header)
+		return nil
+	}
+	return w.Flush()
+}
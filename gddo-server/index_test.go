@@ -0,0 +1,39 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/garyburd/indigo/web"
+)
+
+func TestIndexETag(t *testing.T) {
+	if indexETag(1) == indexETag(2) {
+		t.Errorf("indexETag does not change with the change counter")
+	}
+	if etag := indexETag(3); !etagMatches(etag, etag) {
+		t.Errorf("etagMatches(%q, %q) = false, want true", etag, etag)
+	}
+}
+
+func TestTextIndexBadModifiedSince(t *testing.T) {
+	req := &web.Request{Form: url.Values{"modified_since": {"yesterday"}}}
+	err := serveTextIndex(&testResponse{}, req)
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusBadRequest {
+		t.Errorf("serveTextIndex with bad modified_since returned %v, want bad request", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the jump to identifier endpoint used by the "Go to
+// export" box of the package page. The box jumps directly to identifiers on
+// the page. Other text is sent to the endpoint, which finds the identifiers
+// that start with the text.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// jumpStore is the subset of the database used to find identifiers.
+type jumpStore interface {
+	GetDoc(path string) (*doc.Package, time.Time, error)
+}
+
+// jumpDocs is the store of the packages. The store is set in main.
+var jumpDocs struct {
+	store jumpStore
+}
+
+// jumpMatches returns the identifiers in the package for the query q. An
+// identifier equal to q is the only match. Otherwise, the identifiers
+// that start with q ignoring case are returned. The method name alone
+// matches a method, so that "len" matches "Buffer.Len".
+func jumpMatches(pdoc *doc.Package, q string) []*doc.Identifier {
+	lq := strings.ToLower(q)
+	var matches []*doc.Identifier
+	for _, id := range doc.Identifiers(pdoc) {
+		if id.Name == q {
+			return []*doc.Identifier{id}
+		}
+		name := strings.ToLower(id.Name)
+		method := ""
+		if i := strings.LastIndex(name, "."); id.Kind == "method" && i >= 0 {
+			method = name[i+1:]
+		}
+		if strings.HasPrefix(name, lq) || (method != "" && strings.HasPrefix(method, lq)) {
+			matches = append(matches, id)
+		}
+	}
+	return matches
+}
+
+// serveJump redirects to the declaration of the identifier named by the q
+// parameter in the package named by the path parameter. A page listing the
+// identifiers is shown when more than one identifier matches.
+func serveJump(resp web.Response, req *web.Request) error {
+	path := req.Form.Get("path")
+	q := strings.TrimSpace(req.Form.Get("q"))
+	if !doc.IsValidPath(path) || q == "" {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	if jumpDocs.store == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	pdoc, _, err := jumpDocs.store.GetDoc(path)
+	if err != nil {
+		return err
+	}
+	if pdoc == nil || pdoc.Name == "" {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	repairStoredDoc(pdoc)
+	matches := jumpMatches(pdoc, q)
+	switch len(matches) {
+	case 0:
+		return executeTemplate(resp, req, "notfound"+templateExt(req), web.StatusNotFound, nil, map[string]interface{}{
+			"message": "No exported identifier in " + path + " starts with " + q + ".",
+		})
+	case 1:
+		return web.Redirect(resp, req, sitePath("/"+path)+"#"+matches[0].Anchor, 302, nil)
+	}
+	return executeTemplate(resp, req, "jump.html", web.StatusOK, nil, map[string]interface{}{
+		"pdoc":    pdoc,
+		"q":       q,
+		"matches": matches,
+	})
+}
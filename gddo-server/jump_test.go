@@ -0,0 +1,125 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// jumpTestPackage has a type with methods and a package function that start
+// with the same letters.
+func jumpTestPackage() *doc.Package {
+	return &doc.Package{
+		ImportPath: "github.com/user/repo/bytes",
+		Name:       "bytes",
+		Funcs: []*doc.Func{
+			{Name: "Compare", Doc: "Compare compares two byte slices."},
+			{Name: "Contains", Doc: "Contains reports whether b is within s."},
+		},
+		Types: []*doc.Type{{
+			Name: "Buffer",
+			Doc:  "A Buffer is a variable-sized buffer of bytes.",
+			Methods: []*doc.Func{
+				{Name: "Cap", Recv: "*Buffer", Doc: "Cap returns the capacity of the buffer."},
+				{Name: "Len", Recv: "*Buffer", Doc: "Len returns the number of unread bytes."},
+			},
+		}},
+	}
+}
+
+func TestJumpMatches(t *testing.T) {
+	pdoc := jumpTestPackage()
+	for _, tt := range []struct {
+		q    string
+		want string
+	}{
+		{"Compare", "Compare"},
+		{"compare", "Compare"},
+		{"co", "Compare Contains"},
+		{"Buffer", "Buffer"},
+		{"buf", "Buffer Buffer.Cap Buffer.Len"},
+		{"buffer.l", "Buffer.Len"},
+		{"len", "Buffer.Len"},
+		{"C", "Compare Contains Buffer.Cap"},
+		{"Reader", ""},
+	} {
+		var names []string
+		for _, id := range jumpMatches(pdoc, tt.q) {
+			names = append(names, id.Name)
+		}
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("jumpMatches(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+type fakeJumpStore map[string]*doc.Package
+
+func (s fakeJumpStore) GetDoc(path string) (*doc.Package, time.Time, error) {
+	return s[path], time.Time{}, nil
+}
+
+func TestServeJump(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"jump.html", "common.html", "layout.html"},
+		{"notfound.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := jumpTestPackage()
+	defer func(s jumpStore) { jumpDocs.store = s }(jumpDocs.store)
+	jumpDocs.store = fakeJumpStore{pdoc.ImportPath: pdoc}
+
+	var resp testResponse
+	req := &web.Request{Form: url.Values{"path": {pdoc.ImportPath}, "q": {"co"}}, Header: web.Header{}}
+	if err := serveJump(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	for _, s := range []string{
+		`<a href="/github.com/user/repo/bytes#Compare">Compare</a></td><td>func</td><td>Compare compares two byte slices.</td>`,
+		`<a href="/github.com/user/repo/bytes#Contains">Contains</a>`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("jump page does not contain %q", s)
+		}
+	}
+
+	resp = testResponse{}
+	req = &web.Request{Form: url.Values{"path": {pdoc.ImportPath}, "q": {"Reader"}}, Header: web.Header{}}
+	if err := serveJump(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != web.StatusNotFound || !strings.Contains(resp.buf.String(), "starts with Reader") {
+		t.Errorf("serveJump(Reader) status = %d, want not found with message", resp.status)
+	}
+
+	for _, form := range []url.Values{
+		{"path": {pdoc.ImportPath}},
+		{"path": {"github.com/user/other"}, "q": {"co"}},
+	} {
+		err := serveJump(&testResponse{}, &web.Request{Form: form, Header: web.Header{}})
+		if _, ok := err.(*web.Error); !ok {
+			t.Errorf("serveJump(%v) returned %v, want error status", form, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file serves the landing page of a project root. The page combines
+// the README of the root directory, the packages in the project, the
+// project activity and the documentation of the root package. The rendered
+// page is cached by a version computed from the number of packages in the
+// project, the latest fetch of a package, the README and the activity. A
+// refresh of any package in the project changes the version, so the cache
+// is correct across servers without coordination. The crawler also drops
+// the cached page when it stores a package so that the memory is released
+// early.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// maxLandingCacheSize is the maximum number of projects with a cached
+// landing page.
+const maxLandingCacheSize = 1000
+
+// projectStore is the database used by the landing page.
+type projectStore interface {
+	ProjectUpdated(projectRoot string) (int, time.Time, error)
+	Project(projectRoot string) ([]database.Package, error)
+}
+
+type landingCacheEntry struct {
+	version string
+	page    []byte
+}
+
+type landingCacheMap struct {
+	sync.Mutex
+	m map[string]*landingCacheEntry
+}
+
+var landingCache = landingCacheMap{m: make(map[string]*landingCacheEntry)}
+
+// Usage returns the number of cached pages and the size of a page.
+func (c *landingCacheMap) Usage() (int, int) {
+	c.Lock()
+	defer c.Unlock()
+	for root, e := range c.m {
+		return len(c.m), len(root) + len(e.version) + len(e.page)
+	}
+	return 0, 0
+}
+
+// Evict removes the given fraction of the cached pages.
+func (c *landingCacheMap) Evict(fraction float64) int {
+	c.Lock()
+	defer c.Unlock()
+	n := int(math.Ceil(fraction * float64(len(c.m))))
+	evicted := 0
+	for root := range c.m {
+		if evicted >= n {
+			break
+		}
+		delete(c.m, root)
+		evicted++
+	}
+	return evicted
+}
+
+// getLanding returns the cached landing page of the project if the page
+// has the given version.
+func getLanding(projectRoot, version string) ([]byte, bool) {
+	landingCache.Lock()
+	defer landingCache.Unlock()
+	e := landingCache.m[projectRoot]
+	if e == nil || e.version != version {
+		return nil, false
+	}
+	return e.page, true
+}
+
+// putLanding adds a landing page to the cache.
+func putLanding(projectRoot, version string, page []byte) {
+	landingCache.Lock()
+	defer landingCache.Unlock()
+	if _, ok := landingCache.m[projectRoot]; !ok && len(landingCache.m) >= maxLandingCacheSize {
+		landingCache.m = make(map[string]*landingCacheEntry)
+	}
+	landingCache.m[projectRoot] = &landingCacheEntry{version: version, page: page}
+}
+
+// invalidateLanding removes the cached landing page of a project.
+func invalidateLanding(projectRoot string) {
+	landingCache.Lock()
+	delete(landingCache.m, projectRoot)
+	landingCache.Unlock()
+}
+
+// isLandingRequest returns true if the request for the package page is
+// served with the project landing page. The landing page is served for
+// project roots with a README file or subdirectories when the request has
+// no parameters.
+func isLandingRequest(req *web.Request, pdoc *doc.Package, hasSubdirs bool) bool {
+	return len(req.Form) == 0 &&
+		pdoc.ProjectRoot != "" &&
+		pdoc.ImportPath == pdoc.ProjectRoot &&
+		!pdoc.Monorepo &&
+		(len(pdoc.ReadmeFiles) > 0 || hasSubdirs) &&
+		templateExt(req) == ".html"
+}
+
+// projectReadme returns the name and content of the README file shown on
+// the landing page. README.md is preferred, then the first file by name.
+func projectReadme(pdoc *doc.Package) (string, []byte) {
+	var names []string
+	for name := range pdoc.ReadmeFiles {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	sort.Strings(names)
+	name := names[0]
+	for _, n := range names {
+		if strings.EqualFold(n, "README.md") {
+			name = n
+			break
+		}
+	}
+	return name, pdoc.ReadmeFiles[name]
+}
+
+// landingVersion returns the cache version of a landing page. The version
+// is also the ETag of the page.
+func landingVersion(n int, updated time.Time, readme []byte, a *doc.ProjectActivity) string {
+	h := sha1.New()
+	h.Write(readme)
+	readmeHash := hex.EncodeToString(h.Sum(nil))
+
+	h = sha1.New()
+	h.Write([]byte(strconv.Itoa(n) + " " + strconv.FormatInt(updated.Unix(), 10) + " " + readmeHash))
+	if a != nil {
+		h.Write([]byte(" " + strconv.FormatInt(a.Fetched.Unix(), 10)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// renderLanding renders the landing page of the project with root package
+// pdoc.
+func renderLanding(pdoc *doc.Package, readmeName string, readme []byte, pkgs []database.Package) ([]byte, error) {
+	var subpkgs []database.Package
+	for _, pkg := range pkgs {
+		if pkg.Path != pdoc.ImportPath {
+			subpkgs = append(subpkgs, pkg)
+		}
+	}
+	data := map[string]interface{}{
+		"pdoc": pdoc,
+		"pkgs": subpkgs,
+	}
+	if readme != nil {
+		data["readme"] = renderReadme(pdoc, readmeName, readme)
+	}
+	var buf bytes.Buffer
+	if err := renderTemplate(&buf, nil, "landing.html", data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// serveLanding serves the landing page of the project with root package
+// pdoc.
+func serveLanding(resp web.Response, req *web.Request, store projectStore, pdoc *doc.Package) error {
+	n, updated, err := store.ProjectUpdated(pdoc.ProjectRoot)
+	if err != nil {
+		return err
+	}
+	readmeName, readme := projectReadme(pdoc)
+	version := landingVersion(n, updated, readme, pdoc.Activity)
+
+	etag := quoteETag("landing-" + version)
+	header := web.Header{web.HeaderETag: {etag}}
+	if etagMatches(req.Header.Get(web.HeaderIfNoneMatch), etag) {
+		resp.Start(web.StatusNotModified, header)
+		return nil
+	}
+
+	page, ok := getLanding(pdoc.ProjectRoot, version)
+	if !ok {
+		pkgs, err := store.Project(pdoc.ProjectRoot)
+		if err != nil {
+			return err
+		}
+		page, err = renderLanding(pdoc, readmeName, readme, pkgs)
+		if err != nil {
+			return err
+		}
+		putLanding(pdoc.ProjectRoot, version, page)
+	}
+	header.Set(web.HeaderContentType, contentTypes[".html"])
+	_, err = resp.Start(web.StatusOK, header).Write(page)
+	return err
+}
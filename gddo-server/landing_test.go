@@ -0,0 +1,164 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeProjectStore struct {
+	pkgs         []database.Package
+	updated      time.Time
+	projectCalls int
+}
+
+func (s *fakeProjectStore) ProjectUpdated(projectRoot string) (int, time.Time, error) {
+	return len(s.pkgs), s.updated, nil
+}
+
+func (s *fakeProjectStore) Project(projectRoot string) ([]database.Package, error) {
+	s.projectCalls++
+	return s.pkgs, nil
+}
+
+func landingTestPackage() *doc.Package {
+	return &doc.Package{
+		ImportPath:  "example.com/proj",
+		ProjectRoot: "example.com/proj",
+		ProjectName: "proj",
+		ProjectURL:  "https://example.com/proj",
+		Name:        "proj",
+		Doc:         "Package proj does things.\n",
+		Updated:     time.Unix(1365000000, 0),
+		ReadmeFiles: map[string][]byte{
+			"README":    []byte("Old readme."),
+			"README.md": []byte("# Proj\n\nA synthetic <readme>.\n"),
+		},
+		Activity: &doc.ProjectActivity{Contributors: 3, OpenIssues: -1, Fetched: time.Unix(1365000000, 0)},
+	}
+}
+
+func TestServeLanding(t *testing.T) {
+	parseTestTemplates(t)
+	invalidateLanding("example.com/proj")
+	defer invalidateLanding("example.com/proj")
+
+	pdoc := landingTestPackage()
+	store := &fakeProjectStore{
+		pkgs: []database.Package{
+			{Path: "example.com/proj", Synopsis: "Package proj does things."},
+			{Path: "example.com/proj/sub", Synopsis: "Package sub helps."},
+		},
+		updated: time.Unix(1365000000, 0),
+	}
+	serve := func(header web.Header) *testResponse {
+		var resp testResponse
+		req := &web.Request{Form: url.Values{}, Header: header}
+		if err := serveLanding(&resp, req, store, pdoc); err != nil {
+			t.Fatalf("serveLanding() returned error %v", err)
+		}
+		return &resp
+	}
+
+	resp := serve(web.Header{})
+	body := resp.buf.String()
+	for _, s := range []string{
+		"<h3 id=\"_readme\">README.md</h3>",
+		"A synthetic &lt;readme&gt;.",
+		`href="/example.com/proj/sub"`,
+		"Package sub helps.",
+		"3 contributors",
+		`<a href="#_docs">Documentation</a>`,
+		`<h2 id="_docs">package proj</h2>`,
+		"Package proj does things.",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("landing page does not contain %q", s)
+		}
+	}
+	if strings.Contains(body, "Old readme.") {
+		t.Errorf("landing page contains README, want README.md only")
+	}
+	if i, j := strings.Index(body, `id="_readme"`), strings.Index(body, `id="_docs"`); i < 0 || j < i {
+		t.Errorf("documentation is not below the README")
+	}
+	etag := resp.header.Get(web.HeaderETag)
+
+	// The second request is served from the cache.
+	serve(web.Header{})
+	if store.projectCalls != 1 {
+		t.Errorf("Project called %d times, want 1", store.projectCalls)
+	}
+
+	// The client has the current page.
+	if resp := serve(web.Header{web.HeaderIfNoneMatch: {etag}}); resp.status != web.StatusNotModified {
+		t.Errorf("status with matching ETag = %d, want %d", resp.status, web.StatusNotModified)
+	}
+
+	// A refresh of a subpackage changes the version of the page.
+	store.updated = store.updated.Add(time.Hour)
+	resp = serve(web.Header{web.HeaderIfNoneMatch: {etag}})
+	if resp.status != web.StatusOK || store.projectCalls != 2 {
+		t.Errorf("after subpackage refresh, status = %d and Project called %d times, want %d and 2", resp.status, store.projectCalls, web.StatusOK)
+	}
+
+	// A deleted subpackage changes the version of the page.
+	store.pkgs = store.pkgs[:1]
+	resp = serve(web.Header{})
+	if store.projectCalls != 3 || strings.Contains(resp.buf.String(), "/example.com/proj/sub") {
+		t.Errorf("after subpackage delete, Project called %d times, want 3 and no link to sub", store.projectCalls)
+	}
+
+	invalidateLanding(pdoc.ProjectRoot)
+	serve(web.Header{})
+	if store.projectCalls != 4 {
+		t.Errorf("after invalidate, Project called %d times, want 4", store.projectCalls)
+	}
+}
+
+func TestIsLandingRequest(t *testing.T) {
+	html := web.Header{"Accept": {"text/html"}}
+	for _, tt := range []struct {
+		name       string
+		form       url.Values
+		modify     func(pdoc *doc.Package)
+		hasSubdirs bool
+		want       bool
+	}{
+		{"root", url.Values{}, nil, true, true},
+		{"readme only", url.Values{}, nil, false, true},
+		{"no readme or subdirs", url.Values{}, func(pdoc *doc.Package) { pdoc.ReadmeFiles = nil }, false, false},
+		{"subpackage", url.Values{}, func(pdoc *doc.Package) { pdoc.ImportPath += "/sub" }, true, false},
+		{"standard", url.Values{}, func(pdoc *doc.Package) { pdoc.ProjectRoot = ""; pdoc.ImportPath = "" }, true, false},
+		{"monorepo", url.Values{}, func(pdoc *doc.Package) { pdoc.Monorepo = true }, true, false},
+		{"selection", url.Values{"sel": {"F"}}, nil, true, false},
+	} {
+		pdoc := landingTestPackage()
+		if tt.modify != nil {
+			tt.modify(pdoc)
+		}
+		req := &web.Request{Form: tt.form, Header: html}
+		if got := isLandingRequest(req, pdoc, tt.hasSubdirs); got != tt.want {
+			t.Errorf("%s: isLandingRequest() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import "github.com/garyburd/gddo/doc"
+
+// languageNames maps the detected languages tagged in search results to
+// their names.
+var languageNames = map[string]string{
+	doc.LanguageChinese:    "Chinese",
+	doc.LanguageFrench:     "French",
+	doc.LanguageGerman:     "German",
+	doc.LanguageItalian:    "Italian",
+	doc.LanguageJapanese:   "Japanese",
+	doc.LanguageKorean:     "Korean",
+	doc.LanguagePortuguese: "Portuguese",
+	doc.LanguageRussian:    "Russian",
+	doc.LanguageSpanish:    "Spanish",
+	doc.LanguageUkrainian:  "Ukrainian",
+}
+
+// languageNameFn returns the name of a detected language or "" for English
+// and unknown languages, which are not tagged.
+func languageNameFn(lang string) string {
+	return languageNames[lang]
+}
@@ -0,0 +1,47 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func TestLanguageTags(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"results.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pkgs := []database.Package{
+		{Path: "github.com/user/cache", Synopsis: "Package cache 提供内存缓存。", Language: doc.LanguageChinese},
+		{Path: "github.com/user/config", Synopsis: "Package config reads settings.", Language: doc.LanguageEnglish},
+		{Path: "github.com/user/short", Synopsis: "Package short."},
+	}
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "results.html", web.StatusOK, nil, map[string]interface{}{"q": "lang:zh", "pkgs": pkgs, "results": searchResults(nil, pkgs)}); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	if n := strings.Count(body, `title="Documentation in`); n != 1 {
+		t.Errorf("results show %d language tags, want 1", n)
+	}
+	if !strings.Contains(body, `<small class="muted" title="Documentation in Chinese">zh</small>`) {
+		t.Errorf("results do not tag the package documented in Chinese")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/garyburd/indigo/web"
+)
+
+var (
+	localSocket     = flag.String("local-socket", "", "Path of a Unix domain socket serving the read-only API to local tools. The socket is not created if the path is empty.")
+	localSocketMode = flag.String("local-socket-mode", "0660", "Permissions of the local socket in octal.")
+)
+
+// newLocalHandler returns the handler for the local socket. The handler
+// serves the local safe routes of all hosts. Requests on the socket come
+// from tools on the same machine, so the handler does not apply quotas or
+// CORS.
+func newLocalHandler(routes []*apiRoute) web.Handler {
+	r := web.NewRouter()
+	for _, route := range routes {
+		if !route.localSafe {
+			continue
+		}
+		rr := r.Add(route.pattern)
+		for _, m := range route.methods {
+			rr.Method(m, route.handler)
+		}
+	}
+	return web.ErrorHandler(handleAPIError, web.FormAndCookieHandler(6000, false, r))
+}
+
+// parseSocketMode parses the octal permissions of the local socket.
+func parseSocketMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n&^0777 != 0 {
+		return 0, fmt.Errorf("bad socket mode %q", s)
+	}
+	return os.FileMode(n), nil
+}
+
+// listenLocal listens on the Unix domain socket at path. A socket left
+// behind by a server that did not shut down cleanly is replaced. Other
+// files and sockets with a live listener are left alone.
+func listenLocal(path string, mode os.FileMode) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		// nothing to do
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	default:
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		closeLocal(l, path)
+		return nil, err
+	}
+	return l, nil
+}
+
+// closeLocal closes the listener and removes the socket file.
+func closeLocal(l net.Listener, path string) {
+	l.Close()
+	os.Remove(path)
+}
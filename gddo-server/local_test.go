@@ -0,0 +1,228 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/indigo/server"
+	"github.com/garyburd/indigo/web"
+)
+
+func serveTest(l net.Listener, h web.Handler) {
+	go (&server.Server{Listener: l, Handler: h}).Serve()
+}
+
+func socketClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func getBody(t *testing.T, c *http.Client, url string) (int, string) {
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read %s: %v", url, err)
+	}
+	return resp.StatusCode, string(p)
+}
+
+func tempSocketPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gddo-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "api.sock"), func() { os.RemoveAll(dir) }
+}
+
+var testLocalRoutes = []*apiRoute{
+	{
+		host: siteHost, pattern: "/-/api/stored/<path:.+>", methods: []string{"GET"},
+		quota: cheapQuota, localSafe: true,
+		handler: func(resp web.Response, req *web.Request) error {
+			io.WriteString(resp.Start(web.StatusOK, web.Header{}), "stored "+req.RouteVars["path"])
+			return nil
+		},
+	},
+	{
+		host: siteHost, pattern: "/-/api/fetch/<path:.+>", methods: []string{"GET"},
+		quota: cheapQuota,
+		handler: func(resp web.Response, req *web.Request) error {
+			io.WriteString(resp.Start(web.StatusOK, web.Header{}), "fetched "+req.RouteVars["path"])
+			return nil
+		},
+	},
+}
+
+func TestLocalSocket(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	l, err := listenLocal(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeLocal(l, path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode() & os.ModePerm; mode != 0600 {
+		t.Errorf("mode = %o, want 600", mode)
+	}
+	serveTest(l, newLocalHandler(testLocalRoutes))
+
+	defer func(q *quotaLimiter) { quotas = q }(quotas)
+	quotas = newQuotaLimiter(10)
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	r := web.NewRouter()
+	addAPIRoutes(r, testLocalRoutes, siteHost)
+	serveTest(tl, web.ErrorHandler(handleAPIError, r))
+
+	c := socketClient(path)
+	tcp := "http://" + tl.Addr().String()
+	for _, tt := range []struct {
+		client *http.Client
+		url    string
+		status int
+		body   string
+	}{
+		{c, "http://local/-/api/stored/example.com/a", 200, "stored example.com/a"},
+		{c, "http://local/-/api/fetch/example.com/a", 404, ""},
+		{http.DefaultClient, tcp + "/-/api/stored/example.com/a", 200, "stored example.com/a"},
+		{http.DefaultClient, tcp + "/-/api/fetch/example.com/a", 200, "fetched example.com/a"},
+	} {
+		status, body := getBody(t, tt.client, tt.url)
+		if status != tt.status || (tt.body != "" && body != tt.body) {
+			t.Errorf("get %s = %d %q, want %d %q", tt.url, status, body, tt.status, tt.body)
+		}
+	}
+
+	closeLocal(l, path)
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed after close, err = %v", err)
+	}
+}
+
+func TestLocalSocketAPIRoutes(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	l, err := listenLocal(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeLocal(l, path)
+	serveTest(l, newLocalHandler(apiRoutes))
+	c := socketClient(path)
+
+	status, body := getBody(t, c, "http://local/-/api/status")
+	if status != 200 {
+		t.Fatalf("status endpoint returned %d: %s", status, body)
+	}
+	var data struct {
+		Services []api.ServiceStatus `json:"services"`
+	}
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if len(data.Services) == 0 {
+		t.Error("status has no services")
+	}
+
+	status, body = getBody(t, c, "http://local/-/api")
+	if status != 200 {
+		t.Fatalf("catalog returned %d: %s", status, body)
+	}
+
+	// The text endpoint fetches missing packages.
+	status, _ = getBody(t, c, "http://local/-/api/txt/example.com/a")
+	if status != 404 {
+		t.Errorf("text endpoint returned %d on the local socket, want 404", status)
+	}
+}
+
+func TestListenLocalExistingPath(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	// Leave a socket without a listener behind.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenLocal(path, 0600)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+
+	// The socket is in use.
+	if _, err := listenLocal(path, 0600); err == nil {
+		t.Error("listen on socket in use succeeded")
+	}
+	closeLocal(l, path)
+
+	// The path is a regular file.
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenLocal(path, 0600); err == nil {
+		t.Error("listen on regular file succeeded")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		mode os.FileMode
+		ok   bool
+	}{
+		{"0660", 0660, true},
+		{"600", 0600, true},
+		{"0999", 0, false},
+		{"01777", 0, false},
+	} {
+		mode, err := parseSocketMode(tt.s)
+		if (err == nil) != tt.ok || mode != tt.mode {
+			t.Errorf("parseSocketMode(%q) = %o, %v", tt.s, mode, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the local source tree mode. Packages that cannot be
+// fetched from a repository are built from a directory of the server's file
+// system and the source files are served from the same directory.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var localSource = flag.String("local", "", "Directory of a local source tree, for example $GOPATH/src. Packages that cannot be fetched from a repository are built from this tree.")
+
+// getLocalDoc builds the documentation for path from the local source tree.
+// The file links of the documentation point to serveLocalSource.
+func getLocalDoc(path string, etag string) (*doc.Package, error) {
+	return doc.GetDir(*localSource, path, etag, sitePath("/-/src/"+path+"/%s"), "%s#L%d")
+}
+
+// fetchWithLocalFallback returns the result of the fetch from the repository
+// or, if the package is not found and the local source tree is enabled, the
+// documentation from the local source tree. The result of the fetch is kept
+// if the package is not in the tree.
+func fetchWithLocalFallback(path string, etag string, pdoc *doc.Package, err error) (*doc.Package, error) {
+	if *localSource == "" || !doc.IsNotFound(err) {
+		return pdoc, err
+	}
+	pdocLocal, errLocal := getLocalDoc(path, etag)
+	if doc.IsNotFound(errLocal) {
+		return pdoc, err
+	}
+	return pdocLocal, errLocal
+}
+
+// serveLocalSource serves a documentation source file from the local source
+// tree as plain text. Symbolic links are followed only within the tree.
+func serveLocalSource(resp web.Response, req *web.Request) error {
+	p := req.RouteVars["path"]
+	if *localSource == "" || !doc.IsDocFile(path.Base(p)) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	name, err := doc.LocalDir(*localSource, p)
+	if err != nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	root, err := filepath.EvalSymlinks(*localSource)
+	if err != nil {
+		return err
+	}
+	name, err = filepath.EvalSymlinks(name)
+	if os.IsNotExist(err) {
+		return &web.Error{Status: web.StatusNotFound}
+	} else if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(name, root+string(filepath.Separator)) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return &web.Error{Status: web.StatusNotFound}
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if !fi.Mode().IsRegular() {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"text/plain; charset=utf-8"}})
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func TestServeLocalSource(t *testing.T) {
+	root, err := ioutil.TempDir("", "localsrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "example.com", "a")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.go", "secret.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("package a\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.go"), []byte("secret\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.go"), filepath.Join(dir, "escape.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "a.go"), filepath.Join(dir, "inside.go")); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s string) { *localSource = s }(*localSource)
+	*localSource = root
+
+	serve := func(p string) (*testResponse, error) {
+		req := &web.Request{URL: &url.URL{Path: "/-/src/" + p}, RouteVars: map[string]string{"path": p}}
+		var resp testResponse
+		err := serveLocalSource(&resp, req)
+		return &resp, err
+	}
+
+	resp, err := serve("example.com/a/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.buf.String() != "package a\n" || resp.header.Get(web.HeaderContentType) != "text/plain; charset=utf-8" {
+		t.Errorf("serveLocalSource returned %q with type %q", resp.buf.String(), resp.header.Get(web.HeaderContentType))
+	}
+
+	// A symbolic link within the tree is followed.
+	if resp, err := serve("example.com/a/inside.go"); err != nil || resp.buf.String() != "package a\n" {
+		t.Errorf("serveLocalSource(inside.go) returned %q, %v, want a.go", resp.buf.String(), err)
+	}
+
+	for _, p := range []string{"example.com/a/secret.txt", "example.com/a/b.go", "example.com/../../a.go", "example.com/a", "example.com/a/escape.go"} {
+		if _, err := serve(p); err == nil {
+			t.Errorf("serveLocalSource(%q) returned no error, want not found", p)
+		} else if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+			t.Errorf("serveLocalSource(%q) returned %v, want not found", p, err)
+		}
+	}
+
+	*localSource = ""
+	if _, err := serve("example.com/a/a.go"); err == nil {
+		t.Error("serveLocalSource returned no error with local source tree disabled")
+	}
+}
+
+func TestFetchWithLocalFallback(t *testing.T) {
+	root, err := ioutil.TempDir("", "localsrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(s string) { *localSource = s }(*localSource)
+
+	notFound := doc.NotFoundError{Message: "Import path not valid:"}
+	other := errors.New("other")
+
+	*localSource = ""
+	if _, err := fetchWithLocalFallback("example.com/a", "", nil, notFound); err != notFound {
+		t.Errorf("disabled fallback returned %v, want %v", err, notFound)
+	}
+
+	*localSource = root
+	if _, err := fetchWithLocalFallback("example.com/a", "", nil, other); err != other {
+		t.Errorf("fallback for other error returned %v, want %v", err, other)
+	}
+	if _, err := fetchWithLocalFallback("example.com/a", "", nil, notFound); err != notFound {
+		t.Errorf("fallback for package not in tree returned %v, want %v", err, notFound)
+	}
+}
@@ -16,6 +16,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
@@ -30,16 +31,20 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"code.google.com/p/go.talks/pkg/present"
+	"github.com/garyburd/gddo/api"
 	"github.com/garyburd/gddo/database"
 	"github.com/garyburd/gddo/doc"
 	"github.com/garyburd/indigo/server"
@@ -60,6 +65,21 @@ type crawlResult struct {
 	err  error
 }
 
+// packageStore is the subset of the database used to look up the
+// documentation shown on package pages and in the package API.
+type packageStore interface {
+	CanonicalPath(path string) (string, error)
+	Get(path string) (*doc.Package, []database.Package, time.Time, error)
+	GetDoc(path string) (*doc.Package, time.Time, error)
+	ImporterCount(path string) (int, error)
+}
+
+// packagePages holds the store used for package pages and the package API.
+// The store is set in main.
+var packagePages struct {
+	store packageStore
+}
+
 // getDoc gets the package documentation from the database or from the version
 // control system as needed.
 func getDoc(path string, requestType int) (*doc.Package, []database.Package, error) {
@@ -69,33 +89,35 @@ func getDoc(path string, requestType int) (*doc.Package, []database.Package, err
 		// return not found.
 		return nil, nil, nil
 	}
+	if !doc.IsValidPath(path) && !doc.IsGoRepoPath(path) {
+		return nil, nil, nil
+	}
 
-	pdoc, pkgs, nextCrawl, err := db.Get(path)
+	pdoc, pkgs, nextCrawl, err := packagePages.store.Get(path)
 	if err != nil {
 		return nil, nil, err
 	}
+	repairStoredDoc(pdoc)
 
-	needsCrawl := false
-	switch requestType {
-	case queryRequest:
-		needsCrawl = nextCrawl.IsZero() && len(pkgs) == 0
-	case humanRequest:
-		needsCrawl = nextCrawl.Before(time.Now())
-	case robotRequest:
-		needsCrawl = nextCrawl.IsZero() && len(pkgs) > 0
-	}
-
-	if needsCrawl {
-		c := make(chan crawlResult, 1)
-		go func() {
-			pdoc, err := crawlDoc("web  ", path, pdoc, len(pkgs) > 0, nextCrawl)
-			c <- crawlResult{pdoc, err}
-		}()
+	if crawlNeeded(path, requestType, nextCrawl, len(pkgs) > 0) {
 		var err error
 		timeout := *getTimeout
 		if pdoc == nil {
 			timeout = *firstGetTimeout
 		}
+		c := make(chan crawlResult, 1)
+		if claimFetch(path) {
+			go func() {
+				pdoc, err := crawlDoc("web  ", path, pdoc, len(pkgs) > 0, nextCrawl)
+				releaseFetch(path)
+				c <- crawlResult{pdoc, err}
+			}()
+		} else {
+			// Another server instance is fetching the package.
+			go func() {
+				c <- waitForFetch(path, nextCrawl, timeout)
+			}()
+		}
 		select {
 		case rr := <-c:
 			if rr.err == nil {
@@ -105,7 +127,9 @@ func getDoc(path string, requestType int) (*doc.Package, []database.Package, err
 		case <-time.After(timeout):
 			err = errUpdateTimeout
 		}
-		if err != nil {
+		if isCanonicalPathError(err) {
+			// The caller redirects to the path with the correct case.
+		} else if err != nil {
 			if pdoc != nil {
 				log.Printf("Serving %q from database after error: %v", path, err)
 				err = nil
@@ -119,7 +143,44 @@ func getDoc(path string, requestType int) (*doc.Package, []database.Package, err
 	return pdoc, pkgs, err
 }
 
+// repairStoredDoc normalizes a package loaded from the database when the
+// package was not normalized by the current version of doc.Normalize.
+// Packages stored by older versions of the builder can have duplicate
+// files, positions that refer to missing files, nil declarations or
+// annotations outside of the code text. The repair is logged; the stored
+// record is replaced on the next crawl.
+func repairStoredDoc(pdoc *doc.Package) {
+	if pdoc == nil || pdoc.NormalizeVersion >= doc.NormalizeVersion {
+		return
+	}
+	if cleared, modified := doc.Normalize(pdoc); modified {
+		log.Printf("Repaired stored package %q: %d source positions cleared", pdoc.ImportPath, cleared)
+	}
+}
+
+// crawlNeeded returns true if a request should fetch the package from the
+// VCS before serving it.
+func crawlNeeded(path string, requestType int, nextCrawl time.Time, hasSubdirs bool) bool {
+	if !fetchAllowed(path) {
+		return false
+	}
+	switch requestType {
+	case queryRequest:
+		return nextCrawl.IsZero() && !hasSubdirs
+	case humanRequest:
+		return nextCrawl.Before(time.Now())
+	case robotRequest:
+		return nextCrawl.IsZero() && hasSubdirs
+	}
+	return false
+}
+
+// templateExt returns the extension of the template for the format requested
+// with the format parameter or the Accept header.
 func templateExt(req *web.Request) string {
+	if req.Form.Get("format") == "txt" {
+		return ".txt"
+	}
 	if web.NegotiateContentType(req, []string{"text/html", "text/plain"}, "text/html") == "text/plain" {
 		return ".txt"
 	}
@@ -135,22 +196,17 @@ func isRobot(req *web.Request) bool {
 }
 
 func popularLinkReferral(req *web.Request) bool {
-	u := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: "/"}
+	u := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: sitePath("/")}
 	return req.Header.Get("Referer") == u.String()
 }
 
-func hasFormValue(req *web.Request, key string) bool {
-	_, ok := req.Form[key]
-	return ok
-}
-
 func servePackage(resp web.Response, req *web.Request) error {
 	p := path.Clean(req.URL.Path)
 	if strings.HasPrefix(p, "/pkg/") {
 		p = p[len("/pkg"):]
 	}
 	if p != req.URL.Path {
-		return web.Redirect(resp, req, p, 301, nil)
+		return web.Redirect(resp, req, sitePath(p), 301, nil)
 	}
 
 	requestType := humanRequest
@@ -159,16 +215,51 @@ func servePackage(resp web.Response, req *web.Request) error {
 	}
 
 	path := req.RouteVars["path"]
+	if format, ok := badgeFormat(req.Form); ok {
+		return serveBadge(resp, req, path, format)
+	}
+	if req.Form.Get("format") == "json" {
+		// Errors are reported as JSON, not as an HTML page.
+		h := redirectHandler{"/-/api/pkg/<path:.+>", web.HandlerFunc(serveAPIPackageDoc)}
+		return web.ErrorHandler(handleAPIError, h).ServeWeb(resp, req)
+	}
+	if p, ref, ok := splitRef(path, req.Form); !ok {
+		return &web.Error{Status: web.StatusNotFound}
+	} else if ref != "" {
+		return serveRef(resp, req, p, ref)
+	}
+	if to, ok := redirectImportPath(path); ok {
+		return web.Redirect(resp, req, sitePath("/"+to), 301, nil)
+	}
+	if _, s := doc.GetServiceState(path); s == doc.ServiceRemoved {
+		return serveServiceNotFound(resp, req, path)
+	}
+
+	// Redirect to the stored package if the path differs only in case.
+	if canonical, err := packagePages.store.CanonicalPath(path); err != nil {
+		return err
+	} else if canonical != "" && canonical != path {
+		return web.Redirect(resp, req, sitePath("/"+canonical), 301, nil)
+	}
+
 	pdoc, pkgs, err := getDoc(path, requestType)
-	if err != nil {
+	if e, ok := err.(doc.CanonicalPathError); ok {
+		return web.Redirect(resp, req, sitePath("/"+e.ImportPath), 301, nil)
+	} else if err != nil {
+		return err
+	}
+	if err := deadlinesFor(req).checkHard(); err != nil {
 		return err
 	}
 
 	if pdoc == nil {
 		if len(pkgs) == 0 {
+			if !fetchAllowed(path) {
+				return serveServiceNotFound(resp, req, path)
+			}
 			return &web.Error{Status: web.StatusNotFound}
 		}
-		pdocChild, _, _, err := db.Get(pkgs[0].Path)
+		pdocChild, _, _, err := packagePages.store.Get(pkgs[0].Path)
 		if err != nil {
 			return err
 		}
@@ -180,8 +271,50 @@ func servePackage(resp web.Response, req *web.Request) error {
 		}
 	}
 
+	refreshActivity(pdoc.ProjectRoot, pdoc.Activity)
+
+	if _, ok := req.Form["asof"]; ok {
+		return serveSnapshot(resp, req, pdoc)
+	}
+
+	// The GOOS and GOARCH parameters select the documentation for another
+	// build context.
+	if pdoc.Name != "" {
+		var ok bool
+		if pdoc, ok = packageForContext(pdoc, req.Form); !ok {
+			return &web.Error{Status: web.StatusNotFound}
+		}
+	}
+
+	if v, ok := findView(req.Form); ok {
+		if v == nil {
+			return &web.Error{Status: web.StatusNotFound}
+		}
+		return serveView(resp, req, v, pdoc)
+	}
+
+	// The format parameter selects an export of the documentation. The txt
+	// format is the package page rendered as plain text below.
+	if format, ok := req.Form["format"]; ok && !(len(format) == 1 && format[0] == "txt") {
+		if len(format) != 1 || format[0] != "md" || pdoc.Name == "" {
+			return &web.Error{Status: web.StatusNotFound}
+		}
+		header, p := renderMarkdown(pdoc, req)
+		_, err := resp.Start(web.StatusOK, header).Write(p)
+		return err
+	}
+
+	// The sel, type, trace, index, expand, format, GOOS and GOARCH
+	// parameters do not select a different page.
+	n := len(req.Form)
+	for _, k := range []string{"sel", "type", "trace", "index", "expand", "format", "GOOS", "GOARCH"} {
+		if _, ok := req.Form[k]; ok {
+			n--
+		}
+	}
+
 	switch {
-	case len(req.Form) == 0:
+	case n == 0:
 		if requestType == humanRequest &&
 			pdoc.Name != "" && // not a directory
 			pdoc.ProjectRoot != "" && // not a standard package
@@ -189,98 +322,74 @@ func servePackage(resp web.Response, req *web.Request) error {
 			len(pdoc.Errors) == 0 &&
 			!popularLinkReferral(req) {
 			if err := db.IncrementPopularScore(pdoc.ImportPath); err != nil {
-				log.Print("ERROR db.IncrementPopularScore(%s): %v", pdoc.ImportPath, err)
+				log.Printf("ERROR db.IncrementPopularScore(%s): %v", pdoc.ImportPath, err)
 			}
 		}
-
-		importerCount, err := db.ImporterCount(path)
-		if err != nil {
-			return err
+		if requestType == humanRequest && pdoc.Monorepo {
+			if err := db.SetViewed(pdoc.ImportPath, time.Now()); err != nil {
+				log.Printf("ERROR db.SetViewed(%s): %v", pdoc.ImportPath, err)
+			}
 		}
 
-		template := "pkg"
-		if pdoc.IsCmd {
-			template = "cmd"
+		if isLandingRequest(req, pdoc, len(pkgs) > 0) {
+			return serveLanding(resp, req, db, pdoc)
 		}
-		template += templateExt(req)
 
-		return executeTemplate(resp, template, web.StatusOK, nil, map[string]interface{}{
-			"pkgs":          pkgs,
-			"pdoc":          pdoc,
-			"importerCount": importerCount,
-		})
-	case hasFormValue(req, "imports"):
-		if pdoc.Name == "" {
-			break
-		}
-		pkgs, err = db.Packages(pdoc.Imports)
-		if err != nil {
-			return err
-		}
-		return executeTemplate(resp, "imports.html", web.StatusOK, nil, map[string]interface{}{
-			"pkgs": pkgs,
-			"pdoc": pdoc,
-		})
-	case hasFormValue(req, "importers"):
-		if pdoc.Name == "" {
-			break
-		}
-		pkgs, err = db.Importers(path)
+		sectionData, err := loadSections(pdoc, req, pageSections)
 		if err != nil {
 			return err
 		}
-		return executeTemplate(resp, "importers.html", web.StatusOK, nil, map[string]interface{}{
-			"pkgs": pkgs,
-			"pdoc": pdoc,
-		})
-	case hasFormValue(req, "import-graph"):
-		if pdoc.Name == "" {
-			break
-		}
-		hide := req.Form.Get("hide") == "1"
-		pkgs, edges, err := db.ImportGraph(pdoc, hide)
-		if err != nil {
-			return err
-		}
-		b, err := renderGraph(pdoc, pkgs, edges)
-		if err != nil {
-			return err
+
+		// The selected anchor can be in a format used by other Go
+		// documentation sites. The type parameter scopes a selected method
+		// name to a type.
+		sel, _ := doc.ResolveScopedAnchor(pdoc, req.Form.Get("type"), req.Form.Get("sel"))
+		if requestType == humanRequest {
+			countView(pdoc, sel)
 		}
-		return executeTemplate(resp, "graph.html", web.StatusOK, nil, map[string]interface{}{
-			"svg":  template.HTML(b),
-			"pdoc": pdoc,
-			"hide": hide,
+
+		_, expand := req.Form["expand"]
+		subdirs, moreSubdirs := monorepoSubdirs(pdoc, pkgs, expand)
+
+		name, data := packagePage(pdoc, nil, &RenderOptions{
+			Pkgs:        subdirs,
+			MoreSubdirs: moreSubdirs,
+			Sel:         sel,
+			IndexOrder:  req.Form.Get("index"),
+			Text:        templateExt(req) == ".txt",
+			SectionData: sectionData,
 		})
+		return executePackageTemplate(resp, req, name, pdoc, data)
 	case req.Form.Get("play") != "":
 		u, err := playURL(pdoc, req.Form.Get("play"), req.Form.Get("name"))
 		if err != nil {
 			return err
 		}
 		return web.Redirect(resp, req, u, 301, nil)
-	case req.Form.Get("view") != "":
-		// Redirect deprecated view= queries.
-		var q string
-		switch view := req.Form.Get("view"); view {
-		case "imports", "importers":
-			q = view
-		case "import-graph":
-			if req.Form.Get("hide") == "1" {
-				q = "import-graph&hide=1"
-			} else {
-				q = "import-graph"
-			}
-		}
-		if q != "" {
-			u := *req.URL
-			u.RawQuery = q
-			return web.Redirect(resp, req, u.String(), 301, nil)
-		}
 	}
 	return &web.Error{Status: web.StatusNotFound}
 }
 
+// serveServiceNotFound responds with not found and an explanation for
+// packages on hosts that are not active.
+func serveServiceNotFound(resp web.Response, req *web.Request, path string) error {
+	return executeTemplate(resp, req, "notfound"+templateExt(req), web.StatusNotFound, nil, map[string]interface{}{
+		"message": serviceMessage(path),
+	})
+}
+
 func serveRefresh(resp web.Response, req *web.Request) error {
 	path := req.Form.Get("path")
+	if !doc.IsValidPath(path) {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	switch _, s := doc.GetServiceState(path); s {
+	case doc.ServiceDeprecated:
+		// The package page explains why the package is not refreshed.
+		return web.Redirect(resp, req, sitePath("/"+path), 302, nil)
+	case doc.ServiceRemoved:
+		return &web.Error{Status: web.StatusNotFound}
+	}
 	_, pkgs, _, err := db.Get(path)
 	if err != nil {
 		return err
@@ -298,7 +407,8 @@ func serveRefresh(resp web.Response, req *web.Request) error {
 	if err != nil {
 		return err
 	}
-	return web.Redirect(resp, req, "/"+path, 302, nil)
+	invalidateFragments(path)
+	return web.Redirect(resp, req, sitePath("/"+path), 302, nil)
 }
 
 func serveGoIndex(resp web.Response, req *web.Request) error {
@@ -306,18 +416,23 @@ func serveGoIndex(resp web.Response, req *web.Request) error {
 	if err != nil {
 		return err
 	}
-	return executeTemplate(resp, "std.html", web.StatusOK, nil, map[string]interface{}{
+	return executeTemplate(resp, req, "std.html", web.StatusOK, nil, map[string]interface{}{
 		"pkgs": pkgs,
 	})
 }
 
+// serveIndex serves the import paths of the packages in the index or, to
+// clients that prefer HTML, the index page.
 func serveIndex(resp web.Response, req *web.Request) error {
+	if req.Form.Get("format") != "html" && web.NegotiateContentType(req, []string{"text/plain", "text/html"}, "text/plain") == "text/plain" {
+		return serveTextIndex(resp, req)
+	}
 	pkgs, err := db.Index()
 	if err != nil {
 		return err
 	}
-	return executeTemplate(resp, "index.html", web.StatusOK, nil, map[string]interface{}{
-		"pkgs": pkgs,
+	return executeTemplate(resp, req, "index.html", web.StatusOK, nil, map[string]interface{}{
+		"pkgs": withoutRedirected(pkgs),
 	})
 }
 
@@ -396,7 +511,7 @@ func serveHome(resp web.Response, req *web.Request) error {
 			return err
 		}
 
-		return executeTemplate(resp, "home"+templateExt(req), web.StatusOK, nil,
+		return executeTemplate(resp, req, "home"+templateExt(req), web.StatusOK, nil,
 			map[string]interface{}{"Popular": pkgs})
 	}
 
@@ -404,33 +519,47 @@ func serveHome(resp web.Response, req *web.Request) error {
 		q = path
 	}
 
+	if to, ok := redirectImportPath(q); ok {
+		return web.Redirect(resp, req, sitePath("/"+to), 302, nil)
+	}
+
 	if doc.IsValidRemotePath(q) {
 		pdoc, pkgs, err := getDoc(q, queryRequest)
 		if err == nil && (pdoc != nil || len(pkgs) > 0) {
-			return web.Redirect(resp, req, "/"+q, 302, nil)
+			return web.Redirect(resp, req, sitePath("/"+q), 302, nil)
 		}
 	}
 
-	pkgs, err := db.Query(q)
+	scope := strings.TrimSpace(req.Form.Get("scope"))
+	pkgs, err := db.QueryOrder(q, scope, searchOrder(req))
+	if err == database.ErrStopWordQuery {
+		return executeTemplate(resp, req, "results"+templateExt(req), web.StatusOK, nil,
+			map[string]interface{}{"q": q, "scope": scope, "message": stopWordQueryMessage})
+	}
 	if err != nil {
 		return err
 	}
+	if req.Form.Get("btnI") != "" {
+		if p, ok := luckyResult(q, pkgs); ok {
+			return web.Redirect(resp, req, sitePath("/"+p), 302, nil)
+		}
+	}
+	markAdvisories(pkgs)
 
-	return executeTemplate(resp, "results"+templateExt(req), web.StatusOK, nil,
-		map[string]interface{}{"q": q, "pkgs": pkgs})
+	data := map[string]interface{}{"q": q, "scope": scope, "pkgs": pkgs}
+	if templateExt(req) == ".html" {
+		data["results"] = searchResults(cards, pkgs)
+	}
+	return executeTemplate(resp, req, "results"+templateExt(req), web.StatusOK, nil, data)
 }
 
 func serveAbout(resp web.Response, req *web.Request) error {
-	return executeTemplate(resp, "about.html", web.StatusOK, nil,
-		map[string]interface{}{"Host": req.URL.Host})
+	return executeTemplate(resp, req, "about.html", web.StatusOK, nil,
+		map[string]interface{}{"Host": req.URL.Host + sitePath("")})
 }
 
 func serveBot(resp web.Response, req *web.Request) error {
-	return executeTemplate(resp, "bot.html", web.StatusOK, nil, nil)
-}
-
-func serveOpenSearchDescription(resp web.Response, req *web.Request) error {
-	return executeTemplate(resp, "opensearch.xml", web.StatusOK, nil, req.URL.Host)
+	return executeTemplate(resp, req, "bot.html", web.StatusOK, nil, nil)
 }
 
 func serveTypeahead(resp web.Response, req *web.Request) error {
@@ -550,30 +679,87 @@ func serveCompile(resp web.Response, req *web.Request) error {
 
 func serveAPISearch(resp web.Response, req *web.Request) error {
 	q := strings.TrimSpace(req.Form.Get("q"))
-	pkgs, err := db.Query(q)
+
+	var (
+		pkgs    []database.Package
+		session string
+		err     error
+	)
+	scope := strings.TrimSpace(req.Form.Get("scope"))
+	if _, ok := req.Form["session"]; ok && scope == "" {
+		// Search as you type clients pass the session token from the
+		// previous response.
+		pkgs, session, err = db.QuerySession(q, req.Form.Get("session"))
+	} else {
+		pkgs, err = db.QueryOrder(q, scope, searchOrder(req))
+	}
+	if err == database.ErrStopWordQuery {
+		writeAPIError(resp, web.StatusBadRequest, stopWordQueryMessage)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	markAdvisories(pkgs)
 
-	var data struct {
-		Results []database.Package `json:"results"`
-	}
-	data.Results = pkgs
+	data := api.SearchResponse{Results: apiSearchResults(pkgs), Session: session}
 	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=uft-8"}})
 	return json.NewEncoder(w).Encode(&data)
 }
 
+// serveAPIPackages serves all packages in the index. The packages are
+// written as they are read from the database.
 func serveAPIPackages(resp web.Response, req *web.Request) error {
-	pkgs, err := db.AllPackages()
+	return writePackagesJSON(resp, db.AllPackagesFunc)
+}
+
+// writePackagesJSON writes the packages passed to the callback by walk as a
+// JSON object with a results field. The response is started with the first
+// package so that an error from walk before the first package is reported
+// with an error status.
+func writePackagesJSON(resp web.Response, walk func(func(database.Package) bool) error) error {
+	var w *bufio.Writer
+	var err error
+	start := func() {
+		w = bufio.NewWriter(resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=uft-8"}}))
+		w.WriteString(`{"results":[`)
+	}
+	walkErr := walk(func(pkg database.Package) bool {
+		if w == nil {
+			start()
+		} else {
+			w.WriteByte(',')
+		}
+		var p []byte
+		p, err = json.Marshal(&pkg)
+		if err != nil {
+			return false
+		}
+		_, err = w.Write(p)
+		return err == nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
 	if err != nil {
 		return err
 	}
-	var data struct {
-		Results []database.Package `json:"results"`
+	if w == nil {
+		start()
 	}
-	data.Results = pkgs
-	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=uft-8"}})
-	return json.NewEncoder(w).Encode(&data)
+	w.WriteString("]}\n")
+	return w.Flush()
+}
+
+// serveMigration serves the progress of the database migration to
+// administrators.
+func serveMigration(resp web.Response, req *web.Request) error {
+	status, ok := db.MigrationStatus()
+	if !ok || !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(&status)
 }
 
 func handleError(resp web.Response, req *web.Request, status int, err error, r interface{}) {
@@ -582,15 +768,23 @@ func handleError(resp web.Response, req *web.Request, status int, err error, r i
 	case 0:
 		// nothing to do
 	case web.StatusNotFound:
-		executeTemplate(resp, "notfound"+templateExt(req), status, nil, nil)
+		executeTemplate(resp, req, "notfound"+templateExt(req), status, nil, nil)
 	default:
 		s := web.StatusText(status)
+		status = web.StatusInternalServerError
+		header := web.Header{web.HeaderContentType: {"text/plan; charset=uft-8"}}
 		if err == errUpdateTimeout {
 			s = "Timeout getting package files from the version control system."
+		} else if err == errHardDeadline {
+			s = "Timeout assembling the page. Try again later."
 		} else if e, ok := err.(*doc.RemoteError); ok {
 			s = "Error getting package files from " + e.Host + "."
+		} else if e, ok := err.(doc.RateLimitError); ok {
+			s = "Rate limit exceeded for " + e.Host + ". Try again later."
+			status = web.StatusServiceUnavailable
+			header.Set(web.HeaderRetryAfter, retryAfter(e, time.Now()))
 		}
-		w := resp.Start(web.StatusInternalServerError, web.Header{web.HeaderContentType: {"text/plan; charset=uft-8"}})
+		w := resp.Start(status, header)
 		io.WriteString(w, s)
 	}
 }
@@ -602,6 +796,7 @@ func handlePresentError(resp web.Response, req *web.Request, status int, err err
 		// nothing to do
 	default:
 		s := web.StatusText(status)
+		header := web.Header{web.HeaderContentType: {"text/plan; charset=uft-8"}}
 		if doc.IsNotFound(err) {
 			s = web.StatusText(web.StatusNotFound)
 			status = web.StatusNotFound
@@ -609,8 +804,12 @@ func handlePresentError(resp web.Response, req *web.Request, status int, err err
 			s = "Timeout getting package files from the version control system."
 		} else if e, ok := err.(*doc.RemoteError); ok {
 			s = "Error getting package files from " + e.Host + "."
+		} else if e, ok := err.(doc.RateLimitError); ok {
+			s = "Rate limit exceeded for " + e.Host + ". Try again later."
+			status = web.StatusServiceUnavailable
+			header.Set(web.HeaderRetryAfter, retryAfter(e, time.Now()))
 		}
-		w := resp.Start(status, web.Header{web.HeaderContentType: {"text/plan; charset=uft-8"}})
+		w := resp.Start(status, header)
 		io.WriteString(w, s)
 	}
 }
@@ -621,17 +820,40 @@ func handleAPIError(resp web.Response, req *web.Request, status int, err error,
 	case 0:
 		// nothing to do
 	default:
-		var data struct {
-			Error struct {
-				Message string `json:"message"`
-			} `json:"error"`
+		header := web.Header{web.HeaderContentType: {"application/json; charset=uft-8"}}
+		message := web.StatusText(status)
+		if e, ok := err.(doc.RateLimitError); ok {
+			status = web.StatusServiceUnavailable
+			message = "Rate limit exceeded for " + e.Host + "."
+			header.Set(web.HeaderRetryAfter, retryAfter(e, time.Now()))
 		}
-		data.Error.Message = web.StatusText(status)
-		w := resp.Start(status, web.Header{web.HeaderContentType: {"application/json; charset=uft-8"}})
-		json.NewEncoder(w).Encode(&data)
+		writeAPIErrorHeader(resp, status, message, header)
 	}
 }
 
+// retryAfter returns the Retry-After header value in seconds for a rate
+// limit error from a repository host.
+func retryAfter(e doc.RateLimitError, now time.Time) string {
+	d := e.Reset.Sub(now)
+	if d < time.Second {
+		d = time.Second
+	}
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// writeAPIError writes an API error response with the given status and
+// message.
+func writeAPIError(resp web.Response, status int, message string) {
+	writeAPIErrorHeader(resp, status, message, web.Header{web.HeaderContentType: {"application/json; charset=uft-8"}})
+}
+
+func writeAPIErrorHeader(resp web.Response, status int, message string, header web.Header) {
+	var data api.ErrorResponse
+	data.Error.Message = message
+	w := resp.Start(status, header)
+	json.NewEncoder(w).Encode(&data)
+}
+
 func defaultBase(path string) string {
 	p, err := build.Default.Import(path, "", build.FindOnly)
 	if err != nil {
@@ -642,6 +864,7 @@ func defaultBase(path string) string {
 
 var (
 	db              *database.Database
+	refreshes       *refreshHub
 	robot           = flag.Bool("robot", false, "Robot mode")
 	assetsDir       = flag.String("assets", filepath.Join(defaultBase("github.com/garyburd/gddo/gddo-server"), "assets"), "Base directory for templates and static files.")
 	gzAssetsDir     = flag.String("gzassets", "", "Base directory for compressed static files.")
@@ -653,6 +876,11 @@ var (
 	crawlInterval   = flag.Duration("crawl_interval", 0, "Package updater sleeps for this duration between package updates. Zero disables updates.")
 	githubInterval  = flag.Duration("github_interval", 0, "Github updates crawler sleeps for this duration between fetches. Zero disables the crawler.")
 	secretsPath     = flag.String("secrets", "secrets.json", "Path to file containing application ids and credentials for other services.")
+	netrcPath       = flag.String("netrc", "", "Path to netrc file containing credentials for private repositories.")
+	maxPollRequests = flag.Int("max_poll_requests", 1000, "Maximum number of API requests waiting for a package refresh.")
+	pathPrefix      = flag.String("path_prefix", "", "URL path prefix where the site is mounted, for example /godoc.")
+	hostRequests    = flag.Int("host_requests", 8, "Maximum number of concurrent source file requests to a repository host.")
+	hostDelay       = flag.Duration("host_delay", 10*time.Millisecond, "Minimum time between the starts of source file requests to a repository host.")
 	secrets         struct {
 		// HTTP user agent for outbound requests
 		UserAgent string
@@ -661,8 +889,36 @@ var (
 		GithubId     string
 		GithubSecret string
 
+		// Additional Github API credentials. When the rate limit for
+		// one credential is exceeded, requests use the next.
+		GithubCredentials []struct {
+			Id     string
+			Secret string
+		}
+
 		// Google Analytics account for tracking codes.
 		GAAccount string
+
+		// Github API token for fetching project activity. Project
+		// activity is not displayed if the token is not set.
+		ActivityToken string
+
+		// Key for administrator features. The key is the value of the
+		// admin cookie. Administrator features are disabled if the key
+		// is not set.
+		AdminKey string
+
+		// HTTP basic auth credentials for private repositories, keyed by
+		// host. Credentials are only sent with HTTPS requests.
+		HostCredentials map[string]struct {
+			Username string
+			Password string
+		}
+
+		// Access tokens for the self-hosted repository services in the
+		// hosts file, keyed by host. A token in the hosts file is used
+		// instead of the token here.
+		HostTokens map[string]string
 	}
 )
 
@@ -677,17 +933,33 @@ func readSecrets() error {
 	if secrets.UserAgent != "" {
 		doc.SetUserAgent(secrets.UserAgent)
 	}
-	if secrets.GithubId != "" {
-		doc.SetGithubCredentials(secrets.GithubId, secrets.GithubSecret)
-	} else {
+	if secrets.ActivityToken != "" {
+		doc.SetActivityToken(secrets.ActivityToken)
+	}
+	doc.SetGithubCredentials(secrets.GithubId, secrets.GithubSecret)
+	for _, c := range secrets.GithubCredentials {
+		doc.AddGithubCredentials(c.Id, c.Secret)
+	}
+	if secrets.GithubId == "" && len(secrets.GithubCredentials) == 0 {
 		log.Printf("Github credentials not set in %q.", *secretsPath)
 	}
+	for host, c := range secrets.HostCredentials {
+		doc.SetCredentials(host, c.Username, c.Password)
+	}
+	if *netrcPath != "" {
+		if err := doc.ReadNetrc(*netrcPath); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func main() {
 	flag.Parse()
 	log.Printf("Starting server, os.Args=%s", strings.Join(os.Args, " "))
+	if !validPathPrefix(*pathPrefix) {
+		log.Fatalf("Path prefix %q does not start with /", *pathPrefix)
+	}
 	if err := readSecrets(); err != nil {
 		log.Fatal(err)
 	}
@@ -695,15 +967,26 @@ func main() {
 	if err := parseHTMLTemplates([][]string{
 		{"about.html", "common.html", "layout.html"},
 		{"bot.html", "common.html", "layout.html"},
+		{"card.html", "common.html"},
 		{"cmd.html", "common.html", "layout.html"},
+		{"diff.html", "common.html", "layout.html"},
+		{"diagnostics.html", "common.html", "layout.html"},
+		{"schedule.html", "common.html", "layout.html"},
+		{"analytics.html", "common.html", "layout.html"},
+		{"gates.html", "common.html", "layout.html"},
+		{"history.html", "common.html", "layout.html"},
 		{"home.html", "common.html", "layout.html"},
 		{"importers.html", "common.html", "layout.html"},
 		{"imports.html", "common.html", "layout.html"},
 		{"interface.html", "common.html", "layout.html"},
 		{"index.html", "common.html", "layout.html"},
+		{"jump.html", "common.html", "layout.html"},
+		{"landing.html", "common.html", "layout.html"},
 		{"notfound.html", "common.html", "layout.html"},
 		{"pkg.html", "common.html", "layout.html"},
+		{"reports.html", "common.html", "layout.html"},
 		{"results.html", "common.html", "layout.html"},
+		{"status.html", "common.html", "layout.html"},
 		{"std.html", "common.html", "layout.html"},
 		{"graph.html", "common.html"},
 	}); err != nil {
@@ -717,6 +1000,7 @@ func main() {
 		{"pkg.txt", "common.txt"},
 		{"results.txt", "common.txt"},
 		{"opensearch.xml"},
+		{"status.svg"},
 	}); err != nil {
 		log.Fatal(err)
 	}
@@ -735,6 +1019,78 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	doc.SetFileCache(db)
+	doc.SetHostLimits(*hostRequests, *hostDelay)
+
+	refreshes = newRefreshHub(*maxPollRequests)
+
+	if *hostsPath != "" {
+		if err := loadHostsConfig(*hostsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *redirectsPath != "" {
+		if err := loadRedirects(*redirectsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *corsOriginsPath != "" {
+		if err := loadCORSOrigins(*corsOriginsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *stabilityPhrasesPath != "" {
+		if err := loadStabilityPhrases(*stabilityPhrasesPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *stopWordsPath != "" {
+		if err := loadStopWords(*stopWordsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go reloadConfigOnSignal()
+
+	trustedProxyNets, err = parseCIDRs(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotas = newQuotaLimiter(*maxQuotaClients)
+	fileHashes = newFileHashCache(*maxFileHashes)
+	startMemoryAccountant(db)
+	moderation.store = db
+	blocklist = db
+	redirectIndex = db
+	snapshots = db
+	refDocs.store = db
+	jumpDocs.store = db
+	cards = db
+	projectDocs = db
+	methodSets = db
+	advisories.store = db
+	if *advisoriesPath != "" {
+		if err := loadAdvisories(*advisoriesPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *advisoriesURL != "" {
+		go pollAdvisories()
+	}
+	moderation.block = db.Block
+	moderation.refresh = refreshPackage
+	schedules.store = db
+	sitemaps.store = db
+	badges.store = db
+	packagePages.store = db
+	schedules.getFile = func(root, name string) ([]byte, error) {
+		return doc.GetProjectFile(httpClient, root, name)
+	}
+	declViews.store = db
+	doc.SetMonorepoStore(db)
+
+	reindexIfNeeded()
+	go backfillText()
+	go flushViewsLoop()
 
 	if *crawlInterval > 0 {
 		go crawl(*crawlInterval)
@@ -744,6 +1100,10 @@ func main() {
 		go crawlGithubUpdates(*githubInterval)
 	}
 
+	if *rankInterval > 0 {
+		go updateRanksLoop(db)
+	}
+
 	playScript, err := readPlayScript(*presentDir)
 	if err != nil {
 		log.Fatal(err)
@@ -779,8 +1139,7 @@ func main() {
 	r.Add("/google3d2f3cd4cc2bb44b.html").Get(staticConfig.FileHandler("google3d2f3cd4cc2bb44b.html"))
 	r.Add("/humans.txt").Get(staticConfig.FileHandler("humans.txt"))
 	r.Add("/robots.txt").Get(staticConfig.FileHandler("presentRobots.txt"))
-	r.Add("/search").GetFunc(serveAPISearch)
-	r.Add("/packages").GetFunc(serveAPIPackages)
+	addAPIRoutes(r, apiRoutes, apiHost)
 
 	h.Add("api.<:.*>", web.ErrorHandler(handleAPIError, web.FormAndCookieHandler(6000, false, r)))
 
@@ -789,22 +1148,47 @@ func main() {
 	r.Add("/-/about").GetFunc(serveAbout)
 	r.Add("/-/bot").GetFunc(serveBot)
 	r.Add("/-/opensearch.xml").GetFunc(serveOpenSearchDescription)
-	r.Add("/-/typeahead").GetFunc(serveTypeahead)
+	r.Add("/-/typeahead").Get(quotaHandler{cheapQuota, web.HandlerFunc(serveTypeahead)})
 	r.Add("/-/go").GetFunc(serveGoIndex)
 	r.Add("/-/index").GetFunc(serveIndex)
+	r.Add("/-/jump").GetFunc(serveJump)
 	r.Add("/-/refresh").PostFunc(serveRefresh)
+	r.Add("/-/report").PostFunc(serveReport)
+	r.Add("/-/cadence").PostFunc(serveCadence)
+	r.Add("/-/reports").GetFunc(serveReports)
+	r.Add("/-/reports/action").PostFunc(serveReportAction)
+	r.Add("/-/queue-graph").PostFunc(serveQueueGraph)
+	r.Add("/-/api-token").PostFunc(serveAPIToken)
+	r.Add("/-/flush-static").PostFunc(serveFlushFileHashes)
+	r.Add("/-/debug/vars").GetFunc(serveDebugVars)
+	r.Add("/-/status").GetFunc(serveStatus)
+	r.Add("/-/migration").GetFunc(serveMigration)
+	r.Add("/-/terms").GetFunc(serveTermStats)
+	r.Add("/-/blocklist").GetFunc(serveBlocklist)
+	r.Add("/-/blocklist/import").PostFunc(serveBlocklistImport)
+	r.Add("/-/blocklist/test").GetFunc(serveBlocklistTest)
+	r.Add("/-/redirects/test").GetFunc(serveRedirectsTest)
+	r.Add("/-/advisories").GetFunc(serveAdvisories)
+	r.Add("/-/advisories/import").PostFunc(serveAdvisoriesImport)
+	r.Add("/-/export").Post(quotaHandler{expensiveQuota, web.HandlerFunc(serveExport)})
+	r.Add("/-/export/<id:[0-9a-f]+>/bundle").GetFunc(serveExportBundle)
+	r.Add("/-/export/<id:[0-9a-f]+>").GetFunc(serveExportStatus)
+	r.Add("/-/sitemap/<n:[0-9]+>.xml.gz").GetFunc(serveSitemap)
+	r.Add("/-/src/<path:.+>").GetFunc(serveLocalSource)
+	addAPIRoutes(r, apiRoutes, siteHost)
 	r.Add("/-/static/<path:.*>").Get(staticConfig.DirectoryHandler("static"))
-	r.Add("/a/index").Get(web.RedirectHandler("/-/index", 301))
-	r.Add("/about").Get(web.RedirectHandler("/-/about", 301))
+	r.Add("/a/index").Get(web.RedirectHandler(sitePath("/-/index"), 301))
+	r.Add("/about").Get(web.RedirectHandler(sitePath("/-/about"), 301))
 	r.Add("/favicon.ico").Get(staticConfig.FileHandler("favicon.ico"))
 	r.Add("/google3d2f3cd4cc2bb44b.html").Get(staticConfig.FileHandler("google3d2f3cd4cc2bb44b.html"))
 	r.Add("/humans.txt").Get(staticConfig.FileHandler("humans.txt"))
 	r.Add("/robots.txt").Get(staticConfig.FileHandler("robots.txt"))
 	r.Add("/BingSiteAuth.xml").Get(staticConfig.FileHandler("BingSiteAuth.xml"))
+	r.Add("/sitemap.xml").GetFunc(serveSitemapIndex)
 	r.Add("/C").Get(web.RedirectHandler("http://golang.org/doc/articles/c_go_cgo.html", 301))
 	r.Add("/<path:.+>").GetFunc(servePackage)
 
-	h.Add("<:.*>", web.ErrorHandler(handleError, web.FormAndCookieHandler(1000, false, r)))
+	h.Add("<:.*>", web.ErrorHandler(handleError, deadlineHandler{stripPrefixHandler{web.FormAndCookieHandler(1000, false, r)}}))
 
 	listener, err := net.Listen("tcp", *httpAddr)
 	if err != nil {
@@ -812,7 +1196,39 @@ func main() {
 		return
 	}
 	defer listener.Close()
-	s := &server.Server{Listener: listener, Handler: h} // add logger
+
+	var localListener net.Listener
+	if *localSocket != "" {
+		mode, err := parseSocketMode(*localSocketMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		localListener, err = listenLocal(*localSocket, mode)
+		if err != nil {
+			log.Fatal("Listen local ", err)
+		}
+		defer closeLocal(localListener, *localSocket)
+		go func() {
+			s := &server.Server{Listener: localListener, Handler: newLocalHandler(apiRoutes)}
+			if err := s.Serve(); err != nil {
+				log.Printf("Local server: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("Shutting down on signal %v", <-c)
+		// Release long poll requests before exiting.
+		refreshes.close(5 * time.Second)
+		if localListener != nil {
+			closeLocal(localListener, *localSocket)
+		}
+		os.Exit(0)
+	}()
+
+	s := &server.Server{Listener: listener, Handler: blockHandler{h}} // add logger
 	err = s.Serve()
 	if err != nil {
 		log.Fatal("Server", err)
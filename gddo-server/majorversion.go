@@ -0,0 +1,55 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+type majorVersionLink struct {
+	Path    string
+	Label   string
+	Current bool
+}
+
+// majorVersionsFn returns links to the major versions of the project root
+// of pdoc, ordered by version.
+func majorVersionsFn(pdoc *doc.Package) []majorVersionLink {
+	var links []majorVersionLink
+	for _, path := range pdoc.MajorVersions {
+		links = append(links, majorVersionLink{
+			Path:    path,
+			Label:   "v" + strconv.Itoa(doc.MajorVersion(path, pdoc.ProjectRoot)),
+			Current: path == pdoc.ImportPath,
+		})
+	}
+	return links
+}
+
+// newerMajorVersionFn returns a link to the newest major version of the
+// project root of pdoc or nil if pdoc is the newest major version.
+func newerMajorVersionFn(pdoc *doc.Package) *majorVersionLink {
+	links := majorVersionsFn(pdoc)
+	if len(links) == 0 {
+		return nil
+	}
+	newest := links[len(links)-1]
+	if doc.MajorVersion(newest.Path, pdoc.ProjectRoot) <= doc.MajorVersion(pdoc.ImportPath, pdoc.ProjectRoot) {
+		return nil
+	}
+	return &newest
+}
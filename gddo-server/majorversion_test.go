@@ -0,0 +1,64 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestMajorVersionLinks(t *testing.T) {
+	const root = "github.com/user/repo"
+	versions := []string{root, root + "/v2", root + "/v3"}
+	for _, tt := range []struct {
+		path  string
+		newer string
+	}{
+		{root, root + "/v3"},
+		{root + "/v2", root + "/v3"},
+		{root + "/v3", ""},
+	} {
+		pdoc := &doc.Package{ImportPath: tt.path, ProjectRoot: root, MajorVersions: versions}
+
+		var labels []string
+		current := ""
+		for _, link := range majorVersionsFn(pdoc) {
+			labels = append(labels, link.Label)
+			if link.Current {
+				current = link.Path
+			}
+		}
+		if want := []string{"v1", "v2", "v3"}; !reflect.DeepEqual(labels, want) {
+			t.Errorf("%s: labels = %v, want %v", tt.path, labels, want)
+		}
+		if current != tt.path {
+			t.Errorf("%s: current = %q, want %q", tt.path, current, tt.path)
+		}
+
+		newer := ""
+		if link := newerMajorVersionFn(pdoc); link != nil {
+			newer = link.Path
+		}
+		if newer != tt.newer {
+			t.Errorf("%s: newer = %q, want %q", tt.path, newer, tt.newer)
+		}
+	}
+
+	if link := newerMajorVersionFn(&doc.Package{ImportPath: root, ProjectRoot: root}); link != nil {
+		t.Errorf("newer major version for package without versions = %v, want nil", link)
+	}
+}
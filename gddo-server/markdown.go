@@ -0,0 +1,470 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file renders package documentation as GitHub flavored Markdown for
+// export to wikis. Comments are converted from the go/doc conventions:
+// headings, indented code blocks, indented lists, URLs and references to
+// other packages. The output does not contain raw HTML.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// commentHeadingLevel is the level of the headings in comments. The package
+// page formats comment headings at the level of the method headings.
+const commentHeadingLevel = 3
+
+// markdownWriter writes package documentation in Markdown.
+type markdownWriter struct {
+	buf  bytes.Buffer
+	pdoc *doc.Package
+
+	// Scheme and host of the site for links to package pages.
+	base string
+
+	// Write the anchors of the package page as explicit heading ids. The
+	// {#id} syntax is supported by Pandoc, kramdown and PHP Markdown Extra,
+	// but not by GitHub.
+	ids bool
+}
+
+type commentBlockKind int
+
+const (
+	paraBlock commentBlockKind = iota
+	headingBlock
+	codeBlock
+	listBlock
+)
+
+// commentBlock is a block of comment text. The lines of a code block are
+// unindented. The lines of a list block are the items of the list with
+// the marker and continuation lines joined.
+type commentBlock struct {
+	kind    commentBlockKind
+	lines   []string
+	ordered bool
+}
+
+func isBlank(s string) bool {
+	return strings.TrimSpace(s) == ""
+}
+
+func indentLen(s string) int {
+	i := 0
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// commentBlocks splits comment text into blocks using the rules of the
+// go/doc package. Indented lines are code or, if every line at the outer
+// indent starts with a list marker, a list. A heading is a line by itself
+// that follows a paragraph and precedes a paragraph.
+func commentBlocks(text string) []commentBlock {
+	lines := strings.Split(text, "\n")
+	var blocks []commentBlock
+	var para []string
+	lastWasPara := false
+	closePara := func() {
+		if len(para) > 0 {
+			blocks = append(blocks, commentBlock{kind: paraBlock, lines: para})
+			para = nil
+			lastWasPara = true
+		}
+	}
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			closePara()
+			i++
+			continue
+		}
+		if indentLen(line) > 0 {
+			closePara()
+			j := i + 1
+			for j < len(lines) && (isBlank(lines[j]) || indentLen(lines[j]) > 0) {
+				j++
+			}
+			for isBlank(lines[j-1]) {
+				j--
+			}
+			blocks = append(blocks, indentedBlock(unindent(lines[i:j])))
+			lastWasPara = false
+			i = j
+			continue
+		}
+		if len(para) == 0 && lastWasPara && i+2 < len(lines) &&
+			isBlank(lines[i+1]) && !isBlank(lines[i+2]) && indentLen(lines[i+2]) == 0 {
+			if head := commentHeading(line); head != "" {
+				blocks = append(blocks, commentBlock{kind: headingBlock, lines: []string{head}})
+				lastWasPara = false
+				i += 2
+				continue
+			}
+		}
+		para = append(para, line)
+		i++
+	}
+	closePara()
+	return blocks
+}
+
+// unindent removes the longest common indent from lines. Blank lines are
+// made empty.
+func unindent(lines []string) []string {
+	prefix := ""
+	for _, line := range lines {
+		if isBlank(line) {
+			continue
+		}
+		indent := line[:indentLen(line)]
+		switch {
+		case prefix == "":
+			prefix = indent
+		case strings.HasPrefix(indent, prefix):
+		default:
+			for !strings.HasPrefix(indent, prefix) {
+				prefix = prefix[:len(prefix)-1]
+			}
+		}
+	}
+	result := make([]string, len(lines))
+	for i, line := range lines {
+		if !isBlank(line) {
+			result[i] = line[len(prefix):]
+		}
+	}
+	return result
+}
+
+var listMarkerPat = regexp.MustCompile(`^(?:([-*+•])|([0-9]+)[.)])[ \t]+`)
+
+// indentedBlock returns a list block for unindented lines that form a list
+// or a code block otherwise.
+func indentedBlock(lines []string) commentBlock {
+	list := commentBlock{kind: listBlock}
+	for i, line := range lines {
+		switch {
+		case line == "":
+		case indentLen(line) > 0 && len(list.lines) > 0:
+			list.lines[len(list.lines)-1] += " " + strings.TrimSpace(line)
+		default:
+			m := listMarkerPat.FindStringSubmatchIndex(line)
+			if m == nil || (i > 0 && list.ordered != (m[4] >= 0)) {
+				return commentBlock{kind: codeBlock, lines: lines}
+			}
+			list.ordered = m[4] >= 0
+			item := strings.TrimSpace(line[m[1]:])
+			if list.ordered {
+				item = line[m[4]:m[5]] + ". " + item
+			}
+			list.lines = append(list.lines, item)
+		}
+	}
+	return list
+}
+
+// commentHeading returns the line if the line is a heading by the rules of
+// the go/doc package. Otherwise, "" is returned.
+func commentHeading(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(line)
+	if !unicode.IsLetter(r) || !unicode.IsUpper(r) {
+		return ""
+	}
+	r, _ = utf8.DecodeLastRuneInString(line)
+	if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+		return ""
+	}
+	if strings.ContainsAny(line, ",.;:!?+*/=()[]{}_^°&§~%#@<\">\\") {
+		return ""
+	}
+	// Allow "'" for the possessive "'s" only.
+	for b := line; ; {
+		i := strings.Index(b, "'")
+		if i < 0 {
+			break
+		}
+		if i+1 >= len(b) || b[i+1] != 's' || (i+2 < len(b) && b[i+2] != ' ') {
+			return ""
+		}
+		b = b[i+2:]
+	}
+	return line
+}
+
+// headingID returns the id that the go/doc package assigns to a comment
+// heading.
+func headingID(text string) string {
+	id := []rune("hdr-")
+	for _, r := range text {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			r = '_'
+		}
+		id = append(id, r)
+	}
+	return string(id)
+}
+
+// escapeMarkdown escapes the characters that have a meaning in inline
+// Markdown text.
+func escapeMarkdown(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if strings.IndexRune("\\`*_{}[]<>&~|", rune(s[i])) >= 0 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+var (
+	markdownLinkPat   = regexp.MustCompile(`(?:https?|ftp)://[^\s<>"]+|RFC\s+(\d{3,4})|\bpackage\s+([-a-z0-9]\S+)`)
+	orderedLinePrefix = regexp.MustCompile(`^[0-9]+[.)]`)
+)
+
+// trimURL removes trailing punctuation and unbalanced closing parentheses
+// from a URL found in text.
+func trimURL(u string) string {
+	for {
+		switch {
+		case strings.HasSuffix(u, ")") && strings.Count(u, ")") > strings.Count(u, "("):
+		case len(u) > 0 && strings.IndexRune(".,:;?!'", rune(u[len(u)-1])) >= 0:
+		default:
+			return u
+		}
+		u = u[:len(u)-1]
+	}
+}
+
+// inline writes a paragraph of comment text. URLs are written as
+// autolinks. RFCs and import paths following the word "package" are linked
+// to the RFC and the package page.
+func (w *markdownWriter) inline(text string) {
+	text = strings.Replace(text, "``", "“", -1)
+	text = strings.Replace(text, "''", "”", -1)
+	var buf bytes.Buffer
+	for {
+		m := markdownLinkPat.FindStringSubmatchIndex(text)
+		if m == nil {
+			break
+		}
+		buf.WriteString(escapeMarkdown(text[:m[0]]))
+		end := m[1]
+		switch {
+		case m[2] >= 0:
+			n := text[m[2]:m[3]]
+			fmt.Fprintf(&buf, "[RFC %s](http://tools.ietf.org/html/rfc%s)", n, n)
+		case m[4] >= 0:
+			buf.WriteString(text[m[0]:m[4]])
+			end = m[4]
+			if p := strings.TrimRight(text[m[4]:m[5]], ".,;:!?)"); doc.IsValidPath(p) {
+				fmt.Fprintf(&buf, "[%s](%s)", escapeMarkdown(p), w.base+sitePath("/"+p))
+				end += len(p)
+			}
+		default:
+			u := trimURL(text[m[0]:m[1]])
+			buf.WriteString("<" + u + ">")
+			end = m[0] + len(u)
+		}
+		text = text[end:]
+	}
+	buf.WriteString(escapeMarkdown(text))
+
+	// Escape characters at the start of a line that start a block.
+	for _, line := range strings.Split(buf.String(), "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line != "" && strings.IndexRune("#>-+=", rune(line[0])) >= 0 {
+			w.buf.WriteByte('\\')
+		} else if m := orderedLinePrefix.FindStringIndex(line); m != nil {
+			w.buf.WriteString(line[:m[1]-1])
+			w.buf.WriteByte('\\')
+			line = line[m[1]-1:]
+		}
+		w.buf.WriteString(line)
+		w.buf.WriteByte('\n')
+	}
+}
+
+// comment writes comment text converted to Markdown.
+func (w *markdownWriter) comment(text string) {
+	for _, b := range commentBlocks(text) {
+		switch b.kind {
+		case paraBlock:
+			w.inline(strings.Join(b.lines, "\n"))
+			w.buf.WriteByte('\n')
+		case headingBlock:
+			w.heading(commentHeadingLevel, b.lines[0], headingID(b.lines[0]))
+		case codeBlock:
+			w.code("", strings.Join(b.lines, "\n"))
+		case listBlock:
+			for _, item := range b.lines {
+				if b.ordered {
+					i := strings.Index(item, " ")
+					w.buf.WriteString(item[:i+1])
+					item = item[i+1:]
+				} else {
+					w.buf.WriteString("- ")
+				}
+				w.inline(item)
+			}
+			w.buf.WriteByte('\n')
+		}
+	}
+}
+
+func (w *markdownWriter) heading(level int, text, id string) {
+	w.buf.WriteString(strings.Repeat("#", level))
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(escapeMarkdown(text))
+	if w.ids && id != "" {
+		w.buf.WriteString(" {#" + id + "}")
+	}
+	w.buf.WriteString("\n\n")
+}
+
+// code writes a fenced code block. The fence is longer than any run of
+// backquotes in the text.
+func (w *markdownWriter) code(info, text string) {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	w.buf.WriteString(fence + info + "\n")
+	w.buf.WriteString(strings.TrimRight(text, "\n"))
+	w.buf.WriteString("\n" + fence + "\n\n")
+}
+
+func (w *markdownWriter) examples(level int, object string, examples []*doc.Example) {
+	for _, e := range examples {
+		title := "Example"
+		if e.Name != "" {
+			title += " (" + e.Name + ")"
+		}
+		w.heading(level, title, doc.AnchorID(doc.ExampleAnchor, object, e.Name))
+		w.comment(e.Doc)
+		w.code("go", e.Code.Text)
+		if e.Output != "" {
+			if e.Unordered {
+				w.buf.WriteString("Unordered output:\n\n")
+			} else {
+				w.buf.WriteString("Output:\n\n")
+			}
+			w.code("", e.Output)
+		}
+	}
+}
+
+func (w *markdownWriter) funcDoc(level int, title, anchor, object string, f *doc.Func) {
+	w.heading(level, title, anchor)
+	w.code("go", f.Decl.Text)
+	w.comment(f.Doc)
+	w.examples(level+1, object, f.Examples)
+}
+
+func (w *markdownWriter) values(values []*doc.Value) {
+	for _, v := range values {
+		w.code("go", v.Decl.Text)
+		w.comment(v.Doc)
+	}
+}
+
+// packageDoc writes the documentation in the order of the package page.
+func (w *markdownWriter) packageDoc() {
+	pdoc := w.pdoc
+	if pdoc.IsCmd {
+		w.heading(1, "command "+path.Base(pdoc.ImportPath), "")
+	} else {
+		w.heading(1, "package "+pdoc.Name, "")
+		w.code("go", fmt.Sprintf("import %q", pdoc.ImportPath))
+	}
+	fmt.Fprintf(&w.buf, "Documentation: <%s>\n\n", w.base+sitePath("/"+pdoc.ImportPath))
+	w.comment(pdoc.Doc)
+	if pdoc.IsCmd {
+		return
+	}
+	w.examples(2, "package", pdoc.Examples)
+	if len(pdoc.Consts) > 0 {
+		w.heading(2, "Constants", "_constants")
+		w.values(pdoc.Consts)
+	}
+	if len(pdoc.Vars) > 0 {
+		w.heading(2, "Variables", "_variables")
+		w.values(pdoc.Vars)
+	}
+	for _, f := range pdoc.Funcs {
+		w.funcDoc(2, "func "+f.Name, doc.AnchorID(doc.DeclAnchor, f.Name), f.Name, f)
+	}
+	for _, t := range pdoc.Types {
+		w.heading(2, "type "+t.Name, doc.AnchorID(doc.DeclAnchor, t.Name))
+		w.code("go", t.Decl.Text)
+		w.comment(t.Doc)
+		w.values(t.Consts)
+		w.values(t.Vars)
+		w.examples(3, t.Name, t.Examples)
+		for _, f := range t.Funcs {
+			w.funcDoc(3, "func "+f.Name, doc.AnchorID(doc.DeclAnchor, f.Name), f.Name, f)
+		}
+		for _, f := range t.Methods {
+			w.funcDoc(3, "func ("+f.Recv+") "+f.Name, doc.AnchorID(doc.DeclAnchor, t.Name, f.Name), t.Name+"-"+f.Name, f)
+		}
+	}
+	if bugs := pdoc.Notes["BUG"]; len(bugs) > 0 {
+		w.heading(2, "Bugs", doc.AnchorID(doc.NoteAnchor, "BUG"))
+		for _, n := range bugs {
+			w.comment(n.Body)
+		}
+	}
+	if len(pdoc.Imports) > 0 {
+		w.heading(2, "Imports", "")
+		for _, p := range pdoc.Imports {
+			fmt.Fprintf(&w.buf, "- [%s](%s)\n", escapeMarkdown(p), w.base+sitePath("/"+p))
+		}
+	}
+}
+
+// renderMarkdown renders the package documentation for a request. Links
+// to package pages use the scheme and host of the request.
+func renderMarkdown(pdoc *doc.Package, req *web.Request) (web.Header, []byte) {
+	u := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}
+	w := &markdownWriter{pdoc: pdoc, base: u.String(), ids: req.Form.Get("ids") != ""}
+	w.packageDoc()
+	return web.Header{web.HeaderContentType: {"text/markdown; charset=utf-8"}}, w.buf.Bytes()
+}
+
+// serveAPIMarkdown serves package documentation as Markdown.
+func serveAPIMarkdown(resp web.Response, req *web.Request) error {
+	return servePackageAPI(resp, req, func(pdoc *doc.Package) (web.Header, []byte, error) {
+		header, p := renderMarkdown(pdoc, req)
+		return header, p, nil
+	})
+}
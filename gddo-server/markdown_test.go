@@ -0,0 +1,150 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var commentMarkdownTests = []struct {
+	name string
+	in   string
+	out  string
+}{
+	{"paragraph",
+		"Package pkg does things.\nMore things.\n",
+		"Package pkg does things.\nMore things.\n\n"},
+	{"escape",
+		"Use *p and a_b, [x] or <tag> & `q`.\n",
+		"Use \\*p and a\\_b, \\[x\\] or \\<tag\\> \\& \\`q\\`.\n\n"},
+	{"quotes",
+		"Say ``hello''.\n",
+		"Say “hello”.\n\n"},
+	{"line start",
+		"Text\n# not a heading\n- not a list\n2013. A year\n> not a quote\n",
+		"Text\n\\# not a heading\n\\- not a list\n2013\\. A year\n\\> not a quote\n\n"},
+	{"heading",
+		"Intro.\n\nUsing the Package\n\nText.\n",
+		"Intro.\n\n### Using the Package\n\nText.\n\n"},
+	{"heading possessive",
+		"Intro.\n\nThe Package's Rules\n\nText.\n",
+		"Intro.\n\n### The Package's Rules\n\nText.\n\n"},
+	{"heading first line",
+		"Using the Package\n\nText.\n",
+		"Using the Package\n\nText.\n\n"},
+	{"heading punctuation",
+		"Intro.\n\nThis is a sentence.\n\nText.\n",
+		"Intro.\n\nThis is a sentence.\n\nText.\n\n"},
+	{"heading before code",
+		"Intro.\n\nExample Usage\n\n\tx := 1\n",
+		"Intro.\n\nExample Usage\n\n```\nx := 1\n```\n\n"},
+	{"heading lower case",
+		"Intro.\n\nusing the package\n\nText.\n",
+		"Intro.\n\nusing the package\n\nText.\n\n"},
+	{"code",
+		"Example:\n\n\tif x {\n\t\treturn\n\t}\n\n\ty := 2\n\nDone.\n",
+		"Example:\n\n```\nif x {\n\treturn\n}\n\ny := 2\n```\n\nDone.\n\n"},
+	{"code spaces",
+		"Example:\n   a *b\n    c_d\n",
+		"Example:\n\n```\na *b\n c_d\n```\n\n"},
+	{"code fence",
+		"Example:\n\n\t```\n",
+		"Example:\n\n````\n```\n````\n\n"},
+	{"list",
+		"Modes:\n\n  - read\n  - write and\n    append\n",
+		"Modes:\n\n- read\n- write and append\n\n"},
+	{"ordered list",
+		"Steps:\n\n  1. Get.\n  2) Build *it*.\n",
+		"Steps:\n\n1. Get.\n2. Build \\*it\\*.\n\n"},
+	{"mixed list",
+		"Steps:\n\n  1. Get.\n  - Build.\n",
+		"Steps:\n\n```\n1. Get.\n- Build.\n```\n\n"},
+	{"not list",
+		"Code:\n\n  - x\n  y := -x\n",
+		"Code:\n\n```\n- x\ny := -x\n```\n\n"},
+	{"url",
+		"See http://example.com/a_b(c).\n",
+		"See <http://example.com/a_b(c)>.\n\n"},
+	{"url parens",
+		"(see https://example.com/x?y=z)\n",
+		"(see <https://example.com/x?y=z>)\n\n"},
+	{"url in code",
+		"Example:\n\n\tget http://example.com/\n",
+		"Example:\n\n```\nget http://example.com/\n```\n\n"},
+	{"rfc",
+		"As in RFC 2616.\n",
+		"As in [RFC 2616](http://tools.ietf.org/html/rfc2616).\n\n"},
+	{"package",
+		"See package github.com/user/other.\n",
+		"See package [github.com/user/other](http://example.com/github.com/user/other).\n\n"},
+	{"package not path",
+		"The package main_x.\n",
+		"The package main\\_x.\n\n"},
+}
+
+func TestCommentMarkdown(t *testing.T) {
+	for _, tt := range commentMarkdownTests {
+		w := &markdownWriter{base: "http://example.com"}
+		w.comment(tt.in)
+		if s := w.buf.String(); s != tt.out {
+			t.Errorf("%s: comment(%q) =\n%q\nwant\n%q", tt.name, tt.in, s, tt.out)
+		}
+	}
+}
+
+func TestCommentMarkdownHeadingID(t *testing.T) {
+	w := &markdownWriter{ids: true}
+	w.comment("Intro.\n\nThe Package's Rules\n\nText.\n")
+	if s := w.buf.String(); !strings.Contains(s, "### The Package's Rules {#hdr-The_Package_s_Rules}\n") {
+		t.Errorf("comment() = %q, want heading with id", s)
+	}
+}
+
+func TestPackageMarkdown(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	pdoc.Doc = "Package pkg does things.\n"
+	pdoc.Imports = []string{"io"}
+	pdoc.Types[0].Methods[0].Examples = []*doc.Example{{
+		Name:   "basic",
+		Code:   doc.Code{Text: "fmt.Println(b.Len())"},
+		Output: "0\n",
+	}}
+	w := &markdownWriter{pdoc: pdoc, base: "http://example.com", ids: true}
+	w.packageDoc()
+	const want = "# package pkg\n\n" +
+		"```go\nimport \"github.com/user/repo/pkg\"\n```\n\n" +
+		"Documentation: <http://example.com/github.com/user/repo/pkg>\n\n" +
+		"Package pkg does things.\n\n" +
+		"## func Copy {#Copy}\n\n" +
+		"```go\nfunc Copy(dst io.Writer, src io.Reader) Buffer\n```\n\n" +
+		"Copy copies src to dst. See package [github.com/user/other](http://example.com/github.com/user/other) for more.\n\n" +
+		"## type Buffer {#Buffer}\n\n" +
+		"```go\ntype Buffer struct{}\n```\n\n" +
+		"Buffer is a buffer.\n\n" +
+		"### func (b \\*Buffer) Len {#Buffer.Len}\n\n" +
+		"```go\nfunc (b *Buffer) Len() int\n```\n\n" +
+		"Len returns the length.\n\n" +
+		"#### Example (basic) {#_ex_Buffer-Len-basic}\n\n" +
+		"```go\nfmt.Println(b.Len())\n```\n\n" +
+		"Output:\n\n```\n0\n```\n\n" +
+		"## Imports\n\n" +
+		"- [io](http://example.com/io)\n"
+	if s := w.buf.String(); s != want {
+		t.Errorf("packageDoc() =\n%s\nwant\n%s", s, want)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The memory accountant keeps the in-memory caches within a soft limit on
+// the heap. Each cache is bounded by its own entry count, but the bounds do
+// not account for the other caches or the size of the entries. The
+// accountant periodically compares the heap in use with the limit and asks
+// every cache to evict the same fraction of its entries so that the caches
+// give up memory in proportion to their size.
+
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/gddo/database"
+)
+
+var memoryLimit = flag.Int64("memory-limit", 0, "Soft limit in bytes on the heap in use. Caches evict entries in proportion to their size when the limit is exceeded. Zero disables the limit.")
+
+// memoryCheckInterval is the time between checks of the heap in use.
+const memoryCheckInterval = 10 * time.Second
+
+// accountedCache is a cache registered with the memory accountant.
+type accountedCache interface {
+	// Usage returns the number of entries in the cache and the
+	// approximate size in bytes of an entry sampled from the cache.
+	Usage() (entries, entrySize int)
+
+	// Evict removes about the given fraction of the entries from the
+	// cache and returns the number of entries removed.
+	Evict(fraction float64) int
+}
+
+type accountedCacheEntry struct {
+	name      string
+	cache     accountedCache
+	evictions int // eviction requests
+	evicted   int // entries removed
+}
+
+// accountedStore is persistent storage reported with the caches. The
+// accountant does not evict from stores; stores bound their own size.
+type accountedStore interface {
+	// StorageUsage returns the number of stored items and their total
+	// size in bytes.
+	StorageUsage() (items int, size int64, err error)
+}
+
+type accountedStoreEntry struct {
+	name  string
+	store accountedStore
+}
+
+type memoryAccountant struct {
+	limit    int64
+	heapUsed func() int64
+
+	mu       sync.Mutex
+	caches   []*accountedCacheEntry
+	stores   []*accountedStoreEntry
+	lastHeap int64
+}
+
+func newMemoryAccountant(limit int64) *memoryAccountant {
+	return &memoryAccountant{limit: limit, heapUsed: heapInUse}
+}
+
+func heapInUse() int64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapInuse)
+}
+
+// register adds a cache to the accountant.
+func (a *memoryAccountant) register(name string, c accountedCache) {
+	a.mu.Lock()
+	a.caches = append(a.caches, &accountedCacheEntry{name: name, cache: c})
+	a.mu.Unlock()
+}
+
+// registerStore adds a store to the accountant.
+func (a *memoryAccountant) registerStore(name string, s accountedStore) {
+	a.mu.Lock()
+	a.stores = append(a.stores, &accountedStoreEntry{name: name, store: s})
+	a.mu.Unlock()
+}
+
+// usage returns the memory usage of the registered caches sorted by name.
+func (a *memoryAccountant) usage() []api.CacheUsage {
+	a.mu.Lock()
+	caches := append([]*accountedCacheEntry(nil), a.caches...)
+	a.mu.Unlock()
+	var result []api.CacheUsage
+	for _, e := range caches {
+		entries, size := e.cache.Usage()
+		a.mu.Lock()
+		result = append(result, api.CacheUsage{
+			Name:      e.name,
+			Entries:   entries,
+			Bytes:     int64(entries) * int64(size),
+			Evictions: e.evictions,
+			Evicted:   e.evicted,
+		})
+		a.mu.Unlock()
+	}
+	sort.Sort(cacheUsageByName(result))
+	return result
+}
+
+// storage returns the usage of the registered stores sorted by name. Stores
+// that fail to report are logged and omitted.
+func (a *memoryAccountant) storage() []api.StorageUsage {
+	a.mu.Lock()
+	stores := append([]*accountedStoreEntry(nil), a.stores...)
+	a.mu.Unlock()
+	var result []api.StorageUsage
+	for _, e := range stores {
+		items, size, err := e.store.StorageUsage()
+		if err != nil {
+			log.Printf("ERROR storage usage of %s: %v", e.name, err)
+			continue
+		}
+		result = append(result, api.StorageUsage{Name: e.name, Items: items, Bytes: size})
+	}
+	sort.Sort(storageUsageByName(result))
+	return result
+}
+
+type storageUsageByName []api.StorageUsage
+
+func (p storageUsageByName) Len() int           { return len(p) }
+func (p storageUsageByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p storageUsageByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+
+type cacheUsageByName []api.CacheUsage
+
+func (p cacheUsageByName) Len() int           { return len(p) }
+func (p cacheUsageByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p cacheUsageByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+
+// check compares the heap in use with the limit. If the limit is exceeded,
+// then check asks every cache to evict the fraction of its entries that
+// frees the excess when the caches account for the excess.
+func (a *memoryAccountant) check() {
+	heap := a.heapUsed()
+	a.mu.Lock()
+	a.lastHeap = heap
+	caches := append([]*accountedCacheEntry(nil), a.caches...)
+	a.mu.Unlock()
+
+	if a.limit <= 0 || heap <= a.limit {
+		return
+	}
+	var total int64
+	for _, e := range caches {
+		entries, size := e.cache.Usage()
+		total += int64(entries) * int64(size)
+	}
+	if total == 0 {
+		return
+	}
+	fraction := float64(heap-a.limit) / float64(total)
+	if fraction > 1 {
+		fraction = 1
+	}
+	log.Printf("Heap in use %d exceeds limit %d, evicting %.2f of %d cached bytes", heap, a.limit, fraction, total)
+	for _, e := range caches {
+		n := e.cache.Evict(fraction)
+		a.mu.Lock()
+		e.evictions++
+		e.evicted += n
+		a.mu.Unlock()
+	}
+}
+
+// run checks the heap in use for the life of the process. Request
+// handlers do not wait for the accountant; eviction runs in this
+// goroutine.
+func (a *memoryAccountant) run() {
+	for {
+		time.Sleep(memoryCheckInterval)
+		a.check()
+	}
+}
+
+func (a *memoryAccountant) status() api.MemoryStatus {
+	caches := a.usage()
+	storage := a.storage()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return api.MemoryStatus{Limit: a.limit, Heap: a.lastHeap, Caches: caches, Storage: storage}
+}
+
+// byteSizeFn formats a number of bytes for the status page.
+func byteSizeFn(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// memory is replaced in main with an accountant for the limit set by the
+// memory-limit flag.
+var memory = newMemoryAccountant(0)
+
+func init() {
+	expvar.Publish("memory", expvar.Func(func() interface{} { return memory.status() }))
+}
+
+// startMemoryAccountant registers the caches and starts the accountant.
+func startMemoryAccountant(db *database.Database) {
+	memory = newMemoryAccountant(*memoryLimit)
+	memory.register("fragments", &fragmentCache)
+	memory.register("landingPages", &landingCache)
+	memory.register("fileHashes", fileHashes)
+	memory.register("querySessions", querySessionCache{db})
+	memory.registerStore("snapshots", snapshotStorage{db})
+	memory.registerStore("methodSets", methodSetStorage{db})
+	go memory.run()
+}
+
+// querySessionCache adapts the database query sessions to the accountant.
+type querySessionCache struct {
+	db *database.Database
+}
+
+func (c querySessionCache) Usage() (int, int)          { return c.db.QuerySessionUsage() }
+func (c querySessionCache) Evict(fraction float64) int { return c.db.EvictQuerySessions(fraction) }
+
+// snapshotStorage adapts the database package snapshots to the accountant.
+type snapshotStorage struct {
+	db *database.Database
+}
+
+func (s snapshotStorage) StorageUsage() (int, int64, error) { return s.db.SnapshotUsage() }
@@ -0,0 +1,113 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/garyburd/gddo/api"
+)
+
+type fakeCache struct {
+	entries, size int
+	fractions     []float64
+}
+
+func (c *fakeCache) Usage() (int, int) { return c.entries, c.size }
+
+func (c *fakeCache) Evict(fraction float64) int {
+	c.fractions = append(c.fractions, fraction)
+	n := int(math.Ceil(fraction * float64(c.entries)))
+	c.entries -= n
+	return n
+}
+
+func TestMemoryAccountant(t *testing.T) {
+	a := newMemoryAccountant(1000)
+	heap := int64(900)
+	a.heapUsed = func() int64 { return heap }
+	big := &fakeCache{entries: 100, size: 30}
+	small := &fakeCache{entries: 10, size: 100}
+	a.register("small", small)
+	a.register("big", big)
+
+	// Under the limit.
+	a.check()
+	if len(big.fractions) != 0 || len(small.fractions) != 0 {
+		t.Fatalf("eviction requested under the limit")
+	}
+
+	// The 800 bytes over the limit are 20% of the 4000 cached bytes. Both
+	// caches evict 20% of their entries.
+	heap = 1800
+	a.check()
+	for _, c := range []*fakeCache{big, small} {
+		if len(c.fractions) != 1 || math.Abs(c.fractions[0]-0.2) > 1e-9 {
+			t.Errorf("fractions = %v, want [0.2]", c.fractions)
+		}
+	}
+	if big.entries != 80 || small.entries != 8 {
+		t.Errorf("entries = %d, %d, want 80, 8", big.entries, small.entries)
+	}
+
+	// The fraction is capped when the excess is larger than the caches.
+	heap = 100000
+	a.check()
+	if f := big.fractions[1]; f != 1 {
+		t.Errorf("fraction = %v, want 1", f)
+	}
+
+	status := a.status()
+	if status.Heap != 100000 || status.Limit != 1000 {
+		t.Errorf("status heap, limit = %d, %d, want 100000, 1000", status.Heap, status.Limit)
+	}
+	want := []api.CacheUsage{
+		{Name: "big", Entries: 0, Bytes: 0, Evictions: 2, Evicted: 100},
+		{Name: "small", Entries: 0, Bytes: 0, Evictions: 2, Evicted: 10},
+	}
+	if len(status.Caches) != len(want) {
+		t.Fatalf("status caches = %+v, want %+v", status.Caches, want)
+	}
+	for i := range want {
+		if status.Caches[i] != want[i] {
+			t.Errorf("status cache %d = %+v, want %+v", i, status.Caches[i], want[i])
+		}
+	}
+}
+
+func TestMemoryAccountantNoLimit(t *testing.T) {
+	a := newMemoryAccountant(0)
+	a.heapUsed = func() int64 { return 1 << 40 }
+	c := &fakeCache{entries: 10, size: 10}
+	a.register("c", c)
+	a.check()
+	if len(c.fractions) != 0 {
+		t.Errorf("eviction requested without a limit")
+	}
+}
+
+func TestFragmentCacheEvict(t *testing.T) {
+	c := fragmentCacheMap{m: make(map[string]*fragmentCacheEntry)}
+	for _, path := range []string{"a", "b", "c", "d"} {
+		c.m[path] = &fragmentCacheEntry{version: "1", fragments: map[string][]byte{"X": []byte("abc")}}
+	}
+	if n, size := c.Usage(); n != 4 || size != 6 {
+		t.Errorf("Usage() = %d, %d, want 4, 6", n, size)
+	}
+	if n := c.Evict(0.5); n != 2 || len(c.m) != 2 {
+		t.Errorf("Evict(0.5) = %d with %d left, want 2 with 2 left", n, len(c.m))
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+)
+
+// monorepoSubdirs returns the directories listed on the page for pdoc. The
+// page for a monorepo package lists the direct subdirectories of the
+// package until the reader expands the listing. More is true if the
+// listing omits nested directories.
+func monorepoSubdirs(pdoc *doc.Package, pkgs []database.Package, expand bool) (subdirs []database.Package, more bool) {
+	if !pdoc.Monorepo || expand {
+		return pkgs, false
+	}
+	prefix := pdoc.ImportPath + "/"
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		name := pkg.Path[len(prefix):]
+		if strings.Contains(name, "/") {
+			more = true
+			continue
+		}
+		seen[name] = true
+		subdirs = append(subdirs, pkg)
+	}
+
+	// Directories that are not crawled yet are listed without a synopsis.
+	for _, name := range pdoc.Subdirectories {
+		if !seen[name] {
+			subdirs = append(subdirs, database.Package{Path: prefix + name})
+		}
+	}
+	sort.Sort(&byPath{subdirs, make([]int, len(subdirs))})
+	return subdirs, more
+}
+
+// listedPackage is a row in a directory or importer listing. The listing
+// shows Display and carries the full path in a tooltip.
+type listedPackage struct {
+	database.Package
+	Display string
+}
+
+// listPackages returns the rows of a listing of pkgs with paths shown
+// relative to prefix.
+func listPackages(pkgs []database.Package, prefix string) []listedPackage {
+	listing := make([]listedPackage, len(pkgs))
+	for i, pkg := range pkgs {
+		listing[i] = listedPackage{Package: pkg, Display: trimPathPrefixFn(pkg.Path, prefix)}
+	}
+	return listing
+}
+
+// refreshNeeded returns true if the crawler should refresh the stored
+// documentation for pdoc. Packages in a monorepo are refreshed only after a
+// reader views the package.
+func refreshNeeded(pdoc *doc.Package, lastViewed time.Time) bool {
+	return !pdoc.Monorepo || lastViewed.After(pdoc.Updated)
+}
@@ -0,0 +1,75 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestMonorepoSubdirs(t *testing.T) {
+	pkgs := []database.Package{
+		{Path: "github.com/org/big/a", Synopsis: "Package a."},
+		{Path: "github.com/org/big/a/c", Synopsis: "Package c."},
+		{Path: "github.com/org/big/a/c/d", Synopsis: "Package d."},
+	}
+	pdoc := &doc.Package{
+		ImportPath:     "github.com/org/big",
+		Monorepo:       true,
+		Subdirectories: []string{"a", "b"},
+	}
+
+	subdirs, more := monorepoSubdirs(pdoc, pkgs, false)
+	want := []database.Package{
+		{Path: "github.com/org/big/a", Synopsis: "Package a."},
+		{Path: "github.com/org/big/b"},
+	}
+	if !reflect.DeepEqual(subdirs, want) || !more {
+		t.Errorf("monorepoSubdirs() = %v, %v, want %v, true", subdirs, more, want)
+	}
+
+	if subdirs, more := monorepoSubdirs(pdoc, pkgs, true); !reflect.DeepEqual(subdirs, pkgs) || more {
+		t.Errorf("monorepoSubdirs(expand) = %v, %v, want all packages", subdirs, more)
+	}
+
+	pdoc.Monorepo = false
+	if subdirs, more := monorepoSubdirs(pdoc, pkgs, false); !reflect.DeepEqual(subdirs, pkgs) || more {
+		t.Errorf("monorepoSubdirs(not monorepo) = %v, %v, want all packages", subdirs, more)
+	}
+}
+
+var refreshNeededTests = []struct {
+	monorepo   bool
+	lastViewed time.Time
+	needed     bool
+}{
+	{false, time.Time{}, true},
+	{true, time.Time{}, false},
+	{true, time.Unix(50, 0), false},
+	{true, time.Unix(150, 0), true},
+}
+
+func TestRefreshNeeded(t *testing.T) {
+	for _, tt := range refreshNeededTests {
+		pdoc := &doc.Package{Monorepo: tt.monorepo, Updated: time.Unix(100, 0)}
+		if needed := refreshNeeded(pdoc, tt.lastViewed); needed != tt.needed {
+			t.Errorf("refreshNeeded(monorepo=%v, lastViewed=%v) = %v, want %v", tt.monorepo, tt.lastViewed.Unix(), needed, tt.needed)
+		}
+	}
+}
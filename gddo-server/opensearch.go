@@ -0,0 +1,96 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements browser search integration: the OpenSearch
+// description, the link that lets browsers discover it and the "I'm feeling
+// lucky" search that goes directly to the best result.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	htemp "html/template"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+func serveOpenSearchDescription(resp web.Response, req *web.Request) error {
+	return executeTemplate(resp, req, "opensearch.xml", web.StatusOK, nil, map[string]string{
+		"Scheme": requestScheme(req),
+		"Host":   req.URL.Host + sitePath(""),
+	})
+}
+
+// requestScheme returns the URL scheme used by the client. The
+// X-Forwarded-Proto header is used only for requests from trusted proxies.
+func requestScheme(req *web.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if isTrustedProxy(ip, trustedProxyNets) {
+		switch s := strings.ToLower(strings.TrimSpace(req.Header.Get("X-Forwarded-Proto"))); s {
+		case "http", "https":
+			return s
+		}
+	}
+	if req.URL.Scheme == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// xmlFn escapes s for use in XML text and attribute values.
+func xmlFn(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// openSearchLinkFn returns the link element for discovery of the OpenSearch
+// description.
+func openSearchLinkFn() htemp.HTML {
+	return htemp.HTML(`<link rel="search" type="application/opensearchdescription+xml" title="GoDoc" href="` +
+		htemp.HTMLEscapeString(sitePath("/-/opensearch.xml")) + `">`)
+}
+
+// luckyResult returns the path of the search result to redirect to for an
+// "I'm feeling lucky" search. The top result is used when it is the only
+// result or when it is the only result with a package name or import path
+// equal to the query.
+func luckyResult(q string, pkgs []database.Package) (string, bool) {
+	if len(pkgs) == 0 {
+		return "", false
+	}
+	if len(pkgs) == 1 {
+		return pkgs[0].Path, true
+	}
+	strong := func(p string) bool {
+		return strings.EqualFold(p, q) || strings.EqualFold(path.Base(p), q)
+	}
+	if !strong(pkgs[0].Path) {
+		return "", false
+	}
+	for _, pkg := range pkgs[1:] {
+		if strong(pkg.Path) {
+			return "", false
+		}
+	}
+	return pkgs[0].Path, true
+}
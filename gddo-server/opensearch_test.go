@@ -0,0 +1,118 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+func TestOpenSearchDescription(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseTextTemplates([][]string{{"opensearch.xml"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(nets []*net.IPNet) { trustedProxyNets = nets }(trustedProxyNets)
+	trustedProxyNets, _ = parseCIDRs("10.0.0.0/8")
+
+	req := &web.Request{
+		URL:        &url.URL{Host: `godoc.example.com&"x"`, Path: "/-/opensearch.xml"},
+		RemoteAddr: "10.1.2.3:1234",
+		Header:     web.Header{"X-Forwarded-Proto": {"https"}},
+	}
+	var resp testResponse
+	if err := serveOpenSearchDescription(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	var d struct {
+		URLs []struct {
+			Template string `xml:"template,attr"`
+		} `xml:"Url"`
+	}
+	if err := xml.Unmarshal(resp.buf.Bytes(), &d); err != nil {
+		t.Fatalf("description is not valid XML: %v\n%s", err, resp.buf.Bytes())
+	}
+	if len(d.URLs) != 1 || d.URLs[0].Template != `https://godoc.example.com&"x"/?q={searchTerms}` {
+		t.Errorf("Url templates = %+v, want only https://godoc.example.com&\"x\"/?q={searchTerms}", d.URLs)
+	}
+}
+
+var requestSchemeTests = []struct {
+	remoteAddr string
+	scheme     string
+	forwarded  string
+	want       string
+}{
+	{"10.1.2.3:1234", "", "https", "https"},
+	{"10.1.2.3:1234", "", "HTTP", "http"},
+	{"10.1.2.3:1234", "https", "gopher", "https"},
+	{"192.0.2.1:1234", "", "https", "http"},
+	{"192.0.2.1:1234", "https", "", "https"},
+}
+
+func TestRequestScheme(t *testing.T) {
+	defer func(nets []*net.IPNet) { trustedProxyNets = nets }(trustedProxyNets)
+	trustedProxyNets, _ = parseCIDRs("10.0.0.0/8")
+	for _, tt := range requestSchemeTests {
+		req := &web.Request{
+			URL:        &url.URL{Scheme: tt.scheme},
+			RemoteAddr: tt.remoteAddr,
+			Header:     web.Header{"X-Forwarded-Proto": {tt.forwarded}},
+		}
+		if got := requestScheme(req); got != tt.want {
+			t.Errorf("requestScheme(%s, %q, %q) = %q, want %q", tt.remoteAddr, tt.scheme, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestOpenSearchLink(t *testing.T) {
+	defer func(p string) { *pathPrefix = p }(*pathPrefix)
+	*pathPrefix = "/godoc"
+	if s := string(openSearchLinkFn()); !strings.Contains(s, `rel="search"`) || !strings.Contains(s, `href="/godoc/-/opensearch.xml"`) {
+		t.Errorf("openSearchLinkFn() = %s", s)
+	}
+}
+
+var luckyResultTests = []struct {
+	q     string
+	paths []string
+	want  string
+}{
+	{"yaml", nil, ""},
+	{"yaml", []string{"github.com/a/goyaml"}, "github.com/a/goyaml"},
+	{"yaml", []string{"github.com/a/yaml", "github.com/b/goyaml"}, "github.com/a/yaml"},
+	{"yaml", []string{"github.com/a/yaml", "github.com/b/yaml"}, ""},
+	{"yaml", []string{"github.com/b/goyaml", "github.com/a/yaml"}, ""},
+	{"JSON", []string{"encoding/json", "github.com/a/jsonx"}, "encoding/json"},
+}
+
+func TestLuckyResult(t *testing.T) {
+	for _, tt := range luckyResultTests {
+		var pkgs []database.Package
+		for _, p := range tt.paths {
+			pkgs = append(pkgs, database.Package{Path: p})
+		}
+		got, ok := luckyResult(tt.q, pkgs)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("luckyResult(%q, %v) = %q, %v, want %q", tt.q, tt.paths, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements conditional and long poll requests for the package
+// API. Clients send the ETag from a previous response in the If-None-Match
+// header and optionally ask the server to wait for a refresh of the package
+// with the wait parameter.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// maxPollWait is the maximum time that a request waits for a refresh.
+const maxPollWait = 60 * time.Second
+
+// refreshHub notifies waiting requests when a crawl stores a package. Only
+// crawls by this server instance are seen by the hub. Requests waiting on
+// a package refreshed by another instance time out and the client gets the
+// new version on the next request.
+type refreshHub struct {
+	mu      sync.Mutex
+	max     int
+	waiters map[string]map[*refreshWaiter]bool
+	n       int
+	closed  bool
+	done    chan struct{}
+	active  sync.WaitGroup
+}
+
+func newRefreshHub(max int) *refreshHub {
+	return &refreshHub{
+		max:     max,
+		waiters: make(map[string]map[*refreshWaiter]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+// refreshWaiter is a request waiting for a refresh of a package.
+type refreshWaiter struct {
+	hub    *refreshHub
+	path   string
+	signal chan struct{}
+	etag   string // protected by hub.mu
+}
+
+// subscribe adds a waiter for the package with the given import path. The
+// caller must call cancel when done with the waiter. Subscribe returns false
+// if the hub is full or closed.
+func (h *refreshHub) subscribe(importPath string) (*refreshWaiter, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || h.n >= h.max {
+		return nil, false
+	}
+	w := &refreshWaiter{hub: h, path: importPath, signal: make(chan struct{}, 1)}
+	m := h.waiters[importPath]
+	if m == nil {
+		m = make(map[*refreshWaiter]bool)
+		h.waiters[importPath] = m
+	}
+	m[w] = true
+	h.n++
+	h.active.Add(1)
+	return w, true
+}
+
+// publish notifies the waiters for a package that the package was stored
+// with the given etag. The etag is "" if the package was deleted.
+func (h *refreshHub) publish(importPath, etag string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.waiters[importPath] {
+		w.etag = etag
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close releases all waiters and rejects new subscriptions. Close returns
+// after the requests holding waiters finish or after timeout.
+func (h *refreshHub) close(timeout time.Duration) {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.done)
+	}
+	h.mu.Unlock()
+
+	c := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(c)
+	}()
+	select {
+	case <-c:
+	case <-time.After(timeout):
+	}
+}
+
+// wait waits for the package to be stored with an etag different from the
+// given etag. Wait returns false on timeout or when the hub is closed.
+func (w *refreshWaiter) wait(etag string, timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.signal:
+			w.hub.mu.Lock()
+			changed := w.etag != etag
+			w.hub.mu.Unlock()
+			if changed {
+				return true
+			}
+		case <-t.C:
+			return false
+		case <-w.hub.done:
+			return false
+		}
+	}
+}
+
+func (w *refreshWaiter) cancel() {
+	h := w.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := h.waiters[w.path]
+	if !m[w] {
+		return
+	}
+	delete(m, w)
+	if len(m) == 0 {
+		delete(h.waiters, w.path)
+	}
+	h.n--
+	h.active.Done()
+}
+
+// quoteETag returns the value of the ETag header for a package etag.
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
+
+// etagMatches returns true if the value of an If-None-Match header matches
+// the quoted etag.
+func etagMatches(header, etag string) bool {
+	for _, s := range strings.Split(header, ",") {
+		s = strings.TrimSpace(s)
+		if s == "*" || strings.TrimPrefix(s, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// pollWait returns the wait time for the wait request parameter.
+func pollWait(s string) time.Duration {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	d := time.Duration(n) * time.Second
+	if d > maxPollWait {
+		d = maxPollWait
+	}
+	return d
+}
+
+// packageRenderer returns the header and body of an API response for a
+// package. The header is nil if the requested resource is not found.
+type packageRenderer func(pdoc *doc.Package) (web.Header, []byte, error)
+
+// serveConditional serves an API response for the package with the given
+// import path. The get function returns the current version of the package.
+func serveConditional(resp web.Response, req *web.Request, hub *refreshHub, importPath string, get func() (*doc.Package, error), render packageRenderer) error {
+	pdoc, err := get()
+	if err != nil {
+		return err
+	}
+	if pdoc == nil || pdoc.Name == "" {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+
+	if pdoc.Etag != "" && etagMatches(req.Header.Get(web.HeaderIfNoneMatch), quoteETag(pdoc.Etag)) {
+		wait := pollWait(req.Form.Get("wait"))
+		if wait == 0 {
+			return notModified(resp, pdoc.Etag)
+		}
+		w, ok := hub.subscribe(importPath)
+		if !ok {
+			return &web.Error{Status: web.StatusServiceUnavailable}
+		}
+		// The waiter is canceled after the response is written so that
+		// shutdown waits for the response.
+		defer w.cancel()
+
+		// A refresh can complete between the first get and the subscribe.
+		etag := pdoc.Etag
+		if pdoc, err = get(); err != nil {
+			return err
+		}
+		if pdoc != nil && pdoc.Etag == etag {
+			if !w.wait(etag, wait) {
+				return notModified(resp, etag)
+			}
+			if pdoc, err = get(); err != nil {
+				return err
+			}
+		}
+		if pdoc == nil || pdoc.Name == "" {
+			return &web.Error{Status: web.StatusNotFound}
+		}
+		if pdoc.Etag == etag {
+			return notModified(resp, etag)
+		}
+	}
+
+	header, p, err := render(pdoc)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	if pdoc.Etag != "" {
+		header.Set(web.HeaderETag, quoteETag(pdoc.Etag))
+	}
+	_, err = resp.Start(web.StatusOK, header).Write(p)
+	return err
+}
+
+func notModified(resp web.Response, etag string) error {
+	resp.Start(web.StatusNotModified, web.Header{web.HeaderETag: {quoteETag(etag)}})
+	return nil
+}
+
+// servePackageAPI serves an API response for the package in the path route
+// variable.
+func servePackageAPI(resp web.Response, req *web.Request, render packageRenderer) error {
+	importPath := req.RouteVars["path"]
+	get := func() (*doc.Package, error) {
+		pdoc, _, err := getDoc(importPath, queryRequest)
+		return pdoc, err
+	}
+	return serveConditional(resp, req, refreshes, importPath, get, render)
+}
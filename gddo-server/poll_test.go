@@ -0,0 +1,258 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var etagMatchesTests = []struct {
+	header string
+	match  bool
+}{
+	{``, false},
+	{`"git-1"`, true},
+	{`W/"git-1"`, true},
+	{`"git-0", "git-1"`, true},
+	{`*`, true},
+	{`"git-2"`, false},
+	{`git-1`, false},
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tt := range etagMatchesTests {
+		if match := etagMatches(tt.header, `"git-1"`); match != tt.match {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, match, tt.match)
+		}
+	}
+}
+
+var pollWaitTests = []struct {
+	s string
+	d time.Duration
+}{
+	{"", 0},
+	{"x", 0},
+	{"-1", 0},
+	{"30", 30 * time.Second},
+	{"3600", maxPollWait},
+}
+
+func TestPollWait(t *testing.T) {
+	for _, tt := range pollWaitTests {
+		if d := pollWait(tt.s); d != tt.d {
+			t.Errorf("pollWait(%q) = %v, want %v", tt.s, d, tt.d)
+		}
+	}
+}
+
+// pollTestPackage is a package that changes when refreshed by a test.
+type pollTestPackage struct {
+	mu   sync.Mutex
+	etag string
+}
+
+func (p *pollTestPackage) get() (*doc.Package, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &doc.Package{ImportPath: "example.com/pkg", Name: "pkg", Etag: p.etag}, nil
+}
+
+func (p *pollTestPackage) refresh(hub *refreshHub, etag string) {
+	p.mu.Lock()
+	p.etag = etag
+	p.mu.Unlock()
+	hub.publish("example.com/pkg", etag)
+}
+
+func renderPollTestPackage(pdoc *doc.Package) (web.Header, []byte, error) {
+	return web.Header{web.HeaderContentType: {"text/plain; charset=utf-8"}}, []byte(pdoc.Etag), nil
+}
+
+func servePollTest(hub *refreshHub, p *pollTestPackage, ifNoneMatch, wait string) (*testResponse, error) {
+	req := &web.Request{
+		Header: web.Header{},
+		Form:   url.Values{},
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set(web.HeaderIfNoneMatch, ifNoneMatch)
+	}
+	if wait != "" {
+		req.Form.Set("wait", wait)
+	}
+	resp := &testResponse{}
+	err := serveConditional(resp, req, hub, "example.com/pkg", p.get, renderPollTestPackage)
+	return resp, err
+}
+
+func TestServeConditional(t *testing.T) {
+	hub := newRefreshHub(10)
+	p := &pollTestPackage{etag: "git-1"}
+
+	resp, err := servePollTest(hub, p, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != web.StatusOK || resp.header.Get(web.HeaderETag) != `"git-1"` || resp.buf.String() != "git-1" {
+		t.Errorf("unconditional request returned %d, etag %q, body %q", resp.status, resp.header.Get(web.HeaderETag), resp.buf.String())
+	}
+
+	resp, err = servePollTest(hub, p, `"git-1"`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != web.StatusNotModified || resp.buf.Len() != 0 {
+		t.Errorf("matching request returned %d with %d byte body, want 304 with empty body", resp.status, resp.buf.Len())
+	}
+
+	resp, err = servePollTest(hub, p, `"git-0"`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != web.StatusOK {
+		t.Errorf("stale request returned %d, want 200", resp.status)
+	}
+}
+
+func TestServeConditionalRenderError(t *testing.T) {
+	p := &pollTestPackage{etag: "git-1"}
+	renderErr := errors.New("encode failed")
+	render := func(pdoc *doc.Package) (web.Header, []byte, error) {
+		return nil, nil, renderErr
+	}
+	resp := &testResponse{}
+	req := &web.Request{Header: web.Header{}, Form: url.Values{}}
+	if err := serveConditional(resp, req, newRefreshHub(10), "example.com/pkg", p.get, render); err != renderErr {
+		t.Errorf("serveConditional with render error returned %v, want %v", err, renderErr)
+	}
+	if resp.status != 0 {
+		t.Errorf("serveConditional with render error started response with status %d", resp.status)
+	}
+}
+
+func TestServeConditionalRefresh(t *testing.T) {
+	hub := newRefreshHub(10)
+	p := &pollTestPackage{etag: "git-1"}
+
+	go func() {
+		for {
+			hub.mu.Lock()
+			n := hub.n
+			hub.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		// A refresh of another package does not end the wait.
+		hub.publish("example.com/other", "git-3")
+		p.refresh(hub, "git-2")
+	}()
+
+	start := time.Now()
+	resp, err := servePollTest(hub, p, `"git-1"`, "30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("request returned after %v, want early return", d)
+	}
+	if resp.status != web.StatusOK || resp.header.Get(web.HeaderETag) != `"git-2"` || resp.buf.String() != "git-2" {
+		t.Errorf("refreshed request returned %d, etag %q, body %q", resp.status, resp.header.Get(web.HeaderETag), resp.buf.String())
+	}
+	if hub.n != 0 {
+		t.Errorf("hub has %d waiters after request, want 0", hub.n)
+	}
+}
+
+func TestServeConditionalTimeout(t *testing.T) {
+	hub := newRefreshHub(10)
+	p := &pollTestPackage{etag: "git-1"}
+
+	start := time.Now()
+	resp, err := servePollTest(hub, p, `"git-1"`, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("request returned after %v, want 1s", d)
+	}
+	if resp.status != web.StatusNotModified || resp.header.Get(web.HeaderETag) != `"git-1"` {
+		t.Errorf("timed out request returned %d, etag %q, want 304", resp.status, resp.header.Get(web.HeaderETag))
+	}
+}
+
+func TestRefreshHubBounded(t *testing.T) {
+	hub := newRefreshHub(2)
+	p := &pollTestPackage{etag: "git-1"}
+
+	w1, ok1 := hub.subscribe("example.com/a")
+	_, ok2 := hub.subscribe("example.com/b")
+	if !ok1 || !ok2 {
+		t.Fatal("subscribe failed on hub with room")
+	}
+	if _, ok := hub.subscribe("example.com/c"); ok {
+		t.Error("subscribe succeeded on full hub")
+	}
+	if _, err := servePollTest(hub, p, `"git-1"`, "30"); err == nil {
+		t.Error("long poll succeeded on full hub")
+	} else if e, ok := err.(*web.Error); !ok || e.Status != web.StatusServiceUnavailable {
+		t.Errorf("long poll on full hub returned %v, want 503", err)
+	}
+	w1.cancel()
+	w1.cancel()
+	if _, ok := hub.subscribe("example.com/c"); !ok {
+		t.Error("subscribe failed after cancel")
+	}
+}
+
+func TestRefreshHubClose(t *testing.T) {
+	hub := newRefreshHub(10)
+	p := &pollTestPackage{etag: "git-1"}
+
+	c := make(chan *testResponse, 1)
+	go func() {
+		resp, _ := servePollTest(hub, p, `"git-1"`, "30")
+		c <- resp
+	}()
+	for {
+		hub.mu.Lock()
+		n := hub.n
+		hub.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	hub.close(10 * time.Second)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("close returned after %v, want prompt return", d)
+	}
+	if resp := <-c; resp.status != web.StatusNotModified {
+		t.Errorf("request returned %d after close, want 304", resp.status)
+	}
+	if _, ok := hub.subscribe("example.com/pkg"); ok {
+		t.Error("subscribe succeeded on closed hub")
+	}
+}
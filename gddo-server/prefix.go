@@ -0,0 +1,64 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements mounting the site under a URL path prefix. Handlers
+// and templates see request paths without the prefix and construct all site
+// links with sitePath.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/garyburd/indigo/web"
+)
+
+// sitePath returns the URL path for the site path p. The path p starts with
+// "/".
+func sitePath(p string) string {
+	return strings.TrimRight(*pathPrefix, "/") + p
+}
+
+// sitePathFn returns the URL path for the concatenation of the arguments.
+func sitePathFn(parts ...string) string {
+	return sitePath(strings.Join(parts, ""))
+}
+
+// validPathPrefix returns true if the path prefix flag is "" or an absolute
+// path.
+func validPathPrefix(prefix string) bool {
+	return prefix == "" || strings.HasPrefix(prefix, "/")
+}
+
+// stripPrefixHandler removes the path prefix from requests for the site.
+// Requests outside of the prefix are not found.
+type stripPrefixHandler struct {
+	h web.Handler
+}
+
+func (h stripPrefixHandler) ServeWeb(resp web.Response, req *web.Request) error {
+	prefix := strings.TrimRight(*pathPrefix, "/")
+	if prefix == "" {
+		return h.h.ServeWeb(resp, req)
+	}
+	p := req.URL.Path
+	switch {
+	case p == prefix:
+		return web.Redirect(resp, req, prefix+"/", 301, nil)
+	case !strings.HasPrefix(p, prefix+"/"):
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	req.URL.Path = p[len(prefix):]
+	return h.h.ServeWeb(resp, req)
+}
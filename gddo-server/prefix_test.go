@@ -0,0 +1,107 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+var stripPrefixTests = []struct {
+	path   string
+	served string
+	status int
+}{
+	{"/godoc/", "/", 0},
+	{"/godoc/-/index", "/-/index", 0},
+	{"/godoc/github.com/user/repo", "/github.com/user/repo", 0},
+	{"/godocs/x", "", web.StatusNotFound},
+	{"/github.com/user/repo", "", web.StatusNotFound},
+}
+
+func TestStripPrefixHandler(t *testing.T) {
+	defer func(p string) { *pathPrefix = p }(*pathPrefix)
+	*pathPrefix = "/godoc/"
+
+	for _, tt := range stripPrefixTests {
+		var served string
+		h := stripPrefixHandler{web.HandlerFunc(func(resp web.Response, req *web.Request) error {
+			served = req.URL.Path
+			return nil
+		})}
+		err := h.ServeWeb(&testResponse{}, &web.Request{URL: &url.URL{Path: tt.path}})
+		status := 0
+		if e, ok := err.(*web.Error); ok {
+			status = e.Status
+		} else if err != nil {
+			t.Errorf("%s: returned error %v", tt.path, err)
+		}
+		if served != tt.served || status != tt.status {
+			t.Errorf("%s: served %q with status %d, want %q with status %d", tt.path, served, status, tt.served, tt.status)
+		}
+	}
+}
+
+var linkPat = regexp.MustCompile(`(?:href|src|action)="([^"]*)"`)
+
+func TestPathPrefixLinks(t *testing.T) {
+	defer func(p string) { *pathPrefix = p }(*pathPrefix)
+	*pathPrefix = "/godoc"
+
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"pkg.html", "common.html", "layout.html"},
+		{"notfound.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	pdoc.CopyOf = "github.com/user/original"
+	pdoc.Funcs[0].Doc += "\nSee package github.com/user/more.\n"
+	pkgs := []database.Package{{Path: "github.com/user/repo/pkg/sub", Synopsis: "Package sub."}}
+
+	for _, name := range []string{"pkg.html", "notfound.html"} {
+		var resp testResponse
+		if err := executeTemplate(&resp, nil, name, 200, nil, map[string]interface{}{"pdoc": pdoc, "pkgs": pkgs}); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, m := range linkPat.FindAllStringSubmatch(resp.buf.String(), -1) {
+			link := m[1]
+			if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+				continue
+			}
+			n++
+			if !strings.HasPrefix(link, "/godoc/") {
+				t.Errorf("%s: link %q is outside of the path prefix", name, link)
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: no site links found", name)
+		}
+	}
+
+	if s := string(codeFn(pdoc.Funcs[0].Decl, nil)); !strings.Contains(s, `href="/godoc/io#Writer"`) {
+		t.Errorf("codeFn() = %s, want link to /godoc/io#Writer", s)
+	}
+	if s := string(staticFileFn("site.js")); !strings.HasPrefix(s, "/godoc/-/static/site.js") {
+		t.Errorf("staticFileFn() = %s, want /godoc/-/static/site.js", s)
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements request quotas for the API and search endpoints.
+// Clients are identified by the API token in the Authorization header or by
+// IP address. Each client has a token bucket for each class of endpoint.
+
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+var (
+	trustedProxies      = flag.String("trusted_proxies", "", "Comma separated CIDR ranges of proxies trusted to set the X-Forwarded-For header.")
+	cheapQuotaLimit     = flag.Int("quota_cheap", 300, "Requests per minute to cheap API endpoints for clients without a token. Zero disables the quota.")
+	expensiveQuotaLimit = flag.Int("quota_expensive", 30, "Requests per minute to expensive API endpoints for clients without a token. Zero disables the quota.")
+	maxQuotaClients     = flag.Int("max_quota_clients", 100000, "Maximum number of clients with tracked quotas.")
+)
+
+type quotaClass int
+
+const (
+	// cheapQuota is the class of endpoints that read a single stored value.
+	cheapQuota quotaClass = iota
+
+	// expensiveQuota is the class of endpoints that read many stored
+	// values.
+	expensiveQuota
+)
+
+// anonymousTier is the quota tier for clients without an API token.
+const anonymousTier = "anonymous"
+
+// quotaTiers maps quota tier names to the multiple of the anonymous quota
+// allowed for clients in the tier.
+var quotaTiers = map[string]int{
+	anonymousTier: 1,
+	"standard":    5,
+	"high":        25,
+}
+
+// quotaLimit returns the requests per minute allowed for the class and tier.
+// Zero means no limit.
+func quotaLimit(class quotaClass, tier string) int {
+	limit := *cheapQuotaLimit
+	if class == expensiveQuota {
+		limit = *expensiveQuotaLimit
+	}
+	n, ok := quotaTiers[tier]
+	if !ok {
+		n = 1
+	}
+	return limit * n
+}
+
+// bucket is a token bucket holding up to limit tokens. The bucket refills
+// at limit tokens per minute.
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+	elem    *list.Element
+}
+
+// quotaLimiter holds the token buckets for recently active clients. When
+// the limiter is full, the bucket of the least recently active client is
+// discarded.
+type quotaLimiter struct {
+	mu      sync.Mutex
+	max     int
+	buckets map[string]*bucket
+	lru     *list.List // front is most recently used
+	now     func() time.Time
+}
+
+func newQuotaLimiter(max int) *quotaLimiter {
+	return &quotaLimiter{
+		max:     max,
+		buckets: make(map[string]*bucket),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// quotaState is the state of a client's bucket after a request.
+type quotaState struct {
+	limit     int
+	remaining int
+
+	// Time when the bucket is full again.
+	reset time.Time
+
+	// Time until a token is available if the request was refused, zero
+	// otherwise.
+	retryAfter time.Duration
+}
+
+// take takes a token from the bucket for key.
+func (l *quotaLimiter) take(key string, limit int) quotaState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b := l.buckets[key]
+	if b == nil {
+		// The list is empty if max is less than one.
+		if e := l.lru.Back(); e != nil && len(l.buckets) >= l.max {
+			l.lru.Remove(e)
+			delete(l.buckets, e.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: float64(limit), updated: now}
+		b.elem = l.lru.PushFront(b)
+		l.buckets[key] = b
+	} else {
+		l.lru.MoveToFront(b.elem)
+	}
+
+	// rate is tokens per nanosecond.
+	rate := float64(limit) / float64(time.Minute)
+	b.tokens = math.Min(float64(limit), b.tokens+float64(now.Sub(b.updated))*rate)
+	b.updated = now
+
+	s := quotaState{limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		s.retryAfter = time.Duration(math.Ceil((1 - b.tokens) / rate))
+	}
+	s.remaining = int(b.tokens)
+	s.reset = now.Add(time.Duration(math.Ceil((float64(limit) - b.tokens) / rate)))
+	return s
+}
+
+// header returns the rate limit response headers for the state.
+func (s quotaState) header() web.Header {
+	h := web.Header{
+		"X-Ratelimit-Limit":     {strconv.Itoa(s.limit)},
+		"X-Ratelimit-Remaining": {strconv.Itoa(s.remaining)},
+		"X-Ratelimit-Reset":     {strconv.FormatInt(s.reset.Add(time.Second-1).Unix(), 10)},
+	}
+	if s.retryAfter > 0 {
+		h.Set(web.HeaderRetryAfter, strconv.FormatInt(int64((s.retryAfter+time.Second-1)/time.Second), 10))
+	}
+	return h
+}
+
+// quotas is shared by all endpoints with quotas.
+var quotas *quotaLimiter
+
+// trustedProxyNets is the parsed value of the trusted_proxies flag.
+var trustedProxyNets []*net.IPNet
+
+// parseCIDRs parses a comma separated list of CIDR ranges.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client. The X-Forwarded-For header
+// is used only for requests from trusted proxies. The client is the last
+// address in the header that is not a trusted proxy.
+func clientIP(req *web.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !isTrustedProxy(ip, trusted) {
+		return ip
+	}
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		f := strings.TrimSpace(forwarded[i])
+		if f == "" {
+			continue
+		}
+		if net.ParseIP(f) == nil {
+			break
+		}
+		ip = f
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// apiTokenReloadInterval is the time between loads of the API tokens from
+// the database.
+const apiTokenReloadInterval = time.Minute
+
+var apiTokens = struct {
+	sync.Mutex
+	m      map[string]database.APIToken
+	loaded time.Time
+}{}
+
+// lookupAPIToken returns the description of an API token.
+func lookupAPIToken(token string) (database.APIToken, bool) {
+	apiTokens.Lock()
+	defer apiTokens.Unlock()
+	if time.Since(apiTokens.loaded) > apiTokenReloadInterval {
+		m, err := db.APITokens()
+		if err != nil {
+			log.Printf("Error loading API tokens: %v", err)
+		} else {
+			apiTokens.m = m
+		}
+		apiTokens.loaded = time.Now()
+	}
+	t, ok := apiTokens.m[token]
+	return t, ok
+}
+
+// cacheAPIToken adds a stored token to the loaded tokens.
+func cacheAPIToken(token string, t database.APIToken) {
+	apiTokens.Lock()
+	if apiTokens.m != nil {
+		apiTokens.m[token] = t
+	}
+	apiTokens.Unlock()
+}
+
+// quotaClient returns the bucket key and quota tier for the client. The
+// function returns false if the request has an unknown API token.
+func quotaClient(req *web.Request) (key, tier string, ok bool) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "token ") {
+		return "ip " + clientIP(req, trustedProxyNets), anonymousTier, true
+	}
+	token := strings.TrimSpace(auth[len("token "):])
+	t, ok := lookupAPIToken(token)
+	if !ok {
+		return "", "", false
+	}
+	return "token " + token, t.Tier, true
+}
+
+// hasAPIToken returns true if the request is authorized by a known API
+// token.
+func hasAPIToken(req *web.Request) bool {
+	key, _, ok := quotaClient(req)
+	return ok && strings.HasPrefix(key, "token ")
+}
+
+// quotaHandler enforces the client's quota for a class of endpoints and
+// adds the rate limit headers to the response.
+type quotaHandler struct {
+	class quotaClass
+	h     web.Handler
+}
+
+func (h quotaHandler) ServeWeb(resp web.Response, req *web.Request) error {
+	key, tier, ok := quotaClient(req)
+	if !ok {
+		return &web.Error{Status: web.StatusUnauthorized}
+	}
+	limit := quotaLimit(h.class, tier)
+	if limit <= 0 {
+		return h.h.ServeWeb(resp, req)
+	}
+	s := quotas.take(strconv.Itoa(int(h.class))+" "+key, limit)
+	header := s.header()
+	if s.retryAfter > 0 {
+		var data api.ErrorResponse
+		data.Error.Message = web.StatusText(web.StatusTooManyRequests)
+		header.Set(web.HeaderContentType, "application/json; charset=utf-8")
+		w := resp.Start(web.StatusTooManyRequests, header)
+		return json.NewEncoder(w).Encode(&data)
+	}
+	return h.h.ServeWeb(quotaResponse{resp, header}, req)
+}
+
+// quotaResponse adds the rate limit headers to a response.
+type quotaResponse struct {
+	web.Response
+	quotaHeader web.Header
+}
+
+func (r quotaResponse) Start(status int, header web.Header) io.Writer {
+	h := web.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	for k, v := range r.quotaHeader {
+		h[k] = v
+	}
+	return r.Response.Start(status, h)
+}
+
+// serveAPIToken issues an API token with the label and quota tier in the
+// request form.
+func serveAPIToken(resp web.Response, req *web.Request) error {
+	if err := checkAdminPost(req); err != nil {
+		return err
+	}
+	t := database.APIToken{Label: req.Form.Get("label"), Tier: req.Form.Get("tier")}
+	if _, ok := quotaTiers[t.Tier]; !ok || t.Tier == anonymousTier || t.Label == "" {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	var p [16]byte
+	if _, err := rand.Read(p[:]); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(p[:])
+	if err := db.PutAPIToken(token, t); err != nil {
+		return err
+	}
+	cacheAPIToken(token, t)
+
+	var data struct {
+		Token string `json:"token"`
+		database.APIToken
+	}
+	data.Token = token
+	data.APIToken = t
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(&data)
+}
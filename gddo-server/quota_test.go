@@ -0,0 +1,192 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+// testClock is a clock for quota tests.
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+func TestQuotaRefill(t *testing.T) {
+	clock := &testClock{time.Unix(1000, 0)}
+	l := newQuotaLimiter(10)
+	l.now = clock.now
+
+	for i := 0; i < 60; i++ {
+		if s := l.take("a", 60); s.retryAfter != 0 || s.remaining != 59-i {
+			t.Fatalf("take %d = %+v, want remaining %d", i, s, 59-i)
+		}
+	}
+	s := l.take("a", 60)
+	if s.retryAfter != time.Second || s.remaining != 0 {
+		t.Errorf("take on empty bucket = %+v, want retry after 1s", s)
+	}
+	if want := clock.t.Add(time.Minute); !s.reset.Equal(want) {
+		t.Errorf("reset = %v, want %v", s.reset, want)
+	}
+
+	// One token is added each second.
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	if s := l.take("a", 60); s.retryAfter != 500*time.Millisecond {
+		t.Errorf("take after 0.5s = %+v, want retry after 0.5s", s)
+	}
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	if s := l.take("a", 60); s.retryAfter != 0 || s.remaining != 0 {
+		t.Errorf("take after 1s = %+v, want allowed", s)
+	}
+
+	// The bucket does not fill past the limit.
+	clock.t = clock.t.Add(time.Hour)
+	if s := l.take("a", 60); s.remaining != 59 {
+		t.Errorf("take after 1h = %+v, want remaining 59", s)
+	}
+}
+
+func TestQuotaEviction(t *testing.T) {
+	l := newQuotaLimiter(2)
+	l.take("a", 1)
+	l.take("b", 1)
+	l.take("a", 1)
+	l.take("c", 1) // evicts b, the least recently used bucket.
+	if len(l.buckets) != 2 || l.buckets["b"] != nil {
+		t.Fatalf("buckets = %v, want a and c", l.buckets)
+	}
+	if s := l.take("a", 1); s.retryAfter == 0 {
+		t.Errorf("a was evicted")
+	}
+	if s := l.take("b", 1); s.retryAfter != 0 {
+		t.Errorf("b was not evicted")
+	}
+
+	// A limiter without room for clients keeps the last client.
+	l = newQuotaLimiter(0)
+	l.take("a", 1)
+	l.take("b", 1)
+	if len(l.buckets) != 1 || l.buckets["b"] == nil {
+		t.Errorf("buckets = %v, want b", l.buckets)
+	}
+}
+
+var clientIPTests = []struct {
+	remoteAddr string
+	forwarded  string
+	ip         string
+}{
+	{"1.2.3.4:5678", "", "1.2.3.4"},
+	{"1.2.3.4:5678", "9.9.9.9", "1.2.3.4"},
+	{"10.0.0.1:5678", "", "10.0.0.1"},
+	{"10.0.0.1:5678", "1.2.3.4", "1.2.3.4"},
+	{"10.0.0.1:5678", "9.9.9.9, 1.2.3.4, 10.0.0.2", "1.2.3.4"},
+	{"10.0.0.1:5678", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+	{"10.0.0.1:5678", "1.2.3.4, bogus", "10.0.0.1"},
+	{"[::1]:5678", "1.2.3.4", "1.2.3.4"},
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs("10.0.0.0/8, ::1/128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range clientIPTests {
+		req := &web.Request{RemoteAddr: tt.remoteAddr, Header: web.Header{}}
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if ip := clientIP(req, trusted); ip != tt.ip {
+			t.Errorf("clientIP(%q, %q) = %q, want %q", tt.remoteAddr, tt.forwarded, ip, tt.ip)
+		}
+	}
+}
+
+func TestQuotaHandler(t *testing.T) {
+	clock := &testClock{time.Unix(1000, 0)}
+	defer func(q *quotaLimiter, cheap, expensive int) {
+		quotas, *cheapQuotaLimit, *expensiveQuotaLimit = q, cheap, expensive
+	}(quotas, *cheapQuotaLimit, *expensiveQuotaLimit)
+	quotas = newQuotaLimiter(10)
+	quotas.now = clock.now
+	*cheapQuotaLimit = 2
+	*expensiveQuotaLimit = 1
+
+	apiTokens.Lock()
+	apiTokens.m = map[string]database.APIToken{"abc": {Label: "test", Tier: "standard"}}
+	apiTokens.loaded = time.Now()
+	apiTokens.Unlock()
+
+	h := func(class quotaClass) web.Handler {
+		return quotaHandler{class, web.HandlerFunc(func(resp web.Response, req *web.Request) error {
+			resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"text/plain"}})
+			return nil
+		})}
+	}
+	reset := strconv.FormatInt(clock.t.Unix()+30, 10)
+	for i, tt := range []struct {
+		class      quotaClass
+		auth       string
+		status     int
+		limit      string
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{cheapQuota, "", web.StatusOK, "2", "1", reset, ""},
+		{cheapQuota, "", web.StatusOK, "2", "0", strconv.FormatInt(clock.t.Unix()+60, 10), ""},
+		{cheapQuota, "", web.StatusTooManyRequests, "2", "0", strconv.FormatInt(clock.t.Unix()+60, 10), "30"},
+		{expensiveQuota, "", web.StatusOK, "1", "0", strconv.FormatInt(clock.t.Unix()+60, 10), ""},
+		{expensiveQuota, "", web.StatusTooManyRequests, "1", "0", strconv.FormatInt(clock.t.Unix()+60, 10), "60"},
+		{cheapQuota, "token abc", web.StatusOK, "10", "9", strconv.FormatInt(clock.t.Unix()+6, 10), ""},
+		{expensiveQuota, "token abc", web.StatusOK, "5", "4", strconv.FormatInt(clock.t.Unix()+12, 10), ""},
+	} {
+		req := &web.Request{RemoteAddr: "1.2.3.4:5678", Header: web.Header{}}
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		var resp testResponse
+		if err := h(tt.class).ServeWeb(&resp, req); err != nil {
+			t.Fatalf("%d: returned error %v", i, err)
+		}
+		if resp.status != tt.status {
+			t.Errorf("%d: status = %d, want %d", i, resp.status, tt.status)
+		}
+		for _, kv := range [][2]string{
+			{"X-Ratelimit-Limit", tt.limit},
+			{"X-Ratelimit-Remaining", tt.remaining},
+			{"X-Ratelimit-Reset", tt.reset},
+			{web.HeaderRetryAfter, tt.retryAfter},
+		} {
+			if v := resp.header.Get(kv[0]); v != kv[1] {
+				t.Errorf("%d: %s = %q, want %q", i, kv[0], v, kv[1])
+			}
+		}
+		if tt.status == web.StatusOK && resp.header.Get(web.HeaderContentType) != "text/plain" {
+			t.Errorf("%d: handler header not preserved", i)
+		}
+	}
+
+	req := &web.Request{RemoteAddr: "1.2.3.4:5678", Header: web.Header{"Authorization": {"token unknown"}}}
+	err := h(cheapQuota).ServeWeb(&testResponse{}, req)
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusUnauthorized {
+		t.Errorf("unknown token returned %v, want unauthorized", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+var rankInterval = flag.Duration("rank_interval", time.Hour, "Time between updates of the search rank hints from the page views. Zero disables the updates.")
+
+type rankStore interface {
+	PopularWithScores() ([]database.Package, error)
+	SetRank(path string, rank float64) error
+}
+
+// updateRanks sets the search rank hint of the popular packages to the
+// decayed page view score of the package. PopularWithScores returns the
+// score in the synopsis field.
+func updateRanks(store rankStore) error {
+	pkgs, err := store.PopularWithScores()
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		score, err := strconv.ParseFloat(pkg.Synopsis, 64)
+		if err != nil || pkg.Path == "" {
+			continue
+		}
+		if err := store.SetRank(pkg.Path, score); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateRanksLoop(store rankStore) {
+	for {
+		if err := updateRanks(store); err != nil {
+			log.Printf("ERROR updating search ranks: %v", err)
+		}
+		time.Sleep(*rankInterval)
+	}
+}
+
+// searchOrder returns the order of search results selected by the sort
+// parameter. The results are ordered by rank for sort=rank and by document
+// score otherwise.
+func searchOrder(req *web.Request) database.SortOrder {
+	if req.Form.Get("sort") == "rank" {
+		return database.SortByRank
+	}
+	return database.SortByDocumentScore
+}
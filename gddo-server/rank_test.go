@@ -0,0 +1,69 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeRankStore struct {
+	popular []database.Package
+	ranks   map[string]float64
+}
+
+func (s *fakeRankStore) PopularWithScores() ([]database.Package, error) {
+	return s.popular, nil
+}
+
+func (s *fakeRankStore) SetRank(path string, rank float64) error {
+	s.ranks[path] = rank
+	return nil
+}
+
+func TestUpdateRanks(t *testing.T) {
+	store := &fakeRankStore{
+		popular: []database.Package{
+			{Path: "example.com/a", Synopsis: "12.5"},
+			{Path: "example.com/b", Synopsis: "0.25"},
+			{Path: "", Synopsis: "3"},
+			{Path: "example.com/c", Synopsis: "x"},
+		},
+		ranks: make(map[string]float64),
+	}
+	if err := updateRanks(store); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"example.com/a": 12.5, "example.com/b": 0.25}; !reflect.DeepEqual(store.ranks, want) {
+		t.Errorf("ranks = %v, want %v", store.ranks, want)
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	for q, want := range map[string]database.SortOrder{
+		"":          database.SortByDocumentScore,
+		"sort=rank": database.SortByRank,
+		"sort=path": database.SortByDocumentScore,
+	} {
+		form, _ := url.ParseQuery(q)
+		if got := searchOrder(&web.Request{Form: form}); got != want {
+			t.Errorf("searchOrder(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
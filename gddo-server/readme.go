@@ -0,0 +1,478 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file renders README files for the package and landing pages. Plain
+// text files are shown preformatted. Markdown files are converted to HTML
+// with a small renderer for the common block and inline syntax. The
+// renderer escapes all text from the file, including inline HTML, so the
+// only tags in the output are the tags written by the renderer. Link and
+// image URLs are limited to web and mail schemes, and relative URLs are
+// resolved against the repository URLs of the package's files.
+
+package main
+
+import (
+	"bytes"
+	htemp "html/template"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+// maxReadmeBytes is the size above which a README file is truncated.
+const maxReadmeBytes = 64 << 10
+
+// renderedReadme is a README file rendered as HTML.
+type renderedReadme struct {
+	Name      string
+	HTML      htemp.HTML
+	Truncated bool
+}
+
+// readmeFn renders the README file of pdoc or returns nil if the package
+// does not have a README file.
+func readmeFn(pdoc *doc.Package) *renderedReadme {
+	name, p := projectReadme(pdoc)
+	if p == nil {
+		return nil
+	}
+	return renderReadme(pdoc, name, p)
+}
+
+func isMarkdownFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// renderReadme renders the README file with the given name and content.
+func renderReadme(pdoc *doc.Package, name string, p []byte) *renderedReadme {
+	r := &renderedReadme{Name: name}
+	if len(p) > maxReadmeBytes {
+		p = p[:maxReadmeBytes]
+		if i := bytes.LastIndex(p, []byte{'\n'}); i > 0 {
+			p = p[:i+1]
+		}
+		for len(p) > 0 {
+			if c, size := utf8.DecodeLastRune(p); c != utf8.RuneError || size != 1 {
+				break
+			}
+			p = p[:len(p)-1]
+		}
+		r.Truncated = true
+	}
+	var buf bytes.Buffer
+	if isMarkdownFile(name) {
+		w := readmeWriter{buf: &buf, base: readmeBaseURL(pdoc)}
+		w.blocks(strings.Split(strings.Replace(string(p), "\r\n", "\n", -1), "\n"))
+	} else {
+		buf.WriteString(`<pre class="pre-x-scrollable">`)
+		htemp.HTMLEscape(&buf, p)
+		buf.WriteString(`</pre>`)
+	}
+	r.HTML = htemp.HTML(buf.String())
+	return r
+}
+
+// readmeBaseURL returns the URL that relative links in a README file are
+// resolved against. The URL of a source file in the directory is used
+// because the file URLs name the documented tag.
+func readmeBaseURL(pdoc *doc.Package) *url.URL {
+	s := pdoc.BrowseURL
+	if len(pdoc.Files) > 0 {
+		s = pdoc.Files[0].URL
+	} else if s != "" {
+		s = strings.TrimSuffix(s, "/") + "/"
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return u
+}
+
+// rawPathPat matches the path element that selects the repository web page
+// for a file. The element is replaced with raw to get the file content.
+var rawPathPat = regexp.MustCompile(`/(?:blob|tree|src)/`)
+
+// readmeWriter writes a Markdown README file as HTML.
+type readmeWriter struct {
+	buf  *bytes.Buffer
+	base *url.URL
+}
+
+var (
+	readmeHeadingPat  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	readmeRulePat     = regexp.MustCompile(`^ {0,3}(?:(?:\*\s*){3,}|(?:-\s*){3,}|(?:_\s*){3,})$`)
+	readmeListPat     = regexp.MustCompile(`^ {0,3}(?:([-*+])|(\d{1,9})[.)])\s+`)
+	readmeSetextPat   = regexp.MustCompile(`^ {0,3}(=+|-+)\s*$`)
+	readmeFencePat    = regexp.MustCompile("^ {0,3}(```+|~~~+)")
+	readmeAutolinkPat = regexp.MustCompile(`^https?://[^\s<>"]*[^\s<>".,;:!?)\]]`)
+)
+
+func isIndentedCode(line string) bool {
+	return strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")
+}
+
+// blocks writes the block elements in lines.
+func (w *readmeWriter) blocks(lines []string) {
+	for len(lines) > 0 {
+		line := lines[0]
+		switch {
+		case isBlank(line):
+			lines = lines[1:]
+		case readmeFencePat.MatchString(line):
+			lines = w.fencedCode(lines)
+		case isIndentedCode(line):
+			lines = w.indentedCode(lines)
+		case readmeHeadingPat.MatchString(line):
+			m := readmeHeadingPat.FindStringSubmatch(line)
+			w.heading(len(m[1]), m[2])
+			lines = lines[1:]
+		case readmeRulePat.MatchString(line):
+			w.buf.WriteString("<hr>\n")
+			lines = lines[1:]
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			lines = w.blockquote(lines)
+		case readmeListPat.MatchString(line):
+			lines = w.list(lines)
+		default:
+			lines = w.paragraph(lines)
+		}
+	}
+}
+
+// heading writes a heading. The levels are shifted below the headings of
+// the page.
+func (w *readmeWriter) heading(level int, text string) {
+	level += 2
+	if level > 6 {
+		level = 6
+	}
+	tag := "h" + strconv.Itoa(level)
+	w.buf.WriteString("<" + tag + ">")
+	w.inline(text)
+	w.buf.WriteString("</" + tag + ">\n")
+}
+
+func (w *readmeWriter) code(lines []string) {
+	w.buf.WriteString(`<pre class="pre-x-scrollable"><code>`)
+	for _, line := range lines {
+		htemp.HTMLEscape(w.buf, []byte(line))
+		w.buf.WriteByte('\n')
+	}
+	w.buf.WriteString("</code></pre>\n")
+}
+
+func (w *readmeWriter) fencedCode(lines []string) []string {
+	fence := readmeFencePat.FindStringSubmatch(lines[0])[1]
+	var code []string
+	lines = lines[1:]
+	for len(lines) > 0 {
+		line := lines[0]
+		lines = lines[1:]
+		if strings.HasPrefix(strings.TrimLeft(line, " "), fence) && isBlank(strings.TrimLeft(strings.TrimLeft(line, " "), fence[:1])) {
+			break
+		}
+		code = append(code, line)
+	}
+	w.code(code)
+	return lines
+}
+
+func (w *readmeWriter) indentedCode(lines []string) []string {
+	var code []string
+	for len(lines) > 0 && (isIndentedCode(lines[0]) || isBlank(lines[0])) {
+		line := lines[0]
+		if strings.HasPrefix(line, "\t") {
+			line = line[1:]
+		} else if len(line) >= 4 {
+			line = line[4:]
+		} else {
+			line = ""
+		}
+		code = append(code, line)
+		lines = lines[1:]
+	}
+	for len(code) > 0 && code[len(code)-1] == "" {
+		code = code[:len(code)-1]
+	}
+	w.code(code)
+	return lines
+}
+
+func (w *readmeWriter) blockquote(lines []string) []string {
+	var quoted []string
+	for len(lines) > 0 && !isBlank(lines[0]) {
+		line := strings.TrimLeft(lines[0], " ")
+		if strings.HasPrefix(line, ">") {
+			line = strings.TrimPrefix(line[1:], " ")
+		}
+		quoted = append(quoted, line)
+		lines = lines[1:]
+	}
+	w.buf.WriteString("<blockquote>\n")
+	w.blocks(quoted)
+	w.buf.WriteString("</blockquote>\n")
+	return lines
+}
+
+// list writes a list. Nested lists are written as items of the outer list.
+// A list ends at an item with the other kind of marker.
+func (w *readmeWriter) list(lines []string) []string {
+	ordered := isOrderedItem(lines[0])
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	w.buf.WriteString("<" + tag + ">\n")
+	var item []string
+	flush := func() {
+		if item != nil {
+			w.buf.WriteString("<li>")
+			w.inline(strings.Join(item, " "))
+			w.buf.WriteString("</li>\n")
+		}
+		item = nil
+	}
+	for len(lines) > 0 {
+		line := lines[0]
+		if m := readmeListPat.FindStringIndex(line); m != nil {
+			if isOrderedItem(line) != ordered {
+				break
+			}
+			flush()
+			item = []string{line[m[1]:]}
+		} else if isBlank(line) {
+			if len(lines) < 2 || !readmeListPat.MatchString(lines[1]) && !isIndentedCode(lines[1]) {
+				break
+			}
+		} else if isIndentedCode(line) || !readmeRulePat.MatchString(line) && !readmeHeadingPat.MatchString(line) {
+			item = append(item, strings.TrimSpace(line))
+		} else {
+			break
+		}
+		lines = lines[1:]
+	}
+	flush()
+	w.buf.WriteString("</" + tag + ">\n")
+	return lines
+}
+
+func isOrderedItem(line string) bool {
+	m := readmeListPat.FindStringSubmatch(line)
+	return m != nil && m[2] != ""
+}
+
+func (w *readmeWriter) paragraph(lines []string) []string {
+	var text []string
+	for len(lines) > 0 {
+		line := lines[0]
+		if isBlank(line) || readmeFencePat.MatchString(line) || readmeHeadingPat.MatchString(line) ||
+			strings.HasPrefix(strings.TrimLeft(line, " "), ">") ||
+			len(text) > 0 && (readmeListPat.MatchString(line) || readmeRulePat.MatchString(line) && !readmeSetextPat.MatchString(line)) {
+			break
+		}
+		if len(text) > 0 && readmeSetextPat.MatchString(line) {
+			level := 1
+			if strings.TrimSpace(line)[0] == '-' {
+				level = 2
+			}
+			w.heading(level, strings.Join(text, " "))
+			return lines[1:]
+		}
+		text = append(text, strings.TrimSpace(line))
+		lines = lines[1:]
+	}
+	w.buf.WriteString("<p>")
+	w.inline(strings.Join(text, "\n"))
+	w.buf.WriteString("</p>\n")
+	return lines
+}
+
+// readmePunct is the set of characters that can be escaped with a
+// backslash.
+const readmePunct = "\\`*_{}[]()#+-.!<>|~\""
+
+// inline writes text with the inline syntax converted to HTML.
+func (w *readmeWriter) inline(s string) {
+	for len(s) > 0 {
+		switch {
+		case s[0] == '\\' && len(s) > 1 && strings.IndexByte(readmePunct, s[1]) >= 0:
+			htemp.HTMLEscape(w.buf, []byte(s[1:2]))
+			s = s[2:]
+			continue
+		case s[0] == '`':
+			n := len(s) - len(strings.TrimLeft(s, "`"))
+			fence := s[:n]
+			if i := strings.Index(s[n:], fence); i >= 0 {
+				w.buf.WriteString("<code>")
+				htemp.HTMLEscape(w.buf, []byte(strings.TrimSpace(s[n:n+i])))
+				w.buf.WriteString("</code>")
+				s = s[n+i+n:]
+				continue
+			}
+			htemp.HTMLEscape(w.buf, []byte(fence))
+			s = s[n:]
+			continue
+		case strings.HasPrefix(s, "!["):
+			if text, dest, rest, ok := parseReadmeLink(s[1:]); ok {
+				if u, ok := w.resolve(dest, true); ok {
+					w.buf.WriteString(`<img src="`)
+					w.buf.WriteString(htemp.HTMLEscapeString(u))
+					w.buf.WriteString(`" alt="`)
+					w.buf.WriteString(htemp.HTMLEscapeString(text))
+					w.buf.WriteString(`">`)
+				} else {
+					htemp.HTMLEscape(w.buf, []byte(text))
+				}
+				s = rest
+				continue
+			}
+		case s[0] == '[':
+			if text, dest, rest, ok := parseReadmeLink(s); ok {
+				if u, ok := w.resolve(dest, false); ok {
+					w.buf.WriteString(`<a href="`)
+					w.buf.WriteString(htemp.HTMLEscapeString(u))
+					w.buf.WriteString(`" rel="nofollow">`)
+					w.inline(text)
+					w.buf.WriteString(`</a>`)
+				} else {
+					w.inline(text)
+				}
+				s = rest
+				continue
+			}
+		case strings.HasPrefix(s, "**") || strings.HasPrefix(s, "__"):
+			if i := strings.Index(s[2:], s[:2]); i > 0 {
+				w.buf.WriteString("<strong>")
+				w.inline(s[2 : 2+i])
+				w.buf.WriteString("</strong>")
+				s = s[2+i+2:]
+				continue
+			}
+		case s[0] == '*' && len(s) > 1 && s[1] != ' ':
+			if i := strings.IndexByte(s[1:], '*'); i > 0 && s[i] != ' ' {
+				w.buf.WriteString("<em>")
+				w.inline(s[1 : 1+i])
+				w.buf.WriteString("</em>")
+				s = s[1+i+1:]
+				continue
+			}
+		case s[0] == 'h':
+			if m := readmeAutolinkPat.FindString(s); m != "" {
+				w.buf.WriteString(`<a href="`)
+				w.buf.WriteString(htemp.HTMLEscapeString(m))
+				w.buf.WriteString(`" rel="nofollow">`)
+				htemp.HTMLEscape(w.buf, []byte(m))
+				w.buf.WriteString(`</a>`)
+				s = s[len(m):]
+				continue
+			}
+		}
+
+		// Write the text up to the next character that can start inline
+		// syntax.
+		i := strings.IndexAny(s[1:], "\\`![*_h")
+		if i < 0 {
+			i = len(s)
+		} else {
+			i++
+		}
+		htemp.HTMLEscape(w.buf, []byte(s[:i]))
+		s = s[i:]
+	}
+}
+
+// parseReadmeLink parses a link of the form [text](dest "title") at the
+// start of s.
+func parseReadmeLink(s string) (text, dest, rest string, ok bool) {
+	depth := 0
+	end := -1
+	for i := 0; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 || end+1 >= len(s) || s[end+1] != '(' {
+		return "", "", "", false
+	}
+	text = s[1:end]
+	s = s[end+2:]
+	i := 0
+	for depth = 1; i < len(s); i++ {
+		if s[i] == '(' {
+			depth++
+		} else if s[i] == ')' {
+			if depth--; depth == 0 {
+				break
+			}
+		}
+	}
+	if i == len(s) {
+		return "", "", "", false
+	}
+	fields := strings.Fields(s[:i])
+	if len(fields) == 0 {
+		return "", "", "", false
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(fields[0], "<"), ">")
+	return text, dest, s[i+1:], true
+}
+
+// resolve returns the URL for a link or image destination in the README.
+// Destinations with other schemes than http, https and mailto are rejected.
+// Relative images are resolved to the raw file content.
+func (w *readmeWriter) resolve(dest string, image bool) (string, bool) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", false
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		return u.String(), true
+	case u.Scheme == "mailto" && !image:
+		return u.String(), true
+	case u.Scheme != "" || u.Host != "":
+		return "", false
+	case dest == "" || strings.HasPrefix(dest, "#"):
+		return "", false
+	case w.base == nil:
+		return "", false
+	}
+	s := w.base.ResolveReference(u).String()
+	if image {
+		if loc := rawPathPat.FindStringIndex(s); loc != nil {
+			s = s[:loc[0]] + "/raw/" + s[loc[1]:]
+		}
+	} else {
+		s = strings.Replace(s, "/tree/", "/blob/", 1)
+	}
+	return s, true
+}
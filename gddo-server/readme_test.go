@@ -0,0 +1,75 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+func readmeTestPackage() *doc.Package {
+	return &doc.Package{
+		ImportPath: "github.com/user/repo/pkg",
+		BrowseURL:  "https://github.com/user/repo/tree/master/pkg",
+		Files:      []*doc.File{{Name: "pkg.go", URL: "https://github.com/user/repo/blob/master/pkg/pkg.go"}},
+	}
+}
+
+var renderReadmeTests = []struct {
+	name, in, want string
+}{
+	{"README", "a <b> & c\n", `<pre class="pre-x-scrollable">a &lt;b&gt; &amp; c` + "\n</pre>"},
+	{"README.md", "# Title\n\nSome *text* and **more**.\n",
+		"<h3>Title</h3>\n<p>Some <em>text</em> and <strong>more</strong>.</p>\n"},
+	{"README.md", "Title\n=====\nx\n", "<h3>Title</h3>\n<p>x</p>\n"},
+	{"README.md", "- one\n- two\n\n1. first\n", "<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n<ol>\n<li>first</li>\n</ol>\n"},
+	{"README.md", "```go\nfmt.Println(\"<hi>\")\n```\n", `<pre class="pre-x-scrollable"><code>fmt.Println(&#34;&lt;hi&gt;&#34;)` + "\n</code></pre>\n"},
+	{"README.md", "Use `go get` now.\n", "<p>Use <code>go get</code> now.</p>\n"},
+	{"README.markdown", "> quoted\n", "<blockquote>\n<p>quoted</p>\n</blockquote>\n"},
+	{"README.md", "See http://example.com/x.\n", `<p>See <a href="http://example.com/x" rel="nofollow">http://example.com/x</a>.</p>` + "\n"},
+
+	// Inline HTML and unsafe URLs are not passed through.
+	{"README.md", "<script>alert(1)</script>\n", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+	{"README.md", "[x](javascript:alert(1)) ![y](data:image/png;base64,AA)\n", "<p>x y</p>\n"},
+	{"README.md", `[a](http://example.com/"onclick=")` + "\n", `<p><a href="http://example.com/%22onclick=%22" rel="nofollow">a</a></p>` + "\n"},
+
+	// Relative links go to the repository and relative images to the raw
+	// file.
+	{"README.md", "[doc](doc/guide.md) ![logo](img/logo.png)\n",
+		`<p><a href="https://github.com/user/repo/blob/master/pkg/doc/guide.md" rel="nofollow">doc</a> ` +
+			`<img src="https://github.com/user/repo/raw/master/pkg/img/logo.png" alt="logo"></p>` + "\n"},
+	{"README.md", "[![build](https://ci.example.com/badge.svg)](https://ci.example.com/)\n",
+		`<p><a href="https://ci.example.com/" rel="nofollow"><img src="https://ci.example.com/badge.svg" alt="build"></a></p>` + "\n"},
+}
+
+func TestRenderReadme(t *testing.T) {
+	pdoc := readmeTestPackage()
+	for _, tt := range renderReadmeTests {
+		r := renderReadme(pdoc, tt.name, []byte(tt.in))
+		if string(r.HTML) != tt.want || r.Truncated {
+			t.Errorf("renderReadme(%s, %q) = %q, %v, want %q, false", tt.name, tt.in, r.HTML, r.Truncated, tt.want)
+		}
+	}
+}
+
+func TestRenderReadmeTruncated(t *testing.T) {
+	p := []byte(strings.Repeat("line of text\n", maxReadmeBytes/10))
+	r := renderReadme(readmeTestPackage(), "README", p)
+	if !r.Truncated || len(r.HTML) > maxReadmeBytes+100 || !strings.HasSuffix(string(r.HTML), "line of text\n</pre>") {
+		t.Errorf("renderReadme(large) returned %d bytes, truncated = %v", len(r.HTML), r.Truncated)
+	}
+}
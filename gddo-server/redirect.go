@@ -0,0 +1,368 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the redirect rules for import paths that moved to a
+// new location. Requests for the old paths are redirected to the new paths,
+// the old paths are not fetched and links in documentation point to the new
+// paths.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var redirectsPath = flag.String("redirects", "", "Path to JSON file mapping old import paths to new import paths. A key ending in /... matches the path and the paths below it. A key starting with ^ is a regular expression matched against the whole path and the value can refer to submatches as $1. The file is reloaded on SIGHUP.")
+
+const (
+	// maxRedirectSteps is the maximum number of rules applied to a path.
+	maxRedirectSteps = 10
+
+	// maxRedirectTestPackages is the maximum number of packages listed in
+	// a rule test.
+	maxRedirectTestPackages = 100
+)
+
+// redirectRule is a prefix or regular expression rule.
+type redirectRule struct {
+	from string
+	to   string
+
+	// prefix is the path matched by a prefix rule or the literal prefix of
+	// a regular expression. Rules with longer prefixes are tried first.
+	prefix string
+
+	re *regexp.Regexp // nil for prefix rules
+}
+
+// apply returns the rewritten path and true if the rule matches path.
+func (r *redirectRule) apply(path string) (string, bool) {
+	if r.re == nil {
+		if path != r.prefix && !strings.HasPrefix(path, r.prefix+"/") {
+			return "", false
+		}
+		return r.to + path[len(r.prefix):], true
+	}
+	m := r.re.FindStringSubmatchIndex(path)
+	if m == nil || m[0] != 0 || m[1] != len(path) {
+		return "", false
+	}
+	return string(r.re.ExpandString(nil, r.to, path, m)), true
+}
+
+// redirectRuleError is returned for invalid rules.
+type redirectRuleError struct {
+	from    string
+	message string
+}
+
+func (e *redirectRuleError) Error() string {
+	return fmt.Sprintf("redirect %q: %s", e.from, e.message)
+}
+
+// redirectRules is a parsed redirects file.
+type redirectRules struct {
+	config map[string]string
+	paths  map[string]string
+	rules  []*redirectRule
+	digest string
+}
+
+// parseRedirectRules parses the rules in a redirects file. Explicit paths
+// take precedence over the rules. The rules are ordered by the length of the
+// prefix, longest first, then by prefix rules before regular expressions and
+// then by the key.
+func parseRedirectRules(config map[string]string) (*redirectRules, error) {
+	rs := &redirectRules{config: config, paths: make(map[string]string)}
+	var keys []string
+	for from, to := range config {
+		keys = append(keys, from)
+		if from == "" || to == "" {
+			return nil, &redirectRuleError{from, "empty path"}
+		}
+		switch {
+		case strings.HasPrefix(from, "^"):
+			re, err := regexp.Compile(from)
+			if err != nil {
+				return nil, &redirectRuleError{from, err.Error()}
+			}
+			// The literal prefix is computed without the anchor because
+			// LiteralPrefix does not always see through it.
+			prefix, _ := regexp.MustCompile(from[1:]).LiteralPrefix()
+			rs.rules = append(rs.rules, &redirectRule{from: from, to: to, prefix: prefix, re: re})
+		case strings.HasSuffix(from, "/..."):
+			if !strings.HasSuffix(to, "/...") {
+				return nil, &redirectRuleError{from, to + " does not end with /..."}
+			}
+			rs.rules = append(rs.rules, &redirectRule{from: from, to: to[:len(to)-len("/...")], prefix: from[:len(from)-len("/...")]})
+		default:
+			rs.paths[from] = to
+		}
+	}
+	sort.Sort(byRedirectPrecedence(rs.rules))
+
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q %q\n", k, config[k])
+	}
+	if len(keys) > 0 {
+		rs.digest = strconv.FormatUint(h.Sum64(), 36)
+	}
+	return rs, nil
+}
+
+type byRedirectPrecedence []*redirectRule
+
+func (p byRedirectPrecedence) Len() int      { return len(p) }
+func (p byRedirectPrecedence) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byRedirectPrecedence) Less(i, j int) bool {
+	switch {
+	case len(p[i].prefix) != len(p[j].prefix):
+		return len(p[i].prefix) > len(p[j].prefix)
+	case (p[i].re == nil) != (p[j].re == nil):
+		return p[i].re == nil
+	}
+	return p[i].from < p[j].from
+}
+
+// rewriteOnce applies the first matching rule to path.
+func (rs *redirectRules) rewriteOnce(path string) (string, bool) {
+	if to, ok := rs.paths[path]; ok {
+		return to, true
+	}
+	for _, r := range rs.rules {
+		if to, ok := r.apply(path); ok {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// rewrite returns the new location of path and true if path is redirected.
+// Chains of rules are followed to the final path. Paths in a cycle and
+// paths rewritten to an invalid path are not redirected.
+func (rs *redirectRules) rewrite(path string) (string, bool) {
+	if rs == nil {
+		return "", false
+	}
+	seen := map[string]bool{path: true}
+	p := path
+	for i := 0; i < maxRedirectSteps; i++ {
+		to, ok := rs.rewriteOnce(p)
+		if !ok {
+			break
+		}
+		if seen[to] || !doc.IsValidPath(to) {
+			return "", false
+		}
+		seen[to] = true
+		p = to
+	}
+	if p == path {
+		return "", false
+	}
+	return p, true
+}
+
+var redirects = struct {
+	sync.Mutex
+	rules *redirectRules
+}{}
+
+// loadRedirects sets the redirect rules from the JSON file at path.
+func loadRedirects(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]string
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	rs, err := parseRedirectRules(config)
+	if err != nil {
+		return err
+	}
+	setRedirectRules(rs)
+	return nil
+}
+
+func setRedirectRules(rs *redirectRules) {
+	redirects.Lock()
+	redirects.rules = rs
+	redirects.Unlock()
+}
+
+func currentRedirectRules() *redirectRules {
+	redirects.Lock()
+	defer redirects.Unlock()
+	return redirects.rules
+}
+
+// redirectImportPath returns the new location of the package at path and
+// true if the package moved.
+func redirectImportPath(path string) (string, bool) {
+	return currentRedirectRules().rewrite(path)
+}
+
+// linkPath returns the import path used in links to the package at path.
+// Links to a vendored package go to the canonical package.
+func linkPath(path string) string {
+	if canonical, ok := vendoredPath(path); ok {
+		path = canonical
+	}
+	if to, ok := redirectImportPath(path); ok {
+		return to
+	}
+	return path
+}
+
+// redirectsETag returns a suffix for ETags of responses that depend on the
+// redirect rules.
+func redirectsETag() string {
+	if rs := currentRedirectRules(); rs != nil && rs.digest != "" {
+		return "-" + rs.digest
+	}
+	return ""
+}
+
+// withoutRedirected returns the packages that are not redirected.
+func withoutRedirected(pkgs []database.Package) []database.Package {
+	rs := currentRedirectRules()
+	if rs == nil {
+		return pkgs
+	}
+	var result []database.Package
+	for _, pkg := range pkgs {
+		if _, ok := rs.rewrite(pkg.Path); !ok {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+// redirectHandler redirects API requests for the old path of a package to
+// the same endpoint for the new path.
+type redirectHandler struct {
+	pattern string
+	h       web.Handler
+}
+
+// location returns the URL of the endpoint for the new path and true if the
+// package in the request moved.
+func (h redirectHandler) location(req *web.Request) (string, bool) {
+	to, ok := redirectImportPath(req.RouteVars["path"])
+	if !ok {
+		return "", false
+	}
+	m := routeVarPat.FindStringIndex(h.pattern)
+	u := sitePath(h.pattern[:m[0]] + to + h.pattern[m[1]:])
+	if req.URL.RawQuery != "" {
+		u += "?" + req.URL.RawQuery
+	}
+	return u, true
+}
+
+func (h redirectHandler) ServeWeb(resp web.Response, req *web.Request) error {
+	if u, ok := h.location(req); ok {
+		return web.Redirect(resp, req, u, 301, nil)
+	}
+	return h.h.ServeWeb(resp, req)
+}
+
+// redirectStore is the subset of the database used to test redirect rules.
+type redirectStore interface {
+	AllPackagesFunc(fn func(database.Package) bool) error
+}
+
+// redirectIndex is set in main.
+var redirectIndex redirectStore
+
+type redirectedPackage struct {
+	Path string `json:"path"`
+	To   string `json:"to"`
+}
+
+// testRedirectRule returns the indexed packages that are redirected
+// differently when the rule from → to is added to the current rules, up to
+// limit packages, and the total number of such packages.
+func testRedirectRule(store redirectStore, current *redirectRules, from, to string, limit int) ([]redirectedPackage, int, error) {
+	config := make(map[string]string)
+	if current != nil {
+		for k, v := range current.config {
+			config[k] = v
+		}
+	}
+	config[from] = to
+	proposed, err := parseRedirectRules(config)
+	if err != nil {
+		return nil, 0, err
+	}
+	var pkgs []redirectedPackage
+	n := 0
+	err = store.AllPackagesFunc(func(pkg database.Package) bool {
+		to, ok := proposed.rewrite(pkg.Path)
+		if !ok {
+			return true
+		}
+		if old, ok := current.rewrite(pkg.Path); ok && old == to {
+			return true
+		}
+		n++
+		if len(pkgs) < limit {
+			pkgs = append(pkgs, redirectedPackage{Path: pkg.Path, To: to})
+		}
+		return true
+	})
+	return pkgs, n, err
+}
+
+// serveRedirectsTest reports the indexed packages that a proposed redirect
+// rule would affect. The rule is not added.
+func serveRedirectsTest(resp web.Response, req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	var data struct {
+		Packages     []redirectedPackage `json:"packages"`
+		PackageCount int                 `json:"packageCount"`
+	}
+	var err error
+	data.Packages, data.PackageCount, err = testRedirectRule(redirectIndex, currentRedirectRules(), req.Form.Get("from"), req.Form.Get("to"), maxRedirectTestPackages)
+	if _, ok := err.(*redirectRuleError); ok {
+		writeAPIError(resp, web.StatusBadRequest, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data.Packages == nil {
+		data.Packages = []redirectedPackage{}
+	}
+	return writeJSON(resp, web.StatusOK, &data)
+}
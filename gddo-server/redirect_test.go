@@ -0,0 +1,290 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var testRedirectConfig = map[string]string{
+	"github.com/oldorg/...":               "github.com/neworg/...",
+	"github.com/oldorg/special/...":       "github.com/special/...",
+	"github.com/oldorg/pinned":            "github.com/pinned/pinned",
+	`^git\.example\.com/([^/]+)/go-(.+)$`: "github.com/example-$1/$2",
+	`^git\.example\.com/legacy/(.*)$`:     "github.com/legacy/$1",
+	"github.com/loop/a/...":               "github.com/loop/b/...",
+	"github.com/loop/b/...":               "github.com/loop/a/...",
+	"github.com/chain/one":                "github.com/chain/two",
+	"github.com/chain/two":                "github.com/chain/three",
+}
+
+var redirectRulesTests = []struct {
+	path, to string
+}{
+	// Prefix rules match the path and the paths below it.
+	{"github.com/oldorg", "github.com/neworg"},
+	{"github.com/oldorg/repo/sub", "github.com/neworg/repo/sub"},
+	{"github.com/oldorgx/repo", ""},
+
+	// The longest prefix wins.
+	{"github.com/oldorg/special/pkg", "github.com/special/pkg"},
+
+	// Explicit paths beat prefix rules. Paths below an explicit path are
+	// rewritten by the prefix rule.
+	{"github.com/oldorg/pinned", "github.com/pinned/pinned"},
+	{"github.com/oldorg/pinned/sub", "github.com/neworg/pinned/sub"},
+
+	// Submatches in regular expressions. The literal prefix of the legacy
+	// rule is longer, so it wins over the general rule.
+	{"git.example.com/tools/go-lint", "github.com/example-tools/lint"},
+	{"git.example.com/tools/go-lint/cmd", "github.com/example-tools/lint/cmd"},
+	{"git.example.com/legacy/go-old", "github.com/legacy/go-old"},
+	{"git.example.com/tools/lint", ""},
+
+	// Chains are followed and cycles are not redirected.
+	{"github.com/chain/one", "github.com/chain/three"},
+	{"github.com/loop/a/x", ""},
+
+	{"github.com/user/repo", ""},
+}
+
+func TestRedirectRules(t *testing.T) {
+	rs, err := parseRedirectRules(testRedirectConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range redirectRulesTests {
+		to, ok := rs.rewrite(tt.path)
+		if to != tt.to || ok != (tt.to != "") {
+			t.Errorf("rewrite(%q) = %q, %v, want %q", tt.path, to, ok, tt.to)
+		}
+	}
+
+	// The order of the rules does not depend on the order of the map.
+	for i := 0; i < 10; i++ {
+		rs2, _ := parseRedirectRules(testRedirectConfig)
+		if !reflect.DeepEqual(rs.rules, rs2.rules) || rs.digest != rs2.digest {
+			t.Fatal("rule order is not deterministic")
+		}
+	}
+
+	var nilRules *redirectRules
+	if _, ok := nilRules.rewrite("github.com/oldorg"); ok {
+		t.Error("nil rules rewrote path")
+	}
+}
+
+func TestParseRedirectRulesErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"github.com/a/...": "github.com/b"},
+		{"^github.com/(": "github.com/b"},
+		{"github.com/a": ""},
+	} {
+		if _, err := parseRedirectRules(config); err == nil {
+			t.Errorf("parseRedirectRules(%v) did not return an error", config)
+		}
+	}
+}
+
+func TestLoadRedirects(t *testing.T) {
+	defer setRedirectRules(currentRedirectRules())
+	dir, err := ioutil.TempDir("", "redirects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redirects.json")
+
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"github.com/oldorg/...": "github.com/neworg/..."}`)
+	if err := loadRedirects(path); err != nil {
+		t.Fatal(err)
+	}
+	if to, _ := redirectImportPath("github.com/oldorg/repo"); to != "github.com/neworg/repo" {
+		t.Errorf("after load, redirect = %q, want github.com/neworg/repo", to)
+	}
+	etag := redirectsETag()
+
+	// A reload replaces the rules.
+	write(`{"github.com/oldorg/...": "github.com/other/..."}`)
+	if err := loadRedirects(path); err != nil {
+		t.Fatal(err)
+	}
+	if to, _ := redirectImportPath("github.com/oldorg/repo"); to != "github.com/other/repo" {
+		t.Errorf("after reload, redirect = %q, want github.com/other/repo", to)
+	}
+	if redirectsETag() == etag {
+		t.Error("ETag suffix did not change with the rules")
+	}
+
+	// The rules are kept if the file has an error.
+	write(`{"github.com/oldorg/...": "github.com/broken"}`)
+	if err := loadRedirects(path); err == nil {
+		t.Error("load of invalid file did not return an error")
+	}
+	if to, _ := redirectImportPath("github.com/oldorg/repo"); to != "github.com/other/repo" {
+		t.Errorf("after failed reload, redirect = %q, want github.com/other/repo", to)
+	}
+}
+
+func setTestRedirects(t *testing.T, config map[string]string) func() {
+	old := currentRedirectRules()
+	rs, err := parseRedirectRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRedirectRules(rs)
+	return func() { setRedirectRules(old) }
+}
+
+func TestRedirectLinks(t *testing.T) {
+	defer setTestRedirects(t, testRedirectConfig)()
+
+	code := doc.Code{
+		Text:        "oldorg.Client",
+		Annotations: []doc.Annotation{{Pos: 0, End: 13, Kind: doc.ExportLinkAnnotation, PathIndex: 0}},
+		Paths:       []string{"github.com/oldorg/client"},
+	}
+	if got, want := string(codeFn(code, nil)), `<a href="/github.com/neworg/client#Client">oldorg.Client</a>`; got != want {
+		t.Errorf("codeFn() = %s, want %s", got, want)
+	}
+
+	got := string(commentFn("Use package github.com/oldorg/client instead.\n"))
+	if !strings.Contains(got, `<a href="/github.com/neworg/client">github.com/oldorg/client</a>`) {
+		t.Errorf("commentFn() = %s, want link to new path", got)
+	}
+
+	pkgs := withoutRedirected([]database.Package{{Path: "github.com/oldorg/a"}, {Path: "github.com/user/b"}})
+	if len(pkgs) != 1 || pkgs[0].Path != "github.com/user/b" {
+		t.Errorf("withoutRedirected() = %v, want github.com/user/b", pkgs)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	defer setTestRedirects(t, testRedirectConfig)()
+	defer func(p string) { *pathPrefix = p }(*pathPrefix)
+	*pathPrefix = "/godoc"
+
+	called := false
+	h := redirectHandler{"/-/api/json/<path:.+>", web.HandlerFunc(func(resp web.Response, req *web.Request) error {
+		called = true
+		return nil
+	})}
+	for _, tt := range []struct {
+		path, query, location string
+	}{
+		{"github.com/oldorg/repo", "v=1", "/godoc/-/api/json/github.com/neworg/repo?v=1"},
+		{"github.com/user/repo", "", ""},
+	} {
+		called = false
+		var resp testResponse
+		req := &web.Request{
+			URL:       &url.URL{Path: "/-/api/json/" + tt.path, RawQuery: tt.query},
+			RouteVars: map[string]string{"path": tt.path},
+			Header:    web.Header{},
+		}
+		if u, _ := h.location(req); u != tt.location {
+			t.Errorf("%s: location = %q, want %q", tt.path, u, tt.location)
+		}
+		if err := h.ServeWeb(&resp, req); err != nil {
+			t.Fatal(err)
+		}
+		if called != (tt.location == "") {
+			t.Errorf("%s: handler called = %v, want %v", tt.path, called, tt.location == "")
+		}
+	}
+}
+
+type fakeRedirectStore []string
+
+func (s fakeRedirectStore) AllPackagesFunc(fn func(database.Package) bool) error {
+	for _, p := range s {
+		if !fn(database.Package{Path: p}) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestRedirectsTest(t *testing.T) {
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+	defer setTestRedirects(t, map[string]string{"github.com/oldorg/special/...": "github.com/special/..."})()
+	defer func(s redirectStore) { redirectIndex = s }(redirectIndex)
+	redirectIndex = fakeRedirectStore{
+		"github.com/oldorg/a",
+		"github.com/oldorg/b/c",
+		"github.com/oldorg/special/d",
+		"github.com/user/repo",
+	}
+
+	type result struct {
+		Packages     []redirectedPackage `json:"packages"`
+		PackageCount int                 `json:"packageCount"`
+	}
+	for _, tt := range []struct {
+		from, to string
+		want     []redirectedPackage
+	}{
+		// The existing longer prefix rule keeps github.com/oldorg/special/d.
+		{"github.com/oldorg/...", "github.com/neworg/...", []redirectedPackage{
+			{"github.com/oldorg/a", "github.com/neworg/a"},
+			{"github.com/oldorg/b/c", "github.com/neworg/b/c"},
+		}},
+		{`^github\.com/oldorg/([a-z])$`, "github.com/letters/$1", []redirectedPackage{
+			{"github.com/oldorg/a", "github.com/letters/a"},
+		}},
+		{"github.com/nobody/...", "github.com/somebody/...", []redirectedPackage{}},
+	} {
+		var resp testResponse
+		req := &web.Request{Form: url.Values{"from": {tt.from}, "to": {tt.to}}, Cookie: url.Values{"admin": {"key"}}}
+		if err := serveRedirectsTest(&resp, req); err != nil {
+			t.Fatal(err)
+		}
+		var r result
+		if err := json.Unmarshal(resp.buf.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r.Packages, tt.want) || r.PackageCount != len(tt.want) {
+			t.Errorf("%s packages = %v (%d), want %v", tt.from, r.Packages, r.PackageCount, tt.want)
+		}
+	}
+
+	var resp testResponse
+	req := &web.Request{Form: url.Values{"from": {"github.com/a/..."}, "to": {"github.com/b"}}, Cookie: url.Values{"admin": {"key"}}}
+	if err := serveRedirectsTest(&resp, req); err != nil || resp.status != web.StatusBadRequest {
+		t.Errorf("invalid rule returned %v, status %d, want %d", err, resp.status, web.StatusBadRequest)
+	}
+
+	if err := serveRedirectsTest(&testResponse{}, &web.Request{}); err == nil || err.(*web.Error).Status != web.StatusNotFound {
+		t.Errorf("test without admin cookie returned %v, want not found", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var refMaxAge = flag.Duration("ref_max_age", time.Hour, "Time that stored documentation for an explicitly requested tag or branch is served before it is fetched again.")
+
+// refStore is the subset of the database used to serve documentation for
+// explicitly requested tags and branches.
+type refStore interface {
+	GetRef(path, ref string) (*doc.Package, time.Time, error)
+	PutRef(pdoc *doc.Package, ref string, t time.Time) error
+	BlockingRule(path string) (string, error)
+	CountBlockHit(kind, rule string) error
+}
+
+// refDocs is the store of the documentation for tags and branches. The
+// store is set in main.
+var refDocs struct {
+	store refStore
+}
+
+// validRef returns true if ref is a plausible tag or branch name. The
+// characters are restricted so that the ref can be used in repository host
+// URLs without escaping.
+func validRef(ref string) bool {
+	if ref == "" || len(ref) > 100 || strings.Contains(ref, "..") ||
+		strings.HasPrefix(ref, "-") || strings.HasPrefix(ref, "/") || strings.HasSuffix(ref, "/") {
+		return false
+	}
+	for _, r := range ref {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case strings.ContainsRune("-_./+", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// splitRef returns the import path and the tag or branch requested with a
+// path like "github.com/user/repo@v1.2.0" or the rev parameter. The ref is
+// "" if the request does not name a tag or branch. The result is not ok if
+// the ref is not valid or the request names more than one ref.
+func splitRef(path string, form url.Values) (string, string, bool) {
+	ref := ""
+	if i := strings.Index(path, "@"); i >= 0 {
+		path, ref = path[:i], path[i+1:]
+		if !validRef(ref) {
+			return path, "", false
+		}
+	}
+	if revs, ok := form["rev"]; ok {
+		if ref != "" || len(revs) != 1 || !validRef(revs[0]) {
+			return path, "", false
+		}
+		ref = revs[0]
+	}
+	return path, ref, true
+}
+
+// getRefDoc returns the documentation of the package at the tag or branch
+// ref. Stored documentation younger than the ref_max_age flag is used
+// without a fetch. Stored documentation is used when the fetch fails with
+// an error other than not found or a different canonical path.
+func getRefDoc(path, ref string, now time.Time) (*doc.Package, error) {
+	pdoc, updated, err := refDocs.store.GetRef(path, ref)
+	if err != nil {
+		return nil, err
+	}
+	if pdoc != nil && now.Sub(updated) < *refMaxAge {
+		return pdoc, nil
+	}
+	etag := ""
+	if pdoc != nil {
+		etag = pdoc.Etag
+	}
+	pdocNew, err := doc.GetRef(httpClient, path, ref, etag)
+	switch {
+	case err == doc.ErrNotModified:
+		pdocNew = pdoc
+	case doc.IsNotFound(err):
+		return nil, err
+	case err != nil:
+		if _, ok := err.(doc.CanonicalPathError); ok || pdoc == nil {
+			return nil, err
+		}
+		log.Printf("ERROR get ref %s@%s: %v", path, ref, err)
+		return pdoc, nil
+	}
+	if err := refDocs.store.PutRef(pdocNew, ref, now); err != nil {
+		log.Printf("ERROR put ref %s@%s: %v", path, ref, err)
+	}
+	return pdocNew, nil
+}
+
+// serveRef serves the documentation of the package at the tag or branch
+// ref. The documentation is fetched on request and is not indexed, so the
+// page does not have the views and the crawl schedule of the current
+// documentation.
+func serveRef(resp web.Response, req *web.Request, path, ref string) error {
+	if refDocs.store == nil || !doc.IsValidRemotePath(path) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	if !fetchAllowed(path) {
+		return serveServiceNotFound(resp, req, path)
+	}
+	if rule, err := refDocs.store.BlockingRule(path); err != nil {
+		return err
+	} else if rule != "" {
+		if err := refDocs.store.CountBlockHit(database.BlockPath, rule); err != nil {
+			log.Printf("ERROR counting hit for %s: %v", rule, err)
+		}
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	pdoc, err := getRefDoc(path, ref, time.Now())
+	if e, ok := err.(doc.NotFoundError); ok {
+		return executeTemplate(resp, req, "notfound"+templateExt(req), web.StatusNotFound, nil, map[string]interface{}{
+			"message": e.Message,
+		})
+	} else if e, ok := err.(doc.CanonicalPathError); ok {
+		return web.Redirect(resp, req, sitePath("/"+e.ImportPath+"@"+ref), 301, nil)
+	} else if err != nil {
+		return err
+	}
+	repairStoredDoc(pdoc)
+	sel, _ := doc.ResolveScopedAnchor(pdoc, req.Form.Get("type"), req.Form.Get("sel"))
+	name, data := packagePage(pdoc, nil, &RenderOptions{
+		Sel:        sel,
+		IndexOrder: req.Form.Get("index"),
+		Ref:        ref,
+	})
+	return executeTemplate(resp, req, name, web.StatusOK, nil, data)
+}
@@ -0,0 +1,139 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var splitRefTests = []struct {
+	path string
+	form url.Values
+	want string
+	ref  string
+	ok   bool
+}{
+	{"github.com/user/repo", nil, "github.com/user/repo", "", true},
+	{"github.com/user/repo@v1.2.0", nil, "github.com/user/repo", "v1.2.0", true},
+	{"github.com/user/repo/pkg@release/1.x", nil, "github.com/user/repo/pkg", "release/1.x", true},
+	{"github.com/user/repo", url.Values{"rev": {"develop"}}, "github.com/user/repo", "develop", true},
+	{"github.com/user/repo@", nil, "github.com/user/repo", "", false},
+	{"github.com/user/repo@../master", nil, "github.com/user/repo", "", false},
+	{"github.com/user/repo@-v1", nil, "github.com/user/repo", "", false},
+	{"github.com/user/repo@v1%20x", nil, "github.com/user/repo", "", false},
+	{"github.com/user/repo@v1", url.Values{"rev": {"v2"}}, "github.com/user/repo", "", false},
+	{"github.com/user/repo", url.Values{"rev": {"v1", "v2"}}, "github.com/user/repo", "", false},
+	{"github.com/user/repo", url.Values{"rev": {""}}, "github.com/user/repo", "", false},
+}
+
+func TestSplitRef(t *testing.T) {
+	for _, tt := range splitRefTests {
+		path, ref, ok := splitRef(tt.path, tt.form)
+		if path != tt.want || ref != tt.ref || ok != tt.ok {
+			t.Errorf("splitRef(%q, %v) = %q, %q, %v, want %q, %q, %v", tt.path, tt.form, path, ref, ok, tt.want, tt.ref, tt.ok)
+		}
+	}
+}
+
+type fakeRefStore struct {
+	pdocs   map[string]*doc.Package
+	updated time.Time
+	blocked bool
+	hits    []string
+}
+
+func (s *fakeRefStore) GetRef(path, ref string) (*doc.Package, time.Time, error) {
+	return s.pdocs[path+"@"+ref], s.updated, nil
+}
+
+func (s *fakeRefStore) PutRef(pdoc *doc.Package, ref string, t time.Time) error {
+	s.pdocs[pdoc.ImportPath+"@"+ref] = pdoc
+	s.updated = t
+	return nil
+}
+
+func (s *fakeRefStore) BlockingRule(path string) (string, error) {
+	if s.blocked {
+		return path, nil
+	}
+	return "", nil
+}
+
+func (s *fakeRefStore) CountBlockHit(kind, rule string) error {
+	s.hits = append(s.hits, kind+" "+rule)
+	return nil
+}
+
+func TestServeRef(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pdoc := fragmentTestPackage()
+	pdoc.Doc = "Package pkg at v1.2.0.\n"
+	pdoc.DefaultBranch = "v1.2.0"
+	pdoc.ResolvedFrom = doc.Resolution{Kind: doc.ResolvedExplicit, Ref: "v1.2.0"}
+	store := &fakeRefStore{
+		pdocs:   map[string]*doc.Package{pdoc.ImportPath + "@v1.2.0": pdoc},
+		updated: time.Now(),
+	}
+	defer func(s refStore) { refDocs.store = s }(refDocs.store)
+	refDocs.store = store
+
+	var resp testResponse
+	req := &web.Request{Form: url.Values{}, Header: web.Header{}}
+	if err := serveRef(&resp, req, pdoc.ImportPath, "v1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	for _, s := range []string{
+		"Package pkg at v1.2.0.",
+		"documentation for the v1.2.0 tag or branch",
+		`<a href="/github.com/user/repo@v1.2.0">`,
+		`<span class="muted">@v1.2.0</span>`,
+		`content="NOINDEX"`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("ref page does not contain %q", s)
+		}
+	}
+	for _, s := range []string{`name="refresh"`, "?imports"} {
+		if strings.Contains(body, s) {
+			t.Errorf("ref page contains %q", s)
+		}
+	}
+
+	if len(store.hits) != 0 {
+		t.Errorf("block hits = %v, want none", store.hits)
+	}
+
+	store.blocked = true
+	if err := serveRef(&testResponse{}, req, pdoc.ImportPath, "v1.2.0"); err == nil {
+		t.Error("serveRef() for blocked package returned a page, want not found")
+	} else if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+		t.Errorf("serveRef() for blocked package returned %v, want not found", err)
+	}
+	if want := []string{"path " + pdoc.ImportPath}; !reflect.DeepEqual(store.hits, want) {
+		t.Errorf("block hits = %v, want %v", store.hits, want)
+	}
+}
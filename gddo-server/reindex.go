@@ -0,0 +1,108 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+)
+
+// reindexStatus is the progress of a search index rebuild by this server
+// instance. The status is published as an expvar.
+type reindexStatus struct {
+	mu      sync.Mutex
+	state   string
+	start   time.Time
+	done    int
+	total   int
+	lastErr string
+}
+
+func (s *reindexStatus) progress(done, total int) {
+	s.mu.Lock()
+	s.done = done
+	s.total = total
+	s.mu.Unlock()
+}
+
+func (s *reindexStatus) setState(state string, err error) {
+	s.mu.Lock()
+	s.state = state
+	if err != nil {
+		s.lastErr = err.Error()
+	}
+	s.mu.Unlock()
+}
+
+func (s *reindexStatus) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == "" {
+		return `{"state": "idle"}`
+	}
+	// The ETA assumes that the remaining packages are indexed at the
+	// average rate so far.
+	var eta time.Duration
+	if s.state == "running" && s.done > 0 {
+		elapsed := time.Since(s.start)
+		eta = elapsed*time.Duration(s.total)/time.Duration(s.done) - elapsed
+	}
+	return fmt.Sprintf(`{"state": %q, "done": %d, "total": %d, "etaSeconds": %d, "error": %q}`,
+		s.state, s.done, s.total, eta/time.Second, s.lastErr)
+}
+
+var reindexProgress = &reindexStatus{}
+
+func init() {
+	expvar.Publish("reindex", reindexProgress)
+}
+
+// reindexIfNeeded rebuilds the search index in the background when the live
+// index was built with an old tokenizer. Queries use the old index until the
+// rebuild completes. Progress is shown on the debug vars page.
+func reindexIfNeeded() {
+	version, err := db.IndexVersion()
+	if err != nil {
+		log.Printf("ERROR IndexVersion: %v", err)
+		return
+	}
+	if version == database.TokenizerVersion {
+		return
+	}
+	log.Printf("Rebuilding search index from tokenizer version %d to %d", version, database.TokenizerVersion)
+	reindexProgress.mu.Lock()
+	reindexProgress.state = "running"
+	reindexProgress.start = time.Now()
+	reindexProgress.mu.Unlock()
+	go func() {
+		err := db.Reindex(reindexProgress.progress)
+		switch err {
+		case nil:
+			log.Print("Rebuilt search index")
+			reindexProgress.setState("done", nil)
+		case database.ErrReindexInProgress:
+			// Another server instance is rebuilding the index.
+			reindexProgress.setState("elsewhere", nil)
+		default:
+			log.Printf("ERROR Reindex: %v", err)
+			reindexProgress.setState("failed", err)
+		}
+	}()
+}
@@ -0,0 +1,214 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements rendering package pages without an HTTP request.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// timeNow returns the current time for template funcs. Tests replace
+// timeNow to get the same output on every run.
+var timeNow = time.Now
+
+// stableRender is set by tests to replace values that change between runs
+// and deployments, the Google Analytics account and the static file hashes,
+// with placeholders.
+var stableRender = false
+
+// RenderOptions specifies the data shown on a package page other than the
+// package documentation.
+type RenderOptions struct {
+	// Subdirectories of the package.
+	Pkgs []database.Package
+
+	// MoreSubdirs is true if Pkgs lists the top level of a monorepo package
+	// only.
+	MoreSubdirs bool
+
+	// Number of packages that import the package.
+	ImporterCount int
+
+	// Anchor of the selected declaration or example.
+	Sel string
+
+	// Order of the package index, "" or "uses".
+	IndexOrder string
+
+	// Template data returned by the view loader.
+	ViewData map[string]interface{}
+
+	// Template data returned by loadSections. The data replaces the
+	// ImporterCount and Schedule options.
+	SectionData map[string]interface{}
+
+	// Text is true to render the plain text version of the page.
+	Text bool
+
+	// Crawl schedule of the package shown in the page footer.
+	Schedule *database.Schedule
+
+	// Historical is the time of the snapshot shown on the page or the zero
+	// time for the current documentation.
+	Historical time.Time
+
+	// Ref is the tag or branch requested explicitly for the page or "" for
+	// the current documentation.
+	Ref string
+}
+
+// packagePage returns the template name and template data for a package
+// page or a view of the package page.
+func packagePage(pdoc *doc.Package, v *view, opts *RenderOptions) (string, map[string]interface{}) {
+	if v != nil {
+		data := make(map[string]interface{})
+		for k, value := range opts.ViewData {
+			data[k] = value
+		}
+		data["pdoc"] = pdoc
+		data["view"] = v
+		return v.Template, data
+	}
+	name := "pkg"
+	if pdoc.IsCmd {
+		name = "cmd"
+	}
+	if opts.Text {
+		name += ".txt"
+	} else {
+		name += ".html"
+	}
+	data := map[string]interface{}{
+		"pkgs":          opts.Pkgs,
+		"listing":       listPackages(opts.Pkgs, pdoc.ImportPath),
+		"moreSubdirs":   opts.MoreSubdirs,
+		"pdoc":          pdoc,
+		"importerCount": opts.ImporterCount,
+		"sel":           opts.Sel,
+		"indexOrder":    opts.IndexOrder,
+		"schedule":      opts.Schedule,
+	}
+	if !opts.Historical.IsZero() {
+		data["historical"] = opts.Historical
+	}
+	if opts.Ref != "" {
+		data["ref"] = opts.Ref
+	}
+	for k, value := range opts.SectionData {
+		data[k] = value
+	}
+	return name, data
+}
+
+// RenderPackagePage renders the package page or the named view of the
+// package page. The templates must be parsed before calling the function.
+func RenderPackagePage(pdoc *doc.Package, viewName string, opts *RenderOptions) ([]byte, error) {
+	var v *view
+	if viewName != "" {
+		v = viewsByName[viewName]
+		if v == nil {
+			return nil, fmt.Errorf("view %q not found", viewName)
+		}
+	}
+	if opts == nil {
+		opts = &RenderOptions{}
+	}
+	name, data := packagePage(pdoc, v, opts)
+	var buf bytes.Buffer
+	if err := renderTemplate(&buf, nil, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// templateDigests maps template names to a hash of the template files. The
+// hash is part of the ETag of package pages.
+var templateDigests = map[string]string{}
+
+// setTemplateDigest sets the digest of the template with the given name
+// from the contents of files.
+func setTemplateDigest(name string, files []string) error {
+	h := sha1.New()
+	for _, fname := range files {
+		p, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		h.Write(p)
+	}
+	templateDigests[name] = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// packagePageETag returns the ETag of a package page rendered with the
+// named template and data. The ETag changes with the stored package, the
+// page data, the templates, the redirect rules, the service notice and the
+// advisories. Pages of packages without a stored etag do not have an ETag.
+func packagePageETag(name string, pdoc *doc.Package, data map[string]interface{}) (string, bool) {
+	digest := templateDigests[name]
+	if pdoc.Etag == "" || digest == "" {
+		return "", false
+	}
+	other := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if k != "pdoc" {
+			other[k] = v
+		}
+	}
+	other["activity"] = pdoc.Activity
+	other["context"] = pdoc.Context().String()
+	p, err := json.Marshal(other)
+	if err != nil {
+		return "", false
+	}
+	h := sha1.New()
+	io.WriteString(h, digest+"\x00"+pdoc.Etag+"\x00"+pdoc.Updated.String()+"\x00"+
+		serviceMessage(pdoc.ImportPath)+"\x00"+redirectsETag()+"\x00")
+	h.Write(p)
+	return storedDocETag("page-"+hex.EncodeToString(h.Sum(nil)), advisoriesFor(pdoc.ImportPath, "")), true
+}
+
+// executePackageTemplate executes the template for a package page with an
+// ETag and a Last-Modified header. The template is not executed for a
+// request with a matching If-None-Match header. If-Modified-Since is not
+// checked because the page data other than the package can change without
+// changing the time the package was updated.
+func executePackageTemplate(resp web.Response, req *web.Request, name string, pdoc *doc.Package, data map[string]interface{}) error {
+	header := make(web.Header)
+	if !pdoc.Updated.IsZero() {
+		header.Set(web.HeaderLastModified, pdoc.Updated.UTC().Format(http.TimeFormat))
+	}
+	if etag, ok := packagePageETag(name, pdoc, data); ok && !isTraceRequest(req) {
+		header.Set(web.HeaderETag, etag)
+		if etagMatches(req.Header.Get(web.HeaderIfNoneMatch), etag) {
+			resp.Start(web.StatusNotModified, header)
+			return nil
+		}
+	}
+	return executeTemplate(resp, req, name, web.StatusOK, header, data)
+}
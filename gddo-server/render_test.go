@@ -0,0 +1,310 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files in testdata.")
+
+var goldenPkgs = []database.Package{
+	{Path: "github.com/user/repo/pkg/sub", Synopsis: "Package sub does <b>things</b>."},
+	{Path: "io", Synopsis: "Package io provides basic interfaces to I/O primitives."},
+	{Path: "github.com/user/repo/internal/wire", Summary: "2 types, 5 funcs; notable: Conn"},
+	{Path: "github.com/user/versioned", Synopsis: "Package versioned is version 1.", NewestMajor: "github.com/user/versioned/v3"},
+}
+
+// checkGolden compares a rendered page with the golden file
+// testdata/<name>.golden.
+func checkGolden(t *testing.T, name string, p []byte) {
+	fname := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(fname, p, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, want) {
+		t.Errorf("%s does not match %s; run go test -update to regenerate the golden file\n%s", name, fname, p)
+	}
+}
+
+func TestGoldenPages(t *testing.T) {
+	defer func(stable bool, now func() time.Time, prefix string) {
+		stableRender, timeNow, *pathPrefix = stable, now, prefix
+	}(stableRender, timeNow, *pathPrefix)
+	stableRender = true
+	timeNow = func() time.Time { return time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC) }
+	*pathPrefix = ""
+
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"importers.html", "common.html", "layout.html"},
+		{"imports.html", "common.html", "layout.html"},
+		{"pkg.html", "common.html", "layout.html"},
+		{"results.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pdoc := fragmentTestPackage()
+	pdoc.Stability = doc.StabilityExperimental
+	pdoc.StabilityEvidence = "The API is experimental & may change."
+	for _, tt := range []struct {
+		name     string
+		viewName string
+		opts     *RenderOptions
+	}{
+		{"pkg", "", &RenderOptions{Pkgs: goldenPkgs[:1], ImporterCount: 3}},
+		{"imports", "imports", &RenderOptions{ViewData: map[string]interface{}{"pkgs": goldenPkgs}}},
+		{"importers", "importers", &RenderOptions{ViewData: map[string]interface{}{"pkgs": goldenPkgs, "listing": listPackages(goldenPkgs, pdoc.ProjectRoot)}}},
+	} {
+		for i := 0; i < 2; i++ {
+			p, err := RenderPackagePage(pdoc, tt.viewName, tt.opts)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			checkGolden(t, tt.name, p)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{"results", map[string]interface{}{"q": "<io>", "pkgs": goldenPkgs, "results": searchResults(nil, goldenPkgs)}},
+		{"results-scoped", map[string]interface{}{"q": "a&b", "scope": "github.com/user/repo", "pkgs": goldenPkgs[:1], "results": searchResults(nil, goldenPkgs[:1])}},
+		{"results-scoped-empty", map[string]interface{}{"q": "a&b", "scope": "github.com/user/repo"}},
+	} {
+		var buf bytes.Buffer
+		if err := renderTemplate(&buf, nil, "results.html", tt.data); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, tt.name, buf.Bytes())
+	}
+
+	if _, err := RenderPackagePage(pdoc, "nonexistent", nil); err == nil {
+		t.Errorf("RenderPackagePage with unknown view returned nil error")
+	}
+}
+
+func TestTextPage(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseTextTemplates([][]string{{"pkg.txt", "common.txt"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := RenderPackagePage(fragmentTestPackage(), "", &RenderOptions{Pkgs: goldenPkgs[:1], Text: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "pkg-txt", p)
+
+	// The synopsis is shown for a package without documentation.
+	pdoc := &doc.Package{ImportPath: "example.com/nodoc", Name: "nodoc", Synopsis: "Package nodoc has no comment."}
+	p, err = RenderPackagePage(pdoc, "", &RenderOptions{Text: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(p, []byte("    Package nodoc has no comment.")) {
+		t.Errorf("text page without documentation = %q, want synopsis", p)
+	}
+}
+
+// fakePackageStore serves stored packages for package pages.
+type fakePackageStore struct {
+	pdocs map[string]*doc.Package
+}
+
+func (s *fakePackageStore) CanonicalPath(path string) (string, error) { return "", nil }
+
+func (s *fakePackageStore) Get(path string) (*doc.Package, []database.Package, time.Time, error) {
+	pdoc, ok := s.pdocs[path]
+	if !ok {
+		return nil, nil, time.Time{}, nil
+	}
+	// The copy is not crawled again.
+	p := *pdoc
+	return &p, nil, time.Now().Add(time.Hour), nil
+}
+
+func (s *fakePackageStore) GetDoc(path string) (*doc.Package, time.Time, error) {
+	pdoc, _, nextCrawl, err := s.Get(path)
+	return pdoc, nextCrawl, err
+}
+
+func (s *fakePackageStore) ImporterCount(path string) (int, error) { return 0, nil }
+
+func TestServeTextPage(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseTextTemplates([][]string{{"pkg.txt", "common.txt"}}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	defer func() { packagePages.store = nil }()
+	packagePages.store = &fakePackageStore{pdocs: map[string]*doc.Package{pdoc.ImportPath: pdoc}}
+
+	for _, tt := range []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"format": {"txt"}}, web.StatusOK},
+		{url.Values{"format": {"txt"}, "sel": {"Copy"}}, web.StatusOK},
+		{url.Values{"format": {"txt", "md"}}, web.StatusNotFound},
+		{url.Values{"format": {"pdf"}}, web.StatusNotFound},
+	} {
+		req := &web.Request{
+			URL:       &url.URL{Path: "/" + pdoc.ImportPath},
+			Header:    web.Header{web.HeaderUserAgent: {"Googlebot/2.1 (+http://www.google.com/bot.html)"}},
+			Form:      tt.form,
+			RouteVars: map[string]string{"path": pdoc.ImportPath},
+		}
+		var resp testResponse
+		err := servePackage(&resp, req)
+		if tt.status == web.StatusNotFound {
+			if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+				t.Errorf("%v: servePackage() = %v, want not found", tt.form, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: servePackage() = %v", tt.form, err)
+		}
+		if resp.status != tt.status {
+			t.Errorf("%v: status = %d, want %d", tt.form, resp.status, tt.status)
+		}
+		if ct := resp.header.Get(web.HeaderContentType); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%v: content type = %q, want text/plain", tt.form, ct)
+		}
+		if body := resp.buf.String(); !strings.Contains(body, "func Copy(dst io.Writer, src io.Reader) Buffer") {
+			t.Errorf("%v: text page does not contain the Copy declaration:\n%s", tt.form, body)
+		}
+	}
+}
+
+// countingTemplate counts executions of a template.
+type countingTemplate struct {
+	n int
+}
+
+func (t *countingTemplate) Execute(w io.Writer, data interface{}) error {
+	t.n++
+	_, err := io.WriteString(w, "page")
+	return err
+}
+
+func TestConditionalPackagePage(t *testing.T) {
+	ct := &countingTemplate{}
+	for _, name := range []string{"pkg.html", "pkg.txt"} {
+		defer func(name string, tmpl interface {
+			Execute(io.Writer, interface{}) error
+		}, digest string) {
+			templates[name] = tmpl
+			templateDigests[name] = digest
+		}(name, templates[name], templateDigests[name])
+		templates[name] = ct
+		templateDigests[name] = "digest-" + name
+	}
+
+	updated := time.Date(2013, 7, 1, 12, 0, 0, 0, time.UTC)
+	pdoc := &doc.Package{ImportPath: "example.com/p", Name: "p", Etag: "abc", Updated: updated}
+	get := func(name, ifNoneMatch string, data map[string]interface{}) *testResponse {
+		req := &web.Request{Header: web.Header{}}
+		if ifNoneMatch != "" {
+			req.Header.Set(web.HeaderIfNoneMatch, ifNoneMatch)
+		}
+		var resp testResponse
+		if err := executePackageTemplate(&resp, req, name, pdoc, data); err != nil {
+			t.Fatal(err)
+		}
+		return &resp
+	}
+
+	resp := get("pkg.html", "", map[string]interface{}{"pdoc": pdoc})
+	etag := resp.header.Get(web.HeaderETag)
+	if resp.status != web.StatusOK || etag == "" || resp.buf.String() != "page" {
+		t.Fatalf("status, etag, body = %d, %q, %q; want 200, ETag, page", resp.status, etag, resp.buf.String())
+	}
+	if got, want := resp.header.Get(web.HeaderLastModified), "Mon, 01 Jul 2013 12:00:00 GMT"; got != want {
+		t.Errorf("Last-Modified = %q, want %q", got, want)
+	}
+
+	ct.n = 0
+	resp = get("pkg.html", etag, map[string]interface{}{"pdoc": pdoc})
+	if resp.status != web.StatusNotModified || resp.buf.Len() != 0 || ct.n != 0 {
+		t.Errorf("If-None-Match: status, body, executions = %d, %q, %d; want 304, empty, 0", resp.status, resp.buf.String(), ct.n)
+	}
+	if got := resp.header.Get(web.HeaderETag); got != etag {
+		t.Errorf("If-None-Match: ETag = %q, want %q", got, etag)
+	}
+
+	// The ETag depends on the template and the page data.
+	for _, tt := range []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{"pkg.txt", map[string]interface{}{"pdoc": pdoc}},
+		{"pkg.html", map[string]interface{}{"pdoc": pdoc, "importerCount": 3}},
+	} {
+		if resp := get(tt.name, etag, tt.data); resp.status != web.StatusOK {
+			t.Errorf("%s %v: status = %d, want %d", tt.name, tt.data, resp.status, web.StatusOK)
+		}
+	}
+
+	// Packages without a stored etag are rendered on every request.
+	pdoc.Etag = ""
+	if resp := get("pkg.html", etag, map[string]interface{}{"pdoc": pdoc}); resp.status != web.StatusOK || resp.header.Get(web.HeaderETag) != "" {
+		t.Errorf("no stored etag: status, ETag = %d, %q; want 200, none", resp.status, resp.header.Get(web.HeaderETag))
+	}
+}
+
+var relativeTimeTests = []struct {
+	d time.Duration
+	s string
+}{
+	{0, "just now"},
+	{90 * time.Second, "one minute ago"},
+	{5 * time.Hour, "5 hours ago"},
+	{72 * time.Hour, "3 days ago"},
+	{-time.Hour, "just now"},
+}
+
+func TestRelativeTime(t *testing.T) {
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	now := time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	for _, tt := range relativeTimeTests {
+		if s := relativeTime(now.Add(-tt.d)); s != tt.s {
+			t.Errorf("relativeTime(now - %v) = %q, want %q", tt.d, s, tt.s)
+		}
+	}
+}
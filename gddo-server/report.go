@@ -0,0 +1,220 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements user reports of package pages that need review and
+// the moderation page where administrators act on the reports. Reporters
+// are anonymous; submissions are rate limited by IP address.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var reportQuotaLimit = flag.Int("quota_report", 2, "Package reports per minute from a client. Zero disables the quota.")
+
+const (
+	// maxReportText is the maximum size in bytes of the text of a report.
+	maxReportText = 1000
+
+	// maxReportGroups is the maximum number of packages listed on the
+	// moderation page.
+	maxReportGroups = 200
+)
+
+type reportReason struct {
+	Name  string
+	Label string
+}
+
+var reportReasons = []reportReason{
+	{"malware", "Malware or suspicious code"},
+	{"rendering", "Broken rendering"},
+	{"copyright", "Copyright or license issue"},
+	{"other", "Other"},
+}
+
+func reportReasonsFn() []reportReason {
+	return reportReasons
+}
+
+func isReportReason(name string) bool {
+	for _, r := range reportReasons {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reportStore stores reports. The database implements the interface.
+type reportStore interface {
+	PutReport(r database.Report) error
+	OpenReports(n int) ([]database.ReportGroup, error)
+	DismissReports(path string) error
+}
+
+// moderation is the report store and the actions taken on reported
+// packages. The fields are set in main.
+var moderation struct {
+	store   reportStore
+	block   func(path string) error
+	refresh func(path string) error
+}
+
+// refreshPackage fetches a package from the repository and updates the
+// stored documentation.
+func refreshPackage(path string) error {
+	_, pkgs, _, err := db.Get(path)
+	if err != nil {
+		return err
+	}
+	_, err = crawlDoc("admin", path, nil, len(pkgs) > 0, time.Time{})
+	invalidateFragments(path)
+	return err
+}
+
+// reporterKey is mixed into the hash of reporter IP addresses so that the
+// stored hashes cannot be matched against a list of addresses. The key
+// changes when the server restarts.
+var reporterKey = make([]byte, 16)
+
+func init() {
+	if _, err := rand.Read(reporterKey); err != nil {
+		panic(err)
+	}
+}
+
+func reporterHash(ip string) string {
+	h := sha256.New()
+	h.Write(reporterKey)
+	h.Write([]byte(ip))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// sanitizeReportText replaces invalid UTF-8 and removes control characters
+// other than newline and tab from report text. The result is truncated to
+// maxReportText bytes.
+func sanitizeReportText(s string) string {
+	var buf []byte
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				r = unicode.ReplacementChar
+			}
+		}
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			continue
+		}
+		var p [utf8.UTFMax]byte
+		n := utf8.EncodeRune(p[:], r)
+		if len(buf)+n > maxReportText {
+			break
+		}
+		buf = append(buf, p[:n]...)
+	}
+	return strings.TrimSpace(string(buf))
+}
+
+// serveReport files a report for a package.
+func serveReport(resp web.Response, req *web.Request) error {
+	path := req.Form.Get("path")
+	reason := req.Form.Get("reason")
+	if !doc.IsValidPath(path) || !isReportReason(reason) {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	ip := clientIP(req, trustedProxyNets)
+	if limit := *reportQuotaLimit; limit > 0 {
+		if s := quotas.take("report ip "+ip, limit); s.retryAfter > 0 {
+			return &web.Error{Status: web.StatusTooManyRequests}
+		}
+	}
+	err := moderation.store.PutReport(database.Report{
+		Path:     path,
+		Reason:   reason,
+		Text:     sanitizeReportText(req.Form.Get("text")),
+		Time:     time.Now().UTC(),
+		Reporter: reporterHash(ip),
+	})
+	if err != nil {
+		return err
+	}
+	return web.Redirect(resp, req, sitePath("/"+path), 302, nil)
+}
+
+// serveReports serves the moderation page listing the open reports grouped
+// by package.
+func serveReports(resp web.Response, req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	groups, err := moderation.store.OpenReports(maxReportGroups)
+	if err != nil {
+		return err
+	}
+	for i := range groups {
+		for j := range groups[i].Texts {
+			groups[i].Texts[j].Text = sanitizeReportText(groups[i].Texts[j].Text)
+		}
+	}
+	labels := make(map[string]string)
+	for _, r := range reportReasons {
+		labels[r.Name] = r.Label
+	}
+	return executeTemplate(resp, req, "reports.html", web.StatusOK, nil, map[string]interface{}{
+		"groups": groups,
+		"labels": labels,
+		"csrf":   adminToken(req),
+	})
+}
+
+// serveReportAction blocks, refreshes or dismisses the reports for a
+// package. Blocking a package also dismisses the reports.
+func serveReportAction(resp web.Response, req *web.Request) error {
+	if err := checkAdminPost(req); err != nil {
+		return err
+	}
+	path := req.Form.Get("path")
+	if path == "" {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	var err error
+	switch req.Form.Get("action") {
+	case "block":
+		if err = moderation.block(path); err == nil {
+			err = moderation.store.DismissReports(path)
+		}
+	case "refresh":
+		err = moderation.refresh(path)
+	case "dismiss":
+		err = moderation.store.DismissReports(path)
+	default:
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	if err != nil {
+		return err
+	}
+	return web.Redirect(resp, req, sitePath("/-/reports"), 302, nil)
+}
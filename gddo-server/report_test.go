@@ -0,0 +1,214 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeReportStore struct {
+	reports   []database.Report
+	groups    []database.ReportGroup
+	dismissed []string
+}
+
+func (s *fakeReportStore) PutReport(r database.Report) error {
+	s.reports = append(s.reports, r)
+	return nil
+}
+
+func (s *fakeReportStore) OpenReports(n int) ([]database.ReportGroup, error) {
+	return s.groups, nil
+}
+
+func (s *fakeReportStore) DismissReports(path string) error {
+	s.dismissed = append(s.dismissed, path)
+	return nil
+}
+
+// setTestModeration sets the moderation store and actions to fakes that
+// record the actions in calls. The returned function restores the previous
+// values.
+func setTestModeration(store reportStore, calls *[]string) func() {
+	saved := moderation
+	moderation.store = store
+	moderation.block = func(path string) error {
+		*calls = append(*calls, "block "+path)
+		return nil
+	}
+	moderation.refresh = func(path string) error {
+		*calls = append(*calls, "refresh "+path)
+		return nil
+	}
+	return func() { moderation = saved }
+}
+
+func TestReportRateLimit(t *testing.T) {
+	clock := &testClock{time.Unix(1000, 0)}
+	defer func(q *quotaLimiter, limit int) {
+		quotas, *reportQuotaLimit = q, limit
+	}(quotas, *reportQuotaLimit)
+	quotas = newQuotaLimiter(10)
+	quotas.now = clock.now
+	*reportQuotaLimit = 2
+
+	store := &fakeReportStore{}
+	var calls []string
+	defer setTestModeration(store, &calls)()
+
+	report := func(addr, path, reason string) error {
+		req := &web.Request{
+			RemoteAddr: addr + ":1234",
+			Header:     web.Header{},
+			Form:       url.Values{"path": {path}, "reason": {reason}, "text": {"bad\x00 <b>code</b>\xff"}},
+		}
+		return serveReport(&testResponse{}, req)
+	}
+	status := func(err error) int {
+		if e, ok := err.(*web.Error); ok {
+			return e.Status
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return web.StatusOK
+	}
+
+	for i, tt := range []struct {
+		addr, path, reason string
+		status             int
+	}{
+		{"10.0.0.1", "github.com/user/repo", "malware", web.StatusOK},
+		{"10.0.0.1", "github.com/user/repo", "malware", web.StatusOK},
+		{"10.0.0.1", "github.com/user/repo", "malware", web.StatusTooManyRequests},
+		{"10.0.0.2", "github.com/user/repo", "rendering", web.StatusOK},
+		{"10.0.0.3", "github.com/user/repo", "spam", web.StatusBadRequest},
+		{"10.0.0.3", "not a path", "other", web.StatusBadRequest},
+	} {
+		if s := status(report(tt.addr, tt.path, tt.reason)); s != tt.status {
+			t.Errorf("report %d from %s returned status %d, want %d", i, tt.addr, s, tt.status)
+		}
+	}
+
+	// The bucket refills with time.
+	clock.t = clock.t.Add(time.Minute)
+	if s := status(report("10.0.0.1", "github.com/user/repo", "other")); s != web.StatusOK {
+		t.Errorf("report after refill returned status %d", s)
+	}
+
+	if len(store.reports) != 4 {
+		t.Fatalf("stored %d reports, want 4", len(store.reports))
+	}
+	r := store.reports[0]
+	if r.Text != "bad <b>code</b>�" {
+		t.Errorf("stored text %q, want control characters removed and invalid UTF-8 replaced", r.Text)
+	}
+	if r.Reporter == "" || strings.Contains(r.Reporter, "10.0.0.1") || r.Reporter != store.reports[1].Reporter || r.Reporter == store.reports[2].Reporter {
+		t.Errorf("reporters %q, %q, %q, want equal hashes for the same address", r.Reporter, store.reports[1].Reporter, store.reports[2].Reporter)
+	}
+}
+
+func TestSanitizeReportText(t *testing.T) {
+	long := strings.Repeat("é", maxReportText)
+	s := sanitizeReportText(long)
+	if len(s) > maxReportText || !strings.HasPrefix(long, s) {
+		t.Errorf("sanitizeReportText(long) has length %d, want at most %d on a rune boundary", len(s), maxReportText)
+	}
+	if s := sanitizeReportText("  line 1\r\n\tline 2\x1b[31m  "); s != "line 1\n\tline 2[31m" {
+		t.Errorf("sanitizeReportText = %q", s)
+	}
+}
+
+func TestReportActions(t *testing.T) {
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+	store := &fakeReportStore{}
+	var calls []string
+	defer setTestModeration(store, &calls)()
+
+	admin := url.Values{"admin": {"key"}}
+	token := adminToken(&web.Request{Cookie: admin})
+	action := func(action string, cookie url.Values) error {
+		req := &web.Request{Form: url.Values{"path": {"github.com/user/repo"}, "action": {action}, "csrf": {token}}, Cookie: cookie}
+		return serveReportAction(&testResponse{}, req)
+	}
+
+	for _, name := range []string{"block", "refresh", "dismiss"} {
+		if err := action(name, nil); err == nil || err.(*web.Error).Status != web.StatusNotFound {
+			t.Errorf("%s without admin cookie returned %v, want not found", name, err)
+		}
+	}
+	if len(calls) != 0 || len(store.dismissed) != 0 {
+		t.Fatalf("actions without admin cookie called %v, dismissed %v", calls, store.dismissed)
+	}
+
+	for _, name := range []string{"block", "refresh", "dismiss"} {
+		if err := action(name, admin); err != nil {
+			t.Errorf("%s returned %v", name, err)
+		}
+	}
+	if want := []string{"block github.com/user/repo", "refresh github.com/user/repo"}; strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	// Block dismisses the reports.
+	if len(store.dismissed) != 2 {
+		t.Errorf("dismissed = %v, want two dismissals", store.dismissed)
+	}
+	if err := action("delete", admin); err == nil || err.(*web.Error).Status != web.StatusBadRequest {
+		t.Errorf("unknown action returned %v, want bad request", err)
+	}
+}
+
+func TestReportsPage(t *testing.T) {
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"reports.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeReportStore{groups: []database.ReportGroup{{
+		Path:    "github.com/user/repo",
+		Last:    time.Unix(1400000000, 0).UTC(),
+		Reasons: map[string]int{"malware": 3, "rendering": 1},
+		Texts:   []database.Report{{Reason: "malware", Text: "<script>alert(1)</script>\x07", Reporter: "abc"}},
+	}}}
+	var calls []string
+	defer setTestModeration(store, &calls)()
+
+	if err := serveReports(&testResponse{}, &web.Request{}); err == nil || err.(*web.Error).Status != web.StatusNotFound {
+		t.Errorf("reports page without admin cookie returned %v, want not found", err)
+	}
+
+	var resp testResponse
+	if err := serveReports(&resp, &web.Request{Cookie: url.Values{"admin": {"key"}}}); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	token := adminToken(&web.Request{Cookie: url.Values{"admin": {"key"}}})
+	for _, want := range []string{"4 reports", "Malware or suspicious code: 3", "&lt;script&gt;alert(1)&lt;/script&gt;</pre>", `name="csrf" value="` + token + `"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("reports page does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "<script>alert") || strings.Contains(body, "\x07") {
+		t.Errorf("reports page contains unsanitized text")
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the crawl schedule shown on package pages and the
+// refresh cadence that project authors request for their projects. An
+// author requests a token, commits the token to a file in the root of the
+// repository and asks the server to check the file. After the check, the
+// packages in the project are crawled at a shorter interval until the
+// cadence expires.
+//
+// The client that requests the token is given an author key in a cookie.
+// When the check succeeds, the author key becomes an API token authorized
+// to read the declaration views of the project.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var (
+	cadenceInterval   = flag.Duration("cadence_interval", time.Hour, "Crawl interval for projects with a verified refresh cadence request.")
+	cadenceTTL        = flag.Duration("cadence_ttl", 30*24*time.Hour, "Time a verified refresh cadence request is in effect.")
+	cadenceQuotaLimit = flag.Int("quota_cadence", 2, "Refresh cadence requests per minute from a client. Zero disables the quota.")
+)
+
+const (
+	// refreshFileName is the name of the file in the root of a repository
+	// that holds the token for a refresh cadence request.
+	refreshFileName = ".gddo-refresh"
+
+	// refreshTokenTTL is the time an author has to commit a token.
+	refreshTokenTTL = 24 * time.Hour
+)
+
+// scheduleStore stores crawl schedules. The database implements the
+// interface.
+type scheduleStore interface {
+	GetSchedule(path, root string) (database.Schedule, error)
+	GetCadence(root string) (database.Cadence, error)
+	PutCadence(root string, c database.Cadence) error
+	PutFetchResult(path string, r database.FetchResult) error
+	PutRefreshToken(root, token, author string, ttl time.Duration) error
+	GetRefreshToken(root string) (token, author string, err error)
+	DeleteRefreshToken(root string) error
+	PutAPIToken(token string, t database.APIToken) error
+}
+
+// schedules is the schedule store and the function that fetches a file
+// from the root of a project. The fields are set in main.
+var schedules struct {
+	store   scheduleStore
+	getFile func(root, name string) ([]byte, error)
+}
+
+// scheduleNextCrawl returns the time of the next crawl of a package in the
+// project with the given root. The time is moved before next if the
+// project has a cadence that is in effect at start.
+func scheduleNextCrawl(store scheduleStore, root string, start, next time.Time) time.Time {
+	if store == nil || root == "" {
+		return next
+	}
+	c, err := store.GetCadence(root)
+	if err != nil {
+		log.Printf("ERROR getting cadence for %q: %v", root, err)
+		return next
+	}
+	if c.Active(start) && start.Add(c.Interval).Before(next) {
+		return start.Add(c.Interval)
+	}
+	return next
+}
+
+// fetchResult returns the name of the result of a fetch shown on the
+// package page.
+func fetchResult(err error) string {
+	switch {
+	case err == nil:
+		return "updated"
+	case err == doc.ErrNotModified:
+		return "not modified"
+	case doc.IsNotFound(err):
+		return "not found"
+	case isRateLimitError(err):
+		return "rate limited"
+	}
+	return "error"
+}
+
+// recordFetchResult stores the result of a fetch of the package.
+func recordFetchResult(path string, t time.Time, err error) {
+	if schedules.store == nil {
+		return
+	}
+	if err := schedules.store.PutFetchResult(path, database.FetchResult{Time: t, Result: fetchResult(err)}); err != nil {
+		log.Printf("ERROR storing fetch result for %q: %v", path, err)
+	}
+}
+
+// packageSchedule returns the crawl schedule for the package page or nil
+// if the schedule is not available.
+func packageSchedule(pdoc *doc.Package) *database.Schedule {
+	if schedules.store == nil {
+		return nil
+	}
+	s, err := schedules.store.GetSchedule(pdoc.ImportPath, pdoc.ProjectRoot)
+	if err != nil {
+		log.Printf("ERROR getting schedule for %q: %v", pdoc.ImportPath, err)
+		return nil
+	}
+	return &s
+}
+
+// loadSchedule returns the crawl schedule and the pending refresh token of
+// the project.
+func loadSchedule(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	data := map[string]interface{}{
+		"schedule":        packageSchedule(pdoc),
+		"refreshFile":     refreshFileName,
+		"verifyFailed":    req.Form.Get("verify") == "failed",
+		"cadenceInterval": *cadenceInterval,
+		"cadenceTTL":      *cadenceTTL,
+	}
+	if pdoc.ProjectRoot != "" && schedules.store != nil {
+		token, _, err := schedules.store.GetRefreshToken(pdoc.ProjectRoot)
+		if err != nil {
+			return nil, err
+		}
+		data["token"] = token
+		data["author"] = authorizedForProject(req, pdoc.ProjectRoot)
+	}
+	return data, nil
+}
+
+// durationFn formats a duration in whole days or hours if possible.
+func durationFn(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d == day:
+		return "1 day"
+	case d > day && d%day == 0:
+		return fmt.Sprintf("%d days", d/day)
+	case d == time.Hour:
+		return "1 hour"
+	case d > time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+	return d.String()
+}
+
+// newRefreshToken returns a random token for a refresh cadence request.
+func newRefreshToken() (string, error) {
+	p := make([]byte, 12)
+	if _, err := rand.Read(p); err != nil {
+		return "", err
+	}
+	return "gddo-" + hex.EncodeToString(p), nil
+}
+
+// authorCookie is the name of the cookie that holds the author key.
+const authorCookie = "author"
+
+// requestAuthorKey returns the author key in the request cookie or "" if
+// the cookie is missing or malformed.
+func requestAuthorKey(req *web.Request) string {
+	key := req.Cookie.Get(authorCookie)
+	if len(key) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return ""
+	}
+	return key
+}
+
+// newAuthorKey returns a random author key. Author keys have the format of
+// the API tokens issued by administrators.
+func newAuthorKey() (string, error) {
+	p := make([]byte, 16)
+	if _, err := rand.Read(p); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(p), nil
+}
+
+// grantAuthor authorizes the API token with the author key to read the
+// declaration views of the project with the given root. The token is
+// created if it does not exist.
+func grantAuthor(key, root string) error {
+	if key == "" {
+		return nil
+	}
+	t, ok := lookupAPIToken(key)
+	if !ok {
+		t = database.APIToken{Label: "author", Tier: anonymousTier}
+	}
+	if t.HasRoot(root) {
+		return nil
+	}
+	t.Roots = append(append([]string(nil), t.Roots...), root)
+	if err := schedules.store.PutAPIToken(key, t); err != nil {
+		return err
+	}
+	cacheAPIToken(key, t)
+	return nil
+}
+
+var errRefreshToken = errors.New("refresh file does not contain the token")
+
+// verifyCadence checks the refresh file in the root of the project once.
+// If the file contains the pending token, then the token is deleted, the
+// cadence of the project is set until the cadence expires and the client
+// that requested the token is authorized as an author of the project.
+func verifyCadence(root string, now time.Time) error {
+	token, author, err := schedules.store.GetRefreshToken(root)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return &web.Error{Status: web.StatusBadRequest, Reason: errors.New("no pending refresh token")}
+	}
+	p, err := schedules.getFile(root, refreshFileName)
+	if err != nil {
+		if doc.IsNotFound(err) {
+			return errRefreshToken
+		}
+		return err
+	}
+	if strings.TrimSpace(string(p)) != token {
+		return errRefreshToken
+	}
+	if err := schedules.store.DeleteRefreshToken(root); err != nil {
+		return err
+	}
+	if err := schedules.store.PutCadence(root, database.Cadence{Interval: *cadenceInterval, Expires: now.Add(*cadenceTTL)}); err != nil {
+		return err
+	}
+	return grantAuthor(author, root)
+}
+
+// serveCadence issues a refresh token for a project or checks the refresh
+// file for the token. The client is redirected to the schedule view of the
+// package page. The author key cookie is set when a token is issued.
+func serveCadence(resp web.Response, req *web.Request) error {
+	path := req.Form.Get("path")
+	root := req.Form.Get("root")
+	if !doc.IsValidPath(path) || !doc.IsValidPath(root) || (path != root && !strings.HasPrefix(path, root+"/")) {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	if limit := *cadenceQuotaLimit; limit > 0 {
+		if s := quotas.take("cadence ip "+clientIP(req, trustedProxyNets), limit); s.retryAfter > 0 {
+			return &web.Error{Status: web.StatusTooManyRequests}
+		}
+	}
+	u := sitePath("/"+path) + "?schedule"
+	var header web.Header
+	switch req.Form.Get("action") {
+	case "token":
+		token, err := newRefreshToken()
+		if err != nil {
+			return err
+		}
+		author := requestAuthorKey(req)
+		if author == "" {
+			author, err = newAuthorKey()
+			if err != nil {
+				return err
+			}
+		}
+		if err := schedules.store.PutRefreshToken(root, token, author, refreshTokenTTL); err != nil {
+			return err
+		}
+		header = web.Header{"Set-Cookie": {fmt.Sprintf("%s=%s; Path=%s; Max-Age=%d; HttpOnly",
+			authorCookie, author, sitePath("/"), int64(*cadenceTTL/time.Second))}}
+	case "verify":
+		switch err := verifyCadence(root, time.Now()); err {
+		case nil:
+		case errRefreshToken:
+			u = sitePath("/"+path) + "?view=schedule&verify=failed"
+		default:
+			return err
+		}
+	default:
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	return web.Redirect(resp, req, u, 302, header)
+}
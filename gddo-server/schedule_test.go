@@ -0,0 +1,325 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeScheduleStore struct {
+	schedules map[string]database.Schedule
+	cadences  map[string]database.Cadence
+	tokens    map[string]string
+	authors   map[string]string
+	apiTokens map[string]database.APIToken
+	results   map[string]database.FetchResult
+}
+
+func newFakeScheduleStore() *fakeScheduleStore {
+	return &fakeScheduleStore{
+		schedules: make(map[string]database.Schedule),
+		cadences:  make(map[string]database.Cadence),
+		tokens:    make(map[string]string),
+		authors:   make(map[string]string),
+		apiTokens: make(map[string]database.APIToken),
+		results:   make(map[string]database.FetchResult),
+	}
+}
+
+func (s *fakeScheduleStore) GetSchedule(path, root string) (database.Schedule, error) {
+	sch := s.schedules[path]
+	sch.LastFetch = s.results[path]
+	sch.Cadence = s.cadences[root]
+	return sch, nil
+}
+
+func (s *fakeScheduleStore) GetCadence(root string) (database.Cadence, error) {
+	return s.cadences[root], nil
+}
+
+func (s *fakeScheduleStore) PutCadence(root string, c database.Cadence) error {
+	s.cadences[root] = c
+	return nil
+}
+
+func (s *fakeScheduleStore) PutFetchResult(path string, r database.FetchResult) error {
+	s.results[path] = r
+	return nil
+}
+
+func (s *fakeScheduleStore) PutRefreshToken(root, token, author string, ttl time.Duration) error {
+	s.tokens[root] = token
+	s.authors[root] = author
+	return nil
+}
+
+func (s *fakeScheduleStore) GetRefreshToken(root string) (string, string, error) {
+	return s.tokens[root], s.authors[root], nil
+}
+
+func (s *fakeScheduleStore) DeleteRefreshToken(root string) error {
+	delete(s.tokens, root)
+	delete(s.authors, root)
+	return nil
+}
+
+func (s *fakeScheduleStore) PutAPIToken(token string, t database.APIToken) error {
+	s.apiTokens[token] = t
+	return nil
+}
+
+// setTestSchedules sets the schedule store and the project file fetcher to
+// fakes. The fetcher returns the files in the map keyed by root and name
+// and records the fetches in calls. The returned function restores the
+// previous values.
+func setTestSchedules(store scheduleStore, files map[string]string, calls *[]string) func() {
+	saved := schedules
+	schedules.store = store
+	schedules.getFile = func(root, name string) ([]byte, error) {
+		*calls = append(*calls, root+"/"+name)
+		s, ok := files[root+"/"+name]
+		if !ok {
+			return nil, doc.NotFoundError{Message: "file not found"}
+		}
+		return []byte(s), nil
+	}
+	return func() { schedules = saved }
+}
+
+func TestScheduleNextCrawl(t *testing.T) {
+	store := newFakeScheduleStore()
+	start := time.Unix(1400000000, 0).UTC()
+	next := start.Add(7 * 24 * time.Hour)
+	store.cadences["github.com/user/fast"] = database.Cadence{Interval: time.Hour, Expires: start.Add(24 * time.Hour)}
+	store.cadences["github.com/user/slow"] = database.Cadence{Interval: 30 * 24 * time.Hour, Expires: start.Add(24 * time.Hour)}
+
+	for _, tt := range []struct {
+		root  string
+		start time.Time
+		want  time.Time
+	}{
+		{"github.com/user/fast", start, start.Add(time.Hour)},
+		{"github.com/user/fast", start.Add(23 * time.Hour), start.Add(24 * time.Hour)},
+		// The cadence is not used after it expires.
+		{"github.com/user/fast", start.Add(24 * time.Hour), next},
+		// A cadence does not delay a crawl.
+		{"github.com/user/slow", start, next},
+		{"github.com/user/other", start, next},
+		{"", start, next},
+	} {
+		if got := scheduleNextCrawl(store, tt.root, tt.start, next); !got.Equal(tt.want) {
+			t.Errorf("scheduleNextCrawl(%q, %v) = %v, want %v", tt.root, tt.start, got, tt.want)
+		}
+	}
+	if got := scheduleNextCrawl(nil, "github.com/user/fast", start, next); !got.Equal(next) {
+		t.Errorf("scheduleNextCrawl(nil store) = %v, want %v", got, next)
+	}
+}
+
+func TestNextCrawlTime(t *testing.T) {
+	defer setTestSchedules(newFakeScheduleStore(), nil, nil)()
+	fetched := time.Unix(1400000000, 0).UTC()
+	pdoc := &doc.Package{ImportPath: "github.com/user/repo", ProjectRoot: "github.com/user/repo"}
+	want := nextCrawlTime(pdoc.ImportPath, pdoc, fetched)
+	if !want.Equal(fetched.Add(*maxAge * 7)) {
+		t.Errorf("nextCrawlTime = %v, want %v", want, fetched.Add(*maxAge*7))
+	}
+
+	// Activity from a host with a clock ahead of the local clock does not
+	// change the schedule.
+	pdoc.Activity = &doc.ProjectActivity{
+		LastCommit:    fetched,
+		RawLastCommit: fetched.Add(365 * 24 * time.Hour),
+		ClockSkew:     365 * 24 * time.Hour,
+		Fetched:       fetched,
+	}
+	if got := nextCrawlTime(pdoc.ImportPath, pdoc, fetched); !got.Equal(want) {
+		t.Errorf("nextCrawlTime with future activity = %v, want %v", got, want)
+	}
+}
+
+func TestFetchResult(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "updated"},
+		{doc.ErrNotModified, "not modified"},
+		{doc.NotFoundError{Message: "gone"}, "not found"},
+		{doc.RateLimitError{Host: "api.github.com"}, "rate limited"},
+		{errors.New("timeout"), "error"},
+	} {
+		if got := fetchResult(tt.err); got != tt.want {
+			t.Errorf("fetchResult(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyCadence(t *testing.T) {
+	store := newFakeScheduleStore()
+	files := make(map[string]string)
+	var calls []string
+	defer setTestSchedules(store, files, &calls)()
+	now := time.Unix(1400000000, 0).UTC()
+	root := "github.com/user/repo"
+
+	if err := verifyCadence(root, now); err == nil || len(calls) != 0 {
+		t.Errorf("verifyCadence() without token returned %v after %d fetches, want error without fetch", err, len(calls))
+	}
+
+	store.tokens[root] = "gddo-token"
+	if err := verifyCadence(root, now); err != errRefreshToken {
+		t.Errorf("verifyCadence() without file returned %v, want errRefreshToken", err)
+	}
+	files[root+"/"+refreshFileName] = "gddo-other\n"
+	if err := verifyCadence(root, now); err != errRefreshToken {
+		t.Errorf("verifyCadence() with wrong token returned %v, want errRefreshToken", err)
+	}
+	if _, ok := store.cadences[root]; ok {
+		t.Errorf("cadence set after failed verification")
+	}
+
+	files[root+"/"+refreshFileName] = "gddo-token\n"
+	calls = nil
+	if err := verifyCadence(root, now); err != nil {
+		t.Fatalf("verifyCadence() returned error %v", err)
+	}
+	if len(calls) != 1 || calls[0] != root+"/"+refreshFileName {
+		t.Errorf("verifyCadence() fetched %v, want one fetch of %s", calls, refreshFileName)
+	}
+	c := store.cadences[root]
+	if c.Interval != *cadenceInterval || !c.Expires.Equal(now.Add(*cadenceTTL)) {
+		t.Errorf("cadence = %+v, want interval %v until %v", c, *cadenceInterval, now.Add(*cadenceTTL))
+	}
+	if _, ok := store.tokens[root]; ok {
+		t.Errorf("token not deleted after verification")
+	}
+}
+
+func TestServeCadence(t *testing.T) {
+	defer func(limit int) { *cadenceQuotaLimit = limit }(*cadenceQuotaLimit)
+	*cadenceQuotaLimit = 0
+	store := newFakeScheduleStore()
+	files := make(map[string]string)
+	var calls []string
+	defer setTestSchedules(store, files, &calls)()
+	defer setTestAPITokens(map[string]database.APIToken{})()
+
+	var cookie url.Values
+	post := func(path, root, action string) error {
+		req := &web.Request{
+			RemoteAddr: "10.0.0.1:1234",
+			Header:     web.Header{},
+			Cookie:     cookie,
+			Form:       url.Values{"path": {path}, "root": {root}, "action": {action}},
+		}
+		return serveCadence(&testResponse{}, req)
+	}
+
+	if err := post("github.com/user/repo/pkg", "github.com/other/repo", "token"); err == nil {
+		t.Errorf("serveCadence() for root of other project returned nil error")
+	}
+	if err := post("github.com/user/repo/pkg", "github.com/user/repo", "unknown"); err == nil {
+		t.Errorf("serveCadence() with unknown action returned nil error")
+	}
+
+	if err := post("github.com/user/repo/pkg", "github.com/user/repo", "token"); err != nil {
+		t.Fatalf("serveCadence(token) returned error %v", err)
+	}
+	token := store.tokens["github.com/user/repo"]
+	if !strings.HasPrefix(token, "gddo-") {
+		t.Errorf("stored token %q, want gddo- prefix", token)
+	}
+	author := store.authors["github.com/user/repo"]
+	if len(author) != 32 {
+		t.Errorf("stored author key %q, want 32 hex digits", author)
+	}
+
+	// The author key in the cookie is reused for the next token.
+	cookie = url.Values{authorCookie: {author}}
+	if err := post("github.com/user/repo/pkg", "github.com/user/repo", "token"); err != nil {
+		t.Fatalf("serveCadence(token) with cookie returned error %v", err)
+	}
+	if a := store.authors["github.com/user/repo"]; a != author {
+		t.Errorf("stored author key %q with cookie, want %q", a, author)
+	}
+	token = store.tokens["github.com/user/repo"]
+	cookie = nil
+
+	// A failed check is shown on the schedule view.
+	if err := post("github.com/user/repo/pkg", "github.com/user/repo", "verify"); err != nil {
+		t.Fatalf("serveCadence(verify) without file returned error %v", err)
+	}
+	if _, ok := store.cadences["github.com/user/repo"]; ok {
+		t.Errorf("cadence set without file")
+	}
+
+	files["github.com/user/repo/"+refreshFileName] = token
+	if err := post("github.com/user/repo/pkg", "github.com/user/repo", "verify"); err != nil {
+		t.Fatalf("serveCadence(verify) returned error %v", err)
+	}
+	if c := store.cadences["github.com/user/repo"]; c.Interval != *cadenceInterval {
+		t.Errorf("cadence interval = %v after verification, want %v", c.Interval, *cadenceInterval)
+	}
+
+	// The author key of the client that requested the token is authorized
+	// for the project, not the client that asked for the check.
+	apiToken, ok := store.apiTokens[author]
+	if !ok || !apiToken.HasRoot("github.com/user/repo") || apiToken.Tier != anonymousTier {
+		t.Errorf("API token for author key = %+v, %v, want anonymous tier token for github.com/user/repo", apiToken, ok)
+	}
+	if len(store.apiTokens) != 1 {
+		t.Errorf("stored %d API tokens, want 1", len(store.apiTokens))
+	}
+}
+
+func TestScheduleView(t *testing.T) {
+	parseTestTemplates(t)
+	store := newFakeScheduleStore()
+	var calls []string
+	defer setTestSchedules(store, nil, &calls)()
+
+	path := "github.com/user/repo/pkg"
+	root := "github.com/user/repo"
+	next := time.Unix(1400003600, 0).UTC()
+	store.schedules[path] = database.Schedule{NextCrawl: next}
+	store.results[path] = database.FetchResult{Time: time.Unix(1400000000, 0).UTC(), Result: "not modified"}
+	store.tokens[root] = "gddo-abc"
+
+	pdoc := &doc.Package{ImportPath: path, ProjectRoot: root, ProjectName: "repo", Name: "pkg"}
+	var resp testResponse
+	if err := serveView(&resp, &web.Request{Form: url.Values{"schedule": {""}}}, viewsByName["schedule"], pdoc); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	for _, s := range []string{
+		"2014-05-13 16:53:20 UTC (not modified)",
+		"2014-05-13 17:53:20 UTC",
+		"gddo-abc",
+		refreshFileName,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("schedule view does not contain %q", s)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the request deadlines and the optional sections of
+// the package page. A request has a soft and a hard deadline measured from
+// the start of the request. The optional sections are loaded in decreasing
+// priority. Sections that do not finish loading by the soft deadline are
+// skipped and the page shows a placeholder in their place, except for
+// required sections, which are always loaded. A request that reaches the
+// hard deadline before the page is rendered fails. The hard deadline is
+// checked after the package is fetched and between sections; a fetch or a
+// section load in progress is not interrupted.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"flag"
+	"sort"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var (
+	softDeadline = flag.Duration("soft_deadline", 3*time.Second, "Time from the start of a page request after which the optional page sections are skipped. Zero disables the soft deadline.")
+	hardDeadline = flag.Duration("hard_deadline", 20*time.Second, "Time from the start of a page request after which the request fails. Zero disables the hard deadline.")
+)
+
+var errHardDeadline = errors.New("request deadline exceeded")
+
+var (
+	// droppedSections counts the optional sections skipped at the soft
+	// deadline by section name.
+	droppedSections = expvar.NewMap("droppedPageSections")
+
+	// hardDeadlineErrors counts the requests that failed at the hard
+	// deadline.
+	hardDeadlineErrors = expvar.NewInt("hardDeadlineErrors")
+)
+
+// deadlinesEnvKey is the key of the request deadlines in the request
+// environment.
+const deadlinesEnvKey = "deadlines"
+
+// requestDeadlines are the deadlines of a request. A zero time is no
+// deadline.
+type requestDeadlines struct {
+	soft, hard time.Time
+}
+
+// newRequestDeadlines returns the deadlines for a request started at the
+// given time.
+func newRequestDeadlines(start time.Time, soft, hard time.Duration) *requestDeadlines {
+	d := &requestDeadlines{}
+	if soft > 0 {
+		d.soft = start.Add(soft)
+	}
+	if hard > 0 {
+		d.hard = start.Add(hard)
+	}
+	return d
+}
+
+// deadlinesFor returns the deadlines of the request. Requests that did not
+// pass through deadlineHandler have no deadlines.
+func deadlinesFor(req *web.Request) *requestDeadlines {
+	if req != nil {
+		if d, ok := req.Env[deadlinesEnvKey].(*requestDeadlines); ok {
+			return d
+		}
+	}
+	return &requestDeadlines{}
+}
+
+// checkHard returns errHardDeadline if the hard deadline has passed.
+func (d *requestDeadlines) checkHard() error {
+	if !d.hard.IsZero() && !time.Now().Before(d.hard) {
+		hardDeadlineErrors.Add(1)
+		return errHardDeadline
+	}
+	return nil
+}
+
+// deadlineHandler sets the deadlines of a request.
+type deadlineHandler struct {
+	h web.Handler
+}
+
+func (h deadlineHandler) ServeWeb(resp web.Response, req *web.Request) error {
+	if req.Env == nil {
+		req.Env = make(map[string]interface{})
+	}
+	req.Env[deadlinesEnvKey] = newRequestDeadlines(time.Now(), *softDeadline, *hardDeadline)
+	return h.h.ServeWeb(resp, req)
+}
+
+// pageSection is an optional section of the package page.
+type pageSection struct {
+	// Name of the section. Templates use the name to find the placeholder
+	// of a skipped section.
+	Name string
+
+	// Priority of the section. Sections with a lower priority are skipped
+	// first.
+	Priority int
+
+	// Placeholder is shown in place of a skipped section. Required sections
+	// are never skipped and do not have a placeholder.
+	Placeholder string
+
+	// Required sections are loaded regardless of the soft deadline.
+	Required bool
+
+	// load returns the template data for the section.
+	load func(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error)
+}
+
+// pageSections is the registry of optional package page sections, sorted
+// by decreasing priority in init.
+var pageSections = []*pageSection{
+	{
+		Name:     "advisories",
+		Priority: 40,
+		Required: true,
+		load:     loadAdvisoriesSection,
+	},
+	{
+		Name:        "importers",
+		Priority:    30,
+		Placeholder: "The importer count is not available.",
+		load:        loadImportersSection,
+	},
+	{
+		Name:        "schedule",
+		Priority:    20,
+		Placeholder: "The refresh schedule is not available.",
+		load:        loadScheduleSection,
+	},
+	{
+		Name:        "activity",
+		Priority:    10,
+		Placeholder: "Project activity is not available.",
+		load:        loadActivitySection,
+	},
+}
+
+type sectionsByPriority []*pageSection
+
+func (p sectionsByPriority) Len() int      { return len(p) }
+func (p sectionsByPriority) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p sectionsByPriority) Less(i, j int) bool {
+	if p[i].Priority != p[j].Priority {
+		return p[i].Priority > p[j].Priority
+	}
+	return p[i].Name < p[j].Name
+}
+
+func init() {
+	sort.Sort(sectionsByPriority(pageSections))
+}
+
+// sectionResult records the sections skipped for a page. The result is
+// added to the page data with the key "sections".
+type sectionResult struct {
+	// Placeholders of the skipped sections by name.
+	omitted map[string]string
+
+	// Names of the skipped sections in the order skipped.
+	dropped []string
+}
+
+func (r *sectionResult) drop(s *pageSection) {
+	r.omitted[s.Name] = s.Placeholder
+	r.dropped = append(r.dropped, s.Name)
+	droppedSections.Add(s.Name, 1)
+}
+
+type sectionLoad struct {
+	data map[string]interface{}
+	err  error
+}
+
+// loadSections loads the sections in order and returns the merged template
+// data of the loaded sections. A section that is not required is skipped if
+// the soft deadline passes before the section is loaded. The loader of a
+// skipped section runs to completion in the background; the result is
+// discarded.
+func loadSections(pdoc *doc.Package, req *web.Request, sections []*pageSection) (map[string]interface{}, error) {
+	d := deadlinesFor(req)
+	result := &sectionResult{omitted: make(map[string]string)}
+	data := map[string]interface{}{"sections": result}
+	for _, s := range sections {
+		if err := d.checkHard(); err != nil {
+			return nil, err
+		}
+		var r sectionLoad
+		if d.soft.IsZero() || s.Required {
+			r.data, r.err = s.load(pdoc, req)
+		} else {
+			remaining := d.soft.Sub(time.Now())
+			if remaining <= 0 {
+				result.drop(s)
+				continue
+			}
+			c := make(chan sectionLoad, 1)
+			go func(s *pageSection) {
+				var r sectionLoad
+				r.data, r.err = s.load(pdoc, req)
+				c <- r
+			}(s)
+			timer := time.NewTimer(remaining)
+			select {
+			case r = <-c:
+				timer.Stop()
+			case <-timer.C:
+				result.drop(s)
+				continue
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		for k, v := range r.data {
+			data[k] = v
+		}
+	}
+	return data, nil
+}
+
+// sectionOmittedFn returns the placeholder for the section with the given
+// name if the section was skipped for the page with the template data.
+func sectionOmittedFn(data map[string]interface{}, name string) string {
+	if r, ok := data["sections"].(*sectionResult); ok {
+		return r.omitted[name]
+	}
+	return ""
+}
+
+func loadAdvisoriesSection(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	return map[string]interface{}{"advisories": advisoriesFn(pdoc)}, nil
+}
+
+func loadImportersSection(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	n, err := packagePages.store.ImporterCount(pdoc.ImportPath)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"importerCount": n}, nil
+}
+
+func loadScheduleSection(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	return map[string]interface{}{"schedule": packageSchedule(pdoc)}, nil
+}
+
+func loadActivitySection(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	return map[string]interface{}{"activity": pdoc.Activity}, nil
+}
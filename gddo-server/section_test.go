@@ -0,0 +1,175 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func expvarCount(v expvar.Var) int64 {
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
+
+func droppedSectionCount(name string) int64 {
+	return expvarCount(droppedSections.Get(name))
+}
+
+func deadlineTestRequest(soft, hard time.Duration) *web.Request {
+	return &web.Request{Env: map[string]interface{}{
+		deadlinesEnvKey: newRequestDeadlines(time.Now(), soft, hard),
+	}}
+}
+
+func testSection(name string, priority int, delay time.Duration, err error) *pageSection {
+	return &pageSection{
+		Name:        name,
+		Priority:    priority,
+		Placeholder: name + " is not available.",
+		load: func(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+			time.Sleep(delay)
+			return map[string]interface{}{name: true}, err
+		},
+	}
+}
+
+func TestLoadSections(t *testing.T) {
+	sections := []*pageSection{
+		testSection("testFast", 3, 0, nil),
+		testSection("testSlow", 2, 200*time.Millisecond, nil),
+		testSection("testLate", 1, 0, nil),
+	}
+	slow, late := droppedSectionCount("testSlow"), droppedSectionCount("testLate")
+
+	data, err := loadSections(&doc.Package{}, deadlineTestRequest(50*time.Millisecond, 0), sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["testFast"] != true {
+		t.Errorf("section testFast not loaded")
+	}
+	if data["testSlow"] != nil || data["testLate"] != nil {
+		t.Errorf("sections testSlow and testLate loaded after the soft deadline")
+	}
+	result := data["sections"].(*sectionResult)
+	if got := strings.Join(result.dropped, ","); got != "testSlow,testLate" {
+		t.Errorf("dropped = %s, want testSlow,testLate", got)
+	}
+	if got := sectionOmittedFn(data, "testSlow"); got != "testSlow is not available." {
+		t.Errorf("sectionOmitted(testSlow) = %q", got)
+	}
+	if got := sectionOmittedFn(data, "testFast"); got != "" {
+		t.Errorf("sectionOmitted(testFast) = %q, want empty", got)
+	}
+	if droppedSectionCount("testSlow") != slow+1 || droppedSectionCount("testLate") != late+1 {
+		t.Errorf("dropped section counters not incremented")
+	}
+
+	// Required sections load after the soft deadline.
+	required := testSection("testRequired", 0, 0, nil)
+	required.Required = true
+	data, err = loadSections(&doc.Package{}, deadlineTestRequest(time.Nanosecond, 0), []*pageSection{testSection("testLate", 1, 0, nil), required})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["testRequired"] != true || data["testLate"] != nil {
+		t.Errorf("after the soft deadline, loaded data is %v, want only testRequired", data)
+	}
+
+	// Without deadlines, all sections load.
+	data, err = loadSections(&doc.Package{}, &web.Request{}, sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["testFast"] != true || data["testSlow"] != true || data["testLate"] != true {
+		t.Errorf("sections not loaded without deadlines: %v", data)
+	}
+
+	// Loader errors fail the page.
+	errLoad := errors.New("load failed")
+	_, err = loadSections(&doc.Package{}, &web.Request{}, []*pageSection{testSection("testError", 1, 0, errLoad)})
+	if err != errLoad {
+		t.Errorf("loadSections returned %v, want %v", err, errLoad)
+	}
+}
+
+func TestHardDeadline(t *testing.T) {
+	n := expvarCount(hardDeadlineErrors)
+	req := deadlineTestRequest(0, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, err := loadSections(&doc.Package{}, req, []*pageSection{testSection("testFast", 1, 0, nil)}); err != errHardDeadline {
+		t.Errorf("loadSections returned %v, want %v", err, errHardDeadline)
+	}
+	if got := expvarCount(hardDeadlineErrors); got != n+1 {
+		t.Errorf("hardDeadlineErrors = %d, want %d", got, n+1)
+	}
+	if err := deadlinesFor(&web.Request{}).checkHard(); err != nil {
+		t.Errorf("checkHard without deadlines returned %v", err)
+	}
+}
+
+func TestPageSectionOrder(t *testing.T) {
+	for i := 1; i < len(pageSections); i++ {
+		if pageSections[i-1].Priority < pageSections[i].Priority {
+			t.Errorf("section %s before higher priority section %s", pageSections[i-1].Name, pageSections[i].Name)
+		}
+	}
+}
+
+func TestSectionPlaceholders(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	result := &sectionResult{omitted: make(map[string]string)}
+	for _, s := range pageSections {
+		if s.Name == "importers" || s.Name == "schedule" {
+			result.drop(s)
+		}
+	}
+	data := map[string]interface{}{
+		"pdoc":       pdoc,
+		"sections":   result,
+		"advisories": advisoriesFn(pdoc),
+		"activity":   pdoc.Activity,
+	}
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "pkg.html", web.StatusOK, nil, data); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	for _, want := range []string{"The importer count is not available.", "The refresh schedule is not available."} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page does not contain placeholder %q", want)
+		}
+	}
+	for _, notWant := range []string{"Project activity is not available."} {
+		if strings.Contains(body, notWant) {
+			t.Errorf("page contains placeholder %q for a loaded section", notWant)
+		}
+	}
+}
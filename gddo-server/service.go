@@ -0,0 +1,213 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the lifecycle state of repository hosts. Packages on
+// deprecated hosts are served from the database and never fetched. Packages
+// on removed hosts are not found.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var hostsPath = flag.String("hosts", "", "Path to JSON file mapping repository hosts to a state: active, deprecated or removed, optionally followed by case-insensitive, project roots to monorepo, and self-hosted services to an object with kind, api, raw, web and token fields. The file is reloaded on SIGHUP.")
+
+// hostedConfig is the value in the hosts file for a self-hosted GitHub or
+// GitLab compatible service.
+type hostedConfig struct {
+	Kind  string `json:"kind"`
+	API   string `json:"api"`
+	Raw   string `json:"raw"`
+	Web   string `json:"web"`
+	Token string `json:"token"`
+}
+
+// loadHostsConfig sets the state of repository hosts, the hosts with
+// case-insensitive repository names, the monorepo project roots and the
+// self-hosted services from the JSON file at path.
+func loadHostsConfig(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	states := make(map[string]doc.ServiceState)
+	var monorepos, caseInsensitive []string
+	var hosted []doc.HostConfig
+	for host, raw := range config {
+		if len(raw) > 0 && raw[0] == '{' {
+			var h hostedConfig
+			if err := json.Unmarshal(raw, &h); err != nil {
+				return fmt.Errorf("host %s: %v", host, err)
+			}
+			if h.Token == "" {
+				h.Token = secrets.HostTokens[host]
+			}
+			hosted = append(hosted, doc.HostConfig{
+				Host:   host,
+				Kind:   h.Kind,
+				APIURL: h.API,
+				RawURL: h.Raw,
+				WebURL: h.Web,
+				Token:  h.Token,
+			})
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return fmt.Errorf("host %s: %v", host, err)
+		}
+		if value == "monorepo" {
+			monorepos = append(monorepos, host)
+			continue
+		}
+		for _, name := range strings.Fields(value) {
+			if name == "case-insensitive" {
+				caseInsensitive = append(caseInsensitive, host)
+				continue
+			}
+			s, ok := doc.ParseServiceState(name)
+			if !ok {
+				return fmt.Errorf("unknown state %q for host %s", name, host)
+			}
+			states[host] = s
+		}
+	}
+	if err := doc.SetHosts(hosted); err != nil {
+		return err
+	}
+	doc.SetServiceStates(states)
+	doc.SetMonorepos(monorepos)
+	doc.SetCaseInsensitiveHosts(caseInsensitive)
+	return nil
+}
+
+// reloadConfigOnSignal reloads the hosts file, the redirects file, the CORS
+// origins file, the stability phrases file, the stop words file and the
+// advisories file when the process receives SIGHUP. The previous configuration is kept if a file has an error.
+func reloadConfigOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for _ = range c {
+		for _, config := range []struct {
+			path string
+			load func(string) error
+		}{
+			{*hostsPath, loadHostsConfig},
+			{*redirectsPath, loadRedirects},
+			{*corsOriginsPath, loadCORSOrigins},
+			{*stabilityPhrasesPath, loadStabilityPhrases},
+			{*stopWordsPath, loadStopWords},
+			{*advisoriesPath, loadAdvisories},
+		} {
+			if config.path == "" {
+				continue
+			}
+			if err := config.load(config.path); err != nil {
+				log.Printf("ERROR loading %s: %v", config.path, err)
+			} else {
+				log.Printf("Reloaded %s", config.path)
+			}
+		}
+	}
+}
+
+// fetchAllowed returns true if the package can be fetched from its
+// repository host.
+func fetchAllowed(importPath string) bool {
+	_, s := doc.GetServiceState(importPath)
+	return s == doc.ServiceActive
+}
+
+// serviceMessage returns the explanation shown for packages on a host that
+// is not active.
+func serviceMessage(importPath string) string {
+	host, s := doc.GetServiceState(importPath)
+	switch s {
+	case doc.ServiceDeprecated:
+		return host + " no longer hosts repositories. This documentation was fetched before the host shut down and is not updated."
+	case doc.ServiceRemoved:
+		return host + " no longer hosts repositories. Documentation for packages on the host is not available."
+	}
+	return ""
+}
+
+// serviceNoticeFn returns the notice shown on package pages for packages on
+// a deprecated host.
+func serviceNoticeFn(pdoc *doc.Package) string {
+	return serviceMessage(pdoc.ImportPath)
+}
+
+var lastFetches = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// recordFetch records a successful fetch of a package. Fetches are only
+// recorded for hosts listed on the status page.
+func recordFetch(importPath string, t time.Time) {
+	host, _ := doc.GetServiceState(importPath)
+	for _, s := range doc.Services() {
+		if s.Host == host {
+			lastFetches.Lock()
+			lastFetches.m[host] = t
+			lastFetches.Unlock()
+			return
+		}
+	}
+}
+
+func serviceStatuses() []api.ServiceStatus {
+	lastFetches.Lock()
+	defer lastFetches.Unlock()
+	var result []api.ServiceStatus
+	for _, s := range doc.Services() {
+		result = append(result, api.ServiceStatus{Host: s.Host, State: s.State.String(), LastFetch: lastFetches.m[s.Host]})
+	}
+	return result
+}
+
+func serveStatus(resp web.Response, req *web.Request) error {
+	return executeTemplate(resp, req, "status.html", web.StatusOK, nil, map[string]interface{}{
+		"services": serviceStatuses(),
+		"memory":   memory.status(),
+	})
+}
+
+// serveAPIStatus serves the status page data as JSON.
+func serveAPIStatus(resp web.Response, req *web.Request) error {
+	var data api.Status
+	data.Services = serviceStatuses()
+	data.Memory = memory.status()
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(&data)
+}
@@ -0,0 +1,235 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+func writeHostsConfig(t *testing.T, path, config string) {
+	if err := ioutil.WriteFile(path, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadHostsConfig(t *testing.T) {
+	defer doc.SetServiceStates(nil)
+	defer doc.SetMonorepos(nil)
+	defer doc.SetCaseInsensitiveHosts(nil)
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.json")
+
+	writeHostsConfig(t, path, `{"example.org": "removed"}`)
+	if err := loadHostsConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, s := doc.GetServiceState("example.org/pkg"); s != doc.ServiceRemoved {
+		t.Errorf("example.org state = %v, want removed", s)
+	}
+
+	// Reloading moves hosts between states.
+	writeHostsConfig(t, path, `{"example.org": "deprecated", "code.google.com": "active", "github.com": "active case-insensitive", "github.com/org/big": "monorepo"}`)
+	if err := loadHostsConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, s := doc.GetServiceState("example.org/pkg"); s != doc.ServiceDeprecated {
+		t.Errorf("example.org state after reload = %v, want deprecated", s)
+	}
+	if _, s := doc.GetServiceState("code.google.com/p/project"); s != doc.ServiceActive {
+		t.Errorf("code.google.com state after reload = %v, want active", s)
+	}
+	if !doc.IsMonorepo("github.com/org/big") {
+		t.Errorf("github.com/org/big is not a monorepo after reload")
+	}
+	if _, s := doc.GetServiceState("github.com/User/Repo"); s != doc.ServiceActive {
+		t.Errorf("github.com state after reload = %v, want active", s)
+	}
+	if fold := doc.FoldImportPath("github.com/User/Repo"); fold != "github.com/user/repo" {
+		t.Errorf("github.com is not case-insensitive after reload, fold = %q", fold)
+	}
+	if fold := doc.FoldImportPath("example.org/User/Repo"); fold != "" {
+		t.Errorf("example.org is case-insensitive after reload, fold = %q", fold)
+	}
+
+	// A bad file does not change the states.
+	writeHostsConfig(t, path, `{"example.org": "gone"}`)
+	if err := loadHostsConfig(path); err == nil {
+		t.Errorf("loadHostsConfig with bad state returned nil error")
+	}
+	if _, s := doc.GetServiceState("example.org/pkg"); s != doc.ServiceDeprecated {
+		t.Errorf("example.org state after bad reload = %v, want deprecated", s)
+	}
+	if !doc.IsMonorepo("github.com/org/big") {
+		t.Errorf("github.com/org/big is not a monorepo after bad reload")
+	}
+}
+
+func TestLoadHostedConfig(t *testing.T) {
+	defer doc.SetHosts(nil)
+	defer doc.SetServiceStates(nil)
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.json")
+
+	writeHostsConfig(t, path, `{
+		"example.org": "deprecated",
+		"git.corp": {"kind": "gitlab-compatible", "api": "https://git.corp/api/v4", "token": "secret"}}`)
+	if err := loadHostsConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if !doc.IsValidRemotePath("git.corp/team/tool") {
+		t.Errorf("git.corp/team/tool is not valid after loading hosted service")
+	}
+	if _, s := doc.GetServiceState("example.org/pkg"); s != doc.ServiceDeprecated {
+		t.Errorf("example.org state = %v, want deprecated", s)
+	}
+
+	// An unknown kind does not change the configuration.
+	writeHostsConfig(t, path, `{"git.corp": {"kind": "svn", "api": "https://git.corp/api"}}`)
+	if err := loadHostsConfig(path); err == nil {
+		t.Errorf("loadHostsConfig with unknown kind returned nil error")
+	}
+	if !doc.IsValidRemotePath("git.corp/team/tool") {
+		t.Errorf("git.corp/team/tool is not valid after bad reload")
+	}
+}
+
+var crawlNeededTests = []struct {
+	path        string
+	requestType int
+	nextCrawl   time.Time
+	hasSubdirs  bool
+	needed      bool
+}{
+	{"github.com/user/repo", humanRequest, time.Unix(1, 0), false, true},
+	{"github.com/user/repo", queryRequest, time.Time{}, false, true},
+	{"github.com/user/repo", robotRequest, time.Time{}, true, true},
+	{"code.google.com/p/project", humanRequest, time.Unix(1, 0), false, false},
+	{"code.google.com/p/project", queryRequest, time.Time{}, false, false},
+	{"code.google.com/p/project", robotRequest, time.Time{}, true, false},
+	{"example.org/pkg", humanRequest, time.Unix(1, 0), false, false},
+}
+
+func TestCrawlNeeded(t *testing.T) {
+	defer doc.SetServiceStates(nil)
+	doc.SetServiceStates(map[string]doc.ServiceState{"example.org": doc.ServiceRemoved})
+	for _, tt := range crawlNeededTests {
+		if needed := crawlNeeded(tt.path, tt.requestType, tt.nextCrawl, tt.hasSubdirs); needed != tt.needed {
+			t.Errorf("crawlNeeded(%q, %d) = %v, want %v", tt.path, tt.requestType, needed, tt.needed)
+		}
+	}
+	if fetchAllowed("code.google.com/p/project") || !fetchAllowed("github.com/user/repo") {
+		t.Errorf("fetchAllowed does not follow the host state")
+	}
+}
+
+func TestServiceRefresh(t *testing.T) {
+	defer doc.SetServiceStates(nil)
+	doc.SetServiceStates(map[string]doc.ServiceState{"example.org": doc.ServiceRemoved})
+
+	// The refresh returns before using the database or the network.
+	if err := serveRefresh(&testResponse{}, &web.Request{Form: url.Values{"path": {"code.google.com/p/project"}}}); err != nil {
+		t.Errorf("refresh of deprecated package returned %v", err)
+	}
+	err := serveRefresh(&testResponse{}, &web.Request{Form: url.Values{"path": {"example.org/pkg"}}})
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+		t.Errorf("refresh of removed package returned %v, want not found", err)
+	}
+}
+
+func TestServicePages(t *testing.T) {
+	defer doc.SetServiceStates(nil)
+	doc.SetServiceStates(map[string]doc.ServiceState{"example.org": doc.ServiceRemoved})
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"notfound.html", "common.html", "layout.html"},
+		{"pkg.html", "common.html", "layout.html"},
+		{"status.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed packages are not found with an explanation.
+	var resp testResponse
+	req := &web.Request{URL: &url.URL{Path: "/example.org/pkg"}, RouteVars: map[string]string{"path": "example.org/pkg"}}
+	if err := servePackage(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != web.StatusNotFound || !strings.Contains(resp.buf.String(), "example.org no longer hosts repositories") {
+		t.Errorf("removed package page status %d does not explain removal", resp.status)
+	}
+
+	// Not found pages without an explanation still render.
+	resp = testResponse{}
+	if err := executeTemplate(&resp, nil, "notfound.html", web.StatusNotFound, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deprecated packages are shown with a notice.
+	for _, tt := range []struct {
+		path   string
+		notice bool
+	}{
+		{"code.google.com/p/project", true},
+		{"github.com/user/repo/pkg", false},
+	} {
+		pdoc := fragmentTestPackage()
+		pdoc.ImportPath = tt.path
+		resp = testResponse{}
+		if err := executeTemplate(&resp, nil, "pkg.html", web.StatusOK, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(resp.buf.String(), "no longer hosts repositories") != tt.notice {
+			t.Errorf("%s: notice shown is not %v", tt.path, tt.notice)
+		}
+	}
+
+	// The status page lists hosts with their state and last fetch.
+	recordFetch("github.com/user/repo", time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC))
+	recordFetch("example.com/vanity", time.Now())
+	resp = testResponse{}
+	if err := serveStatus(&resp, &web.Request{}); err != nil {
+		t.Fatal(err)
+	}
+	page := resp.buf.String()
+	for _, s := range []string{
+		"<td>github.com</td><td>active</td><td>2013-05-01 12:00:00 UTC</td>",
+		"<td>code.google.com</td><td>deprecated</td>",
+		"<td>example.org</td><td>removed</td>",
+	} {
+		if !strings.Contains(page, s) {
+			t.Errorf("status page does not contain %s", s)
+		}
+	}
+	if strings.Contains(page, "example.com") {
+		t.Errorf("status page lists unknown host example.com")
+	}
+}
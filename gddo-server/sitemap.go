@@ -0,0 +1,227 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file implements the sitemaps that list the indexed packages for
+// search engines. The sitemap index at /sitemap.xml lists gzip compressed
+// sitemap files of at most sitemapMaxURLs packages each.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/indigo/web"
+)
+
+const (
+	// sitemapMaxURLs is the maximum number of URLs in a sitemap file
+	// allowed by the sitemap protocol.
+	sitemapMaxURLs = 50000
+
+	// sitemapMaxAge is the time that generated sitemaps are served before
+	// they are generated again from the index.
+	sitemapMaxAge = time.Hour
+
+	// sitemapRetryInterval is the minimum time between attempts to
+	// generate the sitemaps. The interval limits the walks of the index
+	// when generation fails.
+	sitemapRetryInterval = time.Minute
+)
+
+var sitemapBaseURL = flag.String("sitemap_base", "http://godoc.org", "Base URL of the package URLs in the sitemaps. The URLs do not depend on the host of the request.")
+
+type sitemapStore interface {
+	IndexFunc(fn func(path string, updated time.Time) bool) error
+}
+
+// sitemaps is the cache of generated sitemaps. The sitemap files are kept
+// compressed. The store is set in main.
+var sitemaps struct {
+	sync.Mutex
+	store     sitemapStore
+	attempted time.Time
+	generated time.Time
+	index     []byte
+	files     [][]byte
+	err       error // error of the last generation
+
+	// done is closed when the running generation completes. It is nil if
+	// the sitemaps are not being generated.
+	done chan struct{}
+}
+
+// sitemapWriter writes the gzip compressed sitemap files.
+type sitemapWriter struct {
+	base    string
+	files   [][]byte
+	lastmod []time.Time
+	buf     *bytes.Buffer
+	zw      *gzip.Writer
+	n       int
+}
+
+func (w *sitemapWriter) add(path string, updated time.Time) {
+	if w.zw == nil || w.n >= sitemapMaxURLs {
+		w.flush()
+		w.buf = new(bytes.Buffer)
+		w.zw = gzip.NewWriter(w.buf)
+		w.n = 0
+		w.lastmod = append(w.lastmod, time.Time{})
+		io.WriteString(w.zw, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`+"\n")
+	}
+	io.WriteString(w.zw, "<url><loc>"+xmlFn(w.base+escapePath(sitePath("/"+path)))+"</loc>")
+	if !updated.IsZero() {
+		io.WriteString(w.zw, "<lastmod>"+updated.UTC().Format("2006-01-02")+"</lastmod>")
+		if i := len(w.lastmod) - 1; updated.After(w.lastmod[i]) {
+			w.lastmod[i] = updated
+		}
+	}
+	io.WriteString(w.zw, "</url>\n")
+	w.n++
+}
+
+// flush completes the current sitemap file.
+func (w *sitemapWriter) flush() {
+	if w.zw == nil {
+		return
+	}
+	io.WriteString(w.zw, "</urlset>\n")
+	w.zw.Close()
+	w.files = append(w.files, w.buf.Bytes())
+	w.zw = nil
+}
+
+// sitemapIndex returns the sitemap index for the sitemap files.
+func (w *sitemapWriter) sitemapIndex() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">` + "\n")
+	for i := range w.files {
+		buf.WriteString("<sitemap><loc>" + xmlFn(w.base+sitePath("/-/sitemap/"+strconv.Itoa(i)+".xml.gz")) + "</loc>")
+		if !w.lastmod[i].IsZero() {
+			buf.WriteString("<lastmod>" + w.lastmod[i].UTC().Format("2006-01-02") + "</lastmod>")
+		}
+		buf.WriteString("</sitemap>\n")
+	}
+	buf.WriteString("</sitemapindex>\n")
+	return buf.Bytes()
+}
+
+// generateSitemaps reads the index from the store and returns the sitemap
+// index and files. The URLs in the sitemaps start with base, as in
+// "http://godoc.org". Redirected paths are not listed. The packages are
+// compressed as they are read, so the uncompressed sitemaps are not held in
+// memory.
+func generateSitemaps(store sitemapStore, base string) ([]byte, [][]byte, error) {
+	w := &sitemapWriter{base: base}
+	rs := currentRedirectRules()
+	if err := store.IndexFunc(func(path string, updated time.Time) bool {
+		if _, ok := rs.rewrite(path); ok {
+			return true
+		}
+		w.add(path, updated)
+		return true
+	}); err != nil {
+		return nil, nil, err
+	}
+	w.flush()
+	return w.sitemapIndex(), w.files, nil
+}
+
+// getSitemaps returns the cached sitemaps. The sitemaps are generated again
+// in the background if they are older than sitemapMaxAge, but not more often
+// than sitemapRetryInterval. The stale sitemaps are served while the
+// sitemaps are generated and when generation fails.
+func getSitemaps(now time.Time) ([]byte, [][]byte, error) {
+	sitemaps.Lock()
+	if sitemaps.store == nil {
+		sitemaps.Unlock()
+		return nil, nil, &web.Error{Status: web.StatusNotFound}
+	}
+	if sitemaps.done == nil &&
+		(sitemaps.index == nil || now.Sub(sitemaps.generated) >= sitemapMaxAge) &&
+		now.Sub(sitemaps.attempted) >= sitemapRetryInterval {
+		sitemaps.attempted = now
+		sitemaps.done = make(chan struct{})
+		go updateSitemaps(sitemaps.store, now, sitemaps.done)
+	}
+	// Wait for the running generation if there are no sitemaps to serve.
+	var wait chan struct{}
+	if sitemaps.index == nil {
+		wait = sitemaps.done
+	}
+	sitemaps.Unlock()
+	if wait != nil {
+		<-wait
+	}
+
+	sitemaps.Lock()
+	defer sitemaps.Unlock()
+	if sitemaps.index == nil {
+		if sitemaps.err != nil {
+			return nil, nil, sitemaps.err
+		}
+		return nil, nil, &web.Error{Status: web.StatusServiceUnavailable}
+	}
+	return sitemaps.index, sitemaps.files, nil
+}
+
+// updateSitemaps generates the sitemaps from store and replaces the cached
+// sitemaps. The mutex is not held while the index is read. The channel done
+// is closed when the cache is updated.
+func updateSitemaps(store sitemapStore, now time.Time, done chan struct{}) {
+	index, files, err := generateSitemaps(store, *sitemapBaseURL)
+	sitemaps.Lock()
+	defer sitemaps.Unlock()
+	sitemaps.err = err
+	if err != nil {
+		log.Printf("ERROR generate sitemaps: %v", err)
+	} else {
+		sitemaps.generated = now
+		sitemaps.index = index
+		sitemaps.files = files
+	}
+	sitemaps.done = nil
+	close(done)
+}
+
+func serveSitemapIndex(resp web.Response, req *web.Request) error {
+	index, _, err := getSitemaps(time.Now())
+	if err != nil {
+		return err
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/xml; charset=utf-8"}})
+	_, err = w.Write(index)
+	return err
+}
+
+func serveSitemap(resp web.Response, req *web.Request) error {
+	_, files, err := getSitemaps(time.Now())
+	if err != nil {
+		return err
+	}
+	i, err := strconv.Atoi(req.RouteVars["n"])
+	if err != nil || i < 0 || i >= len(files) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/x-gzip"}})
+	_, err = w.Write(files[i])
+	return err
+}
@@ -0,0 +1,193 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/indigo/web"
+)
+
+// fakeSitemapStore is an index of n packages. IndexFunc waits for a value
+// on block if block is not nil.
+type fakeSitemapStore struct {
+	n     int
+	calls int
+	err   error
+	block chan struct{}
+}
+
+func (s *fakeSitemapStore) IndexFunc(fn func(string, time.Time) bool) error {
+	s.calls++
+	if s.block != nil {
+		<-s.block
+	}
+	if s.err != nil {
+		return s.err
+	}
+	for i := 0; i < s.n; i++ {
+		path := "example.com/p" + strconv.Itoa(i)
+		if i == s.n-1 {
+			path = "example.com/a&b"
+		}
+		if !fn(path, time.Unix(int64(i)*86400, 0)) {
+			break
+		}
+	}
+	return nil
+}
+
+// waitSitemaps waits for the running generation of the sitemaps.
+func waitSitemaps() {
+	sitemaps.Lock()
+	done := sitemaps.done
+	sitemaps.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+type sitemapURLSet struct {
+	URLs []struct {
+		Loc     string `xml:"loc"`
+		Lastmod string `xml:"lastmod"`
+	} `xml:"url"`
+}
+
+type sitemapIndexSet struct {
+	Sitemaps []struct {
+		Loc     string `xml:"loc"`
+		Lastmod string `xml:"lastmod"`
+	} `xml:"sitemap"`
+}
+
+func TestSitemaps(t *testing.T) {
+	// One path is redirected and is not listed.
+	store := &fakeSitemapStore{n: sitemapMaxURLs + 2}
+	defer setTestRedirects(t, map[string]string{"example.com/p2": "example.com/new"})()
+	defer func(base string) {
+		waitSitemaps()
+		*sitemapBaseURL = base
+		sitemaps.store = nil
+		sitemaps.index = nil
+		sitemaps.attempted = time.Time{}
+	}(*sitemapBaseURL)
+	*sitemapBaseURL = "http://godoc.example.com"
+	sitemaps.store = store
+	sitemaps.index = nil
+	sitemaps.attempted = time.Time{}
+
+	// The URLs do not depend on the host of the request.
+	req := &web.Request{URL: &url.URL{Host: "attacker.example.com", Path: "/sitemap.xml"}}
+	var resp testResponse
+	if err := serveSitemapIndex(&resp, req); err != nil {
+		t.Fatal(err)
+	}
+	var index sitemapIndexSet
+	if err := xml.Unmarshal(resp.buf.Bytes(), &index); err != nil {
+		t.Fatalf("sitemap index is not valid XML: %v", err)
+	}
+	lastmod := time.Unix(int64(sitemapMaxURLs)*86400, 0).UTC().Format("2006-01-02")
+	if len(index.Sitemaps) != 2 || index.Sitemaps[1].Loc != "http://godoc.example.com/-/sitemap/1.xml.gz" || index.Sitemaps[0].Lastmod != lastmod {
+		t.Fatalf("sitemap index = %+v, want 2 sitemaps with the first modified %s", index, lastmod)
+	}
+
+	for i, want := range []int{sitemapMaxURLs, 1} {
+		req := &web.Request{URL: &url.URL{Host: "attacker.example.com"}, RouteVars: map[string]string{"n": strconv.Itoa(i)}}
+		var resp testResponse
+		if err := serveSitemap(&resp, req); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(resp.buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var set sitemapURLSet
+		if err := xml.Unmarshal(p, &set); err != nil {
+			t.Fatalf("sitemap %d is not valid XML: %v", i, err)
+		}
+		if len(set.URLs) != want {
+			t.Errorf("sitemap %d has %d URLs, want %d", i, len(set.URLs), want)
+		}
+		if i == 0 && (set.URLs[1].Loc != "http://godoc.example.com/example.com/p1" || set.URLs[1].Lastmod != "1970-01-02") {
+			t.Errorf("sitemap 0 second URL = %+v", set.URLs[1])
+		}
+		if i == 0 && set.URLs[2].Loc != "http://godoc.example.com/example.com/p3" {
+			t.Errorf("sitemap 0 third URL = %+v, want redirected path skipped", set.URLs[2])
+		}
+		if i == 1 && set.URLs[0].Loc != "http://godoc.example.com/example.com/a&b" {
+			t.Errorf("sitemap 1 URL = %+v, want escaped path", set.URLs[0])
+		}
+	}
+
+	err := serveSitemap(&testResponse{}, &web.Request{URL: &url.URL{Host: "godoc.example.com"}, RouteVars: map[string]string{"n": "2"}})
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+		t.Errorf("serveSitemap(2) returned %v, want not found", err)
+	}
+
+	// The sitemaps are generated again after sitemapMaxAge only.
+	if store.calls != 1 {
+		t.Errorf("index read %d times, want 1", store.calls)
+	}
+	if _, _, err := getSitemaps(time.Now().Add(sitemapMaxAge)); err != nil {
+		t.Fatal(err)
+	}
+	waitSitemaps()
+	if store.calls != 2 {
+		t.Errorf("index read %d times after max age, want 2", store.calls)
+	}
+
+	// Stale sitemaps are served when generation fails and generation is
+	// not attempted again before sitemapRetryInterval.
+	store.err = errors.New("database down")
+	now := time.Now().Add(2 * sitemapMaxAge)
+	for _, t2 := range []time.Time{now, now.Add(sitemapRetryInterval / 2)} {
+		if index, _, err := getSitemaps(t2); err != nil || index == nil {
+			t.Fatalf("getSitemaps() after failure = %v, want stale sitemaps", err)
+		}
+		waitSitemaps()
+	}
+	if store.calls != 3 {
+		t.Errorf("index read %d times after failure, want 3", store.calls)
+	}
+
+	// The stale sitemaps are served while the sitemaps are generated.
+	store.err = nil
+	store.block = make(chan struct{})
+	now = now.Add(sitemapMaxAge)
+	if index, _, err := getSitemaps(now); err != nil || index == nil {
+		t.Fatalf("getSitemaps() during generation = %v, want stale sitemaps", err)
+	}
+	if index, _, err := getSitemaps(now.Add(sitemapRetryInterval)); err != nil || index == nil {
+		t.Fatalf("second getSitemaps() during generation = %v, want stale sitemaps", err)
+	}
+	close(store.block)
+	waitSitemaps()
+	if store.calls != 4 {
+		t.Errorf("index read %d times during generation, want 4", store.calls)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// snapshotStore is the subset of the database used to serve historical
+// snapshots of package documentation.
+type snapshotStore interface {
+	Snapshots(path string) ([]time.Time, error)
+	GetSnapshot(path string, t time.Time) (*doc.Package, error)
+}
+
+// snapshots is set in main.
+var snapshots snapshotStore
+
+// parseAsOf parses the value of the asof parameter. A date selects the end
+// of the day in UTC so that snapshots taken during the day are included. A
+// time in RFC 3339 format is used as is.
+func parseAsOf(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// selectSnapshot returns the newest of times at or before asof. The times
+// are sorted newest first.
+func selectSnapshot(times []time.Time, asof time.Time) (time.Time, bool) {
+	for _, t := range times {
+		if !t.After(asof) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// disablePlay removes the playground links from the examples in pdoc. The
+// examples in a snapshot can depend on packages that have since changed.
+func disablePlay(pdoc *doc.Package) {
+	clearExamples := func(examples []*doc.Example) {
+		for _, e := range examples {
+			if e != nil {
+				e.Play = ""
+			}
+		}
+	}
+	clearFuncs := func(funcs []*doc.Func) {
+		for _, f := range funcs {
+			if f != nil {
+				clearExamples(f.Examples)
+			}
+		}
+	}
+	clearExamples(pdoc.Examples)
+	clearFuncs(pdoc.Funcs)
+	for _, t := range pdoc.Types {
+		if t != nil {
+			clearExamples(t.Examples)
+			clearFuncs(t.Funcs)
+			clearFuncs(t.Methods)
+		}
+	}
+}
+
+// serveSnapshot serves the newest snapshot of the package at or before the
+// time in the asof parameter. Snapshot pages do not count toward the
+// popularity or declaration views of the package and do not offer refresh.
+func serveSnapshot(resp web.Response, req *web.Request, current *doc.Package) error {
+	if current.Name == "" || snapshots == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	asof, err := parseAsOf(req.Form.Get("asof"))
+	if err != nil {
+		return &web.Error{Status: web.StatusBadRequest}
+	}
+	times, err := snapshots.Snapshots(current.ImportPath)
+	if err != nil {
+		return err
+	}
+	t, ok := selectSnapshot(times, asof)
+	if !ok {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	pdoc, err := snapshots.GetSnapshot(current.ImportPath, t)
+	if err != nil {
+		return err
+	}
+	if pdoc == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	repairStoredDoc(pdoc)
+	disablePlay(pdoc)
+	sel, _ := doc.ResolveScopedAnchor(pdoc, req.Form.Get("type"), req.Form.Get("sel"))
+	name, data := packagePage(pdoc, nil, &RenderOptions{
+		Sel:        sel,
+		IndexOrder: req.Form.Get("index"),
+		Historical: t,
+	})
+	return executeTemplate(resp, req, name, web.StatusOK, nil, data)
+}
+
+// loadHistory loads the snapshot times for the history view.
+func loadHistory(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	var times []time.Time
+	if snapshots != nil {
+		var err error
+		times, err = snapshots.Snapshots(pdoc.ImportPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"snapshots": times}, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeSnapshotStore struct {
+	pdocs map[time.Time]*doc.Package
+	times []time.Time
+}
+
+func (s *fakeSnapshotStore) Snapshots(path string) ([]time.Time, error) {
+	return s.times, nil
+}
+
+func (s *fakeSnapshotStore) GetSnapshot(path string, t time.Time) (*doc.Package, error) {
+	return s.pdocs[t], nil
+}
+
+func setTestSnapshots(store snapshotStore) func() {
+	saved := snapshots
+	snapshots = store
+	return func() { snapshots = saved }
+}
+
+func TestParseAsOf(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"2024-03-01", time.Date(2024, 3, 1, 23, 59, 59, 999999999, time.UTC), true},
+		{"2024-03-01T12:00:00Z", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), true},
+		{"2024-03-01T12:00:00+02:00", time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), true},
+		{"2024-3-1", time.Time{}, false},
+		{"", time.Time{}, false},
+	} {
+		got, err := parseAsOf(tt.s)
+		if (err == nil) != tt.ok || (tt.ok && !got.Equal(tt.want)) {
+			t.Errorf("parseAsOf(%q) = %v, %v, want %v, ok=%v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSelectSnapshot(t *testing.T) {
+	newest := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	middle := time.Date(2024, 3, 1, 23, 59, 59, 0, time.UTC)
+	oldest := time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)
+	times := []time.Time{newest, middle, oldest}
+	for _, tt := range []struct {
+		asof string
+		want time.Time
+		ok   bool
+	}{
+		{"2024-03-02", newest, true},
+		{"2024-03-01", middle, true},
+		{"2024-03-01T23:59:58Z", oldest, true},
+		{"2024-02-01T08:00:00Z", oldest, true},
+		{"2024-01-31", time.Time{}, false},
+		{"2030-01-01", newest, true},
+	} {
+		asof, err := parseAsOf(tt.asof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := selectSnapshot(times, asof)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("selectSnapshot(%s) = %v, %v, want %v, %v", tt.asof, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestServeSnapshot(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"pkg.html", "common.html", "layout.html"},
+		{"history.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	current := fragmentTestPackage()
+	old := fragmentTestPackage()
+	old.Doc = "Package pkg is an old build.\n"
+	old.Funcs[0].Examples = []*doc.Example{{Name: "", Code: doc.Code{Text: "Copy(w, r)"}, Play: "package main"}}
+	taken := time.Date(2024, 2, 20, 10, 30, 0, 0, time.UTC)
+	defer setTestSnapshots(&fakeSnapshotStore{
+		pdocs: map[time.Time]*doc.Package{taken: old},
+		times: []time.Time{taken},
+	})()
+
+	var resp testResponse
+	req := &web.Request{Form: url.Values{"asof": {"2024-03-01"}}, Header: web.Header{}}
+	if err := serveSnapshot(&resp, req, current); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	for _, s := range []string{
+		"Package pkg is an old build.",
+		"documentation as fetched on 2024-02-20 10:30 UTC",
+		`content="NOINDEX"`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("snapshot page does not contain %q", s)
+		}
+	}
+	for _, s := range []string{`name="refresh"`, "?play=", `href="#_report"`, "?imports"} {
+		if strings.Contains(body, s) {
+			t.Errorf("snapshot page contains %q", s)
+		}
+	}
+
+	for _, asof := range []string{"2024-02-19", "2024-02-20T10:29:59Z"} {
+		req := &web.Request{Form: url.Values{"asof": {asof}}, Header: web.Header{}}
+		if err := serveSnapshot(&testResponse{}, req, current); err == nil {
+			t.Errorf("serveSnapshot(%s) returned a page, want not found", asof)
+		} else if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+			t.Errorf("serveSnapshot(%s) returned %v, want not found", asof, err)
+		}
+	}
+
+	req = &web.Request{Form: url.Values{"view": {"history"}}, Header: web.Header{}}
+	resp = testResponse{}
+	if err := serveView(&resp, req, viewsByName["history"], current); err != nil {
+		t.Fatal(err)
+	}
+	if s := "?asof=2024-02-20T10%3a30%3a00Z"; !strings.Contains(resp.buf.String(), s) {
+		t.Errorf("history view does not contain %q", s)
+	}
+}
+
+type fakeStore struct {
+	items int
+	size  int64
+}
+
+func (s fakeStore) StorageUsage() (int, int64, error) { return s.items, s.size, nil }
+
+func TestMemoryAccountantStorage(t *testing.T) {
+	a := newMemoryAccountant(0)
+	a.registerStore("snapshots", fakeStore{3, 3000})
+	a.registerStore("archives", fakeStore{1, 10})
+	want := []api.StorageUsage{{Name: "archives", Items: 1, Bytes: 10}, {Name: "snapshots", Items: 3, Bytes: 3000}}
+	got := a.status().Storage
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("storage = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var stabilityPhrasesPath = flag.String("stability-phrases", "", "Path to JSON file mapping API stabilities (frozen, stable, experimental, deprecated) to lists of phrases that declare the stability in a package comment. The file is reloaded on SIGHUP.")
+
+// loadStabilityPhrases sets the stability phrases from the JSON file at
+// path.
+func loadStabilityPhrases(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var phrases map[string][]string
+	if err := json.Unmarshal(b, &phrases); err != nil {
+		return err
+	}
+	return doc.SetStabilityPhrases(phrases)
+}
+
+// stabilityLabelFn returns the class of the label for a stability.
+func stabilityLabelFn(stability string) string {
+	switch stability {
+	case doc.StabilityFrozen, doc.StabilityStable:
+		return "label-success"
+	case doc.StabilityExperimental:
+		return "label-warning"
+	case doc.StabilityDeprecated:
+		return "label-important"
+	}
+	return ""
+}
@@ -16,27 +16,31 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
+	"go/ast"
 	godoc "go/doc"
+	"go/parser"
+	"go/token"
+	"html"
 	htemp "html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/url"
 	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	ttemp "text/template"
 	"time"
+	"unicode/utf8"
 
 	"code.google.com/p/go.talks/pkg/present"
 
+	"github.com/garyburd/gddo/database"
 	"github.com/garyburd/gddo/doc"
 	"github.com/garyburd/indigo/web"
 )
@@ -46,9 +50,17 @@ func escapePath(s string) string {
 	return u.String()
 }
 
+// validFilePos returns true if pos is a valid position in a file of the
+// package.
+func validFilePos(pdoc *doc.Package, pos doc.Pos) bool {
+	return pos.Line != 0 && pos.File >= 0 && int(pos.File) < len(pdoc.Files) && pdoc.Files[pos.File] != nil
+}
+
+// sourceLinkFn returns text linked to the source at pos. Text is not linked
+// if pos is not valid.
 func sourceLinkFn(pdoc *doc.Package, pos doc.Pos, text string) htemp.HTML {
 	text = htemp.HTMLEscapeString(text)
-	if pos.Line == 0 {
+	if !validFilePos(pdoc, pos) {
 		return htemp.HTML(text)
 	}
 	u := fmt.Sprintf(pdoc.LineFmt, pdoc.Files[pos.File].URL, pos.Line)
@@ -56,40 +68,20 @@ func sourceLinkFn(pdoc *doc.Package, pos doc.Pos, text string) htemp.HTML {
 	return htemp.HTML(fmt.Sprintf(`<a href="%s">%s</a>`, u, text))
 }
 
-var (
-	staticMutex sync.RWMutex
-	staticHash  = make(map[string]string)
-)
-
 func fileHashFn(p string) (string, error) {
-	staticMutex.RLock()
-	h, ok := staticHash[p]
-	staticMutex.RUnlock()
-
-	if !ok {
-		b, err := ioutil.ReadFile(filepath.Join(*assetsDir, filepath.FromSlash(p)))
-		if err != nil {
-			return "", err
-		}
-
-		m := md5.New()
-		m.Write(b)
-		h = hex.EncodeToString(m.Sum(nil))
-
-		staticMutex.Lock()
-		staticHash[p] = h
-		staticMutex.Unlock()
+	if stableRender {
+		return "test", nil
 	}
-	return h, nil
+	return fileHashes.hash(filepath.Join(*assetsDir, filepath.FromSlash(p)))
 }
 
 func staticFileFn(p string) htemp.URL {
 	h, err := fileHashFn("static/" + p)
 	if err != nil {
 		log.Printf("WARNING could not read static file %s, %v", p, err)
-		return htemp.URL("/-/static/" + p)
+		return htemp.URL(sitePath("/-/static/" + p))
 	}
-	return htemp.URL("/-/static/" + p + "?v=" + h)
+	return htemp.URL(sitePath("/-/static/" + p + "?v=" + h))
 }
 
 func mapFn(kvs ...interface{}) (map[string]interface{}, error) {
@@ -107,14 +99,60 @@ func mapFn(kvs ...interface{}) (map[string]interface{}, error) {
 	return m, nil
 }
 
-// relativePathFn formats an import path as HTML.
+// vendoredPath returns the canonical import path of a package copied to a
+// vendor directory. The last vendor directory in the path is used when
+// vendor directories are nested. The vendor directory itself is not a
+// vendored package.
+func vendoredPath(path string) (string, bool) {
+	s := "/" + path
+	i := strings.LastIndex(s, "/vendor/")
+	if i < 0 || i+len("/vendor/") == len(s) {
+		return "", false
+	}
+	return s[i+len("/vendor/"):], true
+}
+
+// relativePathFn returns path relative to parentPath. The parent is
+// stripped only at a path element boundary; "." is returned for the parent
+// itself and other paths are returned unchanged. The vendor directory is
+// stripped from vendored packages below the parent.
 func relativePathFn(path string, parentPath interface{}) string {
-	if p, ok := parentPath.(string); ok && p != "" && strings.HasPrefix(path, p) {
-		path = path[len(p)+1:]
+	p, ok := parentPath.(string)
+	p = strings.TrimSuffix(p, "/")
+	switch {
+	case !ok || p == "":
+		return path
+	case path == p:
+		return "."
+	case strings.HasPrefix(path, p) && path[len(p)] == '/':
+		rel := path[len(p)+1:]
+		if canonical, ok := vendoredPath(rel); ok {
+			return canonical
+		}
+		return rel
 	}
 	return path
 }
 
+// maxListedPathElements is the number of elements above which a relative
+// path in a listing is shortened.
+const maxListedPathElements = 4
+
+// trimPathPrefixFn returns the compact form of path shown in directory and
+// importer listings. Paths below prefix are shown relative to prefix with
+// the middle elements of deep paths elided. Other paths are unchanged.
+func trimPathPrefixFn(path, prefix string) string {
+	rel := relativePathFn(path, prefix)
+	if rel == path || rel == "." {
+		return rel
+	}
+	elems := strings.Split(rel, "/")
+	if len(elems) > maxListedPathElements {
+		rel = elems[0] + "/…/" + strings.Join(elems[len(elems)-2:], "/")
+	}
+	return rel
+}
+
 // importPathFn formats an import with zero width space characters to allow for breaks.
 func importPathFn(path string) htemp.HTML {
 	path = htemp.HTMLEscapeString(path)
@@ -129,9 +167,10 @@ func importPathFn(path string) htemp.HTML {
 // time.
 func relativeTime(t time.Time) string {
 	const day = 24 * time.Hour
-	d := time.Now().Sub(t)
+	d := timeNow().Sub(t)
 	switch {
 	case d < time.Second:
+		// Times in the future are from a clock ahead of the local clock.
 		return "just now"
 	case d < 2*time.Second:
 		return "one second ago"
@@ -193,22 +232,145 @@ func commentFn(v string) htemp.HTML {
 		return out
 	})
 	p = replaceAll(p, packagePat, func(out, src []byte, m []int) []byte {
-		path := bytes.TrimRight(src[m[2]:m[3]], ".!?:")
+		path := bytes.TrimRight(src[m[2]:m[3]], ".,;:!?)")
 		if !doc.IsValidPath(string(path)) {
 			return append(out, src[m[0]:m[1]]...)
 		}
 		out = append(out, src[m[0]:m[2]]...)
-		out = append(out, `<a href="/`...)
-		out = append(out, path...)
+		out = append(out, `<a href="`...)
+		out = append(out, escapePath(sitePath("/"+linkPath(string(path))))...)
 		out = append(out, `">`...)
 		out = append(out, path...)
 		out = append(out, `</a>`...)
 		out = append(out, src[m[2]+len(path):m[1]]...)
 		return out
 	})
+	p = replaceAll(p, prePat, func(out, src []byte, m []int) []byte {
+		text := html.UnescapeString(string(tagPat.ReplaceAll(src[m[2]:m[3]], nil)))
+		if classifyPre(text) != preShell {
+			return append(out, src[m[0]:m[1]]...)
+		}
+		out = append(out, `<pre class="shell" data-copy="`...)
+		out = append(out, htemp.HTMLEscapeString(shellCopyText(text))...)
+		out = append(out, `">`...)
+		return append(out, src[m[2]:m[1]]...)
+	})
 	return htemp.HTML(p)
 }
 
+var (
+	prePat       = regexp.MustCompile(`(?s)<pre>(.*?)</pre>`)
+	tagPat       = regexp.MustCompile(`<[^>]*>`)
+	shellFlagPat = regexp.MustCompile(`^--?[a-zA-Z][-a-zA-Z0-9_]*(=.*)?$`)
+	shellWordPat = regexp.MustCompile(`^[-a-zA-Z0-9_./]+$`)
+)
+
+// Classifications of preformatted blocks in comments.
+const (
+	prePlain = iota
+	preGo
+	preShell
+)
+
+// shellCommands is the set of commands that start a shell example.
+var shellCommands = map[string]bool{
+	"apt-get": true,
+	"brew":    true,
+	"cd":      true,
+	"curl":    true,
+	"export":  true,
+	"git":     true,
+	"go":      true,
+	"godoc":   true,
+	"gofmt":   true,
+	"hg":      true,
+	"make":    true,
+	"mkdir":   true,
+	"sudo":    true,
+	"svn":     true,
+	"wget":    true,
+}
+
+// classifyPre classifies the text of a preformatted block in a comment. A
+// block is classified as shell only if the block is not Go and the block
+// starts with a "$ " prompt or every line is a shell command. All other
+// blocks are plain.
+func classifyPre(text string) int {
+	if isGoSource(text) {
+		return preGo
+	}
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if strings.HasPrefix(lines[0], "$ ") {
+		return preShell
+	}
+	continued := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || continued:
+		case !isShellCommand(line):
+			return prePlain
+		}
+		continued = strings.HasSuffix(line, "\\")
+	}
+	return preShell
+}
+
+// isShellCommand returns true if line looks like a shell command: the first
+// word is a known command or a path to a program, or the line is a plain
+// word followed by flags.
+func isShellCommand(line string) bool {
+	words := strings.Fields(line)
+	switch {
+	case shellCommands[words[0]]:
+		return true
+	case strings.HasPrefix(words[0], "./") && shellWordPat.MatchString(words[0]):
+		return true
+	case !shellWordPat.MatchString(words[0]):
+		return false
+	}
+	for _, w := range words[1:] {
+		if shellFlagPat.MatchString(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGoSource returns true if text parses as Go declarations or statements.
+func isGoSource(text string) bool {
+	fset := token.NewFileSet()
+	if _, err := parser.ParseFile(fset, "", "package p\n"+text, 0); err == nil {
+		return true
+	}
+	_, err := parser.ParseFile(fset, "", "package p\nfunc _() {\n"+text+"\n}", 0)
+	return err == nil
+}
+
+// shellCopyText returns the text to copy from a shell block. If the block
+// uses prompts, the text is the prompted commands without the prompts and
+// the output lines are dropped.
+func shellCopyText(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "$ ") {
+		return text
+	}
+	var commands []string
+	continued := false
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case continued:
+			commands = append(commands, line)
+		case strings.HasPrefix(line, "$ "):
+			commands = append(commands, line[len("$ "):])
+		default:
+			continue
+		}
+		continued = strings.HasSuffix(line, "\\")
+	}
+	return strings.Join(commands, "\n")
+}
+
 // commentTextFn formats a source code comment as text.
 func commentTextFn(v string) string {
 	const indent = "    "
@@ -220,26 +382,47 @@ func commentTextFn(v string) string {
 
 var period = []byte{'.'}
 
+// codeFn formats a declaration as HTML. Annotations that are out of order
+// or out of the range of the text are ignored and annotations that refer to
+// a missing path are not linked.
 func codeFn(c doc.Code, typ *doc.Type) htemp.HTML {
 	var buf bytes.Buffer
 	last := 0
 	src := []byte(c.Text)
 	for _, a := range c.Annotations {
+		if int(a.Pos) < last || a.End < a.Pos || int(a.End) > len(src) {
+			continue
+		}
 		htemp.HTMLEscape(&buf, src[last:a.Pos])
-		switch a.Kind {
+		kind := a.Kind
+		if (kind == doc.PackageLinkAnnotation || kind == doc.ExportLinkAnnotation) && int(a.PathIndex) >= len(c.Paths) ||
+			kind == doc.PackageLinkAnnotation && a.PathIndex < 0 {
+			kind = -1
+		}
+		if (kind == doc.PackageLinkAnnotation || kind == doc.ExportLinkAnnotation) &&
+			a.PathIndex >= 0 && doc.IsRelativeImport(c.Paths[a.PathIndex]) {
+			// Documentation built before relative imports were excluded
+			// from links has links that go nowhere.
+			kind = -1
+		}
+		switch kind {
 		case doc.PackageLinkAnnotation:
-			p := "/" + c.Paths[a.PathIndex]
+			p := sitePath("/" + linkPath(c.Paths[a.PathIndex]))
 			buf.WriteString(`<a href="`)
 			buf.WriteString(escapePath(p))
+			if canonical, ok := vendoredPath(c.Paths[a.PathIndex]); ok {
+				buf.WriteString(`" title="View canonical package `)
+				htemp.HTMLEscape(&buf, []byte(canonical))
+			}
 			buf.WriteString(`">`)
 			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
 			buf.WriteString(`</a>`)
 		case doc.ExportLinkAnnotation, doc.BuiltinAnnotation:
 			var p string
 			if a.Kind == doc.BuiltinAnnotation {
-				p = "/builtin"
+				p = sitePath("/builtin")
 			} else if a.PathIndex >= 0 {
-				p = "/" + c.Paths[a.PathIndex]
+				p = sitePath("/" + linkPath(c.Paths[a.PathIndex]))
 			}
 			n := src[a.Pos:a.End]
 			n = n[bytes.LastIndex(n, period)+1:]
@@ -255,12 +438,16 @@ func codeFn(c doc.Code, typ *doc.Type) htemp.HTML {
 			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
 			buf.WriteString(`</span>`)
 		case doc.AnchorAnnotation:
+			if typ != nil && !fieldAnchor(typ, string(src[a.Pos:a.End])) {
+				htemp.HTMLEscape(&buf, src[a.Pos:a.End])
+				break
+			}
 			buf.WriteString(`<span id="`)
 			if typ != nil {
-				htemp.HTMLEscape(&buf, []byte(typ.Name))
-				buf.WriteByte('.')
+				htemp.HTMLEscape(&buf, []byte(doc.AnchorID(doc.DeclAnchor, typ.Name, string(src[a.Pos:a.End]))))
+			} else {
+				htemp.HTMLEscape(&buf, []byte(doc.AnchorID(doc.DeclAnchor, string(src[a.Pos:a.End]))))
 			}
-			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
 			buf.WriteString(`">`)
 			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
 			buf.WriteString(`</span>`)
@@ -273,6 +460,136 @@ func codeFn(c doc.Code, typ *doc.Type) htemp.HTML {
 	return htemp.HTML(buf.String())
 }
 
+// highlightFn formats text as HTML with the matches of the search query
+// terms in bold. Matches that are out of order, out of the range of the text
+// or not on UTF-8 boundaries are ignored. Text without matches is formatted
+// as by importPathFn.
+func highlightFn(text string, matches []database.Match) htemp.HTML {
+	if len(matches) == 0 {
+		return importPathFn(text)
+	}
+	var buf bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		if m.Start < last || m.End <= m.Start || m.End > len(text) ||
+			!utf8.RuneStart(text[m.Start]) || m.End < len(text) && !utf8.RuneStart(text[m.End]) {
+			continue
+		}
+		buf.WriteString(htemp.HTMLEscapeString(text[last:m.Start]))
+		buf.WriteString("<b>")
+		buf.WriteString(htemp.HTMLEscapeString(text[m.Start:m.End]))
+		buf.WriteString("</b>")
+		last = m.End
+	}
+	buf.WriteString(htemp.HTMLEscapeString(text[last:]))
+	return htemp.HTML(buf.String())
+}
+
+// exampleFn formats the parts of an example that follow the code as HTML:
+// the expected output in its own section and, for a playable example, the
+// complete program with the package clause for running the example.
+func exampleFn(e *doc.Example) htemp.HTML {
+	var buf bytes.Buffer
+	if e.Output != "" {
+		label := "Output"
+		if e.Unordered {
+			label = "Unordered output"
+		}
+		buf.WriteString(`<div class="example-output"><p>` + label + `:<pre class="pre-x-scrollable">`)
+		htemp.HTMLEscape(&buf, []byte(e.Output))
+		buf.WriteString(`</pre></div>`)
+	}
+	if e.Play != "" {
+		buf.WriteString(`<textarea class="example-play hide" readonly>`)
+		htemp.HTMLEscape(&buf, []byte(e.Play))
+		buf.WriteString(`</textarea>`)
+	}
+	return htemp.HTML(buf.String())
+}
+
+// fieldAnchor returns true if the field or interface method name in the
+// declaration of typ has an anchor. Unexported fields do not have anchors
+// and the anchor of a method of the type takes precedence over a field with
+// the same name.
+func fieldAnchor(typ *doc.Type, name string) bool {
+	return ast.IsExported(name) && !typ.HasMethod(name)
+}
+
+func declAnchorFn(names ...string) string {
+	return doc.AnchorID(doc.DeclAnchor, names...)
+}
+
+// declIndex is the declaration index of a package. Methods are listed with
+// their type and constructors are promoted from the package functions to
+// their type.
+type declIndex struct {
+	Funcs  []*doc.Func
+	Groups []*doc.IndexGroup
+}
+
+func declIndexFn(pdoc *doc.Package) declIndex {
+	funcs, groups := doc.IndexGroups(pdoc)
+	return declIndex{funcs, groups}
+}
+
+// methodRecvFn returns the receiver type of a method as shown in the
+// declaration index, as in "*Client".
+func methodRecvFn(f *doc.Func) string {
+	name, pointer := f.RecvType()
+	if pointer {
+		return "*" + name
+	}
+	return name
+}
+
+func exampleAnchorFn(objectName, exampleName string) string {
+	return doc.AnchorID(doc.ExampleAnchor, objectName, exampleName)
+}
+
+func exampleGroupAnchorFn(objectName string) string {
+	return doc.AnchorID(doc.ExampleGroupAnchor, objectName)
+}
+
+// readmeAnchorFn returns the anchor of the README example with index
+// i. The README examples are numbered from one.
+func readmeAnchorFn(i int) string {
+	return doc.AnchorID(doc.ExampleAnchor, "readme", strconv.Itoa(i+1))
+}
+
+// generatedFn returns true if the declaration at pos is in a generated file.
+func generatedFn(pdoc *doc.Package, pos doc.Pos) bool {
+	return validFilePos(pdoc, pos) && pdoc.Files[pos.File].Generated
+}
+
+// generatedFilesFn returns the number of generated files in the package.
+func generatedFilesFn(pdoc *doc.Package) int {
+	n := 0
+	for _, f := range pdoc.Files {
+		if f != nil && f.Generated {
+			n++
+		}
+	}
+	return n
+}
+
+// goGenerateFn returns the //go:generate directives in the package files.
+func goGenerateFn(pdoc *doc.Package) []string {
+	var result []string
+	for _, f := range pdoc.Files {
+		if f == nil {
+			continue
+		}
+		for _, c := range f.GoGenerate {
+			result = append(result, f.Name+": "+c)
+		}
+	}
+	return result
+}
+
+func noteAnchorFn(tag string) string {
+	return doc.AnchorID(doc.NoteAnchor, tag)
+}
+
 func pageNameFn(pdoc *doc.Package) string {
 	if pdoc.Name != "" && !pdoc.IsCmd {
 		return pdoc.Name
@@ -281,8 +598,13 @@ func pageNameFn(pdoc *doc.Package) string {
 	return name
 }
 
+var countReadmeExamples = flag.Bool("count_readme_examples", false, "Count examples from README files when deciding if a package has examples.")
+
+// hasExamplesFn returns true if the package has examples from the test
+// files. Examples from README files are not checked by go test and are
+// counted only if the count_readme_examples flag is set.
 func hasExamplesFn(pdoc *doc.Package) bool {
-	if len(pdoc.Examples) > 0 {
+	if len(pdoc.Examples) > 0 || *countReadmeExamples && len(pdoc.ReadmeExamples) > 0 {
 		return true
 	}
 	for _, f := range pdoc.Funcs {
@@ -328,18 +650,32 @@ func breadcrumbsFn(pdoc *doc.Package, templateName string) htemp.HTML {
 			j = len(pdoc.ImportPath)
 		}
 	}
+
+	// The elements of a vendored package below the vendor directory are
+	// shown as one link to the canonical package.
+	end := len(pdoc.ImportPath)
+	canonical, vendored := vendoredPath(pdoc.ImportPath)
+	if vendored && end-len(canonical)-1 >= j {
+		end -= len(canonical) + 1
+	} else {
+		vendored = false
+	}
+
+	// The links of documentation for an explicitly requested tag or branch
+	// are to the directories at the same ref.
+	ref := ""
+	if pdoc.ResolvedFrom.Kind == doc.ResolvedExplicit {
+		ref = "@" + pdoc.DefaultBranch
+	}
+
 	for {
 		if i != 0 {
 			buf.WriteString(`<span class="muted">/</span>`)
 		}
-		link := j < len(pdoc.ImportPath) ||
-			templateName == "imports.html" ||
-			templateName == "importers.html" ||
-			templateName == "graph.html" ||
-			templateName == "interface.html"
+		link := j < len(pdoc.ImportPath) || isViewTemplate(templateName)
 		if link {
-			buf.WriteString(`<a href="/`)
-			buf.WriteString(escapePath(pdoc.ImportPath[:j]))
+			buf.WriteString(`<a href="`)
+			buf.WriteString(escapePath(sitePath("/" + pdoc.ImportPath[:j] + ref)))
 			buf.WriteString(`">`)
 		} else {
 			buf.WriteString(`<span class="muted">`)
@@ -351,20 +687,81 @@ func breadcrumbsFn(pdoc *doc.Package, templateName string) htemp.HTML {
 			buf.WriteString("</span>")
 		}
 		i = j + 1
-		if i >= len(pdoc.ImportPath) {
+		if i >= end {
 			break
 		}
-		j = strings.IndexRune(pdoc.ImportPath[i:], '/')
+		j = strings.IndexRune(pdoc.ImportPath[i:end], '/')
 		if j < 0 {
-			j = len(pdoc.ImportPath)
+			j = end
 		} else {
 			j += i
 		}
 	}
+	if ref != "" {
+		buf.WriteString(`<span class="muted">`)
+		buf.WriteString(htemp.HTMLEscapeString(ref))
+		buf.WriteString("</span>")
+	}
+	if vendored {
+		buf.WriteString(`<span class="muted">/</span><a href="`)
+		buf.WriteString(escapePath(sitePath("/" + linkPath(canonical))))
+		buf.WriteString(`" title="View canonical package">`)
+		buf.WriteString(htemp.HTMLEscapeString(canonical))
+		buf.WriteString("</a>")
+	}
 	return htemp.HTML(buf.String())
 }
 
+// activitySummaryFn formats the contributor and open issue counts in the
+// project activity.
+func activitySummaryFn(a *doc.ProjectActivity) string {
+	var parts []string
+	switch {
+	case a.Contributors >= doc.MaxContributors:
+		parts = append(parts, fmt.Sprintf("%d+ contributors", a.Contributors))
+	case a.Contributors == 1:
+		parts = append(parts, "1 contributor")
+	case a.Contributors > 1:
+		parts = append(parts, fmt.Sprintf("%d contributors", a.Contributors))
+	}
+	switch {
+	case a.OpenIssues == 1:
+		parts = append(parts, "1 open issue")
+	case a.OpenIssues >= 0:
+		parts = append(parts, fmt.Sprintf("%d open issues", a.OpenIssues))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// provenanceBanner explains that the documentation is not built from the
+// current default branch of the project.
+type provenanceBanner struct {
+	Message string
+
+	// Refresh is true if fetching the package again documents the default
+	// branch.
+	Refresh bool
+}
+
+// provenanceBannerFn returns the banner for pdoc or nil if pdoc documents
+// the default branch. The default branch in the project activity is the
+// most recent one reported by the host.
+func provenanceBannerFn(pdoc *doc.Package) *provenanceBanner {
+	current := ""
+	if pdoc.Activity != nil {
+		current = pdoc.Activity.DefaultBranch
+	}
+	message, stale := pdoc.ResolvedFrom.Banner(current)
+	if message == "" {
+		return nil
+	}
+	return &provenanceBanner{Message: message, Refresh: stale}
+}
+
 func gaAccountFn() string {
+	if stableRender {
+		return "UA-TEST-1"
+	}
 	return secrets.GAAccount
 }
 
@@ -379,23 +776,41 @@ func htmlCommentFn(s string) htemp.HTML {
 var contentTypes = map[string]string{
 	".html": "text/html; charset=utf-8",
 	".txt":  "text/plain; charset=utf-8",
+	".svg":  "image/svg+xml",
 }
 
-func executeTemplate(resp web.Response, name string, status int, header web.Header, data interface{}) error {
+// executeTemplate starts the response with the content type of the named
+// template and renders the template.
+func executeTemplate(resp web.Response, req *web.Request, name string, status int, header web.Header, data interface{}) error {
 	contentType, ok := contentTypes[path.Ext(name)]
 	if !ok {
 		contentType = "text/plain; charset=utf-8"
 	}
-	t := templates[name]
-	if t == nil {
+	if templates[name] == nil {
 		return fmt.Errorf("Template %s not found", name)
 	}
 	if header == nil {
 		header = make(web.Header)
 	}
 	header.Set(web.HeaderContentType, contentType)
-	w := resp.Start(status, header)
-	return t.Execute(w, data)
+	return renderTemplate(resp.Start(status, header), req, name, data)
+}
+
+// renderTemplate executes the named template to w and records the render
+// time. HTML templates are traced if requested by an administrator. The
+// request is nil when rendering outside of a request.
+func renderTemplate(w io.Writer, req *web.Request, name string, data interface{}) error {
+	t := templates[name]
+	if t == nil {
+		return fmt.Errorf("Template %s not found", name)
+	}
+	if _, ok := traceTemplates[name]; ok && isTraceRequest(req) {
+		return executeTraceTemplate(w, name, data)
+	}
+	start := time.Now()
+	err := t.Execute(w, data)
+	recordRenderTime(name, time.Since(start))
+	return err
 }
 
 var templates = map[string]interface {
@@ -410,32 +825,82 @@ func joinTemplateDir(base string, files []string) []string {
 	return result
 }
 
+// htmlTemplateFuncs returns the funcs for the HTML template with the given
+// name.
+func htmlTemplateFuncs(templateName string) htemp.FuncMap {
+	return htemp.FuncMap{
+		"sourceLink":         sourceLinkFn,
+		"sitePath":           sitePathFn,
+		"activitySummary":    activitySummaryFn,
+		"advisories":         advisoriesFn,
+		"sectionOmitted":     sectionOmittedFn,
+		"advisoryClass":      advisoryClassFn,
+		"htmlComment":        htmlCommentFn,
+		"breadcrumbs":        breadcrumbsFn,
+		"buildContexts":      buildContextsFn,
+		"comment":            commentFn,
+		"byteSize":           byteSizeFn,
+		"code":               codeFn,
+		"example":            exampleFn,
+		"highlight":          highlightFn,
+		"equal":              reflect.DeepEqual,
+		"wordDiff":           wordDiffFn,
+		"serviceNotice":      serviceNoticeFn,
+		"declAnchor":         declAnchorFn,
+		"duration":           durationFn,
+		"declIndex":          declIndexFn,
+		"methodRecv":         methodRecvFn,
+		"exampleAnchor":      exampleAnchorFn,
+		"exampleGroupAnchor": exampleGroupAnchorFn,
+		"readme":             readmeFn,
+		"readmeAnchor":       readmeAnchorFn,
+		"noteAnchor":         noteAnchorFn,
+		"generated":          generatedFn,
+		"generatedFiles":     generatedFilesFn,
+		"goGenerate":         goGenerateFn,
+		"legacyAnchors":      doc.LegacyAnchors,
+		"hasExamples":        hasExamplesFn,
+		"hasExampleUses":     hasExampleUsesFn,
+		"declsByExampleUses": declsByExampleUsesFn,
+		"exampleUses":        exampleUsesFn,
+		"gaAccount":          gaAccountFn,
+		"importPath":         importPathFn,
+		"isValidImportPath":  doc.IsValidPath,
+		"languageName":       languageNameFn,
+		"majorVersions":      majorVersionsFn,
+		"map":                mapFn,
+		"newerMajorVersion":  newerMajorVersionFn,
+		"noteTitle":          noteTitleFn,
+		"openSearchLink":     openSearchLinkFn,
+		"pageName":           pageNameFn,
+		"provenanceBanner":   provenanceBannerFn,
+		"relativePath":       relativePathFn,
+		"reportReasons":      reportReasonsFn,
+		"trimPathPrefix":     trimPathPrefixFn,
+		"stabilityLabel":     stabilityLabelFn,
+		"staticFile":         staticFileFn,
+		"fileHash":           fileHashFn,
+		"templateName":       func() string { return templateName },
+		"tabViews":           tabViewsFn,
+	}
+}
+
 func parseHTMLTemplates(sets [][]string) error {
 	for _, set := range sets {
-		templateName := set[0]
 		t := htemp.New("")
-		t.Funcs(htemp.FuncMap{
-			"sourceLink":        sourceLinkFn,
-			"htmlComment":       htmlCommentFn,
-			"breadcrumbs":       breadcrumbsFn,
-			"comment":           commentFn,
-			"code":              codeFn,
-			"equal":             reflect.DeepEqual,
-			"hasExamples":       hasExamplesFn,
-			"gaAccount":         gaAccountFn,
-			"importPath":        importPathFn,
-			"isValidImportPath": doc.IsValidPath,
-			"map":               mapFn,
-			"noteTitle":         noteTitleFn,
-			"pageName":          pageNameFn,
-			"relativePath":      relativePathFn,
-			"staticFile":        staticFileFn,
-			"fileHash":          fileHashFn,
-			"templateName":      func() string { return templateName },
-		})
-		if _, err := t.ParseFiles(joinTemplateDir(*assetsDir, set)...); err != nil {
+		t.Funcs(htmlTemplateFuncs(set[0]))
+		files := joinTemplateDir(*assetsDir, set)
+		if _, err := t.ParseFiles(files...); err != nil {
 			return err
 		}
+		if err := setTemplateDigest(set[0], files); err != nil {
+			return err
+		}
+		tt, err := t.Clone()
+		if err != nil {
+			return err
+		}
+		traceTemplates[set[0]] = tt
 		t = t.Lookup("ROOT")
 		if t == nil {
 			return fmt.Errorf("ROOT template not found in %v", set)
@@ -450,8 +915,13 @@ func parseTextTemplates(sets [][]string) error {
 		t := ttemp.New("")
 		t.Funcs(ttemp.FuncMap{
 			"comment": commentTextFn,
+			"xml":     xmlFn,
 		})
-		if _, err := t.ParseFiles(joinTemplateDir(*assetsDir, set)...); err != nil {
+		files := joinTemplateDir(*assetsDir, set)
+		if _, err := t.ParseFiles(files...); err != nil {
+			return err
+		}
+		if err := setTemplateDigest(set[0], files); err != nil {
 			return err
 		}
 		t = t.Lookup("ROOT")
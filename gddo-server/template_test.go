@@ -0,0 +1,657 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+)
+
+func TestGeneratedBadges(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	pdoc.Files = []*doc.File{
+		{Name: "buffer.go", GoGenerate: []string{"stringer -type=Kind"}},
+		{Name: "copy_string.go", Generated: true},
+	}
+	pdoc.Types[0].Pos = doc.Pos{Line: 10, File: 0}
+	pdoc.Funcs[0].Pos = doc.Pos{Line: 3, File: 1}
+
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+		t.Fatal(err)
+	}
+	page := resp.buf.String()
+
+	for _, tt := range []struct {
+		pattern string
+		n       int
+	}{
+		// The function from the generated file and the file list have
+		// badges. The type from the regular file does not.
+		{`<h3 id="Copy">func <a [^>]*>Copy</a> <span class="label">generated</span></h3>`, 1},
+		{`<h3 id="Buffer">type <a [^>]*>Buffer</a></h3>`, 1},
+		{`copy_string.go <span class="label">generated</span>`, 1},
+		{`1 of 2 files in this package are generated`, 1},
+		{`buffer.go: stringer -type=Kind`, 1},
+	} {
+		if n := len(regexp.MustCompile(tt.pattern).FindAllString(page, -1)); n != tt.n {
+			t.Errorf("found %d matches for %s, want %d", n, tt.pattern, tt.n)
+		}
+	}
+	if strings.Count(page, `<span class="label">generated</span>`) != 3 {
+		t.Errorf("page has %d generated badges, want 3", strings.Count(page, `<span class="label">generated</span>`))
+	}
+}
+
+func TestExampleUses(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	pdoc.Funcs[0].ExampleUses = 1
+	pdoc.Types[0].Methods[0].ExampleUses = 2
+	pdoc.Types[0].Methods[0].TestUses = 1
+
+	for _, tt := range []struct {
+		indexOrder string
+		pattern    string
+	}{
+		{"", `(?s)<li><a href="#Copy">.*<li><a href="#Buffer">type Buffer</a>.*<li><a href="#Buffer">\(\*Buffer\)</a> <a href="#Buffer.Len"[^>]*>Len</a>`},
+		{"uses", `(?s)<li><a href="#Buffer">\(\*Buffer\)</a> <a href="#Buffer.Len"[^>]*>Len</a> <small class="muted">used in 2 examples.*<li><a href="#Copy">.*used in 1 example.*<li><a href="#Buffer">type Buffer</a>`},
+	} {
+		var resp testResponse
+		if err := executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc, "indexOrder": tt.indexOrder}); err != nil {
+			t.Fatal(err)
+		}
+		page := resp.buf.String()
+		if !regexp.MustCompile(tt.pattern).MatchString(page) {
+			t.Errorf("index order %q: page does not match %s", tt.indexOrder, tt.pattern)
+		}
+		if !regexp.MustCompile(`<h3 id="Copy">func [^\n]*Copy[^\n]* <small class="muted">used in 1 example</small></h3>`).MatchString(page) {
+			t.Errorf("index order %q: page does not have note for Copy", tt.indexOrder)
+		}
+	}
+
+	uses := declUses(pdoc)
+	if len(uses) != 3 || uses[2].Type != "Buffer" || !uses[2].Pointer || uses[2].ExampleUses != 2 || uses[2].TestUses != 1 {
+		t.Errorf("declUses() returned unexpected uses %+v", uses)
+	}
+}
+
+// methodIndexTestPackage has two types with methods of the same name and a
+// constructor that go/doc does not associate with its type.
+func methodIndexTestPackage() *doc.Package {
+	pdoc := fragmentTestPackage()
+	pdoc.Funcs = append(pdoc.Funcs, &doc.Func{
+		Name: "NewClient",
+		Decl: doc.Code{Text: "func NewClient(addr string) (*Client, error)"},
+	})
+	pdoc.Types = append(pdoc.Types, &doc.Type{
+		Name: "Client",
+		Decl: doc.Code{Text: "type Client struct{}"},
+		Methods: []*doc.Func{
+			{Name: "Do", Recv: "*Client", Decl: doc.Code{Text: "func (c *Client) Do() error"}},
+			{Name: "Len", Recv: "Client", Decl: doc.Code{Text: "func (c Client) Len() int"}},
+		},
+	})
+	return pdoc
+}
+
+func TestMethodIndex(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := methodIndexTestPackage()
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+		t.Fatal(err)
+	}
+	page := resp.buf.String()
+	const pattern = `(?s)<li><a href="#Copy">.*` +
+		`<li><a href="#Buffer">type Buffer</a>.*<li><a href="#Buffer">\(\*Buffer\)</a> <a href="#Buffer.Len"[^>]*>Len</a>.*` +
+		`<li><a href="#Client">type Client</a>.*<li><a href="#NewClient">func NewClient.*` +
+		`<li><a href="#Client">\(\*Client\)</a> <a href="#Client.Do"[^>]*>Do</a>.*` +
+		`<li><a href="#Client">\(Client\)</a> <a href="#Client.Len"[^>]*>Len</a>`
+	if !regexp.MustCompile(pattern).MatchString(page) {
+		t.Errorf("page does not match %s", pattern)
+	}
+
+	// The text summary lists the promoted constructor with its type.
+	w := &textWriter{pdoc: pdoc, width: 80}
+	w.packageSummary()
+	const want = "func Copy(dst io.Writer, src io.Reader) Buffer\n" +
+		"type Buffer struct{}\n" +
+		"type Client struct{}\n" +
+		"    func NewClient(addr string) (*Client, error)\n"
+	if s := w.buf.String(); !strings.HasSuffix(s, want) {
+		t.Errorf("packageSummary() = %q, want suffix %q", s, want)
+	}
+}
+
+var commentPackageLinkTests = []struct {
+	comment string
+	link    string
+}{
+	{"See package github.com/user/repo for details.", "github.com/user/repo"},
+	{"Use package github.com/user/repo, not this one.", "github.com/user/repo"},
+	{"Like package net/http!", "net/http"},
+	{"Moved to package gopkg.in/yaml.v1.", "gopkg.in/yaml.v1"},
+	{"The package github.com/user/my%20repo is gone.", ""},
+	{"The package github.com/user\\repo is gone.", ""},
+	{"The package github.com/user/.hidden is gone.", ""},
+	{"The package foobar is gone.", ""},
+}
+
+func TestCommentPackageLinks(t *testing.T) {
+	for _, tt := range commentPackageLinkTests {
+		s := string(commentFn(tt.comment))
+		hasLink := strings.Contains(s, "<a href=")
+		if tt.link == "" {
+			if hasLink {
+				t.Errorf("commentFn(%q) = %q, want no link", tt.comment, s)
+			}
+			continue
+		}
+		if want := `<a href="/` + tt.link + `">` + tt.link + `</a>`; !strings.Contains(s, want) {
+			t.Errorf("commentFn(%q) = %q, want link %s", tt.comment, s, want)
+		}
+	}
+}
+
+var classifyPreTests = []struct {
+	text  string
+	class int
+	copy  string
+}{
+	{"go get github.com/user/repo\n", preShell, "go get github.com/user/repo"},
+	{"$ go get github.com/user/repo\n$ repo -v -o out.txt\nwrote out.txt\n", preShell, "go get github.com/user/repo\nrepo -v -o out.txt"},
+	{"mycmd -addr=:8080 -debug\n", preShell, "mycmd -addr=:8080 -debug"},
+	{"./build.sh --release\n", preShell, "./build.sh --release"},
+	{"curl -X POST \\\n    http://localhost:8080/\n", preShell, "curl -X POST \\\n    http://localhost:8080/"},
+	{"x := foo.New()\nx.Run()\n", preGo, ""},
+	{"func main() {\n\tfmt.Println(\"hello\")\n}\n", preGo, ""},
+	{"go f(x)\n", preGo, ""},
+	{"+-------+     +-------+\n| input | --> | parse |\n+-------+     +-------+\n", prePlain, ""},
+	{"go get github.com/user/repo\nthen read the docs\n", prePlain, ""},
+	{"Name   Value\nfoo    -1\n", prePlain, ""},
+}
+
+func TestClassifyPre(t *testing.T) {
+	for _, tt := range classifyPreTests {
+		if class := classifyPre(tt.text); class != tt.class {
+			t.Errorf("classifyPre(%q) = %d, want %d", tt.text, class, tt.class)
+		}
+		if tt.class != preShell {
+			continue
+		}
+		if copy := shellCopyText(tt.text); copy != tt.copy {
+			t.Errorf("shellCopyText(%q) = %q, want %q", tt.text, copy, tt.copy)
+		}
+	}
+}
+
+func TestCommentPreBlocks(t *testing.T) {
+	comment := "Package repo does things.\n\nInstall with\n\n    $ go get github.com/user/repo\n\nUse it like this:\n\n    r := repo.New(\"a<b\")\n    r.Run()\n\nThe pipeline:\n\n    input --> parse --> output\n"
+	s := string(commentFn(comment))
+	for _, want := range []string{
+		`<pre class="shell" data-copy="go get github.com/user/repo">$ go get github.com/user/repo`,
+		"<pre>r := repo.New(&quot;a&lt;b&quot;)",
+		"<pre>input --&gt; parse --&gt; output",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("commentFn(%q) = %q, want %q", comment, s, want)
+		}
+	}
+	if n := strings.Count(s, "data-copy"); n != 1 {
+		t.Errorf("commentFn(%q) has %d shell blocks, want 1", comment, n)
+	}
+}
+
+func TestProvenanceBanner(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		resolution doc.Resolution
+		activity   *doc.ProjectActivity
+		banner     string
+	}{
+		{doc.Resolution{Kind: doc.ResolvedDefaultBranch, Ref: "master", HostDefault: "master"}, &doc.ProjectActivity{DefaultBranch: "master"}, ""},
+		{doc.Resolution{}, nil, ""},
+		{doc.Resolution{Kind: doc.ResolvedGo1, Ref: "go1", HostDefault: "master"}, nil, "documentation for the go1 tag or branch"},
+		{doc.Resolution{Kind: doc.ResolvedVCSDefault, Ref: "master", HostDefault: "develop"}, nil, "default branch develop of the project was not found"},
+		{doc.Resolution{Kind: doc.ResolvedDefaultBranch, Ref: "master", HostDefault: "master"}, &doc.ProjectActivity{DefaultBranch: "main"}, "is now main. <a href=\"javascript:document.refresh.submit();\""},
+	} {
+		pdoc := fragmentTestPackage()
+		pdoc.ResolvedFrom = tt.resolution
+		pdoc.Activity = tt.activity
+		var resp testResponse
+		if err := executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+			t.Fatal(err)
+		}
+		page := resp.buf.String()
+		if tt.banner == "" {
+			if strings.Contains(page, "You are viewing the documentation") {
+				t.Errorf("page for %+v has a banner", tt.resolution)
+			}
+		} else if !strings.Contains(page, tt.banner) {
+			t.Errorf("page for %+v does not contain %q", tt.resolution, tt.banner)
+		}
+	}
+}
+
+// corruptedTestPackage returns a package with the problems found in records
+// stored by older versions of the builder.
+func corruptedTestPackage() *doc.Package {
+	pdoc := fragmentTestPackage()
+	pdoc.LineFmt = "%s#L%d"
+	pdoc.Files = []*doc.File{
+		{Name: "copy.go", URL: "http://example.com/copy.go"},
+		nil,
+		{Name: "copy.go", URL: "http://example.com/stale/copy.go"},
+	}
+	pdoc.Funcs[0].Pos = doc.Pos{Line: 3, File: 2}
+	pdoc.Types[0].Pos = doc.Pos{Line: 7, File: 1}
+	pdoc.Types[0].Methods[0].Pos = doc.Pos{Line: 9, File: 5}
+	pdoc.Types[0].Decl.Annotations = []doc.Annotation{
+		{Kind: doc.ExportLinkAnnotation, PathIndex: 3, Pos: 5, End: 11},
+		{Kind: doc.PackageLinkAnnotation, PathIndex: -1, Pos: 12, End: 18},
+		{Kind: doc.CommentAnnotation, Pos: 15, End: 100},
+	}
+	return pdoc
+}
+
+func TestCorruptedStoredPackage(t *testing.T) {
+	parseTestTemplates(t)
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	render := func(pdoc *doc.Package) string {
+		var resp testResponse
+		if err := executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+			t.Fatal(err)
+		}
+		return resp.buf.String()
+	}
+
+	// Rendering degrades to unlinked text without the repair.
+	page := render(corruptedTestPackage())
+	if !strings.Contains(page, "type Buffer struct{}") {
+		t.Errorf("page does not contain the unlinked declaration of Buffer")
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	pdoc := corruptedTestPackage()
+	repairStoredDoc(pdoc)
+	if !strings.Contains(logged.String(), `Repaired stored package "github.com/user/repo/pkg": 2 source positions cleared`) {
+		t.Errorf("log = %q, want repair message", logged.String())
+	}
+	if len(pdoc.Files) != 1 || pdoc.Files[0].URL != "http://example.com/copy.go" {
+		t.Errorf("Files = %v, want the first copy.go", pdoc.Files)
+	}
+	n := 0
+	for _, d := range pdoc.Diagnostics {
+		if d.Code == doc.DiagnosticFilePosition {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("got %d file position diagnostics, want 2", n)
+	}
+
+	page = render(pdoc)
+	if !strings.Contains(page, `href="http://example.com/copy.go#L3"`) {
+		t.Errorf("page does not link Copy to the repaired file position")
+	}
+	if strings.Contains(page, "#L7") || strings.Contains(page, "#L9") {
+		t.Errorf("page links cleared positions")
+	}
+}
+
+// packageDamage is a structural defect of a stored package.
+var packageDamage = []func(r *rand.Rand, pdoc *doc.Package){
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Funcs = append(pdoc.Funcs, nil) },
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Types = append(pdoc.Types, nil) },
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Types[0].Methods = append(pdoc.Types[0].Methods, nil) },
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Types[0].Methods = nil },
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Files = append(pdoc.Files, nil) },
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Notes = map[string][]*doc.Note{"BUG": {nil}} },
+	func(r *rand.Rand, pdoc *doc.Package) {
+		pdoc.Examples = append(pdoc.Examples, nil, &doc.Example{Name: "empty"})
+	},
+	func(r *rand.Rand, pdoc *doc.Package) {
+		pdoc.Funcs[0].Examples = append(pdoc.Funcs[0].Examples, &doc.Example{Code: doc.Code{Text: "Copy()"}})
+	},
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Funcs[0].Pos = doc.Pos{Line: 3, File: int16(r.Intn(10))} },
+	func(r *rand.Rand, pdoc *doc.Package) {
+		c := &pdoc.Funcs[0].Decl
+		i := r.Intn(len(c.Annotations))
+		c.Annotations[i].Pos = int32(r.Intn(100) - 10)
+		c.Annotations[i].End = int32(r.Intn(100) - 10)
+	},
+	func(r *rand.Rand, pdoc *doc.Package) {
+		c := &pdoc.Funcs[0].Decl
+		c.Annotations[r.Intn(len(c.Annotations))].PathIndex = int32(r.Intn(6) - 2)
+	},
+	func(r *rand.Rand, pdoc *doc.Package) {
+		c := &pdoc.Funcs[0].Decl
+		c.Annotations[r.Intn(len(c.Annotations))].Kind = doc.AnnotationKind(r.Intn(5))
+	},
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Funcs[0].Decl.Text = "" },
+	func(r *rand.Rand, pdoc *doc.Package) { pdoc.Funcs[0].Decl.Paths = nil },
+}
+
+func TestRenderDamagedPackages(t *testing.T) {
+	parseTestTemplates(t)
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stderr)
+
+	render := func(pdoc *doc.Package) (page string, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				t.Fatalf("rendering panicked: %v", v)
+			}
+		}()
+		var resp testResponse
+		err = executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc})
+		return resp.buf.String(), err
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		damage := func() *doc.Package {
+			pdoc := fragmentTestPackage()
+			for n := 1 + r.Intn(4); n > 0; n-- {
+				packageDamage[r.Intn(len(packageDamage))](r, pdoc)
+			}
+			return pdoc
+		}
+		seed := r.Int63()
+
+		// Without the repair, rendering can fail but must not panic.
+		r.Seed(seed)
+		render(damage())
+
+		r.Seed(seed)
+		pdoc := damage()
+		repairStoredDoc(pdoc)
+		page, err := render(pdoc)
+		if err != nil {
+			t.Errorf("%d: render repaired package returned %v", i, err)
+		} else if !strings.Contains(page, "package pkg") {
+			t.Errorf("%d: repaired page does not contain the package clause", i)
+		}
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	for _, tt := range []struct {
+		path   string
+		parent interface{}
+		want   string
+	}{
+		{"example.com/src/pkg", "example.com/src", "pkg"},
+		{"example.com/src/a/b", "example.com/src/", "a/b"},
+		{"example.com/src", "example.com/src", "."},
+		{"example.com/srcfoo", "example.com/src", "example.com/srcfoo"},
+		{"example.com/srcfoo/pkg", "example.com/src", "example.com/srcfoo/pkg"},
+		{"example.com/süß/paket", "example.com/süß", "paket"},
+		{"example.com/süßwaren", "example.com/süß", "example.com/süßwaren"},
+		{"example.com/src/pkg", "", "example.com/src/pkg"},
+		{"example.com/src/pkg", nil, "example.com/src/pkg"},
+		{"example.com/src/vendor/github.com/baz/qux", "example.com/src", "github.com/baz/qux"},
+		{"example.com/src/vendor/a/vendor/b", "example.com/src", "b"},
+		{"example.com/src/vendor", "example.com/src", "vendor"},
+	} {
+		if got := relativePathFn(tt.path, tt.parent); got != tt.want {
+			t.Errorf("relativePath(%q, %v) = %q, want %q", tt.path, tt.parent, got, tt.want)
+		}
+	}
+}
+
+func TestVendoredPath(t *testing.T) {
+	for _, tt := range []struct {
+		path      string
+		canonical string
+		ok        bool
+	}{
+		{"github.com/foo/bar/vendor/github.com/baz/qux", "github.com/baz/qux", true},
+		{"github.com/foo/bar/vendor/a/vendor/github.com/baz/qux", "github.com/baz/qux", true},
+		{"vendor/golang.org/x/net/http2", "golang.org/x/net/http2", true},
+		{"github.com/foo/bar/vendor", "", false},
+		{"github.com/foo/bar/vendors/x", "", false},
+		{"github.com/foo/bar", "", false},
+	} {
+		canonical, ok := vendoredPath(tt.path)
+		if canonical != tt.canonical || ok != tt.ok {
+			t.Errorf("vendoredPath(%q) = %q, %v, want %q, %v", tt.path, canonical, ok, tt.canonical, tt.ok)
+		}
+	}
+}
+
+func TestVendoredCodeLinks(t *testing.T) {
+	code := doc.Code{
+		Text:        "qux.Client",
+		Annotations: []doc.Annotation{{Pos: 0, End: 3, Kind: doc.PackageLinkAnnotation, PathIndex: 0}},
+		Paths:       []string{"github.com/foo/bar/vendor/github.com/baz/qux"},
+	}
+	want := `<a href="/github.com/baz/qux" title="View canonical package github.com/baz/qux">qux</a>.Client`
+	if got := string(codeFn(code, nil)); got != want {
+		t.Errorf("codeFn() = %s, want %s", got, want)
+	}
+}
+
+func TestTrimPathPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		path, prefix, want string
+	}{
+		{"example.com/mono/a/b", "example.com/mono", "a/b"},
+		{"example.com/mono/a/b/c/d", "example.com/mono", "a/b/c/d"},
+		{"example.com/mono/a/b/c/d/e", "example.com/mono", "a/…/d/e"},
+		{"example.com/mono/ä/ö/ü/ß/é", "example.com/mono", "ä/…/ß/é"},
+		{"example.com/mono", "example.com/mono", "."},
+		{"example.com/monolith/a/b/c/d/e", "example.com/mono", "example.com/monolith/a/b/c/d/e"},
+		{"example.com/other/a", "", "example.com/other/a"},
+	} {
+		if got := trimPathPrefixFn(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("trimPathPrefix(%q, %q) = %q, want %q", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestListingPaths(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"pkg.html", "common.html", "layout.html"},
+		{"importers.html", "common.html", "layout.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	pkgs := []database.Package{
+		{Path: "github.com/user/repo/pkg/internal/codec/v2/gen/proto"},
+		{Path: "github.com/user/repo/pkg/sub"},
+		{Path: "github.com/user/repository/app"},
+	}
+
+	page, err := RenderPackagePage(pdoc, "", &RenderOptions{Pkgs: pkgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<a href="/github.com/user/repo/pkg/internal/codec/v2/gen/proto" title="github.com/user/repo/pkg/internal/codec/v2/gen/proto">internal/…/gen/proto</a>`,
+		`<a href="/github.com/user/repo/pkg/sub" title="github.com/user/repo/pkg/sub">sub</a>`,
+		`title="github.com/user/repository/app">github.com/user/repository/app</a>`,
+	} {
+		if !bytes.Contains(page, []byte(s)) {
+			t.Errorf("directory listing does not contain %s", s)
+		}
+	}
+
+	page, err = RenderPackagePage(pdoc, "importers", &RenderOptions{
+		ViewData: map[string]interface{}{"pkgs": pkgs, "listing": listPackages(pkgs, pdoc.ProjectRoot)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`title="github.com/user/repo/pkg/internal/codec/v2/gen/proto">pkg/…/gen/proto</a>`,
+		`title="github.com/user/repo/pkg/sub">pkg/sub</a>`,
+		`title="github.com/user/repository/app">github.com/user/repository/app</a>`,
+	} {
+		if !bytes.Contains(page, []byte(s)) {
+			t.Errorf("importer listing does not contain %s", s)
+		}
+	}
+}
+
+func TestReadmeExamples(t *testing.T) {
+	parseTestTemplates(t)
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	pdoc := fragmentTestPackage()
+	pdoc.ReadmeExamples = []*doc.ReadmeExample{{
+		File: "README.md",
+		Line: 12,
+		Code: doc.Code{
+			Text:        "b := pkg.NewBuffer()\nb.Len()\nb.Reset()",
+			Annotations: []doc.Annotation{{Kind: doc.ExportLinkAnnotation, PathIndex: 0, Pos: 5, End: 18}},
+			Paths:       []string{"github.com/user/repo/pkg"},
+		},
+	}}
+
+	if hasExamplesFn(pdoc) {
+		t.Errorf("hasExamples counts README examples without the count_readme_examples flag")
+	}
+	defer func(v bool) { *countReadmeExamples = v }(*countReadmeExamples)
+	*countReadmeExamples = true
+	if !hasExamplesFn(pdoc) {
+		t.Errorf("hasExamples does not count README examples with the count_readme_examples flag")
+	}
+	*countReadmeExamples = false
+
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "pkg.html", 200, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+		t.Fatal(err)
+	}
+	page := resp.buf.String()
+	for _, want := range []string{
+		`<h3 id="_examples">Examples</h3>`,
+		`<a href="#_example_readme"`,
+		`<div class="accordian" id="_example_readme">`,
+		`<div id="_ex_readme-1" class="accordion-body collapse">`,
+		`Example (from README.md)`,
+		`From line 12 of README.md.`,
+		`<a href="/github.com/user/repo/pkg#NewBuffer">pkg.NewBuffer</a>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+	if strings.Contains(page, `<a href="#_examples">Examples</a>`) {
+		t.Errorf("page navigation links to examples for a package with README examples only")
+	}
+}
+
+func TestFieldAnchors(t *testing.T) {
+	code := doc.Code{
+		Text: "type Client struct {\n    Timeout int\n    Close   bool\n    retries int\n}",
+		Annotations: []doc.Annotation{
+			{Pos: 25, End: 32, Kind: doc.AnchorAnnotation},
+			{Pos: 41, End: 46, Kind: doc.AnchorAnnotation},
+			{Pos: 58, End: 65, Kind: doc.AnchorAnnotation},
+		},
+	}
+	typ := &doc.Type{Name: "Client", Methods: []*doc.Func{{Name: "Close"}}}
+	want := "type Client struct {\n    <span id=\"Client.Timeout\">Timeout</span> int\n    Close   bool\n    retries int\n}"
+	if got := string(codeFn(code, typ)); got != want {
+		t.Errorf("codeFn() = %s, want %s", got, want)
+	}
+}
+
+func TestExampleOutputAndPlay(t *testing.T) {
+	for _, tt := range []struct {
+		e    doc.Example
+		want []string
+		not  []string
+	}{
+		{
+			doc.Example{Output: "a < b", Play: "package main\n\nfunc main() {}\n"},
+			[]string{`<div class="example-output"><p>Output:<pre class="pre-x-scrollable">a &lt; b</pre></div>`, `<textarea class="example-play hide" readonly>package main`},
+			nil,
+		},
+		{
+			doc.Example{Output: "x", Unordered: true},
+			[]string{"Unordered output:"},
+			[]string{"example-play"},
+		},
+		{
+			doc.Example{},
+			nil,
+			[]string{"example-output", "example-play"},
+		},
+	} {
+		s := string(exampleFn(&tt.e))
+		for _, w := range tt.want {
+			if !strings.Contains(s, w) {
+				t.Errorf("exampleFn(%+v) = %s, want %s", tt.e, s, w)
+			}
+		}
+		for _, n := range tt.not {
+			if strings.Contains(s, n) {
+				t.Errorf("exampleFn(%+v) = %s, want no %s", tt.e, s, n)
+			}
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	for _, tt := range []struct {
+		text    string
+		matches []database.Match
+		want    string
+	}{
+		{"Reads <b> & writes.", nil, "Reads &lt;b&gt; &amp; writes."},
+		{"Reads <b> & writes.", []database.Match{{Start: 0, End: 5}, {Start: 12, End: 18}}, "<b>Reads</b> &lt;b&gt; &amp; <b>writes</b>."},
+		{"日本語のテキスト", []database.Match{{Start: 0, End: 9}}, "<b>日本語</b>のテキスト"},
+		{"日本語", []database.Match{{Start: 1, End: 3}, {Start: 3, End: 6}}, "日<b>本</b>語"},
+		{"abc", []database.Match{{Start: 1, End: 2}, {Start: 0, End: 1}, {Start: 2, End: 9}}, "a<b>b</b>c"},
+	} {
+		if got := string(highlightFn(tt.text, tt.matches)); got != tt.want {
+			t.Errorf("highlight(%q, %v) = %q, want %q", tt.text, tt.matches, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+var stopWordsPath = flag.String("stop-words", "", "Path to file listing words dropped from search queries, one per line. The words are not dropped when building the search index. The file is reloaded on SIGHUP.")
+
+// stopWordQueryMessage is shown for queries that contain only stop words.
+const stopWordQueryMessage = "The query contains only common words. Add a more specific word to the query."
+
+// defaultTermStatsLimit is the number of terms returned by the term
+// statistics endpoint when the request does not specify a limit.
+const defaultTermStatsLimit = 100
+
+// loadStopWords sets the query stop words from the file at path. Blank
+// lines and lines starting with # are ignored.
+func loadStopWords(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var words []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	database.SetQueryStopWords(words)
+	return nil
+}
+
+// serveTermStats serves the search terms with the prefix parameter and the
+// number of packages with each term to administrators. The limit parameter
+// sets the maximum number of terms. A limit of 0 returns all terms.
+func serveTermStats(resp web.Response, req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	limit := defaultTermStatsLimit
+	if s := req.Form.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return &web.Error{Status: web.StatusBadRequest}
+		}
+	}
+	stats, err := db.TermStats(strings.ToLower(req.Form.Get("prefix")), limit)
+	if err != nil {
+		return err
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(map[string]interface{}{"terms": stats})
+}
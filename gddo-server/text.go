@@ -0,0 +1,397 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	godoc "go/doc"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+const (
+	defaultTextWidth = 80
+	minTextWidth     = 40
+	maxTextWidth     = 200
+)
+
+// textWidth returns the line width for the width request parameter.
+func textWidth(s string) int {
+	n, err := strconv.Atoi(s)
+	switch {
+	case err != nil:
+		return defaultTextWidth
+	case n < minTextWidth:
+		return minTextWidth
+	case n > maxTextWidth:
+		return maxTextWidth
+	}
+	return n
+}
+
+// textWriter writes documentation in the format of the go doc command.
+type textWriter struct {
+	buf   bytes.Buffer
+	pdoc  *doc.Package
+	width int
+	src   bool
+}
+
+func (w *textWriter) comment(s string) {
+	const indent = "    "
+	godoc.ToText(&w.buf, s, indent, indent+"\t", w.width-len(indent))
+}
+
+// summary writes the first line of a declaration. The remaining lines of a
+// multi-line declaration are elided.
+func (w *textWriter) summary(indent string, decl doc.Code) {
+	text := decl.Text
+	if i := strings.Index(text, "\n"); i >= 0 {
+		text = strings.TrimRight(text[:i], " ")
+		switch {
+		case strings.HasSuffix(text, "{"):
+			text += " ... }"
+		case strings.HasSuffix(text, "("):
+			text += " ... )"
+		default:
+			text += " ..."
+		}
+	}
+	w.buf.WriteString(indent)
+	w.buf.WriteString(text)
+	w.buf.WriteByte('\n')
+}
+
+// decl writes a declaration and its comment.
+func (w *textWriter) decl(decl doc.Code, pos doc.Pos, comment string) {
+	w.buf.WriteString(decl.Text)
+	w.buf.WriteByte('\n')
+	if w.src && validFilePos(w.pdoc, pos) {
+		fmt.Fprintf(&w.buf, "    // "+w.pdoc.LineFmt+"\n", w.pdoc.Files[pos.File].URL, pos.Line)
+	}
+	w.comment(comment)
+	w.buf.WriteByte('\n')
+}
+
+func (w *textWriter) header() {
+	if w.pdoc.IsCmd {
+		fmt.Fprintf(&w.buf, "command %s // import %q\n\n", w.pdoc.Name, w.pdoc.ImportPath)
+	} else {
+		fmt.Fprintf(&w.buf, "package %s // import %q\n\n", w.pdoc.Name, w.pdoc.ImportPath)
+	}
+	w.comment(w.pdoc.Doc)
+	w.buf.WriteByte('\n')
+}
+
+// packageSummary writes the package comment and a one line summary of each
+// exported declaration.
+func (w *textWriter) packageSummary() {
+	w.header()
+	if w.pdoc.IsCmd {
+		return
+	}
+	for _, v := range w.pdoc.Consts {
+		w.summary("", v.Decl)
+	}
+	for _, v := range w.pdoc.Vars {
+		w.summary("", v.Decl)
+	}
+	funcs, groups := doc.IndexGroups(w.pdoc)
+	for _, f := range funcs {
+		w.summary("", f.Decl)
+	}
+	for _, g := range groups {
+		w.summary("", g.Type.Decl)
+		for _, f := range g.Funcs {
+			w.summary("    ", f.Decl)
+		}
+	}
+}
+
+// packageAll writes all declarations in the package with their comments.
+func (w *textWriter) packageAll() {
+	w.header()
+	for _, v := range w.pdoc.Consts {
+		w.decl(v.Decl, v.Pos, v.Doc)
+	}
+	for _, v := range w.pdoc.Vars {
+		w.decl(v.Decl, v.Pos, v.Doc)
+	}
+	funcs, groups := doc.IndexGroups(w.pdoc)
+	for _, f := range funcs {
+		w.decl(f.Decl, f.Pos, f.Doc)
+	}
+	for _, g := range groups {
+		w.typeAll(g)
+	}
+}
+
+func (w *textWriter) typeAll(g *doc.IndexGroup) {
+	t := g.Type
+	w.decl(t.Decl, t.Pos, t.Doc)
+	for _, v := range t.Consts {
+		w.decl(v.Decl, v.Pos, v.Doc)
+	}
+	for _, v := range t.Vars {
+		w.decl(v.Decl, v.Pos, v.Doc)
+	}
+	for _, f := range g.Funcs {
+		w.decl(f.Decl, f.Pos, f.Doc)
+	}
+	for _, f := range g.Methods {
+		w.decl(f.Decl, f.Pos, f.Doc)
+	}
+}
+
+// declaration writes the declaration with the given anchor. A type is
+// written with a summary of the associated declarations or, if all is set,
+// with the associated declarations and their comments.
+func (w *textWriter) declaration(anchor string, all bool) bool {
+	for _, f := range w.pdoc.Funcs {
+		if doc.AnchorID(doc.DeclAnchor, f.Name) == anchor {
+			w.decl(f.Decl, f.Pos, f.Doc)
+			return true
+		}
+	}
+	_, groups := doc.IndexGroups(w.pdoc)
+	for _, g := range groups {
+		t := g.Type
+		if doc.AnchorID(doc.DeclAnchor, t.Name) == anchor {
+			if all {
+				w.typeAll(g)
+				return true
+			}
+			w.decl(t.Decl, t.Pos, t.Doc)
+			for _, v := range t.Consts {
+				w.summary("", v.Decl)
+			}
+			for _, v := range t.Vars {
+				w.summary("", v.Decl)
+			}
+			for _, f := range g.Funcs {
+				w.summary("", f.Decl)
+			}
+			for _, f := range g.Methods {
+				w.summary("", f.Decl)
+			}
+			return true
+		}
+		for _, f := range t.Funcs {
+			if doc.AnchorID(doc.DeclAnchor, f.Name) == anchor {
+				w.decl(f.Decl, f.Pos, f.Doc)
+				return true
+			}
+		}
+		for _, f := range t.Methods {
+			if doc.AnchorID(doc.DeclAnchor, t.Name, f.Name) == anchor {
+				w.decl(f.Decl, f.Pos, f.Doc)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveAPIText serves package documentation in the text format of the go
+// doc command. The optional anchor selects a single declaration. The
+// package with the default width and without source links is served from
+// the text stored when the package was crawled.
+func serveAPIText(resp web.Response, req *web.Request) error {
+	all := req.Form.Get("all") != ""
+	anchor := req.Form.Get("anchor")
+	stored := anchor == "" && req.Form.Get("src") == "" && textWidth(req.Form.Get("width")) == defaultTextWidth
+	if stored {
+		if ok, err := serveStoredText(resp, req, all); ok || err != nil {
+			return err
+		}
+	}
+	return servePackageAPI(resp, req, func(pdoc *doc.Package) (web.Header, []byte, error) {
+		header := web.Header{web.HeaderContentType: {"text/plain; charset=utf-8"}}
+		if stored {
+			t, err := db.GetText(pdoc.ImportPath)
+			if err != nil {
+				log.Printf("ERROR db.GetText(%q): %v", pdoc.ImportPath, err)
+			}
+			return header, packageText(pdoc, t, all), nil
+		}
+		w := &textWriter{
+			pdoc:  pdoc,
+			width: textWidth(req.Form.Get("width")),
+			src:   req.Form.Get("src") != "",
+		}
+		if anchor != "" {
+			anchor, ok := doc.ResolveScopedAnchor(pdoc, req.Form.Get("type"), anchor)
+			if !ok || !w.declaration(anchor, all) {
+				return nil, nil, nil
+			}
+		} else if all {
+			w.packageAll()
+		} else {
+			w.packageSummary()
+		}
+		return header, w.buf.Bytes(), nil
+	})
+}
+
+// serveStoredText serves the stored text for the package in the path route
+// variable without loading the package. The text is not served if it was not
+// rendered from the stored documentation by the current renderer or if the
+// request waits for a change to the package. The result is true if the
+// response was written.
+func serveStoredText(resp web.Response, req *web.Request, all bool) (bool, error) {
+	importPath := req.RouteVars["path"]
+	t, err := db.GetText(importPath)
+	if err != nil {
+		log.Printf("ERROR db.GetText(%q): %v", importPath, err)
+		return false, nil
+	}
+	if t == nil || t.Etag == "" || t.Version < textRenderVersion {
+		return false, nil
+	}
+	if etagMatches(req.Header.Get(web.HeaderIfNoneMatch), quoteETag(t.Etag)) {
+		if pollWait(req.Form.Get("wait")) != 0 {
+			return false, nil
+		}
+		return true, notModified(resp, t.Etag)
+	}
+	p := t.Summary
+	if all {
+		p = t.All
+	}
+	header := web.Header{
+		web.HeaderContentType: {"text/plain; charset=utf-8"},
+		web.HeaderETag:        {quoteETag(t.Etag)},
+	}
+	_, err = resp.Start(web.StatusOK, header).Write(p)
+	return true, err
+}
+
+// textRenderVersion is the version of the text renderer. Increment the
+// version when the output of textWriter changes. Text stored by an older
+// version is rendered again by the backfill job.
+const textRenderVersion = 2
+
+// maxStoredText is the maximum size of a stored text rendering.
+const maxStoredText = 512 * 1024
+
+const truncatedTextMarker = "\n... documentation truncated; request a declaration with /txt/<anchor> ...\n"
+
+// renderText renders the package summary or, if all is set, the package
+// with all declarations at the default width. The text is truncated to the
+// size of stored text so that stored and on the fly renderings are the
+// same.
+func renderText(pdoc *doc.Package, all bool) []byte {
+	w := &textWriter{pdoc: pdoc, width: defaultTextWidth}
+	if all {
+		w.packageAll()
+	} else {
+		w.packageSummary()
+	}
+	return truncateText(w.buf.Bytes(), maxStoredText)
+}
+
+// truncateText truncates p at a line boundary so that p with the truncation
+// marker fits in n bytes.
+func truncateText(p []byte, n int) []byte {
+	if len(p) <= n {
+		return p
+	}
+	p = p[:n-len(truncatedTextMarker)]
+	if i := bytes.LastIndex(p, []byte{'\n'}); i >= 0 {
+		p = p[:i]
+	}
+	q := make([]byte, 0, len(p)+len(truncatedTextMarker))
+	q = append(q, p...)
+	return append(q, truncatedTextMarker...)
+}
+
+// newStoredText renders the text stored for pdoc.
+func newStoredText(pdoc *doc.Package, version int) *database.Text {
+	return &database.Text{
+		Version: version,
+		Updated: pdoc.Updated,
+		Summary: renderText(pdoc, false),
+		All:     renderText(pdoc, true),
+	}
+}
+
+// packageText returns the stored text t for pdoc if t was rendered from the
+// current version of pdoc by the current renderer. Otherwise, the text is
+// rendered on the fly.
+func packageText(pdoc *doc.Package, t *database.Text, all bool) []byte {
+	if t == nil || t.Version < textRenderVersion || t.Updated.Unix() != pdoc.Updated.Unix() {
+		return renderText(pdoc, all)
+	}
+	if all {
+		return t.All
+	}
+	return t.Summary
+}
+
+// textStore is the subset of the database used to store text renderings.
+type textStore interface {
+	GetDoc(path string) (*doc.Package, time.Time, error)
+	PutText(path string, t *database.Text) error
+	StaleText(version, n int) ([]string, error)
+}
+
+// storeText renders and stores the text for the package with the given
+// import path. The package is read from the database so that the text
+// matches the stored documentation.
+func storeText(store textStore, path string, version int) error {
+	pdoc, _, err := store.GetDoc(path)
+	if err != nil || pdoc == nil {
+		return err
+	}
+	return store.PutText(path, newStoredText(pdoc, version))
+}
+
+// backfillTextBatch renders the text for up to n packages with text stored
+// by an older renderer. The function sleeps for delay after each package to
+// leave the database to the requests. The number of rendered packages is
+// returned.
+func backfillTextBatch(store textStore, version, n int, delay time.Duration) (int, error) {
+	paths, err := store.StaleText(version, n)
+	if err != nil {
+		return 0, err
+	}
+	for i, path := range paths {
+		if err := storeText(store, path, version); err != nil {
+			return i, err
+		}
+		time.Sleep(delay)
+	}
+	return len(paths), nil
+}
+
+// backfillText renders stale text in the background at low priority.
+func backfillText() {
+	for {
+		n, err := backfillTextBatch(db, textRenderVersion, 100, 100*time.Millisecond)
+		if err != nil {
+			log.Printf("ERROR backfilling text: %v", err)
+		}
+		if n == 0 {
+			time.Sleep(10 * time.Minute)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+)
+
+var textWidthTests = []struct {
+	s string
+	n int
+}{
+	{"", defaultTextWidth},
+	{"x", defaultTextWidth},
+	{"10", minTextWidth},
+	{"100", 100},
+	{"1000", maxTextWidth},
+}
+
+func TestTextWidth(t *testing.T) {
+	for _, tt := range textWidthTests {
+		if n := textWidth(tt.s); n != tt.n {
+			t.Errorf("textWidth(%q) = %d, want %d", tt.s, n, tt.n)
+		}
+	}
+}
+
+func TestPackageSummaryText(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	pdoc.Doc = "Package pkg does things.\n"
+	pdoc.Consts = []*doc.Value{{Decl: doc.Code{Text: "const (\n    A = 1\n    B = 2\n)"}}}
+	w := &textWriter{pdoc: pdoc, width: 80}
+	w.packageSummary()
+	const want = `package pkg // import "github.com/user/repo/pkg"
+
+    Package pkg does things.
+
+const ( ... )
+func Copy(dst io.Writer, src io.Reader) Buffer
+type Buffer struct{}
+`
+	if s := w.buf.String(); s != want {
+		t.Errorf("packageSummary() = %q, want %q", s, want)
+	}
+}
+
+var declarationTextTests = []struct {
+	anchor string
+	all    bool
+	text   string
+}{
+	{"Copy", false, "func Copy(dst io.Writer, src io.Reader) Buffer\n" +
+		"    Copy copies src to dst. See package github.com/user/other for more.\n\n"},
+	{"Buffer.Len", false, "func (b *Buffer) Len() int\n    Len returns the length.\n\n"},
+	{"Buffer", false, "type Buffer struct{}\n    Buffer is a buffer.\n\nfunc (b *Buffer) Len() int\n"},
+	{"Buffer", true, "type Buffer struct{}\n    Buffer is a buffer.\n\n" +
+		"func (b *Buffer) Len() int\n    Len returns the length.\n\n"},
+}
+
+func TestDeclarationText(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	for _, tt := range declarationTextTests {
+		w := &textWriter{pdoc: pdoc, width: 80}
+		if !w.declaration(tt.anchor, tt.all) {
+			t.Errorf("declaration(%q, %v) not found", tt.anchor, tt.all)
+			continue
+		}
+		if s := w.buf.String(); s != tt.text {
+			t.Errorf("declaration(%q, %v) = %q, want %q", tt.anchor, tt.all, s, tt.text)
+		}
+	}
+
+	w := &textWriter{pdoc: pdoc, width: 80}
+	if w.declaration("Missing", false) {
+		t.Errorf("declaration(Missing) found")
+	}
+}
+
+func TestStoredText(t *testing.T) {
+	pdoc := fragmentTestPackage()
+	pdoc.Updated = time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)
+	stored := newStoredText(pdoc, textRenderVersion)
+
+	for _, all := range []bool{false, true} {
+		fly := packageText(pdoc, nil, all)
+		if p := packageText(pdoc, stored, all); !bytes.Equal(p, fly) {
+			t.Errorf("all=%v: stored text %q differs from rendered text %q", all, p, fly)
+		}
+	}
+
+	// Stored text from an older renderer or for an older version of the
+	// package is not served.
+	marker := []byte("stale")
+	for _, st := range []database.Text{
+		{Version: textRenderVersion - 1, Updated: pdoc.Updated, Summary: marker},
+		{Version: textRenderVersion, Updated: pdoc.Updated.Add(-time.Hour), Summary: marker},
+	} {
+		if p := packageText(pdoc, &st, false); bytes.Equal(p, marker) {
+			t.Errorf("stale text served for version %d, updated %v", st.Version, st.Updated)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	var buf bytes.Buffer
+	for buf.Len() < 1000 {
+		buf.WriteString("func F() int\n")
+	}
+	p := truncateText(buf.Bytes(), 200)
+	if len(p) > 200 {
+		t.Errorf("len(truncateText()) = %d, want <= 200", len(p))
+	}
+	if !bytes.HasSuffix(p, []byte(truncatedTextMarker)) {
+		t.Errorf("truncated text does not end with marker: %q", p)
+	}
+	if s := strings.TrimSuffix(string(p), truncatedTextMarker); strings.TrimSuffix(s, "func F() int") == s {
+		t.Errorf("truncated text does not end at a line boundary: %q", s)
+	}
+	if p := truncateText([]byte("short\n"), 200); string(p) != "short\n" {
+		t.Errorf("short text truncated to %q", p)
+	}
+}
+
+// memoryTextStore is a textStore for testing the backfill.
+type memoryTextStore struct {
+	pdocs map[string]*doc.Package
+	texts map[string]*database.Text
+}
+
+func (s *memoryTextStore) GetDoc(path string) (*doc.Package, time.Time, error) {
+	return s.pdocs[path], time.Time{}, nil
+}
+
+func (s *memoryTextStore) PutText(path string, t *database.Text) error {
+	s.texts[path] = t
+	return nil
+}
+
+func (s *memoryTextStore) StaleText(version, n int) ([]string, error) {
+	var paths []string
+	for path, t := range s.texts {
+		if t.Version < version && len(paths) < n {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func TestBackfillText(t *testing.T) {
+	store := &memoryTextStore{pdocs: make(map[string]*doc.Package), texts: make(map[string]*database.Text)}
+	for _, path := range []string{"a", "b", "c"} {
+		pdoc := fragmentTestPackage()
+		pdoc.ImportPath = path
+		store.pdocs[path] = pdoc
+		if err := storeText(store, path, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := backfillTextBatch(store, 1, 10, 0); err != nil || n != 0 {
+		t.Errorf("backfill at stored version = %d, %v, want 0", n, err)
+	}
+
+	// Bumping the version renders all packages again.
+	if n, err := backfillTextBatch(store, 2, 2, 0); err != nil || n != 2 {
+		t.Errorf("first backfill batch = %d, %v, want 2", n, err)
+	}
+	if n, err := backfillTextBatch(store, 2, 2, 0); err != nil || n != 1 {
+		t.Errorf("second backfill batch = %d, %v, want 1", n, err)
+	}
+	for path, st := range store.texts {
+		if st.Version != 2 {
+			t.Errorf("%s version = %d, want 2", path, st.Version)
+		}
+		if !bytes.Equal(st.All, renderText(store.pdocs[path], true)) {
+			t.Errorf("%s backfilled text differs from rendered text", path)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	htemp "html/template"
+	"io"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/garyburd/indigo/web"
+)
+
+// renderBuckets are the upper bounds of the render time histogram buckets.
+// The last bucket counts render times greater than the last bound.
+var renderBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// renderHistogram is a histogram of template render times. The histogram
+// is published as an expvar.
+type renderHistogram struct {
+	mu     sync.Mutex
+	counts []int64
+	count  int64
+	total  time.Duration
+}
+
+func (h *renderHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]int64, len(renderBuckets)+1)
+	}
+	i := sort.Search(len(renderBuckets), func(i int) bool { return d <= renderBuckets[i] })
+	h.counts[i]++
+	h.count++
+	h.total += d
+}
+
+func (h *renderHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"count": %d, "totalMs": %d, "buckets": {`, h.count, h.total/time.Millisecond)
+	for i, n := range h.counts {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		if i < len(renderBuckets) {
+			fmt.Fprintf(&buf, `"%d": %d`, renderBuckets[i]/time.Millisecond, n)
+		} else {
+			fmt.Fprintf(&buf, `"inf": %d`, n)
+		}
+	}
+	buf.WriteString("}}")
+	return buf.String()
+}
+
+var (
+	renderMutex sync.Mutex
+	renderTimes = expvar.NewMap("templateRenderTimes")
+)
+
+// recordRenderTime adds a template render time to the template's histogram.
+func recordRenderTime(name string, d time.Duration) {
+	renderMutex.Lock()
+	h, _ := renderTimes.Get(name).(*renderHistogram)
+	if h == nil {
+		h = &renderHistogram{}
+		renderTimes.Set(name, h)
+	}
+	renderMutex.Unlock()
+	h.observe(d)
+}
+
+// isAdmin returns true if the request has the administrator cookie.
+func isAdmin(req *web.Request) bool {
+	return secrets.AdminKey != "" &&
+		subtle.ConstantTimeCompare([]byte(req.Cookie.Get("admin")), []byte(secrets.AdminKey)) == 1
+}
+
+// adminToken returns the token that administrator forms include in POST
+// requests. The token is derived from the administrator cookie so that a
+// page on another site cannot compute it.
+func adminToken(req *web.Request) string {
+	h := hmac.New(sha1.New, []byte(req.Cookie.Get("admin")))
+	h.Write([]byte("csrf"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sameOrigin returns false if the Origin or Referer header of the request
+// names a host other than the request host.
+func sameOrigin(req *web.Request) bool {
+	s := req.Header.Get("Origin")
+	if s == "" {
+		s = req.Header.Get("Referer")
+	}
+	if s == "" {
+		return true
+	}
+	u, err := url.Parse(s)
+	return err == nil && req.URL != nil && u.Host == req.URL.Host
+}
+
+// checkAdminPost returns an error unless the POST request is from an
+// administrator, is not cross-origin and has the token from adminToken in
+// the csrf form field or the X-CSRF-Token header.
+func checkAdminPost(req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	token := req.Form.Get("csrf")
+	if token == "" {
+		token = req.Header.Get("X-CSRF-Token")
+	}
+	if !sameOrigin(req) || !hmac.Equal([]byte(token), []byte(adminToken(req))) {
+		return &web.Error{Status: web.StatusForbidden}
+	}
+	return nil
+}
+
+// isTraceRequest returns true if template funcs should be traced for the
+// request.
+func isTraceRequest(req *web.Request) bool {
+	return req != nil && req.Form.Get("trace") == "1" && isAdmin(req)
+}
+
+type funcTiming struct {
+	calls int
+	total time.Duration
+}
+
+// funcTrace accumulates the time spent in template funcs while executing a
+// template for a request. A template is executed on a single goroutine, so
+// funcTrace does not need a lock.
+type funcTrace map[string]*funcTiming
+
+// instrumentFuncs returns a copy of funcs with each func wrapped to record
+// calls and elapsed time in tr.
+func instrumentFuncs(funcs htemp.FuncMap, tr funcTrace) htemp.FuncMap {
+	result := make(htemp.FuncMap, len(funcs))
+	for name, f := range funcs {
+		name := name
+		fv := reflect.ValueOf(f)
+		result[name] = reflect.MakeFunc(fv.Type(), func(args []reflect.Value) []reflect.Value {
+			start := time.Now()
+			var out []reflect.Value
+			if fv.Type().IsVariadic() {
+				out = fv.CallSlice(args)
+			} else {
+				out = fv.Call(args)
+			}
+			t := tr[name]
+			if t == nil {
+				t = &funcTiming{}
+				tr[name] = t
+			}
+			t.calls++
+			t.total += time.Since(start)
+			return out
+		}).Interface()
+	}
+	return result
+}
+
+type byTotal struct {
+	names []string
+	tr    funcTrace
+}
+
+func (p byTotal) Len() int      { return len(p.names) }
+func (p byTotal) Swap(i, j int) { p.names[i], p.names[j] = p.names[j], p.names[i] }
+func (p byTotal) Less(i, j int) bool {
+	ti, tj := p.tr[p.names[i]].total, p.tr[p.names[j]].total
+	if ti != tj {
+		return ti > tj
+	}
+	return p.names[i] < p.names[j]
+}
+
+// String returns the trace with one line per func, ordered by decreasing
+// total time.
+func (tr funcTrace) String() string {
+	var names []string
+	for name := range tr {
+		names = append(names, name)
+	}
+	sort.Sort(byTotal{names, tr})
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s calls=%d time=%v\n", name, tr[name].calls, tr[name].total)
+	}
+	return buf.String()
+}
+
+// traceTemplates holds copies of the HTML templates that are never executed.
+// An executed html/template cannot be cloned, so traced requests execute
+// clones of these copies with instrumented funcs.
+var traceTemplates = map[string]*htemp.Template{}
+
+// executeTraceTemplate executes the named HTML template with instrumented
+// funcs. The func timings are appended to the page as an HTML comment and
+// logged.
+func executeTraceTemplate(w io.Writer, name string, data interface{}) error {
+	t := traceTemplates[name]
+	if t == nil {
+		return fmt.Errorf("Template %s not found", name)
+	}
+	t, err := t.Clone()
+	if err != nil {
+		return err
+	}
+	tr := make(funcTrace)
+	t.Funcs(instrumentFuncs(htmlTemplateFuncs(name), tr))
+	t = t.Lookup("ROOT")
+	if t == nil {
+		return fmt.Errorf("ROOT template not found in %s", name)
+	}
+	start := time.Now()
+	if err := t.Execute(w, data); err != nil {
+		return err
+	}
+	s := fmt.Sprintf("trace %s %v\n%s", name, time.Since(start), tr)
+	log.Print(s)
+	_, err = io.WriteString(w, "\n"+string(htmlCommentFn(s))+"\n")
+	return err
+}
+
+// serveDebugVars serves the published expvars to administrators.
+func serveDebugVars(resp web.Response, req *web.Request) error {
+	if !isAdmin(req) {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	io.WriteString(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			io.WriteString(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	_, err := io.WriteString(w, "\n}\n")
+	return err
+}
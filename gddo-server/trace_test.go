@@ -0,0 +1,134 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/indigo/web"
+)
+
+var traceTests = []struct {
+	form   url.Values
+	cookie url.Values
+	trace  bool
+}{
+	{url.Values{}, url.Values{"admin": {"key"}}, false},
+	{url.Values{"trace": {"1"}}, url.Values{}, false},
+	{url.Values{"trace": {"1"}}, url.Values{"admin": {"wrong"}}, false},
+	{url.Values{"trace": {"1"}}, url.Values{"admin": {"key"}}, true},
+}
+
+func TestTrace(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{{"pkg.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+
+	for _, tt := range traceTests {
+		req := &web.Request{Form: tt.form, Cookie: tt.cookie}
+		var resp testResponse
+		if err := executeTemplate(&resp, req, "pkg.html", 200, nil, map[string]interface{}{"pdoc": fragmentTestPackage()}); err != nil {
+			t.Fatal(err)
+		}
+		page := resp.buf.String()
+		if strings.Contains(page, "<!-- trace pkg.html") != tt.trace {
+			t.Errorf("form %v, cookie %v: trace comment present = %v, want %v", tt.form, tt.cookie, !tt.trace, tt.trace)
+		}
+		if !tt.trace {
+			continue
+		}
+		// The package page calls code and comment for each declaration.
+		// The fixture package has no notes.
+		for _, name := range []string{"code", "comment"} {
+			if !strings.Contains(page, "\n"+name+" calls=") {
+				t.Errorf("trace does not contain %s", name)
+			}
+		}
+		if strings.Contains(page, "\nnoteTitle calls=") {
+			t.Errorf("trace contains noteTitle, but noteTitle was not called")
+		}
+	}
+}
+
+func TestInstrumentFuncs(t *testing.T) {
+	tr := make(funcTrace)
+	funcs := instrumentFuncs(htmlTemplateFuncs("x"), tr)
+	if s := funcs["declAnchor"].(func(...string) string)("Buffer", "Len"); s != "Buffer.Len" {
+		t.Errorf("declAnchor(Buffer, Len) = %q, want %q", s, "Buffer.Len")
+	}
+	funcs["declAnchor"].(func(...string) string)("Buffer")
+	if s := funcs["templateName"].(func() string)(); s != "x" {
+		t.Errorf("templateName() = %q, want %q", s, "x")
+	}
+	if n := tr["declAnchor"].calls; n != 2 {
+		t.Errorf("declAnchor calls = %d, want 2", n)
+	}
+	if _, ok := tr["code"]; ok {
+		t.Errorf("code is in trace, but was not called")
+	}
+}
+
+func TestRenderHistogram(t *testing.T) {
+	var h renderHistogram
+	for _, d := range []time.Duration{time.Microsecond, 3 * time.Millisecond, 4 * time.Millisecond, 2 * time.Second} {
+		h.observe(d)
+	}
+	const want = `{"count": 4, "totalMs": 2007, "buckets": {"1": 1, "2": 0, "5": 2, "10": 0, "20": 0, "50": 0, "100": 0, "200": 0, "500": 0, "1000": 0, "inf": 1}}`
+	if s := h.String(); s != want {
+		t.Errorf("h.String() = %s, want %s", s, want)
+	}
+}
+
+func TestCheckAdminPost(t *testing.T) {
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "key"
+	admin := url.Values{"admin": {"key"}}
+	token := adminToken(&web.Request{Cookie: admin})
+	if other := adminToken(&web.Request{Cookie: url.Values{"admin": {"other"}}}); other == token {
+		t.Fatalf("tokens for different cookies are equal")
+	}
+
+	tests := []struct {
+		cookie url.Values
+		form   url.Values
+		header web.Header
+		status int
+	}{
+		{nil, url.Values{"csrf": {token}}, web.Header{}, web.StatusNotFound},
+		{admin, url.Values{}, web.Header{}, web.StatusForbidden},
+		{admin, url.Values{"csrf": {"bad"}}, web.Header{}, web.StatusForbidden},
+		{admin, url.Values{"csrf": {token}}, web.Header{"Origin": {"http://evil.example.com"}}, web.StatusForbidden},
+		{admin, url.Values{"csrf": {token}}, web.Header{"Referer": {"http://evil.example.com/page"}}, web.StatusForbidden},
+		{admin, url.Values{"csrf": {token}}, web.Header{}, 0},
+		{admin, url.Values{"csrf": {token}}, web.Header{"Origin": {"http://godoc.org"}}, 0},
+		{admin, url.Values{}, web.Header{"X-Csrf-Token": {token}, "Referer": {"http://godoc.org/-/reports"}}, 0},
+	}
+	for i, tt := range tests {
+		req := &web.Request{URL: &url.URL{Host: "godoc.org"}, Cookie: tt.cookie, Form: tt.form, Header: tt.header}
+		status := 0
+		if err := checkAdminPost(req); err != nil {
+			status = err.(*web.Error).Status
+		}
+		if status != tt.status {
+			t.Errorf("%d: checkAdminPost returned status %d, want %d", i, status, tt.status)
+		}
+	}
+}
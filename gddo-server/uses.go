@@ -0,0 +1,153 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/gddo/api"
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// declUse is the number of example and test functions in a package that
+// reference a declaration.
+type declUse struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Pointer     bool   `json:"pointer,omitempty"`
+	Anchor      string `json:"anchor"`
+	Text        string `json:"-"`
+	ExampleUses int    `json:"exampleUses"`
+	TestUses    int    `json:"testUses"`
+}
+
+// declUses returns the uses of the functions, types and methods in the
+// package in the order of the declaration index.
+func declUses(pdoc *doc.Package) []*declUse {
+	var uses []*declUse
+	funcs, groups := doc.IndexGroups(pdoc)
+	for _, f := range funcs {
+		uses = append(uses, &declUse{f.Name, "", false, declAnchorFn(f.Name), f.Decl.Text, f.ExampleUses, f.TestUses})
+	}
+	for _, g := range groups {
+		t := g.Type
+		uses = append(uses, &declUse{t.Name, "", false, declAnchorFn(t.Name), "type " + t.Name, t.ExampleUses, t.TestUses})
+		for _, f := range g.Funcs {
+			uses = append(uses, &declUse{f.Name, "", false, declAnchorFn(f.Name), f.Decl.Text, f.ExampleUses, f.TestUses})
+		}
+		for _, f := range g.Methods {
+			_, pointer := f.RecvType()
+			uses = append(uses, &declUse{f.Name, t.Name, pointer, declAnchorFn(t.Name, f.Name), f.Decl.Text, f.ExampleUses, f.TestUses})
+		}
+	}
+	return uses
+}
+
+// byExampleUses sorts declarations by decreasing example uses. Ties are
+// kept in declaration order.
+type byExampleUses struct {
+	uses  []*declUse
+	order map[*declUse]int
+}
+
+func (s byExampleUses) Len() int      { return len(s.uses) }
+func (s byExampleUses) Swap(i, j int) { s.uses[i], s.uses[j] = s.uses[j], s.uses[i] }
+func (s byExampleUses) Less(i, j int) bool {
+	a, b := s.uses[i], s.uses[j]
+	if a.ExampleUses != b.ExampleUses {
+		return a.ExampleUses > b.ExampleUses
+	}
+	return s.order[a] < s.order[b]
+}
+
+// declsByExampleUsesFn returns the declarations for the package index
+// ordered by use in the package examples.
+func declsByExampleUsesFn(pdoc *doc.Package) []*declUse {
+	uses := declUses(pdoc)
+	order := make(map[*declUse]int)
+	for i, u := range uses {
+		order[u] = i
+	}
+	sort.Sort(byExampleUses{uses, order})
+	return uses
+}
+
+// hasExampleUsesFn returns true if an example in the package references a
+// declaration.
+func hasExampleUsesFn(pdoc *doc.Package) bool {
+	for _, u := range declUses(pdoc) {
+		if u.ExampleUses > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// exampleUsesFn returns the note shown next to a declaration used in the
+// package examples.
+func exampleUsesFn(n int) string {
+	if n == 1 {
+		return "used in 1 example"
+	}
+	return "used in " + strconv.Itoa(n) + " examples"
+}
+
+// serveAPIUses serves the uses of the package declarations in the package
+// examples and tests as JSON. The view counts of the declarations are
+// included for clients authorized for the project.
+func serveAPIUses(resp web.Response, req *web.Request) error {
+	return servePackageAPI(resp, req, func(pdoc *doc.Package) (web.Header, []byte, error) {
+		var data struct {
+			Uses  []*declUse             `json:"uses"`
+			Views []database.AnchorViews `json:"views,omitempty"`
+		}
+		data.Uses = declUses(pdoc)
+		if declViews.store != nil && authorizedForProject(req, pdoc.ProjectRoot) {
+			views, err := declViews.store.TopViews(pdoc.ImportPath, time.Now(), 0)
+			if err != nil {
+				log.Printf("ERROR getting views for %q: %v", pdoc.ImportPath, err)
+			}
+			data.Views = views
+		}
+		p, err := json.Marshal(&data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}}, p, nil
+	})
+}
+
+// serveAPIIdentifiers serves the exported identifiers of a stored package.
+func serveAPIIdentifiers(resp web.Response, req *web.Request) error {
+	pdoc, _, err := db.GetDoc(req.RouteVars["path"])
+	if err != nil {
+		return err
+	}
+	if pdoc == nil {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	data := api.IdentifiersResponse{Identifiers: []api.Identifier{}}
+	for _, u := range declUses(pdoc) {
+		data.Identifiers = append(data.Identifiers, api.Identifier{Name: u.Name, Type: u.Type, Anchor: u.Anchor})
+	}
+	w := resp.Start(web.StatusOK, web.Header{web.HeaderContentType: {"application/json; charset=utf-8"}})
+	return json.NewEncoder(w).Encode(&data)
+}
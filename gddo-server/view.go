@@ -0,0 +1,208 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"html/template"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+// view is an alternate presentation of a package page selected by a query
+// parameter, as in /<path>?imports or /<path>?view=imports.
+type view struct {
+	// Name of the view. The name is also the query parameter that selects
+	// the view.
+	Name string
+
+	// Title is the label for the view in the package page tab bar.
+	Title string
+
+	// Template used to render the view.
+	Template string
+
+	// Tab is true if the view is listed in the package page tab bar.
+	Tab bool
+
+	// load returns the template data for the view. The package page
+	// fields "pdoc" and "view" are added to the data by the caller.
+	load func(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error)
+}
+
+// views is the registry of package page views.
+var views = []*view{
+	{
+		Name:     "imports",
+		Title:    "Imports",
+		Template: "imports.html",
+		Tab:      true,
+		load:     loadImports,
+	},
+	{
+		Name:     "importers",
+		Title:    "Importers",
+		Template: "importers.html",
+		Tab:      true,
+		load:     loadImporters,
+	},
+	{
+		Name:     "import-graph",
+		Title:    "Graph",
+		Template: "graph.html",
+		Tab:      true,
+		load:     loadImportGraph,
+	},
+	{
+		Name:     "diff",
+		Title:    "Changes",
+		Template: "diff.html",
+		load:     loadDiff,
+	},
+	{
+		Name:     "diagnostics",
+		Title:    "Diagnostics",
+		Template: "diagnostics.html",
+		load:     loadDiagnostics,
+	},
+	{
+		Name:     "schedule",
+		Title:    "Refresh schedule",
+		Template: "schedule.html",
+		load:     loadSchedule,
+	},
+	{
+		Name:     "gates",
+		Title:    "Fetch gates",
+		Template: "gates.html",
+		load:     loadFetchGates,
+	},
+	{
+		Name:     "history",
+		Title:    "History",
+		Template: "history.html",
+		load:     loadHistory,
+	},
+	{
+		Name:     "analytics",
+		Title:    "Declaration views",
+		Template: "analytics.html",
+		load:     loadAnalytics,
+	},
+}
+
+var (
+	viewsByName     = map[string]*view{}
+	viewsByTemplate = map[string]*view{}
+)
+
+func init() {
+	for _, v := range views {
+		viewsByName[v.Name] = v
+		viewsByTemplate[v.Template] = v
+	}
+}
+
+// findView returns the view selected by the request form. The function
+// returns nil, false if the form does not select a view. The function
+// returns nil, true if the form selects a view that is not registered.
+func findView(form map[string][]string) (v *view, selected bool) {
+	if names, ok := form["view"]; ok {
+		name := ""
+		if len(names) > 0 {
+			name = names[0]
+		}
+		return viewsByName[name], true
+	}
+	for _, v := range views {
+		if _, ok := form[v.Name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// tabViewsFn returns the views listed in the package page tab bar.
+func tabViewsFn() []*view {
+	var result []*view
+	for _, v := range views {
+		if v.Tab {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// isViewTemplate returns true if the template renders a registered view.
+func isViewTemplate(templateName string) bool {
+	return viewsByTemplate[templateName] != nil
+}
+
+func serveView(resp web.Response, req *web.Request, v *view, pdoc *doc.Package) error {
+	if pdoc.Name == "" {
+		return &web.Error{Status: web.StatusNotFound}
+	}
+	viewData, err := v.load(pdoc, req)
+	if err != nil {
+		return err
+	}
+	name, data := packagePage(pdoc, v, &RenderOptions{ViewData: viewData})
+	return executePackageTemplate(resp, req, name, pdoc, data)
+}
+
+func loadImports(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	pkgs, err := db.Packages(pdoc.Imports)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"pkgs": pkgs}, nil
+}
+
+// loadImporters loads the packages that import the package or, with the
+// tests parameter, the packages with tests that import the package.
+func loadImporters(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	get := db.Importers
+	tests := req.Form.Get("tests") == "1"
+	if tests {
+		get = db.TestImporters
+	}
+	pkgs, err := get(pdoc.ImportPath)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"pkgs": pkgs, "listing": listPackages(pkgs, pdoc.ProjectRoot), "tests": tests}, nil
+}
+
+func loadImportGraph(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	hide := req.Form.Get("hide") == "1"
+	g, err := getImportGraph(pdoc, hide)
+	if err != nil {
+		return nil, err
+	}
+	b, err := renderGraph(pdoc, g)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{
+		"svg":      template.HTML(b),
+		"hide":     hide,
+		"graph":    g,
+		"canQueue": isAdmin(req),
+	}
+	if data["canQueue"] == true {
+		data["csrf"] = adminToken(req)
+	}
+	return data, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var findViewTests = []struct {
+	query    string
+	name     string
+	selected bool
+}{
+	{"", "", false},
+	{"play=package", "", false},
+	{"imports", "imports", true},
+	{"importers", "importers", true},
+	{"import-graph&hide=1", "import-graph", true},
+	{"view=imports", "imports", true},
+	{"view=import-graph&hide=1", "import-graph", true},
+	{"view=unknown", "", true},
+	{"view=", "", true},
+}
+
+func TestFindView(t *testing.T) {
+	for _, tt := range findViewTests {
+		form, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, selected := findView(form)
+		name := ""
+		if v != nil {
+			name = v.Name
+		}
+		if name != tt.name || selected != tt.selected {
+			t.Errorf("findView(%q) = %q, %v; want %q, %v", tt.query, name, selected, tt.name, tt.selected)
+		}
+	}
+}
+
+type testResponse struct {
+	status int
+	header web.Header
+	buf    bytes.Buffer
+}
+
+func (r *testResponse) Start(status int, header web.Header) io.Writer {
+	r.status = status
+	r.header = header
+	return &r.buf
+}
+
+func parseTestTemplates(t *testing.T) {
+	*assetsDir = "assets"
+	if err := parseHTMLTemplates([][]string{
+		{"diff.html", "common.html", "layout.html"},
+		{"diagnostics.html", "common.html", "layout.html"},
+		{"importers.html", "common.html", "layout.html"},
+		{"imports.html", "common.html", "layout.html"},
+		{"schedule.html", "common.html", "layout.html"},
+		{"analytics.html", "common.html", "layout.html"},
+		{"gates.html", "common.html", "layout.html"},
+		{"history.html", "common.html", "layout.html"},
+		{"landing.html", "common.html", "layout.html"},
+		{"graph.html", "common.html"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeView(t *testing.T) {
+	parseTestTemplates(t)
+
+	pdoc := &doc.Package{
+		ImportPath:  "github.com/user/repo/pkg",
+		ProjectRoot: "github.com/user/repo",
+		ProjectName: "repo",
+		Name:        "pkg",
+	}
+
+	for _, v := range views {
+		loaded := false
+		saved := v.load
+		v.load = func(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+			loaded = true
+			return nil, nil
+		}
+		var resp testResponse
+		err := serveView(&resp, &web.Request{Form: url.Values{v.Name: {""}}}, v, pdoc)
+		v.load = saved
+		if err != nil {
+			t.Errorf("serveView(%s) returned error %v", v.Name, err)
+			continue
+		}
+		if !loaded {
+			t.Errorf("serveView(%s) did not invoke loader", v.Name)
+		}
+		if resp.status != web.StatusOK {
+			t.Errorf("serveView(%s) status = %d, want %d", v.Name, resp.status, web.StatusOK)
+		}
+		if !strings.Contains(resp.buf.String(), pdoc.Name) {
+			t.Errorf("serveView(%s) body does not contain package name", v.Name)
+		}
+	}
+}
+
+func TestServeViewDirectory(t *testing.T) {
+	err := serveView(&testResponse{}, &web.Request{}, views[0], &doc.Package{ImportPath: "github.com/user/repo"})
+	if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+		t.Errorf("serveView(directory) returned %v, want not found", err)
+	}
+}
+
+func TestBreadcrumbsView(t *testing.T) {
+	pdoc := &doc.Package{
+		ImportPath:  "github.com/user/repo/pkg",
+		ProjectRoot: "github.com/user/repo",
+	}
+	last := `<a href="/github.com/user/repo/pkg">`
+	for _, v := range views {
+		if s := string(breadcrumbsFn(pdoc, v.Template)); !strings.Contains(s, last) {
+			t.Errorf("breadcrumbs(%s) = %s, want link to package", v.Template, s)
+		}
+	}
+	if s := string(breadcrumbsFn(pdoc, "pkg.html")); strings.Contains(s, last) {
+		t.Errorf("breadcrumbs(pkg.html) = %s, want no link to package", s)
+	}
+}
+
+func TestBreadcrumbsVendored(t *testing.T) {
+	for _, tt := range []struct {
+		pdoc *doc.Package
+		want string
+	}{
+		{
+			&doc.Package{ImportPath: "github.com/foo/bar/vendor/github.com/baz/qux", ProjectRoot: "github.com/foo/bar"},
+			`<a href="/github.com/foo/bar">github.com/foo/bar</a>` +
+				`<span class="muted">/</span><a href="/github.com/foo/bar/vendor">vendor</a>` +
+				`<span class="muted">/</span><a href="/github.com/baz/qux" title="View canonical package">github.com/baz/qux</a>`,
+		},
+		{
+			&doc.Package{ImportPath: "github.com/foo/bar/vendor/a/vendor/b", ProjectRoot: "github.com/foo/bar"},
+			`<a href="/github.com/foo/bar">github.com/foo/bar</a>` +
+				`<span class="muted">/</span><a href="/github.com/foo/bar/vendor">vendor</a>` +
+				`<span class="muted">/</span><a href="/github.com/foo/bar/vendor/a">a</a>` +
+				`<span class="muted">/</span><a href="/github.com/foo/bar/vendor/a/vendor">vendor</a>` +
+				`<span class="muted">/</span><a href="/b" title="View canonical package">b</a>`,
+		},
+		{
+			&doc.Package{ImportPath: "github.com/foo/bar/vendor", ProjectRoot: "github.com/foo/bar"},
+			`<a href="/github.com/foo/bar">github.com/foo/bar</a>` +
+				`<span class="muted">/</span><span class="muted">vendor</span>`,
+		},
+	} {
+		if got := string(breadcrumbsFn(tt.pdoc, "pkg.html")); got != tt.want {
+			t.Errorf("breadcrumbs(%s) = %s, want %s", tt.pdoc.ImportPath, got, tt.want)
+		}
+	}
+}
+
+func TestRelativeImportsView(t *testing.T) {
+	parseTestTemplates(t)
+	pdoc := &doc.Package{
+		ImportPath:      "github.com/user/repo/pkg",
+		ProjectRoot:     "github.com/user/repo",
+		ProjectName:     "repo",
+		Name:            "pkg",
+		Imports:         []string{"io"},
+		RelativeImports: []string{"../common", "./util"},
+	}
+	var resp testResponse
+	if err := executeTemplate(&resp, nil, "imports.html", 200, nil, map[string]interface{}{"pdoc": pdoc}); err != nil {
+		t.Fatal(err)
+	}
+	page := resp.buf.String()
+	for _, s := range []string{"Relative imports (non-fetchable)", "<code>../common</code>", "<code>./util</code>"} {
+		if !strings.Contains(page, s) {
+			t.Errorf("imports page does not contain %q", s)
+		}
+	}
+	if strings.Contains(page, `href="/./util"`) || strings.Contains(page, `href="/../common"`) {
+		t.Errorf("imports page links to a relative import")
+	}
+
+	// Declarations stored before relative imports were excluded from
+	// links are rendered without the links.
+	code := doc.Code{
+		Text:  "func Copy(b util.Buffer) io.Reader",
+		Paths: []string{"./util", "io"},
+		Annotations: []doc.Annotation{
+			{Kind: doc.ExportLinkAnnotation, PathIndex: 0, Pos: 12, End: 23},
+			{Kind: doc.ExportLinkAnnotation, PathIndex: 1, Pos: 25, End: 34},
+		},
+	}
+	const want = `func Copy(b util.Buffer) <a href="/io#Reader">io.Reader</a>`
+	if s := string(codeFn(code, nil)); s != want {
+		t.Errorf("codeFn() = %s, want %s", s, want)
+	}
+}
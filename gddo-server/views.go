@@ -0,0 +1,217 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This file counts views of the documentation of declarations. A view is
+// counted when a package page is requested with a selected declaration or
+// when the HTML fragment of a declaration is requested. Counts are
+// accumulated in memory and written to the database in batches. Project
+// authors and administrators see the most viewed declarations on the
+// analytics view of the package page.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/indigo/web"
+)
+
+var viewFlushInterval = flag.Duration("view_flush_interval", time.Minute, "Time between writes of declaration view counts to the database.")
+
+const (
+	// maxPendingViews is the maximum number of package and anchor pairs
+	// counted between writes to the database. Views of other pairs are
+	// dropped until the next write.
+	maxPendingViews = 10000
+
+	// maxAnalyticsViews is the number of declarations listed on the
+	// analytics view.
+	maxAnalyticsViews = 50
+)
+
+// viewStore stores declaration view counts. The database implements the
+// interface.
+type viewStore interface {
+	IncrementViews(path string, counts map[string]int, t time.Time) error
+	TopViews(path string, t time.Time, n int) ([]database.AnchorViews, error)
+	PruneViews(path string, anchors []string, t time.Time) error
+}
+
+// viewCounter accumulates view counts by package and anchor.
+type viewCounter struct {
+	sync.Mutex
+	counts map[string]map[string]int
+	n      int
+}
+
+// add counts a view of the anchor in the package.
+func (c *viewCounter) add(path, anchor string) {
+	c.Lock()
+	defer c.Unlock()
+	counts := c.counts[path]
+	if _, ok := counts[anchor]; !ok {
+		if c.n >= maxPendingViews {
+			return
+		}
+		if counts == nil {
+			if c.counts == nil {
+				c.counts = make(map[string]map[string]int)
+			}
+			counts = make(map[string]int)
+			c.counts[path] = counts
+		}
+		c.n++
+	}
+	counts[anchor]++
+}
+
+// prune removes the pending counts for anchors of the package that are not
+// in keep.
+func (c *viewCounter) prune(path string, keep map[string]bool) {
+	c.Lock()
+	defer c.Unlock()
+	for anchor := range c.counts[path] {
+		if !keep[anchor] {
+			delete(c.counts[path], anchor)
+			c.n--
+		}
+	}
+}
+
+// take returns the pending counts and resets the counter.
+func (c *viewCounter) take() map[string]map[string]int {
+	c.Lock()
+	defer c.Unlock()
+	counts := c.counts
+	c.counts = nil
+	c.n = 0
+	return counts
+}
+
+// declViews is the view store and the pending counts. The store is set in
+// main.
+var declViews struct {
+	store   viewStore
+	pending viewCounter
+}
+
+// declAnchors returns the anchors of the functions, types and methods in
+// the package.
+func declAnchors(pdoc *doc.Package) []string {
+	var anchors []string
+	for _, u := range declUses(pdoc) {
+		anchors = append(anchors, u.Anchor)
+	}
+	return anchors
+}
+
+// countView counts a view of the declaration with the given anchor. Anchors
+// that are not declarations in the current version of the package are not
+// counted.
+func countView(pdoc *doc.Package, anchor string) {
+	if declViews.store == nil || anchor == "" {
+		return
+	}
+	for _, a := range declAnchors(pdoc) {
+		if a == anchor {
+			declViews.pending.add(pdoc.ImportPath, anchor)
+			return
+		}
+	}
+}
+
+// flushViews writes the pending counts to the store with one call per
+// package.
+func flushViews(store viewStore, c *viewCounter, t time.Time) error {
+	var err error
+	for path, counts := range c.take() {
+		if e := store.IncrementViews(path, counts, t); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// flushViewsLoop writes the pending counts at the flush interval.
+func flushViewsLoop() {
+	for {
+		time.Sleep(*viewFlushInterval)
+		if err := flushViews(declViews.store, &declViews.pending, time.Now()); err != nil {
+			log.Printf("ERROR flushing declaration views: %v", err)
+		}
+	}
+}
+
+// pruneViews drops the counts for anchors that are not declarations in the
+// stored version of the package.
+func pruneViews(store viewStore, c *viewCounter, pdoc *doc.Package, t time.Time) error {
+	anchors := declAnchors(pdoc)
+	keep := make(map[string]bool, len(anchors))
+	for _, a := range anchors {
+		keep[a] = true
+	}
+	c.prune(pdoc.ImportPath, keep)
+	return store.PruneViews(pdoc.ImportPath, anchors, t)
+}
+
+// authorizedForProject returns true if the request is from an administrator
+// or has an API token authorized for the project with the given root. The
+// token is read from the Authorization header or the author key cookie.
+func authorizedForProject(req *web.Request, root string) bool {
+	if isAdmin(req) {
+		return true
+	}
+	if root == "" {
+		return false
+	}
+	token := requestAuthorKey(req)
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "token ") {
+		token = strings.TrimSpace(auth[len("token "):])
+	}
+	if token == "" {
+		return false
+	}
+	t, ok := lookupAPIToken(token)
+	return ok && t.HasRoot(root)
+}
+
+// loadAnalytics returns the most viewed declarations of the package. The
+// view is not found for clients that are not authorized for the project.
+func loadAnalytics(pdoc *doc.Package, req *web.Request) (map[string]interface{}, error) {
+	if declViews.store == nil || !authorizedForProject(req, pdoc.ProjectRoot) {
+		return nil, &web.Error{Status: web.StatusNotFound}
+	}
+	top, err := declViews.store.TopViews(pdoc.ImportPath, time.Now(), 0)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, v := range top {
+		total += v.Views
+	}
+	if len(top) > maxAnalyticsViews {
+		top = top[:maxAnalyticsViews]
+	}
+	return map[string]interface{}{
+		"views": top,
+		"total": total,
+		"days":  database.ViewDays,
+	}, nil
+}
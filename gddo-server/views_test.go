@@ -0,0 +1,253 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/indigo/web"
+)
+
+type fakeViewStore struct {
+	increments []map[string]int
+	views      map[string]map[string]int
+	pruned     map[string][]string
+}
+
+func newFakeViewStore() *fakeViewStore {
+	return &fakeViewStore{
+		views:  make(map[string]map[string]int),
+		pruned: make(map[string][]string),
+	}
+}
+
+func (s *fakeViewStore) IncrementViews(path string, counts map[string]int, t time.Time) error {
+	s.increments = append(s.increments, counts)
+	if s.views[path] == nil {
+		s.views[path] = make(map[string]int)
+	}
+	for anchor, n := range counts {
+		s.views[path][anchor] += n
+	}
+	return nil
+}
+
+func (s *fakeViewStore) TopViews(path string, t time.Time, n int) ([]database.AnchorViews, error) {
+	var result []database.AnchorViews
+	for anchor, count := range s.views[path] {
+		result = append(result, database.AnchorViews{Anchor: anchor, Views: count})
+	}
+	sort.Sort(byTestViews(result))
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
+}
+
+func (s *fakeViewStore) PruneViews(path string, anchors []string, t time.Time) error {
+	s.pruned[path] = anchors
+	keep := make(map[string]bool)
+	for _, a := range anchors {
+		keep[a] = true
+	}
+	for anchor := range s.views[path] {
+		if !keep[anchor] {
+			delete(s.views[path], anchor)
+		}
+	}
+	return nil
+}
+
+type byTestViews []database.AnchorViews
+
+func (p byTestViews) Len() int           { return len(p) }
+func (p byTestViews) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byTestViews) Less(i, j int) bool { return p[i].Views > p[j].Views }
+
+// setTestViews sets the view store to a fake and clears the pending counts.
+// The returned function restores the previous store.
+func setTestViews(store viewStore) func() {
+	saved := declViews.store
+	declViews.store = store
+	declViews.pending.take()
+	return func() {
+		declViews.store = saved
+		declViews.pending.take()
+	}
+}
+
+// setTestAPITokens replaces the loaded API tokens. The returned function
+// restores the previous tokens.
+func setTestAPITokens(m map[string]database.APIToken) func() {
+	apiTokens.Lock()
+	savedM, savedLoaded := apiTokens.m, apiTokens.loaded
+	apiTokens.m = m
+	apiTokens.loaded = time.Now()
+	apiTokens.Unlock()
+	return func() {
+		apiTokens.Lock()
+		apiTokens.m, apiTokens.loaded = savedM, savedLoaded
+		apiTokens.Unlock()
+	}
+}
+
+func TestFlushViews(t *testing.T) {
+	store := newFakeViewStore()
+	defer setTestViews(store)()
+	pdoc := fragmentTestPackage()
+
+	for _, anchor := range []string{"Copy", "Buffer.Len", "Copy", "Missing", "", "_ex_Copy"} {
+		countView(pdoc, anchor)
+	}
+	other := fragmentTestPackage()
+	other.ImportPath = "github.com/user/repo/other"
+	countView(other, "Buffer")
+
+	now := time.Unix(1400000000, 0)
+	if err := flushViews(store, &declViews.pending, now); err != nil {
+		t.Fatal(err)
+	}
+	// One write per package with the counts summed.
+	if len(store.increments) != 2 {
+		t.Fatalf("flush wrote %d batches, want 2", len(store.increments))
+	}
+	want := map[string]int{"Copy": 2, "Buffer.Len": 1}
+	if got := store.views[pdoc.ImportPath]; !reflect.DeepEqual(got, want) {
+		t.Errorf("views = %v, want %v", got, want)
+	}
+
+	// The counter is empty after a flush.
+	if err := flushViews(store, &declViews.pending, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.increments) != 2 {
+		t.Errorf("second flush wrote %d batches, want none", len(store.increments)-2)
+	}
+}
+
+func TestViewCounterLimit(t *testing.T) {
+	var c viewCounter
+	for i := 0; i < maxPendingViews; i++ {
+		c.add("example.com/p"+strconv.Itoa(i), "A")
+	}
+	c.add("example.com/new", "A")
+	c.add("example.com/p0", "B")
+	c.add("example.com/p0", "A")
+	counts := c.take()
+	if _, ok := counts["example.com/new"]; ok {
+		t.Errorf("counted new package after limit")
+	}
+	if want := map[string]int{"A": 2}; !reflect.DeepEqual(counts["example.com/p0"], want) {
+		t.Errorf("counts for example.com/p0 = %v, want %v", counts["example.com/p0"], want)
+	}
+}
+
+func TestPruneViews(t *testing.T) {
+	store := newFakeViewStore()
+	defer setTestViews(store)()
+	pdoc := fragmentTestPackage()
+	store.views[pdoc.ImportPath] = map[string]int{"Copy": 3, "Buffer.Len": 2, "Removed": 5}
+	declViews.pending.add(pdoc.ImportPath, "Removed")
+	declViews.pending.add(pdoc.ImportPath, "Copy")
+
+	if err := pruneViews(store, &declViews.pending, pdoc, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Copy", "Buffer", "Buffer.Len"}; !reflect.DeepEqual(store.pruned[pdoc.ImportPath], want) {
+		t.Errorf("pruned to anchors %v, want %v", store.pruned[pdoc.ImportPath], want)
+	}
+	if want := map[string]int{"Copy": 3, "Buffer.Len": 2}; !reflect.DeepEqual(store.views[pdoc.ImportPath], want) {
+		t.Errorf("stored views after prune = %v, want %v", store.views[pdoc.ImportPath], want)
+	}
+	if want := map[string]int{"Copy": 1}; !reflect.DeepEqual(declViews.pending.take()[pdoc.ImportPath], want) {
+		t.Errorf("pending views after prune, want %v", want)
+	}
+}
+
+func TestAnalyticsAuthorization(t *testing.T) {
+	store := newFakeViewStore()
+	defer setTestViews(store)()
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "admin-key"
+	const (
+		authorKey = "0123456789abcdef0123456789abcdef"
+		otherKey  = "fedcba9876543210fedcba9876543210"
+	)
+	defer setTestAPITokens(map[string]database.APIToken{
+		authorKey: {Label: "author", Tier: anonymousTier, Roots: []string{"github.com/user/repo"}},
+		otherKey:  {Label: "author", Tier: anonymousTier, Roots: []string{"github.com/user/other"}},
+	})()
+	pdoc := fragmentTestPackage()
+	store.views[pdoc.ImportPath] = map[string]int{"Copy": 3}
+
+	for _, tt := range []struct {
+		name   string
+		cookie url.Values
+		header web.Header
+		ok     bool
+	}{
+		{"anonymous", nil, web.Header{}, false},
+		{"admin", url.Values{"admin": {"admin-key"}}, web.Header{}, true},
+		{"author cookie", url.Values{authorCookie: {authorKey}}, web.Header{}, true},
+		{"author header", nil, web.Header{"Authorization": {"token " + authorKey}}, true},
+		{"other project", url.Values{authorCookie: {otherKey}}, web.Header{}, false},
+		{"unknown key", url.Values{authorCookie: {"00000000000000000000000000000000"}}, web.Header{}, false},
+	} {
+		req := &web.Request{Form: url.Values{"view": {"analytics"}}, Cookie: tt.cookie, Header: tt.header}
+		data, err := loadAnalytics(pdoc, req)
+		if !tt.ok {
+			if e, ok := err.(*web.Error); !ok || e.Status != web.StatusNotFound {
+				t.Errorf("%s: loadAnalytics() returned %v, want not found", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: loadAnalytics() returned error %v", tt.name, err)
+			continue
+		}
+		if data["total"] != 3 {
+			t.Errorf("%s: total = %v, want 3", tt.name, data["total"])
+		}
+	}
+}
+
+func TestAnalyticsView(t *testing.T) {
+	parseTestTemplates(t)
+	store := newFakeViewStore()
+	defer setTestViews(store)()
+	defer func(key string) { secrets.AdminKey = key }(secrets.AdminKey)
+	secrets.AdminKey = "admin-key"
+	pdoc := fragmentTestPackage()
+	store.views[pdoc.ImportPath] = map[string]int{"Copy": 3, "Buffer.Len": 1}
+
+	var resp testResponse
+	req := &web.Request{Form: url.Values{"view": {"analytics"}}, Cookie: url.Values{"admin": {"admin-key"}}, Header: web.Header{}}
+	if err := serveView(&resp, req, viewsByName["analytics"], pdoc); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.buf.String()
+	for _, s := range []string{"4 views", `href="?sel=Copy#Copy"`, "Buffer.Len"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("analytics view does not contain %q", s)
+		}
+	}
+}